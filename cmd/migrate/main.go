@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/backend"
+	"github.com/jayreddy040-510/receipt_processor/internal/migrate"
+	"github.com/jayreddy040-510/receipt_processor/internal/plugin"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+const usage = `migrate copies a deployment's data from one store to another.
+
+Usage:
+  migrate copy   --from source.env --to target.env [--batch 500]
+  migrate verify --from source.env --to target.env [--batch 500]
+
+Each store is described by a KEY=VALUE env file like myapp's --config
+(STORE_BACKEND, REDIS_ADDR, SQLITE_PATH, DYNAMODB_TABLE...). The environment is
+ignored. Every tenant in the source's TENANTS_PATH is copied, the default one always.
+
+copy is idempotent: receipts, campaigns and retailers are overwritten, user accounts replaced
+with the source's. verify compares everything copy copies and exits 1 when anything
+differs. See "Changing stores" in the README for moving a live deployment.
+
+Flags:
+  --from   env file of the store to copy from
+  --to     env file of the store to copy to
+  --batch  receipts and users read per call (default 500)
+`
+
+type options struct {
+	from, to string
+	batch    int
+}
+
+func parseFlags(name string, args []string) (*options, error) {
+	opts := &options{}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	fs.StringVar(&opts.from, "from", "", "")
+	fs.StringVar(&opts.to, "to", "", "")
+	fs.IntVar(&opts.batch, "batch", 500, "")
+	fs.Parse(args)
+	if opts.from == "" || opts.to == "" {
+		return nil, fmt.Errorf("--from and --to are required")
+	}
+	if opts.batch < 1 {
+		return nil, fmt.Errorf("--batch must be at least 1")
+	}
+	return opts, nil
+}
+
+// open opens and pings the store an env file describes
+func open(path string) (db.Store, config.Config, error) {
+	cfg, err := config.LoadEnvFile(path)
+	if err != nil {
+		return nil, config.Config{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, config.Config{}, fmt.Errorf("Error in %s: %v", path, err)
+	}
+	store, err := backend.Open(cfg)
+	if err != nil {
+		return nil, config.Config{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DbTimeoutInMs)
+	defer cancel()
+	if err := store.CheckConnection(ctx); err != nil {
+		return nil, config.Config{}, fmt.Errorf("Error connecting to database at %s: %v", backend.Addr(cfg), err)
+	}
+	return store, cfg, nil
+}
+
+func run(cmd string, args []string) (bool, error) {
+	opts, err := parseFlags(cmd, args)
+	if err != nil {
+		return false, err
+	}
+	from, fromCfg, err := open(opts.from)
+	if err != nil {
+		return false, err
+	}
+	to, _, err := open(opts.to)
+	if err != nil {
+		return false, err
+	}
+	tenants, err := tenant.NewRegistry(fromCfg.TenantsPath, plugin.New(fromCfg))
+	if err != nil {
+		return false, err
+	}
+
+	ctx := context.Background()
+	clean := true
+	out := json.NewEncoder(os.Stdout)
+	for _, t := range tenants.All() {
+		var report migrate.Report
+		if cmd == "copy" {
+			report, err = migrate.Copy(ctx, from.ForTenant(t.ID), to.ForTenant(t.ID), opts.batch, time.Now())
+		} else {
+			report, err = migrate.Verify(ctx, from.ForTenant(t.ID), to.ForTenant(t.ID), opts.batch)
+		}
+		if err != nil {
+			return false, fmt.Errorf("tenant %q: %w", t.ID, err)
+		}
+		clean = clean && report.Mismatched == 0
+		out.Encode(struct {
+			Tenant string `json:"tenant"`
+			migrate.Report
+		}{t.ID, report})
+	}
+	return clean, nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "copy", "verify":
+		clean, err := run(cmd, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !clean {
+			fmt.Fprintln(os.Stderr, "The stores differ")
+			os.Exit(1)
+		}
+	case "-h", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/clock"
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/backend"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/ocr"
+	"github.com/jayreddy040-510/receipt_processor/internal/plugin"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+const usage = `myapp runs the receipt processor API.
+
+Configuration comes from env vars (see README), optionally seeded from a KEY=VALUE
+file with --config. Flags win over env vars, env vars win over the file.
+
+Flags:
+  --port             port to serve on (overrides SERVER_PORT)
+  --redis-addr       redis host:port (overrides REDIS_ADDR)
+  --log-level        debug, info, warn or error (overrides LOG_LEVEL, default info)
+  --config           path to a KEY=VALUE env file
+  --validate-config  load the configuration, ping the store, print the resolved
+                     configuration and exit. non-zero exit code if anything's off
+  --dry-run          same as --validate-config
+  --fake-now         freeze the clock at this instant (RFC 3339 or YYYY-MM-DD) for
+                     replaying old receipts deterministically. never in production
+`
+
+type options struct {
+	port           string
+	redisAddr      string
+	logLevel       string
+	configPath     string
+	validateConfig bool
+	// nil is the wall clock
+	clock clock.Clock
+}
+
+func parseFlags(args []string) *options {
+	opts := &options{}
+	fs := flag.NewFlagSet("myapp", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	fs.StringVar(&opts.port, "port", "", "")
+	fs.StringVar(&opts.redisAddr, "redis-addr", "", "")
+	fs.StringVar(&opts.logLevel, "log-level", "", "")
+	fs.StringVar(&opts.configPath, "config", "", "")
+	fs.BoolVar(&opts.validateConfig, "validate-config", false, "")
+	fs.BoolVar(&opts.validateConfig, "dry-run", false, "")
+	fs.Func("fake-now", "", func(s string) error {
+		now, err := clock.Parse(s)
+		if err != nil {
+			return err
+		}
+		opts.clock = clock.NewFrozen(now)
+		return nil
+	})
+	fs.Parse(args)
+	return opts
+}
+
+// loadConfig resolves the configuration from the config file, env vars and flags, in
+// increasing order of precedence
+func (o *options) loadConfig() (config.Config, error) {
+	var (
+		cfg config.Config
+		err error
+	)
+	if o.configPath != "" {
+		cfg, err = config.LoadWithEnvFile(o.configPath)
+	} else {
+		cfg, err = config.Load()
+	}
+	if err != nil {
+		return config.Config{}, err
+	}
+	if o.port != "" {
+		cfg.ServerPort = o.port
+	}
+	if o.redisAddr != "" {
+		cfg.RedisAddr = o.redisAddr
+	}
+	if o.logLevel != "" {
+		cfg.LogLevel = o.logLevel
+	}
+	return cfg, cfg.Validate()
+}
+
+// setupLogging routes everything, including the std log calls all over the codebase
+// (logged like logging.Printf, at error level for lines starting with "Error"),
+// through slog. Lines logged with a request's context get its request id. The
+// returned level can be changed on the fly.
+func setupLogging(cfg config.Config) *slog.LevelVar {
+	level := &slog.LevelVar{}
+	level.Set(cfg.SlogLevel())
+	slog.SetDefault(slog.New(logging.Handler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))))
+	log.SetFlags(0)
+	log.SetOutput(logging.Writer())
+	return level
+}
+
+// fatal logs at error level so it's never filtered out by the log level, then exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// validateConfig is --validate-config: everything boot would check short of serving
+func validateConfig(cfg config.Config) error {
+	fmt.Print(cfg.Describe())
+	if _, err := ocr.New(cfg); err != nil {
+		return fmt.Errorf("Error configuring OCR: %v", err)
+	}
+	rulePlugins := plugin.New(cfg)
+	ruleRegistry, err := rules.NewRegistry(cfg.RulesPath, rulePlugins)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rules version: %s\n", ruleRegistry.Current().Version)
+	if _, err := tenant.NewRegistry(cfg.TenantsPath, rulePlugins); err != nil {
+		return err
+	}
+	store, err := backend.Open(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DbTimeoutInMs)
+	defer cancel()
+	if err := store.CheckConnection(ctx); err != nil {
+		return fmt.Errorf("Error connecting to database at %s: %v", backend.Addr(cfg), err)
+	}
+	return nil
+}
+
+// openSecondary opens the store DUAL_WRITE_CONFIG describes and checks it's reachable.
+// Its file alone configures it, the env vars are the primary's.
+func openSecondary(cfg config.Config) (db.Store, error) {
+	secondaryCfg, err := config.LoadEnvFile(cfg.DualWriteConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := secondaryCfg.Validate(); err != nil {
+		return nil, fmt.Errorf("Error in %s: %v", cfg.DualWriteConfig, err)
+	}
+	secondary, err := backend.Open(secondaryCfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secondaryCfg.DbTimeoutInMs)
+	defer cancel()
+	if err := secondary.CheckConnection(ctx); err != nil {
+		return nil, fmt.Errorf("Error connecting to database at %s: %v", backend.Addr(secondaryCfg), err)
+	}
+	log.Printf("Mirroring writes to the %s store at %s", secondaryCfg.StoreBackend, backend.Addr(secondaryCfg))
+	return secondary, nil
+}
@@ -2,63 +2,279 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/jayreddy040-510/receipt_processor/internal/app"
-	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/archive"
+	"github.com/jayreddy040-510/receipt_processor/internal/breaker"
+	"github.com/jayreddy040-510/receipt_processor/internal/chaos"
+	"github.com/jayreddy040-510/receipt_processor/internal/concurrency"
 	"github.com/jayreddy040-510/receipt_processor/internal/db"
-
-	"github.com/go-chi/chi"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/backend"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/dualwrite"
+	"github.com/jayreddy040-510/receipt_processor/internal/events"
+	"github.com/jayreddy040-510/receipt_processor/internal/jobs"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/lru"
+	"github.com/jayreddy040-510/receipt_processor/internal/metrics"
+	"github.com/jayreddy040-510/receipt_processor/internal/ocr"
+	"github.com/jayreddy040-510/receipt_processor/internal/oidc"
+	"github.com/jayreddy040-510/receipt_processor/internal/outbox"
+	"github.com/jayreddy040-510/receipt_processor/internal/plugin"
+	"github.com/jayreddy040-510/receipt_processor/internal/report"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+	"github.com/jayreddy040-510/receipt_processor/internal/webhook"
 )
 
+// how long a SIGTERM waits for requests in flight, streams are cut off after it
+const shutdownTimeout = 30 * time.Second
+
 func main() {
+	opts := parseFlags(os.Args[1:])
+
 	// load config
 	log.Println("Loading configuration...")
-	cfg, err := config.Load()
+	cfg, err := opts.loadConfig()
 	if err != nil {
-		log.Fatalf("Error loading configuration: %v", err)
+		fatal("Error loading configuration", err)
+	}
+	logLevel := setupLogging(cfg)
+	if opts.validateConfig {
+		if err := validateConfig(cfg); err != nil {
+			fatal("Configuration is invalid", err)
+		}
+		fmt.Println("Configuration is valid")
 		return
 	}
 	log.Println("Configuration loaded!")
 
 	// init and check connection to db
-	log.Println("Initializing DB client and testing connection...")
-	db := db.NewRedisStore(cfg)
+	log.Printf("Initializing %s store and testing connection...", cfg.StoreBackend)
+	store, err := backend.Open(cfg)
+	if err != nil {
+		fatal("Error opening database", err)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), cfg.DbTimeoutInMs)
 	defer cancel()
-	if err := db.CheckConnection(ctx); err != nil {
-		log.Fatalf("Error connecting to database: %v", err)
+	if err := store.CheckConnection(ctx); err != nil {
+		fatal("Error connecting to database", err)
 	}
 	log.Println("Successfully connected to DB!")
 
+	// retries, the circuit breaker and the write limiter are about a remote Redis. a
+	// local SQLite file goes without, and so does DynamoDB, the AWS SDK retries itself
+	var storeBreaker *breaker.Breaker
+	var faults *chaos.Injector
+	if redisStore, ok := store.(*db.RedisStore); ok {
+		storeBreaker = redisStore.Breaker()
+		metrics.PublishFunc("store_breaker", func() interface{} { return redisStore.Breaker().Stats() })
+		metrics.PublishFunc("store_write_limiter", func() interface{} { return redisStore.WriteLimiter().Stats() })
+		// fault injection is for staging, it's loud about being on
+		if cfg.ChaosMode {
+			log.Printf("CHAOS_MODE is on, faults can be injected into the store and scoring through /admin/chaos")
+			faults = chaos.New()
+			redisStore.InjectFaults(faults)
+			metrics.PublishFunc("chaos", func() interface{} { return faults.Stats() })
+		}
+	}
+
+	// dual writes are opt-in, for moving to another store with cmd/migrate
+	if cfg.DualWriteConfig != "" {
+		secondary, err := openSecondary(cfg)
+		if err != nil {
+			fatal("Error opening the dual write store", err)
+		}
+		mirrored := dualwrite.New(store, secondary)
+		metrics.PublishFunc("dual_write", func() interface{} { return mirrored.MirrorStats() })
+		store = mirrored
+	}
+
+	// init webhook dispatcher, delivers in the background for the life of the process
+	webhooks := webhook.NewDispatcher(cfg, func(tenantID string) webhook.Registry {
+		return store.ForTenant(tenantID)
+	})
+	webhooks.Start(context.Background(), 4)
+
+	// load the points rules, RULES_PATH unset means the built-in ones. their plugins
+	// only run with RULE_PLUGIN_DIR set
+	rulePlugins := plugin.New(cfg)
+	ruleRegistry, err := rules.NewRegistry(cfg.RulesPath, rulePlugins)
+	if err != nil {
+		fatal("Error loading rules", err)
+	}
+	log.Printf("Scoring with rules version %s", ruleRegistry.Current().Version)
+
+	// tenants are opt-in, TENANTS_PATH unset means a single tenant and no API keys
+	tenants, err := tenant.NewRegistry(cfg.TenantsPath, rulePlugins)
+	if err != nil {
+		fatal("Error loading tenants", err)
+	}
+	if tenants.Enabled() {
+		log.Printf("Serving %d tenants", len(tenants.All())-1)
+	}
+
+	// background jobs (recalculations) run on a couple of workers for the life of the
+	// process
+	jobRunner := jobs.NewRunner(16)
+	jobRunner.Start(context.Background(), 2)
+
 	// init shared resources struct
 	a := &app.App{
-		Db: db,
-        Config: cfg,
+		Db:           store,
+		Breaker:      storeBreaker,
+		Config:       cfg,
+		Webhooks:     webhooks,
+		Rules:        ruleRegistry,
+		Jobs:         jobRunner,
+		Tenants:      tenants,
+		RateLimiter:  tenant.NewLimiter(),
+		Processing:   concurrency.New(cfg.MaxConcurrentReceipts, cfg.ReceiptQueueSize, cfg.ConcurrencyQueueWaitInMs),
+		Requests:     concurrency.NewPriority(cfg.MaxInFlightRequests, cfg.LookupReservedRequests, cfg.InFlightQueueSize, cfg.ConcurrencyQueueWaitInMs),
+		Stream:       events.NewHub(cfg.EventStreamBufferSize, cfg.MaxEventStreams),
+		ReceiptCache: lru.New[db.ReceiptRecord](cfg.ReceiptCacheSize, cfg.ReceiptCacheTTLInMs),
+		Chaos:        faults,
+		Clock:        opts.clock,
+		LoadConfig:   opts.loadConfig,
+		LogLevel:     logLevel,
+	}
+	if opts.clock != nil {
+		log.Printf("Clock frozen at %s by --fake-now, receipts are scored and stamped as of then", opts.clock.Now().Format(time.RFC3339))
 	}
+	a.StartCampaignRefresh(context.Background(), cfg.CampaignRefreshInMs)
+	a.StartPointsExpirySweeper(context.Background(), cfg.PointsExpirySweepInMs)
+	a.StartRetentionSweeper(context.Background(), cfg.RetentionSweepInMs)
+	if cfg.FraudBloomFilter {
+		if _, ok := store.(db.FingerprintFilterStore); ok {
+			log.Printf("Checking for duplicates through a Bloom filter, synced every %v", cfg.FraudBloomSyncInMs)
+		} else {
+			log.Printf("FRAUD_BLOOM_FILTER is ignored while dual writing, every duplicate check asks the store")
+		}
+		a.StartFingerprintSync(context.Background(), cfg.FraudBloomSyncInMs)
+	}
+	metrics.PublishFunc("processing_limiter", func() interface{} { return a.Processing.Stats() })
+	metrics.PublishFunc("request_limiter", func() interface{} { return a.Requests.Stats() })
+	metrics.PublishFunc("event_streams", func() interface{} { return a.Stream.Stats() })
+	metrics.PublishFunc("receipt_cache", func() interface{} { return a.ReceiptCache.Stats() })
 
-	// init router
-	r := chi.NewRouter()
+	// kafka publishing is opt-in, only enabled when brokers are configured
+	var kafkaPublisher *events.KafkaPublisher
+	if len(cfg.KafkaBrokers) > 0 {
+		log.Printf("Publishing receipt events to Kafka topic %q", cfg.KafkaTopic)
+		kafkaPublisher = events.NewKafkaPublisher(cfg)
+		kafkaPublisher.Start()
+		a.Events = kafkaPublisher
+	}
 
-	r.Use(func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx, cancel := context.WithTimeout(r.Context(), cfg.RequestTimeoutInMs)
-			defer cancel()
+	// archiving is opt-in as well, only enabled when a bucket is configured
+	if cfg.ArchiveBucket != "" {
+		archiver, err := archive.New(context.Background(), cfg)
+		if err != nil {
+			fatal("Error configuring the archive", err)
+		}
+		log.Printf("Archiving submitted receipts to bucket %q", cfg.ArchiveBucket)
+		archiver.Start(context.Background(), 4)
+		metrics.PublishFunc("archive", func() interface{} { return archiver.Stats() })
+		a.Archive = archiver
+	}
 
-			next.ServeHTTP(w, r.WithContext(ctx))
-		})
-	})
+	// scheduled reports are opt-in, they need a destination and a schedule to be sent.
+	// they're archived through the archiver, so this comes after it
+	if cfg.HasReportDestination() {
+		a.Reports = report.New(cfg, a.Archive)
+		if cfg.ReportDailySchedule != "" || cfg.ReportWeeklySchedule != "" {
+			log.Printf("Sending reports on schedules %q (daily) and %q (weekly), in UTC", cfg.ReportDailySchedule, cfg.ReportWeeklySchedule)
+		}
+		a.StartReportScheduler(context.Background(), time.Minute)
+	}
 
-	// connect routes to handlers
-	r.Route("/receipts", func(r chi.Router) {
-		r.Post("/process", a.ProcessReceiptHandler)
-		r.Get("/{id}/points", a.GetPointsHandler)
-	})
+	// the outbox is opt-in, without OUTBOX_PATH or DEGRADED_MODE store outages fail the
+	// request
+	if cfg.OutboxPath != "" || cfg.DegradedMode {
+		receiptOutbox := outbox.New(cfg.OutboxMaxEntries)
+		if cfg.OutboxPath != "" {
+			receiptOutbox, err = outbox.Open(cfg.OutboxPath, cfg.OutboxMaxEntries)
+			if err != nil {
+				fatal("Error opening the outbox", err)
+			}
+			log.Printf("Queueing receipts in %s while the store is unavailable, %d pending", cfg.OutboxPath, receiptOutbox.Len())
+		} else {
+			log.Printf("Queueing receipts in memory while the store is unavailable, they're lost if the process exits before it's back")
+		}
+		if cfg.DegradedMode {
+			log.Printf("Degraded mode on, receipts are taken as provisional while the store is down")
+		}
+		metrics.PublishFunc("outbox", func() interface{} { return receiptOutbox.Stats() })
+		a.Outbox = receiptOutbox
+		a.StartOutboxFlusher(context.Background(), cfg.OutboxFlushInMs)
+	}
+
+	// OCR is opt-in too, the image endpoint only exists with a backend configured
+	ocrExtractor, err := ocr.New(cfg)
+	if err != nil {
+		fatal("Error configuring OCR", err)
+	}
+	a.OCR = ocrExtractor
+
+	// with an OIDC provider admins sign in there, the provider has to be up at boot
+	if cfg.OIDCIssuerURL != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		provider, err := oidc.Discover(ctx, &http.Client{Timeout: 10 * time.Second}, cfg.OIDCIssuerURL, cfg.OIDCClientID, cfg.OIDCClientSecret, cfg.OIDCRedirectURL)
+		cancel()
+		if err != nil {
+			fatal("Error configuring OIDC", err)
+		}
+		log.Printf("Admins sign in through OIDC provider %s", cfg.OIDCIssuerURL)
+		a.OIDC = provider
+	}
+
+	// SIGHUP reloads rules and tunables, same as POST /admin/reload
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := a.Reload(); err != nil {
+				logging.Errorf(context.Background(), "Reload on SIGHUP failed, keeping the current config and rules: %v", err)
+			}
+		}
+	}()
+
+	// SIGTERM and SIGINT stop taking requests, give the ones in flight a while to finish
+	// and then flush the Kafka events they published. Event streams never finish on
+	// their own, they're ended right away
+	server := a.Server(":" + cfg.ServerPort)
+	server.RegisterOnShutdown(a.Stream.Close)
+	stopped := make(chan struct{})
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		defer close(stopped)
+		sig := <-term
+		log.Printf("Got %v, shutting down within %v...", sig, shutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logging.Errorf(context.Background(), "Error waiting for requests in flight, exiting anyway: %v", err)
+		}
+	}()
 
 	// boot up server
 	log.Printf("Starting server on :%s...", cfg.ServerPort)
-	if err := http.ListenAndServe(":"+cfg.ServerPort, r); err != nil {
-		log.Fatalf("Server exited: %v", err)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fatal("Server exited", err)
+	}
+	<-stopped
+	if kafkaPublisher != nil {
+		if err := kafkaPublisher.Close(); err != nil {
+			logging.Errorf(context.Background(), "Error closing the Kafka writer: %v", err)
+		}
 	}
+	log.Println("Server stopped")
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/jayreddy040-510/receipt_processor/pkg/client"
+)
+
+type result struct {
+	Input  string `json:"input"`
+	ID     string `json:"id,omitempty"`
+	Points *int   `json:"points,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func runSubmit(args []string) error {
+	fs, opts := newFlagSet("submit")
+	dir := fs.String("dir", "", "")
+	fs.Parse(args)
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	files := fs.Args()
+	if *dir != "" {
+		matches, err := filepath.Glob(filepath.Join(*dir, "*.json"))
+		if err != nil {
+			return fmt.Errorf("Error listing %s: %v", *dir, err)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("nothing to submit, pass files or --dir")
+	}
+
+	c := opts.client()
+	results := runConcurrently(files, opts.concurrency, func(file string) result {
+		res := result{Input: file}
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		var receipt client.Receipt
+		if err := json.Unmarshal(raw, &receipt); err != nil {
+			res.Error = fmt.Sprintf("invalid JSON: %v", err)
+			return res
+		}
+		id, err := c.ProcessReceipt(context.Background(), receipt)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.ID = string(id)
+		return res
+	})
+	return report(results, opts.output)
+}
+
+func runPoints(args []string) error {
+	fs, opts := newFlagSet("points")
+	fs.Parse(args)
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("pass at least one receipt id")
+	}
+
+	c := opts.client()
+	results := runConcurrently(fs.Args(), opts.concurrency, func(id string) result {
+		res := result{Input: id, ID: id}
+		points, err := c.GetPoints(context.Background(), client.ID(id))
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.Points = &points
+		return res
+	})
+	return report(results, opts.output)
+}
+
+// runConcurrently calls fn for every input with at most n calls in flight, keeping
+// results in input order
+func runConcurrently(inputs []string, n int, fn func(string) result) []result {
+	results := make([]result, len(inputs))
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i, input := range inputs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, input string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = fn(input)
+		}(i, input)
+	}
+	wg.Wait()
+	return results
+}
+
+func report(results []result, output string) error {
+	var failed int
+	for _, res := range results {
+		if res.Error != "" {
+			failed++
+		}
+	}
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "INPUT\tID\tPOINTS\tERROR")
+		for _, res := range results {
+			points := "-"
+			if res.Points != nil {
+				points = fmt.Sprint(*res.Points)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", res.Input, orDash(res.ID), points, orDash(res.Error))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d requests failed", failed, len(results))
+	}
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/pkg/client"
+)
+
+const usage = `receiptctl talks to a running receipt processor.
+
+Usage:
+  receiptctl submit [flags] file.json [file.json...]
+  receiptctl submit [flags] --dir ./receipts
+  receiptctl points [flags] id [id...]
+
+Flags (must come before positional arguments):
+  --base-url     server to talk to (default $RECEIPTCTL_BASE_URL or http://localhost:8080)
+  --concurrency  number of requests in flight at once (default 4)
+  --timeout      per request timeout (default 5s)
+  --output       json or table (default table)
+  --dir          submit only: submit every *.json file in this directory
+`
+
+type options struct {
+	baseURL     string
+	concurrency int
+	timeout     time.Duration
+	output      string
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *options) {
+	opts := &options{}
+	defaultBaseURL := os.Getenv("RECEIPTCTL_BASE_URL")
+	if defaultBaseURL == "" {
+		defaultBaseURL = "http://localhost:8080"
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	fs.StringVar(&opts.baseURL, "base-url", defaultBaseURL, "")
+	fs.IntVar(&opts.concurrency, "concurrency", 4, "")
+	fs.DurationVar(&opts.timeout, "timeout", 5*time.Second, "")
+	fs.StringVar(&opts.output, "output", "table", "")
+	return fs, opts
+}
+
+func (o *options) validate() error {
+	if o.concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+	if o.output != "json" && o.output != "table" {
+		return fmt.Errorf("--output must be json or table, got %q", o.output)
+	}
+	return nil
+}
+
+func (o *options) client() *client.Client {
+	return client.New(o.baseURL, client.WithTimeout(o.timeout))
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "submit":
+		err = runSubmit(args)
+	case "points":
+		err = runPoints(args)
+	case "-h", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
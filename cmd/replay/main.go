@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/app"
+	"github.com/jayreddy040-510/receipt_processor/internal/archive"
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/plugin"
+	"github.com/jayreddy040-510/receipt_processor/internal/replay"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+)
+
+const usage = `replay scores archived receipts again with candidate rules, offline, and reports
+how their points would change.
+
+Usage:
+  replay --config service.env [--rules candidate.json] --export receipts.jsonl
+  replay --config service.env [--rules candidate.json] --archive
+  replay --config service.env [--rules candidate.json] --dir ./archive
+
+service.env is the service's KEY=VALUE env file like myapp's --config. Its
+RULES_PATH is the baseline, RULE_PLUGIN_DIR, BUSINESS_TIMEZONE and MAX_RECEIPT_ITEMS
+apply to both rule sets. Nothing is read from or written to the store.
+
+Receipts from an export (GET /admin/export?raw=true, - for stdin) are compared with
+the points they were stored with. Receipts from the archive (ARCHIVE_BUCKET and
+friends from service.env, or a local copy of it with --dir) are compared with what the
+baseline rules give them. The report is printed as JSON. See "Replaying receipts" in
+the README.
+
+Flags:
+  --config          env file of the service
+  --rules           rules file to replay with (default the baseline)
+  --campaigns       campaigns to apply, as GET /admin/campaigns answers (default none)
+  --export          export file to replay
+  --archive         replay the archive bucket
+  --dir             replay a copy of the archive on disk
+  --changes         changes and failures listed in the report (default 1000)
+  --fail-on-change  exit 1 when any receipt's points change
+`
+
+type options struct {
+	config, rules, campaigns string
+	export, dir              string
+	archive, failOnChange    bool
+	changes                  int
+}
+
+func parseFlags(args []string) (*options, error) {
+	opts := &options{}
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	fs.StringVar(&opts.config, "config", "", "")
+	fs.StringVar(&opts.rules, "rules", "", "")
+	fs.StringVar(&opts.campaigns, "campaigns", "", "")
+	fs.StringVar(&opts.export, "export", "", "")
+	fs.BoolVar(&opts.archive, "archive", false, "")
+	fs.StringVar(&opts.dir, "dir", "", "")
+	fs.IntVar(&opts.changes, "changes", 1000, "")
+	fs.BoolVar(&opts.failOnChange, "fail-on-change", false, "")
+	fs.Parse(args)
+	if opts.config == "" {
+		return nil, fmt.Errorf("--config is required")
+	}
+	sources := 0
+	for _, set := range []bool{opts.export != "", opts.archive, opts.dir != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, fmt.Errorf("one of --export, --archive and --dir is required")
+	}
+	if opts.changes < 0 {
+		return nil, fmt.Errorf("--changes must not be negative")
+	}
+	return opts, nil
+}
+
+func readCampaigns(path string) ([]db.Campaign, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading campaigns file: %v", err)
+	}
+	var listed struct {
+		Campaigns []db.Campaign `json:"campaigns"`
+	}
+	if err := json.Unmarshal(data, &listed); err != nil {
+		return nil, fmt.Errorf("Error decoding campaigns file: %v", err)
+	}
+	return listed.Campaigns, nil
+}
+
+func run(opts *options) (replay.Report, error) {
+	cfg, err := config.LoadEnvFile(opts.config)
+	if err != nil {
+		return replay.Report{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return replay.Report{}, fmt.Errorf("Error in %s: %v", opts.config, err)
+	}
+	registry, err := rules.NewRegistry(cfg.RulesPath, plugin.New(cfg))
+	if err != nil {
+		return replay.Report{}, err
+	}
+	candidate := registry.Current()
+	if opts.rules != "" {
+		data, err := os.ReadFile(opts.rules)
+		if err != nil {
+			return replay.Report{}, fmt.Errorf("Error reading rules file: %v", err)
+		}
+		if candidate, err = registry.Parse(data); err != nil {
+			return replay.Report{}, err
+		}
+	}
+	campaigns, err := readCampaigns(opts.campaigns)
+	if err != nil {
+		return replay.Report{}, err
+	}
+	// Validate checked the zone loads
+	loc, _ := time.LoadLocation(cfg.BusinessTimezone)
+	now := time.Now().In(loc)
+	baseline := app.Scorer{Rules: registry.Current(), Campaigns: campaigns, MaxItems: cfg.MaxReceiptItems, Now: now}
+	replayer := replay.New(
+		app.Scorer{Rules: candidate, Campaigns: campaigns, MaxItems: cfg.MaxReceiptItems, Now: now},
+		baseline, candidate.Version, opts.changes)
+	add := func(rec replay.Receipt) error {
+		replayer.Add(rec)
+		return nil
+	}
+
+	ctx := context.Background()
+	switch {
+	case opts.export != "":
+		var in io.Reader = os.Stdin
+		if opts.export != "-" {
+			f, err := os.Open(opts.export)
+			if err != nil {
+				return replay.Report{}, fmt.Errorf("Error opening export: %v", err)
+			}
+			defer f.Close()
+			in = f
+		}
+		err = replay.ReadExport(in, add)
+	case opts.dir != "":
+		err = replay.ReadArchive(ctx, replay.Dir(opts.dir), add)
+	default:
+		if cfg.ArchiveBucket == "" {
+			return replay.Report{}, fmt.Errorf("--archive needs ARCHIVE_BUCKET in %s", opts.config)
+		}
+		var bucket *archive.Archiver
+		if bucket, err = archive.New(ctx, cfg); err != nil {
+			return replay.Report{}, err
+		}
+		err = replay.ReadArchive(ctx, bucket, add)
+	}
+	return replayer.Report(), err
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "-h", "--help", "help":
+			fmt.Fprint(os.Stdout, usage)
+			return
+		}
+	}
+	opts, err := parseFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n%s", err, usage)
+		os.Exit(2)
+	}
+	report, err := run(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	out.Encode(report)
+	if opts.failOnChange && report.Changed > 0 {
+		fmt.Fprintf(os.Stderr, "Points changed on %d receipts\n", report.Changed)
+		os.Exit(1)
+	}
+}
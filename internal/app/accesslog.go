@@ -0,0 +1,86 @@
+package app
+
+import (
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+// accessLogWriter records what went out for the access log line
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. for full duplex
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// AccessLog logs one line per request: who called what and how it went. Only
+// ACCESS_LOG_SAMPLE_RATE of the requests are logged, except server errors, which always
+// are. Paths in ACCESS_LOG_EXCLUDE are never logged. API keys are logged as the start
+// of their hash in the tenants file, never as they were sent.
+func (a *App) AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(a.Config.AccessLogExclude, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		lw := &accessLogWriter{ResponseWriter: w}
+		// deferred so that aborted streams are logged too
+		defer func() {
+			status := lw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if status < 500 && rand.Float64() >= a.config().AccessLogSampleRate {
+				return
+			}
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", status),
+				slog.Duration("latency", time.Since(start)),
+				slog.Int64("bytes", lw.bytes),
+				slog.String("remote_addr", r.RemoteAddr),
+			}
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				attrs = append(attrs, slog.String("route", rctx.RoutePattern()))
+			}
+			if key := r.Header.Get(apiKeyHeader); key != "" {
+				attrs = append(attrs, slog.String("api_key", tenant.HashAPIKey(key)[:apiKeyIDLength]))
+			}
+			slog.LogAttrs(r.Context(), slog.LevelInfo, "access", attrs...)
+		}()
+		next.ServeHTTP(lw, r)
+	})
+}
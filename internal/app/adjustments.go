@@ -0,0 +1,199 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+const (
+	maxAdjustmentPoints = 1000000
+	maxReasonLen        = 256
+)
+
+type adjustmentRequest struct {
+	ID     string `json:"id"`
+	Points int    `json:"points"`
+	Reason string `json:"reason"`
+}
+
+// pointsAdjustment is an adjustment the way clients see it, without who made it
+type pointsAdjustment struct {
+	ID        string    `json:"id" xml:"id"`
+	ReceiptID string    `json:"receiptId,omitempty" xml:"receiptId,omitempty"`
+	Points    int       `json:"points" xml:"points"`
+	Reason    string    `json:"reason" xml:"reason"`
+	CreatedAt time.Time `json:"createdAt" xml:"createdAt"`
+}
+
+func newPointsAdjustments(adjustments []db.Adjustment) []pointsAdjustment {
+	views := make([]pointsAdjustment, len(adjustments))
+	for i, adj := range adjustments {
+		views[i] = pointsAdjustment{ID: adj.ID, ReceiptID: adj.ReceiptID, Points: adj.Points, Reason: adj.Reason, CreatedAt: adj.CreatedAt}
+	}
+	return views
+}
+
+// decodeAdjustmentRequest reads an adjustment like a redemption, the id can come as an
+// idempotency key. Without one the adjustment gets a fresh id and retrying it adjusts
+// again.
+func decodeAdjustmentRequest(r *http.Request) (adjustmentRequest, error) {
+	var req adjustmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return adjustmentRequest{}, fmt.Errorf("Error decoding adjustment: %v", err)
+	}
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		if req.ID != "" && req.ID != key {
+			return adjustmentRequest{}, fmt.Errorf("Adjustment id %q doesn't match %s %q", req.ID, idempotencyKeyHeader, key)
+		}
+		req.ID = key
+	}
+	if req.ID == "" {
+		req.ID = uuid.NewString()
+	}
+	switch {
+	case !isValidUserID(req.ID):
+		return adjustmentRequest{}, fmt.Errorf("Invalid adjustment id %q", req.ID)
+	case req.Points == 0 || req.Points > maxAdjustmentPoints || req.Points < -maxAdjustmentPoints:
+		return adjustmentRequest{}, fmt.Errorf("Adjustment points must be between -%d and %d and not 0, got %d", maxAdjustmentPoints, maxAdjustmentPoints, req.Points)
+	case req.Reason == "":
+		return adjustmentRequest{}, fmt.Errorf("Adjustment has no reason")
+	case len(req.Reason) > maxReasonLen:
+		return adjustmentRequest{}, fmt.Errorf("Reason is longer than %d characters", maxReasonLen)
+	}
+	return req, nil
+}
+
+// receiptAdjustments are the adjustments of a stored receipt, newest first, and the
+// points it comes to with them. Only receipts whose points went to a user can have any.
+func (a *App) receiptAdjustments(ctx context.Context, rec db.ReceiptRecord) ([]db.Adjustment, int, error) {
+	if rec.UserID == "" || rec.Status != "" {
+		return nil, rec.Points, nil
+	}
+	adjustments, err := a.store(ctx).ListAdjustments(ctx, rec.UserID, rec.ID, db.MaxReceiptAdjustments)
+	if err != nil {
+		return nil, 0, err
+	}
+	points := rec.Points
+	for _, adj := range adjustments {
+		points += adj.Points
+	}
+	return adjustments, points, nil
+}
+
+// AdjustReceiptHandler credits or claws back points of a receipt, e.g. goodwill points
+// or points of a receipt found to be fraudulent later. The receipt keeps the points it
+// was scored with, the adjustment is a ledger entry moving its user's balance, and the
+// receipt's points are answered with it added. Only receipts whose points went to a
+// user can be adjusted, and not below zero.
+func (a *App) AdjustReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if ok, err := isValidUUIDv4(id); !ok {
+		logging.Printf(r.Context(), "%v", err)
+		http.Error(w, "No receipt found for that id", http.StatusNotFound)
+		return
+	}
+	defer r.Body.Close()
+	req, err := decodeAdjustmentRequest(r)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	stored, err := a.store(ctx).GetReceipt(ctx, id)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "No receipt found for that id", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading receipt", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case stored.UserID == "":
+		http.Error(w, "The receipt has no user, there are no points to adjust", http.StatusConflict)
+		return
+	case stored.Status != "":
+		http.Error(w, "The receipt is held for fraud review, approve or reject it instead", http.StatusConflict)
+		return
+	}
+	// the store checks the receipt's adjusted total against its points as stored, in
+	// the same step as the write so concurrent clawbacks or a correction can't slip by
+	a.adjust(w, r, db.Adjustment{ID: req.ID, UserID: stored.UserID, ReceiptID: id, Points: req.Points, Reason: req.Reason})
+}
+
+// AdjustUserPointsHandler credits or claws back points of a user, for corrections that
+// aren't about one receipt
+func (a *App) AdjustUserPointsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "id")
+	if !isValidUserID(userID) {
+		http.Error(w, "Invalid user id", http.StatusNotFound)
+		return
+	}
+	defer r.Body.Close()
+	req, err := decodeAdjustmentRequest(r)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.adjust(w, r, db.Adjustment{ID: req.ID, UserID: userID, Points: req.Points, Reason: req.Reason})
+}
+
+// adjust records adj in the user's ledger and answers with it, 201 when it's new and
+// 200 when its id was used for it before. A clawback can't take the balance below zero,
+// nor the receipt's points with its adjustments.
+func (a *App) adjust(w http.ResponseWriter, r *http.Request, adj db.Adjustment) {
+	adj.By = adminFromContext(r.Context()).subject
+	adj.CreatedAt = a.now().UTC()
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	adjusted, created, err := a.store(ctx).Adjust(ctx, adj)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		switch {
+		case a.writeStoreUnavailable(w, r, err):
+		case errors.Is(err, db.ErrInsufficientPoints):
+			http.Error(w, "The user's balance doesn't cover the clawback", http.StatusUnprocessableEntity)
+		case errors.Is(err, db.ErrNotFound):
+			http.Error(w, "No receipt found for that id", http.StatusNotFound)
+		case errors.Is(err, db.ErrReceiptOverdrawn):
+			http.Error(w, "The receipt doesn't have that many points left to claw back", http.StatusUnprocessableEntity)
+		case errors.Is(err, db.ErrTooManyAdjustments):
+			http.Error(w, fmt.Sprintf("The receipt has %d adjustments already", db.MaxReceiptAdjustments), http.StatusConflict)
+		case errors.Is(err, db.ErrAdjustmentConflict):
+			http.Error(w, "The adjustment id was already used for a different adjustment", http.StatusConflict)
+		default:
+			http.Error(w, "Error adjusting points", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		logging.Printf(r.Context(), "Adjusted points of user %s by %d (receipt %q, by %q): %s",
+			adj.UserID, adj.Points, adj.ReceiptID, adj.By, adj.Reason)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(adjusted); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
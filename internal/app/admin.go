@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+type webhookRequest struct {
+	URL string `json:"url"`
+}
+
+type listWebhooksResponse struct {
+	Configured []string `json:"configured"`
+	Registered []string `json:"registered"`
+}
+
+func isValidWebhookURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (a *App) ListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	registered, err := a.store(ctx).ListWebhooks(ctx)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "Error listing webhooks", http.StatusInternalServerError)
+		return
+	}
+	responseToClient := listWebhooksResponse{
+		Configured: append([]string{}, a.config().WebhookURLs...),
+		Registered: append([]string{}, registered...),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+func (a *App) decodeWebhookRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req webhookRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	defer r.Body.Close()
+	if err != nil || !isValidWebhookURL(req.URL) {
+		logging.Printf(r.Context(), "Invalid webhook request: %+v, %v", req, err)
+		http.Error(w, "Webhook url must be an absolute http(s) url", http.StatusBadRequest)
+		return "", false
+	}
+	return req.URL, true
+}
+
+func (a *App) RegisterWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookURL, ok := a.decodeWebhookRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	if err := a.store(ctx).AddWebhook(ctx, webhookURL); err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "Error registering webhook", http.StatusInternalServerError)
+		return
+	}
+	logging.Printf(r.Context(), "Registered webhook %s", webhookURL)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (a *App) RemoveWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookURL, ok := a.decodeWebhookRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	if err := a.store(ctx).RemoveWebhook(ctx, webhookURL); err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "Error removing webhook", http.StatusInternalServerError)
+		return
+	}
+	logging.Printf(r.Context(), "Removed webhook %s", webhookURL)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,230 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/oidc"
+)
+
+// what an admin may do, granted through OIDC_ROLES. capAdmin covers all of them, the
+// static ADMIN_TOKEN has it
+const (
+	capRead   = "read"
+	capReview = "review"
+	capRules  = "rules"
+	capPurge  = "purge"
+	capAdmin  = "admin"
+)
+
+const (
+	// the signed in admin's ID token, for browsers
+	sessionCookie = "admin_session"
+	// state, nonce and where to go back to while a browser is off signing in
+	loginCookie  = "admin_login"
+	loginTimeout = 10 * time.Minute
+	// where a browser lands after signing in when it wasn't sent to sign in from a page
+	adminHome = "/admin/ui/"
+)
+
+// admin is who's calling an /admin route and what they may do
+type admin struct {
+	subject      string
+	capabilities map[string]bool
+}
+
+func (ad admin) can(capability string) bool {
+	return ad.capabilities[capAdmin] || ad.capabilities[capability]
+}
+
+type adminKey struct{}
+
+func adminFromContext(ctx context.Context) admin {
+	ad, _ := ctx.Value(adminKey{}).(admin)
+	return ad
+}
+
+// authenticateAdmin is the admin r comes from. Without OIDC that's the ADMIN_TOKEN as
+// a bearer token, with it a token the provider issued, as a bearer token or the
+// session cookie a browser got on signing in.
+func (a *App) authenticateAdmin(r *http.Request) (admin, bool) {
+	token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if a.OIDC == nil {
+		if !bearer || a.Config.AdminToken == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(a.Config.AdminToken)) != 1 {
+			return admin{}, false
+		}
+		return admin{subject: "admin token", capabilities: map[string]bool{capAdmin: true}}, true
+	}
+	if !bearer {
+		cookie, err := r.Cookie(sessionCookie)
+		if err != nil {
+			return admin{}, false
+		}
+		token = cookie.Value
+	}
+	claims, err := a.OIDC.Verify(r.Context(), token)
+	if err != nil {
+		logging.Warnf(r.Context(), "Rejected an admin token: %v", err)
+		return admin{}, false
+	}
+	return a.adminFromClaims(claims), true
+}
+
+// adminFromClaims grants the capabilities OIDC_ROLES maps the token's roles onto. Any
+// mapped role can read.
+func (a *App) adminFromClaims(claims oidc.Claims) admin {
+	ad := admin{subject: claims.Subject(), capabilities: make(map[string]bool)}
+	for _, role := range claims.Strings(a.Config.OIDCRolesClaim) {
+		capabilities, ok := a.Config.OIDCRoles[role]
+		if !ok {
+			continue
+		}
+		ad.capabilities[capRead] = true
+		for _, capability := range capabilities {
+			ad.capabilities[capability] = true
+		}
+	}
+	return ad
+}
+
+// RequireAdmin guards the /admin routes. Callers have to be signed in (see
+// authenticateAdmin) and hold at least one capability, what each route needs on top
+// is checked by RequireCapability. Browsers that aren't signed in are sent to sign in
+// when OIDC_REDIRECT_URL is set.
+func (a *App) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ad, ok := a.authenticateAdmin(r)
+		if !ok {
+			if a.OIDC != nil && a.OIDC.Login() && r.Method == http.MethodGet &&
+				strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/admin/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if len(ad.capabilities) == 0 {
+			logging.Printf(r.Context(), "Admin %q has no role mapped in OIDC_ROLES", ad.subject)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminKey{}, ad)))
+	})
+}
+
+// RequireCapability lets through admins who may do capability, behind RequireAdmin
+func (a *App) RequireCapability(capability string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ad := adminFromContext(r.Context())
+			if !ad.can(capability) {
+				logging.Printf(r.Context(), "Admin %q needs the %s capability for %s %s", ad.subject, capability, r.Method, r.URL.Path)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// LoginHandler sends a browser off to the OIDC provider to sign in. It comes back to
+// CallbackHandler, which sends it on to next.
+func (a *App) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	state, nonce := randomToken(), randomToken()
+	next := r.URL.Query().Get("next")
+	if !isAdminPath(next) {
+		next = adminHome
+	}
+	http.SetCookie(w, a.adminCookie(loginCookie, state+"|"+nonce+"|"+next, loginTimeout))
+	http.Redirect(w, r, a.OIDC.AuthCodeURL(state, nonce), http.StatusFound)
+}
+
+// CallbackHandler is where the OIDC provider sends a browser back to, with a code to
+// trade for its ID token. The token is kept in the session cookie, valid for as long
+// as the token is.
+func (a *App) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil {
+		http.Error(w, "No sign in in progress", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, a.adminCookie(loginCookie, "", -1))
+	parts := strings.SplitN(cookie.Value, "|", 3)
+	q := r.URL.Query()
+	if len(parts) != 3 || q.Get("state") == "" ||
+		subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(parts[0])) != 1 {
+		http.Error(w, "Sign in state doesn't match", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		logging.Warnf(r.Context(), "Admin sign in failed at the provider: %s %s", e, q.Get("error_description"))
+		http.Error(w, "Sign in failed", http.StatusUnauthorized)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().RequestTimeoutInMs)
+	defer cancel()
+	token, claims, err := a.OIDC.Exchange(ctx, q.Get("code"))
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		http.Error(w, "Sign in failed", http.StatusUnauthorized)
+		return
+	}
+	// the nonce ties the token to this sign in, a token lifted from another can't be
+	// replayed through the callback
+	if nonce, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(nonce), []byte(parts[1])) != 1 {
+		http.Error(w, "Sign in failed", http.StatusUnauthorized)
+		return
+	}
+	logging.Printf(r.Context(), "Admin %q signed in", claims.Subject())
+	http.SetCookie(w, a.adminCookie(sessionCookie, token, time.Until(claims.Expiry())))
+	next := parts[2]
+	if !isAdminPath(next) {
+		next = adminHome
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// LogoutHandler drops the session cookie. The provider's own session stays
+func (a *App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, a.adminCookie(sessionCookie, "", -1))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminCookie is a cookie only the /admin routes get, that scripts can't read and
+// other sites can't send along with their POSTs. maxAge < 0 deletes it
+func (a *App) adminCookie(name, value string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/admin",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   strings.HasPrefix(a.OIDC.RedirectURL(), "https:"),
+		MaxAge:   int(maxAge.Seconds()),
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+// isAdminPath keeps sign in from redirecting anywhere but this service's admin pages
+func isAdminPath(path string) bool {
+	return (path == "/admin" || strings.HasPrefix(path, "/admin/")) && !strings.Contains(path, "\\")
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
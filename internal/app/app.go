@@ -1,32 +1,107 @@
 package app
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
+	"github.com/jayreddy040-510/receipt_processor/internal/archive"
+	"github.com/jayreddy040-510/receipt_processor/internal/breaker"
+	"github.com/jayreddy040-510/receipt_processor/internal/chaos"
+	"github.com/jayreddy040-510/receipt_processor/internal/clock"
+	"github.com/jayreddy040-510/receipt_processor/internal/concurrency"
 	"github.com/jayreddy040-510/receipt_processor/internal/config"
 	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/events"
+	"github.com/jayreddy040-510/receipt_processor/internal/jobs"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/lru"
+	"github.com/jayreddy040-510/receipt_processor/internal/ocr"
+	"github.com/jayreddy040-510/receipt_processor/internal/oidc"
+	"github.com/jayreddy040-510/receipt_processor/internal/outbox"
+	"github.com/jayreddy040-510/receipt_processor/internal/plugin"
+	"github.com/jayreddy040-510/receipt_processor/internal/report"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+	"github.com/jayreddy040-510/receipt_processor/internal/webhook"
 
 	"github.com/go-chi/chi"
 	"github.com/google/uuid"
 )
 
 type App struct {
-	Db     *db.RedisStore
-	Config config.Config
+	Db       db.Store
+	Breaker  *breaker.Breaker
+	Config   config.Config
+	Webhooks *webhook.Dispatcher
+	Events   events.Publisher
+	// Stream feeds GET /receipts/events, nil turns the endpoint off
+	Stream *events.Hub
+	// Outbox holds receipts the store was down for until they can be saved, nil to
+	// fail those requests instead
+	Outbox *outbox.Outbox
+	// ReceiptCache keeps receipts points lookups read, nil turns it off
+	ReceiptCache *lru.Cache[db.ReceiptRecord]
+	// Archive keeps the submitted receipts and images, nil when archiving is off
+	Archive *archive.Archiver
+	// Reports sends the scheduled summaries, nil when they have nowhere to go
+	Reports *report.Sender
+	OCR     ocr.Extractor
+	// OIDC signs admins in instead of the ADMIN_TOKEN, nil when OIDC_ISSUER_URL isn't set
+	OIDC  *oidc.Provider
+	Rules *rules.Registry
+	Jobs  *jobs.Runner
+	// Tenants and RateLimiter are optional, without them everything runs as the
+	// default tenant
+	Tenants     *tenant.Registry
+	RateLimiter *tenant.Limiter
+	// caps how many receipts (or import batches) are processed at once, nil for no cap
+	Processing *concurrency.Limiter
+	// caps the public API requests in flight, keeping some slots for lookups. nil for
+	// no cap
+	Requests *concurrency.PriorityLimiter
+	// Chaos injects faults into scoring (and the store, through its client), nil
+	// unless CHAOS_MODE is on
+	Chaos *chaos.Injector
+	// what time it is for scoring, expiry and the timestamps on records. nil is the
+	// wall clock
+	Clock clock.Clock
+
+	// LoadConfig re-resolves the configuration the way boot did, for reloads. LogLevel
+	// gets updated on reload when set.
+	LoadConfig func() (config.Config, error)
+	LogLevel   *slog.LevelVar
+
+	liveConfig atomic.Pointer[config.Config]
+	// tenant id -> []db.Campaign
+	campaignCache sync.Map
+	// tenant id -> *retailerRegistry
+	retailerCache sync.Map
+	// tenant id -> *fingerprintFilter, with FRAUD_BLOOM_FILTER on
+	fingerprintFilters sync.Map
 }
 
 type item struct {
 	ShortDescription string `json:"shortDescription"`
-	Price            string `json:"price"`
+	// what the line came to, quantity times unitPrice. Either one of price and unitPrice
+	// will do
+	Price string `json:"price"`
+	// optional, how many units the line is for. 0 means 1
+	Quantity  int    `json:"quantity,omitempty"`
+	UnitPrice string `json:"unitPrice,omitempty"`
 }
 
 type receipt struct {
@@ -35,6 +110,48 @@ type receipt struct {
 	PurchaseTime string `json:"purchaseTime"`
 	Items        []item `json:"items"`
 	Total        string `json:"total"`
+	UserID       string `json:"userId,omitempty"`
+	// IANA zone the purchase date and time are in, BUSINESS_TIMEZONE when empty
+	Timezone string `json:"timezone,omitempty"`
+	// optional details from POS integrations, see details.go
+	Tax           string         `json:"tax,omitempty"`
+	Discounts     []discount     `json:"discounts,omitempty"`
+	PaymentMethod string         `json:"paymentMethod,omitempty"`
+	Store         *storeLocation `json:"store,omitempty"`
+
+	// the canonical id of the retailer in the tenant's retailer registry, empty when it
+	// has none. See withRetailerID
+	retailerID string
+	// set when the items were scored while streaming in, see decodeReceiptStream.
+	// Items then only holds them for receipts small enough to keep
+	tally *itemTally
+	// the request body as it was sent, kept for the archive when archiving is on
+	raw     []byte
+	rawType string
+}
+
+type processResponse struct {
+	XMLName xml.Name `json:"-" xml:"processedReceipt"`
+	ID      string   `json:"id" xml:"id"`
+	// set when fraud screening held the points back
+	Status string `json:"status,omitempty" xml:"status,omitempty"`
+	// set when the receipt was taken while the store was down and waits in the outbox,
+	// its status can still change
+	Provisional bool `json:"provisional,omitempty" xml:"provisional,omitempty"`
+}
+
+// itemCount is how many items the receipt has, whether or not they were kept
+func (rec receipt) itemCount() int {
+	if rec.tally != nil {
+		return rec.tally.count
+	}
+	return len(rec.Items)
+}
+
+// hasAllItems reports whether Items holds every item, i.e. whether the receipt can be
+// stored raw and scored again later
+func (rec receipt) hasAllItems() bool {
+	return len(rec.Items) == rec.itemCount()
 }
 
 func isValidUUIDv4(s string) (bool, error) {
@@ -50,183 +167,643 @@ func isValidUUIDv4(s string) (bool, error) {
 	return true, nil
 }
 
+// amounts are capped well inside what a float64 holds to the cent, so the quarter and
+// round dollar checks stay exact and the points an item earns can't overflow an int
+const (
+	maxDollarAmtDigits = 9
+	maxDollarAmt       = 1e9
+)
+
 func parseDollarAsStringInput(amt string) (float64, error) {
 	// accept dollar amt as string, return float64 if valid amt
 	// design decision: allow for prices without decimal? (should we allow for 36 == $36)?
 	// design decision: allow for leading 0's? strconv.ParseFloat() can handle: should we allow for 05.01 == $5.01?
-	amt = strings.ReplaceAll(amt, ",", "") // sanitize input if commas
-
-	for pos, char := range amt {
-		if !unicode.IsDigit(char) && char != '.' {
-			return 0, fmt.Errorf("Error parsing dollar amt: invalid character")
-		}
-		if char == '.' {
-			if len(amt)-pos-1 != 2 {
-				return 0, fmt.Errorf("Error parsing dollar amt: incorrect value")
-			}
+	dollars, cents, hasCents := strings.Cut(amt, ".")
+	if hasCents && len(cents) != 2 {
+		return 0, fmt.Errorf("Error parsing dollar amt: incorrect value")
+	}
+	if strings.Contains(dollars, ",") {
+		// commas are only thousands separators, 1,234.56 but not 12,34.56
+		if !isThousandsGrouped(dollars) {
+			return 0, fmt.Errorf("Error parsing dollar amt: misplaced comma")
 		}
+		dollars = strings.ReplaceAll(dollars, ",", "")
+	}
+	if dollars == "" || !isASCIIDigits(dollars) || !isASCIIDigits(cents) {
+		return 0, fmt.Errorf("Error parsing dollar amt: invalid character")
+	}
+	if len(strings.TrimLeft(dollars, "0")) > maxDollarAmtDigits {
+		return 0, fmt.Errorf("Error parsing dollar amt: more than %d digits of dollars", maxDollarAmtDigits)
 	}
 
-	f, err := strconv.ParseFloat(amt, 64)
+	f, err := strconv.ParseFloat(dollars+"."+cents, 64)
 	if err != nil {
 		return 0, fmt.Errorf("Error parsing dollar amt: %v", err)
 	}
 	return f, nil
 }
 
-func parseDateAsStringInput(dateString string) (int, error) {
+// isASCIIDigits is unicode.IsDigit without the other scripts' digits, which
+// strconv.ParseFloat doesn't take
+func isASCIIDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isThousandsGrouped reports whether s is 1 to 3 characters followed by groups of 3,
+// each group after a comma
+func isThousandsGrouped(s string) bool {
+	groups := strings.Split(s, ",")
+	if len(groups[0]) < 1 || len(groups[0]) > 3 {
+		return false
+	}
+	for _, group := range groups[1:] {
+		if len(group) != 3 {
+			return false
+		}
+	}
+	return true
+}
+
+// the purchase date and time are wall clock readings in loc, they're only in the future
+// while that zone's clock hasn't reached them yet at now
+func parseDateAsStringInput(dateString string, loc *time.Location, now time.Time) (int, error) {
 	// determine if valid date and return day number to caller
-	purchaseDate, err := time.Parse("2006-01-02", dateString)
+	purchaseDate, err := time.ParseInLocation("2006-01-02", dateString, loc)
 	if err != nil {
 		return -1, fmt.Errorf("Error parsing purchaseDate: %v", err)
 	}
 
-	if purchaseDate.After(time.Now()) {
+	if purchaseDate.After(now) {
 		return -1, fmt.Errorf("Error parsing purchaseDate: future date given (%v)", purchaseDate)
 	}
 	return purchaseDate.Day(), nil
 }
 
-func parseTimeAsStringInput(timeString, dateString string) (time.Time, error) {
+func parseTimeAsStringInput(timeString, dateString string, loc *time.Location, now time.Time) (time.Time, error) {
 	// determine if valid time and return time.Time object
 	// need date to see if time given is invalid (could be present day and time after current time)
-	purchaseTimeAndDate, err := time.Parse("2006-01-02 15:04", dateString+" "+timeString)
+	// they're parsed apart, time.Parse lets a space in a layout match any run of spaces
+	// so parsing them joined took " 13:01", and a date could have carried the time
+	purchaseDate, err := time.ParseInLocation("2006-01-02", dateString, loc)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("Error parsing purchaseTimeAndDate: %v", err)
 	}
-	if purchaseTimeAndDate.After(time.Now()) {
+	purchaseTime, err := time.Parse("15:04", timeString)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Error parsing purchaseTimeAndDate: %v", err)
+	}
+	// "15" takes a single digit hour too, the format is HH:MM
+	if len(timeString) != len("15:04") {
+		return time.Time{}, fmt.Errorf("Error parsing purchaseTimeAndDate: %q isn't HH:MM", timeString)
+	}
+	purchaseTimeAndDate := time.Date(purchaseDate.Year(), purchaseDate.Month(), purchaseDate.Day(),
+		purchaseTime.Hour(), purchaseTime.Minute(), 0, 0, loc)
+	if purchaseTimeAndDate.After(now) {
 		return time.Time{}, fmt.Errorf("Error parsing purchaseTimeAndDate: future time given (%v)", purchaseTimeAndDate)
 	}
 	return purchaseTimeAndDate, nil
 }
 
-func calculateRetailerPoints(retailer string) int {
+func calculateRetailerPoints(retailer string, ruleSet *rules.RuleSet) int {
 	var count int
 	for _, char := range retailer {
 		if unicode.IsLetter(char) || unicode.IsDigit(char) {
 			count++
 		}
 	}
-	return count
+	return count * ruleSet.RetailerCharPoints
 }
 
-func calculateReceiptTotalPoints(total string) (int, error) {
-	var points int
+// calculateReceiptTotalPoints returns the round dollar and multiple of 0.25 points
+// separately, they're separate lines of the breakdown
+func calculateReceiptTotalPoints(total string, ruleSet *rules.RuleSet) (int, int, error) {
+	var roundPoints, quarterPoints int
 	receiptTotalAsFloat, err := parseDollarAsStringInput(total) // returns dollar amt as float64
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	if receiptTotalAsFloat == math.Floor(receiptTotalAsFloat) {
-		points += 50
+		roundPoints = ruleSet.RoundTotalPoints
 	}
 	if checkMultipleStatus := receiptTotalAsFloat * 4; checkMultipleStatus == math.Floor(checkMultipleStatus) {
-		points += 25
+		quarterPoints = ruleSet.QuarterMultiplePoints
 	}
 
-	return points, nil
+	return roundPoints, quarterPoints, nil
 }
 
-func calculatePointsFromItems(items []item) int {
-	var points int
-	for _, item := range items {
-		if trimmed := strings.Trim(item.ShortDescription, " "); len(trimmed)%3 == 0 {
-			// would be cleaner to perform each operation and save to a new variable;
-			// but, unnecessary memory allocations inside of a for loop can be expensive?
-			// strings.ReplaceAll() is to sanitize the string price input
-			f, err := parseDollarAsStringInput(item.Price)
-			if err != nil {
-				log.Printf("Error processing Item: %+v. %v", item, err)
-				continue // design decision: return error to parent func here or continue?
-			}
-			points += int(math.Ceil(f * 0.2)) // math.Ceil returns a float
-		}
-	}
-	return points
-}
-
-func calculatePurchaseDatePoints(date string) (int, error) {
-	dayValue, err := parseDateAsStringInput(date)
+func calculatePurchaseDatePoints(date string, loc *time.Location, now time.Time, ruleSet *rules.RuleSet) (int, error) {
+	dayValue, err := parseDateAsStringInput(date, loc, now)
 	if err != nil {
 		return 0, err
 	}
 	if dayValue%2 != 0 {
-		return 6, nil
+		return ruleSet.OddDayPoints, nil
 	}
 	return 0, nil
 }
 
-func calculatePurchaseTimePoints(timeString, dateString string) (int, error) {
-	purchaseTimeAndDate, err := parseTimeAsStringInput(timeString, dateString)
+// calculatePurchaseTimePoints adds the afternoon bonus and the time windows the
+// purchase is in. Every receipt has an afternoonPurchase line, only receipts in a time
+// window have a line for it.
+func calculatePurchaseTimePoints(points *breakdown, timeString, dateString string, loc *time.Location, now time.Time, ruleSet *rules.RuleSet) error {
+	purchaseTimeAndDate, err := parseTimeAsStringInput(timeString, dateString, loc, now)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	// use HHMM format because easy int format to compare times, rather than using
 	// time.Parse() and time.After() and time.Before() several times
 	purchaseHHMM := purchaseTimeAndDate.Hour()*100 + purchaseTimeAndDate.Minute()
 
-	if purchaseHHMM > 1400 && purchaseHHMM < 1600 {
-		return 10, nil
+	afternoon, afternoonPoints := ruleSet.Afternoon(), 0
+	if afternoon.Contains(purchaseHHMM) {
+		afternoonPoints = afternoon.Points
 	}
-
-	return 0, nil
+	points.add(afternoon.Name, "", afternoonPoints)
+	for _, w := range ruleSet.TimeWindows {
+		if w.Contains(purchaseHHMM) {
+			points.add("timeWindow."+w.Name, "", w.Points)
+		}
+	}
+	return nil
 }
 
-func calculateAllPoints(rec receipt) (int, error) {
-	var pointsTotal int
-	pointsTotal += calculateRetailerPoints(rec.Retailer)
-	pointsFromReceiptTotal, err := calculateReceiptTotalPoints(rec.Total)
+// calculateAllPoints scores a receipt. A receipt that was streamed in is scored with the
+// rules and campaigns its items were tallied with, ruleSet and campaigns are ignored.
+// now is when the scoring happens, receipts without a timezone of their own were
+// purchased in now's location (see scoringNow).
+func calculateAllPoints(rec receipt, ruleSet *rules.RuleSet, campaigns []db.Campaign, now time.Time) (int, breakdown, error) {
+	// stored receipts from before normalization are scored normalized too
+	normalizeReceipt(&rec)
+	loc, err := receiptLocation(rec, now.Location())
 	if err != nil {
-		return -1, fmt.Errorf("Error calculating points receipt \"total\": %v", err)
+		return -1, nil, err
+	}
+	if err := validateDetails(rec); err != nil {
+		return -1, nil, err
 	}
-	pointsTotal += pointsFromReceiptTotal
-	pointsTotal += (len(rec.Items) / 2) * 5 // dont need a helper for this (5 points per pair of items)
-	pointsTotal += calculatePointsFromItems(rec.Items)
-	pointsFromPurchaseDateDay, err := calculatePurchaseDatePoints(rec.PurchaseDate)
+	tally := rec.tally
+	if tally == nil {
+		// streamed items were checked as they came in
+		for i, it := range rec.Items {
+			if err := validateItem(it); err != nil {
+				return -1, nil, fmt.Errorf("Error parsing receipt item %d: %v", i+1, err)
+			}
+		}
+		tally = tallyItems(rec.Items, ruleSet, campaigns)
+	}
+	ruleSet = tally.ruleSet
+	var points breakdown
+	points.add("retailerName", "", calculateRetailerPoints(rec.Retailer, ruleSet))
+	roundTotalPoints, quarterMultiplePoints, err := calculateReceiptTotalPoints(rec.Total, ruleSet)
 	if err != nil {
-		return -1, fmt.Errorf("Error calculating points receipt \"purchase date\": %v", err)
+		return -1, nil, fmt.Errorf("Error calculating points receipt \"total\": %v", err)
 	}
-	pointsTotal += pointsFromPurchaseDateDay
-	pointsFromPurchaseTimeHour, err := calculatePurchaseTimePoints(rec.PurchaseTime, rec.PurchaseDate)
+	points.add("roundTotal", "", roundTotalPoints)
+	points.add("quarterMultipleTotal", "", quarterMultiplePoints)
+	points.add("itemPairs", "", (tally.units/2)*ruleSet.ItemPairPoints) // dont need a helper for this (points per pair of items)
+	itemPoints := tally.descriptionPoints
+	points.add("itemDescriptions", "", itemPoints)
+	override := retailerOverride(rec, ruleSet)
+	if override != nil && override.ItemPointsMultiplier != 0 {
+		points.add("retailerOverride.itemPointsMultiplier", override.Describe(),
+			applyMultiplier(itemPoints, override.ItemPointsMultiplier)-itemPoints)
+	}
+	pointsFromPurchaseDateDay, err := calculatePurchaseDatePoints(rec.PurchaseDate, loc, now, ruleSet)
 	if err != nil {
-		return -1, fmt.Errorf("Error calculating points receipt \"purchase time\": %v", err)
+		return -1, nil, fmt.Errorf("Error calculating points receipt \"purchase date\": %v", err)
+	}
+	points.add("oddPurchaseDay", "", pointsFromPurchaseDateDay)
+	if err := calculatePurchaseTimePoints(&points, rec.PurchaseTime, rec.PurchaseDate, loc, now, ruleSet); err != nil {
+		return -1, nil, fmt.Errorf("Error calculating points receipt \"purchase time\": %v", err)
 	}
-	pointsTotal += pointsFromPurchaseTimeHour
-	return pointsTotal, nil
+	if override != nil {
+		points.addMultiplier("retailerOverride.pointsMultiplier", override.Describe(), override.PointsMultiplier)
+		if override.BonusPoints != 0 {
+			points.add("retailerOverride.bonusPoints", override.Describe(), override.BonusPoints)
+		}
+	}
+	// only receipts that get these bonuses have a line for them, breakdowns of receipts
+	// from before they existed stay the same
+	if bonus := ruleSet.PaymentMethodBonus(rec.PaymentMethod); bonus != 0 {
+		points.add("paymentMethod", rec.PaymentMethod, bonus)
+	}
+	if bonus := ruleSet.StoreBonus(rec.storeID()); bonus != 0 {
+		points.add("store", rec.storeID(), bonus)
+	}
+	// the purchase time parsed fine above
+	purchased, _ := parseTimeAsStringInput(rec.PurchaseTime, rec.PurchaseDate, loc, now)
+	if err := applyExpressionRules(&points, rec, ruleSet, purchased); err != nil {
+		return -1, nil, err
+	}
+	if err := applyPlugins(&points, rec, ruleSet); err != nil {
+		return -1, nil, err
+	}
+	applyCampaigns(&points, rec, tally)
+	return points.total(), points, nil
 }
 
-func (a *App) ProcessReceiptHandler(w http.ResponseWriter, r *http.Request) {
-	var rec receipt
-	err := json.NewDecoder(r.Body).Decode(&rec)
-	defer r.Body.Close()
+// newReceiptRecord scores a decoded receipt and turns it into what gets persisted
+func newReceiptRecord(rec receipt, ruleSet *rules.RuleSet, campaigns []db.Campaign, expiryMonths int, now time.Time) (db.ReceiptRecord, error) {
+	// stored the way it's scored
+	normalizeReceipt(&rec)
+	if rec.tally != nil {
+		ruleSet, campaigns = rec.tally.ruleSet, rec.tally.campaigns
+	}
+	pointsTotal, points, err := calculateAllPoints(rec, ruleSet, campaigns, now)
+	if errors.Is(err, plugin.ErrFailed) || errors.Is(err, rules.ErrExpressionFailed) {
+		// the rule's fault, not the receipt's
+		return db.ReceiptRecord{}, fmt.Errorf("Error calculating receipt points: %w", err)
+	}
 	if err != nil {
-		log.Printf("Error decoding request body: %v", err)
-		http.Error(w, "The receipt is invalid", http.StatusBadRequest)
+		return db.ReceiptRecord{}, fmt.Errorf("%w: Error calculating receipt points: %v", errInvalidReceipt, err)
+	}
+	// receipts too big to keep their items are stored without their raw contents, the
+	// same as receipts from before raw contents were kept. they can't be recalculated
+	var raw []byte
+	if rec.hasAllItems() {
+		if raw, err = json.Marshal(rec); err != nil {
+			return db.ReceiptRecord{}, fmt.Errorf("Error encoding receipt: %v", err)
+		}
+	}
+	return db.ReceiptRecord{
+		ID:             uuid.New().String(),
+		Retailer:       rec.Retailer,
+		RetailerID:     rec.retailerID,
+		PurchaseDate:   rec.PurchaseDate,
+		Points:         pointsTotal,
+		CreatedAt:      now.UTC(),
+		UserID:         rec.UserID,
+		PointsExpireAt: pointsExpireAt(rec.PurchaseDate, expiryMonths),
+		RulesVersion:   ruleSet.Version,
+		Breakdown:      points,
+		Receipt:        raw,
+	}, nil
+}
+
+// announceReceipt lets downstream consumers know about a stored receipt
+func (a *App) announceReceipt(ctx context.Context, stored db.ReceiptRecord) {
+	logging.Printf(ctx, "id: %s, pts: %d", stored.ID, stored.Points)
+	// flagged receipts haven't earned anything yet, they're announced once approved
+	if stored.Status != "" {
 		return
 	}
-	pointsTotal, err := calculateAllPoints(rec)
-	if err != nil {
-		log.Printf("Error calculating receipt points: %v", err)
-		http.Error(w, "The receipt is invalid", http.StatusBadRequest)
+	if a.Webhooks != nil {
+		a.Webhooks.Notify(webhook.Payload{ID: stored.ID, Points: stored.Points, Tenant: tenant.FromContext(ctx).ID})
+	}
+	a.publish(events.Event{
+		Type:      events.ReceiptProcessed,
+		ID:        stored.ID,
+		Retailer:  stored.Retailer,
+		Points:    stored.Points,
+		UserID:    stored.UserID,
+		Tenant:    tenant.FromContext(ctx).ID,
+		Timestamp: stored.CreatedAt,
+	})
+}
+
+// publish sends the event to Kafka and the event streams, whichever are on
+func (a *App) publish(ev events.Event) {
+	if a.Events != nil {
+		a.Events.Publish(ev)
+	}
+	if a.Stream != nil {
+		a.Stream.Publish(ev)
+	}
+}
+
+// archiveReceipt queues the receipt for the archive as it was submitted. Receipts out of
+// a batch weren't sent on their own, they're archived as the JSON we'd store them as.
+func (a *App) archiveReceipt(ctx context.Context, rec receipt, stored db.ReceiptRecord) {
+	if a.Archive == nil {
 		return
 	}
-	pointsTotalAsString := strconv.Itoa(pointsTotal)
-	uuidString := uuid.New().String()
-	ctx, cancel := context.WithTimeout(r.Context(), a.Config.DbTimeoutInMs)
+	body, contentType := rec.raw, rec.rawType
+	if body == nil {
+		body, contentType = stored.Receipt, "application/json"
+	}
+	if body == nil {
+		logging.Warnf(ctx, "Receipt %s has too many items to archive whole, not archiving it", stored.ID)
+		return
+	}
+	a.Archive.Receipt(tenant.FromContext(ctx).ID, stored.ID, contentType, body)
+}
+
+// processReceipt scores a decoded receipt, persists it and lets downstream consumers
+// know about it. Used by the single receipt endpoints, bulk paths go through
+// processReceipts.
+func (a *App) processReceipt(ctx context.Context, rec receipt) (db.ReceiptRecord, error) {
+	release, err := a.Processing.Acquire(ctx)
+	if err != nil {
+		return db.ReceiptRecord{}, err
+	}
+	defer release()
+	if err := a.Chaos.Inject(ctx, chaos.Scoring); err != nil {
+		return db.ReceiptRecord{}, err
+	}
+	rec = a.withRetailerID(ctx, rec)
+	stored, err := newReceiptRecord(rec, a.ruleSet(ctx), a.campaigns(ctx), a.config().PointsExpiryInMonths, a.scoringNow())
+	if err != nil {
+		return db.ReceiptRecord{}, err
+	}
+	stored.Retention = retentionClass(ctx)
+	// with DEGRADED_MODE a store that's down doesn't stop the receipt, what it can't
+	// check waits for the outbox to be flushed
+	provisional := false
+	// identical submissions racing each other are processed once, the later ones answer
+	// with the first one
+	unlock := func() {}
+	if a.config().SubmissionLockInMs > 0 {
+		hash, err := submissionHash(rec, stored)
+		if err != nil {
+			return db.ReceiptRecord{}, err
+		}
+		first, err := a.lockSubmission(ctx, hash, stored)
+		switch {
+		case a.degraded(err):
+			provisional = true
+		case err != nil:
+			return db.ReceiptRecord{}, err
+		case first != nil:
+			logging.Printf(ctx, "Answering with receipt %s, submitted with the same content moments ago", first.ID)
+			return *first, nil
+		default:
+			unlock = func() { a.unlockSubmission(ctx, hash, stored.ID) }
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
 	defer cancel()
-	err = a.Db.SetKey(ctx, uuidString, pointsTotalAsString)
+	var claim screening
+	if !provisional {
+		allowed, over, err := a.reserveQuota(ctx, 1)
+		switch {
+		case a.degraded(err):
+			provisional = true
+		case err != nil:
+			unlock()
+			return db.ReceiptRecord{}, err
+		case allowed == 0:
+			unlock()
+			return db.ReceiptRecord{}, over
+		}
+	}
+	if !provisional {
+		claim, err = a.screenReceipt(ctx, rec, &stored)
+		if err != nil {
+			a.releaseQuota(ctx, 1)
+			if !a.degraded(err) {
+				unlock()
+				return db.ReceiptRecord{}, fmt.Errorf("Error screening receipt: %w", err)
+			}
+			provisional = true
+		}
+	}
+	if provisional {
+		fingerprint := a.screenProvisional(ctx, rec, &stored)
+		if err := a.deferProvisional(ctx, []db.ReceiptRecord{stored}, []string{fingerprint}); err != nil {
+			unlock()
+			return db.ReceiptRecord{}, err
+		}
+		// announced once it's flushed
+		a.archiveReceipt(ctx, rec, stored)
+		countRulePoints(stored.Breakdown)
+		return stored, nil
+	}
+	err = a.store(ctx).SaveReceipt(ctx, stored)
+	if err != nil && !a.deferSave(ctx, err, stored) {
+		a.releaseScreening(ctx, claim)
+		a.releaseQuota(ctx, 1)
+		unlock()
+		return db.ReceiptRecord{}, fmt.Errorf("Error setting DB key-value pair: %w", err)
+	}
+	// deferred receipts are counted once they're flushed
+	if err == nil {
+		a.recordUsage(ctx, a.now(), 1, awardedPoints(stored))
+		a.recordFlags(ctx, a.now(), stored)
+	}
+	a.announceReceipt(ctx, stored)
+	a.archiveReceipt(ctx, rec, stored)
+	countRulePoints(stored.Breakdown)
+	return stored, nil
+}
+
+// processReceipts is processReceipt for a batch: every receipt is scored on its own but
+// the valid ones are saved in a single round trip. Results and errors line up with recs.
+// An atomic batch is all or nothing, one receipt failing fails the rest with
+// errImportRolledBack, it's never deferred to the outbox and a failed save is undone
+// (see undoSave).
+func (a *App) processReceipts(ctx context.Context, recs []receipt, atomic bool) ([]db.ReceiptRecord, []error) {
+	stored := make([]db.ReceiptRecord, len(recs))
+	errs := make([]error, len(recs))
+	// a batch takes one slot, it's one round trip to the store
+	release, err := a.Processing.Acquire(ctx)
 	if err != nil {
-		log.Printf("Error setting DB key-value pair: %v", err)
-		http.Error(w, "The receipt is invalid", http.StatusBadRequest)
+		for i := range errs {
+			errs[i] = err
+		}
+		return stored, errs
+	}
+	defer release()
+	var batch []db.ReceiptRecord
+	ruleSet, campaigns, expiryMonths := a.ruleSet(ctx), a.campaigns(ctx), a.config().PointsExpiryInMonths
+	for i := range recs {
+		if errs[i] = a.Chaos.Inject(ctx, chaos.Scoring); errs[i] != nil {
+			continue
+		}
+		recs[i] = a.withRetailerID(ctx, recs[i])
+		stored[i], errs[i] = newReceiptRecord(recs[i], ruleSet, campaigns, expiryMonths, a.scoringNow())
+		stored[i].Retention = retentionClass(ctx)
+	}
+	if atomic && rollBack(errs) {
+		return stored, errs
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+	defer cancel()
+	var valid int
+	for _, err := range errs {
+		if err == nil {
+			valid++
+		}
+	}
+	allowed, over, err := a.reserveQuota(ctx, valid)
+	// with DEGRADED_MODE a store that's down doesn't stop the batch, what it can't check
+	// waits for the outbox to be flushed
+	degraded := !atomic && a.degraded(err)
+	if err != nil && !degraded {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return stored, errs
+	}
+	reserved := allowed
+	if degraded {
+		allowed, reserved = valid, 0
+	}
+	if atomic && allowed < valid {
+		a.releaseQuota(ctx, reserved)
+		// the receipts that fit are rolled back along with the rest
+		for i := range errs {
+			if allowed == 0 {
+				errs[i] = over
+				continue
+			}
+			allowed--
+		}
+		rollBack(errs)
+		return stored, errs
+	}
+	var (
+		claims       []screening
+		provisional  = make([]bool, len(recs))
+		provisionals []db.ReceiptRecord
+		fingerprints []string
+	)
+	for i, rec := range recs {
+		if errs[i] != nil {
+			continue
+		}
+		// receipts past the quota are turned away in order, like they'd have been one by one
+		if allowed == 0 {
+			errs[i] = over
+			continue
+		}
+		allowed--
+		if !degraded {
+			claim, err := a.screenReceipt(ctx, rec, &stored[i])
+			if err == nil {
+				claims = append(claims, claim)
+				batch = append(batch, stored[i])
+				continue
+			}
+			if atomic || !a.degraded(err) {
+				errs[i] = fmt.Errorf("Error screening receipt: %w", err)
+				continue
+			}
+		}
+		provisional[i] = true
+		fingerprints = append(fingerprints, a.screenProvisional(ctx, rec, &stored[i]))
+		provisionals = append(provisionals, stored[i])
+	}
+	if atomic && rollBack(errs) {
+		for _, claim := range claims {
+			a.releaseScreening(ctx, claim)
+		}
+		a.releaseQuota(ctx, reserved)
+		return stored, errs
+	}
+	// the ones that failed screening, or were taken without it, don't count against the
+	// quota (yet)
+	a.releaseQuota(ctx, reserved-len(batch))
+	if len(provisionals) > 0 {
+		if err := a.deferProvisional(ctx, provisionals, fingerprints); err != nil {
+			for i := range recs {
+				if provisional[i] {
+					errs[i] = err
+				}
+			}
+		}
+	}
+
+	var saveErr error
+	if len(batch) > 0 {
+		saveErr = a.store(ctx).SaveReceipts(ctx, batch)
+		switch {
+		case saveErr == nil:
+			a.recordUsage(ctx, a.now(), len(batch), awardedPoints(batch...))
+			a.recordFlags(ctx, a.now(), batch...)
+		// counted once they're flushed
+		case !atomic && a.deferSave(ctx, saveErr, batch...):
+			saveErr = nil
+		case atomic:
+			a.undoSave(ctx, batch)
+		}
+	}
+	if saveErr != nil {
+		for _, claim := range claims {
+			a.releaseScreening(ctx, claim)
+		}
+		a.releaseQuota(ctx, len(batch))
+	}
+	for i := range recs {
+		if errs[i] != nil {
+			continue
+		}
+		// provisional receipts are announced once they're flushed
+		if provisional[i] {
+			a.archiveReceipt(ctx, recs[i], stored[i])
+			countRulePoints(stored[i].Breakdown)
+			continue
+		}
+		if saveErr != nil {
+			errs[i] = fmt.Errorf("Error setting DB key-value pairs: %w", saveErr)
+			continue
+		}
+		a.announceReceipt(ctx, stored[i])
+		a.archiveReceipt(ctx, recs[i], stored[i])
+		countRulePoints(stored[i].Breakdown)
+	}
+	return stored, errs
+}
+
+// readReceipt decodes a submitted receipt and settles its user, answering the client
+// itself when that fails. The body is kept for the archive when archiving is on.
+func (a *App) readReceipt(w http.ResponseWriter, r *http.Request) (receipt, bool) {
+	// items are scored as they stream in, so the receipt is decoded with the rules and
+	// campaigns it'll be scored with
+	codec, body := requestCodec(r), io.Reader(r.Body)
+	var raw *bytes.Buffer
+	if a.Archive != nil {
+		raw = &bytes.Buffer{}
+		body = io.TeeReader(r.Body, raw)
+	}
+	rec, err := codec.decodeReceipt(body, a.config().MaxReceiptItems, a.ruleSet(r.Context()), a.campaigns(r.Context()))
+	if err != nil {
+		logging.Printf(r.Context(), "Error decoding request body: %v", err)
+		if writeBodyTooLarge(w, r, err) {
+			return receipt{}, false
+		}
+		if errors.Is(err, errTooManyItems) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, codeValidationFailed, msgTooManyItems, a.config().MaxReceiptItems)
+			return receipt{}, false
+		}
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgReceiptInvalid)
+		return receipt{}, false
+	}
+	if err := resolveUserID(r, &rec); err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgUserIDInvalid)
+		return receipt{}, false
+	}
+	if raw != nil {
+		rec.raw, rec.rawType = raw.Bytes(), codec.contentType()
+	}
+	return rec, true
+}
+
+func (a *App) ProcessReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	rec, ok := a.readReceipt(w, r)
+	if !ok {
 		return
 	}
-	log.Printf("id: %s, pts: %d", uuidString, pointsTotal)
-	responseToClient := map[string]string{
-		"id": uuidString,
+	stored, err := a.processReceipt(r.Context(), rec)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		a.writeReceiptError(w, r, err)
+		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
-		log.Printf("Error encoding client response: %v", err)
-		http.Error(w, "The receipt is invalid", http.StatusBadRequest)
+	responseToClient := processResponse{ID: stored.ID, Status: stored.Status, Provisional: a.provisional(r.Context(), stored.ID)}
+	if err := writeEncoded(w, responseCodec(r), responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, msgInternal)
 	}
 	return
 }
@@ -234,31 +811,42 @@ func (a *App) ProcessReceiptHandler(w http.ResponseWriter, r *http.Request) {
 func (a *App) GetPointsHandler(w http.ResponseWriter, r *http.Request) {
 	receiptId := chi.URLParam(r, "id")
 	if ok, err := isValidUUIDv4(receiptId); !ok {
-		log.Println(err)
-		http.Error(w, "No receipt found for that id", http.StatusNotFound)
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusNotFound, codeReceiptNotFound, msgReceiptNotFound)
 		return
 	}
-	ctx, cancel := context.WithTimeout(r.Context(), a.Config.DbTimeoutInMs)
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
 	defer cancel()
-	pointsValue, err := a.Db.GetKey(ctx, receiptId)
+	storedReceipt, provisional, err := a.lookupReceipt(ctx, receiptId)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "No receipt found for that id", http.StatusNotFound)
+		logging.Printf(r.Context(), "%v", err)
+		a.writeReceiptError(w, r, err)
 		return
 	}
-	pointsValueAsInt, err := strconv.Atoi(pointsValue)
-	if err != nil {
-		log.Printf("Error converting points string to int: %v", err)
-		http.Error(w, "No receipt found for that id", http.StatusNotFound)
-		return
+	points := storedReceipt.Points
+	var adjustments []db.Adjustment
+	if !provisional {
+		if adjustments, points, err = a.receiptAdjustments(ctx, storedReceipt); err != nil {
+			logging.Printf(r.Context(), "%v", err)
+			a.writeReceiptError(w, r, err)
+			return
+		}
 	}
-	responseToClient := map[string]int{
-		"points": pointsValueAsInt,
+	responseToClient := pointsResponse{
+		Points:       points,
+		RulesVersion: storedReceipt.RulesVersion,
+		Status:       storedReceipt.Status,
+		Provisional:  provisional,
+		Adjustments:  newPointsAdjustments(adjustments),
 	}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
-		log.Printf("Error encoding client response: %v", err)
-		http.Error(w, "No receipt found for that id", http.StatusNotFound)
+	cacheControl := pointsCacheControl(storedReceipt, provisional, a.config().PointsCacheMaxAgeInSec)
+	enc := responseCodec(r)
+	w.Header().Add("Vary", "Accept")
+	err = enc.encode(responseToClient, func(body []byte) {
+		writeCacheable(w, r, body, enc.contentType(), cacheControl)
+	})
+	if err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, msgInternal)
 	}
-	return
 }
@@ -0,0 +1,203 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+// atomic imports are read whole before anything is saved, this bounds what they hold
+const maxAtomicImportReceipts = 1000
+
+// errImportRolledBack fails the receipts of an atomic import that were fine themselves,
+// when another one of the import wasn't
+var errImportRolledBack = errors.New("another receipt of the atomic import failed")
+
+// importSummary is what an import did. Received counts receipts, a CSV receipt spans
+// its rows.
+type importSummary struct {
+	Received  int `json:"received"`
+	Processed int `json:"processed"`
+	Failed    int `json:"failed"`
+	// atomic imports only: nothing was saved because a receipt failed
+	Atomic     bool `json:"atomic,omitempty"`
+	RolledBack bool `json:"rolledBack,omitempty"`
+}
+
+func (s *importSummary) count(failed bool) {
+	s.Received++
+	if failed {
+		s.Failed++
+	} else {
+		s.Processed++
+	}
+}
+
+// fieldError is why one field of a receipt is invalid. Field is its JSON path like
+// "items[2].price", indexes are 0-based. Empty for problems with the receipt as a whole
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// atomicImport reports whether the import asked for all-or-nothing with ?atomic=
+func atomicImport(r *http.Request) (bool, error) {
+	raw := r.URL.Query().Get("atomic")
+	if raw == "" {
+		return false, nil
+	}
+	atomic, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("Error parsing atomic: %v", err)
+	}
+	return atomic, nil
+}
+
+// rollBack fails every receipt of an atomic batch with errImportRolledBack when any of
+// them failed, and reports whether one did
+func rollBack(errs []error) bool {
+	failed := false
+	for _, err := range errs {
+		failed = failed || err != nil
+	}
+	if !failed {
+		return false
+	}
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = errImportRolledBack
+		}
+	}
+	return true
+}
+
+// undoSave removes what made it into the store of an atomic batch that failed to save.
+// Redis saves a batch in one MULTI, DynamoDB one receipt at a time, so part of it can
+// be there. Deleting a receipt leaves its user's balance alone, the points it credited
+// are clawed back through the adjustments ledger first, while the receipt is still
+// there to claw them back from.
+func (a *App) undoSave(ctx context.Context, recs []db.ReceiptRecord) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), a.config().DbTimeoutInMs)
+	defer cancel()
+	for _, rec := range recs {
+		// flagged receipts haven't credited anything yet
+		if rec.UserID != "" && rec.Status == "" && rec.Points > 0 {
+			adj := db.Adjustment{
+				ID:        "rollback-" + rec.ID,
+				UserID:    rec.UserID,
+				ReceiptID: rec.ID,
+				Points:    -rec.Points,
+				Reason:    "atomic import rolled back",
+				CreatedAt: a.now().UTC(),
+			}
+			_, _, err := a.store(ctx).Adjust(ctx, adj)
+			if errors.Is(err, db.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				logging.Printf(ctx, "Error clawing back %d points of rolled back receipt %s: %v", rec.Points, rec.ID, err)
+			}
+		}
+		err := a.store(ctx).DeleteReceipt(ctx, rec.ID)
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			logging.Printf(ctx, "Error rolling back receipt %s of an atomic import: %v", rec.ID, err)
+			continue
+		}
+		a.forgetReceipts(ctx, rec.ID)
+		logging.Printf(ctx, "Rolled back receipt %s of an atomic import", rec.ID)
+	}
+}
+
+// decodeFieldErrors is a JSON decoding error as field errors, naming the field when the
+// value was of the wrong type
+func decodeFieldErrors(err error) []fieldError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return []fieldError{{Field: typeErr.Field, Message: fmt.Sprintf("expected a %s, got a %s", typeErr.Type, typeErr.Value)}}
+	}
+	return []fieldError{{Message: err.Error()}}
+}
+
+// receiptFieldErrors lists every field of an invalid receipt that scoring rejects, with
+// the checks calculateAllPoints runs. It's for reporting, scoring still stops at the
+// first one. The purchase time is only checked once the purchase date is valid, and
+// the business timezone stands in for one that isn't.
+func receiptFieldErrors(rec receipt, now time.Time) []fieldError {
+	normalizeReceipt(&rec)
+	var errs []fieldError
+	add := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, fieldError{Field: field, Message: err.Error()})
+		}
+	}
+	loc, err := receiptLocation(rec, now.Location())
+	add("timezone", err)
+	if err != nil {
+		loc = now.Location()
+	}
+	_, err = parseDateAsStringInput(rec.PurchaseDate, loc, now)
+	add("purchaseDate", err)
+	if err == nil {
+		_, err = parseTimeAsStringInput(rec.PurchaseTime, rec.PurchaseDate, loc, now)
+		add("purchaseTime", err)
+	}
+	_, err = parseDollarAsStringInput(rec.Total)
+	add("total", err)
+	for i, it := range rec.Items {
+		add(fmt.Sprintf("items[%d]", i), validateItem(it))
+	}
+	if rec.Tax != "" {
+		_, err = parseDollarAsStringInput(rec.Tax)
+		add("tax", err)
+	}
+	if len(rec.Discounts) > maxDiscounts {
+		add("discounts", fmt.Errorf("more than %d", maxDiscounts))
+	}
+	long := func(field, value string) {
+		if len(value) > maxDetailFieldLength {
+			add(field, fmt.Errorf("longer than %d bytes", maxDetailFieldLength))
+		}
+	}
+	for i, d := range rec.Discounts {
+		if strings.TrimSpace(d.Description) == "" {
+			add(fmt.Sprintf("discounts[%d].description", i), errors.New("no description"))
+		}
+		long(fmt.Sprintf("discounts[%d].description", i), d.Description)
+		_, err = parseDollarAsStringInput(d.Amount)
+		add(fmt.Sprintf("discounts[%d].amount", i), err)
+	}
+	long("paymentMethod", rec.PaymentMethod)
+	if s := rec.Store; s != nil {
+		for _, f := range []struct{ field, value string }{
+			{"store.id", s.ID}, {"store.address", s.Address}, {"store.city", s.City},
+			{"store.region", s.Region}, {"store.postalCode", s.PostalCode}, {"store.country", s.Country},
+		} {
+			long(f.field, f.value)
+		}
+	}
+	return errs
+}
+
+// processFieldErrors are the field errors of a receipt that failed processing, none
+// unless it was invalid
+func processFieldErrors(rec receipt, err error, now time.Time) []fieldError {
+	if !errors.Is(err, errInvalidReceipt) {
+		return nil
+	}
+	if errs := receiptFieldErrors(rec, now); len(errs) > 0 {
+		return errs
+	}
+	// a check receiptFieldErrors doesn't know about
+	return []fieldError{{Message: strings.TrimPrefix(err.Error(), errInvalidReceipt.Error()+": ")}}
+}
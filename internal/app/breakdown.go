@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/go-chi/chi"
+)
+
+// breakdown collects what every rule contributed to a receipt's points, in the order
+// the rules ran. Its total is the receipt's points.
+type breakdown []db.PointsComponent
+
+func (b *breakdown) add(rule, detail string, points int) {
+	*b = append(*b, db.PointsComponent{Rule: rule, Detail: detail, Points: points})
+}
+
+// addMultiplier scales everything so far, recording the points the multiplier added.
+// 0 means no multiplier.
+func (b *breakdown) addMultiplier(rule, detail string, multiplier float64) {
+	if multiplier == 0 {
+		return
+	}
+	subtotal := b.total()
+	b.add(rule, detail, applyMultiplier(subtotal, multiplier)-subtotal)
+}
+
+func (b breakdown) total() int {
+	var total int
+	for _, c := range b {
+		total += c.Points
+	}
+	return total
+}
+
+type pointsResponse struct {
+	XMLName      xml.Name `json:"-" xml:"receiptPoints"`
+	Points       int      `json:"points" xml:"points"`
+	RulesVersion string   `json:"rulesVersion,omitempty" xml:"rulesVersion,omitempty"`
+	// set while the points are held back by fraud screening
+	Status string `json:"status,omitempty" xml:"status,omitempty"`
+	// set while the receipt waits in the outbox
+	Provisional bool `json:"provisional,omitempty" xml:"provisional,omitempty"`
+	// what operators credited or clawed back, newest first. they're in Points
+	Adjustments []pointsAdjustment `json:"adjustments,omitempty" xml:"adjustments>adjustment,omitempty"`
+}
+
+type breakdownResponse struct {
+	ID           string               `json:"id"`
+	Points       int                  `json:"points"`
+	RulesVersion string               `json:"rulesVersion,omitempty"`
+	Breakdown    []db.PointsComponent `json:"breakdown"`
+	Provisional  bool                 `json:"provisional,omitempty"`
+}
+
+// GetBreakdownHandler explains a receipt's points rule by rule, as they were scored
+func (a *App) GetBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	receiptId := chi.URLParam(r, "id")
+	if ok, err := isValidUUIDv4(receiptId); !ok {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusNotFound, codeReceiptNotFound, msgReceiptNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	storedReceipt, provisional, err := a.lookupReceipt(ctx, receiptId)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		a.writeReceiptError(w, r, err)
+		return
+	}
+	responseToClient := breakdownResponse{
+		ID:           storedReceipt.ID,
+		Points:       storedReceipt.Points,
+		RulesVersion: storedReceipt.RulesVersion,
+		Breakdown:    append([]db.PointsComponent{}, storedReceipt.Breakdown...),
+		Provisional:  provisional,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// buffers bigger than this aren't pooled, one huge request would otherwise pin its
+// buffer for the life of the process
+const maxPooledBufferSize = 64 << 10
+
+// jsonBuffer is a buffer with an encoder writing into it, pooled together so the hot
+// handlers don't allocate either per request
+type jsonBuffer struct {
+	bytes.Buffer
+	enc *json.Encoder
+}
+
+var jsonBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := &jsonBuffer{}
+		b.enc = json.NewEncoder(&b.Buffer)
+		return b
+	},
+}
+
+func getJSONBuffer() *jsonBuffer {
+	return jsonBufferPool.Get().(*jsonBuffer)
+}
+
+func putJSONBuffer(b *jsonBuffer) {
+	if b.Cap() > maxPooledBufferSize {
+		return
+	}
+	b.Reset()
+	jsonBufferPool.Put(b)
+}
+
+// marshalJSON encodes v with a pooled encoder and hands the bytes to use, which must
+// not keep them
+func marshalJSON(v interface{}, use func([]byte)) error {
+	b := getJSONBuffer()
+	defer putJSONBuffer(b)
+	if err := b.enc.Encode(v); err != nil {
+		return err
+	}
+	use(b.Bytes())
+	return nil
+}
+
+// writeJSON sends v as a JSON response, encoded with a pooled encoder. Nothing is
+// written when encoding fails so the caller can still send an error.
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	return writeEncoded(w, jsonCodec{}, v)
+}
+
+// writeEncoded is writeJSON in whatever format enc is
+func writeEncoded(w http.ResponseWriter, enc codec, v interface{}) error {
+	var writeErr error
+	err := enc.encode(v, func(body []byte) {
+		w.Header().Set("Content-Type", enc.contentType())
+		_, writeErr = w.Write(body)
+	})
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// the NDJSON import reads through a 64KB buffer, big enough that most receipts are
+// one ReadSlice
+var importReaderPool = sync.Pool{
+	New: func() interface{} { return bufio.NewReaderSize(nil, 64*1024) },
+}
+
+func getImportReader(body io.Reader) *bufio.Reader {
+	reader := importReaderPool.Get().(*bufio.Reader)
+	reader.Reset(body)
+	return reader
+}
+
+func putImportReader(reader *bufio.Reader) {
+	reader.Reset(nil)
+	importReaderPool.Put(reader)
+}
+
+var importWriterPool = sync.Pool{
+	New: func() interface{} { return bufio.NewWriter(nil) },
+}
+
+func getImportWriter(w io.Writer) *bufio.Writer {
+	writer := importWriterPool.Get().(*bufio.Writer)
+	writer.Reset(w)
+	return writer
+}
+
+func putImportWriter(writer *bufio.Writer) {
+	writer.Reset(nil)
+	importWriterPool.Put(writer)
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+// pointsCacheControl is how long clients may reuse a points lookup. Points of an
+// anonymous receipt only change when an operator recalculates or the receipt gets
+// corrected, so they get the long max age. Receipts with a user can be adjusted at any
+// time, flagged ones are waiting on a review and provisional ones on the store, they
+// get revalidated every time.
+//
+// design decision: private, the same URL answers differently per tenant (X-API-Key)
+func pointsCacheControl(rec db.ReceiptRecord, provisional bool, maxAge time.Duration) string {
+	if rec.UserID != "" || rec.Status != "" || provisional || maxAge <= 0 {
+		return "private, no-cache"
+	}
+	return fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds()))
+}
+
+// etagFor is a strong ETag for a response body: the same body always gets the same
+// tag, whichever instance serves it
+func etagFor(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches compares an If-None-Match header against etag. Like the RFC says for
+// If-None-Match the comparison is weak, the W/ the gzip middleware adds doesn't matter.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCacheable sends an encoded body with an ETag and Cache-Control, or just a 304
+// when the client already has it
+func writeCacheable(w http.ResponseWriter, r *http.Request, body []byte, contentType, cacheControl string) {
+	etag := etagFor(body)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(body); err != nil {
+		logging.Printf(r.Context(), "Error writing client response: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+)
+
+// campaigns are the campaigns of the tenant in ctx to score with, as of the last
+// refresh. Reading them from the store for every receipt would add a round trip to
+// every request.
+func (a *App) campaigns(ctx context.Context) []db.Campaign {
+	if campaigns, ok := a.campaignCache.Load(tenant.FromContext(ctx).ID); ok {
+		return campaigns.([]db.Campaign)
+	}
+	return nil
+}
+
+// refreshCampaigns reloads the campaigns of the tenant in ctx
+func (a *App) refreshCampaigns(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+	defer cancel()
+	campaigns, err := a.store(ctx).ListCampaigns(ctx)
+	if err != nil {
+		return err
+	}
+	a.campaignCache.Store(tenant.FromContext(ctx).ID, campaigns)
+	return nil
+}
+
+// refreshAllCampaigns reloads every tenant's campaigns, carrying on past failures
+func (a *App) refreshAllCampaigns(ctx context.Context) error {
+	var errs []error
+	for _, t := range a.allTenants() {
+		if err := a.refreshCampaigns(tenant.NewContext(ctx, t)); err != nil {
+			errs = append(errs, fmt.Errorf("Error refreshing campaigns of tenant %q: %w", t.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StartCampaignRefresh loads the campaigns and the retailer registry and keeps reloading
+// them every interval until ctx is done, so changes made through another instance show
+// up here too
+func (a *App) StartCampaignRefresh(ctx context.Context, interval time.Duration) {
+	if err := errors.Join(a.refreshAllCampaigns(ctx), a.refreshAllRetailers(ctx)); err != nil {
+		logging.Printf(ctx, "Error loading campaigns or retailers, scoring without them until the next refresh: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := errors.Join(a.refreshAllCampaigns(ctx), a.refreshAllRetailers(ctx)); err != nil {
+					logging.Printf(ctx, "Error refreshing campaigns or retailers, keeping the previous ones: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func validateCampaign(c db.Campaign) error {
+	start, err := time.Parse("2006-01-02", c.StartDate)
+	if err != nil {
+		return fmt.Errorf("Invalid campaign startDate: %v", err)
+	}
+	end, err := time.Parse("2006-01-02", c.EndDate)
+	if err != nil {
+		return fmt.Errorf("Invalid campaign endDate: %v", err)
+	}
+	if end.Before(start) {
+		return fmt.Errorf("Invalid campaign: endDate is before startDate")
+	}
+	if c.Retailer != "" && c.RetailerID != "" {
+		return fmt.Errorf("Invalid campaign: needs at most one of retailer and retailerId")
+	}
+	if c.PointsMultiplier < 0 {
+		return fmt.Errorf("Invalid campaign: pointsMultiplier must not be negative")
+	}
+	if c.Category != nil && len(c.Category.Keywords) == 0 {
+		return fmt.Errorf("Invalid campaign: category needs at least one keyword")
+	}
+	if c.PointsMultiplier == 0 && c.BonusPoints == 0 && c.Category == nil {
+		return fmt.Errorf("Invalid campaign: needs a pointsMultiplier, bonusPoints or category")
+	}
+	return nil
+}
+
+// campaignApplies reports whether a receipt is covered by the campaign. Dates are
+// YYYY-MM-DD so comparing them as strings compares them as dates.
+func campaignApplies(c db.Campaign, rec receipt) bool {
+	if rec.PurchaseDate < c.StartDate || rec.PurchaseDate > c.EndDate {
+		return false
+	}
+	if c.RetailerID != "" {
+		return c.RetailerID == rec.retailerID
+	}
+	return c.Retailer == "" || db.NormalizeRetailer(c.Retailer) == db.NormalizeRetailer(rec.Retailer)
+}
+
+// applyCampaigns adds the campaigns the items were tallied with that cover the receipt
+// on top of its points. Overlapping campaigns stack, in start date order.
+func applyCampaigns(points *breakdown, rec receipt, tally *itemTally) {
+	for i, c := range tally.campaigns {
+		if !campaignApplies(c, rec) {
+			continue
+		}
+		detail := fmt.Sprintf("%s (%s)", c.Name, c.ID)
+		points.addMultiplier("campaign.pointsMultiplier", detail, c.PointsMultiplier)
+		if c.BonusPoints != 0 {
+			points.add("campaign.bonusPoints", detail, c.BonusPoints)
+		}
+		if c.Category != nil {
+			points.add("campaign.category", detail, tally.categoryItems[i]*c.Category.PointsPerItem)
+		}
+	}
+}
+
+type listCampaignsResponse struct {
+	Campaigns []db.Campaign `json:"campaigns"`
+}
+
+func (a *App) ListCampaignsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	campaigns, err := a.store(ctx).ListCampaigns(ctx)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "Error listing campaigns", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(listCampaignsResponse{Campaigns: campaigns}); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+// CreateCampaignHandler stores a new campaign under a generated id
+func (a *App) CreateCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	a.saveCampaign(w, r, uuid.New().String(), http.StatusCreated)
+}
+
+// UpdateCampaignHandler replaces the campaign with the id in the URL, creating it if
+// it doesn't exist
+func (a *App) UpdateCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	a.saveCampaign(w, r, chi.URLParam(r, "id"), http.StatusOK)
+}
+
+func (a *App) saveCampaign(w http.ResponseWriter, r *http.Request, id string, status int) {
+	var c db.Campaign
+	err := json.NewDecoder(r.Body).Decode(&c)
+	defer r.Body.Close()
+	if err == nil {
+		err = validateCampaign(c)
+	}
+	if err != nil {
+		logging.Printf(r.Context(), "Invalid campaign: %v", err)
+		http.Error(w, "The campaign is invalid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.ID = id
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	if err := a.store(ctx).SaveCampaign(ctx, c); err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "Error saving campaign", http.StatusInternalServerError)
+		return
+	}
+	// other instances pick it up on their next refresh, this one right away
+	if err := a.refreshCampaigns(r.Context()); err != nil {
+		logging.Printf(r.Context(), "Error refreshing campaigns after saving %s: %v", c.ID, err)
+	}
+	logging.Printf(r.Context(), "Saved campaign %s (%s)", c.ID, c.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+func (a *App) DeleteCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	if err := a.store(ctx).DeleteCampaign(ctx, id); err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "No campaign found for that id", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error deleting campaign", http.StatusInternalServerError)
+		return
+	}
+	if err := a.refreshCampaigns(r.Context()); err != nil {
+		logging.Printf(r.Context(), "Error refreshing campaigns after deleting %s: %v", id, err)
+	}
+	logging.Printf(r.Context(), "Deleted campaign %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
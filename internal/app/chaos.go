@@ -0,0 +1,49 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/chaos"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/go-chi/chi"
+)
+
+// ListFaultsHandler shows the fault set on each target, if any, and how many calls
+// they've delayed and failed
+func (a *App) ListFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.Chaos.Stats()); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+// SetFaultHandler sets the fault in the body on the target, replacing the one it had
+func (a *App) SetFaultHandler(w http.ResponseWriter, r *http.Request) {
+	target := chi.URLParam(r, "target")
+	var fault chaos.Fault
+	err := json.NewDecoder(r.Body).Decode(&fault)
+	defer r.Body.Close()
+	if err == nil {
+		err = a.Chaos.Set(target, fault)
+	}
+	if err != nil {
+		logging.Printf(r.Context(), "Invalid fault for %s: %v", target, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logging.Printf(r.Context(), "Admin %q set a fault on %s: %+v", adminFromContext(r.Context()).subject, target, fault)
+	a.ListFaultsHandler(w, r)
+}
+
+// ClearFaultHandler clears the target's fault, every fault on DELETE /admin/chaos
+func (a *App) ClearFaultHandler(w http.ResponseWriter, r *http.Request) {
+	target := chi.URLParam(r, "target")
+	a.Chaos.Clear(target)
+	if target == "" {
+		target = "every target"
+	}
+	logging.Printf(r.Context(), "Admin %q cleared the faults on %s", adminFromContext(r.Context()).subject, target)
+	w.WriteHeader(http.StatusNoContent)
+}
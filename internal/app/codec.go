@@ -0,0 +1,285 @@
+package app
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+)
+
+// codec is a wire format for receipts coming in and responses going out. JSON is the
+// API's format, XML is there for partners whose POS systems can't emit anything else and
+// protobuf (protobuf.go) for high volume gateways.
+type codec interface {
+	contentType() string
+	// decodeReceipt scores items as they stream in, like decodeReceiptStream
+	decodeReceipt(body io.Reader, maxItems int, ruleSet *rules.RuleSet, campaigns []db.Campaign) (receipt, error)
+	// encode hands the encoded v to use, which must not keep it
+	encode(v interface{}, use func([]byte)) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) contentType() string { return "application/json" }
+
+func (jsonCodec) decodeReceipt(body io.Reader, maxItems int, ruleSet *rules.RuleSet, campaigns []db.Campaign) (receipt, error) {
+	return decodeReceiptStream(body, maxItems, ruleSet, campaigns)
+}
+
+func (jsonCodec) encode(v interface{}, use func([]byte)) error {
+	return marshalJSON(v, use)
+}
+
+// xmlCodec takes receipts shaped like the JSON ones, the element names are the JSON
+// field names:
+//
+//	<receipt><retailer>Target</retailer><purchaseDate>2022-01-01</purchaseDate>
+//	<purchaseTime>13:01</purchaseTime><total>35.35</total>
+//	<items><item><shortDescription>Pepsi</shortDescription><price>1.25</price></item></items>
+//	</receipt>
+//
+// discounts are <discounts><discount><description>..</description><amount>..</amount>
+// </discount></discounts>, the store is <store><id>..</id><city>..</city></store>.
+type xmlCodec struct{}
+
+func (xmlCodec) contentType() string { return "application/xml; charset=utf-8" }
+
+func (xmlCodec) decodeReceipt(body io.Reader, maxItems int, ruleSet *rules.RuleSet, campaigns []db.Campaign) (receipt, error) {
+	return decodeXMLReceipt(body, maxItems, ruleSet, campaigns)
+}
+
+func (xmlCodec) encode(v interface{}, use func([]byte)) error {
+	b := getJSONBuffer()
+	defer putJSONBuffer(b)
+	b.WriteString(xml.Header)
+	if err := xml.NewEncoder(&b.Buffer).Encode(v); err != nil {
+		return err
+	}
+	b.WriteByte('\n')
+	use(b.Bytes())
+	return nil
+}
+
+func isXMLMediaType(mediaType string) bool {
+	return mediaType == "application/xml" || mediaType == "text/xml"
+}
+
+// requestCodec is the codec for the request body, see bodyCodec
+func requestCodec(r *http.Request) codec {
+	return bodyCodec(r.Header.Get("Content-Type"))
+}
+
+// bodyCodec is the codec for a receipt body sent as contentType. Anything that isn't
+// XML or protobuf is read as JSON, clients have always been able to send JSON without a
+// Content-Type.
+func bodyCodec(contentType string) codec {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case isXMLMediaType(mediaType):
+		return xmlCodec{}
+	case isProtobufMediaType(mediaType):
+		return protobufCodec{}
+	}
+	return jsonCodec{}
+}
+
+// responseCodec picks the response format from the Accept header. XML has to be asked
+// for by name and preferred at least as much as JSON, wildcards get JSON.
+func responseCodec(r *http.Request) codec {
+	var jsonQ, xmlQ float64
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(raw, 64); err != nil {
+				continue
+			}
+		}
+		switch {
+		case isXMLMediaType(mediaType):
+			xmlQ = max(xmlQ, q)
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	if xmlQ > 0 && xmlQ >= jsonQ {
+		return xmlCodec{}
+	}
+	return jsonCodec{}
+}
+
+// decodeXMLReceipt is decodeReceiptStream for XML: items are scored one <item> at a
+// time and only kept while there are up to maxRetainedItems of them
+func decodeXMLReceipt(body io.Reader, maxItems int, ruleSet *rules.RuleSet, campaigns []db.Campaign) (receipt, error) {
+	var rec receipt
+	dec := xml.NewDecoder(body)
+	root, err := nextStartElement(dec)
+	if err != nil {
+		return receipt{}, fmt.Errorf("Error decoding receipt: %w", err)
+	}
+	if root.Name.Local != "receipt" {
+		return receipt{}, fmt.Errorf("Error decoding receipt: expected <receipt>, got <%s>", root.Name.Local)
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return receipt{}, fmt.Errorf("Error decoding receipt: %w", err)
+		}
+		if _, ok := tok.(xml.EndElement); ok {
+			break
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		var field *string
+		switch strings.ToLower(start.Name.Local) {
+		case "items":
+			if rec.tally != nil {
+				return receipt{}, errors.New("Error decoding receipt: items given twice")
+			}
+			if rec.Items, rec.tally, err = decodeXMLItems(dec, maxItems, ruleSet, campaigns); err != nil {
+				return receipt{}, err
+			}
+			continue
+		case "retailer":
+			field = &rec.Retailer
+		case "purchasedate":
+			field = &rec.PurchaseDate
+		case "purchasetime":
+			field = &rec.PurchaseTime
+		case "total":
+			field = &rec.Total
+		case "userid":
+			field = &rec.UserID
+		case "timezone":
+			field = &rec.Timezone
+		case "tax":
+			field = &rec.Tax
+		case "paymentmethod":
+			field = &rec.PaymentMethod
+		case "discounts":
+			if rec.Discounts, err = decodeXMLDiscounts(dec); err != nil {
+				return receipt{}, err
+			}
+			continue
+		case "store":
+			rec.Store = &storeLocation{}
+			if err := dec.DecodeElement(rec.Store, &start); err != nil {
+				return receipt{}, fmt.Errorf("Error decoding receipt element <%s>: %w", start.Name.Local, err)
+			}
+			continue
+		default:
+			if err := dec.Skip(); err != nil {
+				return receipt{}, fmt.Errorf("Error decoding receipt element <%s>: %w", start.Name.Local, err)
+			}
+			continue
+		}
+		if err := dec.DecodeElement(field, &start); err != nil {
+			return receipt{}, fmt.Errorf("Error decoding receipt element <%s>: %w", start.Name.Local, err)
+		}
+	}
+	if rec.tally == nil {
+		rec.tally = newItemTally(ruleSet, campaigns)
+	}
+	return rec, nil
+}
+
+// decodeXMLItems reads the <item> elements up to the closing </items>
+func decodeXMLItems(dec *xml.Decoder, maxItems int, ruleSet *rules.RuleSet, campaigns []db.Campaign) ([]item, *itemTally, error) {
+	tally := newItemTally(ruleSet, campaigns)
+	var items []item
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error decoding receipt items: %w", err)
+		}
+		if _, ok := tok.(xml.EndElement); ok {
+			return items, tally, nil
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "item" {
+			return nil, nil, fmt.Errorf("Error decoding receipt items: expected <item>, got <%s>", start.Name.Local)
+		}
+		var decoded xmlItem
+		if err := dec.DecodeElement(&decoded, &start); err != nil {
+			return nil, nil, fmt.Errorf("Error decoding receipt item %d: %w", tally.count+1, err)
+		}
+		it := normalizeItem(item(decoded))
+		if err := validateItem(it); err != nil {
+			return nil, nil, fmt.Errorf("Error decoding receipt item %d: %w", tally.count+1, err)
+		}
+		if tally.count == maxItems {
+			return nil, nil, fmt.Errorf("Error decoding receipt items: %w, the limit is %d", errTooManyItems, maxItems)
+		}
+		tally.add(it)
+		if tally.count <= maxRetainedItems {
+			items = append(items, it)
+		} else {
+			items = nil
+		}
+	}
+}
+
+// decodeXMLDiscounts reads the <discount> elements up to the closing </discounts>, at
+// most maxDiscounts of them
+func decodeXMLDiscounts(dec *xml.Decoder) ([]discount, error) {
+	var discounts []discount
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding receipt discounts: %w", err)
+		}
+		if _, ok := tok.(xml.EndElement); ok {
+			return discounts, nil
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "discount" {
+			return nil, fmt.Errorf("Error decoding receipt discounts: expected <discount>, got <%s>", start.Name.Local)
+		}
+		if len(discounts) == maxDiscounts {
+			return nil, fmt.Errorf("Error decoding receipt discounts: more than %d", maxDiscounts)
+		}
+		var d discount
+		if err := dec.DecodeElement(&d, &start); err != nil {
+			return nil, fmt.Errorf("Error decoding receipt discount %d: %w", len(discounts)+1, err)
+		}
+		discounts = append(discounts, d)
+	}
+}
+
+type xmlItem struct {
+	ShortDescription string `xml:"shortDescription"`
+	Price            string `xml:"price"`
+	Quantity         int    `xml:"quantity"`
+	UnitPrice        string `xml:"unitPrice"`
+}
+
+// nextStartElement skips the prolog (declaration, comments, whitespace) up to the root
+func nextStartElement(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start, nil
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/events"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+var (
+	errUnderReview   = errors.New("receipt is held for fraud review")
+	errOtherUser     = errors.New("receipt belongs to another user")
+	errOverFraudCaps = errors.New("corrected receipt is over the fraud caps")
+)
+
+type correctResponse struct {
+	ID     string `json:"id"`
+	Points int    `json:"points"`
+	// the original submission is revision 1
+	Revision int `json:"revision"`
+}
+
+// correctRecord is the stored record with the contents of the corrected receipt,
+// rescored, and what it was before added to its revisions. Everything that identifies
+// the receipt (id, creation time, user) is kept.
+//
+// design decision: so are the points' expiry date and the retention class. points are
+// expired per receipt from the date they were awarded with, a correction moving that
+// date would mean rebuilding the user's lots
+func correctRecord(stored db.ReceiptRecord, rec receipt, ruleSet *rules.RuleSet, campaigns []db.Campaign, now time.Time) (db.ReceiptRecord, error) {
+	scored, err := newReceiptRecord(rec, ruleSet, campaigns, 0, now)
+	if err != nil {
+		return db.ReceiptRecord{}, err
+	}
+	corrected := stored
+	corrected.Retailer = scored.Retailer
+	corrected.RetailerID = scored.RetailerID
+	corrected.PurchaseDate = scored.PurchaseDate
+	corrected.Points = scored.Points
+	corrected.RulesVersion = scored.RulesVersion
+	corrected.Breakdown = scored.Breakdown
+	corrected.Receipt = scored.Receipt
+	corrected.Revisions = append(append([]db.ReceiptRevision{}, stored.Revisions...), db.ReceiptRevision{
+		Retailer:     stored.Retailer,
+		PurchaseDate: stored.PurchaseDate,
+		Points:       stored.Points,
+		RulesVersion: stored.RulesVersion,
+		Receipt:      stored.Receipt,
+		ReplacedAt:   now.UTC(),
+	})
+	return corrected, nil
+}
+
+// correctReceipt replaces a stored receipt's contents with a corrected version of it and
+// moves its user's balance by the change in points. Receipts waiting on (or rejected
+// by) fraud review can't be corrected, and when screening is on neither can a
+// correction go over the caps a new receipt would be flagged for.
+//
+// design decision: last write wins. two corrections of the same receipt racing each
+// other both get saved but only one ends up in the history, same as with rescoring
+func (a *App) correctReceipt(ctx context.Context, id string, rec receipt) (db.ReceiptRecord, error) {
+	release, err := a.Processing.Acquire(ctx)
+	if err != nil {
+		return db.ReceiptRecord{}, err
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+	defer cancel()
+	stored, err := a.store(ctx).GetReceipt(ctx, id)
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error reading receipt to correct: %w", err)
+	}
+	if stored.Status != "" {
+		return db.ReceiptRecord{}, errUnderReview
+	}
+	if rec.UserID != "" && rec.UserID != stored.UserID {
+		return db.ReceiptRecord{}, errOtherUser
+	}
+	rec.UserID = stored.UserID
+	if cfg := a.config(); cfg.FraudScreening {
+		if reasons := capReasons(cfg, rec); len(reasons) > 0 {
+			return db.ReceiptRecord{}, fmt.Errorf("%w: %s", errOverFraudCaps, strings.Join(reasons, "; "))
+		}
+	}
+
+	corrected, err := correctRecord(stored, a.withRetailerID(ctx, rec), a.ruleSet(ctx), a.campaigns(ctx), a.scoringNow())
+	if err != nil {
+		return db.ReceiptRecord{}, err
+	}
+	err = a.store(ctx).UpdateReceipts(ctx, []db.ReceiptUpdate{{
+		Record:          corrected,
+		OldPoints:       stored.Points,
+		OldRetailer:     stored.Retailer,
+		OldRetailerID:   stored.RetailerID,
+		OldPurchaseDate: stored.PurchaseDate,
+	}})
+	a.forgetReceipts(ctx, id)
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error saving corrected receipt: %w", err)
+	}
+
+	logging.Printf(ctx, "Corrected receipt %s, pts: %d -> %d", id, stored.Points, corrected.Points)
+	tenantID := tenant.FromContext(ctx).ID
+	a.publish(events.Event{
+		Type:      events.ReceiptCorrected,
+		ID:        corrected.ID,
+		Retailer:  corrected.Retailer,
+		Points:    corrected.Points,
+		UserID:    corrected.UserID,
+		Tenant:    tenantID,
+		Timestamp: a.now(),
+	})
+	if a.Archive != nil && rec.raw != nil {
+		a.Archive.Correction(tenantID, id, len(corrected.Revisions)+1, rec.rawType, rec.raw)
+	}
+	return corrected, nil
+}
+
+// CorrectReceiptHandler takes a corrected version of a previously submitted receipt,
+// in the same format as /receipts/process, rescores it and overwrites the stored one.
+// What the receipt was before is kept in its revision history.
+func (a *App) CorrectReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if ok, err := isValidUUIDv4(id); !ok {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusNotFound, codeReceiptNotFound, msgReceiptNotFound)
+		return
+	}
+	defer r.Body.Close()
+	rec, ok := a.readReceipt(w, r)
+	if !ok {
+		return
+	}
+	corrected, err := a.correctReceipt(r.Context(), id, rec)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		switch {
+		case errors.Is(err, errUnderReview):
+			writeError(w, r, http.StatusConflict, codeUnderReview, msgUnderReview)
+		case errors.Is(err, errOtherUser):
+			writeError(w, r, http.StatusForbidden, codeForbidden, msgOtherUsersReceipt)
+		case errors.Is(err, errOverFraudCaps):
+			writeError(w, r, http.StatusUnprocessableEntity, codeValidationFailed, msgOverFraudCaps)
+		default:
+			a.writeReceiptError(w, r, err)
+		}
+		return
+	}
+	responseToClient := correctResponse{ID: corrected.ID, Points: corrected.Points, Revision: len(corrected.Revisions) + 1}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+package app
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+const maxCSVImportBytes = 32 << 20
+
+// CSV columns, matched case-insensitively in any order. Every row is one item; rows
+// sharing a receipt_ref make up one receipt, so the receipt level columns must agree
+// across those rows. Without a receipt_ref column every row is its own receipt.
+const (
+	csvColReceiptRef      = "receipt_ref"
+	csvColRetailer        = "retailer"
+	csvColPurchaseDate    = "purchase_date"
+	csvColPurchaseTime    = "purchase_time"
+	csvColTotal           = "total"
+	csvColItemDescription = "item_description"
+	csvColItemPrice       = "item_price"
+	csvColItemQuantity    = "item_quantity"
+	csvColItemUnitPrice   = "item_unit_price"
+	csvColUserID          = "user_id"
+	csvColTimezone        = "timezone"
+	csvColTax             = "tax"
+	csvColPaymentMethod   = "payment_method"
+	csvColStoreID         = "store_id"
+)
+
+var requiredCSVColumns = []string{
+	csvColRetailer, csvColPurchaseDate, csvColPurchaseTime, csvColTotal, csvColItemDescription, csvColItemPrice,
+}
+
+// csvRowResult is the outcome of a row's receipt. Index is the receipt's position in
+// the upload, 0-based and in the order receipt_refs first show up. items[k] in Errors
+// is the receipt's k-th row
+type csvRowResult struct {
+	Row         int          `json:"row"`
+	Index       int          `json:"index"`
+	ReceiptRef  string       `json:"receiptRef"`
+	ID          string       `json:"id,omitempty"`
+	Points      *int         `json:"points,omitempty"`
+	Status      string       `json:"status,omitempty"`
+	Provisional bool         `json:"provisional,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Errors      []fieldError `json:"errors,omitempty"`
+}
+
+type csvImportResponse struct {
+	importSummary
+	Rows []csvRowResult `json:"rows"`
+}
+
+type csvReceipt struct {
+	ref  string
+	rows []int
+	rec  receipt
+	err  string
+}
+
+func isCSVUpload(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "text/csv" || mediaType == "multipart/form-data"
+}
+
+// csvBody returns the uploaded CSV, either the raw body or the "file" part of a
+// multipart form
+func csvBody(r *http.Request) (io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, nil
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading multipart file field: %v", err)
+	}
+	return file, nil
+}
+
+// parseCSVReceipts groups CSV rows into receipts, keeping the order in which each
+// receipt_ref first shows up. Row numbers are 1-based and include the header row so
+// they match what a spreadsheet shows.
+func parseCSVReceipts(body io.Reader) ([]*csvReceipt, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+	// fields are copied out of every row before the next one is read
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CSV header: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range requiredCSVColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("CSV is missing required column %q", name)
+		}
+	}
+	refCol, hasRef := columns[csvColReceiptRef]
+	userCol, hasUser := columns[csvColUserID]
+	timezoneCol, hasTimezone := columns[csvColTimezone]
+	taxCol, hasTax := columns[csvColTax]
+	paymentCol, hasPayment := columns[csvColPaymentMethod]
+	storeCol, hasStore := columns[csvColStoreID]
+	quantityCol, hasQuantity := columns[csvColItemQuantity]
+	unitPriceCol, hasUnitPrice := columns[csvColItemUnitPrice]
+
+	var receipts []*csvReceipt
+	byRef := make(map[string]*csvReceipt)
+	for rowNo := 2; ; rowNo++ {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// a row with the wrong number of fields gets reported, the rest still go through
+			if errors.Is(err, csv.ErrFieldCount) {
+				receipts = append(receipts, &csvReceipt{ref: strconv.Itoa(rowNo), rows: []int{rowNo}, err: err.Error()})
+				continue
+			}
+			return nil, fmt.Errorf("Error reading CSV: %v", err)
+		}
+
+		ref := strconv.Itoa(rowNo)
+		if hasRef && strings.TrimSpace(row[refCol]) != "" {
+			ref = strings.TrimSpace(row[refCol])
+		}
+		fields := receipt{
+			Retailer:     row[columns[csvColRetailer]],
+			PurchaseDate: strings.TrimSpace(row[columns[csvColPurchaseDate]]),
+			PurchaseTime: strings.TrimSpace(row[columns[csvColPurchaseTime]]),
+			Total:        strings.TrimSpace(row[columns[csvColTotal]]),
+		}
+		if hasUser {
+			fields.UserID = strings.TrimSpace(row[userCol])
+		}
+		if hasTimezone {
+			fields.Timezone = strings.TrimSpace(row[timezoneCol])
+		}
+		if hasTax {
+			fields.Tax = strings.TrimSpace(row[taxCol])
+		}
+		if hasPayment {
+			fields.PaymentMethod = strings.TrimSpace(row[paymentCol])
+		}
+		if hasStore {
+			if id := strings.TrimSpace(row[storeCol]); id != "" {
+				fields.Store = &storeLocation{ID: id}
+			}
+		}
+		it := item{
+			ShortDescription: row[columns[csvColItemDescription]],
+			Price:            strings.TrimSpace(row[columns[csvColItemPrice]]),
+		}
+		if hasUnitPrice {
+			it.UnitPrice = strings.TrimSpace(row[unitPriceCol])
+		}
+		var quantityErr string
+		if hasQuantity {
+			if raw := strings.TrimSpace(row[quantityCol]); raw != "" {
+				var err error
+				if it.Quantity, err = strconv.Atoi(raw); err != nil {
+					quantityErr = fmt.Sprintf("row %d has an item_quantity that isn't a whole number: %q", rowNo, raw)
+				}
+			}
+		}
+
+		group, ok := byRef[ref]
+		if !ok {
+			group = &csvReceipt{ref: ref, rec: fields}
+			byRef[ref] = group
+			receipts = append(receipts, group)
+		} else if group.rec.Retailer != fields.Retailer || group.rec.PurchaseDate != fields.PurchaseDate ||
+			group.rec.PurchaseTime != fields.PurchaseTime || group.rec.Total != fields.Total || group.rec.UserID != fields.UserID || group.rec.Timezone != fields.Timezone ||
+			group.rec.Tax != fields.Tax || group.rec.PaymentMethod != fields.PaymentMethod || group.rec.storeID() != fields.storeID() {
+			group.err = fmt.Sprintf("row %d disagrees with earlier rows of receipt %q on retailer, date, time, total, user, timezone, tax, payment method or store", rowNo, ref)
+		}
+		if quantityErr != "" && group.err == "" {
+			group.err = quantityErr
+		}
+		group.rows = append(group.rows, rowNo)
+		group.rec.Items = append(group.rec.Items, it)
+	}
+	return receipts, nil
+}
+
+// importCSV handles the text/csv and multipart flavors of /receipts/import. Unlike the
+// NDJSON path the whole file is read up front, rows of one receipt don't have to be
+// adjacent, so the response (one entry per row) is only written once everything ran.
+// An atomic upload is processed in one batch, only when every receipt parsed.
+func (a *App) importCSV(w http.ResponseWriter, r *http.Request, atomic bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCSVImportBytes)
+	defer r.Body.Close()
+	body, err := csvBody(r)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgCSVInvalid)
+		return
+	}
+	receipts, err := parseCSVReceipts(body)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgCSVInvalidDetail, err.Error())
+		return
+	}
+	if atomic && len(receipts) > maxAtomicImportReceipts {
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeValidationFailed, msgAtomicImportTooLarge, maxAtomicImportReceipts)
+		return
+	}
+
+	// valid receipts are saved importBatchSize at a time, one round trip per batch
+	results := make([]csvRowResult, len(receipts))
+	var (
+		pending []receipt
+		indexes []int
+	)
+	process := func() {
+		stored, errs := a.processReceipts(r.Context(), pending, atomic)
+		for j, i := range indexes {
+			if errs[j] != nil {
+				logging.Printf(r.Context(), "Error processing CSV receipt %q: %v", receipts[i].ref, errs[j])
+				results[i].Error = processErrorMessage(r, errs[j])
+				results[i].Errors = processFieldErrors(receipts[i].rec, errs[j], a.scoringNow())
+				continue
+			}
+			results[i].ID = stored[j].ID
+			results[i].Points = &stored[j].Points
+			results[i].Status = stored[j].Status
+			results[i].Provisional = a.provisional(r.Context(), stored[j].ID)
+		}
+		pending, indexes = pending[:0], indexes[:0]
+	}
+	for i, group := range receipts {
+		results[i] = csvRowResult{Index: i, ReceiptRef: group.ref, Error: group.err}
+		if group.err != "" {
+			continue
+		}
+		if err := resolveUserID(r, &group.rec); err != nil {
+			logging.Printf(r.Context(), "Invalid user for CSV receipt %q: %v", group.ref, err)
+			results[i].Error = localize(r, msgUserIDInvalid)
+			results[i].Errors = []fieldError{{Field: "userId", Message: err.Error()}}
+			continue
+		}
+		pending = append(pending, group.rec)
+		indexes = append(indexes, i)
+		if len(pending) == importBatchSize && !atomic {
+			process()
+		}
+	}
+	switch {
+	case atomic && len(pending) < len(receipts):
+		for _, i := range indexes {
+			results[i].Error = localize(r, msgImportRolledBack)
+		}
+	case len(pending) > 0:
+		process()
+	}
+
+	responseToClient := csvImportResponse{importSummary: importSummary{Atomic: atomic}, Rows: []csvRowResult{}}
+	for i, group := range receipts {
+		result := results[i]
+		responseToClient.count(result.Error != "")
+		for _, row := range group.rows {
+			result.Row = row
+			responseToClient.Rows = append(responseToClient.Rows, result)
+		}
+	}
+	responseToClient.RolledBack = atomic && responseToClient.Failed > 0
+	sort.Slice(responseToClient.Rows, func(i, j int) bool {
+		return responseToClient.Rows[i].Row < responseToClient.Rows[j].Row
+	})
+	logging.Printf(r.Context(), "CSV import finished: %d receipts processed, %d failed", responseToClient.Processed, responseToClient.Failed)
+
+	if err := writeJSON(w, responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package app
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/breaker"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+//go:embed ui
+var dashboardFiles embed.FS
+
+var (
+	dashboardAssets = mustSub(dashboardFiles, "ui")
+	dashboardPage   = template.Must(template.ParseFS(dashboardFiles, "ui/index.html"))
+)
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+const (
+	// how many of the newest receipts the dashboard lists, and how many the points
+	// distribution is drawn from
+	dashboardRecentReceipts = 20
+	dashboardSampleReceipts = maxListLimit
+)
+
+// pointsBuckets are the lower bounds of the points distribution's buckets
+var pointsBuckets = []int{0, 25, 50, 100, 250, 500, 1000}
+
+type dashboardStore struct {
+	Status  string         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Breaker *breaker.Stats `json:"breaker,omitempty"`
+	Stats   *db.StoreStats `json:"stats,omitempty"`
+}
+
+type dashboardReceipt struct {
+	ID           string    `json:"id"`
+	Retailer     string    `json:"retailer"`
+	PurchaseDate string    `json:"purchaseDate"`
+	Points       int       `json:"points"`
+	Status       string    `json:"status,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+type pointsBucket struct {
+	// the bucket holds receipts of Min points up to and including Max, no Max for the
+	// last one
+	Min      int  `json:"min"`
+	Max      *int `json:"max,omitempty"`
+	Receipts int  `json:"receipts"`
+}
+
+type dashboardOverview struct {
+	GeneratedAt  time.Time          `json:"generatedAt"`
+	RulesVersion string             `json:"rulesVersion"`
+	Store        dashboardStore     `json:"store"`
+	Recent       []dashboardReceipt `json:"recentReceipts"`
+	// over the newest receipts, Sampled of them
+	PointsDistribution []pointsBucket `json:"pointsDistribution"`
+	Sampled            int            `json:"sampled"`
+}
+
+// DashboardHandler serves the dashboard's page. The page and its assets carry no data,
+// everything it shows comes from GET /admin/overview, which needs the read capability.
+func (a *App) DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	dashboardHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct{ Login bool }{Login: a.OIDC != nil && a.OIDC.Login()}
+	if err := dashboardPage.Execute(w, data); err != nil {
+		logging.Printf(r.Context(), "Error rendering the dashboard: %v", err)
+	}
+}
+
+// DashboardAssetsHandler serves the dashboard's scripts and styles
+func (a *App) DashboardAssetsHandler() http.Handler {
+	files := http.StripPrefix("/admin/ui/", http.FileServer(http.FS(dashboardAssets)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dashboardHeaders(w)
+		files.ServeHTTP(w, r)
+	})
+}
+
+// dashboardHeaders keep the dashboard from running anything it didn't ship with or
+// being framed by another site, and browsers from keeping a stale copy after a deploy
+func dashboardHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-cache")
+}
+
+// DashboardOverviewHandler is what the dashboard shows, in one call: store health, the
+// rules version, store stats, the newest receipts and how their points are spread. A
+// store that's down doesn't fail it, that's shown as the store's status.
+func (a *App) DashboardOverviewHandler(w http.ResponseWriter, r *http.Request) {
+	overview := dashboardOverview{
+		GeneratedAt:  a.now().UTC(),
+		RulesVersion: a.ruleSet(r.Context()).Version,
+		Store:        dashboardStore{Status: "ok"},
+		Recent:       []dashboardReceipt{},
+	}
+	if a.Breaker != nil {
+		stats := a.Breaker.Stats()
+		overview.Store.Breaker = &stats
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	if err := a.loadOverview(ctx, &overview); err != nil {
+		logging.Printf(r.Context(), "Error loading the dashboard overview: %v", err)
+		overview.Store.Status = "unavailable"
+		overview.Store.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(overview); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+func (a *App) loadOverview(ctx context.Context, overview *dashboardOverview) error {
+	if err := a.Db.CheckConnection(ctx); err != nil {
+		return err
+	}
+	stats, err := a.store(ctx).Stats(ctx)
+	if err != nil {
+		return err
+	}
+	overview.Store.Stats = &stats
+	records, _, err := a.store(ctx).ListReceipts(ctx, db.ListFilter{Limit: dashboardSampleReceipts})
+	if err != nil {
+		return err
+	}
+	recent := records
+	if len(recent) > dashboardRecentReceipts {
+		recent = recent[:dashboardRecentReceipts]
+	}
+	for _, rec := range recent {
+		overview.Recent = append(overview.Recent, dashboardReceipt{
+			ID:           rec.ID,
+			Retailer:     rec.Retailer,
+			PurchaseDate: rec.PurchaseDate,
+			Points:       rec.Points,
+			Status:       rec.Status,
+			CreatedAt:    rec.CreatedAt,
+		})
+	}
+	overview.PointsDistribution = distributePoints(records)
+	overview.Sampled = len(records)
+	return nil
+}
+
+// distributePoints counts the records into pointsBuckets
+func distributePoints(records []db.ReceiptRecord) []pointsBucket {
+	buckets := make([]pointsBucket, len(pointsBuckets))
+	for i, min := range pointsBuckets {
+		buckets[i].Min = min
+		if i+1 < len(pointsBuckets) {
+			max := pointsBuckets[i+1] - 1
+			buckets[i].Max = &max
+		}
+	}
+	for _, rec := range records {
+		// anything under the lowest bound counts with the first bucket
+		i := len(buckets) - 1
+		for i > 0 && rec.Points < buckets[i].Min {
+			i--
+		}
+		buckets[i].Receipts++
+	}
+	return buckets
+}
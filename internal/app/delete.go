@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/events"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+// deleteReceipt soft deletes a receipt on behalf of caller, the authenticated user or
+// "" when there is none. The tombstone is purged by the retention sweeper after
+// TOMBSTONE_RETENTION_IN_S.
+func (a *App) deleteReceipt(ctx context.Context, id, caller string) (db.ReceiptRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+	defer cancel()
+	stored, err := a.store(ctx).GetReceipt(ctx, id)
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error reading receipt to delete: %w", err)
+	}
+	if caller != "" && caller != stored.UserID {
+		return db.ReceiptRecord{}, errOtherUser
+	}
+	deleted, err := a.store(ctx).SoftDeleteReceipt(ctx, id, a.now())
+	a.forgetReceipts(ctx, id)
+	if err != nil {
+		return db.ReceiptRecord{}, err
+	}
+	logging.Printf(ctx, "Soft deleted receipt %s", id)
+	a.publishRemoval(ctx, events.ReceiptDeleted, deleted)
+	return deleted, nil
+}
+
+// publishRemoval sends the event for a receipt that was deleted or purged
+func (a *App) publishRemoval(ctx context.Context, eventType string, rec db.ReceiptRecord) {
+	a.publish(events.Event{
+		Type:      eventType,
+		ID:        rec.ID,
+		Retailer:  rec.Retailer,
+		Points:    rec.Points,
+		UserID:    rec.UserID,
+		Tenant:    tenant.FromContext(ctx).ID,
+		Timestamp: a.now(),
+	})
+}
+
+// DeleteReceiptHandler deletes a receipt for its user: it's gone from lookups,
+// listings and the user's history right away, points it awarded stay in the balance.
+// Only the receipt's user can delete a receipt credited to one.
+func (a *App) DeleteReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if ok, err := isValidUUIDv4(id); !ok {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusNotFound, codeReceiptNotFound, msgReceiptNotFound)
+		return
+	}
+	if _, err := a.deleteReceipt(r.Context(), id, r.Header.Get(userIDHeader)); err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if errors.Is(err, errOtherUser) {
+			writeError(w, r, http.StatusForbidden, codeForbidden, msgOtherUsersReceipt)
+			return
+		}
+		a.writeReceiptError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
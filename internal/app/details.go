@@ -0,0 +1,73 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the optional receipt fields POS integrations send on top of the original schema.
+// They're bounded so a receipt's raw contents stay a reasonable size to store
+const (
+	maxDiscounts         = 100
+	maxDetailFieldLength = 128
+)
+
+// discount is a discount line of a receipt. Amount is what was taken off, in the same
+// format as prices
+type discount struct {
+	Description string `json:"description" xml:"description"`
+	Amount      string `json:"amount" xml:"amount"`
+}
+
+// storeLocation is where the receipt is from. Every field is optional, ID is what
+// storePoints rules match on
+type storeLocation struct {
+	ID         string `json:"id,omitempty" xml:"id,omitempty"`
+	Address    string `json:"address,omitempty" xml:"address,omitempty"`
+	City       string `json:"city,omitempty" xml:"city,omitempty"`
+	Region     string `json:"region,omitempty" xml:"region,omitempty"`
+	PostalCode string `json:"postalCode,omitempty" xml:"postalCode,omitempty"`
+	Country    string `json:"country,omitempty" xml:"country,omitempty"`
+}
+
+// validateDetails checks the optional fields of a receipt that has them. The total is
+// what was paid after tax and discounts, neither changes how it's scored.
+func validateDetails(rec receipt) error {
+	if rec.Tax != "" {
+		if _, err := parseDollarAsStringInput(rec.Tax); err != nil {
+			return fmt.Errorf("Error parsing receipt tax: %v", err)
+		}
+	}
+	if len(rec.Discounts) > maxDiscounts {
+		return fmt.Errorf("Error parsing receipt discounts: more than %d", maxDiscounts)
+	}
+	for i, d := range rec.Discounts {
+		if strings.TrimSpace(d.Description) == "" {
+			return fmt.Errorf("Error parsing receipt discount %d: no description", i+1)
+		}
+		if _, err := parseDollarAsStringInput(d.Amount); err != nil {
+			return fmt.Errorf("Error parsing receipt discount %d amount: %v", i+1, err)
+		}
+	}
+	fields := []string{rec.PaymentMethod}
+	for _, d := range rec.Discounts {
+		fields = append(fields, d.Description)
+	}
+	if s := rec.Store; s != nil {
+		fields = append(fields, s.ID, s.Address, s.City, s.Region, s.PostalCode, s.Country)
+	}
+	for _, f := range fields {
+		if len(f) > maxDetailFieldLength {
+			return fmt.Errorf("Error parsing receipt: %q is longer than %d bytes", f[:32]+"...", maxDetailFieldLength)
+		}
+	}
+	return nil
+}
+
+// storeID is the id of the store a receipt is from, "" when it doesn't say
+func (rec receipt) storeID() string {
+	if rec.Store == nil {
+		return ""
+	}
+	return strings.TrimSpace(rec.Store.ID)
+}
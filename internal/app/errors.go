@@ -0,0 +1,185 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/breaker"
+	"github.com/jayreddy040-510/receipt_processor/internal/concurrency"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/i18n"
+)
+
+// error codes sent in JSON error bodies. clients switch on these, the messages next to
+// them are for people, translated and may change
+const (
+	codeReceiptNotFound    = "RECEIPT_NOT_FOUND"
+	codeUserNotFound       = "USER_NOT_FOUND"
+	codeValidationFailed   = "VALIDATION_FAILED"
+	codeStoreUnavailable   = "STORE_UNAVAILABLE"
+	codeOverloaded         = "OVERLOADED"
+	codeRateLimited        = "RATE_LIMITED"
+	codeQuotaExceeded      = "QUOTA_EXCEEDED"
+	codeUnderReview        = "RECEIPT_UNDER_REVIEW"
+	codeInsufficientPoints = "INSUFFICIENT_POINTS"
+	codeConflict           = "CONFLICT"
+	codeUnauthorized       = "UNAUTHORIZED"
+	codeForbidden          = "FORBIDDEN"
+	codeUnsupportedMedia   = "UNSUPPORTED_MEDIA_TYPE"
+	codeNotAcceptable      = "NOT_ACCEPTABLE"
+	codeOCRFailed          = "OCR_FAILED"
+	codeInternal           = "INTERNAL_ERROR"
+)
+
+// ids of the messages in the i18n catalogs
+const (
+	msgReceiptNotFound       = "receipt_not_found"
+	msgReceiptInvalid        = "receipt_invalid"
+	msgTooManyItems          = "receipt_too_many_items"
+	msgReceiptNotSaved       = "receipt_not_saved"
+	msgReceiptInProgress     = "receipt_in_progress"
+	msgUnderReview           = "receipt_under_review"
+	msgOtherUsersReceipt     = "receipt_other_user"
+	msgOverFraudCaps         = "receipt_over_fraud_caps"
+	msgUserIDInvalid         = "user_id_invalid"
+	msgUserNotFound          = "user_not_found"
+	msgOtherUsersPoints      = "user_other_points"
+	msgOtherUsersRedemptions = "user_other_redemptions"
+	msgRedemptionInvalid     = "redemption_invalid"
+	msgInsufficientPoints    = "redemption_insufficient_points"
+	msgRedemptionConflict    = "redemption_conflict"
+	msgQueryInvalid          = "query_invalid"
+	msgLimitOutOfRange       = "limit_out_of_range"
+	msgTopOutOfRange         = "top_out_of_range"
+	msgStatsRangeInvalid     = "stats_range_invalid"
+	msgImageInvalid          = "image_invalid"
+	msgImageUnreadable       = "image_unreadable"
+	msgCSVInvalid            = "csv_invalid"
+	msgCSVInvalidDetail      = "csv_invalid_detail"
+	msgGzipInvalid           = "gzip_invalid"
+	msgRequestTooLarge       = "request_too_large"
+	msgImportRolledBack      = "import_rolled_back"
+	msgAtomicImportTooLarge  = "import_atomic_too_large"
+	msgEncodingUnsupported   = "encoding_unsupported"
+	msgRetentionClassUnknown = "retention_class_unknown"
+	msgAPIKeyInvalid         = "api_key_invalid"
+	msgRateLimited           = "rate_limited"
+	msgQuotaExceeded         = "quota_exceeded"
+	msgAPIVersionMismatch    = "api_version_mismatch"
+	msgAPIVersionUnsupported = "api_version_unsupported"
+	msgServiceBusy           = "service_busy"
+	msgServiceUnavailable    = "service_unavailable"
+	msgInternal              = "internal_error"
+)
+
+// errInvalidReceipt marks receipts that can't be scored as they are, as opposed to
+// ones that couldn't be stored
+var errInvalidReceipt = errors.New("invalid receipt")
+
+type errorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// localize is the message with the id in the language the request asked for
+func localize(r *http.Request, id string, args ...interface{}) string {
+	return i18n.Translate(i18n.Negotiate(r.Header.Get("Accept-Language")), id, args...)
+}
+
+// writeError is http.Error with a JSON body carrying a stable code and the message
+// translated to the request's Accept-Language. The request id is put in the body since
+// requestIDWriter only annotates plain text errors.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, msgID string, args ...interface{}) {
+	lang := i18n.Negotiate(r.Header.Get("Accept-Language"))
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Language", lang)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Add("Vary", "Accept-Language")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Code: code, Message: i18n.Translate(lang, msgID, args...), RequestID: h.Get(requestIDHeader)})
+}
+
+// isStoreUnavailable reports whether err means the store couldn't be reached in time,
+// so the same request may well work later
+func isStoreUnavailable(err error) bool {
+	return errors.Is(err, db.ErrUnavailable) || errors.Is(err, breaker.ErrOpen) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// writeStoreUnavailable answers 503 with a Retry-After when err comes from the store
+// not answering (its circuit breaker being open included), 429 when it's from too much
+// concurrent work, and reports whether it did. Handlers call it before their usual
+// error response.
+func (a *App) writeStoreUnavailable(w http.ResponseWriter, r *http.Request, err error) bool {
+	if errors.Is(err, concurrency.ErrSaturated) {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusTooManyRequests, codeOverloaded, msgServiceBusy)
+		return true
+	}
+	if !isStoreUnavailable(err) {
+		return false
+	}
+	retryAfter := 1
+	if a.Breaker != nil {
+		retryAfter = max(1, int(math.Ceil(a.Breaker.RetryAfter().Seconds())))
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeError(w, r, http.StatusServiceUnavailable, codeStoreUnavailable, msgServiceUnavailable)
+	return true
+}
+
+// writeBodyTooLarge answers 413 when err comes from reading a request body past
+// MAX_REQUEST_BODY_BYTES and reports whether it did
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	writeError(w, r, http.StatusRequestEntityTooLarge, codeValidationFailed, msgRequestTooLarge, tooLarge.Limit)
+	return true
+}
+
+// writeReceiptError answers for a receipt that couldn't be processed or looked up: 404
+// when the store doesn't have it, 400 when it failed validation, 409 when an identical
+// one is still being processed, 503 or 429 when the store is down or busy. Anything
+// else is a 500, it's not the client's fault.
+func (a *App) writeReceiptError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case a.writeStoreUnavailable(w, r, err), a.writeQuotaExceeded(w, r, err):
+	case errors.Is(err, errInvalidReceipt):
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgReceiptInvalid)
+	case errors.Is(err, errSubmissionInProgress):
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusConflict, codeConflict, msgReceiptInProgress)
+	case errors.Is(err, db.ErrNotFound):
+		writeError(w, r, http.StatusNotFound, codeReceiptNotFound, msgReceiptNotFound)
+	default:
+		writeError(w, r, http.StatusInternalServerError, codeInternal, msgInternal)
+	}
+}
+
+// processErrorMessage is what bulk endpoints report for a receipt that failed
+// processReceipt, since they can't answer with a status code per receipt
+func processErrorMessage(r *http.Request, err error) string {
+	switch {
+	case errors.Is(err, errInvalidReceipt):
+		return localize(r, msgReceiptInvalid)
+	case errors.Is(err, errImportRolledBack):
+		return localize(r, msgImportRolledBack)
+	case errors.Is(err, errQuotaExceeded):
+		return localize(r, msgQuotaExceeded)
+	case errors.Is(err, errSubmissionInProgress):
+		return localize(r, msgReceiptInProgress)
+	case errors.Is(err, concurrency.ErrSaturated):
+		return localize(r, msgServiceBusy)
+	case isStoreUnavailable(err):
+		return localize(r, msgServiceUnavailable)
+	}
+	return localize(r, msgReceiptNotSaved)
+}
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+)
+
+// a rules document and a receipt, both well under it
+const maxEvaluateRulesBytes = 1 << 20
+
+type evaluateRulesRequest struct {
+	// a document in the RULES_PATH format
+	Rules   json.RawMessage `json:"rules"`
+	Receipt json.RawMessage `json:"receipt"`
+}
+
+type evaluateRulesResponse struct {
+	scoreResponse
+	// the same receipt scored with the active rules, to compare with
+	Current scoreResponse `json:"current"`
+}
+
+// EvaluateRulesHandler scores a sample receipt with a candidate rules document, without
+// activating the rules, next to what the active rules give it. Active campaigns apply to
+// both. It's for rule authors to try a change before they reload: a candidate that
+// doesn't load or fails on the receipt gets a 422, a receipt that isn't valid a 400,
+// each with the error.
+func (a *App) EvaluateRulesHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req evaluateRulesRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEvaluateRulesBytes)).Decode(&req); err != nil {
+		http.Error(w, "Error decoding request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Rules) == 0 || len(req.Receipt) == 0 {
+		http.Error(w, "The request needs rules and a receipt", http.StatusBadRequest)
+		return
+	}
+	candidate, err := a.Rules.Parse(req.Rules)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	campaigns := a.campaigns(r.Context())
+	var responseToClient evaluateRulesResponse
+	for _, score := range []struct {
+		ruleSet *rules.RuleSet
+		into    *scoreResponse
+	}{{candidate, &responseToClient.scoreResponse}, {a.ruleSet(r.Context()), &responseToClient.Current}} {
+		rec, err := decodeReceiptStream(bytes.NewReader(req.Receipt), a.config().MaxReceiptItems, score.ruleSet, campaigns)
+		if err != nil {
+			http.Error(w, "The receipt is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec = a.withRetailerID(r.Context(), rec)
+		scored, err := newReceiptRecord(rec, score.ruleSet, campaigns, a.config().PointsExpiryInMonths, a.scoringNow())
+		if err != nil {
+			status := http.StatusUnprocessableEntity
+			if errors.Is(err, errInvalidReceipt) {
+				status = http.StatusBadRequest
+			}
+			logging.Printf(r.Context(), "Error evaluating rules %s: %v", score.ruleSet.Version, err)
+			http.Error(w, fmt.Sprintf("Error scoring with rules %s: %v", score.ruleSet.Version, err), status)
+			return
+		}
+		*score.into = scoreResponse{
+			Points:         scored.Points,
+			RulesVersion:   scored.RulesVersion,
+			PointsExpireAt: scored.PointsExpireAt,
+			Breakdown:      append([]db.PointsComponent{}, scored.Breakdown...),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
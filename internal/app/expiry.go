@@ -0,0 +1,79 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+// expirySweepBatch is how many due lots one ExpirePoints call looks at
+const expirySweepBatch = 500
+
+// pointsExpireAt is when points earned on purchaseDate expire, nil when they never do.
+// design decision: expiry counts from the purchase, not from when the receipt was
+// submitted, so holding on to receipts doesn't extend their points
+func pointsExpireAt(purchaseDate string, months int) *time.Time {
+	if months <= 0 {
+		return nil
+	}
+	purchased, err := time.Parse("2006-01-02", purchaseDate)
+	if err != nil {
+		return nil
+	}
+	expireAt := purchased.AddDate(0, months, 0)
+	return &expireAt
+}
+
+// sweepExpiredPoints expires everything of the tenant in ctx that's due, a batch at a
+// time
+func (a *App) sweepExpiredPoints(ctx context.Context) error {
+	now := a.now()
+	for {
+		sweepCtx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+		sweep, err := a.store(sweepCtx).ExpirePoints(sweepCtx, now, expirySweepBatch)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if sweep.Points > 0 {
+			logging.Printf(ctx, "Expired %d points of %d users of tenant %q", sweep.Points, sweep.Users, tenant.FromContext(ctx).ID)
+		}
+		if !sweep.More {
+			return nil
+		}
+	}
+}
+
+// sweepAllExpiredPoints sweeps every tenant, carrying on past failures
+func (a *App) sweepAllExpiredPoints(ctx context.Context) error {
+	var errs []error
+	for _, t := range a.allTenants() {
+		if err := a.sweepExpiredPoints(tenant.NewContext(ctx, t)); err != nil {
+			errs = append(errs, fmt.Errorf("Error expiring points of tenant %q: %w", t.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StartPointsExpirySweeper expires due points right away and then every interval until
+// ctx is done. Every instance runs one, sweeps are safe to overlap.
+func (a *App) StartPointsExpirySweeper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := a.sweepAllExpiredPoints(ctx); err != nil {
+				logging.Printf(ctx, "Error expiring points, trying again next sweep: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
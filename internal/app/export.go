@@ -0,0 +1,187 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+// receipts are read and written exportPageSize at a time, every page is flushed to
+// the client before the next one is read
+const exportPageSize = 500
+
+var exportCSVHeader = []string{
+	"id", "retailer", "purchase_date", "points", "created_at", "user_id", "status", "rules_version", "points_expire_at",
+}
+
+// exportedReceipt is a stored receipt minus the raw submission, which is only kept
+// for rescoring. Exports for replaying (?raw=true) have it and the retailer id too.
+type exportedReceipt struct {
+	ID             string               `json:"id"`
+	Retailer       string               `json:"retailer"`
+	PurchaseDate   string               `json:"purchaseDate"`
+	Points         int                  `json:"points"`
+	CreatedAt      time.Time            `json:"createdAt"`
+	UserID         string               `json:"userId,omitempty"`
+	Status         string               `json:"status,omitempty"`
+	FraudReasons   []string             `json:"fraudReasons,omitempty"`
+	RulesVersion   string               `json:"rulesVersion,omitempty"`
+	PointsExpireAt *time.Time           `json:"pointsExpireAt,omitempty"`
+	Breakdown      []db.PointsComponent `json:"breakdown,omitempty"`
+	RetailerID     string               `json:"retailerId,omitempty"`
+	Receipt        json.RawMessage      `json:"receipt,omitempty"`
+}
+
+// exportWriter writes receipts in one of the export formats
+type exportWriter interface {
+	write(rec db.ReceiptRecord) error
+	flush() error
+}
+
+type jsonlExportWriter struct {
+	out *bufio.Writer
+	enc *json.Encoder
+	raw bool
+}
+
+func (e *jsonlExportWriter) write(rec db.ReceiptRecord) error {
+	exported := exportedReceipt{
+		ID:             rec.ID,
+		Retailer:       rec.Retailer,
+		PurchaseDate:   rec.PurchaseDate,
+		Points:         rec.Points,
+		CreatedAt:      rec.CreatedAt,
+		UserID:         rec.UserID,
+		Status:         rec.Status,
+		FraudReasons:   rec.FraudReasons,
+		RulesVersion:   rec.RulesVersion,
+		PointsExpireAt: rec.PointsExpireAt,
+		Breakdown:      rec.Breakdown,
+	}
+	if e.raw {
+		exported.RetailerID, exported.Receipt = rec.RetailerID, rec.Receipt
+	}
+	return e.enc.Encode(exported)
+}
+
+func (e *jsonlExportWriter) flush() error {
+	return e.out.Flush()
+}
+
+type csvExportWriter struct {
+	out *csv.Writer
+}
+
+func (e *csvExportWriter) write(rec db.ReceiptRecord) error {
+	pointsExpireAt := ""
+	if rec.PointsExpireAt != nil {
+		pointsExpireAt = rec.PointsExpireAt.UTC().Format(time.RFC3339)
+	}
+	return e.out.Write([]string{
+		rec.ID,
+		rec.Retailer,
+		rec.PurchaseDate,
+		strconv.Itoa(rec.Points),
+		rec.CreatedAt.UTC().Format(time.RFC3339Nano),
+		rec.UserID,
+		rec.Status,
+		rec.RulesVersion,
+		pointsExpireAt,
+	})
+}
+
+func (e *csvExportWriter) flush() error {
+	e.out.Flush()
+	return e.out.Error()
+}
+
+// ExportReceiptsHandler streams every stored receipt purchased between ?from= and
+// ?to= (YYYY-MM-DD, inclusive, both optional) as CSV or JSON lines (?format=csv|jsonl,
+// default jsonl), newest purchase first. ?raw=true adds the raw receipts kept for
+// rescoring to JSON lines, for cmd/replay. Receipts are read a page at a time so the export never
+// sits in memory whole.
+func (a *App) ExportReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	from, err := parseOptionalDateParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseOptionalDateParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from != "" && to != "" && from > to {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+
+	var export exportWriter
+	buffered := getImportWriter(w)
+	defer putImportWriter(buffered)
+	switch format := strings.ToLower(r.URL.Query().Get("format")); format {
+	case "", "jsonl", "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="receipts.jsonl"`)
+		export = &jsonlExportWriter{out: buffered, enc: json.NewEncoder(buffered), raw: r.URL.Query().Get("raw") == "true"}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="receipts.csv"`)
+		csvExport := &csvExportWriter{out: csv.NewWriter(buffered)}
+		csvExport.out.Write(exportCSVHeader)
+		export = csvExport
+	default:
+		http.Error(w, "format must be csv or jsonl", http.StatusBadRequest)
+		return
+	}
+
+	filter := db.ListFilter{FromDate: from, ToDate: to, Limit: exportPageSize}
+	rc := http.NewResponseController(w)
+	exported := 0
+	for {
+		a.extendDeadlines(rc)
+		ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+		records, nextCursor, err := a.store(ctx).ListReceipts(ctx, filter)
+		cancel()
+		if err != nil {
+			logging.Printf(r.Context(), "Error exporting receipts after %d: %v", exported, err)
+			// nothing has left the buffer before the first page is flushed
+			if filter.Cursor == "" {
+				w.Header().Del("Content-Disposition")
+				if a.writeStoreUnavailable(w, r, err) {
+					return
+				}
+				http.Error(w, "Error exporting receipts", http.StatusInternalServerError)
+				return
+			}
+			// once rows went out the status can't change anymore. aborting the response
+			// leaves it unterminated, so the client sees a failed download rather than
+			// a short file
+			panic(http.ErrAbortHandler)
+		}
+		for _, rec := range records {
+			if err := export.write(rec); err != nil {
+				logging.Printf(r.Context(), "Error writing export, client likely went away: %v", err)
+				return
+			}
+			exported++
+		}
+		if err := export.flush(); err != nil {
+			logging.Printf(r.Context(), "Error writing export, client likely went away: %v", err)
+			return
+		}
+		rc.Flush()
+		if nextCursor == "" {
+			return
+		}
+		filter.Cursor = nextCursor
+	}
+}
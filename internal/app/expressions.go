@@ -0,0 +1,79 @@
+package app
+
+import (
+	"math"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+)
+
+// money is an amount for expression rules. Amounts were validated before scoring, one
+// that still doesn't parse (an item price) is zero, like it earns nothing elsewhere
+func money(amt string) rules.Money {
+	dollars, err := parseDollarAsStringInput(amt)
+	if err != nil {
+		return rules.Money{}
+	}
+	return dollarsMoney(dollars)
+}
+
+func dollarsMoney(dollars float64) rules.Money {
+	return rules.Money{Cents: int64(math.Round(dollars * 100)), Dollars: dollars}
+}
+
+// expressionInput is the receipt the way expression rules see it
+func expressionInput(rec receipt, purchased time.Time) rules.ExpressionInput {
+	in := rules.ExpressionInput{
+		Retailer:   rec.Retailer,
+		RetailerID: rec.retailerID,
+		Total:      money(rec.Total),
+		Purchase: rules.Purchase{
+			Year:    int64(purchased.Year()),
+			Month:   int64(purchased.Month()),
+			Day:     int64(purchased.Day()),
+			Weekday: int64(purchased.Weekday()),
+			Hour:    int64(purchased.Hour()),
+			Minute:  int64(purchased.Minute()),
+		},
+		Items:         make([]rules.ExpressionItem, 0, len(rec.Items)),
+		ItemCount:     int64(rec.itemCount()),
+		PaymentMethod: rec.PaymentMethod,
+		StoreID:       rec.storeID(),
+		UserID:        rec.UserID,
+	}
+	if rec.Tax != "" {
+		in.Tax = money(rec.Tax)
+	}
+	for _, it := range rec.Items {
+		line, unit, _ := it.prices()
+		in.Items = append(in.Items, rules.ExpressionItem{
+			Description: it.ShortDescription,
+			Price:       dollarsMoney(line),
+			Quantity:    int64(it.units()),
+			UnitPrice:   dollarsMoney(unit),
+		})
+	}
+	for _, d := range rec.Discounts {
+		in.Discounts = append(in.Discounts, rules.ExpressionDiscount{Description: d.Description, Amount: money(d.Amount)})
+	}
+	return in
+}
+
+// applyExpressionRules adds a breakdown line for every expression rule of the rule set,
+// each seeing the points of the ones before
+func applyExpressionRules(points *breakdown, rec receipt, ruleSet *rules.RuleSet, purchased time.Time) error {
+	if len(ruleSet.ExpressionRules) == 0 {
+		return nil
+	}
+	in := expressionInput(rec, purchased)
+	for i := range ruleSet.ExpressionRules {
+		rule := &ruleSet.ExpressionRules[i]
+		in.Points = int64(points.total())
+		rulePoints, err := rule.Eval(in)
+		if err != nil {
+			return err
+		}
+		points.add("expression."+rule.Name, "", rulePoints)
+	}
+	return nil
+}
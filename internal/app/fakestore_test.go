@@ -0,0 +1,255 @@
+package app_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/breaker"
+	"github.com/jayreddy040-510/receipt_processor/internal/concurrency"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/testutil"
+)
+
+func TestFakeStoreRoundTrip(t *testing.T) {
+	h := testutil.NewFake(t, nil)
+	path := "/v1/receipts/" + processReceipt(t, h, testutil.CornerMarketReceipt) + "/points"
+	points, resp := getPoints(t, h, path)
+	if resp.StatusCode != http.StatusOK || points != testutil.CornerMarketPoints {
+		t.Fatalf("got %d with %d points, want 200 with %d", resp.StatusCode, points, testutil.CornerMarketPoints)
+	}
+	if calls := h.Fake.Calls("GetReceipt"); calls != 1 {
+		t.Fatalf("GetReceipt was called %d times, want 1", calls)
+	}
+}
+
+func TestFakeStoreExpiresWithClock(t *testing.T) {
+	h := testutil.NewFake(t, map[string]string{"REDIS_TTL_IN_S": "600"})
+	path := "/v1/receipts/" + processReceipt(t, h, testutil.TargetReceipt) + "/points"
+	h.Clock.Advance(601 * time.Second)
+	if _, resp := getPoints(t, h, path); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("after the TTL: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestStoreErrorsReachClients(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"breaker open", breaker.ErrOpen, http.StatusServiceUnavailable, "STORE_UNAVAILABLE"},
+		{"unavailable", db.Unavailable(errors.New("connection reset by peer")), http.StatusServiceUnavailable, "STORE_UNAVAILABLE"},
+		{"saturated", concurrency.ErrSaturated, http.StatusTooManyRequests, "OVERLOADED"},
+		{"not found", db.ErrNotFound, http.StatusNotFound, "RECEIPT_NOT_FOUND"},
+		{"anything else", errors.New("unexpected end of JSON input"), http.StatusInternalServerError, "INTERNAL_ERROR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testutil.NewFake(t, nil)
+			h.Fake.Fail(tt.err, "GetReceipt")
+			resp := h.Do(t, http.MethodGet, fmt.Sprintf("/v1/receipts/%s/points", uuid.NewString()), "")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got %d %q, want %d", resp.StatusCode, resp.Body, tt.status)
+			}
+			if code := errorCode(t, resp); code != tt.code {
+				t.Errorf("got code %q, want %q", code, tt.code)
+			}
+			retryable := tt.status == http.StatusServiceUnavailable || tt.status == http.StatusTooManyRequests
+			if retryable && resp.Header.Get("Retry-After") == "" {
+				t.Errorf("no Retry-After on a %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestFailedSaveStoresNothing(t *testing.T) {
+	h := testutil.NewFake(t, nil)
+	h.Fake.FailNext(1, errors.New("MULTI aborted"), "SaveReceipt", "SaveReceipts")
+	resp := h.Do(t, http.MethodPost, "/v1/receipts/process", testutil.TargetReceipt)
+	if resp.StatusCode == http.StatusOK {
+		t.Fatalf("process with a failing save: got 200 %q", resp.Body)
+	}
+	if list := h.Do(t, http.MethodGet, "/v1/receipts", ""); strings.Contains(list.Body, `"id"`) {
+		t.Fatalf("the failed save left a receipt behind: %s", list.Body)
+	}
+	// the fault only covered one call
+	processReceipt(t, h, testutil.TargetReceipt)
+}
+
+// partialSave saves the first receipt of a batch and then fails, like DynamoDB can
+type partialSave struct {
+	db.Store
+}
+
+func (s partialSave) ForTenant(tenantID string) db.Store {
+	return partialSave{s.Store.ForTenant(tenantID)}
+}
+
+func (s partialSave) SaveReceipts(ctx context.Context, recs []db.ReceiptRecord) error {
+	if err := s.Store.SaveReceipts(ctx, recs[:1]); err != nil {
+		return err
+	}
+	return errors.New("transaction canceled")
+}
+
+func TestAtomicImportUndoesPartialSave(t *testing.T) {
+	h := testutil.NewFake(t, nil)
+	h.App.Db = partialSave{h.Fake}
+	body := ndjson(t, testutil.CornerMarketReceipt, testutil.TargetReceipt)
+	resp := h.Do(t, http.MethodPost, "/v1/receipts/import?atomic=true", body, "Content-Type", "application/x-ndjson", "X-User-ID", "u1")
+	if !strings.Contains(resp.Body, `"processed":0,"failed":2`) {
+		t.Fatalf("import: got %s, want both failed", resp.Body)
+	}
+	if list := h.Do(t, http.MethodGet, "/v1/receipts", ""); strings.Contains(list.Body, `"id"`) {
+		t.Fatalf("the saved half of the batch was left behind: %s", list.Body)
+	}
+	user := h.Do(t, http.MethodGet, "/v1/users/u1/points", "")
+	if !strings.Contains(user.Body, `"balance":0`) || !strings.Contains(user.Body, fmt.Sprintf(`"points":-%d`, testutil.CornerMarketPoints)) {
+		t.Errorf("the credited points weren't clawed back: %s", user.Body)
+	}
+}
+
+func TestSlowStoreTimesOut(t *testing.T) {
+	h := testutil.NewFake(t, map[string]string{"DB_TIMEOUT_IN_MS": "50"})
+	id := processReceipt(t, h, testutil.TargetReceipt)
+	h.Fake.SetLatency(time.Second)
+	start := time.Now()
+	_, resp := getPoints(t, h, "/v1/receipts/"+id+"/points")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("took %v, the DB timeout is 50ms", elapsed)
+	}
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("got 200 from a store slower than the DB timeout")
+	}
+	h.Fake.SetLatency(0)
+	if _, resp := getPoints(t, h, "/v1/receipts/"+id+"/points"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("once the store is fast again: got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestOutboxTakesReceiptsWhileTheStoreIsDown(t *testing.T) {
+	h := testutil.NewFake(t, map[string]string{
+		"OUTBOX_PATH":        filepath.Join(t.TempDir(), "outbox.jsonl"),
+		"OUTBOX_FLUSH_IN_MS": "10",
+	})
+	h.Fake.Fail(db.Unavailable(errors.New("connection refused")))
+	id := processReceipt(t, h, testutil.TargetReceipt, "X-User-ID", "u1")
+	if points, resp := getPoints(t, h, "/v1/receipts/"+id+"/points"); resp.StatusCode != http.StatusOK || points != testutil.TargetPoints {
+		t.Fatalf("points while queued: got %d %q, want %d", resp.StatusCode, resp.Body, testutil.TargetPoints)
+	}
+	if h.App.Outbox.Len() != 1 {
+		t.Fatalf("outbox holds %d receipts, want 1", h.App.Outbox.Len())
+	}
+
+	// failures that aren't outages still fail the request
+	h.Fake.Fail(errors.New("MULTI aborted"), "SaveReceipt")
+	if resp := h.Do(t, http.MethodPost, "/v1/receipts/process", testutil.TargetReceipt); resp.StatusCode == http.StatusOK {
+		t.Fatalf("process with a failing save: got 200 %q", resp.Body)
+	}
+
+	h.Fake.Fail(nil)
+	deadline := time.Now().Add(2 * time.Second)
+	for h.App.Outbox.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h.App.Outbox.Len() > 0 {
+		t.Fatal("the outbox wasn't flushed once the store was back")
+	}
+	if user := h.Do(t, http.MethodGet, "/v1/users/u1/points", ""); !strings.Contains(user.Body, fmt.Sprintf(`"balance":%d`, testutil.TargetPoints)) {
+		t.Errorf("the flushed receipt is credited once: got %s", user.Body)
+	}
+}
+
+func TestDegradedModeTakesProvisionalReceipts(t *testing.T) {
+	h := testutil.NewFake(t, map[string]string{
+		"DEGRADED_MODE":         "true",
+		"FRAUD_SCREENING":       "true",
+		"SUBMISSION_LOCK_IN_MS": "5000",
+		"OUTBOX_FLUSH_IN_MS":    "10",
+	})
+	h.Fake.Fail(db.Unavailable(errors.New("connection refused")))
+
+	// the lock, the duplicate check and the velocity check all need the store
+	var ids []string
+	for _, user := range []string{"u1", "u2"} {
+		resp := h.Do(t, http.MethodPost, "/v1/receipts/process", testutil.TargetReceipt, "Content-Type", "application/json", "X-User-ID", user)
+		var processed struct {
+			ID          string `json:"id"`
+			Provisional bool   `json:"provisional"`
+		}
+		if resp.StatusCode != http.StatusOK || json.Unmarshal([]byte(resp.Body), &processed) != nil || !processed.Provisional {
+			t.Fatalf("process while the store is down: got %d %q, want a provisional receipt", resp.StatusCode, resp.Body)
+		}
+		ids = append(ids, processed.ID)
+	}
+	resp := h.Do(t, http.MethodGet, "/v1/receipts/"+ids[0]+"/points", "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Body, `"provisional":true`) || resp.Header.Get("Cache-Control") != "private, no-cache" {
+		t.Fatalf("points while provisional: got %d %q, Cache-Control %q", resp.StatusCode, resp.Body, resp.Header.Get("Cache-Control"))
+	}
+
+	h.Fake.Fail(nil)
+	deadline := time.Now().Add(2 * time.Second)
+	for h.App.Outbox.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h.App.Outbox.Len() > 0 {
+		t.Fatal("the outbox wasn't flushed once the store was back")
+	}
+	// screened on the way in: the second is a duplicate of the first
+	if resp := h.Do(t, http.MethodGet, "/v1/receipts/"+ids[0]+"/points", ""); resp.StatusCode != http.StatusOK || strings.Contains(resp.Body, "provisional") || strings.Contains(resp.Body, "status") {
+		t.Errorf("first receipt once flushed: got %d %q, want settled points", resp.StatusCode, resp.Body)
+	}
+	if resp := h.Do(t, http.MethodGet, "/v1/receipts/"+ids[1]+"/points", ""); !strings.Contains(resp.Body, `"status":"flagged"`) {
+		t.Errorf("duplicate once flushed: got %d %q, want it flagged", resp.StatusCode, resp.Body)
+	}
+	if user := h.Do(t, http.MethodGet, "/v1/users/u1/points", ""); !strings.Contains(user.Body, fmt.Sprintf(`"balance":%d`, testutil.TargetPoints)) {
+		t.Errorf("the flushed receipt is credited: got %s", user.Body)
+	}
+}
+
+func TestReceiptCache(t *testing.T) {
+	h := testutil.NewFake(t, nil)
+	id := processReceipt(t, h, testutil.TargetReceipt, "X-User-ID", "u1")
+	path := "/v1/receipts/" + id + "/points"
+	for i := 0; i < 3; i++ {
+		if points, _ := getPoints(t, h, path); points != testutil.TargetPoints {
+			t.Fatalf("lookup %d: got %d points, want %d", i, points, testutil.TargetPoints)
+		}
+	}
+	if calls := h.Fake.Calls("GetReceipt"); calls != 1 {
+		t.Errorf("3 lookups read the store %d times, want 1", calls)
+	}
+	// answered from the cache, the store isn't asked
+	h.Fake.Fail(db.Unavailable(errors.New("connection refused")), "GetReceipt")
+	if _, resp := getPoints(t, h, path); resp.StatusCode != http.StatusOK {
+		t.Errorf("cached lookup with the store down: got %d, want 200", resp.StatusCode)
+	}
+	h.Fake.Fail(nil)
+
+	resp := h.Do(t, http.MethodPut, "/v1/receipts/"+id, testutil.CornerMarketReceipt, "Content-Type", "application/json", "X-User-ID", "u1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("correct: got %d %q, want 200", resp.StatusCode, resp.Body)
+	}
+	if points, _ := getPoints(t, h, path); points != testutil.CornerMarketPoints {
+		t.Errorf("points after correcting: got %d, want %d", points, testutil.CornerMarketPoints)
+	}
+	if resp := h.Do(t, http.MethodDelete, "/v1/receipts/"+id, "", "X-User-ID", "u1"); resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: got %d %q", resp.StatusCode, resp.Body)
+	}
+	if _, resp := getPoints(t, h, path); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("points after deleting: got %d, want 404", resp.StatusCode)
+	}
+	if stats := h.App.ReceiptCache.Stats(); stats.Invalidations != 2 || stats.Hits != 3 {
+		t.Errorf("cache stats: got %+v, want 2 invalidations and 3 hits", stats)
+	}
+}
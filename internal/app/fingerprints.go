@@ -0,0 +1,264 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/bloom"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/metrics"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+// how duplicate checks went with FRAUD_BLOOM_FILTER on. Missed duplicates are receipts
+// saved as no duplicate that turned out to be one when their claim was recorded, sent
+// in to two instances within one sync
+var (
+	bloomSkippedLookups   = metrics.NewInt("fraud_bloom_skipped_lookups")
+	bloomExactLookups     = metrics.NewInt("fraud_bloom_exact_lookups")
+	bloomMissedDuplicates = metrics.NewInt("fraud_bloom_missed_duplicates")
+)
+
+// fingerprintFilter is a tenant's Bloom filter of the fingerprints claimed within the
+// duplicate window, so a receipt that's no duplicate, most of them, gets its fingerprint
+// without asking the store. The filter says maybe for every fingerprint that's claimed
+// and for about FRAUD_BLOOM_FALSE_POSITIVE_RATE of the others, those take the exact
+// claim. Claims made without the store wait in pending until the next sync records them
+// and brings in what other instances added.
+//
+// Fingerprints are added to one filter per generation, a stretch of time as long as the
+// duplicate window at boot, and looked up in every generation the current window
+// reaches into. Each generation is shared between instances as a Redis string.
+type fingerprintFilter struct {
+	tenantID   string
+	store      db.FingerprintFilterStore
+	generation time.Duration
+	m          uint64
+	hashes     int
+
+	mu          sync.Mutex
+	generations map[int64]*bloom.Filter
+	// claims the store doesn't know about yet, by fingerprint
+	pending map[string]db.FingerprintClaim
+}
+
+// fingerprintFilter is the filter of the tenant in ctx, nil when FRAUD_BLOOM_FILTER is
+// off or the store can't share one. A tenant's filter is loaded from the store the
+// first time it's needed.
+func (a *App) fingerprintFilter(ctx context.Context) *fingerprintFilter {
+	if !a.Config.FraudBloomFilter {
+		return nil
+	}
+	tenantID := tenant.FromContext(ctx).ID
+	if f, ok := a.fingerprintFilters.Load(tenantID); ok {
+		return f.(*fingerprintFilter)
+	}
+	store, ok := a.store(ctx).(db.FingerprintFilterStore)
+	if !ok {
+		return nil
+	}
+	m, hashes := bloom.Size(a.Config.FraudBloomCapacity, a.Config.FraudBloomFalsePositiveRate)
+	f := &fingerprintFilter{
+		tenantID:    tenantID,
+		store:       store,
+		generation:  a.Config.FraudDuplicateWindowInMs,
+		m:           m,
+		hashes:      hashes,
+		generations: make(map[int64]*bloom.Filter),
+		pending:     make(map[string]db.FingerprintClaim),
+	}
+	if err := a.pullFingerprintFilter(ctx, f); err != nil {
+		logging.Printf(ctx, "Error loading the fingerprint filter, it starts out empty: %v", err)
+	}
+	actual, _ := a.fingerprintFilters.LoadOrStore(tenantID, f)
+	return actual.(*fingerprintFilter)
+}
+
+// name is what generation gen is shared as. The sizes are in it so instances booted
+// with other settings keep to filters of their own.
+func (f *fingerprintFilter) name(gen int64) string {
+	return fmt.Sprintf("%d:%d:%d:%d", f.generation.Milliseconds(), f.m, f.hashes, gen)
+}
+
+// live are the generations a claim made within window before now can be in, oldest
+// first. Older ones are dropped, the current one created. Callers hold mu.
+func (f *fingerprintFilter) live(now time.Time, window time.Duration) []int64 {
+	length := f.generation.Milliseconds()
+	oldest, current := now.Add(-window).UnixMilli()/length, now.UnixMilli()/length
+	for gen := range f.generations {
+		if gen < oldest {
+			delete(f.generations, gen)
+		}
+	}
+	var gens []int64
+	for gen := oldest; gen <= current; gen++ {
+		if f.generations[gen] == nil {
+			f.generations[gen] = bloom.New(f.m, f.hashes)
+		}
+		gens = append(gens, gen)
+	}
+	return gens
+}
+
+// add puts the fingerprint in the current generation and queues id's claim on it for the
+// next sync. Callers hold mu.
+func (f *fingerprintFilter) add(fingerprint, id string, now time.Time, window time.Duration) {
+	gens := f.live(now, window)
+	current := gens[len(gens)-1]
+	f.pending[fingerprint] = db.FingerprintClaim{
+		Fingerprint: fingerprint,
+		ID:          id,
+		Filter:      f.name(current),
+		Bits:        f.generations[current].Add(fingerprint),
+	}
+}
+
+// claim claims the fingerprint for id without the store when the filter is sure nobody
+// holds it. It returns the receipt holding it when that's one of this instance's
+// unrecorded claims, or exact when only the store can tell.
+func (f *fingerprintFilter) claim(fingerprint, id string, now time.Time, window time.Duration) (holder string, exact bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.pending[fingerprint]; ok && p.ID != id {
+		return p.ID, false
+	}
+	for _, gen := range f.live(now, window) {
+		if f.generations[gen].Test(fingerprint) {
+			return "", true
+		}
+	}
+	f.add(fingerprint, id, now, window)
+	return "", false
+}
+
+// record adds a fingerprint id claimed in the store, so the bits it sets get shared too
+func (f *fingerprintFilter) record(fingerprint, id string, now time.Time, window time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.add(fingerprint, id, now, window)
+}
+
+// unqueue drops id's claim on the fingerprint if it's still waiting for a sync. The
+// bits stay, at worst the fingerprint costs an exact claim later.
+func (f *fingerprintFilter) unqueue(fingerprint, id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.pending[fingerprint]; ok && p.ID == id {
+		delete(f.pending, fingerprint)
+		return true
+	}
+	return false
+}
+
+// claimFingerprint claims the screened receipt's fingerprint, through the tenant's
+// fingerprint filter when there is one. A claim the store wasn't asked about is marked
+// deferred.
+func (a *App) claimFingerprint(ctx context.Context, claim *screening, window time.Duration) (string, error) {
+	f := a.fingerprintFilter(ctx)
+	if f == nil {
+		return a.store(ctx).ClaimFingerprint(ctx, claim.fingerprint, claim.id, window)
+	}
+	now := a.now()
+	holder, exact := f.claim(claim.fingerprint, claim.id, now, window)
+	if !exact {
+		if holder == "" {
+			bloomSkippedLookups.Add(1)
+			claim.deferred = true
+		}
+		return holder, nil
+	}
+	bloomExactLookups.Add(1)
+	holder, err := a.store(ctx).ClaimFingerprint(ctx, claim.fingerprint, claim.id, window)
+	if err == nil && holder == "" {
+		f.record(claim.fingerprint, claim.id, now, window)
+	}
+	return holder, err
+}
+
+// syncFingerprintFilter records the claims waiting in f, then merges in the bits every
+// other instance shared. A claim that turns out to have lost to another receipt was
+// saved as no duplicate already, it's logged and counted.
+func (a *App) syncFingerprintFilter(ctx context.Context, f *fingerprintFilter) error {
+	f.mu.Lock()
+	claims := make([]db.FingerprintClaim, 0, len(f.pending))
+	for _, claim := range f.pending {
+		claims = append(claims, claim)
+	}
+	f.mu.Unlock()
+
+	if len(claims) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+		defer cancel()
+		// a generation is looked up until the window has gone by since it ended
+		window := a.config().FraudDuplicateWindowInMs
+		lost, err := f.store.ClaimFingerprints(ctx, claims, window, window+f.generation)
+		if err != nil {
+			return err
+		}
+		for id, holder := range lost {
+			bloomMissedDuplicates.Add(1)
+			logging.Printf(ctx, "Receipt %s of tenant %q was taken for no duplicate, but receipt %s has the same fingerprint", id, f.tenantID, holder)
+		}
+		// claims made while the batch was out stay for the next sync
+		f.mu.Lock()
+		for _, claim := range claims {
+			if f.pending[claim.Fingerprint].ID == claim.ID {
+				delete(f.pending, claim.Fingerprint)
+			}
+		}
+		f.mu.Unlock()
+	}
+	return a.pullFingerprintFilter(ctx, f)
+}
+
+// pullFingerprintFilter merges the shared bits of every live generation into f's
+func (a *App) pullFingerprintFilter(ctx context.Context, f *fingerprintFilter) error {
+	ctx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+	defer cancel()
+	now, window := a.now(), a.config().FraudDuplicateWindowInMs
+	f.mu.Lock()
+	gens := f.live(now, window)
+	f.mu.Unlock()
+	for _, gen := range gens {
+		// read without holding mu, claims go on meanwhile. bits are only ever set, so
+		// merging whatever was read then loses nothing
+		bits, err := f.store.FingerprintFilter(ctx, f.name(gen))
+		if err != nil {
+			return err
+		}
+		f.mu.Lock()
+		if g := f.generations[gen]; g != nil {
+			g.Merge(bits)
+		}
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+// StartFingerprintSync keeps syncing every tenant's fingerprint filter with the store
+// until ctx is done. It does nothing with FRAUD_BLOOM_FILTER off.
+func (a *App) StartFingerprintSync(ctx context.Context, interval time.Duration) {
+	if !a.Config.FraudBloomFilter {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				a.fingerprintFilters.Range(func(_, f interface{}) bool {
+					if err := a.syncFingerprintFilter(ctx, f.(*fingerprintFilter)); err != nil {
+						logging.Printf(ctx, "Error syncing the fingerprint filter of tenant %q, trying again next time: %v", f.(*fingerprintFilter).tenantID, err)
+					}
+					return true
+				})
+			}
+		}
+	}()
+}
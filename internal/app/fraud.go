@@ -0,0 +1,143 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+// screening is what fraud screening left behind for one receipt: the fingerprint it
+// claimed, so the claim can be given up if the receipt doesn't get saved after all
+type screening struct {
+	id          string
+	fingerprint string
+	// claimed on the fingerprint filter's word, the store doesn't know about it yet
+	deferred bool
+}
+
+// receiptFingerprint identifies a purchase regardless of who submits it, so the same
+// paper receipt sent in by two users (or twice by one) collides. Retailers the registry
+// knows go by their id, so the same receipt with the retailer spelled another way does
+// too.
+func receiptFingerprint(rec receipt) string {
+	total := strings.TrimSpace(rec.Total)
+	if v, err := strconv.ParseFloat(total, 64); err == nil {
+		total = strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	retailer := db.NormalizeRetailer(rec.Retailer)
+	if rec.retailerID != "" {
+		retailer = "id:" + rec.retailerID
+	}
+	sum := sha256.Sum256([]byte(retailer + "|" + rec.PurchaseDate + "|" + total))
+	return hex.EncodeToString(sum[:])
+}
+
+// capReasons are the fraud checks that only look at the receipt itself
+func capReasons(cfg config.Config, rec receipt) []string {
+	var reasons []string
+	if total, err := strconv.ParseFloat(rec.Total, 64); err == nil && total > cfg.FraudMaxTotal {
+		reasons = append(reasons, fmt.Sprintf("total %s is over the %.2f cap", rec.Total, cfg.FraudMaxTotal))
+	}
+	if rec.itemCount() > cfg.FraudMaxItems {
+		reasons = append(reasons, fmt.Sprintf("%d items is over the %d item cap", rec.itemCount(), cfg.FraudMaxItems))
+	}
+	return reasons
+}
+
+// screenReceipt runs the fraud checks on a scored receipt when screening is on. A
+// suspect receipt is still saved, but flagged with the reasons instead of having its
+// points awarded, and waits in the review queue. The checks that don't need the store
+// run first. stored is left as it was when the others fail.
+func (a *App) screenReceipt(ctx context.Context, rec receipt, stored *db.ReceiptRecord) (screening, error) {
+	cfg := a.config()
+	if !cfg.FraudScreening {
+		return screening{}, nil
+	}
+	screened := *stored
+	flagReceipt(ctx, &screened, capReasons(cfg, rec))
+	claim, err := a.screenAgainstStore(ctx, receiptFingerprint(rec), &screened, a.now())
+	if err != nil {
+		return screening{}, err
+	}
+	*stored = screened
+	return claim, nil
+}
+
+// screenProvisional runs the fraud checks that don't need the store on a receipt taken
+// while it's down, and returns the fingerprint to screen it with against the others
+// once it's back. Empty when screening is off.
+func (a *App) screenProvisional(ctx context.Context, rec receipt, stored *db.ReceiptRecord) string {
+	cfg := a.config()
+	if !cfg.FraudScreening {
+		return ""
+	}
+	flagReceipt(ctx, stored, capReasons(cfg, rec))
+	return receiptFingerprint(rec)
+}
+
+// screenAgainstStore runs the fraud checks that compare a receipt with the others, as
+// of now: whether its fingerprint was claimed already and how many receipts its user
+// sent in
+func (a *App) screenAgainstStore(ctx context.Context, fingerprint string, stored *db.ReceiptRecord, now time.Time) (screening, error) {
+	cfg := a.config()
+	var reasons []string
+	claim := screening{id: stored.ID, fingerprint: fingerprint}
+	holder, err := a.claimFingerprint(ctx, &claim, cfg.FraudDuplicateWindowInMs)
+	if err != nil {
+		return screening{}, err
+	}
+	if holder != "" {
+		// the claim belongs to the other receipt, nothing to give up later
+		claim = screening{}
+		reasons = append(reasons, fmt.Sprintf("duplicate of receipt %s", holder))
+	}
+
+	if stored.UserID != "" {
+		count, err := a.store(ctx).CountSubmission(ctx, stored.UserID, stored.ID, now, cfg.FraudVelocityWindowInMs)
+		if err != nil {
+			a.releaseScreening(ctx, claim)
+			return screening{}, err
+		}
+		if count > cfg.FraudVelocityLimit {
+			reasons = append(reasons, fmt.Sprintf("%d receipts within %v, the limit is %d", count, cfg.FraudVelocityWindowInMs, cfg.FraudVelocityLimit))
+		}
+	}
+	flagReceipt(ctx, stored, reasons)
+	return claim, nil
+}
+
+// flagReceipt holds the receipt's points back for review, for the reasons given. It
+// does nothing without reasons.
+func flagReceipt(ctx context.Context, stored *db.ReceiptRecord, reasons []string) {
+	if len(reasons) == 0 {
+		return
+	}
+	stored.Status = db.ReceiptFlagged
+	stored.FraudReasons = append(stored.FraudReasons, reasons...)
+	logging.Printf(ctx, "Flagged receipt %s for review: %s", stored.ID, strings.Join(reasons, "; "))
+}
+
+// releaseScreening gives up a receipt's fingerprint claim after it failed to save, so a
+// retry of the same receipt isn't taken for a duplicate of one that doesn't exist
+func (a *App) releaseScreening(ctx context.Context, claim screening) {
+	if claim.fingerprint == "" {
+		return
+	}
+	if f := a.fingerprintFilter(ctx); f != nil && f.unqueue(claim.fingerprint, claim.id) && claim.deferred {
+		return
+	}
+	// the request's context may be what ran out, only its tenant is still needed
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), a.config().DbTimeoutInMs)
+	defer cancel()
+	if err := a.store(ctx).ReleaseFingerprint(ctx, claim.fingerprint, claim.id); err != nil {
+		logging.Printf(ctx, "Error releasing fingerprint of unsaved receipt %s: %v", claim.id, err)
+	}
+}
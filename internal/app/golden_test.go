@@ -0,0 +1,96 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden scoring files from the current scoring code")
+
+// the golden corpus is scored as of this instant, so future date checks come out the
+// same on every run
+var goldenNow = time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+
+// goldenResult is what a golden file holds: the points and the rule by rule breakdown,
+// or why the receipt was rejected
+type goldenResult struct {
+	Points       int                  `json:"points"`
+	RulesVersion string               `json:"rulesVersion,omitempty"`
+	Breakdown    []db.PointsComponent `json:"breakdown,omitempty"`
+	Error        string               `json:"error,omitempty"`
+}
+
+// TestGoldenScoring scores every case under testdata/golden and compares it with the
+// case's expected.json. A case is a directory with a receipt.json and, to score with
+// something other than the built-in rules, a rules.json in the RULES_PATH format.
+// After a deliberate scoring change, regenerate the expected files and review the diff:
+//
+//	go test ./internal/app -run TestGoldenScoring -update
+func TestGoldenScoring(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "golden", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) == 0 {
+		t.Fatal("no golden cases under testdata/golden")
+	}
+	for _, dir := range dirs {
+		dir := dir
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			got, err := json.MarshalIndent(scoreGoldenCase(t, dir), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+			expectedPath := filepath.Join(dir, "expected.json")
+			if *update {
+				if err := os.WriteFile(expectedPath, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(expectedPath)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("scoring changed for %s\n--- got\n%s--- want\n%s", dir, got, want)
+			}
+		})
+	}
+}
+
+func scoreGoldenCase(t *testing.T, dir string) goldenResult {
+	t.Helper()
+	ruleSet := rules.Default()
+	if data, err := os.ReadFile(filepath.Join(dir, "rules.json")); err == nil {
+		if ruleSet, err = rules.Parse(data); err != nil {
+			t.Fatalf("Error parsing rules.json: %v", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+	body, err := os.ReadFile(filepath.Join(dir, "receipt.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := decodeReceiptStream(bytes.NewReader(body), 1000, ruleSet, nil)
+	if err != nil {
+		return goldenResult{Error: err.Error()}
+	}
+	points, components, err := calculateAllPoints(rec, ruleSet, nil, goldenNow)
+	if err != nil {
+		return goldenResult{Error: err.Error()}
+	}
+	return goldenResult{Points: points, RulesVersion: ruleSet.Version, Breakdown: components}
+}
@@ -0,0 +1,154 @@
+package app
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+// only JSON (and XML) responses and CSV exports get compressed, plain text error
+// messages are too small to be worth it and images/PDFs never come back
+var compressibleContentTypes = map[string]bool{
+	"application/json":     true,
+	"application/x-ndjson": true,
+	"application/xml":      true,
+	"text/csv":             true,
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip (or anything, via *)
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		// q=0 means "not gzip"
+		if name, value, ok := strings.Cut(params, "="); ok && strings.TrimSpace(name) == "q" {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// gzipResponseWriter decides whether to compress on the first WriteHeader/Write, once
+// the handler has set the Content-Type
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(statusCode int) {
+	if !g.decided {
+		g.decided = true
+		h := g.Header()
+		mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+		compress := compressibleContentTypes[mediaType] && h.Get("Content-Encoding") == "" &&
+			statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+		// the compressed bytes aren't the ones a strong ETag promises. a 304 has no body
+		// but has to carry the tag the client got with the (compressed) 200
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) && (compress || statusCode == http.StatusNotModified) {
+			h.Set("ETag", "W/"+etag)
+		}
+		if compress {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			g.gz = gzip.NewWriter(g.ResponseWriter)
+		}
+	}
+	g.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.decided {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// Flush pushes out what's compressed so far, streaming responses (imports) keep
+// streaming
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		if err := g.gz.Flush(); err != nil {
+			return
+		}
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. for full duplex
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipResponseWriter) close(ctx context.Context) {
+	if g.gz == nil {
+		return
+	}
+	if err := g.gz.Close(); err != nil {
+		logging.Printf(ctx, "Error finishing gzip response: %v", err)
+	}
+}
+
+// Gzip transparently decompresses request bodies sent with Content-Encoding: gzip and
+// compresses JSON responses for clients that send Accept-Encoding: gzip. Every body is
+// held to MAX_REQUEST_BODY_BYTES once decompressed, so a small gzip bomb can't make
+// handlers buffer gigabytes. Body size limits in handlers apply to the decompressed
+// body too.
+func (a *App) Gzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+		case "", "identity":
+		case "gzip":
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				logging.Printf(r.Context(), "Error reading gzip request body: %v", err)
+				writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgGzipInvalid)
+				return
+			}
+			r.Body = &gzipBody{Reader: zr, body: r.Body}
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		default:
+			writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMedia, msgEncodingUnsupported, encoding)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, a.config().MaxRequestBodyBytes)
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close(r.Context())
+		next.ServeHTTP(gw, r)
+	})
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/breaker"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/metrics"
+)
+
+type readyzResponse struct {
+	Status  string         `json:"status"`
+	Store   string         `json:"store"`
+	Breaker *breaker.Stats `json:"breaker,omitempty"`
+}
+
+// HealthzHandler is liveness only: the process is up and serving
+func (a *App) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// ReadyzHandler reports whether the instance can serve traffic, i.e. the store answers
+// and its circuit breaker isn't open
+func (a *App) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	responseToClient := readyzResponse{Status: "ready", Store: "ok"}
+	status := http.StatusOK
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	if err := a.Db.CheckConnection(ctx); err != nil {
+		logging.Errorf(r.Context(), "Readiness check failed: %v", err)
+		responseToClient.Status = "not ready"
+		responseToClient.Store = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	if a.Breaker != nil {
+		stats := a.Breaker.Stats()
+		responseToClient.Breaker = &stats
+		if a.Breaker.State() == breaker.Open {
+			responseToClient.Status = "not ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+// MetricsHandler serves the metrics, to callers with the METRICS_TOKEN as a bearer
+// token when one is set. Scrapers get their own token, they don't need an admin's.
+func (a *App) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if want := a.Config.MetricsToken; want != "" {
+		token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	metrics.Handler().ServeHTTP(w, r)
+}
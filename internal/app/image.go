@@ -0,0 +1,117 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/ocr"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+const maxImageUploadBytes = 10 << 20
+
+type imageReceiptResponse struct {
+	ID          string     `json:"id,omitempty"`
+	Points      *int       `json:"points,omitempty"`
+	Status      string     `json:"status,omitempty"`
+	Provisional bool       `json:"provisional,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	RequestID   string     `json:"requestId,omitempty"`
+	Extracted   ocr.Fields `json:"extracted"`
+}
+
+// readImageUpload returns the uploaded file, either the raw body or the "file" part of
+// a multipart form. The type is sniffed from the bytes rather than trusting headers.
+func readImageUpload(r *http.Request) ([]byte, string, error) {
+	var body io.Reader = r.Body
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, "", fmt.Errorf("Error reading multipart file field: %v", err)
+		}
+		defer file.Close()
+		body = file
+	}
+	image, err := io.ReadAll(body)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error reading image upload: %v", err)
+	}
+	contentType := http.DetectContentType(image)
+	if !ocr.IsSupportedContentType(contentType) {
+		return nil, "", fmt.Errorf("Unsupported image type %s", contentType)
+	}
+	return image, contentType, nil
+}
+
+// ProcessReceiptImageHandler runs an uploaded JPEG/PNG/PDF through OCR, maps the text
+// onto a receipt and scores it like any other. The extracted fields are always sent
+// back so clients can show them (or prefill manual entry when scoring fails).
+func (a *App) ProcessReceiptImageHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageUploadBytes)
+	defer r.Body.Close()
+	image, contentType, err := readImageUpload(r)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgImageInvalid)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().OCRTimeoutInMs)
+	defer cancel()
+	text, err := a.OCR.ExtractText(ctx, image, contentType)
+	if err != nil {
+		logging.Printf(r.Context(), "Error extracting text from receipt image: %v", err)
+		writeError(w, r, http.StatusBadGateway, codeOCRFailed, msgImageUnreadable)
+		return
+	}
+	fields := ocr.ParseReceipt(text)
+
+	rec := receipt{
+		Retailer:     fields.Retailer,
+		PurchaseDate: fields.PurchaseDate,
+		PurchaseTime: fields.PurchaseTime,
+		Total:        fields.Total,
+	}
+	for _, it := range fields.Items {
+		rec.Items = append(rec.Items, item{ShortDescription: it.ShortDescription, Price: it.Price})
+	}
+	if err := resolveUserID(r, &rec); err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgUserIDInvalid)
+		return
+	}
+
+	responseToClient := imageReceiptResponse{Extracted: fields}
+	status := http.StatusOK
+	stored, err := a.processReceipt(r.Context(), rec)
+	if err != nil {
+		logging.Printf(r.Context(), "Error processing OCR'd receipt %+v: %v", fields, err)
+		if !errors.Is(err, errInvalidReceipt) {
+			a.writeReceiptError(w, r, err)
+			return
+		}
+		responseToClient.Error = localize(r, msgReceiptInvalid)
+		responseToClient.RequestID = logging.RequestID(r.Context())
+		status = http.StatusBadRequest
+	} else {
+		if a.Archive != nil {
+			a.Archive.Image(tenant.FromContext(r.Context()).ID, stored.ID, contentType, image)
+		}
+		responseToClient.ID = stored.ID
+		responseToClient.Points = &stored.Points
+		responseToClient.Status = stored.Status
+		responseToClient.Provisional = a.provisional(r.Context(), stored.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+const (
+	// lines are scored and saved importBatchSize at a time, one round trip to the store
+	// per batch, and the batch's results are flushed to the client together. flushing
+	// per line would cost a syscall per receipt on big backfills
+	importBatchSize  = 64
+	maxImportLineLen = 1 << 20
+)
+
+// importResult is one receipt's outcome. Index is its position in the import, 0-based
+// and without blank lines. Errors has the fields at fault when it's invalid
+type importResult struct {
+	Line        int          `json:"line"`
+	Index       int          `json:"index"`
+	ID          string       `json:"id,omitempty"`
+	Points      *int         `json:"points,omitempty"`
+	Status      string       `json:"status,omitempty"`
+	Provisional bool         `json:"provisional,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Errors      []fieldError `json:"errors,omitempty"`
+}
+
+// the last line of an NDJSON import's results
+type importSummaryLine struct {
+	Summary importSummary `json:"summary"`
+}
+
+// ImportReceiptsHandler takes newline delimited JSON receipts and streams back one
+// result line per input line, in order, as it goes, then a summary line. The body is
+// never buffered whole so arbitrarily large backfills can go through one request.
+// Blank lines are skipped but still counted so line numbers match the client's file.
+// CSV uploads are handed off to importCSV, ?atomic=true imports to importAtomically.
+func (a *App) ImportReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	atomic, err := atomicImport(r)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgQueryInvalid)
+		return
+	}
+	if isCSVUpload(r) {
+		a.importCSV(w, r, atomic)
+		return
+	}
+	if atomic {
+		a.importAtomically(w, r)
+		return
+	}
+	defer r.Body.Close()
+	// without full duplex the server closes the request body on the first response write
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil {
+		logging.Printf(r.Context(), "Error enabling full duplex for import, results will stream once the body is read: %v", err)
+	}
+	a.extendDeadlines(rc)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	reader := getImportReader(r.Body)
+	defer putImportReader(reader)
+	out := getImportWriter(w)
+	defer putImportWriter(out)
+	enc := json.NewEncoder(out)
+
+	var (
+		summary importSummary
+		batch   importBatch
+	)
+	// flush processes the pending batch and writes its results, false once the client
+	// is gone
+	flush := func() bool {
+		a.extendDeadlines(rc)
+		for _, res := range a.importBatch(r, batch, false) {
+			summary.count(res.Error != "")
+			if err := enc.Encode(res); err != nil {
+				logging.Printf(r.Context(), "Error writing import result, client likely went away: %v", err)
+				return false
+			}
+		}
+		batch = batch[:0]
+		out.Flush()
+		rc.Flush()
+		return true
+	}
+	// lines are decoded as soon as they're read, one buffer does for all of them
+	var lineBuf []byte
+	for lineNo := 1; ; lineNo++ {
+		line, readErr := readImportLine(reader, lineBuf[:0])
+		lineBuf = line
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			logging.Printf(r.Context(), "Error reading import body at line %d: %v", lineNo, readErr)
+			msg := "Error reading request body"
+			var tooLarge *http.MaxBytesError
+			if errors.As(readErr, &tooLarge) {
+				msg = localize(r, msgRequestTooLarge, tooLarge.Limit)
+			}
+			if flush() {
+				enc.Encode(importResult{Line: lineNo, Index: summary.Received, Error: msg})
+			}
+			break
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			batch = append(batch, decodeImportLine(lineNo, summary.Received+len(batch), line))
+			if len(batch) == importBatchSize && !flush() {
+				return
+			}
+		}
+		if readErr != nil { // io.EOF
+			break
+		}
+	}
+	if flush() {
+		enc.Encode(importSummaryLine{Summary: summary})
+		out.Flush()
+	}
+	logging.Printf(r.Context(), "Import finished: %d processed, %d failed", summary.Processed, summary.Failed)
+}
+
+// importAtomically is the NDJSON import with ?atomic=true: every line is read before
+// any is processed and if one receipt fails none are saved. The results and summary
+// are the streamed import's, written once the import is settled. Up to
+// maxAtomicImportReceipts receipts.
+func (a *App) importAtomically(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	reader := getImportReader(r.Body)
+	defer putImportReader(reader)
+	var (
+		batch   importBatch
+		lineBuf []byte
+	)
+	for lineNo := 1; ; lineNo++ {
+		line, readErr := readImportLine(reader, lineBuf[:0])
+		lineBuf = line
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			logging.Printf(r.Context(), "Error reading atomic import body at line %d: %v", lineNo, readErr)
+			if !writeBodyTooLarge(w, r, readErr) {
+				writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgReceiptInvalid)
+			}
+			return
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if len(batch) == maxAtomicImportReceipts {
+				writeError(w, r, http.StatusRequestEntityTooLarge, codeValidationFailed, msgAtomicImportTooLarge, maxAtomicImportReceipts)
+				return
+			}
+			batch = append(batch, decodeImportLine(lineNo, len(batch), line))
+		}
+		if readErr != nil { // io.EOF
+			break
+		}
+	}
+
+	results := a.importBatch(r, batch, true)
+	summary := importSummary{Atomic: true}
+	for _, res := range results {
+		summary.count(res.Error != "")
+	}
+	summary.RolledBack = summary.Failed > 0
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	out := getImportWriter(w)
+	defer putImportWriter(out)
+	enc := json.NewEncoder(out)
+	for _, res := range results {
+		if err := enc.Encode(res); err != nil {
+			logging.Printf(r.Context(), "Error writing import result, client likely went away: %v", err)
+			return
+		}
+	}
+	enc.Encode(importSummaryLine{Summary: summary})
+	out.Flush()
+	logging.Printf(r.Context(), "Atomic import finished: %d processed, %d failed", summary.Processed, summary.Failed)
+}
+
+// importLine is one decoded NDJSON line waiting to be processed
+type importLine struct {
+	lineNo int
+	index  int
+	rec    receipt
+	err    error
+	fields []fieldError
+}
+
+type importBatch []importLine
+
+func decodeImportLine(lineNo, index int, line []byte) importLine {
+	var rec receipt
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return importLine{lineNo: lineNo, index: index, err: fmt.Errorf("Error decoding import line %d: %v", lineNo, err), fields: decodeFieldErrors(err)}
+	}
+	return importLine{lineNo: lineNo, index: index, rec: rec}
+}
+
+// importBatch processes the decodable lines of a batch together and returns one result
+// per line, in order. An atomic batch is only processed when every line is fine, and
+// saved only when every receipt is.
+func (a *App) importBatch(r *http.Request, batch importBatch, atomic bool) []importResult {
+	results := make([]importResult, len(batch))
+	var (
+		recs    []receipt
+		indexes []int
+	)
+	for i, line := range batch {
+		results[i].Line, results[i].Index = line.lineNo, line.index
+		if line.err != nil {
+			logging.Printf(r.Context(), "%v", line.err)
+			results[i].Error = localize(r, msgReceiptInvalid)
+			results[i].Errors = line.fields
+			continue
+		}
+		if err := resolveUserID(r, &line.rec); err != nil {
+			logging.Printf(r.Context(), "Invalid user on import line %d: %v", line.lineNo, err)
+			results[i].Error = localize(r, msgUserIDInvalid)
+			results[i].Errors = []fieldError{{Field: "userId", Message: err.Error()}}
+			continue
+		}
+		recs = append(recs, line.rec)
+		indexes = append(indexes, i)
+	}
+	if len(recs) == 0 {
+		return results
+	}
+	if atomic && len(recs) < len(batch) {
+		for _, i := range indexes {
+			results[i].Error = localize(r, msgImportRolledBack)
+		}
+		return results
+	}
+	stored, errs := a.processReceipts(r.Context(), recs, atomic)
+	for j, i := range indexes {
+		if errs[j] != nil {
+			logging.Printf(r.Context(), "Error processing import line %d: %v", batch[i].lineNo, errs[j])
+			results[i].Error = processErrorMessage(r, errs[j])
+			results[i].Errors = processFieldErrors(batch[i].rec, errs[j], a.scoringNow())
+			continue
+		}
+		results[i].ID = stored[j].ID
+		results[i].Points = &stored[j].Points
+		results[i].Status = stored[j].Status
+		results[i].Provisional = a.provisional(r.Context(), stored[j].ID)
+	}
+	return results
+}
+
+// readImportLine appends the input up to and including the next newline to line,
+// refusing lines longer than maxImportLineLen so one bad line can't eat the server's
+// memory
+func readImportLine(reader *bufio.Reader, line []byte) ([]byte, error) {
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxImportLineLen {
+			return nil, errors.New("line too long")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return line, err
+	}
+}
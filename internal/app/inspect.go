@@ -0,0 +1,197 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/jobs"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+const (
+	defaultScanCount = 100
+	maxScanCount     = 1000
+)
+
+type listKeysResponse struct {
+	Keys []string `json:"keys"`
+	// pass back as ?cursor= for the next page, empty once the scan is done
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// GetReceiptAdminHandler returns everything stored for a receipt: the raw receipt,
+// breakdown, status, expiry and so on. Soft deleted receipts are shown until they're
+// purged, with their deletedAt.
+func (a *App) GetReceiptAdminHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if ok, err := isValidUUIDv4(id); !ok {
+		logging.Printf(r.Context(), "%v", err)
+		http.Error(w, "No receipt found for that id", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	stored, err := a.store(ctx).GetReceipt(ctx, id)
+	if errors.Is(err, db.ErrNotFound) {
+		stored, err = a.store(ctx).GetTombstone(ctx, id)
+	}
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "No receipt found for that id", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stored); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+// DeleteReceiptAdminHandler force deletes a receipt and every index entry pointing at
+// it. Points it already awarded stay in the user's balance.
+func (a *App) DeleteReceiptAdminHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if ok, err := isValidUUIDv4(id); !ok {
+		logging.Printf(r.Context(), "%v", err)
+		http.Error(w, "No receipt found for that id", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	err := a.store(ctx).DeleteReceipt(ctx, id)
+	a.forgetReceipts(ctx, id)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "No receipt found for that id", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error deleting receipt", http.StatusInternalServerError)
+		return
+	}
+	logging.Printf(r.Context(), "Force deleted receipt %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListKeysHandler pages through the Redis keys starting with ?prefix= (all keys when
+// it's empty), ?count= at a time
+func (a *App) ListKeysHandler(w http.ResponseWriter, r *http.Request) {
+	var cursor uint64
+	if raw := r.URL.Query().Get("cursor"); raw != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	count, err := parseOptionalIntParam(r, "count")
+	if err != nil || (count != nil && (*count < 1 || *count > maxScanCount)) {
+		http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxScanCount), http.StatusBadRequest)
+		return
+	}
+	scanCount := defaultScanCount
+	if count != nil {
+		scanCount = *count
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	keys, next, err := a.store(ctx).ScanKeys(ctx, r.URL.Query().Get("prefix"), cursor, int64(scanCount))
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "Error listing keys", http.StatusInternalServerError)
+		return
+	}
+	responseToClient := listKeysResponse{Keys: append([]string{}, keys...)}
+	if next != 0 {
+		responseToClient.NextCursor = strconv.FormatUint(next, 10)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+func (a *App) StoreStatsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	stats, err := a.store(ctx).Stats(ctx)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "Error reading store stats", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+type pruneIndexesReport struct {
+	Checked int `json:"checked"`
+	Removed int `json:"removed"`
+}
+
+// maintenanceTasks are the jobs operators can start through POST /admin/maintenance/{task}
+func (a *App) maintenanceTasks() map[string]jobs.Func {
+	return map[string]jobs.Func{
+		"prune-indexes": func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			report := &pruneIndexesReport{}
+			removed, err := a.store(ctx).PruneIndexes(ctx, func(checked int) {
+				report.Checked = checked
+				job.SetProgress(*report)
+			})
+			report.Removed = removed
+			return report, err
+		},
+		"expire-points": func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			return nil, a.sweepExpiredPoints(ctx)
+		},
+		"purge-receipts": func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			return nil, a.sweepRetention(ctx)
+		},
+		"refresh-campaigns": func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			if err := a.refreshCampaigns(ctx); err != nil {
+				return nil, err
+			}
+			return a.campaigns(ctx), nil
+		},
+	}
+}
+
+// RunMaintenanceHandler starts a maintenance task as a background job
+func (a *App) RunMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	task := chi.URLParam(r, "task")
+	fn, ok := a.maintenanceTasks()[task]
+	if !ok {
+		http.Error(w, "Unknown maintenance task, expected prune-indexes, expire-points, purge-receipts or refresh-campaigns", http.StatusNotFound)
+		return
+	}
+	status, err := a.Jobs.Submit(task, forTenant(tenant.FromContext(r.Context()), fn))
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many jobs queued, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	a.writeJobAccepted(w, r, status)
+}
@@ -0,0 +1,2183 @@
+package app_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/breaker"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/events"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/oidc/oidctest"
+	"github.com/jayreddy040-510/receipt_processor/internal/plugin/plugintest"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+	"github.com/jayreddy040-510/receipt_processor/internal/testutil"
+	"github.com/jayreddy040-510/receipt_processor/pkg/receiptpb"
+)
+
+// processReceipt posts a JSON receipt, with any extra header name/value pairs, and
+// returns its id
+func processReceipt(t *testing.T, h *testutil.Harness, body string, headers ...string) string {
+	t.Helper()
+	resp := h.Do(t, http.MethodPost, "/v1/receipts/process", body, append([]string{"Content-Type", "application/json"}, headers...)...)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("process: got %d %q, want 200", resp.StatusCode, resp.Body)
+	}
+	var processed struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &processed); err != nil {
+		t.Fatalf("process: decoding %q: %v", resp.Body, err)
+	}
+	if _, err := uuid.Parse(processed.ID); err != nil {
+		t.Fatalf("process: id %q isn't a uuid: %v", processed.ID, err)
+	}
+	return processed.ID
+}
+
+func getPoints(t *testing.T, h *testutil.Harness, path string) (int, testutil.Response) {
+	t.Helper()
+	resp := h.Do(t, http.MethodGet, path, "")
+	if resp.StatusCode != http.StatusOK {
+		return 0, resp
+	}
+	var points struct {
+		Points int `json:"points"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &points); err != nil {
+		t.Fatalf("points: decoding %q: %v", resp.Body, err)
+	}
+	return points.Points, resp
+}
+
+// errorCode is the machine-readable code of a JSON error response
+func errorCode(t *testing.T, resp testutil.Response) string {
+	t.Helper()
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("error body %q isn't JSON: %v", resp.Body, err)
+	}
+	return body.Code
+}
+
+func TestProcessThenGetPoints(t *testing.T) {
+	h := testutil.New(t, nil)
+	tests := []struct {
+		name    string
+		receipt string
+		points  int
+	}{
+		{"target", testutil.TargetReceipt, testutil.TargetPoints},
+		{"corner market", testutil.CornerMarketReceipt, testutil.CornerMarketPoints},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := processReceipt(t, h, tt.receipt)
+			for _, path := range []string{"/v1/receipts/" + id + "/points", "/receipts/" + id + "/points"} {
+				points, resp := getPoints(t, h, path)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("GET %s: got %d %q, want 200", path, resp.StatusCode, resp.Body)
+				}
+				if points != tt.points {
+					t.Errorf("GET %s: got %d points, want %d", path, points, tt.points)
+				}
+			}
+		})
+	}
+}
+
+func TestXMLRoundTrip(t *testing.T) {
+	h := testutil.New(t, nil)
+	body := `<?xml version="1.0"?>
+<receipt>
+  <retailer>M&amp;M Corner Market</retailer>
+  <purchaseDate>2022-03-20</purchaseDate>
+  <purchaseTime>14:33</purchaseTime>
+  <items>
+    <item><shortDescription>Gatorade</shortDescription><price>2.25</price></item>
+    <item><shortDescription>Gatorade</shortDescription><price>2.25</price></item>
+    <item><shortDescription>Gatorade</shortDescription><price>2.25</price></item>
+    <item><shortDescription>Gatorade</shortDescription><price>2.25</price></item>
+  </items>
+  <total>9.00</total>
+  <tax>0.68</tax>
+  <discounts><discount><description>Bundle</description><amount>1.00</amount></discount></discounts>
+  <paymentMethod>debit</paymentMethod>
+  <store><id>17</id><city>Springfield</city></store>
+</receipt>`
+	xmlHeaders := []string{"Content-Type", "application/xml", "Accept", "application/xml"}
+	invalid := strings.Replace(body, "<amount>1.00</amount>", "<amount>one dollar</amount>", 1)
+	if resp := h.Do(t, http.MethodPost, "/v1/receipts/process", invalid, xmlHeaders...); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid discount: got %d, want 400", resp.StatusCode)
+	}
+	processed := h.Do(t, http.MethodPost, "/v1/receipts/process", body, xmlHeaders...)
+	if processed.StatusCode != http.StatusOK || !strings.Contains(processed.Body, "<processedReceipt>") {
+		t.Fatalf("process: got %d %q, want 200 and a <processedReceipt>", processed.StatusCode, processed.Body)
+	}
+	id := between(processed.Body, "<id>", "</id>")
+	points := h.Do(t, http.MethodGet, "/v1/receipts/"+id+"/points", "", xmlHeaders...)
+	if want := fmt.Sprintf("<points>%d</points>", testutil.CornerMarketPoints); points.StatusCode != http.StatusOK || !strings.Contains(points.Body, want) {
+		t.Fatalf("points: got %d %q, want 200 and %s", points.StatusCode, points.Body, want)
+	}
+}
+
+func TestProtobufReceipt(t *testing.T) {
+	h := testutil.New(t, map[string]string{"MAX_RECEIPT_ITEMS": "5"})
+	pb := &receiptpb.Receipt{
+		Retailer:      "M&M Corner Market",
+		PurchaseDate:  "2022-03-20",
+		PurchaseTime:  "14:33",
+		Total:         "9.00",
+		Tax:           "0.68",
+		Discounts:     []*receiptpb.Discount{{Description: "Bundle", Amount: "1.00"}},
+		PaymentMethod: "debit",
+		Store:         &receiptpb.Store{Id: "17", City: "Springfield"},
+	}
+	for i := 0; i < 4; i++ {
+		pb.Items = append(pb.Items, &receiptpb.Item{ShortDescription: "Gatorade", Price: "2.25"})
+	}
+	body, err := proto.Marshal(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := processReceipt(t, h, string(body), "Content-Type", "application/x-protobuf")
+	if points, resp := getPoints(t, h, "/v1/receipts/"+id+"/points"); points != testutil.CornerMarketPoints {
+		t.Fatalf("points: got %d (%d %q), want %d", points, resp.StatusCode, resp.Body, testutil.CornerMarketPoints)
+	}
+
+	for i := 0; i < 2; i++ {
+		pb.Items = append(pb.Items, &receiptpb.Item{ShortDescription: "Gatorade", Price: "2.25"})
+	}
+	tooMany, _ := proto.Marshal(pb)
+	if resp := h.Do(t, http.MethodPost, "/v1/receipts/process", string(tooMany), "Content-Type", "application/x-protobuf"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("6 items: got %d, want 413", resp.StatusCode)
+	}
+	if resp := h.Do(t, http.MethodPost, "/v1/receipts/process", string(body[:len(body)-3]), "Content-Type", "application/x-protobuf"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("truncated body: got %d, want 400", resp.StatusCode)
+	}
+}
+
+// ndjson is an import body with the receipts one per line
+func ndjson(t *testing.T, receipts ...string) string {
+	t.Helper()
+	var b bytes.Buffer
+	for _, rec := range receipts {
+		if err := json.Compact(&b, []byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+type importLine struct {
+	Line   int    `json:"line"`
+	Index  int    `json:"index"`
+	ID     string `json:"id"`
+	Error  string `json:"error"`
+	Errors []struct {
+		Field string `json:"field"`
+	} `json:"errors"`
+	Summary *struct {
+		Received, Processed, Failed int
+		Atomic, RolledBack          bool
+	} `json:"summary"`
+}
+
+func importNDJSON(t *testing.T, h *testutil.Harness, path, body string) []importLine {
+	t.Helper()
+	resp := h.Do(t, http.MethodPost, path, body, "Content-Type", "application/x-ndjson")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("import: got %d %q, want 200", resp.StatusCode, resp.Body)
+	}
+	var lines []importLine
+	for _, raw := range strings.Split(strings.TrimSpace(resp.Body), "\n") {
+		var line importLine
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("import: decoding %q: %v", raw, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func fields(line importLine) string {
+	var names []string
+	for _, e := range line.Errors {
+		names = append(names, e.Field)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestImportReportsFieldErrors(t *testing.T) {
+	h := testutil.New(t, nil)
+	invalid := strings.NewReplacer(`"total": "35.35"`, `"total": "35.3"`, `"price": "6.49"`, `"price": "6.49", "quantity": -1`).Replace(testutil.TargetReceipt)
+	wrongType := strings.Replace(testutil.CornerMarketReceipt, `"total": "9.00"`, `"total": 9`, 1)
+	body := ndjson(t, testutil.TargetReceipt, invalid) + "\n" + ndjson(t, wrongType, testutil.CornerMarketReceipt)
+
+	lines := importNDJSON(t, h, "/v1/receipts/import", body)
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, want 4 results and a summary: %+v", len(lines), lines)
+	}
+	if lines[0].ID == "" || lines[3].ID == "" || lines[3].Line != 5 || lines[3].Index != 3 {
+		t.Errorf("valid receipts: got %+v and %+v, want them processed", lines[0], lines[3])
+	}
+	if got := fields(lines[1]); lines[1].Index != 1 || got != "total,items[0]" {
+		t.Errorf("invalid receipt: got %+v (fields %s), want total and items[0]", lines[1], got)
+	}
+	if got := fields(lines[2]); lines[2].Line != 4 || got != "total" {
+		t.Errorf("wrong type: got %+v (fields %s), want total", lines[2], got)
+	}
+	if s := lines[4].Summary; s == nil || s.Received != 4 || s.Processed != 2 || s.Failed != 2 || s.Atomic {
+		t.Errorf("summary: got %+v", lines[4])
+	}
+
+	csv := "receipt_ref,retailer,purchase_date,purchase_time,total,item_description,item_price\n" +
+		"A,Target,2022-01-01,13:01,1.25,Pepsi,1.25\n" +
+		"B,Target,2022-01-01,25:01,1.25,Pepsi,1.25\n"
+	resp := h.Do(t, http.MethodPost, "/v1/receipts/import", csv, "Content-Type", "text/csv")
+	for _, want := range []string{`"received":2,"processed":1,"failed":1`, `"index":1,"receiptRef":"B"`, `"field":"purchaseTime"`} {
+		if !strings.Contains(resp.Body, want) {
+			t.Errorf("CSV import is missing %s: %s", want, resp.Body)
+		}
+	}
+}
+
+func TestAtomicImport(t *testing.T) {
+	h := testutil.New(t, nil)
+	invalid := strings.Replace(testutil.TargetReceipt, `"total": "35.35"`, `"total": "abc"`, 1)
+	lines := importNDJSON(t, h, "/v1/receipts/import?atomic=true", ndjson(t, testutil.TargetReceipt, invalid, testutil.CornerMarketReceipt))
+	if s := lines[3].Summary; s == nil || !s.Atomic || !s.RolledBack || s.Processed != 0 || s.Failed != 3 {
+		t.Fatalf("summary: got %+v, want everything rolled back", lines[3])
+	}
+	if lines[0].ID != "" || lines[0].Error == "" || fields(lines[1]) != "total" {
+		t.Errorf("results: got %+v, want the valid receipts rolled back and the invalid one's total reported", lines[:3])
+	}
+	if list := h.Do(t, http.MethodGet, "/v1/receipts", ""); strings.Contains(list.Body, `"id"`) {
+		t.Fatalf("the rolled back import left receipts behind: %s", list.Body)
+	}
+
+	lines = importNDJSON(t, h, "/v1/receipts/import?atomic=1", ndjson(t, testutil.TargetReceipt, testutil.CornerMarketReceipt))
+	if s := lines[2].Summary; s == nil || s.RolledBack || s.Processed != 2 {
+		t.Fatalf("summary: got %+v, want both processed", lines[2])
+	}
+	if points, _ := getPoints(t, h, "/v1/receipts/"+lines[1].ID+"/points"); points != testutil.CornerMarketPoints {
+		t.Errorf("points: got %d, want %d", points, testutil.CornerMarketPoints)
+	}
+
+	csv := "receipt_ref,retailer,purchase_date,purchase_time,total,item_description,item_price\n" +
+		"A,Target,2022-01-01,13:01,1.25,Pepsi,1.25\n" +
+		"B,Target,2022-01-01,13:01,1.2,Pepsi,1.25\n"
+	resp := h.Do(t, http.MethodPost, "/v1/receipts/import?atomic=true", csv, "Content-Type", "text/csv")
+	if !strings.Contains(resp.Body, `"processed":0,"failed":2,"atomic":true,"rolledBack":true`) || strings.Contains(resp.Body, `"id"`) {
+		t.Errorf("atomic CSV import: got %s, want it rolled back", resp.Body)
+	}
+	if resp := h.Do(t, http.MethodPost, "/v1/receipts/import?atomic=maybe", "", "Content-Type", "application/x-ndjson"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("atomic=maybe: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func between(s, start, end string) string {
+	_, after, _ := strings.Cut(s, start)
+	before, _, _ := strings.Cut(after, end)
+	return before
+}
+
+func TestProcessTwiceGivesTwoReceipts(t *testing.T) {
+	h := testutil.New(t, nil)
+	first := processReceipt(t, h, testutil.TargetReceipt)
+	second := processReceipt(t, h, testutil.TargetReceipt)
+	if first == second {
+		t.Fatalf("both submissions got id %s", first)
+	}
+}
+
+func TestPointsRevalidateWithETag(t *testing.T) {
+	h := testutil.New(t, nil)
+	path := "/v1/receipts/" + processReceipt(t, h, testutil.TargetReceipt) + "/points"
+	_, first := getPoints(t, h, path)
+	etag := first.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag on points lookup")
+	}
+	again := h.Do(t, http.MethodGet, path, "", "If-None-Match", etag)
+	if again.StatusCode != http.StatusNotModified || again.Body != "" {
+		t.Fatalf("revalidation: got %d %q, want an empty 304", again.StatusCode, again.Body)
+	}
+}
+
+func TestPointsCacheHeaders(t *testing.T) {
+	h := testutil.New(t, map[string]string{"POINTS_CACHE_MAX_AGE_IN_S": "60", "FRAUD_SCREENING": "true"})
+	path := "/v1/receipts/" + processReceipt(t, h, testutil.TargetReceipt) + "/points"
+
+	plain := h.Do(t, http.MethodGet, path, "", "Accept-Encoding", "identity")
+	etag := plain.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("uncompressed lookup: got ETag %q, want a strong one", etag)
+	}
+	if cc := plain.Header.Get("Cache-Control"); cc != "private, max-age=60" {
+		t.Errorf("Cache-Control: got %q, want private, max-age=60", cc)
+	}
+	// the same points always get the same tag, gzip only weakens it
+	if again := h.Do(t, http.MethodGet, path, "", "Accept-Encoding", "identity"); again.Header.Get("ETag") != etag {
+		t.Errorf("second lookup: got ETag %q, want %q", again.Header.Get("ETag"), etag)
+	}
+	if _, gzipped := getPoints(t, h, path); gzipped.Header.Get("ETag") != "W/"+etag {
+		t.Errorf("compressed lookup: got ETag %q, want W/%s", gzipped.Header.Get("ETag"), etag)
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		status      int
+	}{
+		{"same tag", etag, http.StatusNotModified},
+		{"weak tag", "W/" + etag, http.StatusNotModified},
+		{"in a list", `"stale", ` + etag, http.StatusNotModified},
+		{"any", "*", http.StatusNotModified},
+		{"other tag", `"stale"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := h.Do(t, http.MethodGet, path, "", "If-None-Match", tt.ifNoneMatch, "Accept-Encoding", "identity")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got %d %q, want %d", resp.StatusCode, resp.Body, tt.status)
+			}
+			// a 304 still carries what the client needs to keep using its copy
+			if resp.Header.Get("ETag") != etag || resp.Header.Get("Cache-Control") != "private, max-age=60" {
+				t.Errorf("got ETag %q and Cache-Control %q", resp.Header.Get("ETag"), resp.Header.Get("Cache-Control"))
+			}
+		})
+	}
+
+	// a flagged receipt can change with its review
+	duplicate := processReceipt(t, h, testutil.TargetReceipt)
+	if _, flagged := getPoints(t, h, "/v1/receipts/"+duplicate+"/points"); flagged.Header.Get("Cache-Control") != "private, no-cache" {
+		t.Errorf("Cache-Control of a flagged receipt: got %q, want private, no-cache", flagged.Header.Get("Cache-Control"))
+	}
+}
+
+func TestUnknownReceipts(t *testing.T) {
+	h := testutil.New(t, nil)
+	for _, id := range []string{uuid.NewString(), "not-a-uuid", strings.Repeat("a", 500)} {
+		if _, resp := getPoints(t, h, "/v1/receipts/"+id+"/points"); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("points for %.20q: got %d, want 404", id, resp.StatusCode)
+		}
+	}
+}
+
+func TestReceiptsExpireAfterTTL(t *testing.T) {
+	// only Redis's clock jumps ahead, the receipt cache would keep answering
+	h := testutil.New(t, map[string]string{"REDIS_TTL_IN_S": "600", "RECEIPT_CACHE_SIZE": "0"})
+	path := "/v1/receipts/" + processReceipt(t, h, testutil.TargetReceipt) + "/points"
+
+	h.Redis.FastForward(599 * time.Second)
+	if _, resp := getPoints(t, h, path); resp.StatusCode != http.StatusOK {
+		t.Fatalf("before the TTL: got %d, want 200", resp.StatusCode)
+	}
+	h.Redis.FastForward(2 * time.Second)
+	if _, resp := getPoints(t, h, path); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("after the TTL: got %d, want 404", resp.StatusCode)
+	}
+	// the listing drops it too, even though its index entry outlives it
+	list := h.Do(t, http.MethodGet, "/v1/receipts", "")
+	if list.StatusCode != http.StatusOK || strings.Contains(list.Body, `"id"`) {
+		t.Fatalf("listing after the TTL: got %d %q, want 200 and no receipts", list.StatusCode, list.Body)
+	}
+}
+
+func TestReceiptsWithoutTTLStay(t *testing.T) {
+	h := testutil.New(t, map[string]string{"REDIS_TTL_IN_S": "0"})
+	path := "/v1/receipts/" + processReceipt(t, h, testutil.TargetReceipt) + "/points"
+	h.Redis.FastForward(365 * 24 * time.Hour)
+	if _, resp := getPoints(t, h, path); resp.StatusCode != http.StatusOK {
+		t.Fatalf("a year later: got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestRetentionClasses(t *testing.T) {
+	h := testutil.New(t, map[string]string{
+		"REDIS_TTL_IN_S":         "600",
+		"RECEIPT_RETENTION_IN_S": "dryrun=60,keep=0",
+		"RECEIPT_CACHE_SIZE":     "0",
+	})
+	pointsPath := func(headers ...string) string {
+		return "/v1/receipts/" + processReceipt(t, h, testutil.TargetReceipt, headers...) + "/points"
+	}
+	dryRun := pointsPath("X-Retention-Class", "dryrun")
+	kept := pointsPath("X-Retention-Class", "keep")
+	standard := pointsPath()
+
+	h.Redis.FastForward(61 * time.Second)
+	if _, resp := getPoints(t, h, dryRun); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("dryrun receipt after 61s: got %d, want 404", resp.StatusCode)
+	}
+	if _, resp := getPoints(t, h, standard); resp.StatusCode != http.StatusOK {
+		t.Fatalf("default receipt after 61s: got %d, want 200", resp.StatusCode)
+	}
+	h.Redis.FastForward(365 * 24 * time.Hour)
+	if _, resp := getPoints(t, h, standard); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("default receipt a year later: got %d, want 404", resp.StatusCode)
+	}
+	if _, resp := getPoints(t, h, kept); resp.StatusCode != http.StatusOK {
+		t.Fatalf("keep receipt a year later: got %d, want 200", resp.StatusCode)
+	}
+
+	resp := h.Do(t, http.MethodPost, "/v1/receipts/process", testutil.TargetReceipt, "X-Retention-Class", "forever")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown retention class: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestMalformedReceipts(t *testing.T) {
+	h := testutil.New(t, map[string]string{"MAX_RECEIPT_ITEMS": "5"})
+	withField := func(field, value string) string {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(testutil.TargetReceipt), &rec); err != nil {
+			t.Fatal(err)
+		}
+		rec[field] = json.RawMessage(value)
+		b, err := json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	sixItems := `[` + strings.TrimSuffix(strings.Repeat(`{"shortDescription": "Pepsi", "price": "1.25"},`, 6), ",") + `]`
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		status      int
+	}{
+		{"empty body", "", "application/json", http.StatusBadRequest},
+		{"not json", "retailer=Target", "application/json", http.StatusBadRequest},
+		{"truncated", testutil.TargetReceipt[:40], "application/json", http.StatusBadRequest},
+		{"array", "[" + testutil.TargetReceipt + "]", "application/json", http.StatusBadRequest},
+		{"number total", withField("total", `35.35`), "application/json", http.StatusBadRequest},
+		{"non numeric total", withField("total", `"thirty five"`), "application/json", http.StatusBadRequest},
+		{"bad date", withField("purchaseDate", `"2022-13-01"`), "application/json", http.StatusBadRequest},
+		{"future date", withField("purchaseDate", `"2024-01-16"`), "application/json", http.StatusBadRequest},
+		{"later today", strings.Replace(withField("purchaseDate", `"2024-01-15"`), `"13:01"`, `"12:30"`, 1), "application/json", http.StatusBadRequest},
+		{"bad time", withField("purchaseTime", `"25:00"`), "application/json", http.StatusBadRequest},
+		{"unknown timezone", withField("timezone", `"Mars/Olympus"`), "application/json", http.StatusBadRequest},
+		{"items not an array", withField("items", `{"shortDescription": "Pepsi"}`), "application/json", http.StatusBadRequest},
+		{"items given twice", strings.Replace(testutil.TargetReceipt, `"total"`, `"items": [], "total"`, 1), "application/json", http.StatusBadRequest},
+		{"too many items", withField("items", sixItems), "application/json", http.StatusRequestEntityTooLarge},
+		{"bad user id", withField("userId", `"no spaces allowed"`), "application/json", http.StatusBadRequest},
+		{"malformed xml", "<receipt><retailer>Target</retailer>", "application/xml", http.StatusBadRequest},
+		{"wrong xml root", "<order/>", "application/xml", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := h.Do(t, http.MethodPost, "/v1/receipts/process", tt.body, "Content-Type", tt.contentType)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got %d %q, want %d", resp.StatusCode, resp.Body, tt.status)
+			}
+			if requestID := resp.Header.Get("X-Request-ID"); !strings.Contains(resp.Body, requestID) {
+				t.Errorf("error %q doesn't mention request id %s", resp.Body, requestID)
+			}
+			if code := errorCode(t, resp); code != "VALIDATION_FAILED" {
+				t.Errorf("got code %q, want VALIDATION_FAILED", code)
+			}
+		})
+	}
+	// none of them left anything behind
+	if list := h.Do(t, http.MethodGet, "/v1/receipts", ""); strings.Contains(list.Body, `"id"`) {
+		t.Fatalf("rejected receipts were stored: %s", list.Body)
+	}
+}
+
+func TestGzipBodiesAreCapped(t *testing.T) {
+	h := testutil.New(t, map[string]string{"MAX_REQUEST_BODY_BYTES": "4096"})
+	gzipped := func(body string) string {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(body))
+		zw.Close()
+		return buf.String()
+	}
+	// a few hundred bytes on the wire, well over the limit once inflated
+	padded := strings.Replace(testutil.TargetReceipt, "{", "{"+strings.Repeat(" ", 1<<20), 1)
+
+	resp := h.Do(t, http.MethodPost, "/v1/receipts/process", gzipped(testutil.TargetReceipt),
+		"Content-Type", "application/json", "Content-Encoding", "gzip")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("gzipped receipt: got %d %q, want 200", resp.StatusCode, resp.Body)
+	}
+	for _, path := range []string{"/v1/receipts/process", "/v1/receipts/import?atomic=true"} {
+		resp := h.Do(t, http.MethodPost, path, gzipped(padded), "Content-Type", "application/json", "Content-Encoding", "gzip")
+		if resp.StatusCode != http.StatusRequestEntityTooLarge || errorCode(t, resp) != "VALIDATION_FAILED" {
+			t.Errorf("%s with a gzip bomb: got %d %q, want 413", path, resp.StatusCode, resp.Body)
+		}
+	}
+	// the limit is on what's read, compressed or not
+	if resp := h.Do(t, http.MethodPost, "/v1/receipts/process", padded, "Content-Type", "application/json"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized receipt: got %d %q, want 413", resp.StatusCode, resp.Body)
+	}
+	// a streamed import has answered 200 by then, it reports the limit after the receipts
+	// that fit
+	resp = h.Do(t, http.MethodPost, "/v1/receipts/import", gzipped(strings.Repeat(ndjson(t, testutil.TargetReceipt), 20)),
+		"Content-Type", "application/x-ndjson", "Content-Encoding", "gzip")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Body, `"error":"The request body is larger than 4096 bytes"`) {
+		t.Errorf("streamed import over the limit: got %d %q", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestStalledStoreTimesOut(t *testing.T) {
+	h := testutil.New(t, map[string]string{
+		"REDIS_ADDR":                testutil.StalledRedis(t),
+		"DB_TIMEOUT_IN_MS":          "100",
+		"DB_ATTEMPT_TIMEOUT_IN_MS":  "30",
+		"BREAKER_FAILURE_THRESHOLD": "1000",
+	})
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"process", http.MethodPost, "/v1/receipts/process", testutil.TargetReceipt},
+		{"points", http.MethodGet, fmt.Sprintf("/v1/receipts/%s/points", uuid.NewString()), ""},
+		{"list", http.MethodGet, "/v1/receipts", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			resp := h.Do(t, tt.method, tt.path, tt.body)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("took %v, the DB timeout is 100ms", elapsed)
+			}
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("got %d %q, want 503", resp.StatusCode, resp.Body)
+			}
+		})
+	}
+}
+
+func TestOpenBreakerAnswers503(t *testing.T) {
+	h := testutil.New(t, map[string]string{
+		"REDIS_ADDR":                testutil.StalledRedis(t),
+		"DB_TIMEOUT_IN_MS":          "50",
+		"DB_ATTEMPT_TIMEOUT_IN_MS":  "20",
+		"BREAKER_FAILURE_THRESHOLD": "1",
+		"BREAKER_OPEN_IN_MS":        "60000",
+	})
+	path := fmt.Sprintf("/v1/receipts/%s/points", uuid.NewString())
+	h.Do(t, http.MethodGet, path, "")
+	resp := h.Do(t, http.MethodGet, path, "")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("with the breaker open: got %d (Retry-After %q), want 503 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if ready := h.Do(t, http.MethodGet, "/readyz", ""); ready.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("readyz with the breaker open: got %d, want 503", ready.StatusCode)
+	}
+}
+
+func TestCorrectReceipt(t *testing.T) {
+	h := testutil.New(t, nil)
+	id := processReceipt(t, h, testutil.TargetReceipt, "X-User-ID", "u1")
+
+	resp := h.Do(t, http.MethodPut, "/v1/receipts/"+id, testutil.CornerMarketReceipt, "Content-Type", "application/json", "X-User-ID", "u1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("correct: got %d %q, want 200", resp.StatusCode, resp.Body)
+	}
+	want := fmt.Sprintf(`{"id":"%s","points":%d,"revision":2}`, id, testutil.CornerMarketPoints)
+	if strings.TrimSpace(resp.Body) != want {
+		t.Errorf("correct: got %s, want %s", resp.Body, want)
+	}
+	if points, _ := getPoints(t, h, "/v1/receipts/"+id+"/points"); points != testutil.CornerMarketPoints {
+		t.Errorf("points after correcting: got %d, want %d", points, testutil.CornerMarketPoints)
+	}
+	if balance := h.Do(t, http.MethodGet, "/v1/users/u1/points", ""); !strings.Contains(balance.Body, fmt.Sprintf(`"balance":%d`, testutil.CornerMarketPoints)) {
+		t.Errorf("balance moves by the difference: got %s", balance.Body)
+	}
+	if list := h.Do(t, http.MethodGet, "/v1/receipts?retailer=Target", ""); strings.Contains(list.Body, id) {
+		t.Errorf("still listed under the old retailer: %s", list.Body)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		headers []string
+		status  int
+	}{
+		{"someone else's", "/v1/receipts/" + id, []string{"X-User-ID", "u2"}, http.StatusForbidden},
+		{"unknown", "/v1/receipts/" + uuid.New().String(), nil, http.StatusNotFound},
+		{"not an id", "/v1/receipts/nope", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := h.Do(t, http.MethodPut, tt.path, testutil.TargetReceipt, tt.headers...)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got %d %q, want %d", resp.StatusCode, resp.Body, tt.status)
+			}
+		})
+	}
+}
+
+func TestRedeemPoints(t *testing.T) {
+	h := testutil.New(t, nil)
+	processReceipt(t, h, testutil.TargetReceipt, "X-User-ID", "u1")
+	path := "/v1/users/u1/redemptions"
+
+	coffee := `{"id": "order-1", "points": 10, "reward": "free coffee"}`
+	resp := h.Do(t, http.MethodPost, path, coffee)
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(resp.Body, fmt.Sprintf(`"balanceAfter":%d`, testutil.TargetPoints-10)) {
+		t.Fatalf("redeem: got %d %s", resp.StatusCode, resp.Body)
+	}
+	// a retry gets the original redemption back and spends nothing
+	if again := h.Do(t, http.MethodPost, path, coffee); again.StatusCode != http.StatusOK || again.Body != resp.Body {
+		t.Errorf("replay: got %d %s, want 200 %s", again.StatusCode, again.Body, resp.Body)
+	}
+	if again := h.Do(t, http.MethodPost, path, `{"points": 10, "reward": "free coffee"}`, "Idempotency-Key", "order-1"); again.StatusCode != http.StatusOK {
+		t.Errorf("replay with Idempotency-Key: got %d %s, want 200", again.StatusCode, again.Body)
+	}
+	if balance := h.Do(t, http.MethodGet, "/v1/users/u1/points", ""); !strings.Contains(balance.Body, fmt.Sprintf(`"balance":%d`, testutil.TargetPoints-10)) {
+		t.Errorf("balance after the replays: got %s", balance.Body)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		body    string
+		headers []string
+		status  int
+		code    string
+	}{
+		{"id reused for other points", path, `{"id": "order-1", "points": 11, "reward": "free coffee"}`, nil, http.StatusConflict, "CONFLICT"},
+		{"more than the balance", path, fmt.Sprintf(`{"id": "order-2", "points": %d}`, testutil.TargetPoints-9), nil, http.StatusUnprocessableEntity, "INSUFFICIENT_POINTS"},
+		{"user without points", "/v1/users/u2/redemptions", `{"id": "order-3", "points": 1}`, nil, http.StatusUnprocessableEntity, "INSUFFICIENT_POINTS"},
+		{"no points", path, `{"id": "order-4", "points": 0}`, nil, http.StatusBadRequest, "VALIDATION_FAILED"},
+		{"no id", path, `{"points": 1}`, nil, http.StatusBadRequest, "VALIDATION_FAILED"},
+		{"id and key differ", path, `{"id": "order-5", "points": 1}`, []string{"Idempotency-Key", "order-6"}, http.StatusBadRequest, "VALIDATION_FAILED"},
+		{"someone else's points", path, `{"id": "order-7", "points": 1}`, []string{"X-User-ID", "u2"}, http.StatusForbidden, "FORBIDDEN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := h.Do(t, http.MethodPost, tt.path, tt.body, tt.headers...)
+			if resp.StatusCode != tt.status || errorCode(t, resp) != tt.code {
+				t.Fatalf("got %d %s, want %d %s", resp.StatusCode, resp.Body, tt.status, tt.code)
+			}
+		})
+	}
+
+	// what's left covers three of these, whichever three get there first
+	left := testutil.TargetPoints - 10
+	var wg sync.WaitGroup
+	statuses := make([]int, 6)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"id": "race-%d", "points": %d}`, i, left/3)
+			statuses[i] = h.Do(t, http.MethodPost, path, body).StatusCode
+		}(i)
+	}
+	wg.Wait()
+	var redeemed int
+	for _, status := range statuses {
+		if status == http.StatusCreated {
+			redeemed++
+		} else if status != http.StatusUnprocessableEntity {
+			t.Errorf("concurrent redemption: got %d", status)
+		}
+	}
+	if redeemed != 3 {
+		t.Errorf("%d concurrent redemptions went through, want 3", redeemed)
+	}
+
+	if balance := h.Do(t, http.MethodGet, "/v1/users/u1/points", ""); !strings.Contains(balance.Body, fmt.Sprintf(`"balance":%d`, left%3)) {
+		t.Errorf("balance after the race: got %s", balance.Body)
+	}
+
+	var ledger struct {
+		Redemptions []struct {
+			BalanceAfter int `json:"balanceAfter"`
+		} `json:"redemptions"`
+	}
+	list := h.Do(t, http.MethodGet, path+"?limit=10", "")
+	if err := json.Unmarshal([]byte(list.Body), &ledger); err != nil {
+		t.Fatalf("ledger %q: %v", list.Body, err)
+	}
+	// every redemption saw the balance the one before it left
+	var balances []int
+	for _, red := range ledger.Redemptions {
+		balances = append(balances, red.BalanceAfter)
+	}
+	sort.Ints(balances)
+	if want := []int{left % 3, left%3 + left/3, left%3 + 2*(left/3), left}; !slices.Equal(balances, want) {
+		t.Errorf("ledger balances: got %v, want %v", balances, want)
+	}
+	if other := h.Do(t, http.MethodGet, path, "", "X-User-ID", "u2"); other.StatusCode != http.StatusForbidden {
+		t.Errorf("someone else's ledger: got %d, want 403", other.StatusCode)
+	}
+}
+
+func TestPointsAdjustments(t *testing.T) {
+	h := testutil.New(t, nil)
+	id := processReceipt(t, h, testutil.TargetReceipt, "X-User-ID", "u1")
+	anonymous := processReceipt(t, h, testutil.CornerMarketReceipt)
+	path := "/admin/receipts/" + id + "/adjustments"
+
+	goodwill := `{"id": "goodwill-1", "points": 10, "reason": "late delivery"}`
+	if resp := h.Do(t, http.MethodPost, path, goodwill); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without the admin token: got %d, want 401", resp.StatusCode)
+	}
+	resp := h.Admin(t, http.MethodPost, path, goodwill)
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(resp.Body, fmt.Sprintf(`"balanceAfter":%d`, testutil.TargetPoints+10)) ||
+		!strings.Contains(resp.Body, `"by":"admin token"`) {
+		t.Fatalf("goodwill: got %d %s", resp.StatusCode, resp.Body)
+	}
+	if resp := h.Admin(t, http.MethodPost, path, goodwill); resp.StatusCode != http.StatusOK {
+		t.Errorf("replay: got %d %s, want 200", resp.StatusCode, resp.Body)
+	}
+	points, resp := getPoints(t, h, "/v1/receipts/"+id+"/points")
+	if points != testutil.TargetPoints+10 || !strings.Contains(resp.Body, `"adjustments":[{"id":"goodwill-1","receiptId":"`+id+`","points":10,"reason":"late delivery"`) {
+		t.Errorf("points with the goodwill: got %s", resp.Body)
+	}
+
+	// a receipt gives back at most what it came to
+	clawback := fmt.Sprintf(`{"points": %d, "reason": "fraud"}`, -(testutil.TargetPoints + 11))
+	if resp := h.Admin(t, http.MethodPost, path, clawback); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("clawing back more than the receipt's points: got %d %s, want 422", resp.StatusCode, resp.Body)
+	}
+	clawback = fmt.Sprintf(`{"points": %d, "reason": "fraud"}`, -(testutil.TargetPoints + 10))
+	if resp := h.Admin(t, http.MethodPost, path, clawback); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("clawback: got %d %s", resp.StatusCode, resp.Body)
+	}
+	if points, resp := getPoints(t, h, "/v1/receipts/"+id+"/points"); points != 0 || strings.Count(resp.Body, `"reason"`) != 2 {
+		t.Errorf("points after the clawback: got %s", resp.Body)
+	}
+
+	if resp := h.Admin(t, http.MethodPost, "/admin/users/u1/adjustments", `{"points": 5, "reason": "apology"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("user adjustment: got %d %s", resp.StatusCode, resp.Body)
+	}
+	if resp := h.Admin(t, http.MethodPost, "/admin/users/u1/adjustments", `{"points": -6, "reason": "fraud"}`); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("clawing back more than the balance: got %d %s, want 422", resp.StatusCode, resp.Body)
+	}
+	user := h.Do(t, http.MethodGet, "/v1/users/u1/points", "")
+	if !strings.Contains(user.Body, `"balance":5`) || strings.Count(user.Body, `"reason"`) != 3 || strings.Contains(user.Body, "admin token") {
+		t.Errorf("user points: got %s", user.Body)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"reused id", path, `{"id": "goodwill-1", "points": 11, "reason": "late delivery"}`, http.StatusConflict},
+		{"anonymous receipt", "/admin/receipts/" + anonymous + "/adjustments", goodwill, http.StatusConflict},
+		{"unknown receipt", "/admin/receipts/" + uuid.New().String() + "/adjustments", goodwill, http.StatusNotFound},
+		{"no points", path, `{"points": 0, "reason": "nothing"}`, http.StatusBadRequest},
+		{"no reason", path, `{"points": 1}`, http.StatusBadRequest},
+		{"bad user", "/admin/users/a:b/adjustments", goodwill, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := h.Admin(t, http.MethodPost, tt.path, tt.body); resp.StatusCode != tt.status {
+				t.Fatalf("got %d %q, want %d", resp.StatusCode, resp.Body, tt.status)
+			}
+		})
+	}
+}
+
+func TestAdjustablePointsAreRevalidated(t *testing.T) {
+	h := testutil.New(t, nil)
+	id := processReceipt(t, h, testutil.TargetReceipt, "X-User-ID", "u1")
+	path := "/v1/receipts/" + id + "/points"
+	_, before := getPoints(t, h, path)
+	if cc := before.Header.Get("Cache-Control"); cc != "private, no-cache" {
+		t.Errorf("Cache-Control of a receipt with a user: got %q, want private, no-cache", cc)
+	}
+	if resp := h.Admin(t, http.MethodPost, "/admin/receipts/"+id+"/adjustments", `{"points": 5, "reason": "late delivery"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("goodwill: got %d %s", resp.StatusCode, resp.Body)
+	}
+	if resp := h.Do(t, http.MethodGet, path, "", "If-None-Match", before.Header.Get("ETag")); resp.StatusCode != http.StatusOK {
+		t.Errorf("revalidating after an adjustment: got %d, want 200 with the new points", resp.StatusCode)
+	}
+	_, anonymous := getPoints(t, h, "/v1/receipts/"+processReceipt(t, h, testutil.CornerMarketReceipt)+"/points")
+	if cc := anonymous.Header.Get("Cache-Control"); !strings.Contains(cc, "max-age=") {
+		t.Errorf("Cache-Control of an anonymous receipt: got %q, want a max age", cc)
+	}
+}
+
+func TestConcurrentClawbacksKeepTheReceiptFloor(t *testing.T) {
+	h := testutil.New(t, nil)
+	id := processReceipt(t, h, testutil.TargetReceipt, "X-User-ID", "u1")
+	// the balance covers every clawback, only the receipt's points hold them back
+	if resp := h.Admin(t, http.MethodPost, "/admin/users/u1/adjustments", `{"points": 10000, "reason": "float"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("user adjustment: got %d %s", resp.StatusCode, resp.Body)
+	}
+
+	const racers = 5
+	statuses := make(chan int, racers)
+	clawback := fmt.Sprintf(`{"points": %d, "reason": "fraud"}`, -testutil.TargetPoints)
+	for i := 0; i < racers; i++ {
+		go func() {
+			req, err := http.NewRequest(http.MethodPost, h.Server.URL+"/admin/receipts/"+id+"/adjustments", strings.NewReader(clawback))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			req.Header.Set("Authorization", "Bearer "+testutil.AdminToken)
+			resp, err := h.Server.Client().Do(req)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	created := 0
+	for i := 0; i < racers; i++ {
+		switch status := <-statuses; status {
+		case http.StatusCreated:
+			created++
+		case http.StatusUnprocessableEntity:
+		default:
+			t.Errorf("racing clawback: got %d, want 201 or 422", status)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d racing clawbacks of all the receipt's points went through, want 1", created)
+	}
+	if points, resp := getPoints(t, h, "/v1/receipts/"+id+"/points"); points != 0 {
+		t.Errorf("points after the racing clawbacks: got %s", resp.Body)
+	}
+}
+
+// runMaintenance starts an admin maintenance task and waits for its job to succeed
+func runMaintenance(t *testing.T, h *testutil.Harness, task string) {
+	t.Helper()
+	resp := h.Admin(t, http.MethodPost, "/admin/maintenance/"+task, "")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("%s: got %d %q, want 202", task, resp.StatusCode, resp.Body)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		job := h.Admin(t, http.MethodGet, resp.Header.Get("Location"), "")
+		if strings.Contains(job.Body, `"state":"succeeded"`) {
+			return
+		}
+		if strings.Contains(job.Body, `"state":"failed"`) {
+			t.Fatalf("%s failed: %s", task, job.Body)
+		}
+	}
+	t.Fatalf("%s didn't finish in time", task)
+}
+
+func TestDeleteReceipt(t *testing.T) {
+	h := testutil.New(t, map[string]string{"TOMBSTONE_RETENTION_IN_S": "3600"})
+	id := processReceipt(t, h, testutil.TargetReceipt, "X-User-ID", "u1")
+	path := "/v1/receipts/" + id
+
+	if resp := h.Do(t, http.MethodDelete, path, "", "X-User-ID", "u2"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("someone else's: got %d %q, want 403", resp.StatusCode, resp.Body)
+	}
+	if resp := h.Do(t, http.MethodDelete, path, "", "X-User-ID", "u1"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: got %d %q, want 204", resp.StatusCode, resp.Body)
+	}
+	if _, resp := getPoints(t, h, path+"/points"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("points of a deleted receipt: got %d, want 404", resp.StatusCode)
+	}
+	if resp := h.Do(t, http.MethodDelete, path, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("delete again: got %d, want 404", resp.StatusCode)
+	}
+	if user := h.Do(t, http.MethodGet, "/v1/users/u1/points", ""); strings.Contains(user.Body, id) ||
+		!strings.Contains(user.Body, fmt.Sprintf(`"balance":%d`, testutil.TargetPoints)) {
+		t.Errorf("the receipt leaves the history, its points stay: got %s", user.Body)
+	}
+	if tombstone := h.Admin(t, http.MethodGet, "/admin/receipts/"+id, ""); !strings.Contains(tombstone.Body, `"deletedAt"`) {
+		t.Errorf("admin lookup of the tombstone: got %d %s", tombstone.StatusCode, tombstone.Body)
+	}
+
+	runMaintenance(t, h, "purge-receipts")
+	if tombstone := h.Admin(t, http.MethodGet, "/admin/receipts/"+id, ""); tombstone.StatusCode != http.StatusOK {
+		t.Fatalf("purged before TOMBSTONE_RETENTION_IN_S: got %d", tombstone.StatusCode)
+	}
+	h.Clock.Advance(time.Hour + time.Second)
+	runMaintenance(t, h, "purge-receipts")
+	if tombstone := h.Admin(t, http.MethodGet, "/admin/receipts/"+id, ""); tombstone.StatusCode != http.StatusNotFound {
+		t.Fatalf("after TOMBSTONE_RETENTION_IN_S: got %d %s, want 404", tombstone.StatusCode, tombstone.Body)
+	}
+}
+
+func TestReceiptsArePurgedAtMaxAge(t *testing.T) {
+	h := testutil.New(t, map[string]string{"RECEIPT_MAX_AGE_IN_S": "86400"})
+	old := processReceipt(t, h, testutil.TargetReceipt)
+	h.Clock.Advance(12 * time.Hour)
+	young := processReceipt(t, h, testutil.TargetReceipt)
+	h.Clock.Advance(12*time.Hour + time.Second)
+
+	runMaintenance(t, h, "purge-receipts")
+	if _, resp := getPoints(t, h, "/v1/receipts/"+old+"/points"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("receipt past RECEIPT_MAX_AGE_IN_S: got %d, want 404", resp.StatusCode)
+	}
+	if _, resp := getPoints(t, h, "/v1/receipts/"+young+"/points"); resp.StatusCode != http.StatusOK {
+		t.Errorf("younger receipt: got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestErrorsAreLocalized(t *testing.T) {
+	h := testutil.New(t, nil)
+	path := fmt.Sprintf("/v1/receipts/%s/points", uuid.NewString())
+	tests := []struct {
+		acceptLanguage string
+		lang           string
+		message        string
+	}{
+		{"", "en", "No receipt found for that id"},
+		{"es-MX,es;q=0.9", "es", "No se encontró ningún recibo con ese id"},
+		{"de,fr;q=0.5", "fr", "Aucun reçu trouvé pour cet identifiant"},
+		{"de", "en", "No receipt found for that id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lang, func(t *testing.T) {
+			resp := h.Do(t, http.MethodGet, path, "", "Accept-Language", tt.acceptLanguage)
+			if resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("got %d %q, want 404", resp.StatusCode, resp.Body)
+			}
+			var body struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+				t.Fatalf("decoding %q: %v", resp.Body, err)
+			}
+			if body.Code != "RECEIPT_NOT_FOUND" || body.Message != tt.message {
+				t.Errorf("got %s %q, want RECEIPT_NOT_FOUND %q", body.Code, body.Message, tt.message)
+			}
+			if lang := resp.Header.Get("Content-Language"); lang != tt.lang {
+				t.Errorf("Content-Language: got %q, want %q", lang, tt.lang)
+			}
+		})
+	}
+}
+
+func TestReceiptEventStream(t *testing.T) {
+	h := testutil.New(t, map[string]string{"MAX_EVENT_STREAMS": "1"})
+	resp, err := http.Get(h.Server.URL + "/v1/receipts/events")
+	if err != nil {
+		t.Fatalf("opening the stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("stream: got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if second := h.Do(t, http.MethodGet, "/v1/receipts/events", ""); second.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("past MAX_EVENT_STREAMS: got %d, want 503", second.StatusCode)
+	}
+
+	// other tenants' receipts and other kinds of events don't reach the stream
+	h.App.Stream.Publish(events.Event{Type: events.ReceiptProcessed, ID: "other-tenant", Tenant: "acme"})
+	h.App.Stream.Publish(events.Event{Type: events.ReceiptDeleted, ID: "deleted"})
+	id := processReceipt(t, h, testutil.TargetReceipt)
+
+	lines := bufio.NewScanner(resp.Body)
+	var data string
+	for lines.Scan() {
+		if rest, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			data = rest
+			break
+		}
+	}
+	var ev struct {
+		ID       string `json:"id"`
+		Retailer string `json:"retailer"`
+		Points   int    `json:"points"`
+	}
+	if err := json.Unmarshal([]byte(data), &ev); err != nil {
+		t.Fatalf("event data %q: %v", data, err)
+	}
+	if ev.ID != id || ev.Retailer != "Target" || ev.Points != testutil.TargetPoints {
+		t.Errorf("event: got %+v, want receipt %s", ev, id)
+	}
+
+	// shutting down ends the stream instead of waiting for the client to leave
+	h.Server.Config.RegisterOnShutdown(h.App.Stream.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := h.Server.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("shutting down with a stream open: %v", err)
+	}
+	for lines.Scan() {
+	}
+	if err := lines.Err(); err != nil {
+		t.Errorf("stream after shutdown: %v, want it ended", err)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	h := testutil.New(t, nil)
+	// prior knowledge h2c, the way a gRPC-web or HTTP/2 proxy talks to the service
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	resp, err := client.Get(h.Server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Errorf("healthz over h2c: got %d over %s, want 200 over HTTP/2", resp.StatusCode, resp.Proto)
+	}
+	// HTTP/1.1 clients are served on the same port
+	if resp := h.Do(t, http.MethodGet, "/healthz", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("healthz over HTTP/1.1: got %d", resp.StatusCode)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	h := testutil.New(t, map[string]string{
+		"SERVER_READ_HEADER_TIMEOUT_IN_MS": "100",
+		"SERVER_READ_TIMEOUT_IN_MS":        "600",
+		"SERVER_WRITE_TIMEOUT_IN_MS":       "600",
+		"EVENT_STREAM_PING_IN_MS":          "50",
+	})
+
+	// a client that never finishes its headers is hung up on
+	conn, err := net.Dial("tcp", h.Server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /healthz HTTP/1.1\r\nHost: localhost\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("slow headers: got %v, want the connection closed", err)
+	}
+
+	// event streams outlive the read and write timeouts as long as they keep pinging
+	resp, err := http.Get(h.Server.URL + "/v1/receipts/events")
+	if err != nil {
+		t.Fatalf("opening the stream: %v", err)
+	}
+	defer resp.Body.Close()
+	time.Sleep(time.Second)
+	id := processReceipt(t, h, testutil.TargetReceipt)
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		if strings.HasPrefix(lines.Text(), "data: ") {
+			if !strings.Contains(lines.Text(), id) {
+				t.Errorf("event: got %q, want receipt %s", lines.Text(), id)
+			}
+			return
+		}
+	}
+	t.Errorf("the stream ended past the server timeouts: %v", lines.Err())
+}
+
+// accessLog collects what's logged while the test runs
+type accessLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *accessLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func captureAccessLog(t *testing.T) *accessLog {
+	l := &accessLog{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(logging.Handler(slog.NewJSONHandler(l, nil))))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return l
+}
+
+// lines waits for want access log lines, they're logged once the response went out
+// and can come after the client has it
+func (l *accessLog) lines(t *testing.T, want int) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		l.mu.Lock()
+		logged := l.buf.String()
+		l.mu.Unlock()
+		lines = lines[:0]
+		for _, line := range strings.Split(strings.TrimSpace(logged), "\n") {
+			var entry map[string]interface{}
+			if json.Unmarshal([]byte(line), &entry) == nil && entry["msg"] == "access" {
+				lines = append(lines, entry)
+			}
+		}
+		if len(lines) >= want || time.Now().After(deadline) {
+			break
+		}
+	}
+	// anything past want shows up when it's there by then
+	time.Sleep(50 * time.Millisecond)
+	if len(lines) != want {
+		t.Fatalf("access log: got %d lines, want %d: %v", len(lines), want, lines)
+	}
+	return lines
+}
+
+func TestAccessLog(t *testing.T) {
+	h := testutil.New(t, nil)
+	logged := captureAccessLog(t)
+	h.Do(t, http.MethodGet, "/healthz", "")
+	id := processReceipt(t, h, testutil.TargetReceipt, "X-API-Key", "secret", "X-Request-ID", "req-1")
+	getPoints(t, h, "/v1/receipts/"+id+"/points")
+
+	// the health check isn't logged
+	lines := logged.lines(t, 2)
+	process := lines[0]
+	if process["method"] != "POST" || process["path"] != "/v1/receipts/process" || process["status"] != float64(200) ||
+		process["request_id"] != "req-1" || process["bytes"].(float64) == 0 {
+		t.Errorf("process: got %v", process)
+	}
+	if key := process["api_key"]; key != tenant.HashAPIKey("secret")[:12] {
+		t.Errorf("process: got api_key %v, want the start of the key's hash", key)
+	}
+	if route := lines[1]["route"]; route != "/v1/receipts/{id}/points" {
+		t.Errorf("points: got route %v", route)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	h := testutil.New(t, map[string]string{"ACCESS_LOG_SAMPLE_RATE": "0"})
+	logged := captureAccessLog(t)
+	processReceipt(t, h, testutil.TargetReceipt)
+	h.Redis.SetError("server down")
+	h.Do(t, http.MethodGet, "/v1/receipts/"+uuid.NewString()+"/points", "")
+	h.Redis.SetError("")
+	// server errors are logged whatever the rate
+	if status := logged.lines(t, 1)[0]["status"].(float64); status < 500 {
+		t.Errorf("access log: got a %v, want the failed request's only", status)
+	}
+}
+
+func TestFailuresAreLoggedAtWarnLevel(t *testing.T) {
+	h := testutil.New(t, nil)
+	l := &accessLog{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(logging.Handler(slog.NewJSONHandler(l, &slog.HandlerOptions{Level: slog.LevelWarn}))))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	processReceipt(t, h, testutil.TargetReceipt)
+	h.Redis.SetError("server down")
+	h.Do(t, http.MethodGet, "/v1/receipts/"+uuid.NewString()+"/points", "")
+	h.Redis.SetError("")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	levels := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(l.buf.String()), "\n") {
+		var entry map[string]interface{}
+		if json.Unmarshal([]byte(line), &entry) != nil {
+			continue
+		}
+		if level, _ := entry["level"].(string); level == "INFO" {
+			t.Errorf("got an info line at LOG_LEVEL=warn: %v", entry)
+		} else {
+			levels[level] = true
+		}
+	}
+	if !levels["ERROR"] {
+		t.Errorf("got levels %v, want the failed lookup at ERROR", levels)
+	}
+}
+
+func TestScoreReceipt(t *testing.T) {
+	h := testutil.New(t, nil)
+	resp := h.Do(t, http.MethodPost, "/v1/receipts/score", testutil.TargetReceipt, "Content-Type", "application/json")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("score: got %d %q", resp.StatusCode, resp.Body)
+	}
+	var scored struct {
+		ID        string `json:"id"`
+		Points    int    `json:"points"`
+		Breakdown []struct {
+			Points int `json:"points"`
+		} `json:"breakdown"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &scored); err != nil {
+		t.Fatalf("score: decoding %q: %v", resp.Body, err)
+	}
+	total := 0
+	for _, c := range scored.Breakdown {
+		total += c.Points
+	}
+	if scored.ID != "" || scored.Points != testutil.TargetPoints || total != scored.Points {
+		t.Errorf("score: got %+v, want %d points and no id", scored, testutil.TargetPoints)
+	}
+	// nothing was stored, not even toward a quota
+	if keys := h.Redis.Keys(); len(keys) != 0 {
+		t.Errorf("score left keys behind: %v", keys)
+	}
+	if resp := h.Do(t, http.MethodPost, "/v1/receipts/score", `{"retailer": ""}`, "Content-Type", "application/json"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid receipt: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestEvaluateRules(t *testing.T) {
+	h := testutil.New(t, nil)
+	body := `{"rules": {"version": "candidate", "roundTotalPoints": 100, "expressionRules": [{"name": "bonus", "expression": "7"}]}, "receipt": ` + testutil.TargetReceipt + `}`
+	resp := h.Admin(t, http.MethodPost, "/admin/rules/evaluate", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("evaluate: got %d %q", resp.StatusCode, resp.Body)
+	}
+	var evaluated struct {
+		Points       int                  `json:"points"`
+		RulesVersion string               `json:"rulesVersion"`
+		Breakdown    []db.PointsComponent `json:"breakdown"`
+		Current      struct {
+			Points       int    `json:"points"`
+			RulesVersion string `json:"rulesVersion"`
+		} `json:"current"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &evaluated); err != nil {
+		t.Fatalf("evaluate: decoding %q: %v", resp.Body, err)
+	}
+	// the Target receipt's total isn't round, only the expression rule adds anything
+	if evaluated.RulesVersion != "candidate" || evaluated.Points != testutil.TargetPoints+7 ||
+		evaluated.Current.RulesVersion != rules.DefaultVersion || evaluated.Current.Points != testutil.TargetPoints {
+		t.Errorf("evaluate: got %+v", evaluated)
+	}
+	// nothing was activated or stored
+	if version := h.App.Rules.Current().Version; version != rules.DefaultVersion {
+		t.Errorf("active rules are %s after an evaluation", version)
+	}
+	if keys := h.Redis.Keys(); len(keys) != 0 {
+		t.Errorf("evaluate left keys behind: %v", keys)
+	}
+
+	for name, tc := range map[string]struct {
+		body   string
+		status int
+		want   string
+	}{
+		"rules that don't load": {`{"rules": {"expressionRules": [{"name": "bad", "expression": "total.nope"}]}, "receipt": ` + testutil.TargetReceipt + `}`, http.StatusUnprocessableEntity, "undefined field"},
+		"a rule that fails":     {`{"rules": {"expressionRules": [{"name": "div", "expression": "1 / size(discounts)"}]}, "receipt": ` + testutil.TargetReceipt + `}`, http.StatusUnprocessableEntity, "division by zero"},
+		"an invalid receipt":    {`{"rules": {}, "receipt": {"retailer": "Target"}}`, http.StatusBadRequest, "invalid"},
+		"no receipt":            {`{"rules": {}}`, http.StatusBadRequest, "needs rules and a receipt"},
+	} {
+		resp := h.Admin(t, http.MethodPost, "/admin/rules/evaluate", tc.body)
+		if resp.StatusCode != tc.status || !strings.Contains(resp.Body, tc.want) {
+			t.Errorf("%s: got %d %q, want %d saying %q", name, resp.StatusCode, resp.Body, tc.status, tc.want)
+		}
+	}
+}
+
+func TestRulePlugins(t *testing.T) {
+	dir := t.TempDir()
+	// 10 points for Target receipts, going by what it's sent
+	plugintest.Build(t, dir, "target-bonus", `package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	in, _ := io.ReadAll(os.Stdin)
+	if bytes.Contains(in, []byte("\"retailer\":\"Target\"")) {
+		fmt.Println("[{\"detail\": \"partner\", \"points\": 10}]")
+		return
+	}
+	fmt.Println("[]")
+}
+`)
+	plugintest.Build(t, dir, "broken", "package main\n\nimport \"os\"\n\nfunc main() { os.Exit(1) }\n")
+	rulesPath := filepath.Join(dir, "rules.json")
+	if err := os.WriteFile(rulesPath, []byte(`{"version": "v1", "plugins": ["target-bonus"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := testutil.New(t, map[string]string{"RULES_PATH": rulesPath, "RULE_PLUGIN_DIR": dir, "RULE_PLUGIN_TIMEOUT_IN_MS": "5000"})
+	resp := h.Do(t, http.MethodPost, "/v1/receipts/score", testutil.TargetReceipt, "Content-Type", "application/json")
+	var scored struct {
+		Points    int                  `json:"points"`
+		Breakdown []db.PointsComponent `json:"breakdown"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &scored); err != nil {
+		t.Fatalf("score: decoding %q: %v", resp.Body, err)
+	}
+	last := scored.Breakdown[len(scored.Breakdown)-1]
+	if scored.Points != testutil.TargetPoints+10 || last != (db.PointsComponent{Rule: "plugin.target-bonus", Detail: "partner", Points: 10}) {
+		t.Errorf("score: got %+v, want the plugin's 10 points on top", scored)
+	}
+
+	// a plugin failing is a server error, the receipt is fine
+	os.WriteFile(rulesPath, []byte(`{"version": "v2", "plugins": ["broken"]}`), 0o644)
+	if _, err := h.App.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := h.Do(t, http.MethodPost, "/v1/receipts/process", testutil.TargetReceipt, "Content-Type", "application/json"); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("broken plugin: got %d, want 500", resp.StatusCode)
+	}
+
+	// rules naming a plugin that isn't there don't load
+	os.WriteFile(rulesPath, []byte(`{"version": "v3", "plugins": ["missing"]}`), 0o644)
+	if _, err := h.App.Reload(); err == nil {
+		t.Error("rules with a missing plugin reloaded")
+	}
+}
+
+func TestRetailerRegistry(t *testing.T) {
+	h := testutil.New(t, nil)
+	mm := `{"name": "M&M Corner Market", "aliases": ["MM CORNER MKT"], "patterns": ["^m&m corner market #\\d+$"]}`
+	if resp := h.Admin(t, http.MethodPut, "/admin/retailers/mm", mm); resp.StatusCode != http.StatusOK {
+		t.Fatalf("save retailer: got %d %q", resp.StatusCode, resp.Body)
+	}
+	campaign := `{"name": "MM week", "startDate": "2022-03-01", "endDate": "2022-03-31", "retailerId": "mm", "bonusPoints": 100}`
+	if resp := h.Admin(t, http.MethodPost, "/admin/campaigns", campaign); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("save campaign: got %d %q", resp.StatusCode, resp.Body)
+	}
+	var ids []string
+	for _, name := range []string{"M&M Corner Market #123", "MM  corner mkt"} {
+		ids = append(ids, processReceipt(t, h, strings.Replace(testutil.CornerMarketReceipt, "M&M Corner Market", name, 1)))
+	}
+	for _, id := range ids {
+		if resp := h.Admin(t, http.MethodGet, "/admin/receipts/"+id, ""); !strings.Contains(resp.Body, `"retailerId":"mm"`) {
+			t.Errorf("receipt %s: got %s, want retailer id mm", id, resp.Body)
+		}
+		if resp := h.Do(t, http.MethodGet, "/v1/receipts/"+id+"/breakdown", ""); !strings.Contains(resp.Body, "campaign.bonusPoints") {
+			t.Errorf("receipt %s: the campaign for mm didn't apply: %s", id, resp.Body)
+		}
+	}
+	if resp := h.Do(t, http.MethodGet, "/v1/stats", ""); !strings.Contains(resp.Body, `{"retailer":"mm","receipts":2}`) {
+		t.Errorf("stats count aliases apart: %s", resp.Body)
+	}
+
+	resp := h.Admin(t, http.MethodGet, "/admin/retailers/resolve?retailer=mm+corner+mkt&retailer=Target", "")
+	if want := `{"retailers":{"Target":"","mm corner mkt":"mm"}}`; strings.TrimSpace(resp.Body) != want {
+		t.Errorf("resolve: got %d %s, want %s", resp.StatusCode, resp.Body, want)
+	}
+	for name, tc := range map[string]struct {
+		method, path, body string
+		status             int
+	}{
+		"an alias another retailer has": {http.MethodPut, "/admin/retailers/other", `{"name": "Other", "aliases": ["m&m corner market"]}`, http.StatusConflict},
+		"a bad pattern":                 {http.MethodPut, "/admin/retailers/other", `{"name": "Other", "patterns": ["("]}`, http.StatusBadRequest},
+		"a bad id":                      {http.MethodPut, "/admin/retailers/Not%20An%20Id", `{"name": "Other"}`, http.StatusBadRequest},
+		"no name":                       {http.MethodPut, "/admin/retailers/other", `{"aliases": ["x"]}`, http.StatusBadRequest},
+		"an unknown retailer":           {http.MethodDelete, "/admin/retailers/other", "", http.StatusNotFound},
+		"replacing one":                 {http.MethodPut, "/admin/retailers/mm", `{"name": "M&M Corner Market"}`, http.StatusOK},
+	} {
+		if resp := h.Admin(t, tc.method, tc.path, tc.body); resp.StatusCode != tc.status {
+			t.Errorf("%s: got %d %q, want %d", name, resp.StatusCode, resp.Body, tc.status)
+		}
+	}
+	if resp := h.Admin(t, http.MethodDelete, "/admin/retailers/mm", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete: got %d %q", resp.StatusCode, resp.Body)
+	}
+	if resp := h.Admin(t, http.MethodGet, "/admin/retailers", ""); strings.TrimSpace(resp.Body) != `{"retailers":[]}` {
+		t.Errorf("list after delete: got %s", resp.Body)
+	}
+}
+
+func TestFingerprintFilter(t *testing.T) {
+	env := map[string]string{"FRAUD_SCREENING": "true", "FRAUD_BLOOM_FILTER": "true", "FRAUD_BLOOM_SYNC_IN_MS": "20"}
+	h := testutil.New(t, env)
+	status := func(h *testutil.Harness, body string) string {
+		t.Helper()
+		resp := h.Do(t, http.MethodPost, "/v1/receipts/process", body, "Content-Type", "application/json")
+		var processed struct {
+			Status string `json:"status"`
+		}
+		if resp.StatusCode != http.StatusOK || json.Unmarshal([]byte(resp.Body), &processed) != nil {
+			t.Fatalf("process: got %d %q", resp.StatusCode, resp.Body)
+		}
+		return processed.Status
+	}
+
+	if got := status(h, testutil.TargetReceipt); got != "" {
+		t.Fatalf("first receipt is %q", got)
+	}
+	// caught whether or not its claim was recorded yet
+	if got := status(h, testutil.TargetReceipt); got != db.ReceiptFlagged {
+		t.Errorf("duplicate on the same instance is %q, want flagged", got)
+	}
+
+	// the sync records the claim and shares the filter
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var fingerprints, filters int
+		for _, key := range h.Redis.Keys() {
+			if strings.HasPrefix(key, "fraud:fingerprint:") {
+				fingerprints++
+			}
+			if strings.HasPrefix(key, "fraud:bloom:") {
+				filters++
+			}
+		}
+		if fingerprints == 1 && filters == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d fingerprints and %d filters in Redis, want 1 each: %v", fingerprints, filters, h.Redis.Keys())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// another instance loads the shared filter, the duplicate takes the exact claim
+	env["REDIS_ADDR"] = h.Redis.Addr()
+	other := testutil.New(t, env)
+	if got := status(other, testutil.TargetReceipt); got != db.ReceiptFlagged {
+		t.Errorf("duplicate on another instance is %q, want flagged", got)
+	}
+	if got := status(other, testutil.CornerMarketReceipt); got != "" {
+		t.Errorf("another receipt is %q", got)
+	}
+}
+
+func TestSearchReceipts(t *testing.T) {
+	h := testutil.New(t, nil)
+	mm := `{"name": "M&M Corner Market", "aliases": ["MM CORNER MKT"], "patterns": ["^m&m corner market #\\d+$"]}`
+	if resp := h.Admin(t, http.MethodPut, "/admin/retailers/mm", mm); resp.StatusCode != http.StatusOK {
+		t.Fatalf("save retailer: got %d %q", resp.StatusCode, resp.Body)
+	}
+	target := processReceipt(t, h, testutil.TargetReceipt)
+	var corner []string
+	for _, name := range []string{"M&M Corner Market #123", "MM  corner mkt"} {
+		corner = append(corner, processReceipt(t, h, strings.Replace(testutil.CornerMarketReceipt, "M&M Corner Market", name, 1)))
+	}
+
+	search := func(query string) ([]string, string) {
+		t.Helper()
+		resp := h.Do(t, http.MethodGet, "/v1/receipts/search?"+query, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("search %s: got %d %q", query, resp.StatusCode, resp.Body)
+		}
+		var found struct {
+			Receipts []struct {
+				ID string `json:"id"`
+			} `json:"receipts"`
+			NextCursor string `json:"nextCursor"`
+		}
+		if err := json.Unmarshal([]byte(resp.Body), &found); err != nil {
+			t.Fatalf("search %s: decoding %q: %v", query, resp.Body, err)
+		}
+		var ids []string
+		for _, rec := range found.Receipts {
+			ids = append(ids, rec.ID)
+		}
+		sort.Strings(ids)
+		return ids, found.NextCursor
+	}
+	sort.Strings(corner)
+	for query, want := range map[string][]string{
+		// any spelling the registry knows finds every spelling of the retailer
+		"retailer=M%26M+Corner+Market+%2377":             corner,
+		"retailer=mm+corner+mkt&minPoints=100":           corner,
+		"retailer=mm+corner+mkt&minPoints=120":           nil,
+		"retailer=mm+corner+mkt&from=2022-04-01":         nil,
+		"retailer=+TARGET&from=2022-01-01&to=2022-01-01": {target},
+		"from=2022-03-01":                                corner,
+	} {
+		if got, _ := search(query); !slices.Equal(got, want) {
+			t.Errorf("search %s: got %v, want %v", query, got, want)
+		}
+	}
+
+	first, cursor := search("retailer=mm&limit=1")
+	second, cursor := search("retailer=mm&limit=1&cursor=" + cursor)
+	third, _ := search("retailer=mm&limit=1&cursor=" + cursor)
+	if len(first) != 1 || len(second) != 1 || first[0] == second[0] || len(third) != 0 {
+		t.Errorf("paging: got %v, %v then %v", first, second, third)
+	}
+	if resp := h.Do(t, http.MethodGet, "/v1/receipts/search?minPoints=lots", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad minPoints: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestKeyPrefixAndHashTags(t *testing.T) {
+	sum := sha256.Sum256([]byte("acme-key"))
+	tenants := filepath.Join(t.TempDir(), "tenants.json")
+	if err := os.WriteFile(tenants, []byte(`{"tenants": [{"id": "acme", "name": "Acme", "apiKeySha256": ["`+hex.EncodeToString(sum[:])+`"]}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h := testutil.New(t, map[string]string{"KEY_PREFIX": "staging", "REDIS_HASH_TAGS": "true", "TENANTS_PATH": tenants})
+
+	// the public API needs a tenant's key now, admin calls act on the default tenant
+	id := processReceipt(t, h, testutil.TargetReceipt, "X-API-Key", "acme-key", "X-User-ID", "alice")
+	if resp := h.Do(t, http.MethodGet, "/v1/receipts/"+id+"/points", "", "X-API-Key", "acme-key"); resp.StatusCode != http.StatusOK {
+		t.Errorf("acme: got %d %q", resp.StatusCode, resp.Body)
+	}
+	if resp := h.Admin(t, http.MethodPut, "/admin/retailers/target", `{"name": "Target"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("saving a retailer: got %d %q", resp.StatusCode, resp.Body)
+	}
+
+	var defaults, acme int
+	for _, key := range h.Redis.Keys() {
+		switch {
+		case strings.HasPrefix(key, "{staging}:"):
+			defaults++
+		case strings.HasPrefix(key, "{staging:tenant:acme}:"):
+			acme++
+		default:
+			t.Errorf("key %q is outside the namespace or its tenant's hash tag", key)
+		}
+	}
+	if defaults == 0 || acme == 0 {
+		t.Errorf("got %d default tenant keys and %d acme keys: %v", defaults, acme, h.Redis.Keys())
+	}
+}
+
+func TestTenantUsageAndQuotas(t *testing.T) {
+	keyHash := func(key string) string {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	tenants := filepath.Join(t.TempDir(), "tenants.json")
+	file := `{"tenants": [
+		{"id": "acme", "name": "Acme", "apiKeySha256": ["` + keyHash("acme-key") + `", "` + keyHash("acme-key-2") + `"], "monthlyReceiptQuota": 2},
+		{"id": "beta", "name": "Beta", "apiKeySha256": ["` + keyHash("beta-key") + `"]}]}`
+	if err := os.WriteFile(tenants, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h := testutil.New(t, map[string]string{"TENANTS_PATH": tenants})
+
+	processReceipt(t, h, testutil.TargetReceipt, "X-API-Key", "acme-key")
+	processReceipt(t, h, testutil.CornerMarketReceipt, "X-API-Key", "acme-key-2")
+	processReceipt(t, h, testutil.CornerMarketReceipt, "X-API-Key", "beta-key")
+	// the monthly quota is used up, the middleware turns the next one away until next month
+	resp := h.Do(t, http.MethodPost, "/v1/receipts/process", testutil.TargetReceipt, "Content-Type", "application/json", "X-API-Key", "acme-key")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("over the monthly quota: got %d %q, want 429", resp.StatusCode, resp.Body)
+	}
+	// on the app's clock, from the 15th at noon to the 1st
+	if got, want := resp.Header.Get("Retry-After"), strconv.Itoa(16*24*3600+12*3600); got != want {
+		t.Errorf("Retry-After: got %q, want %q, when the month is over", got, want)
+	}
+
+	resp = h.Admin(t, http.MethodGet, "/admin/usage", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("usage: got %d %q", resp.StatusCode, resp.Body)
+	}
+	var usage struct {
+		Tenants []struct {
+			TenantID string `json:"tenantId"`
+			Receipts int    `json:"receipts"`
+			Points   int    `json:"points"`
+			Periods  []struct {
+				Receipts int `json:"receipts"`
+				Keys     []struct {
+					APIKey   string `json:"apiKey"`
+					Receipts int    `json:"receipts"`
+					Points   int    `json:"points"`
+				} `json:"keys"`
+			} `json:"periods"`
+		} `json:"tenants"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &usage); err != nil {
+		t.Fatalf("usage: decoding %q: %v", resp.Body, err)
+	}
+	if len(usage.Tenants) != 3 {
+		t.Fatalf("usage: got %d tenants, want the default tenant, acme and beta: %s", len(usage.Tenants), resp.Body)
+	}
+	acme, beta := usage.Tenants[1], usage.Tenants[2]
+	if acme.TenantID != "acme" || acme.Receipts != 2 || acme.Points != 137 || beta.Receipts != 1 || beta.Points != 109 {
+		t.Errorf("usage: got %s", resp.Body)
+	}
+	keys := acme.Periods[len(acme.Periods)-1].Keys
+	if len(keys) != 2 || keys[0].APIKey != keyHash("acme-key")[:12] || keys[0].Points != 28 || keys[1].Points != 109 {
+		t.Errorf("usage per key: got %+v", keys)
+	}
+
+	today := testutil.Now.UTC().Format("2006-01-02")
+	resp = h.Do(t, http.MethodGet, "/admin/usage?by=month&format=csv&from="+today+"&to="+today, "",
+		"Authorization", "Bearer "+testutil.AdminToken, "X-Tenant-ID", "beta")
+	month := today[:7]
+	want := "tenant,period,apiKey,receipts,points\nbeta," + month + ",,1,109\nbeta," + month + "," + keyHash("beta-key")[:12] + ",1,109\n"
+	if resp.StatusCode != http.StatusOK || resp.Body != want {
+		t.Errorf("usage CSV: got %d %q, want %q", resp.StatusCode, resp.Body, want)
+	}
+	if resp := h.Admin(t, http.MethodGet, "/admin/usage?by=week", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("usage by week: got %d, want 400", resp.StatusCode)
+	}
+
+	// next month by the app's clock, the quota starts over
+	h.Clock.Set(time.Date(2024, time.February, 1, 0, 0, 1, 0, time.UTC))
+	processReceipt(t, h, testutil.TargetReceipt, "X-API-Key", "acme-key")
+}
+
+func TestScheduledReports(t *testing.T) {
+	reports := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reports <- string(body)
+	}))
+	defer receiver.Close()
+	h := testutil.New(t, map[string]string{
+		"FRAUD_SCREENING":       "true",
+		"REPORT_DAILY_SCHEDULE": "0 6 * * *",
+		"REPORT_WEBHOOK_URL":    receiver.URL,
+		"REPORT_TOP_RETAILERS":  "1",
+	})
+	type summary struct {
+		Period        string `json:"period"`
+		From          string `json:"from"`
+		To            string `json:"to"`
+		Receipts      int    `json:"receipts"`
+		PointsAwarded int    `json:"pointsAwarded"`
+		FraudFlags    int    `json:"fraudFlags"`
+		Tenants       []struct {
+			PendingReview int `json:"pendingReview"`
+			TopRetailers  []struct {
+				Retailer string `json:"retailer"`
+				Receipts int    `json:"receipts"`
+			} `json:"topRetailers"`
+		} `json:"tenants"`
+	}
+	decode := func(body string) summary {
+		t.Helper()
+		var s summary
+		if err := json.Unmarshal([]byte(body), &s); err != nil || len(s.Tenants) != 1 {
+			t.Fatalf("report %q isn't a summary of the default tenant: %v", body, err)
+		}
+		return s
+	}
+
+	// processed and purchased the day before the report goes out, the second Target
+	// receipt is a duplicate held for review
+	h.Clock.Set(time.Date(2024, time.January, 14, 20, 0, 0, 0, time.UTC))
+	target := processReceipt(t, h, strings.Replace(testutil.TargetReceipt, "2022-01-01", "2024-01-14", 1))
+	processReceipt(t, h, strings.Replace(testutil.TargetReceipt, "2022-01-01", "2024-01-14", 1))
+	corner := processReceipt(t, h, strings.Replace(testutil.CornerMarketReceipt, "2022-03-20", "2024-01-14", 1))
+	targetPoints, _ := getPoints(t, h, "/v1/receipts/"+target+"/points")
+	cornerPoints, _ := getPoints(t, h, "/v1/receipts/"+corner+"/points")
+
+	// two instances' schedulers, only one of them sends
+	h.Clock.Set(time.Date(2024, time.January, 15, 5, 59, 0, 0, time.UTC))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.App.StartReportScheduler(ctx, 5*time.Millisecond)
+	h.App.StartReportScheduler(ctx, 5*time.Millisecond)
+	select {
+	case body := <-reports:
+		t.Fatalf("report sent before it was due: %s", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	h.Clock.Set(time.Date(2024, time.January, 15, 6, 0, 0, 0, time.UTC))
+	var daily summary
+	select {
+	case body := <-reports:
+		daily = decode(body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no report was sent when it was due")
+	}
+	top := daily.Tenants[0].TopRetailers
+	if daily.Period != "daily" || daily.From != "2024-01-14" || daily.To != "2024-01-14" ||
+		daily.Receipts != 3 || daily.PointsAwarded != targetPoints+cornerPoints || daily.FraudFlags != 1 ||
+		daily.Tenants[0].PendingReview != 1 || len(top) != 1 || top[0].Retailer != "target" || top[0].Receipts != 2 {
+		t.Errorf("daily report: got %+v", daily)
+	}
+	select {
+	case body := <-reports:
+		t.Errorf("report sent twice: %s", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	resp := h.Admin(t, http.MethodGet, "/admin/reports/weekly?date=2024-01-14", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("weekly report: got %d %q", resp.StatusCode, resp.Body)
+	}
+	if weekly := decode(resp.Body); weekly.From != "2024-01-08" || weekly.To != "2024-01-14" || weekly.Receipts != 3 {
+		t.Errorf("weekly report: got %+v", weekly)
+	}
+	if resp := h.Admin(t, http.MethodGet, "/admin/reports/monthly", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("monthly report: got %d, want 400", resp.StatusCode)
+	}
+
+	// sending by hand goes out whether or not the scheduler sent it already
+	if resp := h.Admin(t, http.MethodPost, "/admin/reports/daily?date=2024-01-14", ""); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("sending the report: got %d %q, want 202", resp.StatusCode, resp.Body)
+	}
+	select {
+	case body := <-reports:
+		if resent := decode(body); resent.Receipts != 3 {
+			t.Errorf("resent report: got %+v", resent)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the report wasn't sent again")
+	}
+}
+
+func TestIdenticalSubmissionsAreProcessedOnce(t *testing.T) {
+	h := testutil.New(t, map[string]string{"SUBMISSION_LOCK_IN_MS": "5000"})
+
+	const racers = 5
+	ids := make(chan string, racers)
+	for i := 0; i < racers; i++ {
+		go func() {
+			resp, err := h.Server.Client().Post(h.Server.URL+"/v1/receipts/process", "application/json", strings.NewReader(testutil.TargetReceipt))
+			if err != nil {
+				ids <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			var processed struct {
+				ID string `json:"id"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&processed); err != nil || resp.StatusCode != http.StatusOK {
+				ids <- fmt.Sprintf("%d %v", resp.StatusCode, err)
+				return
+			}
+			ids <- processed.ID
+		}()
+	}
+	first := <-ids
+	for i := 1; i < racers; i++ {
+		if id := <-ids; id != first {
+			t.Errorf("racing submissions got %q and %q, want the same receipt", first, id)
+		}
+	}
+	if id := processReceipt(t, h, testutil.TargetReceipt); id != first {
+		t.Errorf("a resubmission within the lock got %s, want %s", id, first)
+	}
+
+	var receipts int
+	for _, key := range h.Redis.Keys() {
+		if strings.HasPrefix(key, "receipt:") {
+			receipts++
+		}
+	}
+	if receipts != 1 {
+		t.Errorf("got %d receipts stored, want 1", receipts)
+	}
+
+	// another user's receipt is another submission
+	if id := processReceipt(t, h, testutil.TargetReceipt, "X-User-ID", "alice"); id == first {
+		t.Error("alice's receipt got the anonymous one's id")
+	}
+	// and once the lock is gone so is the same content
+	h.Redis.FastForward(6 * time.Second)
+	if id := processReceipt(t, h, testutil.TargetReceipt); id == first {
+		t.Error("a submission after the lock expired got the first one's id")
+	}
+}
+
+// a write retried after Redis applied it, because the reply came too late, must not
+// credit or count the receipt again
+func TestRetriedWritesApplyOnce(t *testing.T) {
+	h := testutil.New(t, nil)
+	ctx := context.Background()
+	// updates check expiry by the wall clock
+	expireAt := time.Now().AddDate(1, 0, 0)
+	rec := db.ReceiptRecord{ID: "r1", Retailer: "Target", PurchaseDate: "2024-01-01", Points: 40, CreatedAt: testutil.Now, UserID: "alice", PointsExpireAt: &expireAt}
+	for i := 0; i < 2; i++ {
+		if err := h.Store.SaveReceipts(ctx, []db.ReceiptRecord{rec}); err != nil {
+			t.Fatalf("save %d: %v", i+1, err)
+		}
+	}
+	rescored := rec
+	rescored.Points = 55
+	for i := 0; i < 2; i++ {
+		if err := h.Store.UpdateReceipts(ctx, []db.ReceiptUpdate{{Record: rescored, OldPoints: rec.Points}}); err != nil {
+			t.Fatalf("update %d: %v", i+1, err)
+		}
+	}
+
+	points, err := h.Store.GetUserPoints(ctx, "alice", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points.Balance != 55 || len(points.Receipts) != 1 {
+		t.Errorf("got a balance of %d from %d receipts, want 55 from 1", points.Balance, len(points.Receipts))
+	}
+	analytics, err := h.Store.GetAnalytics(ctx, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if analytics.Receipts != 1 || analytics.ScoredPoints != 55 || analytics.PointsAwarded != 55 {
+		t.Errorf("got %d receipts with %d points scored and %d awarded, want 1 with 55 and 55",
+			analytics.Receipts, analytics.ScoredPoints, analytics.PointsAwarded)
+	}
+	if lot := h.Redis.HGet("user:alice:lotpoints", "r1"); lot != "55" {
+		t.Errorf("got %q points in the receipt's lot, want 55", lot)
+	}
+}
+
+func TestLoadSheddingKeepsLookupsGoing(t *testing.T) {
+	h := testutil.New(t, map[string]string{"MAX_IN_FLIGHT_REQUESTS": "2", "LOOKUP_RESERVED_REQUESTS": "1", "CONCURRENCY_QUEUE_WAIT_IN_MS": "50"})
+	id := processReceipt(t, h, testutil.TargetReceipt)
+
+	// a submission whose body is still on its way holds the one slot submissions get
+	body, send := io.Pipe()
+	done := make(chan int, 1)
+	go func() {
+		resp, err := h.Server.Client().Post(h.Server.URL+"/v1/receipts/process", "application/json", body)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	for h.App.Requests.Stats().InFlight == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	resp := h.Do(t, http.MethodPost, "/v1/receipts/process", testutil.CornerMarketReceipt, "Content-Type", "application/json")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" || errorCode(t, resp) != "OVERLOADED" {
+		t.Errorf("second submission: got %d %q, want a 429 with Retry-After", resp.StatusCode, resp.Body)
+	}
+	if points, resp := getPoints(t, h, "/v1/receipts/"+id+"/points"); resp.StatusCode != http.StatusOK || points != testutil.TargetPoints {
+		t.Errorf("lookup while submissions are shed: got %d points, status %d, want %d and 200", points, resp.StatusCode, testutil.TargetPoints)
+	}
+
+	io.WriteString(send, testutil.CornerMarketReceipt)
+	send.Close()
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("held submission: got %d, want 200", status)
+	}
+	processReceipt(t, h, testutil.CornerMarketReceipt)
+	if stats := h.App.Requests.Stats(); stats.Low.Rejected != 1 || stats.InFlight != 0 {
+		t.Errorf("got limiter stats %+v, want one low priority rejection and nothing in flight", stats)
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	h := testutil.New(t, map[string]string{"METRICS_TOKEN": "scrape-token"})
+	if resp := h.Do(t, http.MethodGet, "/metrics", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the token: got %d, want 401", resp.StatusCode)
+	}
+	if resp := h.Admin(t, http.MethodGet, "/metrics", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("with the admin token: got %d, want 401", resp.StatusCode)
+	}
+	resp := h.Do(t, http.MethodGet, "/metrics", "", "Authorization", "Bearer scrape-token")
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(resp.Body), &vars); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("with the token: got %d, %v", resp.StatusCode, err)
+	}
+	if _, ok := vars["memstats"]; !ok {
+		t.Error("memstats is missing")
+	}
+	if _, ok := vars["cmdline"]; ok {
+		t.Error("the command line is served")
+	}
+}
+
+func TestRulePointsMetrics(t *testing.T) {
+	h := testutil.New(t, nil)
+	type ruleStats struct {
+		Receipts  int64 `json:"receipts"`
+		Fired     int64 `json:"fired"`
+		Points    int64 `json:"points"`
+		Histogram struct {
+			Count   int64 `json:"count"`
+			Buckets []struct {
+				LE    string `json:"le"`
+				Count int64  `json:"count"`
+			} `json:"buckets"`
+		} `json:"histogram"`
+	}
+	// metrics are process wide, other tests count into them too
+	scrape := func() map[string]ruleStats {
+		t.Helper()
+		resp := h.Do(t, http.MethodGet, "/metrics", "")
+		var vars struct {
+			RulePoints map[string]ruleStats `json:"rule_points"`
+		}
+		if err := json.Unmarshal([]byte(resp.Body), &vars); err != nil {
+			t.Fatalf("decoding /metrics: %v", err)
+		}
+		return vars.RulePoints
+	}
+	before := scrape()
+	processReceipt(t, h, testutil.CornerMarketReceipt)
+	processReceipt(t, h, testutil.TargetReceipt)
+	after := scrape()
+
+	// 9.00 is a round dollar amount, 35.35 isn't
+	round, was := after["roundTotal"], before["roundTotal"]
+	if round.Receipts-was.Receipts != 2 || round.Fired-was.Fired != 1 || round.Points-was.Points != 50 {
+		t.Errorf("roundTotal went from %+v to %+v, want 2 more receipts and one 50 point bonus", was, round)
+	}
+	if round.Histogram.Count-was.Histogram.Count != 1 {
+		t.Errorf("roundTotal histogram went from %d to %d values, want one more", was.Histogram.Count, round.Histogram.Count)
+	}
+	for i, bucket := range round.Histogram.Buckets {
+		var earlier int64
+		if len(was.Histogram.Buckets) > i {
+			earlier = was.Histogram.Buckets[i].Count
+		}
+		// buckets count everything up to their bound
+		want := int64(1)
+		if bound, err := strconv.ParseFloat(bucket.LE, 64); err == nil && bound < 50 {
+			want = 0
+		}
+		if bucket.Count-earlier != want {
+			t.Errorf("roundTotal bucket le=%s got %d more, want %d", bucket.LE, bucket.Count-earlier, want)
+		}
+	}
+	if retailer := after["retailerName"]; retailer.Fired-before["retailerName"].Fired != 2 {
+		t.Errorf("retailerName fired %d more times, want 2", retailer.Fired-before["retailerName"].Fired)
+	}
+}
+
+func TestOIDCAdminCapabilities(t *testing.T) {
+	idp := oidctest.New(t, "receipts", "secret")
+	h := testutil.New(t, map[string]string{
+		"ADMIN_TOKEN":        "",
+		"OIDC_ISSUER_URL":    idp.Issuer,
+		"OIDC_CLIENT_ID":     "receipts",
+		"OIDC_CLIENT_SECRET": "secret",
+		"OIDC_REDIRECT_URL":  "https://receipts.example.com/admin/callback",
+		"OIDC_ROLES":         "viewer=read,ops=review+purge,root=admin",
+	})
+	id := processReceipt(t, h, testutil.TargetReceipt)
+	as := func(roles ...string) string {
+		return "Bearer " + idp.Token(t, map[string]interface{}{"sub": "someone", "roles": roles})
+	}
+
+	for _, tc := range []struct {
+		name, method, path, auth string
+		want                     int
+	}{
+		{"viewer reads", http.MethodGet, "/admin/receipts/" + id, as("viewer"), http.StatusOK},
+		{"viewer can't purge", http.MethodDelete, "/admin/receipts/" + id, as("viewer"), http.StatusForbidden},
+		{"viewer can't edit rules", http.MethodPost, "/admin/reload", as("viewer"), http.StatusForbidden},
+		{"ops can't edit rules", http.MethodPost, "/admin/reload", as("ops"), http.StatusForbidden},
+		{"ops can't register webhooks", http.MethodPost, "/admin/webhooks", as("ops"), http.StatusForbidden},
+		{"unmapped role", http.MethodGet, "/admin/stats", as("intern"), http.StatusForbidden},
+		{"static token", http.MethodGet, "/admin/stats", "Bearer " + testutil.AdminToken, http.StatusUnauthorized},
+		{"no token", http.MethodGet, "/admin/stats", "", http.StatusUnauthorized},
+		{"ops purges", http.MethodDelete, "/admin/receipts/" + id, as("viewer", "ops"), http.StatusNoContent},
+		{"root edits rules", http.MethodPost, "/admin/reload", as("root"), http.StatusOK},
+	} {
+		if resp := h.Do(t, tc.method, tc.path, "", "Authorization", tc.auth); resp.StatusCode != tc.want {
+			t.Errorf("%s: got %d %q, want %d", tc.name, resp.StatusCode, resp.Body, tc.want)
+		}
+	}
+
+	// a browser signs in at the provider and comes back with a session cookie
+	browser := *h.Server.Client()
+	browser.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	get := func(url string, cookies ...*http.Cookie) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Accept", "text/html")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := browser.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := get(h.Server.URL + "/admin/stats"); resp.StatusCode != http.StatusFound ||
+		resp.Header.Get("Location") != "/admin/login?next=%2Fadmin%2Fstats" {
+		t.Fatalf("signed out browser: got %d to %q, want sent to sign in", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	idp.SignIn(map[string]interface{}{"email": "ana@example.com", "roles": []string{"viewer"}})
+	login := get(h.Server.URL + "/admin/login?next=/admin/review")
+	if len(login.Cookies()) != 1 || !strings.HasPrefix(login.Header.Get("Location"), idp.Issuer) {
+		t.Fatalf("login: got %d to %q", login.StatusCode, login.Header.Get("Location"))
+	}
+	back, err := url.Parse(get(login.Header.Get("Location")).Header.Get("Location"))
+	if err != nil || back.Path != "/admin/callback" {
+		t.Fatalf("provider sent the browser back to %v", back)
+	}
+	if forged := get(h.Server.URL+"/admin/callback?code=x&state=forged", login.Cookies()...); forged.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback with someone else's state: got %d, want 400", forged.StatusCode)
+	}
+	callback := get(h.Server.URL+"/admin/callback?"+back.RawQuery, login.Cookies()...)
+	var session *http.Cookie
+	for _, c := range callback.Cookies() {
+		if c.Name == "admin_session" {
+			session = c
+		}
+	}
+	if callback.StatusCode != http.StatusFound || callback.Header.Get("Location") != "/admin/review" || session == nil {
+		t.Fatalf("callback: got %d to %q, cookies %v", callback.StatusCode, callback.Header.Get("Location"), callback.Cookies())
+	}
+	if !session.HttpOnly || !session.Secure || session.Path != "/admin" || session.MaxAge <= 0 {
+		t.Errorf("session cookie %+v should be HttpOnly, Secure, for /admin and expire", session)
+	}
+	if resp := get(h.Server.URL+"/admin/review", session); resp.StatusCode != http.StatusOK {
+		t.Errorf("signed in browser: got %d, want 200", resp.StatusCode)
+	}
+	if resp := h.Do(t, http.MethodPost, "/admin/maintenance/purge-receipts", "", "Cookie", session.String()); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("viewer's session purging: got %d, want 403", resp.StatusCode)
+	}
+	if resp := h.Do(t, http.MethodPost, "/admin/logout", ""); resp.StatusCode != http.StatusNoContent ||
+		!strings.Contains(resp.Header.Get("Set-Cookie"), "admin_session=;") {
+		t.Errorf("logout: got %d, Set-Cookie %q", resp.StatusCode, resp.Header.Get("Set-Cookie"))
+	}
+}
+
+func TestAdminDashboard(t *testing.T) {
+	h := testutil.New(t, nil)
+	page := h.Do(t, http.MethodGet, "/admin/ui/", "")
+	if page.StatusCode != http.StatusOK || !strings.Contains(page.Body, `data-login="false"`) ||
+		!strings.Contains(page.Header.Get("Content-Security-Policy"), "default-src 'self'") {
+		t.Fatalf("dashboard page: got %d %v %q", page.StatusCode, page.Header, page.Body)
+	}
+	if script := h.Do(t, http.MethodGet, "/admin/ui/dashboard.js", ""); script.StatusCode != http.StatusOK ||
+		!strings.Contains(script.Header.Get("Content-Type"), "javascript") {
+		t.Errorf("dashboard script: got %d %q", script.StatusCode, script.Header.Get("Content-Type"))
+	}
+	if resp := h.Do(t, http.MethodGet, "/admin/overview", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("overview without a token: got %d, want 401", resp.StatusCode)
+	}
+
+	target := processReceipt(t, h, testutil.TargetReceipt)
+	h.Clock.Advance(time.Second)
+	corner := processReceipt(t, h, testutil.CornerMarketReceipt)
+	type overview struct {
+		RulesVersion string `json:"rulesVersion"`
+		Store        struct {
+			Status string `json:"status"`
+			Stats  *struct {
+				IndexedReceipts int `json:"indexedReceipts"`
+			} `json:"stats"`
+		} `json:"store"`
+		Recent []struct {
+			ID     string `json:"id"`
+			Points int    `json:"points"`
+		} `json:"recentReceipts"`
+		PointsDistribution []struct {
+			Min      int `json:"min"`
+			Receipts int `json:"receipts"`
+		} `json:"pointsDistribution"`
+		Sampled int `json:"sampled"`
+	}
+	get := func() overview {
+		t.Helper()
+		resp := h.Admin(t, http.MethodGet, "/admin/overview", "")
+		var o overview
+		if err := json.Unmarshal([]byte(resp.Body), &o); resp.StatusCode != http.StatusOK || err != nil {
+			t.Fatalf("overview: got %d %q, %v", resp.StatusCode, resp.Body, err)
+		}
+		return o
+	}
+	o := get()
+	if o.RulesVersion != rules.DefaultVersion || o.Store.Status != "ok" || o.Store.Stats == nil || o.Store.Stats.IndexedReceipts != 2 {
+		t.Errorf("overview: got %+v", o)
+	}
+	if len(o.Recent) != 2 || o.Recent[0].ID != corner || o.Recent[1].ID != target || o.Sampled != 2 {
+		t.Errorf("recent receipts, newest first: got %+v", o.Recent)
+	}
+	perBucket := map[int]int{}
+	for _, b := range o.PointsDistribution {
+		perBucket[b.Min] = b.Receipts
+	}
+	// 28 and 109 points
+	if len(o.PointsDistribution) != 7 || perBucket[25] != 1 || perBucket[100] != 1 || perBucket[0] != 0 {
+		t.Errorf("points distribution: got %+v", o.PointsDistribution)
+	}
+
+	// a store that's down is what the dashboard is for, it shows as the store's status
+	h.Redis.SetError("LOADING Redis is loading the dataset in memory")
+	defer h.Redis.SetError("")
+	if o := get(); o.Store.Status != "unavailable" || len(o.Recent) != 0 {
+		t.Errorf("overview with the store down: got %+v", o)
+	}
+}
+
+func TestChaosMode(t *testing.T) {
+	if resp := testutil.New(t, nil).Admin(t, http.MethodGet, "/admin/chaos", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("chaos without CHAOS_MODE: got %d, want 404", resp.StatusCode)
+	}
+
+	h := testutil.New(t, map[string]string{
+		"CHAOS_MODE":                "true",
+		"BREAKER_FAILURE_THRESHOLD": "2",
+		"BREAKER_OPEN_IN_MS":        "50",
+	})
+	process := func() testutil.Response {
+		t.Helper()
+		return h.Do(t, http.MethodPost, "/v1/receipts/process", testutil.TargetReceipt, "Content-Type", "application/json")
+	}
+	for _, bad := range []struct{ target, body string }{
+		{"scoring", `{"errorRate": 1, "error": "loading"}`},
+		{"store", `{"errorRate": 2}`},
+		{"store", `{"latencyMs": -1}`},
+		{"queue", `{"errorRate": 1}`},
+	} {
+		if resp := h.Admin(t, http.MethodPut, "/admin/chaos/"+bad.target, bad.body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("fault %s on %s: got %d, want 400", bad.body, bad.target, resp.StatusCode)
+		}
+	}
+
+	if resp := h.Admin(t, http.MethodPut, "/admin/chaos/scoring", `{"errorRate": 1}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("scoring fault: got %d %q", resp.StatusCode, resp.Body)
+	}
+	if resp := process(); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("process with scoring failing: got %d %q, want 500", resp.StatusCode, resp.Body)
+	}
+	h.Admin(t, http.MethodDelete, "/admin/chaos/scoring", "")
+
+	// error replies mean Redis is up, they don't open the breaker
+	h.Admin(t, http.MethodPut, "/admin/chaos/store", `{"errorRate": 1, "error": "reply"}`)
+	for i := 0; i < 3; i++ {
+		if resp := process(); resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("process with the store replying errors: got %d %q, want 500", resp.StatusCode, resp.Body)
+		}
+	}
+	if state := h.Store.Breaker().State(); state != breaker.Closed {
+		t.Errorf("breaker after error replies: got %v, want closed", state)
+	}
+
+	h.Admin(t, http.MethodPut, "/admin/chaos/store", `{"errorRate": 1}`)
+	for i := 0; i < 2; i++ {
+		if resp := process(); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("process with the store dropping connections: got %d %q, want 503", resp.StatusCode, resp.Body)
+		}
+	}
+	if state := h.Store.Breaker().State(); state != breaker.Open {
+		t.Errorf("breaker after dropped connections: got %v, want open", state)
+	}
+	var stats map[string]struct {
+		Fault *struct {
+			Error string `json:"error"`
+		} `json:"fault"`
+		Failed int `json:"failed"`
+	}
+	resp := h.Admin(t, http.MethodGet, "/admin/chaos", "")
+	if err := json.Unmarshal([]byte(resp.Body), &stats); err != nil || stats["store"].Fault == nil ||
+		stats["store"].Fault.Error != "connection" || stats["store"].Failed == 0 || stats["scoring"].Failed != 1 {
+		t.Errorf("chaos stats: got %q, %v", resp.Body, err)
+	}
+
+	if resp := h.Admin(t, http.MethodDelete, "/admin/chaos", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("clearing faults: got %d", resp.StatusCode)
+	}
+	time.Sleep(60 * time.Millisecond)
+	processReceipt(t, h, testutil.TargetReceipt)
+}
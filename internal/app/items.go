@@ -0,0 +1,299 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+)
+
+// receipts with up to this many items keep them in memory (and stored raw, so they can
+// be recalculated). bigger ones are only scored as they stream past
+const maxRetainedItems = 1000
+
+var errTooManyItems = errors.New("too many items")
+
+// itemTally is everything scoring needs from a receipt's items, folded in one item at
+// a time so warehouse sized receipts never have to sit in memory whole. It only holds
+// for the rules and campaigns it was folded with.
+type itemTally struct {
+	ruleSet   *rules.RuleSet
+	campaigns []db.Campaign
+
+	// count is the item lines, units what the rules count as items: the lines again, or
+	// their quantities when the rules count units
+	count             int
+	units             int
+	descriptionPoints int
+	// items matching each campaign's category, in the order of campaigns
+	categoryItems []int
+}
+
+func newItemTally(ruleSet *rules.RuleSet, campaigns []db.Campaign) *itemTally {
+	return &itemTally{ruleSet: ruleSet, campaigns: campaigns, categoryItems: make([]int, len(campaigns))}
+}
+
+func (t *itemTally) add(it item) {
+	units := 1
+	if t.ruleSet.ItemQuantityMode == rules.ItemQuantityUnit {
+		units = it.units()
+	}
+	t.count++
+	t.units += units
+	t.descriptionPoints += itemDescriptionPoints(it, t.ruleSet)
+	for i, c := range t.campaigns {
+		if c.Category != nil && inCategory(it, c.Category.Keywords) {
+			t.categoryItems[i] += units
+		}
+	}
+}
+
+// the most units one item line can be for
+const maxItemQuantity = 100000
+
+// units is how many units the line is for
+func (it item) units() int {
+	if it.Quantity == 0 {
+		return 1
+	}
+	return it.Quantity
+}
+
+// validateItem checks an item's quantity and unit price, and that they agree with its
+// price. A price that doesn't parse isn't an error, the item just earns nothing for it
+func validateItem(it item) error {
+	if it.Quantity < 0 || it.Quantity > maxItemQuantity {
+		return fmt.Errorf("quantity must be between 1 and %d, got %d", maxItemQuantity, it.Quantity)
+	}
+	if it.UnitPrice == "" {
+		return nil
+	}
+	unit, err := parseDollarAsStringInput(it.UnitPrice)
+	if err != nil {
+		return fmt.Errorf("unitPrice: %v", err)
+	}
+	if it.Price == "" {
+		return nil
+	}
+	if line, err := parseDollarAsStringInput(it.Price); err == nil && math.Abs(unit*float64(it.units())-line) >= 0.005 {
+		return fmt.Errorf("price %s isn't %d times unitPrice %s", it.Price, it.units(), it.UnitPrice)
+	}
+	return nil
+}
+
+// prices is what the line came to and what one unit of it cost, each worked out from
+// the other when the item only has one
+func (it item) prices() (line, unit float64, err error) {
+	if it.UnitPrice == "" {
+		line, err = parseDollarAsStringInput(it.Price)
+		return line, line / float64(it.units()), err
+	}
+	if unit, err = parseDollarAsStringInput(it.UnitPrice); err != nil {
+		return 0, 0, err
+	}
+	if it.Price == "" {
+		// to the cent, so that 3 x 0.10 is 0.30 like a price given as 0.30
+		return math.Round(unit*float64(it.units())*100) / 100, unit, nil
+	}
+	line, err = parseDollarAsStringInput(it.Price)
+	return line, unit, err
+}
+
+// tallyItems folds items that are already in memory
+func tallyItems(items []item, ruleSet *rules.RuleSet, campaigns []db.Campaign) *itemTally {
+	t := newItemTally(ruleSet, campaigns)
+	for _, it := range items {
+		t.add(it)
+	}
+	return t
+}
+
+// itemDescriptionPoints is what an item earns when its trimmed description length is a
+// multiple of ItemDescriptionMultiple: its price times ItemPriceMultiplier rounded up,
+// for the line or for every unit depending on ItemQuantityMode
+func itemDescriptionPoints(it item, ruleSet *rules.RuleSet) int {
+	if trimmed := strings.Trim(it.ShortDescription, " "); len(trimmed)%ruleSet.ItemDescriptionMultiple != 0 {
+		return 0
+	}
+	// strings.ReplaceAll() in the parser sanitizes the price input
+	line, unit, err := it.prices()
+	if err != nil {
+		logging.Printf(context.Background(), "Error processing Item: %+v. %v", it, err)
+		return 0 // design decision: return error to parent func here or continue?
+	}
+	// per unit every unit's points are rounded up on their own, like separate lines
+	if ruleSet.ItemQuantityMode == rules.ItemQuantityUnit {
+		return it.units() * int(math.Ceil(unit*ruleSet.ItemPriceMultiplier))
+	}
+	return int(math.Ceil(line * ruleSet.ItemPriceMultiplier)) // math.Ceil returns a float
+}
+
+// inCategory reports whether an item's description contains one of the keywords
+func inCategory(it item, keywords []string) bool {
+	description := strings.ToLower(it.ShortDescription)
+	for _, keyword := range keywords {
+		if strings.Contains(description, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("expected %v, got %v", want, tok)
+	}
+	return nil
+}
+
+// decodeReceiptStream decodes a receipt token by token. Items are scored with ruleSet
+// and campaigns as they're read and only kept while there are up to maxRetainedItems
+// of them, more than maxItems fail with errTooManyItems. Field names match case
+// insensitively and unknown fields are skipped, like json.Unmarshal does.
+func decodeReceiptStream(body io.Reader, maxItems int, ruleSet *rules.RuleSet, campaigns []db.Campaign) (receipt, error) {
+	var rec receipt
+	dec := json.NewDecoder(body)
+	if err := expectDelim(dec, '{'); err != nil {
+		return receipt{}, fmt.Errorf("Error decoding receipt: %w", err)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return receipt{}, fmt.Errorf("Error decoding receipt: %w", err)
+		}
+		key, _ := tok.(string)
+		var field *string
+		switch strings.ToLower(key) {
+		case "items":
+			if rec.tally != nil {
+				return receipt{}, errors.New("Error decoding receipt: items given twice")
+			}
+			if rec.Items, rec.tally, err = decodeItemStream(dec, maxItems, ruleSet, campaigns); err != nil {
+				return receipt{}, err
+			}
+			continue
+		case "retailer":
+			field = &rec.Retailer
+		case "purchasedate":
+			field = &rec.PurchaseDate
+		case "purchasetime":
+			field = &rec.PurchaseTime
+		case "total":
+			field = &rec.Total
+		case "userid":
+			field = &rec.UserID
+		case "timezone":
+			field = &rec.Timezone
+		case "tax":
+			field = &rec.Tax
+		case "paymentmethod":
+			field = &rec.PaymentMethod
+		case "discounts":
+			if rec.Discounts, err = decodeDiscountStream(dec); err != nil {
+				return receipt{}, err
+			}
+			continue
+		case "store":
+			if err := dec.Decode(&rec.Store); err != nil {
+				return receipt{}, fmt.Errorf("Error decoding receipt field %q: %w", key, err)
+			}
+			continue
+		default:
+			var skipped json.RawMessage
+			if err := dec.Decode(&skipped); err != nil {
+				return receipt{}, fmt.Errorf("Error decoding receipt field %q: %w", key, err)
+			}
+			continue
+		}
+		if err := dec.Decode(field); err != nil {
+			return receipt{}, fmt.Errorf("Error decoding receipt field %q: %w", key, err)
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return receipt{}, fmt.Errorf("Error decoding receipt: %w", err)
+	}
+	if rec.tally == nil {
+		rec.tally = newItemTally(ruleSet, campaigns)
+	}
+	return rec, nil
+}
+
+// decodeItemStream scores the items array element by element
+func decodeItemStream(dec *json.Decoder, maxItems int, ruleSet *rules.RuleSet, campaigns []db.Campaign) ([]item, *itemTally, error) {
+	tally := newItemTally(ruleSet, campaigns)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error decoding receipt items: %w", err)
+	}
+	if tok == nil { // "items": null, same as no items
+		return nil, tally, nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, nil, fmt.Errorf("Error decoding receipt items: expected an array, got %v", tok)
+	}
+	var items []item
+	for dec.More() {
+		var it item
+		if err := dec.Decode(&it); err != nil {
+			return nil, nil, fmt.Errorf("Error decoding receipt item %d: %w", tally.count+1, err)
+		}
+		it = normalizeItem(it)
+		if err := validateItem(it); err != nil {
+			return nil, nil, fmt.Errorf("Error decoding receipt item %d: %w", tally.count+1, err)
+		}
+		if tally.count == maxItems {
+			return nil, nil, fmt.Errorf("Error decoding receipt items: %w, the limit is %d", errTooManyItems, maxItems)
+		}
+		tally.add(it)
+		if tally.count <= maxRetainedItems {
+			items = append(items, it)
+		} else {
+			items = nil
+		}
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return nil, nil, fmt.Errorf("Error decoding receipt items: %w", err)
+	}
+	return items, tally, nil
+}
+
+// decodeDiscountStream reads the discounts array up to maxDiscounts of them, so a
+// runaway array fails before it's all in memory
+func decodeDiscountStream(dec *json.Decoder) ([]discount, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding receipt discounts: %w", err)
+	}
+	if tok == nil {
+		return nil, nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("Error decoding receipt discounts: expected an array, got %v", tok)
+	}
+	var discounts []discount
+	for dec.More() {
+		if len(discounts) == maxDiscounts {
+			return nil, fmt.Errorf("Error decoding receipt discounts: more than %d", maxDiscounts)
+		}
+		var d discount
+		if err := dec.Decode(&d); err != nil {
+			return nil, fmt.Errorf("Error decoding receipt discount %d: %w", len(discounts)+1, err)
+		}
+		discounts = append(discounts, d)
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return nil, fmt.Errorf("Error decoding receipt discounts: %w", err)
+	}
+	return discounts, nil
+}
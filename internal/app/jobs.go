@@ -0,0 +1,44 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/jobs"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/go-chi/chi"
+)
+
+type listJobsResponse struct {
+	Jobs []jobs.Status `json:"jobs"`
+}
+
+// writeJobAccepted answers 202 pointing the client at the job's status
+func (a *App) writeJobAccepted(w http.ResponseWriter, r *http.Request, status jobs.Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/admin/jobs/"+status.ID)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+func (a *App) ListJobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(listJobsResponse{Jobs: a.Jobs.List()}); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+func (a *App) GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	status, ok := a.Jobs.Get(chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, "No job found for that id", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
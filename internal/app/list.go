@@ -0,0 +1,150 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+type listedReceipt struct {
+	ID           string `json:"id"`
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	Points       int    `json:"points"`
+}
+
+type listReceiptsResponse struct {
+	Receipts   []listedReceipt `json:"receipts"`
+	NextCursor string          `json:"nextCursor,omitempty"`
+}
+
+func parseOptionalIntParam(r *http.Request, name string) (*int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return nil, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", name, err)
+	}
+	return &v, nil
+}
+
+func parseOptionalDateParam(r *http.Request, name string) (string, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return "", nil
+	}
+	if _, err := time.Parse("2006-01-02", raw); err != nil {
+		return "", fmt.Errorf("Error parsing %s: %v", name, err)
+	}
+	return raw, nil
+}
+
+func parseListFilter(r *http.Request) (db.ListFilter, error) {
+	filter := db.ListFilter{
+		Retailer: r.URL.Query().Get("retailer"),
+		Cursor:   r.URL.Query().Get("cursor"),
+		Limit:    defaultListLimit,
+	}
+	limit, err := parseOptionalIntParam(r, "limit")
+	if err != nil {
+		return db.ListFilter{}, err
+	}
+	if limit != nil {
+		if *limit < 1 || *limit > maxListLimit {
+			return db.ListFilter{}, fmt.Errorf("Error parsing limit: must be between 1 and %d", maxListLimit)
+		}
+		filter.Limit = *limit
+	}
+	if filter.FromDate, err = parseOptionalDateParam(r, "from"); err != nil {
+		return db.ListFilter{}, err
+	}
+	if filter.ToDate, err = parseOptionalDateParam(r, "to"); err != nil {
+		return db.ListFilter{}, err
+	}
+	if filter.MinPoints, err = parseOptionalIntParam(r, "minPoints"); err != nil {
+		return db.ListFilter{}, err
+	}
+	if filter.MaxPoints, err = parseOptionalIntParam(r, "maxPoints"); err != nil {
+		return db.ListFilter{}, err
+	}
+	return filter, nil
+}
+
+func (a *App) ListReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseListFilter(r)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgQueryInvalid)
+		return
+	}
+	a.listReceipts(w, r, filter)
+}
+
+// SearchReceiptsHandler finds receipts by retailer however it was spelled: ?retailer= is
+// resolved through the retailer registry like submissions are and matched against what
+// receipts are counted under, their retailer id or their normalized retailer when the
+// registry didn't know it. The other parameters work like the listing's, receipts come
+// newest purchase first when searching by retailer or date.
+func (a *App) SearchReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseListFilter(r)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgQueryInvalid)
+		return
+	}
+	if filter.Retailer != "" {
+		filter.CanonicalRetailer = a.retailers(r.Context()).resolve(filter.Retailer)
+		if filter.CanonicalRetailer == "" {
+			filter.CanonicalRetailer = db.NormalizeRetailer(filter.Retailer)
+		}
+		filter.Retailer = ""
+	}
+	a.listReceipts(w, r, filter)
+}
+
+func (a *App) listReceipts(w http.ResponseWriter, r *http.Request, filter db.ListFilter) {
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	records, nextCursor, err := a.store(ctx).ListReceipts(ctx, filter)
+	if err != nil {
+		logging.Printf(r.Context(), "Error listing receipts: %v", err)
+		if errors.Is(err, db.ErrInvalidCursor) {
+			writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgQueryInvalid)
+			return
+		}
+		a.writeReceiptError(w, r, err)
+		return
+	}
+
+	responseToClient := listReceiptsResponse{
+		Receipts:   make([]listedReceipt, 0, len(records)),
+		NextCursor: nextCursor,
+	}
+	for _, rec := range records {
+		responseToClient.Receipts = append(responseToClient.Receipts, listedReceipt{
+			ID:           rec.ID,
+			Retailer:     rec.Retailer,
+			PurchaseDate: rec.PurchaseDate,
+			Points:       rec.Points,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, msgInternal)
+	}
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// POS artifacts in item descriptions: SKU, UPC or PLU codes at either end, and the tax
+// flag column at the end. Single letter flags only count when they're column aligned
+// (two or more spaces or a tab away), so "Vitamin A" keeps its A.
+var (
+	leadingSKU  = regexp.MustCompile(`^(?:(?i:sku|upc|plu)\s*[:#]?\s*\d{4,14}|#\d{4,14}|\d{8,14})\s+`)
+	trailingSKU = regexp.MustCompile(`\s+(?:(?i:sku|upc|plu)\s*[:#]?\s*\d{4,14}|#\d{4,14}|\d{8,14})$`)
+	taxFlag     = regexp.MustCompile(`(?:\s+TF|(?:\s{2,}|\t)[ABFNTX])$`)
+)
+
+// normalizeText is s in canonical form: NFC, so a precomposed é and an e with a
+// combining accent are the same, with every run of whitespace collapsed to one space
+// and none around it
+func normalizeText(s string) string {
+	return strings.Join(strings.FieldsFunc(norm.NFC.String(s), unicode.IsSpace), " ")
+}
+
+// normalizeDescription is normalizeText for an item description, with what the POS
+// printed around the product name stripped first
+func normalizeDescription(s string) string {
+	s = norm.NFC.String(s)
+	for {
+		stripped := leadingSKU.ReplaceAllString(s, "")
+		stripped = trailingSKU.ReplaceAllString(stripped, "")
+		stripped = taxFlag.ReplaceAllString(stripped, "")
+		if stripped == s {
+			return normalizeText(s)
+		}
+		s = stripped
+	}
+}
+
+func normalizeItem(it item) item {
+	it.ShortDescription = normalizeDescription(it.ShortDescription)
+	return it
+}
+
+// normalizeReceipt puts the free text of a receipt in canonical form before it's scored
+// and stored, so receipts that look the same score the same and are the same
+// duplicate. Case is kept for display, everything comparing names ignores it. Every
+// step is idempotent, normalizing twice changes nothing.
+func normalizeReceipt(rec *receipt) {
+	rec.Retailer = normalizeText(rec.Retailer)
+	rec.PaymentMethod = normalizeText(rec.PaymentMethod)
+	// copies, the receipt may share them with its caller
+	rec.Items = slices.Clone(rec.Items)
+	for i := range rec.Items {
+		rec.Items[i] = normalizeItem(rec.Items[i])
+	}
+	rec.Discounts = slices.Clone(rec.Discounts)
+	for i := range rec.Discounts {
+		rec.Discounts[i].Description = normalizeText(rec.Discounts[i].Description)
+	}
+	if s := rec.Store; s != nil {
+		normalized := storeLocation{
+			ID:         normalizeText(s.ID),
+			Address:    normalizeText(s.Address),
+			City:       normalizeText(s.City),
+			Region:     normalizeText(s.Region),
+			PostalCode: normalizeText(s.PostalCode),
+			Country:    normalizeText(s.Country),
+		}
+		rec.Store = &normalized
+	}
+}
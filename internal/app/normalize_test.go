@@ -0,0 +1,24 @@
+package app
+
+import "testing"
+
+func TestNormalizeDescription(t *testing.T) {
+	for in, want := range map[string]string{
+		"  Klarbrunn 12-PK 12 FL OZ  ":       "Klarbrunn 12-PK 12 FL OZ",
+		"Pe\u0301rrier   Water":              "Pérrier Water",
+		"SKU 0012345 Mountain Dew 12PK TF":   "Mountain Dew 12PK",
+		"012345678905 Emils Cheese Pizza\tA": "Emils Cheese Pizza",
+		"Knorr Creamy Chicken  B #4011":      "Knorr Creamy Chicken",
+		"UPC:049000050103 Coke":              "Coke",
+		"Vitamin A":                          "Vitamin A",
+		"7UP 12PK":                           "7UP 12PK",
+		"Doritos Nacho Cheese  X":            "Doritos Nacho Cheese",
+	} {
+		if got := normalizeDescription(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+		if got := normalizeDescription(want); got != want {
+			t.Errorf("%q normalized again: got %q", want, got)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/outbox"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+// deferSave puts receipts the store failed to save in the outbox when the failure was
+// the store being unavailable, and reports whether it did. The caller then carries on
+// as if they had been saved. design decision: only outages are deferred, anything else
+// (a bad record, the store's write queue being full) fails the request like before
+func (a *App) deferSave(ctx context.Context, saveErr error, recs ...db.ReceiptRecord) bool {
+	if a.Outbox == nil || !isStoreUnavailable(saveErr) {
+		return false
+	}
+	if err := a.Outbox.Add(tenant.FromContext(ctx).ID, recs, a.now()); err != nil {
+		logging.Printf(ctx, "Error queueing %d receipts in the outbox: %v", len(recs), err)
+		return false
+	}
+	logging.Warnf(ctx, "Store unavailable, queued %d receipts in the outbox: %v", len(recs), saveErr)
+	return true
+}
+
+// degraded reports whether DEGRADED_MODE has a receipt taken without the store when
+// err is what the store answered
+func (a *App) degraded(err error) bool {
+	return a.Config.DegradedMode && a.Outbox != nil && isStoreUnavailable(err)
+}
+
+// deferProvisional puts receipts in the outbox that were taken while the store was down,
+// before it could screen them (against the others, with fingerprints lining up with
+// recs) or count them against the quota. That's done when they're flushed.
+func (a *App) deferProvisional(ctx context.Context, recs []db.ReceiptRecord, fingerprints []string) error {
+	if err := a.Outbox.AddProvisional(tenant.FromContext(ctx).ID, recs, fingerprints, a.now()); err != nil {
+		return fmt.Errorf("%w: Error queueing provisional receipts: %v", db.ErrUnavailable, err)
+	}
+	logging.Warnf(ctx, "Store unavailable, took %d receipts as provisional", len(recs))
+	return nil
+}
+
+// provisional reports whether the receipt with the id is still waiting in the outbox,
+// so its points and status aren't settled yet
+func (a *App) provisional(ctx context.Context, id string) bool {
+	if a.Outbox == nil {
+		return false
+	}
+	_, ok := a.Outbox.Pending(tenant.FromContext(ctx).ID, id)
+	return ok
+}
+
+// getReceipt is the tenant's receipt with the id, from the receipt cache when it's
+// there and from the outbox while it's waiting there. For reads only, writes need the
+// receipt as it is in the store.
+func (a *App) getReceipt(ctx context.Context, id string) (db.ReceiptRecord, error) {
+	stored, _, err := a.lookupReceipt(ctx, id)
+	return stored, err
+}
+
+// lookupReceipt is getReceipt, also reporting whether the receipt came from the outbox
+func (a *App) lookupReceipt(ctx context.Context, id string) (db.ReceiptRecord, bool, error) {
+	if cached, ok := a.cachedReceipt(ctx, id); ok {
+		return cached, false, nil
+	}
+	stored, err := a.store(ctx).GetReceipt(ctx, id)
+	if err == nil {
+		a.cacheReceipt(ctx, stored)
+	}
+	if err != nil && a.Outbox != nil && (errors.Is(err, db.ErrNotFound) || isStoreUnavailable(err)) {
+		if pending, ok := a.Outbox.Get(tenant.FromContext(ctx).ID, id); ok {
+			return pending, true, nil
+		}
+	}
+	return stored, false, err
+}
+
+// saveFromOutbox saves an outbox entry unless the store has the receipt already, which
+// it does when the save that failed went through after all or a flush got cut off.
+// Saving it again would credit its user twice. Provisional receipts are screened and
+// counted against the quota first, as of when they were taken, and announced once
+// they're saved. Usage is counted as of when receipts were taken too, though not
+// under the API key they came with, the outbox doesn't keep it.
+func (a *App) saveFromOutbox(ctx context.Context, e outbox.Entry) (bool, error) {
+	ctx, cancel := context.WithTimeout(a.tenantContext(ctx, e.Tenant), a.config().DbTimeoutInMs)
+	defer cancel()
+	store := a.store(ctx)
+	_, err := store.GetReceipt(ctx, e.Record.ID)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return false, err
+	}
+	if !e.Provisional {
+		if err := store.SaveReceipt(ctx, e.Record); err != nil {
+			return false, fmt.Errorf("Error saving receipt %s from the outbox: %w", e.Record.ID, err)
+		}
+		a.recordUsage(ctx, e.QueuedAt, 1, awardedPoints(e.Record))
+		a.recordFlags(ctx, e.QueuedAt, e.Record)
+		return true, nil
+	}
+
+	rec := e.Record
+	var claim screening
+	if e.Fingerprint != "" && a.config().FraudScreening {
+		if claim, err = a.screenAgainstStore(ctx, e.Fingerprint, &rec, e.QueuedAt); err != nil {
+			return false, fmt.Errorf("Error screening provisional receipt %s: %w", rec.ID, err)
+		}
+	}
+	// the quota doesn't turn it away anymore, it was taken
+	if err := a.takeQuota(ctx, e.QueuedAt, 1); err != nil {
+		a.releaseScreening(ctx, claim)
+		return false, fmt.Errorf("Error counting provisional receipt %s against the quota: %w", rec.ID, err)
+	}
+	if err := store.SaveReceipt(ctx, rec); err != nil {
+		a.releaseScreening(ctx, claim)
+		a.handBackQuota(ctx, quotas(ctx, e.QueuedAt), 1)
+		return false, fmt.Errorf("Error saving receipt %s from the outbox: %w", rec.ID, err)
+	}
+	a.recordUsage(ctx, e.QueuedAt, 1, awardedPoints(rec))
+	a.recordFlags(ctx, e.QueuedAt, rec)
+	a.announceReceipt(ctx, rec)
+	return true, nil
+}
+
+// tenantContext is ctx acting for the tenant with the id. One removed from the tenants
+// file since still gets its data written, with the default settings.
+func (a *App) tenantContext(ctx context.Context, id string) context.Context {
+	t, ok := tenant.Default, id == ""
+	if !ok && a.Tenants != nil {
+		t, ok = a.Tenants.Get(id)
+	}
+	if !ok {
+		t = &tenant.Tenant{ID: id}
+	}
+	return tenant.NewContext(ctx, t)
+}
+
+// flushOutbox saves what's waiting in the outbox, oldest first, until the store fails
+func (a *App) flushOutbox(ctx context.Context) error {
+	if a.Outbox.Len() == 0 {
+		return nil
+	}
+	flushed, err := a.Outbox.Flush(ctx, a.saveFromOutbox)
+	if flushed > 0 {
+		logging.Printf(ctx, "Flushed %d receipts from the outbox, %d left", flushed, a.Outbox.Len())
+	}
+	return err
+}
+
+// StartOutboxFlusher flushes the outbox right away, for what a previous run left in
+// it, and then every interval until ctx is done
+func (a *App) StartOutboxFlusher(ctx context.Context, interval time.Duration) {
+	if a.Outbox == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := a.flushOutbox(ctx); err != nil && ctx.Err() == nil {
+				logging.Printf(ctx, "Error flushing the outbox, trying again in %s: %v", interval, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
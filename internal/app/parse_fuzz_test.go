@@ -0,0 +1,185 @@
+package app
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+	"github.com/jayreddy040-510/receipt_processor/pkg/receiptpb"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// what parseDollarAsStringInput is meant to accept: whole dollars or dollars and cents,
+// commas only as thousands separators
+var wellFormedDollarAmt = regexp.MustCompile(`^(\d+|\d{1,3}(,\d{3})+)(\.\d{2})?$`)
+
+var fuzzNow = time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+
+func FuzzParseDollarAsStringInput(f *testing.F) {
+	for _, seed := range []string{
+		"35.35", "9.00", "0.25", "36", "05.01", "1,234.56", "1,234,567", "",
+		".", ".25", "1.", "1.2", "1.234", "1.2.3", "1..23", "-1.00", "+1.00", "1e5",
+		",", "1,2,3.45", "12,34.56", ",123.45", "1,234,", "١٢.٣٤", "NaN", "Inf",
+		"99999999999999999999999999.99", " 1.00", "1.00 ",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, amt string) {
+		got, err := parseDollarAsStringInput(amt)
+		wellFormed := wellFormedDollarAmt.MatchString(amt)
+		if err != nil {
+			if wellFormed && len(strings.TrimLeft(strings.SplitN(amt, ".", 2)[0], "0,")) <= maxDollarAmtDigits {
+				t.Fatalf("rejected %q: %v", amt, err)
+			}
+			return
+		}
+		if !wellFormed {
+			t.Fatalf("accepted malformed %q as %v", amt, got)
+		}
+		want, _ := strconv.ParseFloat(strings.ReplaceAll(amt, ",", ""), 64)
+		if got != want || got < 0 || got >= maxDollarAmt {
+			t.Fatalf("parsed %q as %v, want %v", amt, got, want)
+		}
+	})
+}
+
+func FuzzParseDateAsStringInput(f *testing.F) {
+	for _, seed := range []string{
+		"2022-01-01", "2024-01-15", "2024-01-16", "2022-13-01", "2022-02-30", "2022-1-1",
+		"22-01-01", "0000-01-01", "9999-12-31", "2022-01-01 ", " 2022-01-01", "2022-01-01T00:00:00Z", "",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, date string) {
+		day, err := parseDateAsStringInput(date, time.UTC, fuzzNow)
+		if err != nil {
+			return
+		}
+		parsed, parseErr := time.Parse("2006-01-02", date)
+		if parseErr != nil || parsed.Format("2006-01-02") != date {
+			t.Fatalf("accepted %q, which isn't a YYYY-MM-DD date", date)
+		}
+		if parsed.After(fuzzNow) {
+			t.Fatalf("accepted %q, which is after %v", date, fuzzNow)
+		}
+		if day != parsed.Day() {
+			t.Fatalf("got day %d for %q", day, date)
+		}
+	})
+}
+
+func FuzzParseTimeAsStringInput(f *testing.F) {
+	for _, seed := range []struct{ time, date string }{
+		{"13:01", "2022-01-01"}, {"00:00", "2022-01-01"}, {"23:59", "2022-01-01"}, {"24:00", "2022-01-01"},
+		{"12:60", "2022-01-01"}, {"1:01", "2022-01-01"}, {" 13:01", "2022-01-01"}, {"13:01 ", "2022-01-01"},
+		{"13:01:00", "2022-01-01"}, {"12:30", "2024-01-15"}, {"11:59", "2024-01-15"}, {"01", "2022-01-01 13:"},
+		{"", "2022-01-01 13:01"}, {"1pm", "2022-01-01"},
+	} {
+		f.Add(seed.time, seed.date)
+	}
+	f.Fuzz(func(t *testing.T, timeString, date string) {
+		got, err := parseTimeAsStringInput(timeString, date, time.UTC, fuzzNow)
+		if err != nil {
+			return
+		}
+		if got.Format("15:04") != timeString || got.Format("2006-01-02") != date {
+			t.Fatalf("accepted time %q on %q as %v", timeString, date, got)
+		}
+		if got.After(fuzzNow) {
+			t.Fatalf("accepted %v, which is after %v", got, fuzzNow)
+		}
+	})
+}
+
+const fuzzMaxItems = 50
+
+var fuzzReceiptSeeds = []string{
+	`{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[{"shortDescription":"Mountain Dew 12PK","price":"6.49"}],"total":"6.49"}`,
+	`{"retailer":"M&M Corner Market","purchaseDate":"2022-03-20","purchaseTime":"14:33","items":[{"shortDescription":"Gatorade","price":"2.25"},{"shortDescription":"Gatorade","price":"2.25"}],"total":"4.50","timezone":"America/Chicago","userId":"u1"}`,
+	`{"RETAILER":"a","items":null,"extra":{"nested":[1,2,{"x":null}]},"total":"1"}`,
+	`{"items":[],"items":[]}`,
+	`{"items":{}}`,
+	`{"items":[1]}`,
+	`{"total":1.5}`,
+	`{"retailer":"a"`,
+	`[]`,
+	``,
+	`{"retailer":"a"}{"retailer":"b"}`,
+	`{"timezone":"Local","purchaseDate":"2022-01-01","purchaseTime":"13:01","total":"1.00"}`,
+}
+
+func FuzzDecodeReceiptStream(f *testing.F) {
+	for _, seed := range fuzzReceiptSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		checkDecodedReceipt(t, jsonCodec{}, body)
+	})
+}
+
+func FuzzDecodeXMLReceipt(f *testing.F) {
+	for _, seed := range []string{
+		`<receipt><retailer>Target</retailer><purchaseDate>2022-01-01</purchaseDate><purchaseTime>13:01</purchaseTime><items><item><shortDescription>Pepsi</shortDescription><price>1.25</price></item></items><total>1.25</total></receipt>`,
+		`<?xml version="1.0"?><!-- c --><receipt><Retailer>a</Retailer><extra><x/></extra><items/></receipt>`,
+		`<receipt><items></items><items></items></receipt>`,
+		`<receipt><items><order/></items></receipt>`,
+		`<receipt><total><b>1</b></total></receipt>`,
+		`<receipt>`,
+		`<order/>`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		checkDecodedReceipt(t, xmlCodec{}, body)
+	})
+}
+
+func FuzzDecodeProtobufReceipt(f *testing.F) {
+	for _, seed := range []*receiptpb.Receipt{
+		{Retailer: "Target", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Total: "1.25", Items: []*receiptpb.Item{{ShortDescription: "Pepsi", Price: "1.25"}}},
+		{Items: []*receiptpb.Item{{Quantity: -1}, {}}, Discounts: []*receiptpb.Discount{{}}, Store: &receiptpb.Store{}},
+		{},
+	} {
+		body, err := proto.Marshal(seed)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(body)
+	}
+	// an items field that isn't length prefixed, a truncated one and an invalid tag
+	f.Add([]byte{0x20, 0x01})
+	f.Add([]byte{0x22, 0x05, 0x0a})
+	f.Add([]byte{0x00})
+	f.Fuzz(func(t *testing.T, body []byte) {
+		checkDecodedReceipt(t, protobufCodec{}, body)
+	})
+}
+
+// checkDecodedReceipt decodes and scores body, neither of which may panic, and checks
+// what a decoded receipt promises the rest of the pipeline
+func checkDecodedReceipt(t *testing.T, enc codec, body []byte) {
+	ruleSet := rules.Default()
+	rec, err := enc.decodeReceipt(bytes.NewReader(body), fuzzMaxItems, ruleSet, nil)
+	if err != nil {
+		return
+	}
+	if rec.tally == nil {
+		t.Fatal("decoded receipt has no item tally")
+	}
+	if rec.tally.count > fuzzMaxItems {
+		t.Fatalf("decoded %d items, the limit is %d", rec.tally.count, fuzzMaxItems)
+	}
+	if !rec.hasAllItems() {
+		t.Fatalf("kept %d of %d items from a receipt under maxRetainedItems", len(rec.Items), rec.tally.count)
+	}
+	points, _, err := calculateAllPoints(rec, ruleSet, nil, fuzzNow)
+	if err == nil && points < 0 {
+		t.Fatalf("scored %d points", points)
+	}
+}
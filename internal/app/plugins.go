@@ -0,0 +1,46 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+)
+
+// pluginInput is what a rule plugin gets on its stdin
+type pluginInput struct {
+	Receipt receipt `json:"receipt"`
+	// how many items the receipt has, receipts too big to keep their items only come
+	// with the first ones
+	ItemCount int `json:"itemCount"`
+	// the receipt's points so far, from the built-in rules and the plugins before
+	Points       int    `json:"points"`
+	RulesVersion string `json:"rulesVersion"`
+}
+
+// applyPlugins runs the rule set's plugins on a receipt, one after the other, adding a
+// breakdown line for every delta they answer with. A plugin failing fails the scoring,
+// skipping it would score the same receipt differently from one try to the next.
+func applyPlugins(points *breakdown, rec receipt, ruleSet *rules.RuleSet) error {
+	for _, name := range ruleSet.Plugins {
+		input, err := json.Marshal(pluginInput{
+			Receipt:      rec,
+			ItemCount:    rec.itemCount(),
+			Points:       points.total(),
+			RulesVersion: ruleSet.Version,
+		})
+		if err != nil {
+			return fmt.Errorf("Error encoding receipt for rule plugin %s: %v", name, err)
+		}
+		// plugins have a timeout of their own, scoring doesn't get the request's context
+		deltas, err := ruleSet.PluginRunner().Run(context.Background(), name, input)
+		if err != nil {
+			return err
+		}
+		for _, d := range deltas {
+			points.add("plugin."+name, d.Detail, d.Points)
+		}
+	}
+	return nil
+}
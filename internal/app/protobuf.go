@@ -0,0 +1,170 @@
+package app
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+	"github.com/jayreddy040-510/receipt_processor/pkg/receiptpb"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// the most bytes one encoded item can take, and everything but the items together
+	maxProtobufItemBytes   = 64 << 10
+	maxProtobufFieldsBytes = 1 << 20
+)
+
+// the items field of receiptpb.Receipt, the one decodeProtobufReceipt streams
+var protobufItemsField = (&receiptpb.Receipt{}).ProtoReflect().Descriptor().Fields().ByName("items").Number()
+
+// protobufCodec takes receiptpb.Receipt bodies (pkg/receiptpb/receipt.proto), for POS
+// gateways submitting more receipts than they want to spend serializing JSON for.
+// Responses are never protobuf, responseCodec only picks JSON or XML.
+type protobufCodec struct{}
+
+func (protobufCodec) contentType() string { return "application/x-protobuf" }
+
+func (protobufCodec) decodeReceipt(body io.Reader, maxItems int, ruleSet *rules.RuleSet, campaigns []db.Campaign) (receipt, error) {
+	return decodeProtobufReceipt(body, maxItems, ruleSet, campaigns)
+}
+
+func (protobufCodec) encode(v interface{}, use func([]byte)) error {
+	return errors.New("protobuf responses aren't supported")
+}
+
+func isProtobufMediaType(mediaType string) bool {
+	return mediaType == "application/x-protobuf" || mediaType == "application/protobuf"
+}
+
+// decodeProtobufReceipt is decodeReceiptStream for protobuf. The wire format lets the
+// items come one field at a time, so they're unmarshalled and scored as they stream in
+// and everything else is set aside and unmarshalled once the body ends.
+func decodeProtobufReceipt(body io.Reader, maxItems int, ruleSet *rules.RuleSet, campaigns []db.Campaign) (receipt, error) {
+	r := bufio.NewReader(body)
+	tally := newItemTally(ruleSet, campaigns)
+	var (
+		items  []item
+		fields []byte
+	)
+	for {
+		tag, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return receipt{}, fmt.Errorf("Error decoding receipt: %w", err)
+		}
+		if tag>>3 < uint64(protowire.MinValidNumber) || tag>>3 > uint64(protowire.MaxValidNumber) {
+			return receipt{}, fmt.Errorf("Error decoding receipt: invalid field number %d", tag>>3)
+		}
+		num, typ := protowire.Number(tag>>3), protowire.Type(tag&7)
+		if num == protobufItemsField && typ == protowire.BytesType {
+			b, err := readProtobufBytes(r, maxProtobufItemBytes)
+			if err != nil {
+				return receipt{}, fmt.Errorf("Error decoding receipt item %d: %w", tally.count+1, err)
+			}
+			var decoded receiptpb.Item
+			if err := proto.Unmarshal(b, &decoded); err != nil {
+				return receipt{}, fmt.Errorf("Error decoding receipt item %d: %w", tally.count+1, err)
+			}
+			it := normalizeItem(item{
+				ShortDescription: decoded.ShortDescription,
+				Price:            decoded.Price,
+				Quantity:         int(decoded.Quantity),
+				UnitPrice:        decoded.UnitPrice,
+			})
+			if err := validateItem(it); err != nil {
+				return receipt{}, fmt.Errorf("Error decoding receipt item %d: %w", tally.count+1, err)
+			}
+			if tally.count == maxItems {
+				return receipt{}, fmt.Errorf("Error decoding receipt items: %w, the limit is %d", errTooManyItems, maxItems)
+			}
+			tally.add(it)
+			if tally.count <= maxRetainedItems {
+				items = append(items, it)
+			} else {
+				items = nil
+			}
+			continue
+		}
+		fields = protowire.AppendTag(fields, num, typ)
+		switch typ {
+		case protowire.VarintType:
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				return receipt{}, fmt.Errorf("Error decoding receipt field %d: %w", num, err)
+			}
+			fields = protowire.AppendVarint(fields, v)
+		case protowire.Fixed32Type, protowire.Fixed64Type:
+			n := 4
+			if typ == protowire.Fixed64Type {
+				n = 8
+			}
+			var b [8]byte
+			if _, err := io.ReadFull(r, b[:n]); err != nil {
+				return receipt{}, fmt.Errorf("Error decoding receipt field %d: %w", num, err)
+			}
+			fields = append(fields, b[:n]...)
+		case protowire.BytesType:
+			b, err := readProtobufBytes(r, maxProtobufFieldsBytes-len(fields))
+			if err != nil {
+				return receipt{}, fmt.Errorf("Error decoding receipt field %d: %w", num, err)
+			}
+			fields = protowire.AppendBytes(fields, b)
+		default:
+			return receipt{}, fmt.Errorf("Error decoding receipt field %d: unsupported wire type %d", num, typ)
+		}
+		if len(fields) > maxProtobufFieldsBytes {
+			return receipt{}, fmt.Errorf("Error decoding receipt: more than %d bytes besides the items", maxProtobufFieldsBytes)
+		}
+	}
+	var decoded receiptpb.Receipt
+	if err := proto.Unmarshal(fields, &decoded); err != nil {
+		return receipt{}, fmt.Errorf("Error decoding receipt: %w", err)
+	}
+	rec := receipt{
+		Retailer:      decoded.Retailer,
+		PurchaseDate:  decoded.PurchaseDate,
+		PurchaseTime:  decoded.PurchaseTime,
+		Items:         items,
+		Total:         decoded.Total,
+		UserID:        decoded.UserId,
+		Timezone:      decoded.Timezone,
+		Tax:           decoded.Tax,
+		PaymentMethod: decoded.PaymentMethod,
+		tally:         tally,
+	}
+	if len(decoded.Discounts) > maxDiscounts {
+		return receipt{}, fmt.Errorf("Error decoding receipt discounts: more than %d", maxDiscounts)
+	}
+	for _, d := range decoded.Discounts {
+		rec.Discounts = append(rec.Discounts, discount{Description: d.Description, Amount: d.Amount})
+	}
+	if s := decoded.Store; s != nil {
+		rec.Store = &storeLocation{ID: s.Id, Address: s.Address, City: s.City, Region: s.Region, PostalCode: s.PostalCode, Country: s.Country}
+	}
+	return rec, nil
+}
+
+// readProtobufBytes reads a length prefixed field of at most limit bytes
+func readProtobufBytes(r *bufio.Reader, limit int) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if limit < 0 || n > uint64(limit) {
+		return nil, fmt.Errorf("%d bytes, the limit is %d", n, limit)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,188 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/jobs"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+const (
+	recalculatePageSize = 100
+	// the report lists every changed receipt up to this many, counts are always complete
+	maxReportedChanges = 1000
+)
+
+var errNoRawReceipt = errors.New("receipt was stored without its raw contents")
+
+// rescoreRecord scores a stored receipt again from its raw contents. Everything that
+// identifies the receipt (id, creation time) is kept, so is its retailer id: it's
+// resolved again when the receipt is corrected, not when the rules change.
+func rescoreRecord(stored db.ReceiptRecord, ruleSet *rules.RuleSet, campaigns []db.Campaign, now time.Time) (db.ReceiptRecord, error) {
+	if len(stored.Receipt) == 0 {
+		return db.ReceiptRecord{}, errNoRawReceipt
+	}
+	var rec receipt
+	if err := json.Unmarshal(stored.Receipt, &rec); err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error decoding stored receipt: %v", err)
+	}
+	rec.retailerID = stored.RetailerID
+	pointsTotal, points, err := calculateAllPoints(rec, ruleSet, campaigns, now)
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error calculating receipt points: %v", err)
+	}
+	rescored := stored
+	rescored.Points = pointsTotal
+	rescored.Breakdown = points
+	rescored.RulesVersion = ruleSet.Version
+	return rescored, nil
+}
+
+type recalculateRequest struct {
+	Retailer string `json:"retailer"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+type recalculateCounts struct {
+	Scanned   int `json:"scanned"`
+	Updated   int `json:"updated"`
+	Changed   int `json:"changed"`
+	Unchanged int `json:"unchanged"`
+	// stored before raw receipts were kept, they can't be rescored
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+type pointsChange struct {
+	ID              string `json:"id"`
+	OldPoints       int    `json:"oldPoints"`
+	NewPoints       int    `json:"newPoints"`
+	OldRulesVersion string `json:"oldRulesVersion,omitempty"`
+}
+
+type recalculateReport struct {
+	RulesVersion string `json:"rulesVersion"`
+	recalculateCounts
+	Changes          []pointsChange `json:"changes"`
+	ChangesTruncated bool           `json:"changesTruncated,omitempty"`
+}
+
+func parseRecalculateFilter(r *http.Request) (db.ListFilter, error) {
+	var req recalculateRequest
+	// no body at all means every receipt
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return db.ListFilter{}, fmt.Errorf("Error decoding recalculate request: %v", err)
+	}
+	for _, date := range []string{req.From, req.To} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return db.ListFilter{}, fmt.Errorf("Error parsing date filter: %v", err)
+		}
+	}
+	return db.ListFilter{
+		Retailer: req.Retailer,
+		FromDate: req.From,
+		ToDate:   req.To,
+		Limit:    recalculatePageSize,
+	}, nil
+}
+
+// RecalculateReceiptsHandler starts a background job rescoring the stored receipts
+// matching the filter in the body (retailer, from, to, all optional) with the current
+// rules and campaigns. The job's report has every receipt whose points changed.
+func (a *App) RecalculateReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseRecalculateFilter(r)
+	defer r.Body.Close()
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		http.Error(w, "Invalid recalculate request, expected {\"retailer\", \"from\", \"to\"} (all optional)", http.StatusBadRequest)
+		return
+	}
+	status, err := a.Jobs.Submit("recalculate", forTenant(tenant.FromContext(r.Context()), a.recalculateJob(filter)))
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many jobs queued, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	a.writeJobAccepted(w, r, status)
+}
+
+func (a *App) recalculateJob(filter db.ListFilter) jobs.Func {
+	return func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		// one rule set and campaign list for the whole run, a reload halfway through
+		// would leave receipts scored with two different rule sets
+		ruleSet, campaigns := a.ruleSet(ctx), a.campaigns(ctx)
+		report := &recalculateReport{RulesVersion: ruleSet.Version, Changes: []pointsChange{}}
+		for {
+			dbCtx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+			records, nextCursor, err := a.store(dbCtx).ListReceipts(dbCtx, filter)
+			cancel()
+			if err != nil {
+				return report, fmt.Errorf("Error listing receipts to recalculate: %w", err)
+			}
+
+			var updated []db.ReceiptUpdate
+			for _, stored := range records {
+				report.Scanned++
+				rescored, err := rescoreRecord(stored, ruleSet, campaigns, a.scoringNow())
+				if errors.Is(err, errNoRawReceipt) {
+					report.Skipped++
+					continue
+				} else if err != nil {
+					logging.Printf(ctx, "Error recalculating receipt %s: %v", stored.ID, err)
+					report.Failed++
+					continue
+				}
+				if rescored.Points == stored.Points && rescored.RulesVersion == stored.RulesVersion {
+					report.Unchanged++
+					continue
+				}
+				updated = append(updated, db.ReceiptUpdate{Record: rescored, OldPoints: stored.Points})
+				if rescored.Points == stored.Points {
+					continue
+				}
+				report.Changed++
+				if len(report.Changes) == maxReportedChanges {
+					report.ChangesTruncated = true
+					continue
+				}
+				report.Changes = append(report.Changes, pointsChange{
+					ID:              stored.ID,
+					OldPoints:       stored.Points,
+					NewPoints:       rescored.Points,
+					OldRulesVersion: stored.RulesVersion,
+				})
+			}
+
+			dbCtx, cancel = context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+			err = a.store(dbCtx).UpdateReceipts(dbCtx, updated)
+			cancel()
+			for _, u := range updated {
+				a.forgetReceipts(ctx, u.Record.ID)
+			}
+			if err != nil {
+				return report, fmt.Errorf("Error saving recalculated receipts: %w", err)
+			}
+			report.Updated += len(updated)
+			job.SetProgress(report.recalculateCounts)
+
+			if nextCursor == "" {
+				return report, nil
+			}
+			filter.Cursor = nextCursor
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+// receiptCacheKey scopes ids to the tenant, like the store does
+func receiptCacheKey(ctx context.Context, id string) string {
+	return tenant.FromContext(ctx).ID + "/" + id
+}
+
+// cachedReceipt is the receipt from the cache. Entries expire by the wall clock like
+// the store's TTLs, --fake-now doesn't keep them forever.
+func (a *App) cachedReceipt(ctx context.Context, id string) (db.ReceiptRecord, bool) {
+	return a.ReceiptCache.Get(receiptCacheKey(ctx, id), time.Now())
+}
+
+func (a *App) cacheReceipt(ctx context.Context, rec db.ReceiptRecord) {
+	a.ReceiptCache.Add(receiptCacheKey(ctx, rec.ID), rec, time.Now())
+}
+
+// forgetReceipts drops receipts from the cache after they were changed or removed.
+// design decision: this instance only, other instances serve what they cached until
+// it expires after RECEIPT_CACHE_TTL_IN_MS
+func (a *App) forgetReceipts(ctx context.Context, ids ...string) {
+	for _, id := range ids {
+		a.ReceiptCache.Remove(receiptCacheKey(ctx, id))
+	}
+}
@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+const (
+	// clients can send the redemption id as an idempotency key instead of in the body
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	maxRewardLen = 256
+)
+
+type redemptionRequest struct {
+	ID     string `json:"id"`
+	Points int    `json:"points"`
+	Reward string `json:"reward"`
+}
+
+type redemptionsResponse struct {
+	UserID      string          `json:"userId"`
+	Redemptions []db.Redemption `json:"redemptions"`
+}
+
+// authorizedForUser makes sure an authenticated caller only spends (or reads the
+// spending of) their own points. calls without the header come from trusted backends.
+func authorizedForUser(r *http.Request, userID string) bool {
+	caller := r.Header.Get(userIDHeader)
+	return caller == "" || caller == userID
+}
+
+func decodeRedemptionRequest(r *http.Request) (redemptionRequest, error) {
+	var req redemptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return redemptionRequest{}, fmt.Errorf("Error decoding redemption: %v", err)
+	}
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		if req.ID != "" && req.ID != key {
+			return redemptionRequest{}, fmt.Errorf("Redemption id %q doesn't match %s %q", req.ID, idempotencyKeyHeader, key)
+		}
+		req.ID = key
+	}
+	switch {
+	case !isValidUserID(req.ID):
+		return redemptionRequest{}, fmt.Errorf("Invalid redemption id %q", req.ID)
+	case req.Points < 1:
+		return redemptionRequest{}, fmt.Errorf("Redemption points must be positive, got %d", req.Points)
+	case len(req.Reward) > maxRewardLen:
+		return redemptionRequest{}, fmt.Errorf("Reward is longer than %d characters", maxRewardLen)
+	}
+	return req, nil
+}
+
+// RedeemPointsHandler spends points from a user's balance. The redemption id makes it
+// safe to retry: repeating a redemption returns the original one (200 instead of 201)
+// without spending twice.
+func (a *App) RedeemPointsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "id")
+	if !isValidUserID(userID) {
+		writeError(w, r, http.StatusNotFound, codeUserNotFound, msgUserNotFound)
+		return
+	}
+	if !authorizedForUser(r, userID) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, msgOtherUsersPoints)
+		return
+	}
+	defer r.Body.Close()
+	req, err := decodeRedemptionRequest(r)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgRedemptionInvalid)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	redemption, created, err := a.store(ctx).Redeem(ctx, db.Redemption{
+		ID:        req.ID,
+		UserID:    userID,
+		Points:    req.Points,
+		Reward:    req.Reward,
+		CreatedAt: a.now().UTC(),
+	})
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		switch {
+		case a.writeStoreUnavailable(w, r, err):
+		case errors.Is(err, db.ErrInsufficientPoints):
+			writeError(w, r, http.StatusUnprocessableEntity, codeInsufficientPoints, msgInsufficientPoints)
+		case errors.Is(err, db.ErrRedemptionConflict):
+			writeError(w, r, http.StatusConflict, codeConflict, msgRedemptionConflict)
+		default:
+			writeError(w, r, http.StatusInternalServerError, codeInternal, msgInternal)
+		}
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(redemption); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+// ListRedemptionsHandler returns a user's latest redemptions (?limit=, default 10)
+func (a *App) ListRedemptionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "id")
+	if !isValidUserID(userID) {
+		writeError(w, r, http.StatusNotFound, codeUserNotFound, msgUserNotFound)
+		return
+	}
+	if !authorizedForUser(r, userID) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, msgOtherUsersRedemptions)
+		return
+	}
+	limit, err := parseOptionalIntParam(r, "limit")
+	if err != nil || (limit != nil && (*limit < 1 || *limit > maxUserHistoryLimit)) {
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgLimitOutOfRange, maxUserHistoryLimit)
+		return
+	}
+	historyLimit := defaultUserHistoryLimit
+	if limit != nil {
+		historyLimit = *limit
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	redemptions, err := a.store(ctx).ListRedemptions(ctx, userID, historyLimit)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, codeInternal, msgInternal)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(redemptionsResponse{UserID: userID, Redemptions: redemptions}); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
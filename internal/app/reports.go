@@ -0,0 +1,346 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/cron"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/report"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+// design decision: summaries are put together from what's already counted, billing
+// usage for receipts and points and a usage counter of fraud flags per UTC day. only the
+// top retailers need receipts read, the analytics ranking is all time, so they're
+// ranked by the receipts purchased in the period
+const (
+	// how many of a period's receipts are read to rank its retailers, per tenant
+	maxReportReceipts = 100000
+	// how long the claim on sending a scheduled summary is kept, longer than a week so
+	// instances never send one twice
+	reportClaimTTL = 31 * 24 * time.Hour
+)
+
+func reportFlagsName(day string) string {
+	return "reports:" + day + ":flagged"
+}
+
+// recordFlags counts the receipts of recs that were flagged for review towards the
+// tenant in ctx's fraud flags on at's UTC day. Best effort like recordUsage.
+func (a *App) recordFlags(ctx context.Context, at time.Time, recs ...db.ReceiptRecord) {
+	flagged := 0
+	for _, rec := range recs {
+		if rec.Status == db.ReceiptFlagged {
+			flagged++
+		}
+	}
+	if flagged == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), a.config().DbTimeoutInMs)
+	defer cancel()
+	if _, err := a.store(ctx).AddUsage(ctx, reportFlagsName(at.UTC().Format(statsDateLayout)), flagged, usageTTL); err != nil {
+		logging.Printf(ctx, "Error counting %d fraud flags: %v", flagged, err)
+	}
+}
+
+// reportDays are the days (YYYY-MM-DD) a summary of period ending on last covers
+func reportDays(period string, last time.Time) ([]string, error) {
+	n := 1
+	switch period {
+	case report.Daily:
+	case report.Weekly:
+		n = 7
+	default:
+		return nil, fmt.Errorf("Report period must be %s or %s, got %q", report.Daily, report.Weekly, period)
+	}
+	days := make([]string, n)
+	for i := range days {
+		days[i] = last.AddDate(0, 0, i-n+1).Format(statsDateLayout)
+	}
+	return days, nil
+}
+
+// topRetailers ranks retailers by the receipts of the tenant in ctx purchased on days,
+// reading at most maxReportReceipts of them. It reports whether it read them all.
+func (a *App) topRetailers(ctx context.Context, days []string, top int) ([]report.Retailer, bool, error) {
+	counts := make(map[string]int)
+	filter := db.ListFilter{FromDate: days[0], ToDate: days[len(days)-1], Limit: exportPageSize}
+	read := 0
+	for {
+		pageCtx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+		records, nextCursor, err := a.store(pageCtx).ListReceipts(pageCtx, filter)
+		cancel()
+		if err != nil {
+			return nil, false, err
+		}
+		for _, rec := range records {
+			counts[rec.AnalyticsRetailer()]++
+		}
+		read += len(records)
+		if nextCursor == "" {
+			break
+		}
+		if read >= maxReportReceipts {
+			return rankRetailers(counts, top), false, nil
+		}
+		filter.Cursor = nextCursor
+	}
+	return rankRetailers(counts, top), true, nil
+}
+
+func rankRetailers(counts map[string]int, top int) []report.Retailer {
+	ranked := make([]report.Retailer, 0, len(counts))
+	for retailer, receipts := range counts {
+		ranked = append(ranked, report.Retailer{Retailer: retailer, Receipts: receipts})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Receipts != ranked[j].Receipts {
+			return ranked[i].Receipts > ranked[j].Receipts
+		}
+		return ranked[i].Retailer < ranked[j].Retailer
+	})
+	return ranked[:min(top, len(ranked))]
+}
+
+// tenantReport is a tenant's part of a summary over days
+func (a *App) tenantReport(ctx context.Context, t *tenant.Tenant, days []string) (report.Tenant, error) {
+	usage, err := a.tenantUsage(ctx, t, days, false)
+	if err != nil {
+		return report.Tenant{}, err
+	}
+	summary := report.Tenant{ID: t.ID, Name: t.Name, Receipts: usage.Receipts, PointsAwarded: usage.Points}
+
+	ctx = tenant.NewContext(ctx, t)
+	names := make([]string, len(days))
+	for i, day := range days {
+		names[i] = reportFlagsName(day)
+	}
+	dbCtx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+	defer cancel()
+	flags, err := a.store(dbCtx).GetUsage(dbCtx, names)
+	if err != nil {
+		return report.Tenant{}, err
+	}
+	for _, name := range names {
+		summary.FraudFlags += flags[name]
+	}
+	stats, err := a.store(dbCtx).Stats(dbCtx)
+	if err != nil {
+		return report.Tenant{}, err
+	}
+	summary.PendingReview = int(stats.FlaggedReceipts)
+
+	var complete bool
+	summary.TopRetailers, complete, err = a.topRetailers(ctx, days, a.config().ReportTopRetailers)
+	if err != nil {
+		return report.Tenant{}, err
+	}
+	summary.TopRetailersPartial = !complete
+	return summary, nil
+}
+
+// buildReport puts together the summary of period ending on last for tenants
+func (a *App) buildReport(ctx context.Context, period string, last time.Time, tenants []*tenant.Tenant) (report.Summary, error) {
+	days, err := reportDays(period, last)
+	if err != nil {
+		return report.Summary{}, err
+	}
+	summary := report.Summary{
+		Period:      period,
+		From:        days[0],
+		To:          days[len(days)-1],
+		GeneratedAt: a.now().UTC(),
+		Tenants:     make([]report.Tenant, 0, len(tenants)),
+	}
+	for _, t := range tenants {
+		ts, err := a.tenantReport(ctx, t, days)
+		if err != nil {
+			return report.Summary{}, fmt.Errorf("Error reporting on tenant %q: %w", t.ID, err)
+		}
+		summary.Receipts += ts.Receipts
+		summary.PointsAwarded += ts.PointsAwarded
+		summary.FraudFlags += ts.FraudFlags
+		summary.Tenants = append(summary.Tenants, ts)
+	}
+	return summary, nil
+}
+
+// claimReport reports whether this instance is the one to send the scheduled summary
+// named name, the first to count it is
+func (a *App) claimReport(ctx context.Context, name string) (bool, error) {
+	ctx = tenant.NewContext(ctx, tenant.Default)
+	ctx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+	defer cancel()
+	n, err := a.store(ctx).AddUsage(ctx, "reports:sent:"+name, 1, reportClaimTTL)
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// sendScheduledReport sends the summary of period that was due at, the one ending on the
+// UTC day before
+func (a *App) sendScheduledReport(ctx context.Context, period string, at time.Time) error {
+	last := at.UTC().AddDate(0, 0, -1)
+	days, err := reportDays(period, last)
+	if err != nil {
+		return err
+	}
+	name := report.Summary{Period: period, From: days[0]}.Name()
+	claimed, err := a.claimReport(ctx, name)
+	if err != nil {
+		return fmt.Errorf("Error claiming report %s: %w", name, err)
+	}
+	if !claimed {
+		logging.Printf(ctx, "Report %s was sent by another instance", name)
+		return nil
+	}
+	summary, err := a.buildReport(ctx, period, last, a.allTenants())
+	if err != nil {
+		return err
+	}
+	if err := a.Reports.Send(ctx, summary); err != nil {
+		return err
+	}
+	logging.Printf(ctx, "Sent report %s: %d receipts, %d points, %d fraud flags", name, summary.Receipts, summary.PointsAwarded, summary.FraudFlags)
+	return nil
+}
+
+// StartReportScheduler sends the daily and weekly summaries on REPORT_DAILY_SCHEDULE
+// and REPORT_WEEKLY_SCHEDULE, checking every interval whether one is due, until ctx is
+// done. Every instance runs one and the first to claim a summary sends it, the others
+// don't try again when that fails (POST /admin/reports/{period} sends it by hand).
+func (a *App) StartReportScheduler(ctx context.Context, interval time.Duration) {
+	if a.Reports == nil {
+		return
+	}
+	schedules := make(map[string]cron.Schedule)
+	for period, spec := range map[string]string{report.Daily: a.Config.ReportDailySchedule, report.Weekly: a.Config.ReportWeeklySchedule} {
+		if spec == "" {
+			continue
+		}
+		// validated at boot
+		schedule, err := cron.Parse(spec)
+		if err != nil {
+			logging.Errorf(ctx, "Not sending %s reports: %v", period, err)
+			continue
+		}
+		schedules[period] = schedule
+	}
+	if len(schedules) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		due := make(map[string]time.Time, len(schedules))
+		for period, schedule := range schedules {
+			due[period] = schedule.Next(a.now())
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			now := a.now()
+			for period, at := range due {
+				if at.IsZero() || now.Before(at) {
+					continue
+				}
+				if err := a.sendScheduledReport(ctx, period, at); err != nil {
+					logging.Printf(ctx, "Error sending %s report due at %s: %v", period, at.Format(time.RFC3339), err)
+				}
+				due[period] = schedules[period].Next(now)
+			}
+		}
+	}()
+}
+
+// reportRequest reads the period and ?date= (YYYY-MM-DD, the summary's last day,
+// yesterday without it) of a report request
+func (a *App) reportRequest(r *http.Request) (string, time.Time, error) {
+	period := chi.URLParam(r, "period")
+	if _, err := reportDays(period, time.Time{}); err != nil {
+		return "", time.Time{}, err
+	}
+	date, err := parseOptionalDateParam(r, "date")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	last := a.now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	if date != "" {
+		last, _ = time.Parse(statsDateLayout, date)
+	}
+	return period, last, nil
+}
+
+// GetReportHandler returns the daily or weekly summary ending on ?date= (yesterday
+// without it) the way the scheduler sends it, for every tenant unless X-Tenant-ID names
+// one. Retailers are ranked from receipts, it isn't bound by the request timeout.
+func (a *App) GetReportHandler(w http.ResponseWriter, r *http.Request) {
+	period, last, err := a.reportRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tenants := []*tenant.Tenant{tenant.FromContext(r.Context())}
+	if r.Header.Get(tenantIDHeader) == "" {
+		tenants = a.allTenants()
+	}
+	summary, err := a.buildReport(r.Context(), period, last, tenants)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "Error building report", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+// SendReportHandler sends the summary ending on ?date= (yesterday without it) to the
+// report destinations now, e.g. again after one was down when it was due. It answers
+// 202 with the summary, delivery goes on in the background and is logged.
+func (a *App) SendReportHandler(w http.ResponseWriter, r *http.Request) {
+	period, last, err := a.reportRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	summary, err := a.buildReport(r.Context(), period, last, a.allTenants())
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "Error building report", http.StatusInternalServerError)
+		return
+	}
+	go func(ctx context.Context) {
+		if err := a.Reports.Send(ctx, summary); err != nil {
+			logging.Printf(ctx, "Error sending report %s: %v", summary.Name(), err)
+			return
+		}
+		logging.Printf(ctx, "Sent report %s on request", summary.Name())
+	}(context.WithoutCancel(r.Context()))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
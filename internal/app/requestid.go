@@ -0,0 +1,92 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+)
+
+// isValidRequestID keeps ids passed in by clients or proxies to something that is safe
+// to echo in headers and log lines
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlnum && !strings.ContainsRune("-_.:", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDWriter appends the request id to plain text error bodies (http.Error), so
+// whoever reports "The receipt is invalid" can also say which request it was
+type requestIDWriter struct {
+	http.ResponseWriter
+	id          string
+	wroteHeader bool
+	annotate    bool
+}
+
+func (w *requestIDWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if statusCode >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+			w.annotate = true
+			w.Header().Del("Content-Length")
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *requestIDWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.annotate {
+		return w.ResponseWriter.Write(b)
+	}
+	// http.Error writes the whole message at once, only that first write is annotated
+	w.annotate = false
+	annotated := append(bytes.TrimRight(b, "\n"), []byte(" (request id: "+w.id+")\n")...)
+	if _, err := w.ResponseWriter.Write(annotated); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *requestIDWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. for full duplex
+func (w *requestIDWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// RequestID gives every request an id: the X-Request-ID it came with (e.g. from a load
+// balancer) when that looks sane, a fresh one otherwise. It's sent back in
+// X-Request-ID, logged with every line logged for the request and added to error
+// messages.
+func (a *App) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := logging.NewContext(r.Context(), id)
+		next.ServeHTTP(&requestIDWriter{ResponseWriter: w, id: id}, r.WithContext(ctx))
+	})
+}
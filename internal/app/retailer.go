@@ -0,0 +1,36 @@
+package app
+
+import (
+	"math"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+)
+
+// retailerOverride finds the override that applies to a receipt's retailer, nil when
+// none does. Names are compared in the same normalized form the retailer indexes use.
+func retailerOverride(rec receipt, ruleSet *rules.RuleSet) *rules.RetailerOverride {
+	normalized := db.NormalizeRetailer(rec.Retailer)
+	for i := range ruleSet.RetailerOverrides {
+		o := &ruleSet.RetailerOverrides[i]
+		if o.Retailer != "" && db.NormalizeRetailer(o.Retailer) == normalized {
+			return o
+		}
+		if o.RetailerID != "" && o.RetailerID == rec.retailerID {
+			return o
+		}
+		if re := o.Regexp(); re != nil && re.MatchString(rec.Retailer) {
+			return o
+		}
+	}
+	return nil
+}
+
+// applyMultiplier scales points, a zero multiplier meaning "not set". Rounds to the
+// nearest point so 2x and 1.5x partners don't lose points to truncation.
+func applyMultiplier(points int, multiplier float64) int {
+	if multiplier == 0 {
+		return points
+	}
+	return int(math.Round(float64(points) * multiplier))
+}
@@ -0,0 +1,282 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	maxRetailerNameLength = 128
+	maxRetailerAliases    = 100
+	maxRetailerPatterns   = 20
+)
+
+var validRetailerID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// retailerRegistry resolves the retailer a receipt names to its canonical id, compiled
+// from the registry in the store
+type retailerRegistry struct {
+	// normalized alias -> id
+	aliases  map[string]string
+	patterns []retailerPattern
+}
+
+type retailerPattern struct {
+	id string
+	re *regexp.Regexp
+}
+
+// newRetailerRegistry compiles retailers, ordered by id. An alias two retailers claim
+// goes to the first, a pattern that doesn't compile (they're checked when they're
+// saved) is left out.
+func newRetailerRegistry(ctx context.Context, retailers []db.Retailer) *retailerRegistry {
+	reg := &retailerRegistry{aliases: make(map[string]string)}
+	for _, r := range retailers {
+		for _, alias := range append([]string{r.Name}, r.Aliases...) {
+			if key := db.NormalizeRetailer(alias); key != "" && reg.aliases[key] == "" {
+				reg.aliases[key] = r.ID
+			}
+		}
+		for _, p := range r.Patterns {
+			re, err := regexp.Compile("(?i)" + p)
+			if err != nil {
+				logging.Printf(ctx, "Error compiling pattern %q of retailer %s, leaving it out: %v", p, r.ID, err)
+				continue
+			}
+			reg.patterns = append(reg.patterns, retailerPattern{id: r.ID, re: re})
+		}
+	}
+	return reg
+}
+
+// resolve is the id of the retailer, empty when the registry doesn't know it. Aliases
+// win over patterns, then the first matching pattern does.
+func (reg *retailerRegistry) resolve(retailer string) string {
+	if reg == nil {
+		return ""
+	}
+	if id, ok := reg.aliases[db.NormalizeRetailer(retailer)]; ok {
+		return id
+	}
+	retailer = normalizeText(retailer)
+	for _, p := range reg.patterns {
+		if p.re.MatchString(retailer) {
+			return p.id
+		}
+	}
+	return ""
+}
+
+// retailers is the retailer registry of the tenant in ctx, as of the last refresh
+func (a *App) retailers(ctx context.Context) *retailerRegistry {
+	if reg, ok := a.retailerCache.Load(tenant.FromContext(ctx).ID); ok {
+		return reg.(*retailerRegistry)
+	}
+	return nil
+}
+
+// withRetailerID is rec with the id the tenant's registry has for its retailer
+func (a *App) withRetailerID(ctx context.Context, rec receipt) receipt {
+	rec.retailerID = a.retailers(ctx).resolve(rec.Retailer)
+	return rec
+}
+
+// refreshRetailers reloads the retailer registry of the tenant in ctx
+func (a *App) refreshRetailers(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+	defer cancel()
+	retailers, err := a.store(ctx).ListRetailers(ctx)
+	if err != nil {
+		return err
+	}
+	a.retailerCache.Store(tenant.FromContext(ctx).ID, newRetailerRegistry(ctx, retailers))
+	return nil
+}
+
+// refreshAllRetailers reloads every tenant's retailer registry, carrying on past
+// failures
+func (a *App) refreshAllRetailers(ctx context.Context) error {
+	var errs []error
+	for _, t := range a.allTenants() {
+		if err := a.refreshRetailers(tenant.NewContext(ctx, t)); err != nil {
+			errs = append(errs, fmt.Errorf("Error refreshing retailers of tenant %q: %w", t.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateRetailer(r db.Retailer) error {
+	if r.Name == "" || len(r.Name) > maxRetailerNameLength {
+		return fmt.Errorf("Invalid retailer: name must be 1 to %d bytes", maxRetailerNameLength)
+	}
+	if len(r.Aliases) > maxRetailerAliases {
+		return fmt.Errorf("Invalid retailer: more than %d aliases", maxRetailerAliases)
+	}
+	for _, alias := range r.Aliases {
+		if db.NormalizeRetailer(alias) == "" || len(alias) > maxRetailerNameLength {
+			return fmt.Errorf("Invalid retailer: aliases must be 1 to %d bytes and not blank", maxRetailerNameLength)
+		}
+	}
+	if len(r.Patterns) > maxRetailerPatterns {
+		return fmt.Errorf("Invalid retailer: more than %d patterns", maxRetailerPatterns)
+	}
+	for _, p := range r.Patterns {
+		if _, err := regexp.Compile("(?i)" + p); err != nil {
+			return fmt.Errorf("Invalid retailer pattern %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// aliasConflict is the first of r's names another retailer already has, along with
+// that retailer, so one raw name never resolves to two retailers
+func aliasConflict(r db.Retailer, others []db.Retailer) (string, string) {
+	claimed := make(map[string]string)
+	for _, other := range others {
+		if other.ID == r.ID {
+			continue
+		}
+		for _, alias := range append([]string{other.Name}, other.Aliases...) {
+			claimed[db.NormalizeRetailer(alias)] = other.ID
+		}
+	}
+	for _, alias := range append([]string{r.Name}, r.Aliases...) {
+		if id, ok := claimed[db.NormalizeRetailer(alias)]; ok {
+			return alias, id
+		}
+	}
+	return "", ""
+}
+
+type listRetailersResponse struct {
+	Retailers []db.Retailer `json:"retailers"`
+}
+
+func (a *App) ListRetailersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	retailers, err := a.store(ctx).ListRetailers(ctx)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "Error listing retailers", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(listRetailersResponse{Retailers: retailers}); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+// SaveRetailerHandler creates or replaces the retailer with the id in the URL. Ids are
+// picked by the operator since rules and campaigns refer to them. A name or alias
+// another retailer already has gets a 409.
+func (a *App) SaveRetailerHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !validRetailerID.MatchString(id) {
+		http.Error(w, "Retailer ids are up to 64 lowercase letters, digits, '-' and '_'", http.StatusBadRequest)
+		return
+	}
+	var rt db.Retailer
+	err := json.NewDecoder(r.Body).Decode(&rt)
+	defer r.Body.Close()
+	if err == nil {
+		err = validateRetailer(rt)
+	}
+	if err != nil {
+		logging.Printf(r.Context(), "Invalid retailer: %v", err)
+		http.Error(w, "The retailer is invalid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rt.ID = id
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	// design decision: checked against what's stored, two saves racing each other can
+	// still both claim an alias. resolving picks the retailer with the lower id then
+	others, err := a.store(ctx).ListRetailers(ctx)
+	if err == nil {
+		if alias, other := aliasConflict(rt, others); other != "" {
+			http.Error(w, fmt.Sprintf("%q is already a name of retailer %s", alias, other), http.StatusConflict)
+			return
+		}
+		err = a.store(ctx).SaveRetailer(ctx, rt)
+	}
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "Error saving retailer", http.StatusInternalServerError)
+		return
+	}
+	// other instances pick it up on their next refresh, this one right away
+	if err := a.refreshRetailers(r.Context()); err != nil {
+		logging.Printf(r.Context(), "Error refreshing retailers after saving %s: %v", rt.ID, err)
+	}
+	logging.Printf(r.Context(), "Saved retailer %s (%s)", rt.ID, rt.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rt); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+func (a *App) DeleteRetailerHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	if err := a.store(ctx).DeleteRetailer(ctx, id); err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "No retailer found for that id", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error deleting retailer", http.StatusInternalServerError)
+		return
+	}
+	if err := a.refreshRetailers(r.Context()); err != nil {
+		logging.Printf(r.Context(), "Error refreshing retailers after deleting %s: %v", id, err)
+	}
+	logging.Printf(r.Context(), "Deleted retailer %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type resolveRetailersResponse struct {
+	// raw name -> retailer id, empty for names the registry doesn't know
+	Retailers map[string]string `json:"retailers"`
+}
+
+// ResolveRetailersHandler answers which retailer ids the raw names in the retailer query
+// parameters resolve to, as of this instance's last refresh
+func (a *App) ResolveRetailersHandler(w http.ResponseWriter, r *http.Request) {
+	names := r.URL.Query()["retailer"]
+	if len(names) == 0 {
+		http.Error(w, "Name at least one retailer to resolve", http.StatusBadRequest)
+		return
+	}
+	reg := a.retailers(r.Context())
+	resp := resolveRetailersResponse{Retailers: make(map[string]string, len(names))}
+	for _, name := range names {
+		resp.Retailers[name] = reg.resolve(name)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/events"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+// clients pick how long the receipts they submit are kept with X-Retention-Class: one
+// of the classes in RECEIPT_RETENTION_IN_S. without it receipts get REDIS_TTL_IN_S
+const retentionClassHeader = "X-Retention-Class"
+
+type retentionClassKey struct{}
+
+// retentionClass is the retention class the request asked for, "" for the default
+func retentionClass(ctx context.Context) string {
+	class, _ := ctx.Value(retentionClassKey{}).(string)
+	return class
+}
+
+// RetentionClass checks the X-Retention-Class a request asked for is configured. The
+// classes are the boot config's, the store was built with them and doesn't reload.
+func (a *App) RetentionClass(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := r.Header.Get(retentionClassHeader)
+		if class == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := a.Config.ReceiptRetention[class]; !ok {
+			writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgRetentionClassUnknown)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), retentionClassKey{}, class)))
+	})
+}
+
+// retentionSweepBatch is how many receipts one PurgeReceipts call deletes
+const retentionSweepBatch = 200
+
+// sweepRetention purges the tenant in ctx's tombstones that are past
+// TOMBSTONE_RETENTION_IN_S and, when RECEIPT_MAX_AGE_IN_S is set, its receipts older
+// than that, a batch at a time. Every purged receipt gets a receipt.purged event.
+func (a *App) sweepRetention(ctx context.Context) error {
+	cfg := a.config()
+	now := a.now()
+	var createdBefore time.Time
+	if cfg.ReceiptMaxAgeInSec > 0 {
+		createdBefore = now.Add(-cfg.ReceiptMaxAgeInSec)
+	}
+	deletedBefore := now.Add(-cfg.TombstoneRetentionInSec)
+	for {
+		sweepCtx, cancel := context.WithTimeout(ctx, cfg.DbTimeoutInMs)
+		sweep, err := a.store(sweepCtx).PurgeReceipts(sweepCtx, createdBefore, deletedBefore, retentionSweepBatch)
+		cancel()
+		// whatever was purged before a failure is gone, it's reported either way
+		for _, rec := range sweep.Purged {
+			a.forgetReceipts(ctx, rec.ID)
+			a.publishRemoval(ctx, events.ReceiptPurged, rec)
+		}
+		if len(sweep.Purged) > 0 {
+			logging.Printf(ctx, "Purged %d receipts of tenant %q", len(sweep.Purged), tenant.FromContext(ctx).ID)
+		}
+		if err != nil {
+			return err
+		}
+		if !sweep.More {
+			return nil
+		}
+	}
+}
+
+// sweepAllRetention sweeps every tenant, carrying on past failures
+func (a *App) sweepAllRetention(ctx context.Context) error {
+	var errs []error
+	for _, t := range a.allTenants() {
+		if err := a.sweepRetention(tenant.NewContext(ctx, t)); err != nil {
+			errs = append(errs, fmt.Errorf("Error purging receipts of tenant %q: %w", t.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StartRetentionSweeper purges what's past retention right away and then every
+// interval until ctx is done. Every instance runs one, sweeps are safe to overlap.
+func (a *App) StartRetentionSweeper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := a.sweepAllRetention(ctx); err != nil {
+				logging.Printf(ctx, "Error purging receipts, trying again next sweep: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
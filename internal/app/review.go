@@ -0,0 +1,120 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+type flaggedReceipt struct {
+	ID           string    `json:"id"`
+	Retailer     string    `json:"retailer"`
+	PurchaseDate string    `json:"purchaseDate"`
+	Points       int       `json:"points"`
+	UserID       string    `json:"userId,omitempty"`
+	FraudReasons []string  `json:"fraudReasons"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func newFlaggedReceipt(rec db.ReceiptRecord) flaggedReceipt {
+	return flaggedReceipt{
+		ID:           rec.ID,
+		Retailer:     rec.Retailer,
+		PurchaseDate: rec.PurchaseDate,
+		Points:       rec.Points,
+		UserID:       rec.UserID,
+		FraudReasons: rec.FraudReasons,
+		CreatedAt:    rec.CreatedAt,
+	}
+}
+
+// ListFlaggedHandler returns the review queue, oldest first (?limit=, default 20)
+func (a *App) ListFlaggedHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseOptionalIntParam(r, "limit")
+	if err != nil || (limit != nil && (*limit < 1 || *limit > maxListLimit)) {
+		http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+		return
+	}
+	queueLimit := defaultListLimit
+	if limit != nil {
+		queueLimit = *limit
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	records, err := a.store(ctx).ListFlagged(ctx, queueLimit)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		http.Error(w, "Error listing flagged receipts", http.StatusInternalServerError)
+		return
+	}
+	responseToClient := make([]flaggedReceipt, 0, len(records))
+	for _, rec := range records {
+		responseToClient = append(responseToClient, newFlaggedReceipt(rec))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
+
+func (a *App) ApproveReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	a.resolveFlagged(w, r, true)
+}
+
+func (a *App) RejectReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	a.resolveFlagged(w, r, false)
+}
+
+// resolveFlagged takes a flagged receipt out of the review queue. Approved receipts get
+// their points and are announced like any other, rejected ones never do.
+func (a *App) resolveFlagged(w http.ResponseWriter, r *http.Request, approve bool) {
+	id := chi.URLParam(r, "id")
+	if ok, err := isValidUUIDv4(id); !ok {
+		logging.Printf(r.Context(), "%v", err)
+		http.Error(w, "No flagged receipt found for that id", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	resolved, err := a.store(ctx).ResolveFlagged(ctx, id, approve)
+	a.forgetReceipts(ctx, id)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "No flagged receipt found for that id", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error resolving flagged receipt", http.StatusInternalServerError)
+		return
+	}
+	if approve {
+		logging.Printf(r.Context(), "Approved flagged receipt %s", id)
+		a.recordUsage(r.Context(), a.now(), 0, resolved.Points)
+		a.announceReceipt(r.Context(), resolved)
+	} else {
+		logging.Printf(r.Context(), "Rejected flagged receipt %s", id)
+	}
+	responseToClient := pointsResponse{
+		Points:       resolved.Points,
+		RulesVersion: resolved.RulesVersion,
+		Status:       resolved.Status,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+)
+
+// Router wires every route to its handler. The admin routes only exist when the boot
+// config has an ADMIN_TOKEN or an OIDC provider.
+func (a *App) Router() http.Handler {
+	r := chi.NewRouter()
+
+	requestTimeout := a.RequestTimeout
+	r.Use(a.RequestID, a.AccessLog, a.Gzip)
+
+	// connect routes to handlers
+	r.With(requestTimeout).Get("/healthz", a.HealthzHandler)
+	r.With(requestTimeout).Get("/readyz", a.ReadyzHandler)
+	r.With(requestTimeout).Get("/metrics", a.MetricsHandler)
+
+	// the public API lives under /v1. the unversioned paths it had before stay around
+	// as deprecated aliases until clients have moved over
+	r.Route("/v1", func(r chi.Router) {
+		r.Use(a.APIVersion(1))
+		a.publicRoutes(r)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(a.LegacyAPI)
+		a.publicRoutes(r)
+	})
+
+	// admin routes only exist when admins can sign in, with a token or through OIDC
+	if a.Config.AdminToken != "" || a.OIDC != nil {
+		r.Route("/admin", func(r chi.Router) {
+			if a.OIDC != nil && a.OIDC.Login() {
+				r.With(requestTimeout).Get("/login", a.LoginHandler)
+				r.Get("/callback", a.CallbackHandler)
+				r.With(requestTimeout).Post("/logout", a.LogoutHandler)
+			}
+			// the dashboard's page and assets hold no data, they load without signing in
+			// and get everything they show from /admin/overview
+			r.Get("/ui", http.RedirectHandler("/admin/ui/", http.StatusMovedPermanently).ServeHTTP)
+			r.Get("/ui/", a.DashboardHandler)
+			r.Handle("/ui/*", a.DashboardAssetsHandler())
+			r.Group(func(r chi.Router) {
+				r.Use(a.RequireAdmin, a.AdminTenant)
+				a.adminRoutes(r)
+			})
+		})
+	}
+	return r
+}
+
+// adminRoutes are the /admin routes, each behind the capability it needs
+func (a *App) adminRoutes(r chi.Router) {
+	read := r.With(a.RequireCapability(capRead))
+	// exports stream for as long as there are receipts, so they don't get the request
+	// timeout. each page is still bounded by the DB timeout
+	read.Get("/export", a.ExportReceiptsHandler)
+	// reports read a period's receipts to rank its retailers, each page is bounded
+	read.Get("/reports/{period}", a.GetReportHandler)
+	read = read.With(a.RequestTimeout)
+	read.Get("/webhooks", a.ListWebhooksHandler)
+	read.Post("/rules/evaluate", a.EvaluateRulesHandler)
+	read.Get("/campaigns", a.ListCampaignsHandler)
+	read.Get("/retailers", a.ListRetailersHandler)
+	read.Get("/retailers/resolve", a.ResolveRetailersHandler)
+	read.Get("/receipts/{id}", a.GetReceiptAdminHandler)
+	read.Get("/review", a.ListFlaggedHandler)
+	read.Get("/keys", a.ListKeysHandler)
+	read.Get("/stats", a.StoreStatsHandler)
+	read.Get("/overview", a.DashboardOverviewHandler)
+	read.Get("/jobs", a.ListJobsHandler)
+	read.Get("/jobs/{id}", a.GetJobHandler)
+	read.Get("/usage", a.UsageHandler)
+
+	review := r.With(a.RequireCapability(capReview), a.RequestTimeout)
+	review.Post("/review/{id}/approve", a.ApproveReceiptHandler)
+	review.Post("/review/{id}/reject", a.RejectReceiptHandler)
+	review.Post("/receipts/{id}/adjustments", a.AdjustReceiptHandler)
+	review.Post("/users/{id}/adjustments", a.AdjustUserPointsHandler)
+
+	rules := r.With(a.RequireCapability(capRules), a.RequestTimeout)
+	rules.Post("/reload", a.ReloadHandler)
+	rules.Post("/campaigns", a.CreateCampaignHandler)
+	rules.Put("/campaigns/{id}", a.UpdateCampaignHandler)
+	rules.Delete("/campaigns/{id}", a.DeleteCampaignHandler)
+	rules.Put("/retailers/{id}", a.SaveRetailerHandler)
+	rules.Delete("/retailers/{id}", a.DeleteRetailerHandler)
+	rules.Post("/receipts/recalculate", a.RecalculateReceiptsHandler)
+
+	purge := r.With(a.RequireCapability(capPurge), a.RequestTimeout)
+	purge.Delete("/receipts/{id}", a.DeleteReceiptAdminHandler)
+	purge.Post("/maintenance/{task}", a.RunMaintenanceHandler)
+
+	webhooks := r.With(a.RequireCapability(capAdmin), a.RequestTimeout)
+	webhooks.Post("/webhooks", a.RegisterWebhookHandler)
+	webhooks.Delete("/webhooks", a.RemoveWebhookHandler)
+	// sending reports by hand only exists with somewhere to send them
+	if a.Reports != nil {
+		r.With(a.RequireCapability(capAdmin)).Post("/reports/{period}", a.SendReportHandler)
+	}
+
+	// fault injection only exists with CHAOS_MODE on
+	if a.Chaos != nil {
+		faults := r.With(a.RequireCapability(capAdmin), a.RequestTimeout)
+		faults.Get("/chaos", a.ListFaultsHandler)
+		faults.Delete("/chaos", a.ClearFaultHandler)
+		faults.Put("/chaos/{target}", a.SetFaultHandler)
+		faults.Delete("/chaos/{target}", a.ClearFaultHandler)
+	}
+}
+
+// publicRoutes are the receipt and user routes clients call
+func (a *App) publicRoutes(r chi.Router) {
+	r.Route("/receipts", func(r chi.Router) {
+		r.Use(a.IdentifyTenant, a.RetentionClass)
+		r.Group(func(r chi.Router) {
+			r.Use(a.ShedLoad, a.RequestTimeout)
+			r.Get("/", a.ListReceiptsHandler)
+			r.Get("/search", a.SearchReceiptsHandler)
+			r.With(a.EnforceQuota).Post("/process", a.ProcessReceiptHandler)
+			r.Post("/score", a.ScoreReceiptHandler)
+			r.Put("/{id}", a.CorrectReceiptHandler)
+			r.Delete("/{id}", a.DeleteReceiptHandler)
+			r.Get("/{id}/points", a.GetPointsHandler)
+			r.Get("/{id}/breakdown", a.GetBreakdownHandler)
+		})
+		// bulk import streams for as long as the client keeps sending, so it doesn't get
+		// the request timeout, nor a request slot. each receipt is still bounded by the
+		// DB timeout and batches wait for MAX_CONCURRENT_RECEIPTS
+		r.With(a.EnforceQuota).Post("/import", a.ImportReceiptsHandler)
+		// event streams stay open for as long as the client listens
+		if a.Stream != nil {
+			r.Get("/events", a.ReceiptEventsHandler)
+		}
+		// OCR easily takes longer than the request timeout, it has its own
+		if a.OCR != nil {
+			r.With(a.ShedLoad, a.EnforceQuota).Post("/process/image", a.ProcessReceiptImageHandler)
+		}
+	})
+
+	r.Route("/users/{id}", func(r chi.Router) {
+		r.Use(a.IdentifyTenant, a.ShedLoad, a.RequestTimeout)
+		r.Get("/points", a.GetUserPointsHandler)
+		r.Get("/redemptions", a.ListRedemptionsHandler)
+		r.Post("/redemptions", a.RedeemPointsHandler)
+	})
+
+	r.With(a.IdentifyTenant, a.ShedLoad, a.RequestTimeout).Get("/stats", a.GetStatsHandler)
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/metrics"
+)
+
+// rulePoints is what every rule contributed to the receipts saved since boot, by rule
+// name across tenants: how many receipts it ran on, how many it gave points (or took
+// some away), the points it gave and a histogram of them
+var (
+	rulePoints   = metrics.NewMap("rule_points")
+	rulePointsMu sync.Mutex
+)
+
+// rulePointsBuckets are the histogram's upper bounds, from a few points for an item
+// description to big campaign bonuses
+var rulePointsBuckets = []float64{0, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// ruleMetrics are the rule's counters, created the first time the rule shows up
+func ruleMetrics(rule string) *expvar.Map {
+	if m, ok := rulePoints.Get(rule).(*expvar.Map); ok {
+		return m
+	}
+	rulePointsMu.Lock()
+	defer rulePointsMu.Unlock()
+	if m, ok := rulePoints.Get(rule).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	m.Set("histogram", metrics.NewHistogram(rulePointsBuckets...))
+	rulePoints.Set(rule, m)
+	return m
+}
+
+// countRulePoints adds a saved receipt's breakdown to rulePoints. A rule with more than
+// one line (a campaign per item, say) counts once with their sum.
+func countRulePoints(breakdown []db.PointsComponent) {
+	if len(breakdown) == 0 {
+		return
+	}
+	var order []string
+	byRule := make(map[string]int, len(breakdown))
+	for _, c := range breakdown {
+		if _, ok := byRule[c.Rule]; !ok {
+			order = append(order, c.Rule)
+		}
+		byRule[c.Rule] += c.Points
+	}
+	for _, rule := range order {
+		m, points := ruleMetrics(rule), byRule[rule]
+		m.Add("receipts", 1)
+		if points == 0 {
+			continue
+		}
+		m.Add("fired", 1)
+		m.Add("points", int64(points))
+		m.Get("histogram").(*metrics.Histogram).Observe(float64(points))
+	}
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/chaos"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+type scoreResponse struct {
+	Points         int                  `json:"points"`
+	RulesVersion   string               `json:"rulesVersion,omitempty"`
+	PointsExpireAt *time.Time           `json:"pointsExpireAt,omitempty"`
+	Breakdown      []db.PointsComponent `json:"breakdown"`
+}
+
+// ScoreReceiptHandler previews what processing a receipt would earn: its points and
+// breakdown with the current rules and campaigns. Nothing is stored and the receipt gets
+// no id, it isn't counted against the tenant's quota or fraud screened either, so the
+// points of a receipt that's later flagged can still end up held back.
+func (a *App) ScoreReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	rec, ok := a.readReceipt(w, r)
+	if !ok {
+		return
+	}
+	release, err := a.Processing.Acquire(r.Context())
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		a.writeReceiptError(w, r, err)
+		return
+	}
+	defer release()
+	if err := a.Chaos.Inject(r.Context(), chaos.Scoring); err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		a.writeReceiptError(w, r, err)
+		return
+	}
+	// scored exactly like processReceipt scores, the record just never leaves here
+	rec = a.withRetailerID(r.Context(), rec)
+	scored, err := newReceiptRecord(rec, a.ruleSet(r.Context()), a.campaigns(r.Context()), a.config().PointsExpiryInMonths, a.scoringNow())
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		a.writeReceiptError(w, r, err)
+		return
+	}
+	responseToClient := scoreResponse{
+		Points:         scored.Points,
+		RulesVersion:   scored.RulesVersion,
+		PointsExpireAt: scored.PointsExpireAt,
+		Breakdown:      append([]db.PointsComponent{}, scored.Breakdown...),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+)
+
+// Scorer scores receipts the way processing does, without a store or anything else the
+// service runs with, for tools that replay archived receipts offline (see cmd/replay)
+type Scorer struct {
+	Rules     *rules.RuleSet
+	Campaigns []db.Campaign
+	// receipts with more items are invalid, like processing answers them with a 413
+	MaxItems int
+	// when the receipts are scored, in the business timezone. Receipts without a
+	// timezone of their own were purchased in its location
+	Now time.Time
+}
+
+// Score scores a receipt body, JSON, XML or protobuf depending on contentType, as if it
+// was submitted now. retailerID is the id the retailer registry had for its retailer,
+// if any. The record's id is a fresh one.
+func (s Scorer) Score(body []byte, contentType, retailerID string) (db.ReceiptRecord, error) {
+	rec, err := bodyCodec(contentType).decodeReceipt(bytes.NewReader(body), s.MaxItems, s.Rules, s.Campaigns)
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("%w: %v", errInvalidReceipt, err)
+	}
+	rec.retailerID = retailerID
+	return newReceiptRecord(rec, s.Rules, s.Campaigns, 0, s.Now)
+}
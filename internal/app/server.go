@@ -0,0 +1,44 @@
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Server is the http.Server main runs the app with, listening on addr. The timeouts
+// keep slow or stalled clients from holding connections forever, and with H2C on
+// proxies can multiplex requests over one cleartext HTTP/2 connection.
+func (a *App) Server(addr string) *http.Server {
+	var handler http.Handler = a.Router()
+	if a.Config.H2C {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: a.Config.ServerIdleTimeoutInMs})
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: a.Config.ServerReadHeaderTimeoutInMs,
+		ReadTimeout:       a.Config.ServerReadTimeoutInMs,
+		WriteTimeout:      a.Config.ServerWriteTimeoutInMs,
+		IdleTimeout:       a.Config.ServerIdleTimeoutInMs,
+	}
+}
+
+// extendDeadlines gives a streaming response another server read and write timeout
+// from now. Handlers that run for as long as the client keeps up call it before every
+// chunk, so the timeouts still catch a client that stalls but not one that's just slow.
+func (a *App) extendDeadlines(rc *http.ResponseController) {
+	// errors only mean the writer can't set deadlines, e.g. a test recorder
+	rc.SetReadDeadline(deadline(a.Config.ServerReadTimeoutInMs))
+	rc.SetWriteDeadline(deadline(a.Config.ServerWriteTimeoutInMs))
+}
+
+// deadline is timeout from now, or none for a 0 timeout
+func deadline(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
@@ -0,0 +1,21 @@
+package app
+
+import (
+	"net/http"
+)
+
+// ShedLoad turns public API requests away with a 429 once MAX_IN_FLIGHT_REQUESTS of
+// them are in and IN_FLIGHT_QUEUE_SIZE more are waiting, rather than taking everything
+// and timing out on the store. Lookups (GET) may also use the LOOKUP_RESERVED_REQUESTS
+// slots kept for them, so balances and points still load while submissions are shed.
+func (a *App) ShedLoad(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := a.Requests.Acquire(r.Context(), r.Method == http.MethodGet || r.Method == http.MethodHead)
+		if err != nil {
+			a.writeStoreUnavailable(w, r, err)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
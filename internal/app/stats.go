@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+const (
+	defaultStatsDays      = 30
+	maxStatsDays          = 366
+	defaultStatsRetailers = 10
+	maxStatsRetailers     = 100
+	statsDateLayout       = "2006-01-02"
+)
+
+type dayStats struct {
+	Date     string `json:"date"`
+	Receipts int    `json:"receipts"`
+	Points   int    `json:"points"`
+}
+
+type retailerStats struct {
+	Retailer string `json:"retailer"`
+	Receipts int    `json:"receipts"`
+}
+
+type statsResponse struct {
+	Receipts      int             `json:"receipts"`
+	PointsAwarded int             `json:"pointsAwarded"`
+	AveragePoints float64         `json:"averagePoints"`
+	Days          []dayStats      `json:"days"`
+	TopRetailers  []retailerStats `json:"topRetailers"`
+}
+
+// statsDays lists the days between ?from= and ?to= (YYYY-MM-DD, UTC, both inclusive).
+// without them it's the last 30 days up to today
+func statsDays(r *http.Request, now time.Time) ([]string, error) {
+	from, err := parseOptionalDateParam(r, "from")
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseOptionalDateParam(r, "to")
+	if err != nil {
+		return nil, err
+	}
+	end := now.UTC().Truncate(24 * time.Hour)
+	if to != "" {
+		end, _ = time.Parse(statsDateLayout, to)
+	}
+	start := end.AddDate(0, 0, -(defaultStatsDays - 1))
+	if from != "" {
+		start, _ = time.Parse(statsDateLayout, from)
+	}
+	if start.After(end) {
+		return nil, fmt.Errorf("Error parsing from: %s is after %s", start.Format(statsDateLayout), end.Format(statsDateLayout))
+	}
+	if int(end.Sub(start)/(24*time.Hour)) >= maxStatsDays {
+		return nil, fmt.Errorf("Error parsing from: at most %d days can be asked for at once", maxStatsDays)
+	}
+	var days []string
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		days = append(days, day.Format(statsDateLayout))
+	}
+	return days, nil
+}
+
+// GetStatsHandler returns aggregates over the tenant's receipts: how many were processed
+// and the points awarded overall, receipts and points per day (?from=, ?to=) and the
+// retailers with the most receipts (?top=, default 10)
+func (a *App) GetStatsHandler(w http.ResponseWriter, r *http.Request) {
+	days, err := statsDays(r, a.now())
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgStatsRangeInvalid, maxStatsDays)
+		return
+	}
+	top, err := parseOptionalIntParam(r, "top")
+	if err != nil || (top != nil && (*top < 1 || *top > maxStatsRetailers)) {
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgTopOutOfRange, maxStatsRetailers)
+		return
+	}
+	topRetailers := defaultStatsRetailers
+	if top != nil {
+		topRetailers = *top
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	analytics, err := a.store(ctx).GetAnalytics(ctx, days, topRetailers)
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, codeInternal, msgInternal)
+		return
+	}
+	responseToClient := statsResponse{
+		Receipts:      analytics.Receipts,
+		PointsAwarded: analytics.PointsAwarded,
+		Days:          make([]dayStats, 0, len(analytics.Days)),
+		TopRetailers:  make([]retailerStats, 0, len(analytics.TopRetailers)),
+	}
+	// the average is over what receipts were scored with, flagged ones included, so it
+	// describes the receipts rather than the payouts
+	if analytics.Receipts > 0 {
+		responseToClient.AveragePoints = math.Round(float64(analytics.ScoredPoints)/float64(analytics.Receipts)*100) / 100
+	}
+	for _, day := range analytics.Days {
+		responseToClient.Days = append(responseToClient.Days, dayStats{Date: day.Date, Receipts: day.Receipts, Points: day.Points})
+	}
+	for _, retailer := range analytics.TopRetailers {
+		responseToClient.TopRetailers = append(responseToClient.TopRetailers, retailerStats{Retailer: retailer.Retailer, Receipts: retailer.Receipts})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/events"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+// streamedReceipt is the data of a receipt.processed server-sent event
+type streamedReceipt struct {
+	ID        string    `json:"id"`
+	Retailer  string    `json:"retailer"`
+	Points    int       `json:"points"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ReceiptEventsHandler streams the tenant's receipts as they're processed, as
+// server-sent events, for dashboards that would otherwise poll. It runs until the
+// client goes away or the server shuts down. A comment goes out every EVENT_STREAM_PING_IN_MS so proxies don't
+// take a quiet stream for a dead one.
+func (a *App) ReceiptEventsHandler(w http.ResponseWriter, r *http.Request) {
+	tenantID := tenant.FromContext(r.Context()).ID
+	sub, err := a.Stream.Subscribe(func(ev events.Event) bool {
+		return ev.Type == events.ReceiptProcessed && ev.Tenant == tenantID
+	})
+	if errors.Is(err, events.ErrTooManySubscribers) || errors.Is(err, events.ErrHubClosed) {
+		w.Header().Set("Retry-After", "5")
+		writeError(w, r, http.StatusServiceUnavailable, codeOverloaded, msgServiceBusy)
+		return
+	}
+	defer sub.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// nginx buffers responses unless told otherwise
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	a.extendDeadlines(rc)
+	// the comment gets the headers to the client now rather than with the first event
+	fmt.Fprint(w, ": connected\n\n")
+	rc.Flush()
+
+	ping := time.NewTicker(a.Config.EventStreamPingInMs)
+	defer ping.Stop()
+	for {
+		var err error
+		a.extendDeadlines(rc)
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case ev, ok := <-sub.C:
+			// the hub closed, the server is shutting down
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(streamedReceipt{ID: ev.ID, Retailer: ev.Retailer, Points: ev.Points, Timestamp: ev.Timestamp})
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			logging.Printf(r.Context(), "Error writing event stream, client likely went away: %v", err)
+			return
+		}
+	}
+}
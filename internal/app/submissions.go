@@ -0,0 +1,85 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+// how often a submission waiting for an identical one checks whether it's saved
+const submissionLockPollInterval = 25 * time.Millisecond
+
+// errSubmissionInProgress is an identical receipt still being processed when the
+// request ran out of time waiting for it
+var errSubmissionInProgress = errors.New("an identical receipt is still being processed")
+
+// submissionHash identifies what was submitted: the receipt as it's stored, its user
+// and retention class. Receipts too big to keep their items are told apart by their
+// item count and points too.
+func submissionHash(rec receipt, stored db.ReceiptRecord) (string, error) {
+	normalizeReceipt(&rec)
+	content, err := json.Marshal(rec)
+	if err != nil {
+		return "", fmt.Errorf("Error encoding receipt: %v", err)
+	}
+	sum := sha256.Sum256(fmt.Appendf(content, "|%s|%d|%d", stored.Retention, rec.itemCount(), stored.Points))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lockSubmission locks the content of a receipt about to be saved as stored, for
+// SUBMISSION_LOCK_IN_MS. When an identical receipt holds the lock it waits for that
+// one to be saved and returns it instead, or takes the lock over once its request gives
+// up. nil means the lock is stored's. The wait keeps the processing slot, it's over when
+// the other request is.
+func (a *App) lockSubmission(ctx context.Context, hash string, stored db.ReceiptRecord) (*db.ReceiptRecord, error) {
+	ticker := time.NewTicker(submissionLockPollInterval)
+	defer ticker.Stop()
+	for {
+		first, locked, err := a.tryLockSubmission(ctx, hash, stored.ID)
+		if err != nil || locked || first != nil {
+			return first, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errSubmissionInProgress
+		case <-ticker.C:
+		}
+	}
+}
+
+// tryLockSubmission takes the lock for id, or looks up the receipt holding it. Neither
+// when that one isn't saved yet.
+func (a *App) tryLockSubmission(ctx context.Context, hash, id string) (*db.ReceiptRecord, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.config().DbTimeoutInMs)
+	defer cancel()
+	holder, err := a.store(ctx).LockSubmission(ctx, hash, id, a.config().SubmissionLockInMs)
+	if err != nil || holder == "" {
+		return nil, err == nil, err
+	}
+	first, err := a.getReceipt(ctx, holder)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &first, false, nil
+}
+
+// unlockSubmission gives up the lock of a receipt that wasn't saved after all, so an
+// identical submission waiting on it (or a retry) goes ahead
+func (a *App) unlockSubmission(ctx context.Context, hash, id string) {
+	// the request's context may be what ran out, only its tenant is still needed
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), a.config().DbTimeoutInMs)
+	defer cancel()
+	if err := a.store(ctx).UnlockSubmission(ctx, hash, id); err != nil {
+		logging.Printf(ctx, "Error unlocking submission of unsaved receipt %s: %v", id, err)
+	}
+}
@@ -0,0 +1,220 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/jobs"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	// lets admin calls act on one tenant's data, the default tenant's without it
+	tenantIDHeader = "X-Tenant-ID"
+)
+
+// errQuotaExceeded is returned for receipts over one of their tenant's quotas
+var errQuotaExceeded = errors.New("receipt quota exceeded")
+
+// store is the store scoped to the tenant in ctx
+func (a *App) store(ctx context.Context) db.Store {
+	return a.Db.ForTenant(tenant.FromContext(ctx).ID)
+}
+
+// allTenants is every tenant whose data background work has to cover
+func (a *App) allTenants() []*tenant.Tenant {
+	if a.Tenants == nil {
+		return []*tenant.Tenant{tenant.Default}
+	}
+	return a.Tenants.All()
+}
+
+// forTenant makes a job act for a tenant, the one whose request submitted it
+func forTenant(t *tenant.Tenant, fn jobs.Func) jobs.Func {
+	return func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		return fn(tenant.NewContext(ctx, t), job)
+	}
+}
+
+// IdentifyTenant works out which tenant a request is for from its X-API-Key, which
+// its usage is counted under, and applies the tenant's rate limit. Without a tenants file every request is the
+// default tenant's and no key is needed.
+func (a *App) IdentifyTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := tenant.Default
+		ctx := r.Context()
+		if a.Tenants != nil && a.Tenants.Enabled() {
+			var ok bool
+			apiKey := r.Header.Get(apiKeyHeader)
+			if t, ok = a.Tenants.Authenticate(apiKey); !ok {
+				writeError(w, r, http.StatusUnauthorized, codeUnauthorized, msgAPIKeyInvalid)
+				return
+			}
+			ctx = withAPIKeyID(ctx, tenant.HashAPIKey(apiKey))
+		}
+		if a.RateLimiter != nil {
+			if ok, wait := a.RateLimiter.Allow(t, time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, r, http.StatusTooManyRequests, codeRateLimited, msgRateLimited)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(tenant.NewContext(ctx, t)))
+	})
+}
+
+// AdminTenant scopes an admin request to the tenant named in X-Tenant-ID
+func (a *App) AdminTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := tenant.Default
+		if id := r.Header.Get(tenantIDHeader); id != "" {
+			var ok bool
+			if a.Tenants != nil {
+				t, ok = a.Tenants.Get(id)
+			}
+			if !ok {
+				http.Error(w, "No tenant found for that id", http.StatusNotFound)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(tenant.NewContext(r.Context(), t)))
+	})
+}
+
+// quota counters outlive their period by a day so late hand backs don't start them over
+const (
+	quotaTTL        = 48 * time.Hour
+	monthlyQuotaTTL = 32 * 24 * time.Hour
+)
+
+// quota is one of a tenant's receipt quotas, for the period receipts are taken in
+type quota struct {
+	period string
+	limit  int
+	// the counter's name and how long it's kept
+	name string
+	ttl  time.Duration
+	// when the period ends and the quota frees up
+	resets time.Time
+}
+
+// quotas are the receipt quotas of the tenant in ctx for receipts taken at at
+func quotas(ctx context.Context, at time.Time) []quota {
+	t := tenant.FromContext(ctx)
+	at = at.UTC()
+	var qs []quota
+	if t.DailyReceiptQuota > 0 {
+		qs = append(qs, quota{
+			period: "daily",
+			limit:  t.DailyReceiptQuota,
+			name:   "receipts:" + at.Format("2006-01-02"),
+			ttl:    quotaTTL,
+			resets: time.Date(at.Year(), at.Month(), at.Day()+1, 0, 0, 0, 0, time.UTC),
+		})
+	}
+	if t.MonthlyReceiptQuota > 0 {
+		qs = append(qs, quota{
+			period: "monthly",
+			limit:  t.MonthlyReceiptQuota,
+			name:   "receipts:" + at.Format("2006-01"),
+			ttl:    monthlyQuotaTTL,
+			resets: time.Date(at.Year(), at.Month()+1, 1, 0, 0, 0, 0, time.UTC),
+		})
+	}
+	return qs
+}
+
+// quotaError is errQuotaExceeded for a quota that frees up at resets
+type quotaError struct {
+	period string
+	resets time.Time
+}
+
+func (e *quotaError) Error() string {
+	return e.period + " receipt quota exceeded"
+}
+
+func (e *quotaError) Is(target error) bool {
+	return target == errQuotaExceeded
+}
+
+// reserveQuota takes n receipts off every quota of the tenant in ctx and returns how
+// many of them fit, along with the error for the ones that didn't. Tenants without a
+// quota always get all n.
+func (a *App) reserveQuota(ctx context.Context, n int) (int, error, error) {
+	qs := quotas(ctx, a.now())
+	if len(qs) == 0 || n == 0 {
+		return n, nil, nil
+	}
+	allowed := n
+	var over error
+	for i, q := range qs {
+		used, err := a.store(ctx).AddUsage(ctx, q.name, n, q.ttl)
+		if err != nil {
+			a.handBackQuota(ctx, qs[:i], n)
+			return 0, nil, fmt.Errorf("Error reserving receipt quota: %w", err)
+		}
+		if fit := max(0, q.limit-(used-n)); fit < allowed {
+			allowed, over = fit, &quotaError{period: q.period, resets: q.resets}
+		}
+	}
+	// hand back what didn't fit so it doesn't count against later requests
+	a.handBackQuota(ctx, qs, n-allowed)
+	return allowed, over, nil
+}
+
+// takeQuota counts n receipts taken at at against the quotas without checking them,
+// for receipts that were taken already
+func (a *App) takeQuota(ctx context.Context, at time.Time, n int) error {
+	qs := quotas(ctx, at)
+	for i, q := range qs {
+		if _, err := a.store(ctx).AddUsage(ctx, q.name, n, q.ttl); err != nil {
+			a.handBackQuota(ctx, qs[:i], n)
+			return fmt.Errorf("Error counting receipts against the quota: %w", err)
+		}
+	}
+	return nil
+}
+
+// releaseQuota hands back reserved receipts that didn't get saved after all
+func (a *App) releaseQuota(ctx context.Context, n int) {
+	a.handBackQuota(ctx, quotas(ctx, a.now()), n)
+}
+
+func (a *App) handBackQuota(ctx context.Context, qs []quota, n int) {
+	if n <= 0 || len(qs) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), a.config().DbTimeoutInMs)
+	defer cancel()
+	for _, q := range qs {
+		if _, err := a.store(ctx).AddUsage(ctx, q.name, -n, q.ttl); err != nil {
+			logging.Printf(ctx, "Error handing back %d receipts of %s quota: %v", n, q.period, err)
+		}
+	}
+}
+
+// writeQuotaExceeded answers 429 when err is errQuotaExceeded and reports whether it
+// did. Retry-After is when the quota frees up, midnight UTC for the daily one.
+func (a *App) writeQuotaExceeded(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, errQuotaExceeded) {
+		return false
+	}
+	now := a.now().UTC()
+	resets := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	var qe *quotaError
+	if errors.As(err, &qe) {
+		resets = qe.resets
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(resets.Sub(now).Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests, codeQuotaExceeded, msgQuotaExceeded)
+	return true
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+// time.LoadLocation reads the zone database every call, loaded zones are kept here. only
+// names that loaded end up in it, so it's bounded by the zones that exist
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// businessLocation is the zone purchase dates and times are in when a receipt doesn't
+// say, BUSINESS_TIMEZONE
+func (a *App) businessLocation() *time.Location {
+	loc, err := loadLocation(a.config().BusinessTimezone)
+	if err != nil {
+		// Validate rejects zones that don't load, this only happens if the zone
+		// database changed underneath a running process
+		logging.Printf(context.Background(), "Error loading BUSINESS_TIMEZONE %q, using UTC: %v", a.config().BusinessTimezone, err)
+		return time.UTC
+	}
+	return loc
+}
+
+// now is the time on the app's clock
+func (a *App) now() time.Time {
+	if a.Clock == nil {
+		return time.Now()
+	}
+	return a.Clock.Now()
+}
+
+// scoringNow is now in the business timezone, what scoring compares purchase dates
+// and times against
+func (a *App) scoringNow() time.Time {
+	return a.now().In(a.businessLocation())
+}
+
+// receiptLocation is the zone a receipt's purchase date and time are in: its own
+// timezone (an IANA name like "America/Chicago") when it has one, business otherwise
+func receiptLocation(rec receipt, business *time.Location) (*time.Location, error) {
+	if rec.Timezone == "" {
+		return business, nil
+	}
+	// "" and "Local" would load the server's zone, which is what this is getting away from
+	if rec.Timezone == "Local" {
+		return nil, fmt.Errorf("Error parsing timezone: %q is not an IANA zone name", rec.Timezone)
+	}
+	loc, err := loadLocation(rec.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing timezone: %v", err)
+	}
+	return loc, nil
+}
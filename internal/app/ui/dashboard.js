@@ -0,0 +1,142 @@
+// The dashboard polls GET /admin/overview. Browsers signed in through OIDC send their
+// session cookie, without OIDC the admin token is asked for and kept in sessionStorage.
+"use strict";
+
+const refreshMs = 30000;
+const login = document.body.dataset.login === "true";
+// ?tenant=acme shows that tenant's receipts
+const tenant = new URLSearchParams(location.search).get("tenant");
+
+const $ = (id) => document.getElementById(id);
+
+function show(id, visible) {
+  $(id).hidden = !visible;
+}
+
+function say(text) {
+  $("message").textContent = text;
+  show("message", text !== "");
+}
+
+function text(id, value) {
+  $(id).textContent = value;
+}
+
+async function refresh() {
+  const headers = { Accept: "application/json" };
+  const token = sessionStorage.getItem("adminToken");
+  if (token) {
+    headers.Authorization = "Bearer " + token;
+  }
+  if (tenant) {
+    headers["X-Tenant-ID"] = tenant;
+  }
+  let resp;
+  try {
+    resp = await fetch("/admin/overview", { headers, credentials: "same-origin" });
+  } catch (err) {
+    say("The service can't be reached: " + err.message);
+    return;
+  }
+  if (resp.status === 401) {
+    show("dashboard", false);
+    if (login) {
+      location.assign("/admin/login?next=" + encodeURIComponent(location.pathname + location.search));
+      return;
+    }
+    sessionStorage.removeItem("adminToken");
+    say(token ? "That token was not accepted." : "");
+    show("token-form", true);
+    return;
+  }
+  if (resp.status === 403) {
+    show("dashboard", false);
+    say("Your roles don't include reading the admin API.");
+    return;
+  }
+  if (!resp.ok) {
+    say("The overview failed: " + resp.status + " " + (await resp.text()));
+    return;
+  }
+  say("");
+  show("token-form", false);
+  render(await resp.json());
+  show("dashboard", true);
+}
+
+function render(o) {
+  text("updated", "Updated " + new Date(o.generatedAt).toLocaleTimeString());
+  text("rules-version", o.rulesVersion || "default");
+
+  const up = o.store.status === "ok";
+  text("store-status", up ? "Healthy" : "Unavailable");
+  $("store-status").className = up ? "ok" : "down";
+  const breaker = o.store.breaker ? "breaker " + o.store.breaker.state : "";
+  text("store-detail", [o.store.error, breaker].filter(Boolean).join(", "));
+
+  const stats = o.store.stats || {};
+  const count = (n) => (n === undefined ? "–" : n.toLocaleString());
+  text("indexed-receipts", count(stats.indexedReceipts));
+  text("flagged-receipts", count(stats.flaggedReceipts));
+  text("expiring-lots", count(stats.expiringLots));
+  text("used-memory", stats.usedMemoryHuman || "–");
+
+  const buckets = o.pointsDistribution || [];
+  const most = Math.max(1, ...buckets.map((b) => b.receipts));
+  text("sampled", "newest " + o.sampled + " receipts");
+  const bars = $("distribution");
+  bars.replaceChildren();
+  for (const b of buckets) {
+    const label = document.createElement("span");
+    label.textContent = b.max === undefined ? b.min + "+" : b.min + "–" + b.max;
+    const bar = document.createElement("div");
+    bar.className = "bar";
+    bar.style.width = (100 * b.receipts) / most + "%";
+    const n = document.createElement("span");
+    n.className = "num";
+    n.textContent = b.receipts;
+    bars.append(label, bar, n);
+  }
+
+  const rows = $("recent");
+  rows.replaceChildren();
+  for (const r of o.recentReceipts) {
+    const tr = document.createElement("tr");
+    const cells = [
+      [new Date(r.createdAt).toLocaleString()],
+      [r.retailer],
+      [r.purchaseDate],
+      [r.points, "num"],
+      [r.status || "awarded"],
+      [r.id, "id"],
+    ];
+    for (const [value, cls] of cells) {
+      const td = document.createElement("td");
+      td.textContent = value;
+      if (cls) {
+        td.className = cls;
+      }
+      tr.append(td);
+    }
+    rows.append(tr);
+  }
+}
+
+$("token-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  sessionStorage.setItem("adminToken", $("token").value);
+  $("token").value = "";
+  refresh();
+});
+
+if (login) {
+  show("logout", true);
+  $("logout").addEventListener("click", async () => {
+    await fetch("/admin/logout", { method: "POST", credentials: "same-origin" });
+    show("dashboard", false);
+    say("Signed out.");
+  });
+}
+
+refresh();
+setInterval(refresh, refreshMs);
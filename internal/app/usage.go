@@ -0,0 +1,273 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+)
+
+// design decision: billing usage is a pair of counters (receipts, points) per tenant and
+// UTC day, and again per API key. they're bumped after receipts are saved rather than in
+// the save's transaction, so a store error loses the count instead of the receipt.
+// months are summed from their days when they're read
+const (
+	usageTTL = 400 * 24 * time.Hour
+	// how much of its SHA-256 an API key is reported and logged under, enough to tell a
+	// tenant's keys apart without handing out the whole hash
+	apiKeyIDLength = 12
+)
+
+type apiKeyIDKey struct{}
+
+// apiKeyID is the id of the API key the request came with, "" without tenants
+func apiKeyID(ctx context.Context) string {
+	id, _ := ctx.Value(apiKeyIDKey{}).(string)
+	return id
+}
+
+func withAPIKeyID(ctx context.Context, keyHash string) context.Context {
+	return context.WithValue(ctx, apiKeyIDKey{}, keyHash[:apiKeyIDLength])
+}
+
+func usageName(day, keyID, counter string) string {
+	if keyID == "" {
+		return "billing:" + day + ":" + counter
+	}
+	return "billing:" + day + ":key:" + keyID + ":" + counter
+}
+
+// awardedPoints are the points recs were awarded, flagged receipts get theirs counted
+// once they're approved
+func awardedPoints(recs ...db.ReceiptRecord) int {
+	points := 0
+	for _, rec := range recs {
+		if rec.Status == "" {
+			points += rec.Points
+		}
+	}
+	return points
+}
+
+// recordUsage counts receipts and points awarded towards the usage of the tenant in ctx
+// on at's UTC day, and of the API key the request came with. The receipts are saved by
+// the time it's called, so it's best effort: a store error is logged and they go
+// uncounted.
+func (a *App) recordUsage(ctx context.Context, at time.Time, receipts, points int) {
+	if receipts == 0 && points == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), a.config().DbTimeoutInMs)
+	defer cancel()
+	day := at.UTC().Format(statsDateLayout)
+	keyIDs := []string{""}
+	if id := apiKeyID(ctx); id != "" {
+		keyIDs = append(keyIDs, id)
+	}
+	for _, keyID := range keyIDs {
+		for _, counter := range []struct {
+			name string
+			n    int
+		}{{"receipts", receipts}, {"points", points}} {
+			if counter.n == 0 {
+				continue
+			}
+			if _, err := a.store(ctx).AddUsage(ctx, usageName(day, keyID, counter.name), counter.n, usageTTL); err != nil {
+				logging.Printf(ctx, "Error recording usage of %d receipts and %d points: %v", receipts, points, err)
+				return
+			}
+		}
+	}
+}
+
+// EnforceQuota turns submissions away with a 429 once the tenant's daily or monthly
+// receipt quota is used up, before their bodies are read. Processing still reserves
+// quota receipt by receipt, batches can be partly over it. When the store can't say,
+// the request goes ahead and processing decides.
+func (a *App) EnforceQuota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qs := quotas(r.Context(), a.now())
+		if len(qs) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		names := make([]string, len(qs))
+		for i, q := range qs {
+			names[i] = q.name
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+		used, err := a.store(ctx).GetUsage(ctx, names)
+		cancel()
+		if err != nil {
+			logging.Printf(r.Context(), "Error checking receipt quota, leaving it to processing: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, q := range qs {
+			if used[q.name] >= q.limit {
+				a.writeQuotaExceeded(w, r, &quotaError{period: q.period, resets: q.resets})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type keyUsage struct {
+	APIKey   string `json:"apiKey"`
+	Receipts int    `json:"receipts"`
+	Points   int    `json:"points"`
+}
+
+type periodUsage struct {
+	Period   string     `json:"period"`
+	Receipts int        `json:"receipts"`
+	Points   int        `json:"points"`
+	Keys     []keyUsage `json:"keys,omitempty"`
+}
+
+type tenantUsage struct {
+	TenantID            string        `json:"tenantId"`
+	Name                string        `json:"name"`
+	DailyReceiptQuota   int           `json:"dailyReceiptQuota,omitempty"`
+	MonthlyReceiptQuota int           `json:"monthlyReceiptQuota,omitempty"`
+	Receipts            int           `json:"receipts"`
+	Points              int           `json:"points"`
+	Periods             []periodUsage `json:"periods"`
+}
+
+type usageResponse struct {
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Tenants []tenantUsage `json:"tenants"`
+}
+
+var usageCSVHeader = []string{"tenant", "period", "apiKey", "receipts", "points"}
+
+// tenantUsage reads a tenant's usage over days, per day or per month (YYYY-MM) with
+// byMonth. Keys are the tenant's current ones, a key rotated out still counts in the
+// tenant's totals but isn't listed anymore.
+func (a *App) tenantUsage(ctx context.Context, t *tenant.Tenant, days []string, byMonth bool) (tenantUsage, error) {
+	keyIDs := make([]string, len(t.APIKeyHashes))
+	for i, hash := range t.APIKeyHashes {
+		keyIDs[i] = hash[:apiKeyIDLength]
+	}
+	var names []string
+	for _, day := range days {
+		for _, keyID := range append([]string{""}, keyIDs...) {
+			names = append(names, usageName(day, keyID, "receipts"), usageName(day, keyID, "points"))
+		}
+	}
+	ctx = tenant.NewContext(ctx, t)
+	used, err := a.store(ctx).GetUsage(ctx, names)
+	if err != nil {
+		return tenantUsage{}, err
+	}
+
+	usage := tenantUsage{
+		TenantID:            t.ID,
+		Name:                t.Name,
+		DailyReceiptQuota:   t.DailyReceiptQuota,
+		MonthlyReceiptQuota: t.MonthlyReceiptQuota,
+		Periods:             []periodUsage{},
+	}
+	for _, day := range days {
+		period := day
+		if byMonth {
+			period = day[:len("2006-01")]
+		}
+		if n := len(usage.Periods); n == 0 || usage.Periods[n-1].Period != period {
+			usage.Periods = append(usage.Periods, periodUsage{Period: period, Keys: make([]keyUsage, len(keyIDs))})
+			for i, keyID := range keyIDs {
+				usage.Periods[n].Keys[i].APIKey = keyID
+			}
+		}
+		p := &usage.Periods[len(usage.Periods)-1]
+		receipts, points := used[usageName(day, "", "receipts")], used[usageName(day, "", "points")]
+		p.Receipts += receipts
+		p.Points += points
+		usage.Receipts += receipts
+		usage.Points += points
+		for i, keyID := range keyIDs {
+			p.Keys[i].Receipts += used[usageName(day, keyID, "receipts")]
+			p.Keys[i].Points += used[usageName(day, keyID, "points")]
+		}
+	}
+	return usage, nil
+}
+
+// UsageHandler reports receipts submitted and points awarded per tenant and API key
+// between ?from= and ?to= (YYYY-MM-DD, UTC, inclusive, the last 30 days without them),
+// per day or per calendar month (?by=day|month), as JSON or CSV (?format=json|csv) for
+// billing. Every tenant is reported unless X-Tenant-ID names one.
+func (a *App) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	days, err := statsDays(r, a.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var byMonth bool
+	switch by := r.URL.Query().Get("by"); by {
+	case "", "day":
+	case "month":
+		byMonth = true
+	default:
+		http.Error(w, "by must be day or month", http.StatusBadRequest)
+		return
+	}
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+	tenants := []*tenant.Tenant{tenant.FromContext(r.Context())}
+	if r.Header.Get(tenantIDHeader) == "" {
+		tenants = a.allTenants()
+	}
+
+	responseToClient := usageResponse{From: days[0], To: days[len(days)-1], Tenants: make([]tenantUsage, 0, len(tenants))}
+	for _, t := range tenants {
+		usage, err := a.tenantUsage(r.Context(), t, days, byMonth)
+		if err != nil {
+			logging.Printf(r.Context(), "Error reading usage of tenant %q: %v", t.ID, err)
+			if a.writeStoreUnavailable(w, r, err) {
+				return
+			}
+			http.Error(w, "Error reading usage", http.StatusInternalServerError)
+			return
+		}
+		responseToClient.Tenants = append(responseToClient.Tenants, usage)
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		out := csv.NewWriter(w)
+		out.Write(usageCSVHeader)
+		for _, t := range responseToClient.Tenants {
+			for _, p := range t.Periods {
+				// the tenant's totals have no key
+				out.Write([]string{t.TenantID, p.Period, "", strconv.Itoa(p.Receipts), strconv.Itoa(p.Points)})
+				for _, k := range p.Keys {
+					out.Write([]string{t.TenantID, p.Period, k.APIKey, strconv.Itoa(k.Receipts), strconv.Itoa(k.Points)})
+				}
+			}
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			logging.Printf(r.Context(), "Error writing usage, client likely went away: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	// set by the auth gateway in front of the service. it wins over a userId in the
+	// payload so a client can't credit points to somebody else's account
+	userIDHeader = "X-User-ID"
+
+	defaultUserHistoryLimit = 10
+	maxUserHistoryLimit     = 100
+	maxUserIDLen            = 128
+)
+
+// isValidUserID keeps user ids to characters that are safe inside Redis keys and URLs
+func isValidUserID(userID string) bool {
+	if userID == "" || len(userID) > maxUserIDLen {
+		return false
+	}
+	for _, c := range userID {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlnum && c != '-' && c != '_' && c != '.' && c != '@' {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveUserID settles who a receipt belongs to: the authenticated user when there is
+// one, the payload's userId otherwise, nobody when neither is set
+func resolveUserID(r *http.Request, rec *receipt) error {
+	if userID := r.Header.Get(userIDHeader); userID != "" {
+		rec.UserID = userID
+	}
+	if rec.UserID != "" && !isValidUserID(rec.UserID) {
+		return fmt.Errorf("Invalid user id %q", rec.UserID)
+	}
+	return nil
+}
+
+type userReceipt struct {
+	ID             string     `json:"id"`
+	Retailer       string     `json:"retailer"`
+	PurchaseDate   string     `json:"purchaseDate"`
+	Points         int        `json:"points"`
+	PointsExpireAt *time.Time `json:"pointsExpireAt,omitempty"`
+	Status         string     `json:"status,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+}
+
+type userPointsResponse struct {
+	UserID   string        `json:"userId"`
+	Balance  int           `json:"balance"`
+	Expired  int           `json:"expired"`
+	Receipts []userReceipt `json:"receipts"`
+	// the latest points operators credited or clawed back, they're in the balance
+	Adjustments []pointsAdjustment `json:"adjustments"`
+}
+
+// GetUserPointsHandler returns a user's running points balance, how many of their
+// points expired, their latest receipts and their latest adjustments (?limit= of each,
+// default 10)
+func (a *App) GetUserPointsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "id")
+	if !isValidUserID(userID) {
+		writeError(w, r, http.StatusNotFound, codeUserNotFound, msgUserNotFound)
+		return
+	}
+	limit, err := parseOptionalIntParam(r, "limit")
+	if err != nil || (limit != nil && (*limit < 1 || *limit > maxUserHistoryLimit)) {
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, msgLimitOutOfRange, maxUserHistoryLimit)
+		return
+	}
+	historyLimit := defaultUserHistoryLimit
+	if limit != nil {
+		historyLimit = *limit
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().DbTimeoutInMs)
+	defer cancel()
+	userPoints, err := a.store(ctx).GetUserPoints(ctx, userID, historyLimit)
+	var adjustments []db.Adjustment
+	if err == nil {
+		adjustments, err = a.store(ctx).ListAdjustments(ctx, userID, "", historyLimit)
+	}
+	if err != nil {
+		logging.Printf(r.Context(), "%v", err)
+		if a.writeStoreUnavailable(w, r, err) {
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, codeInternal, msgInternal)
+		return
+	}
+	responseToClient := userPointsResponse{
+		UserID:      userPoints.UserID,
+		Balance:     userPoints.Balance,
+		Expired:     userPoints.Expired,
+		Receipts:    make([]userReceipt, 0, len(userPoints.Receipts)),
+		Adjustments: newPointsAdjustments(adjustments),
+	}
+	for _, rec := range userPoints.Receipts {
+		responseToClient.Receipts = append(responseToClient.Receipts, userReceipt{
+			ID:             rec.ID,
+			Retailer:       rec.Retailer,
+			PurchaseDate:   rec.PurchaseDate,
+			Points:         rec.Points,
+			PointsExpireAt: rec.PointsExpireAt,
+			Status:         rec.Status,
+			CreatedAt:      rec.CreatedAt,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseToClient); err != nil {
+		logging.Printf(r.Context(), "Error encoding client response: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/metrics"
+)
+
+const (
+	// clients can ask for a version with Accept: application/vnd.receipts.v1+json. the
+	// version in the path wins, the header matters for the legacy unversioned paths
+	versionedMediaPrefix = "application/vnd.receipts.v"
+	versionedMediaSuffix = "+json"
+	apiVersionHeader     = "API-Version"
+
+	latestAPIVersion = 1
+)
+
+// supportedAPIVersions are the versions there are routes for. a version stays in here
+// (and its routes mounted) for as long as clients are allowed to use it
+var supportedAPIVersions = map[int]bool{1: true}
+
+var legacyAPIRequests = metrics.NewInt("api_legacy_requests")
+
+type apiVersionKey struct{}
+
+// apiVersion is the API version a request was routed to, handlers branch on it once
+// versions differ in their payloads
+func apiVersion(ctx context.Context) int {
+	if v, ok := ctx.Value(apiVersionKey{}).(int); ok {
+		return v
+	}
+	return latestAPIVersion
+}
+
+// acceptedAPIVersion returns the version asked for in the Accept header, 0 when the
+// header doesn't ask for one
+func acceptedAPIVersion(r *http.Request) (int, error) {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil || !strings.HasPrefix(mediaType, versionedMediaPrefix) || !strings.HasSuffix(mediaType, versionedMediaSuffix) {
+			continue
+		}
+		raw := strings.TrimSuffix(strings.TrimPrefix(mediaType, versionedMediaPrefix), versionedMediaSuffix)
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return 0, fmt.Errorf("Error parsing API version in Accept header %q: %v", accepted, err)
+		}
+		return v, nil
+	}
+	return 0, nil
+}
+
+func withAPIVersion(w http.ResponseWriter, r *http.Request, version int) *http.Request {
+	w.Header().Set(apiVersionHeader, strconv.Itoa(version))
+	return r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version))
+}
+
+// APIVersion serves the routes mounted under /v<version>. An Accept header asking for
+// another version is a 406, the path is the version.
+func (a *App) APIVersion(version int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			accepted, err := acceptedAPIVersion(r)
+			if err != nil || (accepted != 0 && accepted != version) {
+				writeError(w, r, http.StatusNotAcceptable, codeNotAcceptable, msgAPIVersionMismatch, version)
+				return
+			}
+			next.ServeHTTP(w, withAPIVersion(w, r, version))
+		})
+	}
+}
+
+// LegacyAPI serves the unversioned paths from before /v1. They answer with the version
+// asked for in Accept (v1 without one) and tell clients where the versioned route is.
+func (a *App) LegacyAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, err := acceptedAPIVersion(r)
+		if version == 0 && err == nil {
+			version = 1
+		}
+		if err != nil || !supportedAPIVersions[version] {
+			writeError(w, r, http.StatusNotAcceptable, codeNotAcceptable, msgAPIVersionUnsupported)
+			return
+		}
+		legacyAPIRequests.Add(1)
+		successor := fmt.Sprintf("/v%d%s", version, r.URL.Path)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		next.ServeHTTP(w, withAPIVersion(w, r, version))
+	})
+}
@@ -0,0 +1,279 @@
+// Package archive keeps the original artifacts behind stored receipts, the body as it
+// was submitted and any uploaded image, in an S3-compatible bucket. Redis only holds
+// receipts for as long as their retention class says, the bucket is where they're kept
+// for compliance (7 years, see the README for setting up the bucket's retention).
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+const (
+	queueSize  = 1024
+	maxBackoff = time.Minute
+	// what every archived body is signed as, S3 wants the payload hash in a header
+	contentHashHeader = "X-Amz-Content-Sha256"
+	tenantHeader      = "X-Amz-Meta-Tenant"
+)
+
+// Object is one artifact to upload
+type Object struct {
+	Key         string
+	ContentType string
+	Body        []byte
+	Tenant      string
+}
+
+// Stats is what the archiver has done since boot
+type Stats struct {
+	Queued   int   `json:"queued"`
+	Archived int64 `json:"archived"`
+	Failed   int64 `json:"failed"`
+	Dropped  int64 `json:"dropped"`
+}
+
+// Archiver uploads objects from a buffered queue on background workers, so a slow or
+// unavailable bucket never holds up receipt processing
+type Archiver struct {
+	client      *http.Client
+	credentials aws.CredentialsProvider
+	signer      *v4.Signer
+	region      string
+	// base is the bucket's URL, keys are appended to its path
+	base       *url.URL
+	prefix     string
+	maxRetries int
+	timeout    time.Duration
+	backoff    time.Duration
+	queue      chan Object
+
+	archived atomic.Int64
+	failed   atomic.Int64
+	dropped  atomic.Int64
+}
+
+// New resolves AWS credentials the standard way (environment, shared config, instance
+// role) and returns an Archiver for cfg.ArchiveBucket
+func New(ctx context.Context, cfg config.Config) (*Archiver, error) {
+	var loadOpts []func(*awsconfig.LoadOptions) error
+	if cfg.ArchiveRegion != "" {
+		loadOpts = append(loadOpts, awsconfig.WithRegion(cfg.ArchiveRegion))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading AWS config: %v", err)
+	}
+	region := awsCfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return newArchiver(cfg, awsCfg.Credentials, region)
+}
+
+func newArchiver(cfg config.Config, credentials aws.CredentialsProvider, region string) (*Archiver, error) {
+	base, err := bucketURL(cfg.ArchiveEndpoint, cfg.ArchiveBucket, region)
+	if err != nil {
+		return nil, err
+	}
+	return &Archiver{
+		client:      &http.Client{},
+		credentials: credentials,
+		// S3 signs the path as sent, not escaped a second time like other services
+		signer:     v4.NewSigner(func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true }),
+		region:     region,
+		base:       base,
+		prefix:     cfg.ArchivePrefix,
+		maxRetries: cfg.ArchiveMaxRetries,
+		timeout:    cfg.ArchiveTimeoutInMs,
+		backoff:    cfg.ArchiveBackoffInMs,
+		queue:      make(chan Object, queueSize),
+	}, nil
+}
+
+// bucketURL is the virtual-hosted AWS URL for the bucket, or a path-style one on
+// endpoint. MinIO and most other S3-compatible stores only do path-style.
+func bucketURL(endpoint, bucket, region string) (*url.URL, error) {
+	if endpoint == "" {
+		return url.Parse(fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", bucket, region))
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("ARCHIVE_ENDPOINT must be a URL like http://minio:9000, got %q", endpoint)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/" + bucket + "/"
+	return base, nil
+}
+
+// Start runs the upload workers until ctx is done
+func (a *Archiver) Start(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go a.work(ctx)
+	}
+}
+
+// Receipt queues the receipt as submitted, stored under "<prefix><id>/receipt.<ext>"
+func (a *Archiver) Receipt(tenantID, id, contentType string, body []byte) {
+	a.enqueue(Object{Key: a.key(id, "receipt", contentType), ContentType: contentType, Body: body, Tenant: tenantID})
+}
+
+// Correction queues a corrected receipt as submitted, stored under
+// "<prefix><id>/revision-<n>.<ext>". The original submission is revision 1.
+func (a *Archiver) Correction(tenantID, id string, revision int, contentType string, body []byte) {
+	a.enqueue(Object{Key: a.key(id, "revision-"+strconv.Itoa(revision), contentType), ContentType: contentType, Body: body, Tenant: tenantID})
+}
+
+// Image queues the image a receipt was read from, stored under "<prefix><id>/image.<ext>"
+func (a *Archiver) Image(tenantID, id, contentType string, body []byte) {
+	a.enqueue(Object{Key: a.key(id, "image", contentType), ContentType: contentType, Body: body, Tenant: tenantID})
+}
+
+// Report queues a scheduled summary report, stored under "<prefix>reports/<name>.<ext>"
+func (a *Archiver) Report(name, contentType string, body []byte) {
+	a.enqueue(Object{Key: a.prefix + "reports/" + name + extension(contentType), ContentType: contentType, Body: body})
+}
+
+func (a *Archiver) Stats() Stats {
+	return Stats{
+		Queued:   len(a.queue),
+		Archived: a.archived.Load(),
+		Failed:   a.failed.Load(),
+		Dropped:  a.dropped.Load(),
+	}
+}
+
+// key names objects by receipt id alone, ids are UUIDs so they're unique across tenants
+func (a *Archiver) key(id, name, contentType string) string {
+	return a.prefix + id + "/" + name + extension(contentType)
+}
+
+func extension(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch strings.TrimSpace(mediaType) {
+	case "application/json":
+		return ".json"
+	case "application/xml", "text/xml":
+		return ".xml"
+	case "application/x-protobuf", "application/protobuf":
+		return ".pb"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "application/pdf":
+		return ".pdf"
+	}
+	return ""
+}
+
+// enqueue doesn't block. design decision: same as webhooks, a full queue drops (and
+// logs and counts) rather than slowing receipt processing down. The receipt itself is
+// still stored, and the dropped counter is what to alert on.
+func (a *Archiver) enqueue(obj Object) {
+	select {
+	case a.queue <- obj:
+	default:
+		a.dropped.Add(1)
+		logging.Warnf(context.Background(), "Archive queue full, dropping %s", obj.Key)
+	}
+}
+
+func (a *Archiver) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case obj := <-a.queue:
+			a.upload(ctx, obj)
+		}
+	}
+}
+
+// upload PUTs until the bucket answers 2xx, backing off exponentially between
+// attempts, and gives up after maxRetries retries
+func (a *Archiver) upload(ctx context.Context, obj Object) {
+	backoff := a.backoff
+	for attempt := 0; ; attempt++ {
+		err := a.put(ctx, obj)
+		if err == nil {
+			a.archived.Add(1)
+			return
+		}
+		if attempt >= a.maxRetries {
+			a.failed.Add(1)
+			logging.Errorf(ctx, "Giving up on archiving %s after %d attempts: %v", obj.Key, attempt+1, err)
+			return
+		}
+		logging.Warnf(ctx, "Archiving %s failed, retrying in %v: %v", obj.Key, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (a *Archiver) put(ctx context.Context, obj Object) error {
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	target := a.base.JoinPath(obj.Key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target.String(), bytes.NewReader(obj.Body))
+	if err != nil {
+		return fmt.Errorf("Error building archive request: %v", err)
+	}
+	sum := sha256.Sum256(obj.Body)
+	payloadHash := hex.EncodeToString(sum[:])
+	if obj.ContentType != "" {
+		req.Header.Set("Content-Type", obj.ContentType)
+	}
+	if obj.Tenant != "" {
+		req.Header.Set(tenantHeader, obj.Tenant)
+	}
+	resp, err := a.do(ctx, req, payloadHash)
+	if err != nil {
+		return fmt.Errorf("Error uploading to archive: %v", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do signs req, whose body hashes to payloadHash, and sends it. Anything but a 2xx is
+// an error, otherwise the caller closes the response's body.
+func (a *Archiver) do(ctx context.Context, req *http.Request, payloadHash string) (*http.Response, error) {
+	req.Header.Set(contentHashHeader, payloadHash)
+	creds, err := a.credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving AWS credentials: %v", err)
+	}
+	if err := a.signer.SignHTTP(ctx, creds, req, payloadHash, "s3", a.region, time.Now()); err != nil {
+		return nil, fmt.Errorf("Error signing archive request: %v", err)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Archive responded with status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
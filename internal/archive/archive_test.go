@@ -0,0 +1,172 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+type upload struct {
+	path, contentType, tenant, authorization, body string
+}
+
+// fakeBucket answers the first failures PUTs with a 503 and records the rest
+func fakeBucket(t *testing.T, failures int) (*httptest.Server, chan upload) {
+	uploads := make(chan upload, 10)
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		uploads <- upload{
+			path:          r.Method + " " + r.URL.Path,
+			contentType:   r.Header.Get("Content-Type"),
+			tenant:        r.Header.Get(tenantHeader),
+			authorization: r.Header.Get("Authorization"),
+			body:          string(body),
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, uploads
+}
+
+func testArchiver(t *testing.T, endpoint string) *Archiver {
+	creds := aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "key", SecretAccessKey: "secret"}, nil
+	})
+	a, err := newArchiver(config.Config{
+		ArchiveBucket:      "receipts",
+		ArchiveEndpoint:    endpoint,
+		ArchivePrefix:      "raw/",
+		ArchiveMaxRetries:  2,
+		ArchiveTimeoutInMs: time.Second,
+		ArchiveBackoffInMs: time.Millisecond,
+	}, creds, "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	a.Start(ctx, 1)
+	return a
+}
+
+func receive(t *testing.T, uploads chan upload) upload {
+	t.Helper()
+	select {
+	case u := <-uploads:
+		return u
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was uploaded")
+		return upload{}
+	}
+}
+
+func TestUploadsAreSignedAndKeyedByReceiptID(t *testing.T) {
+	server, uploads := fakeBucket(t, 0)
+	a := testArchiver(t, server.URL)
+
+	a.Receipt("acme", "r1", "application/xml; charset=utf-8", []byte("<receipt/>"))
+	got := receive(t, uploads)
+	want := upload{path: "PUT /receipts/raw/r1/receipt.xml", contentType: "application/xml; charset=utf-8", tenant: "acme", body: "<receipt/>"}
+	if !strings.HasPrefix(got.authorization, "AWS4-HMAC-SHA256 Credential=key/") {
+		t.Errorf("Authorization: got %q, want a SigV4 signature", got.authorization)
+	}
+	got.authorization = ""
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	a.Image("", "r1", "image/png", []byte("png"))
+	if got := receive(t, uploads); got.path != "PUT /receipts/raw/r1/image.png" || got.tenant != "" {
+		t.Errorf("image: got %+v, want it next to the receipt and no tenant for the default one", got)
+	}
+
+	a.Report("daily-2024-01-14", "application/json", []byte("{}"))
+	if got := receive(t, uploads); got.path != "PUT /receipts/raw/reports/daily-2024-01-14.json" {
+		t.Errorf("report: got %+v, want it under reports/", got)
+	}
+}
+
+func TestUploadsAreRetried(t *testing.T) {
+	server, uploads := fakeBucket(t, 2)
+	a := testArchiver(t, server.URL)
+
+	a.Receipt("", "r1", "application/json", []byte("{}"))
+	if got := receive(t, uploads); got.body != "{}" {
+		t.Errorf("got %+v, want the receipt after two failures", got)
+	}
+	// the counter moves once the response is in, just after the bucket saw the upload
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats().Archived != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := a.Stats(); stats.Archived != 1 || stats.Failed != 0 {
+		t.Errorf("stats: got %+v, want 1 archived", stats)
+	}
+}
+
+func TestListAndGet(t *testing.T) {
+	objects := map[string]string{"raw/r1/receipt.json": "{}", "raw/r1/revision-2.json": `{"total": "1.00"}`, "raw/r2/receipt.xml": "<receipt/>"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		q := r.URL.Query()
+		if r.URL.Path == "/receipts/" && q.Get("list-type") == "2" && q.Get("prefix") == "raw/" {
+			// two keys on the first page, the rest on the second
+			if q.Get("continuation-token") == "" {
+				io.WriteString(w, `<ListBucketResult><Contents><Key>raw/r1/receipt.json</Key></Contents><Contents><Key>raw/r1/revision-2.json</Key></Contents><IsTruncated>true</IsTruncated><NextContinuationToken>page 2</NextContinuationToken></ListBucketResult>`)
+				return
+			}
+			io.WriteString(w, `<ListBucketResult><Contents><Key>raw/r2/receipt.xml</Key></Contents><IsTruncated>false</IsTruncated></ListBucketResult>`)
+			return
+		}
+		body, ok := objects[strings.TrimPrefix(r.URL.Path, "/receipts/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	a := testArchiver(t, server.URL)
+	ctx := context.Background()
+
+	var keys []string
+	for continuation := ""; ; {
+		page, next, err := a.List(ctx, continuation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, page...)
+		if next == "" {
+			break
+		}
+		continuation = next
+	}
+	if got := strings.Join(keys, ","); got != "r1/receipt.json,r1/revision-2.json,r2/receipt.xml" {
+		t.Errorf("keys: got %s", got)
+	}
+	if body, err := a.Get(ctx, "r2/receipt.xml"); err != nil || string(body) != "<receipt/>" {
+		t.Errorf("get: got %q, %v", body, err)
+	}
+	if _, err := a.Get(ctx, "r3/receipt.json"); err == nil {
+		t.Error("get of a missing key didn't fail")
+	}
+}
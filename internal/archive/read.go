@@ -0,0 +1,83 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// the payload hash of a request without a body
+var emptyPayloadHash = func() string {
+	sum := sha256.Sum256(nil)
+	return hex.EncodeToString(sum[:])
+}()
+
+// listBucketResult is the part of an S3 ListObjectsV2 answer List needs
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List is a page of the archived keys, in lexical order and without the prefix, and
+// the continuation to pass to get the next page, "" after the last one. The first page
+// is continuation "".
+func (a *Archiver) List(ctx context.Context, continuation string) ([]string, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	query := url.Values{"list-type": {"2"}, "prefix": {a.prefix}}
+	if continuation != "" {
+		query.Set("continuation-token", continuation)
+	}
+	target := *a.base
+	target.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error building archive request: %v", err)
+	}
+	resp, err := a.do(ctx, req, emptyPayloadHash)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error listing the archive: %v", err)
+	}
+	defer resp.Body.Close()
+	var result listBucketResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", fmt.Errorf("Error decoding the archive listing: %v", err)
+	}
+	keys := make([]string, 0, len(result.Contents))
+	for _, obj := range result.Contents {
+		keys = append(keys, strings.TrimPrefix(obj.Key, a.prefix))
+	}
+	if !result.IsTruncated {
+		return keys, "", nil
+	}
+	return keys, result.NextContinuationToken, nil
+}
+
+// Get reads the object at key, under the prefix
+func (a *Archiver) Get(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.base.JoinPath(a.prefix+key).String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error building archive request: %v", err)
+	}
+	resp, err := a.do(ctx, req, emptyPayloadHash)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s from the archive: %v", key, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s from the archive: %v", key, err)
+	}
+	return body, nil
+}
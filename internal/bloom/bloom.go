@@ -0,0 +1,89 @@
+// Package bloom is a Bloom filter: a fixed-size set of keys that answers "definitely
+// not added" or "maybe added", the latter wrong at a rate that depends on its size.
+// Bits are laid out the way Redis lays out a string's bits (SETBIT, GETBIT), so a filter
+// can be shared through a Redis string and merged back in with Merge.
+package bloom
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+// Filter is a Bloom filter. It's not safe for concurrent use, callers lock around it.
+type Filter struct {
+	bits   []byte
+	m      uint64
+	hashes int
+}
+
+// Size is the number of bits and hashes for a filter holding capacity keys that's
+// wrong about falsePositiveRate of the keys it never saw, once it's full
+func Size(capacity int, falsePositiveRate float64) (uint64, int) {
+	n := math.Max(float64(capacity), 1)
+	m := math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / n * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return uint64(m), k
+}
+
+// New is an empty filter of m bits (at least 8) checking hashes bits per key
+func New(m uint64, hashes int) *Filter {
+	if m < 8 {
+		m = 8
+	}
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &Filter{bits: make([]byte, (m+7)/8), m: m, hashes: hashes}
+}
+
+// Positions are the bits key sets, the same for every filter of the same size
+func (f *Filter) Positions(key string) []uint64 {
+	// double hashing, the two halves of one 128 bit hash stand in for k hashes
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:]) | 1
+	positions := make([]uint64, f.hashes)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % f.m
+	}
+	return positions
+}
+
+// Add adds key and returns the bits it set
+func (f *Filter) Add(key string) []uint64 {
+	positions := f.Positions(key)
+	for _, p := range positions {
+		f.bits[p/8] |= 0x80 >> (p % 8)
+	}
+	return positions
+}
+
+// Test is false when key was definitely never added
+func (f *Filter) Test(key string) bool {
+	for _, p := range f.Positions(key) {
+		if f.bits[p/8]&(0x80>>(p%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge adds every key another filter of the same size added, given its bits. Bits past
+// the end of the filter are ignored, a shorter bitmap (Redis trims trailing zero bytes
+// it never wrote) only merges what it has.
+func (f *Filter) Merge(bits []byte) {
+	for i := 0; i < len(bits) && i < len(f.bits); i++ {
+		f.bits[i] |= bits[i]
+	}
+}
+
+// Bytes are the filter's bits, Redis string layout
+func (f *Filter) Bytes() []byte {
+	return append([]byte(nil), f.bits...)
+}
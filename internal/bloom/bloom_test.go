@@ -0,0 +1,61 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	const capacity = 10000
+	m, k := Size(capacity, 0.01)
+	f := New(m, k)
+	for i := 0; i < capacity; i++ {
+		f.Add(fmt.Sprint("added-", i))
+	}
+	for i := 0; i < capacity; i++ {
+		if !f.Test(fmt.Sprint("added-", i)) {
+			t.Fatalf("added-%d was added but tests negative", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < capacity; i++ {
+		if f.Test(fmt.Sprint("other-", i)) {
+			falsePositives++
+		}
+	}
+	// 1% asked for, allow for chance
+	if rate := float64(falsePositives) / capacity; rate > 0.02 {
+		t.Errorf("false positive rate %.4f for a filter sized for 0.01", rate)
+	}
+}
+
+func TestMergeUsesRedisBitOrder(t *testing.T) {
+	f := New(64, 3)
+	positions := f.Add("fingerprint")
+
+	// what SETBIT key <position> 1 leaves in the string: bit 0 is the most significant
+	// bit of the first byte
+	redis := make([]byte, 8)
+	for _, p := range positions {
+		redis[p/8] |= 1 << (7 - p%8)
+	}
+	if got := f.Bytes(); string(got) != string(redis) {
+		t.Errorf("got bits %08b, SETBIT would give %08b", got, redis)
+	}
+
+	other := New(64, 3)
+	if other.Test("fingerprint") {
+		t.Fatal("empty filter tests positive")
+	}
+	// trailing zero bytes are cut off, like a Redis string only has the bytes written
+	last := 0
+	for i, b := range redis {
+		if b != 0 {
+			last = i
+		}
+	}
+	other.Merge(redis[:last+1])
+	if !other.Test("fingerprint") {
+		t.Error("merged filter is missing the key")
+	}
+}
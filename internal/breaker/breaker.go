@@ -0,0 +1,142 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned instead of calling through while the breaker is open
+var ErrOpen = errors.New("circuit breaker is open")
+
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Stats is a snapshot for metrics and readiness reporting
+type Stats struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	Opened              int64  `json:"opened"`
+	Rejected            int64  `json:"rejected"`
+}
+
+// Breaker opens after threshold consecutive failures, rejects everything for
+// openFor, then lets a single probe through (half-open). The probe succeeding closes
+// the breaker again, failing re-opens it for another openFor.
+type Breaker struct {
+	threshold int
+	openFor   time.Duration
+
+	mu                  sync.Mutex
+	state               State
+	consecutiveFailures int
+	openedAt            time.Time
+	probing             bool
+	opened              int64
+	rejected            int64
+}
+
+func New(threshold int, openFor time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, openFor: openFor}
+}
+
+// Allow reports whether a call may go through, returning ErrOpen if not. Every
+// allowed call must be followed by Success or Failure.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Open:
+		if time.Since(b.openedAt) < b.openFor {
+			b.rejected++
+			return ErrOpen
+		}
+		b.state = HalfOpen
+		b.probing = true
+		return nil
+	case HalfOpen:
+		// only one probe at a time, everyone else keeps failing fast until it reports back
+		if b.probing {
+			b.rejected++
+			return ErrOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Success and Failure from calls that started before the breaker opened are ignored,
+// only the half-open probe decides when it closes again
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open {
+		return
+	}
+	b.consecutiveFailures = 0
+	b.probing = false
+	b.state = Closed
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open {
+		return
+	}
+	b.consecutiveFailures++
+	b.probing = false
+	if b.state == HalfOpen || b.consecutiveFailures >= b.threshold {
+		b.opened++
+		b.state = Open
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// RetryAfter is how long until the breaker lets a probe through, 0 when it isn't open
+func (b *Breaker) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Closed {
+		return 0
+	}
+	if wait := b.openFor - time.Since(b.openedAt); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (b *Breaker) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return Stats{
+		State:               b.state.String(),
+		ConsecutiveFailures: b.consecutiveFailures,
+		Opened:              b.opened,
+		Rejected:            b.rejected,
+	}
+}
@@ -0,0 +1,200 @@
+// Package chaos makes things slow and failing on purpose, for checking in staging that
+// retries, the circuit breaker, load shedding and degraded mode do what they should.
+// Faults are set per target at runtime and apply to every call into it until cleared.
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// the parts of the service faults can be injected into
+const (
+	// every Redis command, below retries and the circuit breaker
+	Store = "store"
+	// scoring a receipt, before anything is stored
+	Scoring = "scoring"
+)
+
+// Targets are the targets there are
+var Targets = []string{Store, Scoring}
+
+// what an injected store failure looks like. Scoring failures are plain errors
+const (
+	// the connection dropping: retried, and counted by the circuit breaker
+	Connection = "connection"
+	// Redis answering LOADING: retried, but Redis is up as far as the breaker knows
+	Loading = "loading"
+	// an error reply: neither retried nor counted
+	Reply = "reply"
+)
+
+// Fault is what happens to the calls into a target: each one is held up for
+// LatencyInMs plus up to JitterInMs, then fails with probability ErrorRate
+type Fault struct {
+	LatencyInMs int64   `json:"latencyMs"`
+	JitterInMs  int64   `json:"jitterMs,omitempty"`
+	ErrorRate   float64 `json:"errorRate"`
+	// one of Connection (the default), Loading or Reply, for the store
+	Error string `json:"error,omitempty"`
+}
+
+// Validate checks a fault can be set on target
+func (f Fault) Validate(target string) error {
+	if !isTarget(target) {
+		return fmt.Errorf("Error setting fault: unknown target %q", target)
+	}
+	if f.LatencyInMs < 0 || f.JitterInMs < 0 {
+		return fmt.Errorf("Error setting fault: latencyMs and jitterMs must not be negative")
+	}
+	if f.ErrorRate < 0 || f.ErrorRate > 1 {
+		return fmt.Errorf("Error setting fault: errorRate must be between 0 and 1")
+	}
+	switch {
+	case f.Error == "":
+	case target != Store:
+		return fmt.Errorf("Error setting fault: only the store fails in different ways")
+	case f.Error != Connection && f.Error != Loading && f.Error != Reply:
+		return fmt.Errorf("Error setting fault: error must be %s, %s or %s", Connection, Loading, Reply)
+	}
+	return nil
+}
+
+func isTarget(target string) bool {
+	for _, t := range Targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Error is a failure Inject made up
+type Error struct {
+	Target string
+	Kind   string
+}
+
+func (e *Error) Error() string {
+	if e.Kind == "" {
+		return "chaos: injected failure in " + e.Target
+	}
+	return fmt.Sprintf("chaos: injected %s failure in %s", e.Kind, e.Target)
+}
+
+// TargetStats are the faults injected into a target so far
+type TargetStats struct {
+	Fault   *Fault `json:"fault,omitempty"`
+	Delayed int64  `json:"delayed"`
+	Failed  int64  `json:"failed"`
+}
+
+// Injector holds the faults set on each target
+type Injector struct {
+	mu     sync.Mutex
+	faults map[string]Fault
+	stats  map[string]*TargetStats
+	rand   *rand.Rand
+}
+
+// New is an injector with no faults set
+func New() *Injector {
+	return &Injector{
+		faults: make(map[string]Fault),
+		stats:  make(map[string]*TargetStats),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Set makes every call into target suffer f from now on
+func (inj *Injector) Set(target string, f Fault) error {
+	if err := f.Validate(target); err != nil {
+		return err
+	}
+	if target == Store && f.Error == "" {
+		f.Error = Connection
+	}
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.faults[target] = f
+	return nil
+}
+
+// Clear removes the fault on target, all of them without a target
+func (inj *Injector) Clear(target string) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if target == "" {
+		inj.faults = make(map[string]Fault)
+		return
+	}
+	delete(inj.faults, target)
+}
+
+// Stats are the faults set and what they've done, by target
+func (inj *Injector) Stats() map[string]TargetStats {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	stats := make(map[string]TargetStats, len(Targets))
+	for _, target := range Targets {
+		var s TargetStats
+		if counted := inj.stats[target]; counted != nil {
+			s = *counted
+		}
+		if f, ok := inj.faults[target]; ok {
+			s.Fault = &f
+		}
+		stats[target] = s
+	}
+	return stats
+}
+
+// Inject applies target's fault to a call: it waits out the latency, then returns an
+// *Error at the fault's error rate. It returns ctx's error when ctx ends during the
+// wait, like a slow dependency would make the call time out. A nil injector, or one
+// without a fault on target, returns nil right away.
+func (inj *Injector) Inject(ctx context.Context, target string) error {
+	if inj == nil {
+		return nil
+	}
+	inj.mu.Lock()
+	f, ok := inj.faults[target]
+	if !ok {
+		inj.mu.Unlock()
+		return nil
+	}
+	delay := time.Duration(f.LatencyInMs) * time.Millisecond
+	if f.JitterInMs > 0 {
+		delay += time.Duration(inj.rand.Int63n(f.JitterInMs+1)) * time.Millisecond
+	}
+	fail := inj.rand.Float64() < f.ErrorRate
+	s := inj.stats[target]
+	if s == nil {
+		s = &TargetStats{}
+		inj.stats[target] = s
+	}
+	if delay > 0 {
+		s.Delayed++
+	}
+	if fail {
+		s.Failed++
+	}
+	inj.mu.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if !fail {
+		return nil
+	}
+	return &Error{Target: target, Kind: f.Error}
+}
@@ -0,0 +1,59 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time. Anything that decides based on what time it is (is this receipt
+// from the future, which points are due to expire) asks a Clock instead of calling
+// time.Now, so tests and replays can pin it. Timeouts, backoffs and rate limits stay on
+// the real clock, they're about the process not the receipts.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Real is the wall clock
+var Real Clock = realClock{}
+
+// Frozen is a clock that stands still at an instant until it's moved with Set or
+// Advance. It's safe for concurrent use.
+type Frozen struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFrozen(now time.Time) *Frozen {
+	return &Frozen{now: now}
+}
+
+func (f *Frozen) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Frozen) Set(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = now
+}
+
+func (f *Frozen) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// Parse reads a --fake-now style instant: RFC 3339 ("2022-01-01T15:04:05Z") or a bare
+// date, which means midnight UTC
+func Parse(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
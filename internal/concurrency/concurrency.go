@@ -0,0 +1,165 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSaturated is returned when every slot is taken and either the queue is full too
+// or the wait for a slot ran out
+var ErrSaturated = errors.New("too many concurrent requests")
+
+// Stats is a snapshot for metrics
+type Stats struct {
+	Limit    int   `json:"limit"`
+	InFlight int   `json:"inFlight"`
+	Queued   int64 `json:"queued"`
+	Rejected int64 `json:"rejected"`
+}
+
+// Limiter lets at most limit callers in at a time. Up to queueSize more wait for a
+// slot, for at most maxWait, everyone else is turned away straight away. Turning work
+// away early keeps a burst from piling up goroutines and Redis connections until
+// everything times out.
+//
+// A nil Limiter (limit 0) lets everyone in.
+type Limiter struct {
+	limit    int
+	slots    chan struct{}
+	maxQueue int64
+	maxWait  time.Duration
+
+	queued   atomic.Int64
+	rejected atomic.Int64
+}
+
+// New returns a Limiter, nil when limit is 0 (no limit)
+func New(limit, queueSize int, maxWait time.Duration) *Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &Limiter{
+		limit:    limit,
+		slots:    make(chan struct{}, limit),
+		maxQueue: int64(queueSize),
+		maxWait:  maxWait,
+	}
+}
+
+// Acquire takes a slot, waiting in the queue if there's room in it. Every successful
+// Acquire must be followed by calling the returned release.
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		l.rejected.Add(1)
+		return nil, ErrSaturated
+	}
+	defer l.queued.Add(-1)
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-timer.C:
+		l.rejected.Add(1)
+		return nil, ErrSaturated
+	case <-ctx.Done():
+		// still saturated as far as the caller is concerned, it never got a slot
+		l.rejected.Add(1)
+		return nil, fmt.Errorf("%w: %v", ErrSaturated, ctx.Err())
+	}
+}
+
+func (l *Limiter) release() {
+	<-l.slots
+}
+
+func (l *Limiter) Stats() Stats {
+	if l == nil {
+		return Stats{}
+	}
+	return Stats{
+		Limit:    l.limit,
+		InFlight: len(l.slots),
+		Queued:   l.queued.Load(),
+		Rejected: l.rejected.Load(),
+	}
+}
+
+// PriorityStats is a snapshot of a PriorityLimiter for metrics. The embedded Stats are
+// for every caller, Low for the low priority ones.
+type PriorityStats struct {
+	Stats
+	Reserved int   `json:"reserved"`
+	Low      Stats `json:"low"`
+}
+
+// PriorityLimiter is a Limiter that keeps reserved of its slots for high priority
+// callers: low priority ones are turned away once limit-reserved of them are in, so
+// under overload the high priority work still gets through.
+//
+// A nil PriorityLimiter (limit 0) lets everyone in.
+type PriorityLimiter struct {
+	all      *Limiter
+	low      *Limiter
+	reserved int
+	maxWait  time.Duration
+}
+
+// NewPriority returns a PriorityLimiter, nil when limit is 0 (no limit). Low priority
+// callers get a queue of their own, of the same size.
+func NewPriority(limit, reserved, queueSize int, maxWait time.Duration) *PriorityLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	l := &PriorityLimiter{all: New(limit, queueSize, maxWait), reserved: reserved, maxWait: maxWait}
+	if reserved > 0 {
+		l.low = New(limit-reserved, queueSize, maxWait)
+	}
+	return l
+}
+
+// Acquire takes a slot the way Limiter.Acquire does, low priority callers one that
+// isn't reserved. Waiting for both takes no longer than maxWait altogether.
+func (l *PriorityLimiter) Acquire(ctx context.Context, high bool) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	if high || l.low == nil {
+		return l.all.Acquire(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, l.maxWait)
+	defer cancel()
+	releaseLow, err := l.low.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	releaseAll, err := l.all.Acquire(ctx)
+	if err != nil {
+		releaseLow()
+		return nil, err
+	}
+	return func() {
+		releaseAll()
+		releaseLow()
+	}, nil
+}
+
+func (l *PriorityLimiter) Stats() PriorityStats {
+	if l == nil {
+		return PriorityStats{}
+	}
+	return PriorityStats{Stats: l.all.Stats(), Reserved: l.reserved, Low: l.low.Stats()}
+}
@@ -2,8 +2,10 @@ package config
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,39 +16,657 @@ type Config struct {
 	RedisTTLInSec      time.Duration
 	RequestTimeoutInMs time.Duration
 	MaxDBConnRetries   int
+	AdminToken         string
+	MetricsToken       string
+	LogLevel           string
+	RulesPath          string
+	TenantsPath        string
+
+	// with OIDCIssuerURL set admins sign in with that OpenID Connect provider instead of
+	// an ADMIN_TOKEN. the roles in their tokens' OIDCRolesClaim (a dotted path for nested
+	// claims) map onto admin capabilities through OIDCRoles. OIDCRedirectURL, this
+	// service's /admin/callback as the provider knows it, turns on browser sign in
+	OIDCIssuerURL    string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCRolesClaim   string
+	OIDCRoles        map[string][]string
+
+	// the http.Server's timeouts, 0 disables all but ReadHeaderTimeout. streaming
+	// endpoints push the read and write deadlines out as they go. H2C serves HTTP/2
+	// without TLS next to HTTP/1.1 on the same port
+	ServerReadHeaderTimeoutInMs time.Duration
+	ServerReadTimeoutInMs       time.Duration
+	ServerWriteTimeoutInMs      time.Duration
+	ServerIdleTimeoutInMs       time.Duration
+	H2C                         bool
+
+	// the share of requests that get an access log line, 0 to 1. server errors are
+	// always logged. requests to AccessLogExclude paths never are
+	AccessLogSampleRate float64
+	AccessLogExclude    []string
+
+	// redis (the default), sqlite, a local file at SQLitePath instead of a Redis server,
+	// or dynamodb, the DynamoDBTable table. region and credentials come from the standard
+	// AWS config (env, shared files, instance role) unless DynamoDBRegion is set
+	StoreBackend     string
+	SQLitePath       string
+	DynamoDBTable    string
+	DynamoDBRegion   string
+	DynamoDBEndpoint string
+
+	CampaignRefreshInMs time.Duration
+
+	// TTLs for the retention classes requests can pick with X-Retention-Class, they
+	// win over RedisTTLInSec. 0 keeps a class's receipts forever
+	ReceiptRetention map[string]time.Duration
+	// the retention sweeper purges receipts older than ReceiptMaxAgeInSec (0 keeps them)
+	// and soft deleted ones TombstoneRetentionInSec after they were deleted
+	ReceiptMaxAgeInSec      time.Duration
+	TombstoneRetentionInSec time.Duration
+	RetentionSweepInMs      time.Duration
+
+	PointsCacheMaxAgeInSec time.Duration
+	MaxReceiptItems        int
+	MaxRequestBodyBytes    int64
+	BusinessTimezone       string
+
+	PointsExpiryInMonths  int
+	PointsExpirySweepInMs time.Duration
+
+	FraudScreening           bool
+	FraudMaxTotal            float64
+	FraudMaxItems            int
+	FraudVelocityLimit       int
+	FraudVelocityWindowInMs  time.Duration
+	FraudDuplicateWindowInMs time.Duration
+	// duplicate checks go through a Bloom filter of FraudBloomCapacity fingerprints per
+	// duplicate window first, synced between instances every FraudBloomSyncInMs. Redis
+	// only, and unlike the other Fraud settings these need a restart
+	FraudBloomFilter            bool
+	FraudBloomCapacity          int
+	FraudBloomFalsePositiveRate float64
+	FraudBloomSyncInMs          time.Duration
+
+	// identical submissions within SubmissionLockInMs of each other are processed once,
+	// the later ones get the first one's id. 0 turns it off
+	SubmissionLockInMs time.Duration
+
+	DbAttemptTimeoutInMs  time.Duration
+	DbRetryBaseDelayInMs  time.Duration
+	DbRetryMaxDelayInMs   time.Duration
+	DbRetryMaxElapsedInMs time.Duration
+
+	// the go-redis client's connection pool and socket settings. 0 RedisPoolSize is
+	// go-redis' default of 10 per CPU. RedisMaxRetries are go-redis' own retries, on top
+	// of the MaxDBConnRetries every operation gets, so 0 (none) by default
+	RedisPoolSize         int
+	RedisMinIdleConns     int
+	RedisDialTimeoutInMs  time.Duration
+	RedisReadTimeoutInMs  time.Duration
+	RedisWriteTimeoutInMs time.Duration
+	RedisMaxRetries       int
+	// every Redis key starts with KeyPrefix, so environments can share a Redis. With
+	// RedisHashTags a tenant's keys share a Redis Cluster hash tag
+	KeyPrefix     string
+	RedisHashTags bool
+
+	BreakerFailureThreshold int
+	BreakerOpenInMs         time.Duration
+
+	MaxConcurrentReceipts    int
+	ReceiptQueueSize         int
+	MaxConcurrentStoreWrites int
+	StoreWriteQueueSize      int
+	ConcurrencyQueueWaitInMs time.Duration
+	// public API requests in flight at once, 0 for no limit. LookupReservedRequests of
+	// them are kept for lookups, so reads still get in while submissions are shed
+	MaxInFlightRequests    int
+	InFlightQueueSize      int
+	LookupReservedRequests int
+
+	WebhookURLs        []string
+	WebhookSecret      string
+	WebhookMaxRetries  int
+	WebhookTimeoutInMs time.Duration
+	WebhookBackoffInMs time.Duration
+
+	KafkaBrokers           []string
+	KafkaTopic             string
+	KafkaBufferSize        int
+	KafkaBatchSize         int
+	KafkaMaxAttempts       int
+	KafkaFlushIntervalInMs time.Duration
+
+	// GET /receipts/events. each stream buffers EventStreamBufferSize events before
+	// it starts missing them
+	MaxEventStreams       int
+	EventStreamBufferSize int
+	EventStreamPingInMs   time.Duration
+
+	// receipts that can't be saved because the store is down are kept in a file at
+	// OutboxPath and saved later, instead of failing the request. off when empty
+	OutboxPath       string
+	OutboxMaxEntries int
+	OutboxFlushInMs  time.Duration
+	// with DegradedMode receipts are taken while the store is down even when the checks
+	// before the save can't run, and kept in the outbox as provisional. The outbox is in
+	// memory when there's no OutboxPath
+	DegradedMode bool
+
+	// ChaosMode is for staging: faults (latency, errors) can be injected into the store
+	// and scoring through /admin/chaos, to see retries, the circuit breaker and degraded
+	// mode at work. Never on in production
+	ChaosMode bool
+
+	// points lookups read receipts through an in-process LRU cache of
+	// ReceiptCacheSize entries that each live ReceiptCacheTTLInMs. 0 size turns it off
+	ReceiptCacheSize    int
+	ReceiptCacheTTLInMs time.Duration
+
+	// while moving to another store: path to a KEY=VALUE env file describing it,
+	// every write is mirrored there after the store's own succeeds. off when empty
+	DualWriteConfig string
+
+	// raw receipts and images are archived to this S3-compatible bucket when set.
+	// ArchiveEndpoint is for non-AWS stores (MinIO etc.), addressed path-style
+	ArchiveBucket      string
+	ArchiveRegion      string
+	ArchiveEndpoint    string
+	ArchivePrefix      string
+	ArchiveMaxRetries  int
+	ArchiveTimeoutInMs time.Duration
+	ArchiveBackoffInMs time.Duration
+
+	// summaries of the previous UTC day and week, sent on cron schedules (in UTC) to
+	// every destination configured: ReportWebhookURL, email through ReportSMTPAddr and
+	// the archive bucket with ReportToArchive. An empty schedule turns its report off
+	ReportDailySchedule  string
+	ReportWeeklySchedule string
+	ReportTopRetailers   int
+	ReportTimeoutInMs    time.Duration
+	ReportWebhookURL     string
+	ReportSMTPAddr       string
+	ReportSMTPUsername   string
+	ReportSMTPPassword   string
+	ReportEmailFrom      string
+	ReportEmailTo        []string
+	ReportToArchive      bool
+
+	OCRBackend       string
+	OCRTesseractPath string
+	OCRPdftoppmPath  string
+	OCRHTTPURL       string
+	OCRHTTPToken     string
+	OCRTimeoutInMs   time.Duration
+
+	// rules files can name scoring plugins, WebAssembly modules in RulePluginDir that
+	// are run for every receipt under these limits. Empty turns plugins off
+	RulePluginDir             string
+	RulePluginTimeoutInMs     time.Duration
+	RulePluginMemoryLimitInMB int
 }
 
 func Load() (Config, error) {
+	return load(os.Getenv)
+}
+
+// LoadWithEnvFile is Load with a KEY=VALUE file (the docker-compose env_file format)
+// filling in whatever isn't set in the environment. The file is read fresh on every
+// call, so reloads pick up edits to it.
+func LoadWithEnvFile(path string) (Config, error) {
+	vars, err := readEnvFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	return load(func(key string) string {
+		if v, ok := os.LookupEnv(key); ok {
+			return v
+		}
+		return vars[key]
+	})
+}
+
+// LoadEnvFile loads the configuration from a KEY=VALUE file alone, ignoring the
+// environment. For tools that deal with more than one deployment at a time.
+func LoadEnvFile(path string) (Config, error) {
+	vars, err := readEnvFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	return load(func(key string) string { return vars[key] })
+}
+
+func load(getenv envFunc) (Config, error) {
 	// design decision: return Config or *Config? since main functionality of Config is
 	// to read it and not write to it, decided to return struct
-	redisAddr := os.Getenv("REDIS_ADDR")
+	redisAddr := getenv("REDIS_ADDR")
 	if redisAddr == "" {
 		redisAddr = "redis:6379"
 	}
-	serverPort := os.Getenv("SERVER_PORT")
+	serverPort := getenv("SERVER_PORT")
 	if serverPort == "" {
 		serverPort = "8080"
 	}
 
-	// strconv will throw error if os.Getenv("FOO") returns "" - can catch early
-	dbTimeoutInMs, err := strconv.Atoi(os.Getenv("DB_TIMEOUT_IN_MS"))
+	// strconv will throw error if getenv("FOO") returns "" - can catch early
+	dbTimeoutInMs, err := strconv.Atoi(getenv("DB_TIMEOUT_IN_MS"))
 	if err != nil {
 		return Config{}, fmt.Errorf("Error converting DB_TIMEOUT env to int: %v", err)
 	}
 
-	reqTimeoutInMs, err := strconv.Atoi(os.Getenv("REQUEST_TIMEOUT_IN_MS"))
+	reqTimeoutInMs, err := strconv.Atoi(getenv("REQUEST_TIMEOUT_IN_MS"))
 	if err != nil {
 		return Config{}, fmt.Errorf("Error converting DB_TIMEOUT env to int: %v", err)
 	}
 
-	redisTTLInSec, err := strconv.Atoi(os.Getenv("REDIS_TTL_IN_S"))
+	maxDBConnRetries, err := strconv.Atoi(getenv("MAX_DB_CONN_RETRIES"))
+	if err != nil {
+		return Config{}, fmt.Errorf("Error converting MAX_DB_CONN_RETRIES env to int: %v", err)
+	}
+
+	// everything below is optional, unset env vars fall back to defaults
+	serverReadHeaderTimeoutInMs, err := getenv.int("SERVER_READ_HEADER_TIMEOUT_IN_MS", 5000)
 	if err != nil {
-		return Config{}, fmt.Errorf("Error converting REDIS_TTL env to int: %v", err)
+		return Config{}, err
 	}
 
-	maxDBConnRetries, err := strconv.Atoi(os.Getenv("MAX_DB_CONN_RETRIES"))
+	// long enough for a max size CSV import or receipt image over a slow link
+	serverReadTimeoutInMs, err := getenv.int("SERVER_READ_TIMEOUT_IN_MS", 60000)
 	if err != nil {
-		return Config{}, fmt.Errorf("Error converting MAX_DB_CONN_RETRIES env to int: %v", err)
+		return Config{}, err
+	}
+
+	serverWriteTimeoutInMs, err := getenv.int("SERVER_WRITE_TIMEOUT_IN_MS", 60000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	serverIdleTimeoutInMs, err := getenv.int("SERVER_IDLE_TIMEOUT_IN_MS", 120000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	h2c, err := getenv.bool("H2C", true)
+	if err != nil {
+		return Config{}, err
+	}
+
+	accessLogSampleRate, err := getenv.float("ACCESS_LOG_SAMPLE_RATE", 1)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// health checks and scrapes would drown out everything else, "none" logs them too
+	accessLogExclude := []string{"/healthz", "/readyz", "/metrics"}
+	switch getenv("ACCESS_LOG_EXCLUDE") {
+	case "":
+	case "none":
+		accessLogExclude = nil
+	default:
+		accessLogExclude = getenv.list("ACCESS_LOG_EXCLUDE")
+	}
+
+	// 0 keeps receipts forever, which is what production wants
+	redisTTLInSec, err := getenv.int("REDIS_TTL_IN_S", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	receiptRetentionInSec, err := getenv.seconds("RECEIPT_RETENTION_IN_S")
+	if err != nil {
+		return Config{}, err
+	}
+
+	// 0 keeps receipts until they're deleted
+	receiptMaxAgeInSec, err := getenv.int("RECEIPT_MAX_AGE_IN_S", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// 30 days to take a deletion back by hand before it's final
+	tombstoneRetentionInSec, err := getenv.int("TOMBSTONE_RETENTION_IN_S", 2592000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	retentionSweepInMs, err := getenv.int("RETENTION_SWEEP_IN_MS", 3600000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	dbAttemptTimeoutInMs, err := getenv.int("DB_ATTEMPT_TIMEOUT_IN_MS", 100)
+	if err != nil {
+		return Config{}, err
+	}
+
+	dbRetryBaseDelayInMs, err := getenv.int("DB_RETRY_BASE_DELAY_IN_MS", 10)
+	if err != nil {
+		return Config{}, err
+	}
+
+	dbRetryMaxDelayInMs, err := getenv.int("DB_RETRY_MAX_DELAY_IN_MS", 100)
+	if err != nil {
+		return Config{}, err
+	}
+
+	campaignRefreshInMs, err := getenv.int("CAMPAIGN_REFRESH_IN_MS", 30000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// points lookups are revalidated with their ETag, clients rarely need to come back
+	// sooner than this
+	pointsCacheMaxAgeInSec, err := getenv.int("POINTS_CACHE_MAX_AGE_IN_S", 86400)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxReceiptItems, err := getenv.int("MAX_RECEIPT_ITEMS", 100000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// every request body, counted after it's decompressed
+	maxRequestBodyBytes, err := getenv.int("MAX_REQUEST_BODY_BYTES", 64<<20)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// 0 keeps points forever
+	pointsExpiryInMonths, err := getenv.int("POINTS_EXPIRY_IN_MONTHS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	pointsExpirySweepInMs, err := getenv.int("POINTS_EXPIRY_SWEEP_IN_MS", 3600000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	fraudScreening, err := getenv.bool("FRAUD_SCREENING", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	fraudMaxTotal, err := getenv.float("FRAUD_MAX_TOTAL", 5000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	fraudMaxItems, err := getenv.int("FRAUD_MAX_ITEMS", 100)
+	if err != nil {
+		return Config{}, err
+	}
+
+	fraudVelocityLimit, err := getenv.int("FRAUD_VELOCITY_LIMIT", 20)
+	if err != nil {
+		return Config{}, err
+	}
+
+	fraudVelocityWindowInMs, err := getenv.int("FRAUD_VELOCITY_WINDOW_IN_MS", 3600000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// 30 days
+	fraudDuplicateWindowInMs, err := getenv.int("FRAUD_DUPLICATE_WINDOW_IN_MS", 2592000000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	fraudBloomFilter, err := getenv.bool("FRAUD_BLOOM_FILTER", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	fraudBloomCapacity, err := getenv.int("FRAUD_BLOOM_CAPACITY", 100000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	fraudBloomFalsePositiveRate, err := getenv.float("FRAUD_BLOOM_FALSE_POSITIVE_RATE", 0.01)
+	if err != nil {
+		return Config{}, err
+	}
+
+	fraudBloomSyncInMs, err := getenv.int("FRAUD_BLOOM_SYNC_IN_MS", 1000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	submissionLockInMs, err := getenv.int("SUBMISSION_LOCK_IN_MS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// by default retries may use up the whole DB timeout
+	dbRetryMaxElapsedInMs, err := getenv.int("DB_RETRY_MAX_ELAPSED_IN_MS", dbTimeoutInMs)
+	if err != nil {
+		return Config{}, err
+	}
+
+	redisPoolSize, err := getenv.int("REDIS_POOL_SIZE", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	redisMinIdleConns, err := getenv.int("REDIS_MIN_IDLE_CONNS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// go-redis' defaults
+	redisDialTimeoutInMs, err := getenv.int("REDIS_DIAL_TIMEOUT_IN_MS", 5000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	redisReadTimeoutInMs, err := getenv.int("REDIS_READ_TIMEOUT_IN_MS", 3000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	redisWriteTimeoutInMs, err := getenv.int("REDIS_WRITE_TIMEOUT_IN_MS", redisReadTimeoutInMs)
+	if err != nil {
+		return Config{}, err
+	}
+
+	redisMaxRetries, err := getenv.int("REDIS_MAX_RETRIES", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	redisHashTags, err := getenv.bool("REDIS_HASH_TAGS", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	breakerFailureThreshold, err := getenv.int("BREAKER_FAILURE_THRESHOLD", 5)
+	if err != nil {
+		return Config{}, err
+	}
+
+	breakerOpenInMs, err := getenv.int("BREAKER_OPEN_IN_MS", 5000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// 0 concurrency means no limit
+	maxConcurrentReceipts, err := getenv.int("MAX_CONCURRENT_RECEIPTS", 256)
+	if err != nil {
+		return Config{}, err
+	}
+
+	receiptQueueSize, err := getenv.int("RECEIPT_QUEUE_SIZE", 1024)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxConcurrentStoreWrites, err := getenv.int("MAX_CONCURRENT_STORE_WRITES", 64)
+	if err != nil {
+		return Config{}, err
+	}
+
+	storeWriteQueueSize, err := getenv.int("STORE_WRITE_QUEUE_SIZE", 256)
+	if err != nil {
+		return Config{}, err
+	}
+
+	concurrencyQueueWaitInMs, err := getenv.int("CONCURRENCY_QUEUE_WAIT_IN_MS", 1000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxInFlightRequests, err := getenv.int("MAX_IN_FLIGHT_REQUESTS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	inFlightQueueSize, err := getenv.int("IN_FLIGHT_QUEUE_SIZE", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	lookupReservedRequests, err := getenv.int("LOOKUP_RESERVED_REQUESTS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	webhookMaxRetries, err := getenv.int("WEBHOOK_MAX_RETRIES", 5)
+	if err != nil {
+		return Config{}, err
+	}
+
+	webhookTimeoutInMs, err := getenv.int("WEBHOOK_TIMEOUT_IN_MS", 2000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	webhookBackoffInMs, err := getenv.int("WEBHOOK_BACKOFF_IN_MS", 500)
+	if err != nil {
+		return Config{}, err
+	}
+
+	kafkaBufferSize, err := getenv.int("KAFKA_BUFFER_SIZE", 10000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	kafkaBatchSize, err := getenv.int("KAFKA_BATCH_SIZE", 100)
+	if err != nil {
+		return Config{}, err
+	}
+
+	kafkaMaxAttempts, err := getenv.int("KAFKA_MAX_ATTEMPTS", 5)
+	if err != nil {
+		return Config{}, err
+	}
+
+	kafkaFlushIntervalInMs, err := getenv.int("KAFKA_FLUSH_INTERVAL_IN_MS", 1000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxEventStreams, err := getenv.int("MAX_EVENT_STREAMS", 100)
+	if err != nil {
+		return Config{}, err
+	}
+
+	eventStreamBufferSize, err := getenv.int("EVENT_STREAM_BUFFER_SIZE", 64)
+	if err != nil {
+		return Config{}, err
+	}
+
+	eventStreamPingInMs, err := getenv.int("EVENT_STREAM_PING_IN_MS", 15000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	outboxMaxEntries, err := getenv.int("OUTBOX_MAX_ENTRIES", 10000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	outboxFlushInMs, err := getenv.int("OUTBOX_FLUSH_IN_MS", 1000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	degradedMode, err := getenv.bool("DEGRADED_MODE", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	receiptCacheSize, err := getenv.int("RECEIPT_CACHE_SIZE", 10000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	receiptCacheTTLInMs, err := getenv.int("RECEIPT_CACHE_TTL_IN_MS", 30000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	kafkaTopic := getenv("KAFKA_TOPIC")
+	if kafkaTopic == "" {
+		kafkaTopic = "receipt.processed"
+	}
+
+	archiveMaxRetries, err := getenv.int("ARCHIVE_MAX_RETRIES", 8)
+	if err != nil {
+		return Config{}, err
+	}
+
+	archiveTimeoutInMs, err := getenv.int("ARCHIVE_TIMEOUT_IN_MS", 10000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	archiveBackoffInMs, err := getenv.int("ARCHIVE_BACKOFF_IN_MS", 1000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	reportTopRetailers, err := getenv.int("REPORT_TOP_RETAILERS", 5)
+	if err != nil {
+		return Config{}, err
+	}
+
+	reportTimeoutInMs, err := getenv.int("REPORT_TIMEOUT_IN_MS", 10000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	reportToArchive, err := getenv.bool("REPORT_TO_ARCHIVE", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	ocrTimeoutInMs, err := getenv.int("OCR_TIMEOUT_IN_MS", 30000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	rulePluginTimeoutInMs, err := getenv.int("RULE_PLUGIN_TIMEOUT_IN_MS", 200)
+	if err != nil {
+		return Config{}, err
+	}
+
+	rulePluginMemoryLimitInMB, err := getenv.int("RULE_PLUGIN_MEMORY_LIMIT_IN_MB", 128)
+	if err != nil {
+		return Config{}, err
+	}
+
+	chaosMode, err := getenv.bool("CHAOS_MODE", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	oidcRoles, err := getenv.sets("OIDC_ROLES")
+	if err != nil {
+		return Config{}, err
 	}
 
 	appConfig := Config{
@@ -55,7 +675,304 @@ func Load() (Config, error) {
 		RequestTimeoutInMs: time.Millisecond * time.Duration(reqTimeoutInMs),
 		DbTimeoutInMs:      time.Millisecond * time.Duration(dbTimeoutInMs),
 		RedisTTLInSec:      time.Second * time.Duration(redisTTLInSec),
+		ReceiptRetention:   receiptRetentionInSec,
 		MaxDBConnRetries:   maxDBConnRetries,
+		AdminToken:         getenv("ADMIN_TOKEN"),
+		MetricsToken:       getenv("METRICS_TOKEN"),
+		LogLevel:           getenv.string("LOG_LEVEL", "info"),
+		RulesPath:          getenv("RULES_PATH"),
+		TenantsPath:        getenv("TENANTS_PATH"),
+		OIDCIssuerURL:      getenv("OIDC_ISSUER_URL"),
+		OIDCClientID:       getenv("OIDC_CLIENT_ID"),
+		OIDCClientSecret:   getenv("OIDC_CLIENT_SECRET"),
+		OIDCRedirectURL:    getenv("OIDC_REDIRECT_URL"),
+		OIDCRolesClaim:     getenv.string("OIDC_ROLES_CLAIM", "roles"),
+		OIDCRoles:          oidcRoles,
+		StoreBackend:       getenv.string("STORE_BACKEND", "redis"),
+		SQLitePath:         getenv.string("SQLITE_PATH", "receipts.db"),
+		DynamoDBTable:      getenv("DYNAMODB_TABLE"),
+		DynamoDBRegion:     getenv("DYNAMODB_REGION"),
+		DynamoDBEndpoint:   getenv("DYNAMODB_ENDPOINT"),
+
+		ServerReadHeaderTimeoutInMs: time.Millisecond * time.Duration(serverReadHeaderTimeoutInMs),
+		ServerReadTimeoutInMs:       time.Millisecond * time.Duration(serverReadTimeoutInMs),
+		ServerWriteTimeoutInMs:      time.Millisecond * time.Duration(serverWriteTimeoutInMs),
+		ServerIdleTimeoutInMs:       time.Millisecond * time.Duration(serverIdleTimeoutInMs),
+		H2C:                         h2c,
+
+		AccessLogSampleRate: accessLogSampleRate,
+		AccessLogExclude:    accessLogExclude,
+
+		ReceiptMaxAgeInSec:      time.Second * time.Duration(receiptMaxAgeInSec),
+		TombstoneRetentionInSec: time.Second * time.Duration(tombstoneRetentionInSec),
+		RetentionSweepInMs:      time.Millisecond * time.Duration(retentionSweepInMs),
+
+		CampaignRefreshInMs: time.Millisecond * time.Duration(campaignRefreshInMs),
+
+		PointsCacheMaxAgeInSec: time.Second * time.Duration(pointsCacheMaxAgeInSec),
+		MaxReceiptItems:        maxReceiptItems,
+		MaxRequestBodyBytes:    int64(maxRequestBodyBytes),
+		// purchase dates and times without a timezone of their own are read in this zone
+		BusinessTimezone: getenv.string("BUSINESS_TIMEZONE", "UTC"),
+
+		PointsExpiryInMonths:  pointsExpiryInMonths,
+		PointsExpirySweepInMs: time.Millisecond * time.Duration(pointsExpirySweepInMs),
+
+		FraudScreening:           fraudScreening,
+		FraudMaxTotal:            fraudMaxTotal,
+		FraudMaxItems:            fraudMaxItems,
+		FraudVelocityLimit:       fraudVelocityLimit,
+		FraudVelocityWindowInMs:  time.Millisecond * time.Duration(fraudVelocityWindowInMs),
+		FraudDuplicateWindowInMs: time.Millisecond * time.Duration(fraudDuplicateWindowInMs),
+
+		FraudBloomFilter:            fraudBloomFilter,
+		FraudBloomCapacity:          fraudBloomCapacity,
+		FraudBloomFalsePositiveRate: fraudBloomFalsePositiveRate,
+		FraudBloomSyncInMs:          time.Millisecond * time.Duration(fraudBloomSyncInMs),
+
+		SubmissionLockInMs: time.Millisecond * time.Duration(submissionLockInMs),
+
+		DbAttemptTimeoutInMs:  time.Millisecond * time.Duration(dbAttemptTimeoutInMs),
+		DbRetryBaseDelayInMs:  time.Millisecond * time.Duration(dbRetryBaseDelayInMs),
+		DbRetryMaxDelayInMs:   time.Millisecond * time.Duration(dbRetryMaxDelayInMs),
+		DbRetryMaxElapsedInMs: time.Millisecond * time.Duration(dbRetryMaxElapsedInMs),
+
+		RedisPoolSize:         redisPoolSize,
+		RedisMinIdleConns:     redisMinIdleConns,
+		RedisDialTimeoutInMs:  time.Millisecond * time.Duration(redisDialTimeoutInMs),
+		RedisReadTimeoutInMs:  time.Millisecond * time.Duration(redisReadTimeoutInMs),
+		RedisWriteTimeoutInMs: time.Millisecond * time.Duration(redisWriteTimeoutInMs),
+		RedisMaxRetries:       redisMaxRetries,
+		KeyPrefix:             getenv.string("KEY_PREFIX", ""),
+		RedisHashTags:         redisHashTags,
+
+		BreakerFailureThreshold: breakerFailureThreshold,
+		BreakerOpenInMs:         time.Millisecond * time.Duration(breakerOpenInMs),
+
+		MaxConcurrentReceipts:    maxConcurrentReceipts,
+		ReceiptQueueSize:         receiptQueueSize,
+		MaxConcurrentStoreWrites: maxConcurrentStoreWrites,
+		StoreWriteQueueSize:      storeWriteQueueSize,
+		ConcurrencyQueueWaitInMs: time.Millisecond * time.Duration(concurrencyQueueWaitInMs),
+		MaxInFlightRequests:      maxInFlightRequests,
+		InFlightQueueSize:        inFlightQueueSize,
+		LookupReservedRequests:   lookupReservedRequests,
+
+		WebhookURLs:        getenv.list("WEBHOOK_URLS"),
+		WebhookSecret:      getenv("WEBHOOK_SECRET"),
+		WebhookMaxRetries:  webhookMaxRetries,
+		WebhookTimeoutInMs: time.Millisecond * time.Duration(webhookTimeoutInMs),
+		WebhookBackoffInMs: time.Millisecond * time.Duration(webhookBackoffInMs),
+
+		KafkaBrokers:           getenv.list("KAFKA_BROKERS"),
+		KafkaTopic:             kafkaTopic,
+		KafkaBufferSize:        kafkaBufferSize,
+		KafkaBatchSize:         kafkaBatchSize,
+		KafkaMaxAttempts:       kafkaMaxAttempts,
+		KafkaFlushIntervalInMs: time.Millisecond * time.Duration(kafkaFlushIntervalInMs),
+
+		MaxEventStreams:       maxEventStreams,
+		EventStreamBufferSize: eventStreamBufferSize,
+		EventStreamPingInMs:   time.Millisecond * time.Duration(eventStreamPingInMs),
+
+		OutboxPath:       getenv("OUTBOX_PATH"),
+		OutboxMaxEntries: outboxMaxEntries,
+		OutboxFlushInMs:  time.Millisecond * time.Duration(outboxFlushInMs),
+		DegradedMode:     degradedMode,
+		ChaosMode:        chaosMode,
+
+		ReceiptCacheSize:    receiptCacheSize,
+		ReceiptCacheTTLInMs: time.Millisecond * time.Duration(receiptCacheTTLInMs),
+
+		DualWriteConfig: getenv("DUAL_WRITE_CONFIG"),
+
+		ArchiveBucket:      getenv("ARCHIVE_BUCKET"),
+		ArchiveRegion:      getenv("ARCHIVE_REGION"),
+		ArchiveEndpoint:    getenv("ARCHIVE_ENDPOINT"),
+		ArchivePrefix:      getenv("ARCHIVE_PREFIX"),
+		ArchiveMaxRetries:  archiveMaxRetries,
+		ArchiveTimeoutInMs: time.Millisecond * time.Duration(archiveTimeoutInMs),
+		ArchiveBackoffInMs: time.Millisecond * time.Duration(archiveBackoffInMs),
+
+		ReportDailySchedule:  getenv("REPORT_DAILY_SCHEDULE"),
+		ReportWeeklySchedule: getenv("REPORT_WEEKLY_SCHEDULE"),
+		ReportTopRetailers:   reportTopRetailers,
+		ReportTimeoutInMs:    time.Millisecond * time.Duration(reportTimeoutInMs),
+		ReportWebhookURL:     getenv("REPORT_WEBHOOK_URL"),
+		ReportSMTPAddr:       getenv("REPORT_SMTP_ADDR"),
+		ReportSMTPUsername:   getenv("REPORT_SMTP_USERNAME"),
+		ReportSMTPPassword:   getenv("REPORT_SMTP_PASSWORD"),
+		ReportEmailFrom:      getenv("REPORT_EMAIL_FROM"),
+		ReportEmailTo:        getenv.list("REPORT_EMAIL_TO"),
+		ReportToArchive:      reportToArchive,
+
+		OCRBackend:       getenv("OCR_BACKEND"),
+		OCRTesseractPath: getenv.string("OCR_TESSERACT_PATH", "tesseract"),
+		OCRPdftoppmPath:  getenv.string("OCR_PDFTOPPM_PATH", "pdftoppm"),
+		OCRHTTPURL:       getenv("OCR_HTTP_URL"),
+		OCRHTTPToken:     getenv("OCR_HTTP_TOKEN"),
+		OCRTimeoutInMs:   time.Millisecond * time.Duration(ocrTimeoutInMs),
+
+		RulePluginDir:             getenv("RULE_PLUGIN_DIR"),
+		RulePluginTimeoutInMs:     time.Millisecond * time.Duration(rulePluginTimeoutInMs),
+		RulePluginMemoryLimitInMB: rulePluginMemoryLimitInMB,
 	}
 	return appConfig, nil
 }
+
+// WithTunables returns c with the settings that can change at runtime taken from
+// fresh. Everything else (ports, addresses, secrets, pool sizes) needs a restart.
+func (c Config) WithTunables(fresh Config) Config {
+	c.RequestTimeoutInMs = fresh.RequestTimeoutInMs
+	c.DbTimeoutInMs = fresh.DbTimeoutInMs
+	c.OCRTimeoutInMs = fresh.OCRTimeoutInMs
+	c.LogLevel = fresh.LogLevel
+	c.AccessLogSampleRate = fresh.AccessLogSampleRate
+	c.PointsCacheMaxAgeInSec = fresh.PointsCacheMaxAgeInSec
+	c.MaxReceiptItems = fresh.MaxReceiptItems
+	c.MaxRequestBodyBytes = fresh.MaxRequestBodyBytes
+	c.BusinessTimezone = fresh.BusinessTimezone
+	c.PointsExpiryInMonths = fresh.PointsExpiryInMonths
+	c.ReceiptMaxAgeInSec = fresh.ReceiptMaxAgeInSec
+	c.TombstoneRetentionInSec = fresh.TombstoneRetentionInSec
+	c.FraudScreening = fresh.FraudScreening
+	c.FraudMaxTotal = fresh.FraudMaxTotal
+	c.FraudMaxItems = fresh.FraudMaxItems
+	c.FraudVelocityLimit = fresh.FraudVelocityLimit
+	c.FraudVelocityWindowInMs = fresh.FraudVelocityWindowInMs
+	c.FraudDuplicateWindowInMs = fresh.FraudDuplicateWindowInMs
+	c.WebhookURLs = fresh.WebhookURLs
+	c.WebhookMaxRetries = fresh.WebhookMaxRetries
+	c.WebhookTimeoutInMs = fresh.WebhookTimeoutInMs
+	c.WebhookBackoffInMs = fresh.WebhookBackoffInMs
+	return c
+}
+
+// SlogLevel maps LogLevel onto slog, unknown values (rejected by Validate) mean info
+func (c Config) SlogLevel() slog.Level {
+	switch strings.ToLower(c.LogLevel) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// envFunc looks up a config variable, "" meaning unset
+type envFunc func(key string) string
+
+// string reads an optional env var, returning def when it isn't set
+func (getenv envFunc) string(key, def string) string {
+	if v := getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// int reads an optional int env var, returning def when it isn't set
+func (getenv envFunc) int(key string, def int) (int, error) {
+	raw := getenv(key)
+	if raw == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("Error converting %s env to int: %v", key, err)
+	}
+	return v, nil
+}
+
+// bool reads an optional bool env var (true/false/1/0), returning def when it isn't set
+func (getenv envFunc) bool(key string, def bool) (bool, error) {
+	raw := getenv(key)
+	if raw == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("Error converting %s env to bool: %v", key, err)
+	}
+	return v, nil
+}
+
+// float reads an optional float env var, returning def when it isn't set
+func (getenv envFunc) float(key string, def float64) (float64, error) {
+	raw := getenv(key)
+	if raw == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Error converting %s env to float: %v", key, err)
+	}
+	return v, nil
+}
+
+// list reads an optional comma separated env var, dropping empty entries
+func (getenv envFunc) list(key string) []string {
+	var list []string
+	for _, v := range strings.Split(getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// seconds reads an optional comma separated list of name=seconds pairs, like
+// RECEIPT_RETENTION_IN_S=dryrun=600,test=86400
+func (getenv envFunc) seconds(key string) (map[string]time.Duration, error) {
+	pairs := getenv.list(key)
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	values := make(map[string]time.Duration, len(pairs))
+	for _, pair := range pairs {
+		name, raw, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("Error parsing %s env: %q isn't name=seconds", key, pair)
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("Error converting %s env entry %q to int: %v", key, name, err)
+		}
+		if _, dup := values[name]; dup {
+			return nil, fmt.Errorf("Error parsing %s env: %q is set twice", key, name)
+		}
+		values[name] = time.Second * time.Duration(v)
+	}
+	return values, nil
+}
+
+// sets reads an optional comma separated list of name=value+value pairs, like
+// OIDC_ROLES=viewer=read,ops=review+purge
+func (getenv envFunc) sets(key string) (map[string][]string, error) {
+	pairs := getenv.list(key)
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	sets := make(map[string][]string, len(pairs))
+	for _, pair := range pairs {
+		name, raw, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("Error parsing %s env: %q isn't name=value+value", key, pair)
+		}
+		if _, dup := sets[name]; dup {
+			return nil, fmt.Errorf("Error parsing %s env: %q is set twice", key, name)
+		}
+		var values []string
+		for _, v := range strings.Split(raw, "+") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		sets[name] = values
+	}
+	return sets, nil
+}
@@ -0,0 +1,348 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/cron"
+)
+
+var validKeyPrefix = regexp.MustCompile(`^[A-Za-z0-9_.-]+(?::[A-Za-z0-9_.-]+)*$`)
+
+// readEnvFile parses KEY=VALUE lines. Blank lines and lines starting with # are
+// skipped, values may be quoted.
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening config file: %v", err)
+	}
+	defer f.Close()
+
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("Error parsing config file %s line %d: expected KEY=VALUE", path, lineNo)
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		vars[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading config file: %v", err)
+	}
+	return vars, nil
+}
+
+// Validate catches values that parse fine but can't work, so a bad deploy fails at
+// boot (or in --validate-config) instead of on the first request
+func (c Config) Validate() error {
+	port, err := strconv.Atoi(c.ServerPort)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("SERVER_PORT must be a port number, got %q", c.ServerPort)
+	}
+	switch c.StoreBackend {
+	case "redis":
+		if c.RedisAddr == "" {
+			return fmt.Errorf("REDIS_ADDR must not be empty")
+		}
+	case "sqlite":
+		if c.SQLitePath == "" {
+			return fmt.Errorf("SQLITE_PATH must not be empty")
+		}
+	case "dynamodb":
+		if c.DynamoDBTable == "" {
+			return fmt.Errorf("DYNAMODB_TABLE must not be empty")
+		}
+	default:
+		return fmt.Errorf("STORE_BACKEND must be redis, sqlite or dynamodb, got %q", c.StoreBackend)
+	}
+	if c.DbTimeoutInMs <= 0 || c.RequestTimeoutInMs <= 0 || c.DbAttemptTimeoutInMs <= 0 {
+		return fmt.Errorf("DB_TIMEOUT_IN_MS, REQUEST_TIMEOUT_IN_MS and DB_ATTEMPT_TIMEOUT_IN_MS must be positive")
+	}
+	if c.ServerReadHeaderTimeoutInMs <= 0 {
+		return fmt.Errorf("SERVER_READ_HEADER_TIMEOUT_IN_MS must be positive")
+	}
+	if c.ServerReadTimeoutInMs < 0 || c.ServerWriteTimeoutInMs < 0 || c.ServerIdleTimeoutInMs < 0 {
+		return fmt.Errorf("SERVER_READ_TIMEOUT_IN_MS, SERVER_WRITE_TIMEOUT_IN_MS and SERVER_IDLE_TIMEOUT_IN_MS must not be negative")
+	}
+	// a response cut off by the write timeout never reaches the client, the request
+	// timeout has to fire first so it gets a 503
+	if c.ServerWriteTimeoutInMs > 0 && c.ServerWriteTimeoutInMs <= c.RequestTimeoutInMs {
+		return fmt.Errorf("SERVER_WRITE_TIMEOUT_IN_MS must be more than REQUEST_TIMEOUT_IN_MS, or 0")
+	}
+	if c.AccessLogSampleRate < 0 || c.AccessLogSampleRate > 1 {
+		return fmt.Errorf("ACCESS_LOG_SAMPLE_RATE must be between 0 and 1")
+	}
+	if c.RedisTTLInSec < 0 {
+		return fmt.Errorf("REDIS_TTL_IN_S must not be negative")
+	}
+	for class, ttl := range c.ReceiptRetention {
+		if !isRetentionClassName(class) {
+			return fmt.Errorf("RECEIPT_RETENTION_IN_S class names must be lowercase letters, digits, - or _, got %q", class)
+		}
+		if ttl < 0 {
+			return fmt.Errorf("RECEIPT_RETENTION_IN_S must not be negative, %q is", class)
+		}
+	}
+	if c.ReceiptMaxAgeInSec < 0 || c.TombstoneRetentionInSec < 0 {
+		return fmt.Errorf("RECEIPT_MAX_AGE_IN_S and TOMBSTONE_RETENTION_IN_S must not be negative")
+	}
+	if c.RetentionSweepInMs <= 0 {
+		return fmt.Errorf("RETENTION_SWEEP_IN_MS must be positive")
+	}
+	if c.MaxDBConnRetries < 0 {
+		return fmt.Errorf("MAX_DB_CONN_RETRIES must not be negative")
+	}
+	if c.CampaignRefreshInMs <= 0 {
+		return fmt.Errorf("CAMPAIGN_REFRESH_IN_MS must be positive")
+	}
+	if c.MaxReceiptItems < 1 {
+		return fmt.Errorf("MAX_RECEIPT_ITEMS must be at least 1")
+	}
+	if c.MaxRequestBodyBytes < 1 {
+		return fmt.Errorf("MAX_REQUEST_BODY_BYTES must be at least 1")
+	}
+	if _, err := time.LoadLocation(c.BusinessTimezone); err != nil || c.BusinessTimezone == "Local" {
+		return fmt.Errorf("BUSINESS_TIMEZONE must be an IANA zone name like America/Chicago, got %q", c.BusinessTimezone)
+	}
+	if c.PointsCacheMaxAgeInSec < 0 {
+		return fmt.Errorf("POINTS_CACHE_MAX_AGE_IN_S must not be negative")
+	}
+	if c.PointsExpiryInMonths < 0 {
+		return fmt.Errorf("POINTS_EXPIRY_IN_MONTHS must not be negative")
+	}
+	if c.PointsExpirySweepInMs <= 0 {
+		return fmt.Errorf("POINTS_EXPIRY_SWEEP_IN_MS must be positive")
+	}
+	if c.FraudMaxTotal <= 0 || c.FraudMaxItems < 1 || c.FraudVelocityLimit < 1 {
+		return fmt.Errorf("FRAUD_MAX_TOTAL, FRAUD_MAX_ITEMS and FRAUD_VELOCITY_LIMIT must be positive")
+	}
+	if c.FraudVelocityWindowInMs <= 0 || c.FraudDuplicateWindowInMs <= 0 {
+		return fmt.Errorf("FRAUD_VELOCITY_WINDOW_IN_MS and FRAUD_DUPLICATE_WINDOW_IN_MS must be positive")
+	}
+	if c.FraudBloomFilter {
+		if c.StoreBackend != "redis" {
+			return fmt.Errorf("FRAUD_BLOOM_FILTER needs STORE_BACKEND=redis, the filters are shared through Redis")
+		}
+		if c.FraudBloomCapacity < 1 || c.FraudBloomSyncInMs <= 0 {
+			return fmt.Errorf("FRAUD_BLOOM_CAPACITY and FRAUD_BLOOM_SYNC_IN_MS must be positive")
+		}
+		if c.FraudBloomFalsePositiveRate <= 0 || c.FraudBloomFalsePositiveRate >= 1 {
+			return fmt.Errorf("FRAUD_BLOOM_FALSE_POSITIVE_RATE must be between 0 and 1")
+		}
+	}
+	if c.SubmissionLockInMs < 0 {
+		return fmt.Errorf("SUBMISSION_LOCK_IN_MS must not be negative")
+	}
+	if c.MaxConcurrentReceipts < 0 || c.ReceiptQueueSize < 0 || c.MaxConcurrentStoreWrites < 0 || c.StoreWriteQueueSize < 0 {
+		return fmt.Errorf("MAX_CONCURRENT_RECEIPTS, RECEIPT_QUEUE_SIZE, MAX_CONCURRENT_STORE_WRITES and STORE_WRITE_QUEUE_SIZE must not be negative")
+	}
+	if c.MaxInFlightRequests < 0 || c.InFlightQueueSize < 0 || c.LookupReservedRequests < 0 {
+		return fmt.Errorf("MAX_IN_FLIGHT_REQUESTS, IN_FLIGHT_QUEUE_SIZE and LOOKUP_RESERVED_REQUESTS must not be negative")
+	}
+	if c.LookupReservedRequests > 0 && c.LookupReservedRequests >= c.MaxInFlightRequests {
+		return fmt.Errorf("LOOKUP_RESERVED_REQUESTS must be less than MAX_IN_FLIGHT_REQUESTS, which must be set")
+	}
+	if c.ConcurrencyQueueWaitInMs <= 0 {
+		return fmt.Errorf("CONCURRENCY_QUEUE_WAIT_IN_MS must be positive")
+	}
+	if c.RedisPoolSize < 0 || c.RedisMinIdleConns < 0 || c.RedisMaxRetries < 0 {
+		return fmt.Errorf("REDIS_POOL_SIZE, REDIS_MIN_IDLE_CONNS and REDIS_MAX_RETRIES must not be negative")
+	}
+	if c.RedisPoolSize > 0 && c.RedisMinIdleConns > c.RedisPoolSize {
+		return fmt.Errorf("REDIS_MIN_IDLE_CONNS must not be more than REDIS_POOL_SIZE")
+	}
+	if (c.KeyPrefix != "" || c.RedisHashTags) && c.StoreBackend != "redis" {
+		return fmt.Errorf("KEY_PREFIX and REDIS_HASH_TAGS need STORE_BACKEND=redis, give other stores a file or table of their own instead")
+	}
+	// tenants' keys start with tenant:, a namespace that does too would be mistaken for one
+	if c.KeyPrefix != "" && (!validKeyPrefix.MatchString(c.KeyPrefix) || c.KeyPrefix == "tenant" || strings.HasPrefix(c.KeyPrefix, "tenant:")) {
+		return fmt.Errorf("KEY_PREFIX must be letters, digits, '-', '_', '.' and ':' and not start with tenant, got %q", c.KeyPrefix)
+	}
+	if c.RedisDialTimeoutInMs <= 0 || c.RedisReadTimeoutInMs <= 0 || c.RedisWriteTimeoutInMs <= 0 {
+		return fmt.Errorf("REDIS_DIAL_TIMEOUT_IN_MS, REDIS_READ_TIMEOUT_IN_MS and REDIS_WRITE_TIMEOUT_IN_MS must be positive")
+	}
+	if c.BreakerFailureThreshold < 1 {
+		return fmt.Errorf("BREAKER_FAILURE_THRESHOLD must be at least 1")
+	}
+	if c.MaxEventStreams < 0 || c.EventStreamBufferSize < 1 || c.EventStreamPingInMs <= 0 {
+		return fmt.Errorf("MAX_EVENT_STREAMS must not be negative, EVENT_STREAM_BUFFER_SIZE and EVENT_STREAM_PING_IN_MS must be positive")
+	}
+	// a stream's deadlines are pushed out on every ping, a quiet stream would time out
+	// between two
+	for _, timeout := range []time.Duration{c.ServerReadTimeoutInMs, c.ServerWriteTimeoutInMs} {
+		if timeout > 0 && c.EventStreamPingInMs >= timeout {
+			return fmt.Errorf("EVENT_STREAM_PING_IN_MS must be less than SERVER_READ_TIMEOUT_IN_MS and SERVER_WRITE_TIMEOUT_IN_MS")
+		}
+	}
+	if c.OutboxMaxEntries < 0 || c.OutboxFlushInMs <= 0 {
+		return fmt.Errorf("OUTBOX_MAX_ENTRIES must not be negative, OUTBOX_FLUSH_IN_MS must be positive")
+	}
+	if c.ChaosMode && c.StoreBackend != "redis" {
+		return fmt.Errorf("CHAOS_MODE needs STORE_BACKEND=redis, store faults are injected into the Redis client")
+	}
+	if c.ReceiptCacheSize < 0 || c.ReceiptCacheTTLInMs <= 0 {
+		return fmt.Errorf("RECEIPT_CACHE_SIZE must not be negative, RECEIPT_CACHE_TTL_IN_MS must be positive")
+	}
+	if c.ArchiveBucket != "" {
+		if c.ArchiveMaxRetries < 0 || c.ArchiveTimeoutInMs <= 0 || c.ArchiveBackoffInMs <= 0 {
+			return fmt.Errorf("ARCHIVE_MAX_RETRIES must not be negative, ARCHIVE_TIMEOUT_IN_MS and ARCHIVE_BACKOFF_IN_MS must be positive")
+		}
+		if c.ArchiveEndpoint != "" {
+			if u, err := url.Parse(c.ArchiveEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("ARCHIVE_ENDPOINT must be a URL like http://minio:9000, got %q", c.ArchiveEndpoint)
+			}
+		}
+	}
+	for _, schedule := range []struct{ name, spec string }{
+		{"REPORT_DAILY_SCHEDULE", c.ReportDailySchedule},
+		{"REPORT_WEEKLY_SCHEDULE", c.ReportWeeklySchedule},
+	} {
+		name, spec := schedule.name, schedule.spec
+		if spec == "" {
+			continue
+		}
+		parsed, err := cron.Parse(spec)
+		if err != nil {
+			return fmt.Errorf("%s must be a cron schedule like \"0 6 * * *\": %v", name, err)
+		}
+		if parsed.Next(time.Now()).IsZero() {
+			return fmt.Errorf("%s never fires, got %q", name, spec)
+		}
+		if !c.HasReportDestination() {
+			return fmt.Errorf("%s needs somewhere to send reports: REPORT_WEBHOOK_URL, REPORT_SMTP_ADDR or REPORT_TO_ARCHIVE", name)
+		}
+	}
+	if c.ReportTopRetailers < 1 || c.ReportTimeoutInMs <= 0 {
+		return fmt.Errorf("REPORT_TOP_RETAILERS and REPORT_TIMEOUT_IN_MS must be positive")
+	}
+	if c.ReportWebhookURL != "" {
+		if u, err := url.Parse(c.ReportWebhookURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("REPORT_WEBHOOK_URL must be a URL like https://hooks.example.com/reports, got %q", c.ReportWebhookURL)
+		}
+	}
+	if c.ReportSMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.ReportSMTPAddr); err != nil {
+			return fmt.Errorf("REPORT_SMTP_ADDR must be host:port like smtp.example.com:587, got %q", c.ReportSMTPAddr)
+		}
+		if c.ReportEmailFrom == "" || len(c.ReportEmailTo) == 0 {
+			return fmt.Errorf("REPORT_EMAIL_FROM and REPORT_EMAIL_TO must be set to email reports")
+		}
+	}
+	if c.ReportToArchive && c.ArchiveBucket == "" {
+		return fmt.Errorf("REPORT_TO_ARCHIVE needs ARCHIVE_BUCKET, reports are kept next to the receipts")
+	}
+	if c.RulePluginTimeoutInMs <= 0 || c.RulePluginMemoryLimitInMB < 1 {
+		return fmt.Errorf("RULE_PLUGIN_TIMEOUT_IN_MS and RULE_PLUGIN_MEMORY_LIMIT_IN_MB must be positive")
+	}
+	// a WebAssembly module can't address more than 4GB
+	if c.RulePluginMemoryLimitInMB > 4096 {
+		return fmt.Errorf("RULE_PLUGIN_MEMORY_LIMIT_IN_MB can be 4096 at most")
+	}
+	if c.OIDCIssuerURL != "" {
+		// shared static keys are what OIDC replaces, both at once would keep one around
+		if c.AdminToken != "" {
+			return fmt.Errorf("ADMIN_TOKEN and OIDC_ISSUER_URL must not both be set")
+		}
+		if u, err := url.Parse(c.OIDCIssuerURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("OIDC_ISSUER_URL must be a URL like https://login.example.com, got %q", c.OIDCIssuerURL)
+		}
+		if c.OIDCClientID == "" || c.OIDCRolesClaim == "" {
+			return fmt.Errorf("OIDC_CLIENT_ID and OIDC_ROLES_CLAIM must not be empty")
+		}
+		if c.OIDCRedirectURL != "" {
+			if c.OIDCClientSecret == "" {
+				return fmt.Errorf("OIDC_CLIENT_SECRET must be set for browser sign in through OIDC_REDIRECT_URL")
+			}
+			if u, err := url.Parse(c.OIDCRedirectURL); err != nil || u.Host == "" || u.Path != "/admin/callback" {
+				return fmt.Errorf("OIDC_REDIRECT_URL must be this service's /admin/callback URL, got %q", c.OIDCRedirectURL)
+			}
+		}
+		if len(c.OIDCRoles) == 0 {
+			return fmt.Errorf("OIDC_ROLES must map at least one role onto admin capabilities")
+		}
+		for role, capabilities := range c.OIDCRoles {
+			if len(capabilities) == 0 {
+				return fmt.Errorf("OIDC_ROLES must give role %q at least one capability", role)
+			}
+			for _, capability := range capabilities {
+				if !isAdminCapability(capability) {
+					return fmt.Errorf("OIDC_ROLES capabilities must be one of %s, role %q has %q", strings.Join(AdminCapabilities, ", "), role, capability)
+				}
+			}
+		}
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("LOG_LEVEL must be one of debug, info, warn or error, got %q", c.LogLevel)
+	}
+	return nil
+}
+
+// AdminCapabilities are what OIDC_ROLES can grant: read (every lookup), review (approve
+// and reject flagged receipts), rules (rules, campaigns, retailers and recalculation),
+// purge (deleting receipts and maintenance) and admin (all of it, webhooks too)
+var AdminCapabilities = []string{"read", "review", "rules", "purge", "admin"}
+
+func isAdminCapability(name string) bool {
+	for _, c := range AdminCapabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HasReportDestination reports whether scheduled reports have anywhere to go
+func (c Config) HasReportDestination() bool {
+	return c.ReportWebhookURL != "" || c.ReportSMTPAddr != "" || c.ReportToArchive
+}
+
+func isRetentionClassName(name string) bool {
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Describe lists every setting as "Name: value", one per line, with secrets masked.
+// Meant for humans debugging what a deployment actually resolved to.
+func (c Config) Describe() string {
+	var b strings.Builder
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value := fmt.Sprint(v.Field(i).Interface())
+		if isSecretField(name) && value != "" {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(&b, "%s: %s\n", name, value)
+	}
+	return b.String()
+}
+
+func isSecretField(name string) bool {
+	return strings.HasSuffix(name, "Token") || strings.HasSuffix(name, "Secret") || strings.HasSuffix(name, "Password")
+}
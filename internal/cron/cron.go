@@ -0,0 +1,166 @@
+// Package cron reads the five field schedules cron uses (minute hour day-of-month month
+// day-of-week), for the background work that runs at set times instead of every so
+// often. Schedules are in UTC.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// macros are the @ shorthands cron takes for the common schedules
+var macros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// how far ahead Next looks before deciding a schedule never fires (Feb 30 and the like)
+const maxLookahead = 5 * 366 * 24 * time.Hour
+
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = [5]field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	// 7 is Sunday as well as 0
+	{"day of week", 0, 7},
+}
+
+// Schedule is a parsed cron expression, a set of allowed values per field
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// like cron, a day matches on day of month or day of week when both are
+	// restricted, and on the restricted one otherwise
+	domAny, dowAny bool
+}
+
+// Parse reads a five field cron expression like "0 6 * * 1-5", or one of the @hourly,
+// @daily, @weekly, @monthly and @yearly shorthands. Fields take *, numbers, ranges
+// (1-5), steps (*/15, 0-30/10) and comma separated lists of those.
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := macros[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return Schedule{}, fmt.Errorf("cron schedule %q must have 5 fields (minute hour day-of-month month day-of-week), it has %d", spec, len(parts))
+	}
+	var sets [5]uint64
+	for i, part := range parts {
+		set, err := parseField(part, fields[i])
+		if err != nil {
+			return Schedule{}, fmt.Errorf("cron schedule %q: %v", spec, err)
+		}
+		sets[i] = set
+	}
+	s := Schedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: parts[2] == "*",
+		dowAny: parts[4] == "*",
+	}
+	// Sunday is matched as 0
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parseField reads one field into a bit set of its allowed values
+func parseField(raw string, f field) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(raw, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("%s step %q must be a positive number", f.name, stepPart)
+			}
+			step = n
+		}
+		lo, hi := f.min, f.max
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = parseValue(first, f); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = parseValue(last, f); err != nil {
+					return 0, err
+				}
+				if hi < lo {
+					return 0, fmt.Errorf("%s range %q runs backwards", f.name, rangePart)
+				}
+			} else if hasStep {
+				// 5/15 is 5, 20, 35, 50
+				hi = f.max
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func parseValue(raw string, f field) (int, error) {
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s %q must be a number from %d to %d", f.name, raw, f.min, f.max)
+	}
+	return v, nil
+}
+
+func (s Schedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<t.Weekday()) != 0
+	switch {
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Next is the first time after after (to the minute, in UTC) the schedule fires, the
+// zero time when it never does
+func (s Schedule) Next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxLookahead)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,59 @@
+package cron
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// a Monday
+	from := time.Date(2024, time.January, 15, 12, 0, 30, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"0 6 * * *", time.Date(2024, time.January, 16, 6, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.January, 16, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.January, 15, 12, 15, 0, 0, time.UTC)},
+		// same minute as from is in the past
+		{"0 12 * * *", time.Date(2024, time.January, 16, 12, 0, 0, 0, time.UTC)},
+		{"30 7 * * 1", time.Date(2024, time.January, 22, 7, 30, 0, 0, time.UTC)},
+		{"0 7 * * 7", time.Date(2024, time.January, 21, 7, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2024, time.January, 16, 9, 0, 0, 0, time.UTC)},
+		{"5/20 13 * * *", time.Date(2024, time.January, 15, 13, 5, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		// day of month or day of week when both are restricted
+		{"0 0 20 * 3", time.Date(2024, time.January, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := Parse(tc.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tc.want) {
+			t.Errorf("%q: next is %v, want %v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for spec, want := range map[string]string{
+		"0 6 * *":      "5 fields",
+		"60 * * * *":   "minute",
+		"0 24 * * *":   "hour",
+		"0 0 0 * *":    "day of month",
+		"0 0 * 13 *":   "month",
+		"0 0 * * 8":    "day of week",
+		"*/0 * * * *":  "step",
+		"0 9-5 * * *":  "backwards",
+		"0 6 * * MON":  "day of week",
+		"@fortnightly": "5 fields",
+	} {
+		if _, err := Parse(spec); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Parse(%q) = %v, want an error about %s", spec, err, want)
+		}
+	}
+}
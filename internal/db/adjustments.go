@@ -0,0 +1,235 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MaxReceiptAdjustments is how many adjustments a receipt can take, its points are
+// answered with all of them
+const MaxReceiptAdjustments = 100
+
+var (
+	// ErrAdjustmentConflict is returned when an adjustment id is reused for a different
+	// adjustment
+	ErrAdjustmentConflict = errors.New("adjustment id already used for a different adjustment")
+	// ErrReceiptOverdrawn is returned when a clawback would take a receipt's adjusted
+	// total below zero
+	ErrReceiptOverdrawn = errors.New("clawback is more than the receipt's points")
+	// ErrTooManyAdjustments is returned when a receipt has MaxReceiptAdjustments already
+	ErrTooManyAdjustments = errors.New("receipt has too many adjustments")
+)
+
+// Adjustment is one entry of a user's adjustment ledger: points an operator credited
+// (goodwill) or took back (a clawback), with ReceiptID set when it was for a receipt.
+// Receipts keep the points they were scored with, their adjusted total is those plus
+// their adjustments.
+type Adjustment struct {
+	ID        string `json:"id"`
+	UserID    string `json:"userId"`
+	ReceiptID string `json:"receiptId,omitempty"`
+	// negative for clawbacks
+	Points int    `json:"points"`
+	Reason string `json:"reason"`
+	// who made it, the admin's subject
+	By           string    `json:"by,omitempty"`
+	BalanceAfter int       `json:"balanceAfter"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func (rs *RedisStore) adjustmentKey(userID, id string) string {
+	return rs.key(userKeyPrefix + userID + ":adjustment:" + id)
+}
+
+func (rs *RedisStore) userAdjustmentsKey(userID string) string {
+	return rs.key(userKeyPrefix + userID + ":adjustments")
+}
+
+// receiptAdjustmentsKey indexes the adjustments of one of the user's receipts
+func (rs *RedisStore) receiptAdjustmentsKey(userID, receiptID string) string {
+	return rs.key(userKeyPrefix + userID + ":adjustments:" + receiptID)
+}
+
+// adjustScript is redeemScript for adjustments: it checks the balance stays covered,
+// moves it and writes the ledger entry in one step, and returns the original entry for
+// an id that was already used. KEYS[4] and on are only there for adjustments of a
+// receipt: its index, its record and the entries of the ids in ARGV[6] and on, what
+// the index held when they were read. The receipt is held to ARGV[5] adjustments and
+// to its points as stored plus its adjustments at or above zero.
+// replies {0, entry} when adjusted, {1, entry} when the id was already used,
+// {2, balance} when a clawback would take the balance below zero, {3, count} when the
+// receipt has too many adjustments, {4, total} when a clawback would take the
+// receipt's adjusted total below zero, {5} when the receipt doesn't exist and {6}
+// when its index changed since it was read
+var adjustScript = redis.NewScript(`
+local existing = redis.call('GET', KEYS[2])
+if existing then
+	return {1, existing}
+end
+local points = tonumber(ARGV[1])
+if KEYS[4] then
+	local record = redis.call('GET', KEYS[5])
+	if not record then
+		return {5, ''}
+	end
+	local ids = redis.call('ZRANGE', KEYS[4], 0, -1)
+	if #ids ~= #KEYS - 5 then
+		return {6, ''}
+	end
+	for i, id in ipairs(ids) do
+		if id ~= ARGV[5 + i] then
+			return {6, ''}
+		end
+	end
+	if #ids >= tonumber(ARGV[5]) then
+		return {3, tostring(#ids)}
+	end
+	local total = tonumber(cjson.decode(record)['points'])
+	for i = 6, #KEYS do
+		local other = redis.call('GET', KEYS[i])
+		if other then
+			total = total + cjson.decode(other)['points']
+		end
+	end
+	if total + points < 0 then
+		return {4, tostring(total)}
+	end
+end
+local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+if balance + points < 0 then
+	return {2, tostring(balance)}
+end
+local entry = cjson.decode(ARGV[2])
+entry['balanceAfter'] = redis.call('INCRBY', KEYS[1], points)
+local encoded = cjson.encode(entry)
+redis.call('SET', KEYS[2], encoded)
+redis.call('ZADD', KEYS[3], ARGV[3], ARGV[4])
+if KEYS[4] then
+	redis.call('ZADD', KEYS[4], ARGV[3], ARGV[4])
+end
+return {0, encoded}
+`)
+
+// Adjust moves the user's balance by an adjustment and records it in their ledger, and
+// in its receipt's when it has one. It reports whether the adjustment is new; like with
+// redemptions, replaying an id returns the original entry without moving the balance
+// again, ErrAdjustmentConflict when it's for different points, receipt or reason.
+// ErrInsufficientPoints when a clawback is more than the balance. An adjustment of a
+// receipt is held to MaxReceiptAdjustments (ErrTooManyAdjustments) and can't take the
+// receipt's points plus adjustments below zero (ErrReceiptOverdrawn), both checked
+// against the receipt as stored when it's written. ErrNotFound without the receipt.
+func (rs *RedisStore) Adjust(ctx context.Context, adj Adjustment) (Adjustment, bool, error) {
+	entry, err := json.Marshal(adj)
+	if err != nil {
+		return Adjustment{}, false, fmt.Errorf("Error encoding adjustment: %v", err)
+	}
+
+	var reply []interface{}
+	// design decision: every key the script reads is in KEYS, so it runs on a cluster
+	// too. the receipt's entries are read first and the script bails out when its index
+	// changed meanwhile, the retry reads them again
+	err = rs.withWriteSlot(ctx, "adjusting points", func(ctx context.Context) error {
+		keys := []string{rs.userBalanceKey(adj.UserID), rs.adjustmentKey(adj.UserID, adj.ID), rs.userAdjustmentsKey(adj.UserID)}
+		args := []interface{}{adj.Points, entry, float64(adj.CreatedAt.UnixMicro()), adj.ID, MaxReceiptAdjustments}
+		if adj.ReceiptID != "" {
+			indexKey := rs.receiptAdjustmentsKey(adj.UserID, adj.ReceiptID)
+			ids, err := rs.client.ZRange(ctx, indexKey, 0, -1).Result()
+			if err != nil {
+				return err
+			}
+			keys = append(keys, indexKey, rs.receiptKey(adj.ReceiptID))
+			for _, id := range ids {
+				keys = append(keys, rs.adjustmentKey(adj.UserID, id))
+				args = append(args, id)
+			}
+		}
+		var err error
+		reply, err = adjustScript.Run(ctx, rs.client, keys, args...).Slice()
+		if err == nil && len(reply) == 2 && reply[0] == int64(6) {
+			return redis.TxFailedErr
+		}
+		return err
+	})
+	if err != nil {
+		return Adjustment{}, false, fmt.Errorf("Error adjusting points: %w", err)
+	}
+	if len(reply) != 2 {
+		return Adjustment{}, false, fmt.Errorf("Error adjusting points: unexpected reply %v", reply)
+	}
+	status, _ := reply[0].(int64)
+	payload, _ := reply[1].(string)
+	switch status {
+	case 2:
+		return Adjustment{}, false, fmt.Errorf("Error adjusting by %d points with a balance of %s: %w", adj.Points, payload, ErrInsufficientPoints)
+	case 3:
+		return Adjustment{}, false, fmt.Errorf("Error adjusting receipt %s with %s adjustments: %w", adj.ReceiptID, payload, ErrTooManyAdjustments)
+	case 4:
+		return Adjustment{}, false, fmt.Errorf("Error adjusting receipt %s by %d points with %s left: %w", adj.ReceiptID, adj.Points, payload, ErrReceiptOverdrawn)
+	case 5:
+		return Adjustment{}, false, fmt.Errorf("Error adjusting receipt %s: %w", adj.ReceiptID, ErrNotFound)
+	}
+
+	var stored Adjustment
+	if err := json.Unmarshal([]byte(payload), &stored); err != nil {
+		return Adjustment{}, false, fmt.Errorf("Error decoding adjustment: %v", err)
+	}
+	if status == 1 && (stored.Points != adj.Points || stored.ReceiptID != adj.ReceiptID || stored.Reason != adj.Reason) {
+		return Adjustment{}, false, fmt.Errorf("Error adjusting %s: %w", adj.ID, ErrAdjustmentConflict)
+	}
+	return stored, status == 0, nil
+}
+
+// ListAdjustments returns up to limit of the user's latest adjustments, newest first,
+// only the ones of receiptID unless that's empty
+func (rs *RedisStore) ListAdjustments(ctx context.Context, userID, receiptID string, limit int) ([]Adjustment, error) {
+	indexKey := rs.userAdjustmentsKey(userID)
+	if receiptID != "" {
+		indexKey = rs.receiptAdjustmentsKey(userID, receiptID)
+	}
+	var ids []string
+	err := rs.withRetry(ctx, "listing adjustments", func(ctx context.Context) error {
+		var err error
+		ids, err = rs.client.ZRevRange(ctx, indexKey, 0, int64(limit)-1).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing adjustments: %w", err)
+	}
+	return rs.getAdjustments(ctx, userID, ids)
+}
+
+// getAdjustments reads the user's adjustments by id, in the order of ids
+func (rs *RedisStore) getAdjustments(ctx context.Context, userID string, ids []string) ([]Adjustment, error) {
+	if len(ids) == 0 {
+		return []Adjustment{}, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = rs.adjustmentKey(userID, id)
+	}
+	values, err := rs.GetMany(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching adjustments: %w", err)
+	}
+	adjustments := make([]Adjustment, 0, len(values))
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var adj Adjustment
+		if err := json.Unmarshal([]byte(s), &adj); err != nil {
+			logging.Printf(ctx, "Error decoding adjustment %s of user %s: %v", ids[i], userID, err)
+			continue
+		}
+		adjustments = append(adjustments, adj)
+	}
+	return adjustments, nil
+}
@@ -0,0 +1,258 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StoreStats is an overview of what's in Redis, for operators
+type StoreStats struct {
+	Keys            int64  `json:"keys"`
+	UsedMemoryBytes int64  `json:"usedMemoryBytes"`
+	UsedMemoryHuman string `json:"usedMemoryHuman,omitempty"`
+	// index entries, they include receipts that expired and haven't been pruned yet
+	IndexedReceipts int64 `json:"indexedReceipts"`
+	FlaggedReceipts int64 `json:"flaggedReceipts"`
+	ExpiringLots    int64 `json:"expiringLots"`
+}
+
+// DeleteReceipt removes a receipt along with its index, history and review queue
+// entries. Balances are left as they are, whatever the receipt earned stays earned.
+// ErrNotFound when there is no such receipt.
+func (rs *RedisStore) DeleteReceipt(ctx context.Context, id string) error {
+	rec, err := rs.GetReceipt(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("Error deleting receipt %s: %w", id, ErrNotFound)
+		}
+		return err
+	}
+	err = rs.withWriteSlot(ctx, "deleting receipt", func(ctx context.Context) error {
+		_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			rs.queueReceiptDelete(ctx, pipe, rec)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error deleting receipt %s: %w", id, err)
+	}
+	return nil
+}
+
+// queueReceiptDelete removes the record and every index entry pointing at it
+func (rs *RedisStore) queueReceiptDelete(ctx context.Context, pipe redis.Pipeliner, rec ReceiptRecord) {
+	pipe.Del(ctx, rs.receiptKey(rec.ID))
+	pipe.ZRem(ctx, rs.key(createdIndexKey), rec.ID)
+	pipe.ZRem(ctx, rs.key(purchaseDateIndexKey), rec.ID)
+	pipe.ZRem(ctx, rs.retailerIndexKey(rec.Retailer), rec.ID)
+	pipe.ZRem(ctx, rs.canonicalRetailerIndexKey(rec.AnalyticsRetailer()), rec.ID)
+	pipe.ZRem(ctx, rs.key(reviewQueueKey), rec.ID)
+	if rec.UserID != "" {
+		pipe.ZRem(ctx, rs.userReceiptsKey(rec.UserID), rec.ID)
+	}
+}
+
+// ScanKeys lists up to roughly count keys starting with prefix, SCAN style: pass the
+// returned cursor back in for the next page, 0 means done. Pages can come back empty
+// or with duplicates, that's how SCAN works. Keys come back whole, tenant prefix
+// included.
+func (rs *RedisStore) ScanKeys(ctx context.Context, prefix string, cursor uint64, count int64) ([]string, uint64, error) {
+	var (
+		keys []string
+		next uint64
+	)
+	err := rs.withRetry(ctx, "scanning keys", func(ctx context.Context) error {
+		var err error
+		keys, next, err = rs.client.Scan(ctx, cursor, escapeGlob(rs.key(prefix))+"*", count).Result()
+		return err
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error scanning keys: %w", err)
+	}
+	return keys, next, nil
+}
+
+// escapeGlob keeps a prefix from being read as a SCAN pattern
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Stats counts keys and reads memory use from INFO, along with the sizes of the
+// receipt indexes and queues
+func (rs *RedisStore) Stats(ctx context.Context) (StoreStats, error) {
+	var stats StoreStats
+	err := rs.withRetry(ctx, "reading store stats", func(ctx context.Context) error {
+		var (
+			dbSize                       *redis.IntCmd
+			memory                       *redis.StringCmd
+			indexed, flagged, expiryLots *redis.IntCmd
+		)
+		rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			dbSize = pipe.DBSize(ctx)
+			memory = pipe.Info(ctx, "memory")
+			indexed = pipe.ZCard(ctx, rs.key(createdIndexKey))
+			flagged = pipe.ZCard(ctx, rs.key(reviewQueueKey))
+			expiryLots = pipe.ZCard(ctx, rs.key(pointsExpiryKey))
+			return nil
+		})
+		// not every Redis compatible server has INFO memory, it's left out when missing
+		for _, cmd := range []*redis.IntCmd{dbSize, indexed, flagged, expiryLots} {
+			if err := cmd.Err(); err != nil {
+				return err
+			}
+		}
+		stats = StoreStats{
+			Keys:            dbSize.Val(),
+			IndexedReceipts: indexed.Val(),
+			FlaggedReceipts: flagged.Val(),
+			ExpiringLots:    expiryLots.Val(),
+		}
+		stats.UsedMemoryBytes, stats.UsedMemoryHuman = parseMemoryInfo(memory.Val())
+		return nil
+	})
+	if err != nil {
+		return StoreStats{}, fmt.Errorf("Error reading store stats: %w", err)
+	}
+	return stats, nil
+}
+
+func parseMemoryInfo(info string) (int64, string) {
+	var (
+		bytes int64
+		human string
+	)
+	for _, line := range strings.Split(info, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "used_memory":
+			bytes, _ = strconv.ParseInt(value, 10, 64)
+		case "used_memory_human":
+			human = value
+		}
+	}
+	return bytes, human
+}
+
+// PruneIndexes drops index entries whose receipt expired, from the listing indexes
+// and the review queue. Listings already skip (and clean up) those lazily, this gets
+// rid of the ones nobody reads. On the way it adds the receipts saved before the
+// canonical retailer date indexes existed to theirs and drops the sets those replaced.
+// progress is called with the running total of entries checked.
+func (rs *RedisStore) PruneIndexes(ctx context.Context, progress func(checked int)) (int, error) {
+	indexKeys := []string{rs.key(createdIndexKey), rs.key(purchaseDateIndexKey), rs.key(reviewQueueKey)}
+	var legacyKeys []string
+	for _, scan := range []struct {
+		prefix string
+		keys   *[]string
+	}{{retailerIndexKeyPrefix, &indexKeys}, {canonicalRetailerIndexKeyPrefix, &indexKeys}, {legacyCanonicalRetailerSetKeyPrefix, &legacyKeys}} {
+		var cursor uint64
+		for {
+			keys, next, err := rs.ScanKeys(ctx, scan.prefix, cursor, 100)
+			if err != nil {
+				return 0, err
+			}
+			*scan.keys = append(*scan.keys, keys...)
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+	}
+
+	var checked, removed int
+	count := func(n int) {
+		checked += n
+		progress(checked)
+	}
+	for _, indexKey := range indexKeys {
+		n, err := rs.pruneIndex(ctx, indexKey, indexKey == rs.key(createdIndexKey), count)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	if len(legacyKeys) > 0 {
+		err := rs.withWriteSlot(ctx, "dropping legacy indexes", func(ctx context.Context) error {
+			return rs.client.Del(ctx, legacyKeys...).Err()
+		})
+		if err != nil {
+			return removed, fmt.Errorf("Error dropping legacy indexes: %w", err)
+		}
+	}
+	return removed, nil
+}
+
+const pruneBatchSize = 500
+
+// pruneIndex prunes a sorted set index. With reindex the receipts still there are
+// added to their canonical retailer's date index, every receipt is in the creation index.
+func (rs *RedisStore) pruneIndex(ctx context.Context, indexKey string, reindex bool, checked func(n int)) (int, error) {
+	var removed int
+	for start := int64(0); ; {
+		var ids []string
+		err := rs.withRetry(ctx, "reading index", func(ctx context.Context) error {
+			var err error
+			ids, err = rs.client.ZRange(ctx, indexKey, start, start+pruneBatchSize-1).Result()
+			return err
+		})
+		if err != nil {
+			return removed, fmt.Errorf("Error reading index %s: %w", indexKey, err)
+		}
+		if len(ids) == 0 {
+			return removed, nil
+		}
+		records, missing, err := rs.getReceipts(ctx, ids)
+		if err != nil {
+			return removed, err
+		}
+		if reindex && len(records) > 0 {
+			entries := make([]redis.Z, len(records))
+			for i, rec := range records {
+				score, err := dateScore(rec.PurchaseDate)
+				if err != nil {
+					return removed, err
+				}
+				entries[i] = redis.Z{Score: score, Member: rec.ID}
+			}
+			err := rs.withWriteSlot(ctx, "indexing retailers", func(ctx context.Context) error {
+				_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+					for i, rec := range records {
+						pipe.ZAdd(ctx, rs.canonicalRetailerIndexKey(rec.AnalyticsRetailer()), entries[i])
+					}
+					return nil
+				})
+				return err
+			})
+			if err != nil {
+				return removed, fmt.Errorf("Error indexing retailers: %w", err)
+			}
+		}
+		if len(missing) > 0 {
+			err := rs.withWriteSlot(ctx, "pruning index", func(ctx context.Context) error {
+				return rs.client.ZRem(ctx, indexKey, missing...).Err()
+			})
+			if err != nil {
+				return removed, fmt.Errorf("Error pruning index %s: %w", indexKey, err)
+			}
+		}
+		removed += len(missing)
+		checked(len(ids))
+		// the removed entries no longer take up ranks
+		start += int64(len(ids) - len(missing))
+	}
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// design decision: aggregates are counters bumped by the same script that writes the
+// receipt, reading them is a handful of commands however much data there is. like
+// balances they never expire, and they only cover receipts saved since they exist
+const (
+	analyticsTotalsKey    = "analytics:totals"
+	analyticsDaysKey      = "analytics:days"
+	analyticsRetailersKey = "analytics:retailers"
+
+	totalsReceiptsField      = "receipts"
+	totalsScoredPointsField  = "scoredPoints"
+	totalsAwardedPointsField = "awardedPoints"
+)
+
+func dayReceiptsField(day string) string { return day + ":receipts" }
+func dayPointsField(day string) string   { return day + ":points" }
+
+// Analytics are the aggregates over a tenant's receipts. Points are the points
+// receipts were scored with, PointsAwarded leaves out flagged and rejected receipts.
+type Analytics struct {
+	Receipts      int
+	ScoredPoints  int
+	PointsAwarded int
+	Days          []DayAnalytics
+	TopRetailers  []RetailerAnalytics
+}
+
+type DayAnalytics struct {
+	Date     string
+	Receipts int
+	Points   int
+}
+
+type RetailerAnalytics struct {
+	Retailer string
+	Receipts int
+}
+
+// queueAnalyticsChange moves the point totals when a stored receipt is rescored or its
+// points get awarded after review
+func (rs *RedisStore) queueAnalyticsChange(ctx context.Context, pipe redis.Pipeliner, scoredDelta, awardedDelta int) {
+	totals := rs.key(analyticsTotalsKey)
+	if scoredDelta != 0 {
+		pipe.HIncrBy(ctx, totals, totalsScoredPointsField, int64(scoredDelta))
+	}
+	if awardedDelta != 0 {
+		pipe.HIncrBy(ctx, totals, totalsAwardedPointsField, int64(awardedDelta))
+	}
+}
+
+// GetAnalytics reads the totals, the per day counts for days (YYYY-MM-DD, in the
+// order given) and the topRetailers retailers with the most receipts
+func (rs *RedisStore) GetAnalytics(ctx context.Context, days []string, topRetailers int) (Analytics, error) {
+	var (
+		totals    map[string]string
+		dayValues []interface{}
+		retailers []redis.Z
+	)
+	fields := make([]string, 0, 2*len(days))
+	for _, day := range days {
+		fields = append(fields, dayReceiptsField(day), dayPointsField(day))
+	}
+	err := rs.withRetry(ctx, "reading analytics", func(ctx context.Context) error {
+		var totalsCmd *redis.MapStringStringCmd
+		var daysCmd *redis.SliceCmd
+		var retailersCmd *redis.ZSliceCmd
+		_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			totalsCmd = pipe.HGetAll(ctx, rs.key(analyticsTotalsKey))
+			if len(fields) > 0 {
+				daysCmd = pipe.HMGet(ctx, rs.key(analyticsDaysKey), fields...)
+			}
+			retailersCmd = pipe.ZRevRangeWithScores(ctx, rs.key(analyticsRetailersKey), 0, int64(topRetailers)-1)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		totals = totalsCmd.Val()
+		if daysCmd != nil {
+			dayValues = daysCmd.Val()
+		}
+		retailers = retailersCmd.Val()
+		return nil
+	})
+	if err != nil {
+		return Analytics{}, fmt.Errorf("Error reading analytics: %w", err)
+	}
+
+	counter := func(v interface{}) int {
+		s, _ := v.(string)
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	analytics := Analytics{
+		Receipts:      counter(totals[totalsReceiptsField]),
+		ScoredPoints:  counter(totals[totalsScoredPointsField]),
+		PointsAwarded: counter(totals[totalsAwardedPointsField]),
+		Days:          make([]DayAnalytics, len(days)),
+		TopRetailers:  make([]RetailerAnalytics, 0, len(retailers)),
+	}
+	for i, day := range days {
+		analytics.Days[i] = DayAnalytics{Date: day}
+		if len(dayValues) == len(fields) {
+			analytics.Days[i].Receipts = counter(dayValues[2*i])
+			analytics.Days[i].Points = counter(dayValues[2*i+1])
+		}
+	}
+	for _, z := range retailers {
+		member, _ := z.Member.(string)
+		analytics.TopRetailers = append(analytics.TopRetailers, RetailerAnalytics{Retailer: member, Receipts: int(z.Score)})
+	}
+	return analytics, nil
+}
@@ -0,0 +1,43 @@
+// Package backend opens the store a configuration's STORE_BACKEND names. It lives
+// outside package db so that db doesn't depend on its own implementations.
+package backend
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/dynamo"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/sqlite"
+)
+
+// Open opens the store STORE_BACKEND names, Redis by default
+func Open(cfg config.Config) (db.Store, error) {
+	switch cfg.StoreBackend {
+	case "sqlite":
+		store, err := sqlite.Open(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening database at %s: %v", cfg.SQLitePath, err)
+		}
+		return store, nil
+	case "dynamodb":
+		store, err := dynamo.Open(context.Background(), cfg)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening DynamoDB table %s: %v", cfg.DynamoDBTable, err)
+		}
+		return store, nil
+	}
+	return db.NewRedisStore(cfg), nil
+}
+
+// Addr is where the store lives, for error messages
+func Addr(cfg config.Config) string {
+	switch cfg.StoreBackend {
+	case "sqlite":
+		return cfg.SQLitePath
+	case "dynamodb":
+		return "DynamoDB table " + cfg.DynamoDBTable
+	}
+	return cfg.RedisAddr
+}
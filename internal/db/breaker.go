@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/breaker"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// breakerHook puts every command the client sends, pipelines included, behind the
+// circuit breaker. Doing it at the client level means new store methods are covered
+// without having to remember to wrap them.
+type breakerHook struct {
+	breaker *breaker.Breaker
+}
+
+func (h breakerHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (h breakerHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := h.breaker.Allow(); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		err := next(ctx, cmd)
+		h.record(err)
+		return err
+	}
+}
+
+func (h breakerHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := h.breaker.Allow(); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		err := next(ctx, cmds)
+		h.record(err)
+		return err
+	}
+}
+
+func (h breakerHook) record(err error) {
+	if isStoreFailure(err) {
+		h.breaker.Failure()
+	} else {
+		h.breaker.Success()
+	}
+}
+
+// isStoreFailure tells Redis being unhealthy apart from errors that say nothing about
+// its health: a missing key, an error reply (Redis is up enough to answer) or the
+// caller giving up on its own.
+func isStoreFailure(err error) bool {
+	if err == nil || err == redis.Nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var redisErr redis.Error
+	return !errors.As(err, &redisErr)
+}
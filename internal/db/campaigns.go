@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+const campaignsKey = "campaigns"
+
+// Campaign is a time-bounded promotion applied on top of the points rules to receipts
+// whose purchase date falls between StartDate and EndDate (both inclusive).
+type Campaign struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	StartDate string `json:"startDate"` // YYYY-MM-DD
+	EndDate   string `json:"endDate"`   // YYYY-MM-DD
+	// optional, limits the campaign to one retailer (case-insensitive), or to the
+	// receipts the retailer registry has under one id. At most one of them
+	Retailer   string `json:"retailer,omitempty"`
+	RetailerID string `json:"retailerId,omitempty"`
+
+	// multiplies the receipt's points, 0 means 1
+	PointsMultiplier float64 `json:"pointsMultiplier,omitempty"`
+	// flat bonus per receipt
+	BonusPoints int `json:"bonusPoints,omitempty"`
+	// bonus per item whose description contains one of the category's keywords
+	Category *CategoryBonus `json:"category,omitempty"`
+}
+
+type CategoryBonus struct {
+	Keywords      []string `json:"keywords"`
+	PointsPerItem int      `json:"pointsPerItem"`
+}
+
+// SaveCampaign creates the campaign or replaces the one with the same ID
+func (rs *RedisStore) SaveCampaign(ctx context.Context, c Campaign) error {
+	value, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("Error encoding campaign: %v", err)
+	}
+	err = rs.withWriteSlot(ctx, "saving campaign", func(ctx context.Context) error {
+		return rs.client.HSet(ctx, rs.key(campaignsKey), c.ID, value).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("Error saving campaign: %w", err)
+	}
+	return nil
+}
+
+func (rs *RedisStore) DeleteCampaign(ctx context.Context, id string) error {
+	var deleted int64
+	err := rs.withWriteSlot(ctx, "deleting campaign", func(ctx context.Context) error {
+		var err error
+		deleted, err = rs.client.HDel(ctx, rs.key(campaignsKey), id).Result()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error deleting campaign: %w", err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("Error deleting campaign %s: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// ListCampaigns returns every campaign, past and future ones included, ordered by start
+// date
+func (rs *RedisStore) ListCampaigns(ctx context.Context) ([]Campaign, error) {
+	var values map[string]string
+	err := rs.withRetry(ctx, "listing campaigns", func(ctx context.Context) error {
+		var err error
+		values, err = rs.client.HGetAll(ctx, rs.key(campaignsKey)).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing campaigns: %w", err)
+	}
+	campaigns := make([]Campaign, 0, len(values))
+	for id, value := range values {
+		var c Campaign
+		if err := json.Unmarshal([]byte(value), &c); err != nil {
+			logging.Printf(ctx, "Error decoding campaign %s: %v", id, err)
+			continue
+		}
+		campaigns = append(campaigns, c)
+	}
+	sort.Slice(campaigns, func(i, j int) bool {
+		if campaigns[i].StartDate != campaigns[j].StartDate {
+			return campaigns[i].StartDate < campaigns[j].StartDate
+		}
+		return campaigns[i].ID < campaigns[j].ID
+	})
+	return campaigns, nil
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/chaos"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// InjectFaults puts the injector's store faults on every command the client sends,
+// inside the circuit breaker, so they're retried and counted like the real thing
+func (rs *RedisStore) InjectFaults(faults *chaos.Injector) {
+	rs.client.AddHook(chaosHook{faults: faults})
+}
+
+type chaosHook struct {
+	faults *chaos.Injector
+}
+
+func (h chaosHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h chaosHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := h.inject(ctx); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h chaosHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := h.inject(ctx); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// inject dresses an injected failure up as what Redis going wrong that way looks like
+// to the client
+func (h chaosHook) inject(ctx context.Context) error {
+	err := h.faults.Inject(ctx, chaos.Store)
+	var injected *chaos.Error
+	if !errors.As(err, &injected) {
+		return err
+	}
+	switch injected.Kind {
+	case chaos.Loading:
+		return injectedReply("LOADING " + injected.Error())
+	case chaos.Reply:
+		return injectedReply("ERR " + injected.Error())
+	}
+	return &net.OpError{Op: "read", Net: "tcp", Err: injected}
+}
+
+// injectedReply is an error reply Redis never sent
+type injectedReply string
+
+func (e injectedReply) Error() string { return string(e) }
+
+func (injectedReply) RedisError() {}
@@ -0,0 +1,230 @@
+// Package dualwrite mirrors a store's writes to a second store while data moves from
+// one backend to another, see cmd/migrate. Reads only ever go to the primary.
+package dualwrite
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+// Stats counts the writes mirrored to the secondary since boot
+type Stats struct {
+	Mirrored int64 `json:"mirrored"`
+	Failed   int64 `json:"failed"`
+}
+
+type counters struct {
+	mirrored atomic.Int64
+	failed   atomic.Int64
+}
+
+// Store is the primary with every write that succeeded on it repeated on the
+// secondary. A write the secondary fails is logged and counted, never failed: the
+// primary is the source of truth until the switch, cmd/migrate verify finds what the
+// secondary missed. Fingerprint claims, submission counts and usage are short-lived and
+// aren't mirrored.
+type Store struct {
+	db.Store
+	secondary db.Store
+	counters  *counters
+}
+
+// New mirrors primary's writes to secondary
+func New(primary, secondary db.Store) *Store {
+	return &Store{Store: primary, secondary: secondary, counters: &counters{}}
+}
+
+// MirrorStats is named so as not to shadow the store's own Stats
+func (s *Store) MirrorStats() Stats {
+	return Stats{Mirrored: s.counters.mirrored.Load(), Failed: s.counters.failed.Load()}
+}
+
+func (s *Store) ForTenant(tenantID string) db.Store {
+	return &Store{Store: s.Store.ForTenant(tenantID), secondary: s.secondary.ForTenant(tenantID), counters: s.counters}
+}
+
+// mirror runs write on the secondary. It's called with the request's context, so the
+// secondary's latency adds to the request's.
+func (s *Store) mirror(ctx context.Context, what string, write func(db.Store) error) {
+	if err := write(s.secondary); err != nil {
+		s.counters.failed.Add(1)
+		logging.Printf(ctx, "Error mirroring %s to the secondary store: %v", what, err)
+		return
+	}
+	s.counters.mirrored.Add(1)
+}
+
+func (s *Store) SaveReceipt(ctx context.Context, rec db.ReceiptRecord) error {
+	if err := s.Store.SaveReceipt(ctx, rec); err != nil {
+		return err
+	}
+	s.mirror(ctx, "receipt "+rec.ID, func(secondary db.Store) error { return secondary.SaveReceipt(ctx, rec) })
+	return nil
+}
+
+func (s *Store) SaveReceipts(ctx context.Context, recs []db.ReceiptRecord) error {
+	if err := s.Store.SaveReceipts(ctx, recs); err != nil {
+		return err
+	}
+	s.mirror(ctx, "a batch of receipts", func(secondary db.Store) error { return secondary.SaveReceipts(ctx, recs) })
+	return nil
+}
+
+func (s *Store) UpdateReceipts(ctx context.Context, updates []db.ReceiptUpdate) error {
+	if err := s.Store.UpdateReceipts(ctx, updates); err != nil {
+		return err
+	}
+	s.mirror(ctx, "receipt updates", func(secondary db.Store) error { return secondary.UpdateReceipts(ctx, updates) })
+	return nil
+}
+
+// Redeem mirrors new redemptions only, replays changed nothing
+func (s *Store) Redeem(ctx context.Context, red db.Redemption) (db.Redemption, bool, error) {
+	redeemed, isNew, err := s.Store.Redeem(ctx, red)
+	if err != nil || !isNew {
+		return redeemed, isNew, err
+	}
+	s.mirror(ctx, "redemption "+red.ID, func(secondary db.Store) error {
+		_, _, err := secondary.Redeem(ctx, red)
+		return err
+	})
+	return redeemed, isNew, nil
+}
+
+// Adjust mirrors new adjustments only, like Redeem
+func (s *Store) Adjust(ctx context.Context, adj db.Adjustment) (db.Adjustment, bool, error) {
+	adjusted, isNew, err := s.Store.Adjust(ctx, adj)
+	if err != nil || !isNew {
+		return adjusted, isNew, err
+	}
+	s.mirror(ctx, "adjustment "+adj.ID, func(secondary db.Store) error {
+		_, _, err := secondary.Adjust(ctx, adj)
+		return err
+	})
+	return adjusted, isNew, nil
+}
+
+// ExpirePoints sweeps the secondary as well, each store expires its own lots
+func (s *Store) ExpirePoints(ctx context.Context, now time.Time, limit int) (db.ExpirySweep, error) {
+	sweep, err := s.Store.ExpirePoints(ctx, now, limit)
+	if err != nil {
+		return sweep, err
+	}
+	s.mirror(ctx, "points expiry", func(secondary db.Store) error {
+		_, err := secondary.ExpirePoints(ctx, now, limit)
+		return err
+	})
+	return sweep, nil
+}
+
+func (s *Store) ResolveFlagged(ctx context.Context, id string, approve bool) (db.ReceiptRecord, error) {
+	rec, err := s.Store.ResolveFlagged(ctx, id, approve)
+	if err != nil {
+		return rec, err
+	}
+	s.mirror(ctx, "review of receipt "+id, func(secondary db.Store) error {
+		_, err := secondary.ResolveFlagged(ctx, id, approve)
+		return err
+	})
+	return rec, nil
+}
+
+func (s *Store) DeleteReceipt(ctx context.Context, id string) error {
+	if err := s.Store.DeleteReceipt(ctx, id); err != nil {
+		return err
+	}
+	s.mirror(ctx, "deletion of receipt "+id, func(secondary db.Store) error { return secondary.DeleteReceipt(ctx, id) })
+	return nil
+}
+
+func (s *Store) SoftDeleteReceipt(ctx context.Context, id string, at time.Time) (db.ReceiptRecord, error) {
+	rec, err := s.Store.SoftDeleteReceipt(ctx, id, at)
+	if err != nil {
+		return rec, err
+	}
+	s.mirror(ctx, "deletion of receipt "+id, func(secondary db.Store) error {
+		_, err := secondary.SoftDeleteReceipt(ctx, id, at)
+		return err
+	})
+	return rec, nil
+}
+
+func (s *Store) PurgeReceipts(ctx context.Context, createdBefore, deletedBefore time.Time, limit int) (db.RetentionSweep, error) {
+	sweep, err := s.Store.PurgeReceipts(ctx, createdBefore, deletedBefore, limit)
+	if err != nil {
+		return sweep, err
+	}
+	s.mirror(ctx, "retention sweep", func(secondary db.Store) error {
+		_, err := secondary.PurgeReceipts(ctx, createdBefore, deletedBefore, limit)
+		return err
+	})
+	return sweep, nil
+}
+
+func (s *Store) AddWebhook(ctx context.Context, url string) error {
+	if err := s.Store.AddWebhook(ctx, url); err != nil {
+		return err
+	}
+	s.mirror(ctx, "webhook", func(secondary db.Store) error { return secondary.AddWebhook(ctx, url) })
+	return nil
+}
+
+func (s *Store) RemoveWebhook(ctx context.Context, url string) error {
+	if err := s.Store.RemoveWebhook(ctx, url); err != nil {
+		return err
+	}
+	s.mirror(ctx, "webhook removal", func(secondary db.Store) error { return secondary.RemoveWebhook(ctx, url) })
+	return nil
+}
+
+func (s *Store) SaveCampaign(ctx context.Context, c db.Campaign) error {
+	if err := s.Store.SaveCampaign(ctx, c); err != nil {
+		return err
+	}
+	s.mirror(ctx, "campaign "+c.ID, func(secondary db.Store) error { return secondary.SaveCampaign(ctx, c) })
+	return nil
+}
+
+func (s *Store) DeleteCampaign(ctx context.Context, id string) error {
+	if err := s.Store.DeleteCampaign(ctx, id); err != nil {
+		return err
+	}
+	s.mirror(ctx, "deletion of campaign "+id, func(secondary db.Store) error { return secondary.DeleteCampaign(ctx, id) })
+	return nil
+}
+
+func (s *Store) SaveRetailer(ctx context.Context, r db.Retailer) error {
+	if err := s.Store.SaveRetailer(ctx, r); err != nil {
+		return err
+	}
+	s.mirror(ctx, "retailer "+r.ID, func(secondary db.Store) error { return secondary.SaveRetailer(ctx, r) })
+	return nil
+}
+
+func (s *Store) DeleteRetailer(ctx context.Context, id string) error {
+	if err := s.Store.DeleteRetailer(ctx, id); err != nil {
+		return err
+	}
+	s.mirror(ctx, "deletion of retailer "+id, func(secondary db.Store) error { return secondary.DeleteRetailer(ctx, id) })
+	return nil
+}
+
+func (s *Store) PutUserAccount(ctx context.Context, acct db.UserAccount) error {
+	if err := s.Store.PutUserAccount(ctx, acct); err != nil {
+		return err
+	}
+	s.mirror(ctx, "account of user "+acct.UserID, func(secondary db.Store) error { return secondary.PutUserAccount(ctx, acct) })
+	return nil
+}
+
+func (s *Store) RestoreReceipts(ctx context.Context, recs []db.ReceiptRecord, now time.Time) error {
+	if err := s.Store.RestoreReceipts(ctx, recs, now); err != nil {
+		return err
+	}
+	s.mirror(ctx, "restored receipts", func(secondary db.Store) error { return secondary.RestoreReceipts(ctx, recs, now) })
+	return nil
+}
@@ -0,0 +1,122 @@
+package dynamo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+const (
+	webhooksKey  = "webhooks"
+	campaignsKey = "campaigns"
+	retailersKey = "retailers"
+)
+
+func (s *Store) AddWebhook(ctx context.Context, url string) error {
+	if err := s.table.transact(ctx, []write{{item: item{key: key{s.key(webhooksKey), url}}, kind: putWrite}}); err != nil {
+		return fmt.Errorf("Error registering webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) RemoveWebhook(ctx context.Context, url string) error {
+	if err := s.table.transact(ctx, []write{{item: item{key: key{s.key(webhooksKey), url}}, kind: deleteWrite}}); err != nil {
+		return fmt.Errorf("Error removing webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) ListWebhooks(ctx context.Context) ([]string, error) {
+	items, err := s.table.query(ctx, query{pk: s.key(webhooksKey)})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing webhooks: %w", err)
+	}
+	var urls []string
+	for _, it := range items {
+		urls = append(urls, it.sk)
+	}
+	return urls, nil
+}
+
+// SaveCampaign creates the campaign or replaces the one with the same ID
+func (s *Store) SaveCampaign(ctx context.Context, c db.Campaign) error {
+	value, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("Error encoding campaign: %v", err)
+	}
+	err = s.table.transact(ctx, []write{{item: item{key: key{s.key(campaignsKey), c.ID}, value: string(value)}, kind: putWrite}})
+	if err != nil {
+		return fmt.Errorf("Error saving campaign: %w", err)
+	}
+	return nil
+}
+
+// DeleteCampaign removes the campaign, db.ErrNotFound when there is no such campaign
+func (s *Store) DeleteCampaign(ctx context.Context, id string) error {
+	err := s.table.transact(ctx, []write{{item: item{key: key{s.key(campaignsKey), id}}, kind: deleteWrite, cond: cond{live: true}}})
+	if _, failed := failedWrite(err); failed {
+		return fmt.Errorf("Error deleting campaign %s: %w", id, db.ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("Error deleting campaign: %w", err)
+	}
+	return nil
+}
+
+// ListCampaigns returns every campaign ordered by start date, then id
+func (s *Store) ListCampaigns(ctx context.Context) ([]db.Campaign, error) {
+	items, err := s.table.query(ctx, query{pk: s.key(campaignsKey)})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing campaigns: %w", err)
+	}
+	campaigns := make([]db.Campaign, len(items))
+	for i, it := range items {
+		if err := json.Unmarshal([]byte(it.value), &campaigns[i]); err != nil {
+			return nil, fmt.Errorf("Error decoding campaign: %v", err)
+		}
+	}
+	// the partition is in id order already
+	sort.SliceStable(campaigns, func(i, j int) bool { return campaigns[i].StartDate < campaigns[j].StartDate })
+	return campaigns, nil
+}
+
+// SaveRetailer creates the retailer or replaces the one with the same ID
+func (s *Store) SaveRetailer(ctx context.Context, r db.Retailer) error {
+	value, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("Error encoding retailer: %v", err)
+	}
+	err = s.table.transact(ctx, []write{{item: item{key: key{s.key(retailersKey), r.ID}, value: string(value)}, kind: putWrite}})
+	if err != nil {
+		return fmt.Errorf("Error saving retailer: %w", err)
+	}
+	return nil
+}
+
+// DeleteRetailer removes the retailer, db.ErrNotFound when there is no such retailer
+func (s *Store) DeleteRetailer(ctx context.Context, id string) error {
+	err := s.table.transact(ctx, []write{{item: item{key: key{s.key(retailersKey), id}}, kind: deleteWrite, cond: cond{live: true}}})
+	if _, failed := failedWrite(err); failed {
+		return fmt.Errorf("Error deleting retailer %s: %w", id, db.ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("Error deleting retailer: %w", err)
+	}
+	return nil
+}
+
+// ListRetailers returns the whole registry ordered by id, the order of the partition
+func (s *Store) ListRetailers(ctx context.Context) ([]db.Retailer, error) {
+	items, err := s.table.query(ctx, query{pk: s.key(retailersKey)})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing retailers: %w", err)
+	}
+	retailers := make([]db.Retailer, len(items))
+	for i, it := range items {
+		if err := json.Unmarshal([]byte(it.value), &retailers[i]); err != nil {
+			return nil, fmt.Errorf("Error decoding retailer: %v", err)
+		}
+	}
+	return retailers, nil
+}
@@ -0,0 +1,155 @@
+package dynamo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+const (
+	analyticsTotalsKey    = "analytics:totals"
+	analyticsDaysKey      = "analytics:days"
+	analyticsRetailersKey = "analytics:retailers"
+	usageKeyPrefix        = "usage:"
+)
+
+// retailerSortKey prefixes retailer names in the analytics partition, sort keys can't
+// be empty and a retailer that's all spaces normalizes to ""
+const retailerSortKey = "retailer:"
+
+// totalsWrite moves the analytics totals
+func (s *Store) totalsWrite(receipts, scored, awarded int) write {
+	return write{item: item{key: key{s.key(analyticsTotalsKey), single}, nums: map[string]int64{
+		"receipts": int64(receipts),
+		"scored":   int64(scored),
+		"awarded":  int64(awarded),
+	}}}
+}
+
+// countWrites add a newly saved receipt to the analytics. Retailers are counted by
+// their normalized name, the one the listings filter on.
+func (s *Store) countWrites(rec db.ReceiptRecord) []write {
+	awarded := 0
+	if rec.Status == "" {
+		awarded = rec.Points
+	}
+	day := rec.CreatedAt.UTC().Format("2006-01-02")
+	return []write{
+		s.totalsWrite(1, rec.Points, awarded),
+		{item: item{key: key{s.key(analyticsDaysKey), day}, nums: map[string]int64{"receipts": 1, "points": int64(rec.Points)}}},
+		{item: item{
+			key:  key{s.key(analyticsRetailersKey), retailerSortKey + rec.AnalyticsRetailer()},
+			nums: map[string]int64{"receipts": 1},
+		}},
+	}
+}
+
+func (s *Store) GetAnalytics(ctx context.Context, days []string, topRetailers int) (db.Analytics, error) {
+	totals, _, err := s.table.get(ctx, key{s.key(analyticsTotalsKey), single})
+	if err != nil {
+		return db.Analytics{}, fmt.Errorf("Error reading analytics: %w", err)
+	}
+	dayKeys := make([]key, len(days))
+	for i, day := range days {
+		dayKeys[i] = key{s.key(analyticsDaysKey), day}
+	}
+	dayItems, err := s.table.getMany(ctx, dayKeys)
+	if err != nil {
+		return db.Analytics{}, fmt.Errorf("Error reading analytics: %w", err)
+	}
+	// every retailer is read and sorted here, there's one item per distinct name
+	retailers, err := s.table.query(ctx, query{pk: s.key(analyticsRetailersKey)})
+	if err != nil {
+		return db.Analytics{}, fmt.Errorf("Error reading analytics: %w", err)
+	}
+
+	analytics := db.Analytics{
+		Receipts:      int(totals.nums["receipts"]),
+		ScoredPoints:  int(totals.nums["scored"]),
+		PointsAwarded: int(totals.nums["awarded"]),
+		Days:          make([]db.DayAnalytics, len(days)),
+		TopRetailers:  make([]db.RetailerAnalytics, 0, len(retailers)),
+	}
+	for i, k := range dayKeys {
+		analytics.Days[i] = db.DayAnalytics{
+			Date:     days[i],
+			Receipts: int(dayItems[k].nums["receipts"]),
+			Points:   int(dayItems[k].nums["points"]),
+		}
+	}
+	for _, it := range retailers {
+		// retailers that corrections took every receipt away from
+		if it.nums["receipts"] <= 0 {
+			continue
+		}
+		analytics.TopRetailers = append(analytics.TopRetailers, db.RetailerAnalytics{
+			Retailer: strings.TrimPrefix(it.sk, retailerSortKey),
+			Receipts: int(it.nums["receipts"]),
+		})
+	}
+	// most receipts first, ties in reverse name order like ZREVRANGE
+	sort.Slice(analytics.TopRetailers, func(i, j int) bool {
+		a, b := analytics.TopRetailers[i], analytics.TopRetailers[j]
+		if a.Receipts != b.Receipts {
+			return a.Receipts > b.Receipts
+		}
+		return a.Retailer > b.Retailer
+	})
+	if topRetailers > 0 && len(analytics.TopRetailers) > topRetailers {
+		analytics.TopRetailers = analytics.TopRetailers[:topRetailers]
+	}
+	return analytics, nil
+}
+
+// AddUsage adds n to the named counter and returns its new value. The counter expires
+// ttl after it was created, one that expired but is still in the table starts over.
+func (s *Store) AddUsage(ctx context.Context, name string, n int, ttl time.Duration) (int, error) {
+	k := key{s.key(usageKeyPrefix + name), single}
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		counter, err := s.table.update(ctx, write{
+			item: item{key: k, nums: map[string]int64{"value": int64(n)}, expire: s.expiry(ttl)},
+			cond: cond{unexpired: true},
+		})
+		if _, failed := failedWrite(err); !failed {
+			if err != nil {
+				return 0, fmt.Errorf("Error counting usage: %w", err)
+			}
+			return int(counter.nums["value"]), nil
+		}
+		err = s.table.transact(ctx, []write{{
+			item: item{key: k, nums: map[string]int64{"value": int64(n)}, expire: s.expiry(ttl)},
+			kind: putWrite,
+			cond: cond{absent: true},
+		}})
+		if _, failed := failedWrite(err); !failed {
+			if err != nil {
+				return 0, fmt.Errorf("Error counting usage: %w", err)
+			}
+			return n, nil
+		}
+	}
+	return 0, errContention("counting usage")
+}
+
+// GetUsage reads the named counters that haven't expired, in batches
+func (s *Store) GetUsage(ctx context.Context, names []string) (map[string]int, error) {
+	keys := make([]key, len(names))
+	for i, name := range names {
+		keys[i] = key{s.key(usageKeyPrefix + name), single}
+	}
+	items, err := s.table.getMany(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading usage: %w", err)
+	}
+	usage := make(map[string]int, len(items))
+	for i, k := range keys {
+		if it, ok := items[k]; ok {
+			usage[names[i]] = int(it.nums["value"])
+		}
+	}
+	return usage, nil
+}
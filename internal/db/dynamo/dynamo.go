@@ -0,0 +1,143 @@
+// Package dynamo is a db.Store on a DynamoDB table, for deployments that have DynamoDB
+// but no Redis. It behaves like RedisStore as far as callers can tell.
+//
+// Everything lives in one table with a string partition key pk and a string sort key
+// sk. Partitions are named after the keys RedisStore uses: a receipt is the item
+// receipt:<id>, an index like receipts:idx:created is a partition of items sorted by
+// score. Writes that have to happen together go in one transaction, and the ones that
+// must happen once (saving a receipt, a redemption, claiming a fingerprint) are
+// conditional, so a retried request can't apply twice.
+//
+// Receipts and their index entries carry the receipt's TTL in expire_at, which should
+// be the table's TTL attribute.
+package dynamo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/clock"
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// Store is a DynamoDB backed db.Store. Views returned by ForTenant share their
+// parent's table.
+type Store struct {
+	*shared
+	// "" for the default tenant
+	tenant string
+}
+
+type shared struct {
+	table     table
+	clock     clock.Clock
+	ttl       time.Duration
+	retention map[string]time.Duration
+}
+
+var _ db.Store = (*Store)(nil)
+
+// Option configures a Store
+type Option func(*shared)
+
+// WithClock sets the clock TTLs and fingerprint windows go by, the real one by default
+func WithClock(c clock.Clock) Option {
+	return func(s *shared) { s.clock = c }
+}
+
+// Open connects to DYNAMODB_TABLE. Region and credentials come from the standard AWS
+// config, DYNAMODB_REGION and DYNAMODB_ENDPOINT (e.g. DynamoDB Local) override them.
+// The table isn't created here, see the README for its definition.
+func Open(ctx context.Context, cfg config.Config, opts ...Option) (*Store, error) {
+	var loadOpts []func(*awsconfig.LoadOptions) error
+	if cfg.DynamoDBRegion != "" {
+		loadOpts = append(loadOpts, awsconfig.WithRegion(cfg.DynamoDBRegion))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading AWS config: %v", err)
+	}
+	client := dynamodb.NewFromConfig(awsCfg, func(o *dynamodb.Options) {
+		if cfg.DynamoDBEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.DynamoDBEndpoint)
+		}
+	})
+	s := newStore(cfg, opts...)
+	s.table = &dynamoTable{client: client, name: cfg.DynamoDBTable, clock: s.clock}
+	return s, nil
+}
+
+// newStore is a Store with the options applied and no table yet
+func newStore(cfg config.Config, opts ...Option) *Store {
+	s := &shared{clock: clock.Real, ttl: cfg.RedisTTLInSec, retention: cfg.ReceiptRetention}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return &Store{shared: s}
+}
+
+func (s *Store) ForTenant(tenantID string) db.Store {
+	return &Store{shared: s.shared, tenant: tenantID}
+}
+
+func (s *Store) CheckConnection(ctx context.Context) error {
+	return s.table.ping(ctx)
+}
+
+// key is the partition RedisStore keeps name in, scoped to the tenant
+func (s *Store) key(name string) string {
+	if s.tenant == "" {
+		return name
+	}
+	return "tenant:" + s.tenant + ":" + name
+}
+
+// single is the sort key of partitions that hold one item
+const single = "-"
+
+func (s *Store) now() time.Time {
+	return s.clock.Now()
+}
+
+// expiry is when something saved now with ttl expires, 0 for never
+func (s *Store) expiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return s.now().Add(ttl).Unix()
+}
+
+// receiptTTL is RedisStore's: the receipt's retention class's TTL when it has one,
+// REDIS_TTL_IN_S otherwise
+func (s *Store) receiptTTL(rec db.ReceiptRecord) time.Duration {
+	if ttl, ok := s.retention[rec.Retention]; ok && rec.Retention != "" {
+		return ttl
+	}
+	return s.ttl
+}
+
+// sortable formats a score so that sort keys order like the numbers do, negative
+// ones included
+func sortable(score int64) string {
+	return fmt.Sprintf("%020d", uint64(score)^(1<<63))
+}
+
+// indexKey is the sort key of member in a sorted partition, ties go by member like
+// they do in a Redis sorted set
+func indexKey(score int64, member string) string {
+	return sortable(score) + "#" + member
+}
+
+// optimistic writes read, compute and write on the condition that nothing changed,
+// this many times before giving up
+const maxAttempts = 10
+
+func errContention(what string) error {
+	return fmt.Errorf("Error %s: gave up after %d attempts, the data kept changing", what, maxAttempts)
+}
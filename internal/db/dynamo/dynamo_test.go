@@ -0,0 +1,89 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/clock"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/storetest"
+	"github.com/jayreddy040-510/receipt_processor/internal/testutil"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// memStore is a Store on an in-memory table
+func memStore(t *testing.T, overrides map[string]string, opts ...Option) *Store {
+	cfg := testutil.Config(t, "127.0.0.1:0", overrides)
+	s := newStore(cfg, opts...)
+	s.table = newMemTable(s.clock)
+	return s
+}
+
+// TestMatchesRedisStore runs the same calls against the store and a RedisStore on
+// miniredis and expects the same answers from both
+func TestMatchesRedisStore(t *testing.T) {
+	cfg := testutil.Config(t, miniredis.RunT(t).Addr(), map[string]string{"REDIS_TTL_IN_S": "0"})
+	redisStore := db.NewRedisStore(cfg)
+	t.Cleanup(func() { redisStore.Close() })
+
+	want := storetest.Script(t, redisStore)
+	storetest.Compare(t, storetest.Script(t, memStore(t, map[string]string{"REDIS_TTL_IN_S": "0"})), want)
+}
+
+func TestReceiptsExpire(t *testing.T) {
+	now := clock.NewFrozen(testutil.Now)
+	store := memStore(t, map[string]string{"REDIS_TTL_IN_S": "600", "RECEIPT_RETENTION_IN_S": "keep=0"}, WithClock(now))
+
+	ctx := context.Background()
+	expiring := db.ReceiptRecord{ID: "expiring", PurchaseDate: "2024-01-01", CreatedAt: testutil.Now}
+	kept := db.ReceiptRecord{ID: "kept", PurchaseDate: "2024-01-01", CreatedAt: testutil.Now, Retention: "keep"}
+	if err := store.SaveReceipts(ctx, []db.ReceiptRecord{expiring, kept}); err != nil {
+		t.Fatal(err)
+	}
+	now.Advance(600 * time.Second)
+	if _, err := store.GetReceipt(ctx, "expiring"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("after the TTL: got %v, want db.ErrNotFound", err)
+	}
+	if _, err := store.GetReceipt(ctx, "kept"); err != nil {
+		t.Errorf("a receipt kept forever: %v", err)
+	}
+	if recs, _, err := store.ListReceipts(ctx, db.ListFilter{Limit: 10}); err != nil || len(recs) != 1 {
+		t.Errorf("listing: got %d receipts, %v, want only the kept one", len(recs), err)
+	}
+	// created, purchase date and retailer index, like RedisStore counts them
+	if removed, err := store.PruneIndexes(ctx, func(int) {}); err != nil || removed != 3 {
+		t.Errorf("prune: got %d, %v, want 3 removed", removed, err)
+	}
+}
+
+// a retried save finds the receipt already written and doesn't credit it again
+func TestSaveIsIdempotent(t *testing.T) {
+	store := memStore(t, nil)
+	ctx := context.Background()
+	rec := db.ReceiptRecord{ID: "r1", Retailer: "Target", PurchaseDate: "2024-01-01", Points: 28, CreatedAt: testutil.Now, UserID: "u1"}
+	for i := 0; i < 2; i++ {
+		if err := store.SaveReceipts(ctx, []db.ReceiptRecord{rec}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	points, err := store.GetUserPoints(ctx, "u1", 10)
+	if err != nil || points.Balance != 28 || len(points.Receipts) != 1 {
+		t.Errorf("after saving twice: got %+v, %v, want a balance of 28 and r1 once", points, err)
+	}
+	analytics, err := store.GetAnalytics(ctx, nil, 1)
+	if err != nil || analytics.Receipts != 1 {
+		t.Errorf("analytics: got %+v, %v, want 1 receipt", analytics, err)
+	}
+}
+
+func TestSortableOrdersNegativeScores(t *testing.T) {
+	scores := []int64{-1 << 62, -5, 0, 5, 1 << 62}
+	for i := 1; i < len(scores); i++ {
+		if sortable(scores[i-1]) >= sortable(scores[i]) {
+			t.Errorf("sortable(%d) = %s isn't before sortable(%d) = %s", scores[i-1], sortable(scores[i-1]), scores[i], sortable(scores[i]))
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package dynamo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+const (
+	fingerprintKeyPrefix    = "fraud:fingerprint:"
+	velocityKeyPrefix       = "fraud:velocity:"
+	submissionLockKeyPrefix = "lock:submission:"
+)
+
+func (s *Store) fingerprintKey(fingerprint string) key {
+	return key{s.key(fingerprintKeyPrefix + fingerprint), single}
+}
+
+// ClaimFingerprint claims the fingerprint for id for the window with a conditional
+// put and returns who holds it, "" when id got it (or already had it)
+func (s *Store) ClaimFingerprint(ctx context.Context, fingerprint, id string, window time.Duration) (string, error) {
+	err := s.table.transact(ctx, []write{{
+		item: item{key: s.fingerprintKey(fingerprint), value: id, expire: s.expiry(window)},
+		kind: putWrite,
+		cond: cond{absent: true},
+	}})
+	if _, failed := failedWrite(err); !failed {
+		if err != nil {
+			return "", fmt.Errorf("Error claiming receipt fingerprint: %w", err)
+		}
+		return "", nil
+	}
+	holder, ok, err := s.table.get(ctx, s.fingerprintKey(fingerprint))
+	if err != nil {
+		return "", fmt.Errorf("Error claiming receipt fingerprint: %w", err)
+	}
+	// expired between the two calls, or a retried claim found its own earlier attempt
+	if !ok || holder.value == id {
+		return "", nil
+	}
+	return holder.value, nil
+}
+
+// ReleaseFingerprint gives up id's claim on a fingerprint, a claim someone else holds
+// stays
+func (s *Store) ReleaseFingerprint(ctx context.Context, fingerprint, id string) error {
+	err := s.table.transact(ctx, []write{{item: item{key: s.fingerprintKey(fingerprint)}, kind: deleteWrite, cond: cond{value: &id}}})
+	if _, failed := failedWrite(err); err != nil && !failed {
+		return fmt.Errorf("Error releasing receipt fingerprint: %w", err)
+	}
+	return nil
+}
+
+// LockSubmission locks the submission's hash for id for ttl with a conditional put and
+// returns who holds it, "" when id got it (or already had it)
+func (s *Store) LockSubmission(ctx context.Context, hash, id string, ttl time.Duration) (string, error) {
+	lock := key{s.key(submissionLockKeyPrefix + hash), single}
+	err := s.table.transact(ctx, []write{{
+		item: item{key: lock, value: id, expire: s.expiry(ttl)},
+		kind: putWrite,
+		cond: cond{absent: true},
+	}})
+	if _, failed := failedWrite(err); !failed {
+		if err != nil {
+			return "", fmt.Errorf("Error locking submission: %w", err)
+		}
+		return "", nil
+	}
+	holder, ok, err := s.table.get(ctx, lock)
+	if err != nil {
+		return "", fmt.Errorf("Error locking submission: %w", err)
+	}
+	// expired between the two calls, it's free again
+	if !ok {
+		return s.LockSubmission(ctx, hash, id, ttl)
+	}
+	if holder.value == id {
+		return "", nil
+	}
+	return holder.value, nil
+}
+
+// UnlockSubmission gives up id's lock, a lock someone else holds stays
+func (s *Store) UnlockSubmission(ctx context.Context, hash, id string) error {
+	lock := key{s.key(submissionLockKeyPrefix + hash), single}
+	err := s.table.transact(ctx, []write{{item: item{key: lock}, kind: deleteWrite, cond: cond{value: &id}}})
+	if _, failed := failedWrite(err); err != nil && !failed {
+		return fmt.Errorf("Error unlocking submission: %w", err)
+	}
+	return nil
+}
+
+// CountSubmission records that the user submitted receipt id at now and returns how
+// many receipts they submitted within the window up to now, this one included.
+// Submissions are items that expire after the window.
+func (s *Store) CountSubmission(ctx context.Context, userID, id string, now time.Time, window time.Duration) (int, error) {
+	pk := s.key(velocityKeyPrefix + userID)
+	err := s.table.transact(ctx, []write{{
+		item: item{key: key{pk, id}, nums: map[string]int64{"at": now.UnixMicro()}, expire: s.expiry(window)},
+		kind: putWrite,
+	}})
+	if err != nil {
+		return 0, fmt.Errorf("Error counting user submissions: %w", err)
+	}
+	submissions, err := s.table.query(ctx, query{pk: pk})
+	if err != nil {
+		return 0, fmt.Errorf("Error counting user submissions: %w", err)
+	}
+	var count int
+	for _, sub := range submissions {
+		if sub.nums["at"] > now.Add(-window).UnixMicro() {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ListFlagged returns up to limit receipts waiting for review, oldest first
+func (s *Store) ListFlagged(ctx context.Context, limit int) ([]db.ReceiptRecord, error) {
+	entries, err := s.table.query(ctx, query{pk: s.key(reviewQueueKey), limit: limit})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing flagged receipts: %w", err)
+	}
+	records, err := s.indexed(ctx, entries)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing flagged receipts: %w", err)
+	}
+	return records, nil
+}
+
+// ResolveFlagged approves or rejects a flagged receipt, db.ErrNotFound when it isn't
+// waiting for review. Taking it off the queue is conditional, so only one of two
+// concurrent reviews goes through.
+func (s *Store) ResolveFlagged(ctx context.Context, id string, approve bool) (db.ReceiptRecord, error) {
+	rec, err := s.receipt(ctx, id)
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error resolving flagged receipt %s: %w", id, err)
+	}
+	queued := key{s.key(reviewQueueKey), indexKey(rec.CreatedAt.UnixMicro(), id)}
+	rec.Status = db.ReceiptRejected
+	if approve {
+		rec.Status = ""
+	}
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error encoding receipt record: %v", err)
+	}
+	writes := []write{
+		{item: item{key: queued}, kind: deleteWrite, cond: cond{live: true}},
+		{item: item{key: s.receiptKey(id), value: string(value)}, cond: cond{live: true}},
+	}
+	if approve {
+		writes = append(writes, s.totalsWrite(0, 0, rec.Points))
+		if rec.UserID != "" {
+			writes = append(writes, s.creditWrites(rec, s.now())...)
+		}
+	}
+	err = s.table.transact(ctx, writes)
+	if _, failed := failedWrite(err); failed {
+		return db.ReceiptRecord{}, fmt.Errorf("Error resolving flagged receipt %s: %w", id, db.ErrNotFound)
+	} else if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error resolving flagged receipt %s: %w", id, err)
+	}
+	return rec, nil
+}
@@ -0,0 +1,189 @@
+package dynamo
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/clock"
+)
+
+// memTable is the table in memory, with DynamoDB's semantics for the writes the store
+// makes: conditions, transactions and expired items that reads leave out
+type memTable struct {
+	mu    sync.Mutex
+	items map[key]item
+	clock clock.Clock
+}
+
+func newMemTable(c clock.Clock) *memTable {
+	return &memTable{items: make(map[key]item), clock: c}
+}
+
+func (t *memTable) now() int64 {
+	return t.clock.Now().Unix()
+}
+
+func (t *memTable) live(it item) bool {
+	return it.expire == 0 || it.expire > t.now()
+}
+
+func (t *memTable) ping(ctx context.Context) error {
+	return nil
+}
+
+func (t *memTable) get(ctx context.Context, k key) (item, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	it, ok := t.items[k]
+	if !ok || !t.live(it) {
+		return item{}, false, nil
+	}
+	return copyItem(it), true, nil
+}
+
+func (t *memTable) getMany(ctx context.Context, keys []key) (map[key]item, error) {
+	found := make(map[key]item)
+	for _, k := range keys {
+		if it, ok, _ := t.get(ctx, k); ok {
+			found[k] = it
+		}
+	}
+	return found, nil
+}
+
+func (t *memTable) query(ctx context.Context, q query) ([]item, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var items []item
+	for k, it := range t.items {
+		if k.pk != q.pk || (q.from != "" && k.sk < q.from) || (q.to != "" && k.sk > q.to) {
+			continue
+		}
+		if q.after != "" && ((!q.desc && k.sk <= q.after) || (q.desc && k.sk >= q.after)) {
+			continue
+		}
+		if q.withExpired || t.live(it) {
+			items = append(items, copyItem(it))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if q.desc {
+			return items[i].sk > items[j].sk
+		}
+		return items[i].sk < items[j].sk
+	})
+	if q.limit > 0 && len(items) > q.limit {
+		items = items[:q.limit]
+	}
+	return items, nil
+}
+
+func (t *memTable) count(ctx context.Context, pk string) (int64, error) {
+	items, err := t.query(ctx, query{pk: pk})
+	return int64(len(items)), err
+}
+
+func (t *memTable) scan(ctx context.Context, prefix string) ([]key, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var keys []key
+	for k, it := range t.items {
+		if strings.HasPrefix(k.pk, prefix) && t.live(it) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (t *memTable) update(ctx context.Context, w write) (item, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.holds(w) {
+		return item{}, &conditionFailed{}
+	}
+	t.apply(w)
+	return copyItem(t.items[w.key]), nil
+}
+
+func (t *memTable) transact(ctx context.Context, writes []write) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seen := make(map[key]bool)
+	for i, w := range writes {
+		if seen[w.key] {
+			panic("two writes to " + w.pk + " " + w.sk + " in one transaction")
+		}
+		seen[w.key] = true
+		if !t.holds(w) {
+			return &conditionFailed{index: i}
+		}
+	}
+	for _, w := range writes {
+		t.apply(w)
+	}
+	return nil
+}
+
+func (t *memTable) holds(w write) bool {
+	it, exists := t.items[w.key]
+	expired := exists && it.expire != 0 && it.expire <= t.now()
+	c := w.cond
+	if c.absent && exists && !expired {
+		return false
+	}
+	if c.live && (!exists || expired) {
+		return false
+	}
+	if c.unexpired && expired {
+		return false
+	}
+	if c.value != nil && (!exists || it.value != *c.value) {
+		return false
+	}
+	for attr, n := range c.nums {
+		if it.nums[attr] != n {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *memTable) apply(w write) {
+	switch w.kind {
+	case checkWrite:
+	case putWrite:
+		t.items[w.key] = copyItem(w.item)
+	case deleteWrite:
+		delete(t.items, w.key)
+	default:
+		it, exists := t.items[w.key]
+		if !exists {
+			it = item{key: w.key}
+		}
+		it = copyItem(it)
+		if w.value != "" {
+			it.value = w.value
+		}
+		if w.expire != 0 && it.expire == 0 {
+			it.expire = w.expire
+		}
+		for attr, n := range w.nums {
+			if it.nums == nil {
+				it.nums = make(map[string]int64)
+			}
+			it.nums[attr] += n
+		}
+		t.items[w.key] = it
+	}
+}
+
+func copyItem(it item) item {
+	nums := make(map[string]int64, len(it.nums))
+	for attr, n := range it.nums {
+		nums[attr] = n
+	}
+	it.nums = nums
+	return it
+}
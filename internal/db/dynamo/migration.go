@@ -0,0 +1,184 @@
+package dynamo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// ListUsers pages through the tenant's users by id, the cursor is the last id of the
+// previous page. Like ScanKeys it scans the whole table.
+func (s *Store) ListUsers(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	names, err := s.partitions(ctx, userKeyPrefix)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error listing users: %w", err)
+	}
+	seen := make(map[string]bool)
+	var ids []string
+	for _, name := range names {
+		// user ids can't contain ':', everything after the first one is the partition's kind
+		userID, _, _ := strings.Cut(strings.TrimPrefix(name, s.key(userKeyPrefix)), ":")
+		if userID != "" && userID > cursor && !seen[userID] {
+			seen[userID] = true
+			ids = append(ids, userID)
+		}
+	}
+	sort.Strings(ids)
+	if limit <= 0 || len(ids) <= limit {
+		return ids, "", nil
+	}
+	ids = ids[:limit]
+	return ids, ids[len(ids)-1], nil
+}
+
+// GetUserAccount reads the user's counters, lots, redemptions and adjustments. Unknown
+// users have an empty account.
+func (s *Store) GetUserAccount(ctx context.Context, userID string) (db.UserAccount, error) {
+	balance, _, err := s.table.get(ctx, s.userBalanceKey(userID))
+	if err != nil {
+		return db.UserAccount{}, fmt.Errorf("Error reading user account: %w", err)
+	}
+	acct := db.UserAccount{UserID: userID, Balance: int(balance.nums["balance"]), Expired: int(balance.nums["expired"])}
+	lots, err := s.table.query(ctx, query{pk: s.lotKey(userID, "").pk})
+	if err != nil {
+		return db.UserAccount{}, fmt.Errorf("Error reading user lots: %w", err)
+	}
+	for _, lot := range lots {
+		acct.Lots = append(acct.Lots, db.PointsLot{
+			ReceiptID: lot.sk,
+			Points:    int(lot.nums["points"]),
+			ExpireAt:  time.Unix(lot.nums["due"], 0).UTC(),
+		})
+	}
+	entries, err := s.table.query(ctx, query{pk: s.userRedemptionsKey(userID)})
+	if err != nil {
+		return db.UserAccount{}, fmt.Errorf("Error reading user redemptions: %w", err)
+	}
+	for _, entry := range entries {
+		var red db.Redemption
+		if err := json.Unmarshal([]byte(entry.value), &red); err != nil {
+			return db.UserAccount{}, fmt.Errorf("Error decoding redemption: %v", err)
+		}
+		acct.Redemptions = append(acct.Redemptions, red)
+	}
+	if entries, err = s.table.query(ctx, query{pk: s.userAdjustmentsKey(userID)}); err != nil {
+		return db.UserAccount{}, fmt.Errorf("Error reading user adjustments: %w", err)
+	}
+	for _, entry := range entries {
+		var adj db.Adjustment
+		if err := json.Unmarshal([]byte(entry.value), &adj); err != nil {
+			return db.UserAccount{}, fmt.Errorf("Error decoding adjustment: %v", err)
+		}
+		acct.Adjustments = append(acct.Adjustments, adj)
+	}
+	db.SortAccount(&acct)
+	return acct, nil
+}
+
+// PutUserAccount makes the user's points what acct says, like RedisStore. A user with
+// more lots and ledger entries than fit in one transaction is written in several, the
+// counters go last so a reader never sees a balance without the lots behind it.
+func (s *Store) PutUserAccount(ctx context.Context, acct db.UserAccount) error {
+	userID := acct.UserID
+	old, err := s.table.query(ctx, query{pk: s.lotKey(userID, "").pk})
+	if err != nil {
+		return fmt.Errorf("Error writing user account: %w", err)
+	}
+	keep := make(map[key]bool, len(acct.Lots))
+	for _, lot := range acct.Lots {
+		keep[s.lotKey(userID, lot.ReceiptID)] = true
+	}
+	var writes []write
+	for _, lot := range old {
+		entry := s.expiryKey(userID, lot.sk, lot.nums["due"])
+		writes = append(writes, write{item: item{key: entry}, kind: deleteWrite})
+		if !keep[lot.key] {
+			writes = append(writes, write{item: item{key: lot.key}, kind: deleteWrite})
+		}
+	}
+	var puts []write
+	for _, lot := range acct.Lots {
+		due := lot.ExpireAt.Unix()
+		puts = append(puts,
+			write{item: item{key: s.lotKey(userID, lot.ReceiptID), nums: map[string]int64{"points": int64(lot.Points), "due": due}}, kind: putWrite},
+			write{item: item{key: s.expiryKey(userID, lot.ReceiptID, due), value: userID}, kind: putWrite})
+	}
+	for _, red := range acct.Redemptions {
+		value, err := json.Marshal(red)
+		if err != nil {
+			return fmt.Errorf("Error encoding redemption: %v", err)
+		}
+		puts = append(puts,
+			write{item: item{key: s.redemptionKey(userID, red.ID), value: string(value)}, kind: putWrite},
+			write{item: item{key: key{s.userRedemptionsKey(userID), indexKey(red.CreatedAt.UnixMicro(), red.ID)}, value: string(value)}, kind: putWrite})
+	}
+	for _, adj := range acct.Adjustments {
+		value, err := json.Marshal(adj)
+		if err != nil {
+			return fmt.Errorf("Error encoding adjustment: %v", err)
+		}
+		puts = append(puts, write{item: item{key: s.adjustmentKey(userID, adj.ID), value: string(value)}, kind: putWrite})
+		puts = append(puts, s.adjustmentWrites(adj, string(value))...)
+	}
+	// an expiry entry that's deleted and put again is the same item, the put wins
+	put := make(map[key]bool, len(puts))
+	for _, w := range puts {
+		put[w.key] = true
+	}
+	var deletes []write
+	for _, w := range writes {
+		if !put[w.key] {
+			deletes = append(deletes, w)
+		}
+	}
+	writes = append(deletes, puts...)
+	writes = append(writes, write{
+		item: item{key: s.userBalanceKey(userID), nums: map[string]int64{"balance": int64(acct.Balance), "expired": int64(acct.Expired)}},
+		kind: putWrite,
+	})
+	for len(writes) > 0 {
+		n := min(len(writes), maxTransactItems)
+		if err := s.table.transact(ctx, writes[:n]); err != nil {
+			return fmt.Errorf("Error writing user account: %w", err)
+		}
+		writes = writes[n:]
+	}
+	return nil
+}
+
+// RestoreReceipts writes copied records with their index entries but without crediting
+// their users or counting them in the analytics, like RedisStore. Each receipt is its
+// own transaction, records that are there already are overwritten.
+func (s *Store) RestoreReceipts(ctx context.Context, recs []db.ReceiptRecord, now time.Time) error {
+	for _, rec := range recs {
+		ttl := db.RemainingTTL(s.receiptTTL(rec), rec.CreatedAt, now)
+		if ttl < 0 {
+			continue
+		}
+		value, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("Error encoding receipt record: %v", err)
+		}
+		indexes, err := s.indexes(rec)
+		if err != nil {
+			return err
+		}
+		var expire int64
+		if ttl > 0 {
+			expire = now.Add(ttl).Unix()
+		}
+		writes := []write{{item: item{key: s.receiptKey(rec.ID), value: string(value), expire: expire}, kind: putWrite}}
+		for _, k := range indexes {
+			writes = append(writes, write{item: item{key: k, value: rec.ID, expire: expire}, kind: putWrite})
+		}
+		if err := s.table.transact(ctx, writes); err != nil {
+			return fmt.Errorf("Error restoring receipts in database: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,498 @@
+package dynamo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+const (
+	receiptKeyPrefix       = "receipt:"
+	createdIndexKey        = "receipts:idx:created"
+	purchaseDateIndexKey   = "receipts:idx:purchase_date"
+	retailerIndexKeyPrefix = "receipts:idx:retailer:"
+	reviewQueueKey         = "receipts:review"
+)
+
+// purchaseScore turns YYYY-MM-DD into YYYYMMDD, the order the purchase date index
+// lists by
+func purchaseScore(date string) (int64, error) {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing date for index: %v", err)
+	}
+	return int64(t.Year()*10000 + int(t.Month())*100 + t.Day()), nil
+}
+
+func (s *Store) receiptKey(id string) key {
+	return key{s.key(receiptKeyPrefix + id), single}
+}
+
+// indexes are the index entries of a receipt: the listings, its user's history, and
+// the review queue while it's flagged
+func (s *Store) indexes(rec db.ReceiptRecord) ([]key, error) {
+	purchased, err := purchaseScore(rec.PurchaseDate)
+	if err != nil {
+		return nil, err
+	}
+	created := indexKey(rec.CreatedAt.UnixMicro(), rec.ID)
+	keys := []key{
+		{s.key(createdIndexKey), created},
+		{s.key(retailerIndexKeyPrefix + db.NormalizeRetailer(rec.Retailer)), created},
+		{s.key(purchaseDateIndexKey), indexKey(purchased, rec.ID)},
+	}
+	if rec.Status == db.ReceiptFlagged {
+		keys = append(keys, key{s.key(reviewQueueKey), created})
+	}
+	if rec.UserID != "" {
+		keys = append(keys, key{s.userReceiptsKey(rec.UserID), created})
+	}
+	return keys, nil
+}
+
+// saveWrites are a receipt's transaction: the record, its index entries, analytics and
+// the credit. The record is only written when it doesn't exist yet, a save that was
+// already applied fails the transaction instead of counting twice.
+func (s *Store) saveWrites(rec db.ReceiptRecord) ([]write, error) {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding receipt record: %v", err)
+	}
+	indexes, err := s.indexes(rec)
+	if err != nil {
+		return nil, err
+	}
+	expire := s.expiry(s.receiptTTL(rec))
+	writes := []write{{
+		item: item{key: s.receiptKey(rec.ID), value: string(value), expire: expire},
+		kind: putWrite,
+		cond: cond{absent: true},
+	}}
+	// index entries expire with the record
+	for _, k := range indexes {
+		writes = append(writes, write{item: item{key: k, value: rec.ID, expire: expire}, kind: putWrite})
+	}
+	writes = append(writes, s.countWrites(rec)...)
+	if rec.UserID != "" && rec.Status == "" {
+		// the receipt was credited when it was created, by the app's clock
+		writes = append(writes, s.creditWrites(rec, rec.CreatedAt)...)
+	}
+	return writes, nil
+}
+
+func (s *Store) SaveReceipt(ctx context.Context, rec db.ReceiptRecord) error {
+	return s.SaveReceipts(ctx, []db.ReceiptRecord{rec})
+}
+
+// SaveReceipts saves each receipt in its own transaction, DynamoDB can't fit a batch
+// in one. A record with an invalid purchase date fails the batch before anything is
+// written; a receipt that's already saved is skipped, so a retried batch picks up
+// where the failed one stopped.
+func (s *Store) SaveReceipts(ctx context.Context, recs []db.ReceiptRecord) error {
+	writes := make([][]write, len(recs))
+	for i, rec := range recs {
+		var err error
+		if writes[i], err = s.saveWrites(rec); err != nil {
+			return err
+		}
+	}
+	for _, w := range writes {
+		err := s.table.transact(ctx, w)
+		if i, failed := failedWrite(err); failed && i == 0 {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Error saving receipts in database: %w", err)
+		}
+	}
+	return nil
+}
+
+// UpdateReceipts overwrites the records that still exist, keeping their TTL, and moves
+// balances and analytics by the change in points. Updates of receipts that expired or
+// were deleted in the meantime are dropped.
+func (s *Store) UpdateReceipts(ctx context.Context, updates []db.ReceiptUpdate) error {
+	now := s.now()
+	for _, u := range updates {
+		value, err := json.Marshal(u.Record)
+		if err != nil {
+			return fmt.Errorf("Error encoding receipt record: %v", err)
+		}
+		delta := u.Record.Points - u.OldPoints
+		awarded := 0
+		if u.Record.Status == "" {
+			awarded = delta
+		}
+		writes := []write{{item: item{key: s.receiptKey(u.Record.ID), value: string(value)}, cond: cond{live: true}}}
+		if delta != 0 {
+			writes = append(writes, s.totalsWrite(0, delta, awarded))
+		}
+		credited := u.Record.UserID != "" && u.Record.Status == "" && delta != 0 &&
+			(u.Record.PointsExpireAt == nil || u.Record.PointsExpireAt.After(now))
+		if credited {
+			writes = append(writes, write{item: item{key: s.userBalanceKey(u.Record.UserID), nums: map[string]int64{"balance": int64(delta)}}})
+		}
+		if _, _, moved := u.AnalyticsRetailerMove(); moved || u.RetailerChanged() || u.PurchaseDateChanged() {
+			moves, err := s.indexMoves(ctx, u)
+			if err == db.ErrNotFound {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("Error updating receipts in database: %w", err)
+			}
+			writes = append(writes, moves...)
+		}
+		err = s.table.transact(ctx, writes)
+		if _, failed := failedWrite(err); failed {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Error updating receipts in database: %w", err)
+		}
+		if credited && u.Record.PointsExpireAt != nil {
+			// the lot can be swept meanwhile, then there's nothing left to move
+			_, err := s.table.update(ctx, write{
+				item: item{key: s.lotKey(u.Record.UserID, u.Record.ID), nums: map[string]int64{"points": int64(delta)}},
+				cond: cond{live: true},
+			})
+			if _, failed := failedWrite(err); err != nil && !failed {
+				return fmt.Errorf("Error updating receipts in database: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// indexMoves take a corrected receipt's index entries from its old retailer and
+// purchase date to the new ones, expiring with the record like they did. Retailer
+// analytics move along.
+func (s *Store) indexMoves(ctx context.Context, u db.ReceiptUpdate) ([]write, error) {
+	stored, ok, err := s.table.get(ctx, s.receiptKey(u.Record.ID))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	var writes []write
+	move := func(from, to key) {
+		writes = append(writes,
+			write{item: item{key: from}, kind: deleteWrite},
+			write{item: item{key: to, value: u.Record.ID, expire: stored.expire}, kind: putWrite})
+	}
+	created := indexKey(u.Record.CreatedAt.UnixMicro(), u.Record.ID)
+	if u.RetailerChanged() {
+		move(key{s.key(retailerIndexKeyPrefix + db.NormalizeRetailer(u.OldRetailer)), created},
+			key{s.key(retailerIndexKeyPrefix + db.NormalizeRetailer(u.Record.Retailer)), created})
+	}
+	if from, to, moved := u.AnalyticsRetailerMove(); moved {
+		writes = append(writes,
+			write{item: item{key: key{s.key(analyticsRetailersKey), retailerSortKey + from}, nums: map[string]int64{"receipts": -1}}},
+			write{item: item{key: key{s.key(analyticsRetailersKey), retailerSortKey + to}, nums: map[string]int64{"receipts": 1}}})
+	}
+	if u.PurchaseDateChanged() {
+		from, err := purchaseScore(u.OldPurchaseDate)
+		if err != nil {
+			return nil, err
+		}
+		to, err := purchaseScore(u.Record.PurchaseDate)
+		if err != nil {
+			return nil, err
+		}
+		move(key{s.key(purchaseDateIndexKey), indexKey(from, u.Record.ID)}, key{s.key(purchaseDateIndexKey), indexKey(to, u.Record.ID)})
+	}
+	return writes, nil
+}
+
+// receipt is the live record with the id, db.ErrNotFound for unknown and expired ones
+func (s *Store) receipt(ctx context.Context, id string) (db.ReceiptRecord, error) {
+	it, ok, err := s.table.get(ctx, s.receiptKey(id))
+	if err != nil {
+		return db.ReceiptRecord{}, err
+	}
+	if !ok {
+		return db.ReceiptRecord{}, db.ErrNotFound
+	}
+	var rec db.ReceiptRecord
+	if err := json.Unmarshal([]byte(it.value), &rec); err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error decoding receipt record: %v", err)
+	}
+	return rec, nil
+}
+
+// GetReceipt fails with db.ErrNotFound for unknown and expired ids
+func (s *Store) GetReceipt(ctx context.Context, id string) (db.ReceiptRecord, error) {
+	rec, err := s.receipt(ctx, id)
+	if err == db.ErrNotFound {
+		return db.ReceiptRecord{}, fmt.Errorf("Key does not exist in database: %w", err)
+	} else if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error getting key from database: %w", err)
+	}
+	return rec, nil
+}
+
+// GetReceipts fetches the records with BatchGetItem, in the order of ids. Unknown or
+// expired ids are left out.
+func (s *Store) GetReceipts(ctx context.Context, ids []string) ([]db.ReceiptRecord, error) {
+	records, err := s.receipts(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching receipts from database: %w", err)
+	}
+	return records, nil
+}
+
+func (s *Store) receipts(ctx context.Context, ids []string) ([]db.ReceiptRecord, error) {
+	keys := make([]key, len(ids))
+	for i, id := range ids {
+		keys[i] = s.receiptKey(id)
+	}
+	items, err := s.table.getMany(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]db.ReceiptRecord, 0, len(items))
+	for _, k := range keys {
+		it, ok := items[k]
+		if !ok {
+			continue
+		}
+		var rec db.ReceiptRecord
+		if err := json.Unmarshal([]byte(it.value), &rec); err != nil {
+			return nil, fmt.Errorf("Error decoding receipt record: %v", err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// indexed reads the receipts behind index entries
+func (s *Store) indexed(ctx context.Context, entries []item) ([]db.ReceiptRecord, error) {
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.value
+	}
+	return s.receipts(ctx, ids)
+}
+
+// DeleteReceipt removes the receipt along with its index entries. Balances stay.
+func (s *Store) DeleteReceipt(ctx context.Context, id string) error {
+	rec, err := s.receipt(ctx, id)
+	if err != nil {
+		return fmt.Errorf("Error deleting receipt %s: %w", id, err)
+	}
+	writes, err := s.deleteWrites(rec)
+	if err != nil {
+		return fmt.Errorf("Error deleting receipt %s: %w", id, err)
+	}
+	if err := s.table.transact(ctx, writes); err != nil {
+		return fmt.Errorf("Error deleting receipt %s: %w", id, err)
+	}
+	return nil
+}
+
+// deleteWrites remove the record and every index entry pointing at it
+func (s *Store) deleteWrites(rec db.ReceiptRecord) ([]write, error) {
+	indexes, err := s.indexes(rec)
+	if err != nil {
+		return nil, err
+	}
+	writes := []write{{item: item{key: s.receiptKey(rec.ID)}, kind: deleteWrite}}
+	for _, k := range indexes {
+		writes = append(writes, write{item: item{key: k}, kind: deleteWrite})
+	}
+	return writes, nil
+}
+
+// ListReceipts pages through stored receipts newest first, walking the same index
+// RedisStore would for the filter and filtering the rest after the records are
+// fetched. The cursor is the sort key of the last entry handed out.
+func (s *Store) ListReceipts(ctx context.Context, filter db.ListFilter) ([]db.ReceiptRecord, string, error) {
+	q := query{pk: s.key(createdIndexKey), desc: true, limit: filter.Limit * 2}
+	if filter.Retailer != "" {
+		q.pk = s.key(retailerIndexKeyPrefix + db.NormalizeRetailer(filter.Retailer))
+	} else if filter.CanonicalRetailer != "" || filter.FromDate != "" || filter.ToDate != "" {
+		// there's no index per canonical retailer, its receipts are picked out of the
+		// purchase date index
+		q.pk = s.key(purchaseDateIndexKey)
+		if filter.FromDate != "" {
+			score, err := purchaseScore(filter.FromDate)
+			if err != nil {
+				return nil, "", err
+			}
+			q.from = sortable(score)
+		}
+		if filter.ToDate != "" {
+			score, err := purchaseScore(filter.ToDate)
+			if err != nil {
+				return nil, "", err
+			}
+			// past every "score#id" of that day
+			q.to = sortable(score) + "$"
+		}
+	}
+	if filter.Cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(filter.Cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", db.ErrInvalidCursor, err)
+		}
+		q.after = string(after)
+	}
+
+	var results []db.ReceiptRecord
+	for len(results) < filter.Limit {
+		entries, err := s.table.query(ctx, q)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error reading receipt index: %w", err)
+		}
+		if len(entries) == 0 {
+			return results, "", nil
+		}
+		q.after = entries[len(entries)-1].sk
+
+		records, err := s.indexed(ctx, entries)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error fetching receipts from database: %w", err)
+		}
+		sortKeys := make(map[string]string, len(entries))
+		for _, entry := range entries {
+			sortKeys[entry.value] = entry.sk
+		}
+		for _, rec := range records {
+			if !matches(filter, rec) {
+				continue
+			}
+			results = append(results, rec)
+			if len(results) == filter.Limit {
+				return results, base64.RawURLEncoding.EncodeToString([]byte(sortKeys[rec.ID])), nil
+			}
+		}
+		if len(entries) < q.limit {
+			return results, "", nil
+		}
+	}
+	return results, "", nil
+}
+
+// matches is db.ListFilter's check on a fetched record
+func matches(f db.ListFilter, rec db.ReceiptRecord) bool {
+	if f.Retailer != "" && db.NormalizeRetailer(rec.Retailer) != db.NormalizeRetailer(f.Retailer) {
+		return false
+	}
+	if f.CanonicalRetailer != "" && rec.AnalyticsRetailer() != f.CanonicalRetailer {
+		return false
+	}
+	if f.FromDate != "" && rec.PurchaseDate < f.FromDate {
+		return false
+	}
+	if f.ToDate != "" && rec.PurchaseDate > f.ToDate {
+		return false
+	}
+	if f.MinPoints != nil && rec.Points < *f.MinPoints {
+		return false
+	}
+	if f.MaxPoints != nil && rec.Points > *f.MaxPoints {
+		return false
+	}
+	return true
+}
+
+// partitions are the distinct partitions of the tenant whose name starts with prefix,
+// sorted
+func (s *Store) partitions(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := s.table.scan(ctx, s.key(prefix))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, k := range keys {
+		if !seen[k.pk] {
+			seen[k.pk] = true
+			names = append(names, k.pk)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ScanKeys pages through the tenant's partitions, the keys the data would have in
+// Redis, with the cursor as an offset. It scans the whole table, it's meant for
+// operators.
+func (s *Store) ScanKeys(ctx context.Context, prefix string, cursor uint64, count int64) ([]string, uint64, error) {
+	keys, err := s.partitions(ctx, prefix)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error scanning keys: %w", err)
+	}
+	if count <= 0 {
+		count = 10
+	}
+	start := min(int(cursor), len(keys))
+	end := min(start+int(count), len(keys))
+	next := uint64(end)
+	if end == len(keys) {
+		next = 0
+	}
+	return keys[start:end], next, nil
+}
+
+// Stats counts partitions like DBSIZE counts keys, which takes a scan of the table.
+// Memory use is always 0.
+func (s *Store) Stats(ctx context.Context) (db.StoreStats, error) {
+	keys, err := s.partitions(ctx, "")
+	if err != nil {
+		return db.StoreStats{}, fmt.Errorf("Error reading store stats: %w", err)
+	}
+	stats := db.StoreStats{Keys: int64(len(keys))}
+	for _, c := range []struct {
+		pk string
+		n  *int64
+	}{
+		{createdIndexKey, &stats.IndexedReceipts},
+		{reviewQueueKey, &stats.FlaggedReceipts},
+		{pointsExpiryKey, &stats.ExpiringLots},
+	} {
+		if *c.n, err = s.table.count(ctx, s.key(c.pk)); err != nil {
+			return db.StoreStats{}, fmt.Errorf("Error reading store stats: %w", err)
+		}
+	}
+	return stats, nil
+}
+
+// PruneIndexes deletes the index entries whose receipt's TTL ran out that DynamoDB's
+// TTL hasn't gotten to yet, counting them like RedisStore does: once per index.
+func (s *Store) PruneIndexes(ctx context.Context, progress func(checked int)) (int, error) {
+	indexes := []string{s.key(createdIndexKey), s.key(purchaseDateIndexKey), s.key(reviewQueueKey)}
+	retailers, err := s.partitions(ctx, retailerIndexKeyPrefix)
+	if err != nil {
+		return 0, fmt.Errorf("Error reading index: %w", err)
+	}
+	indexes = append(indexes, retailers...)
+
+	now := s.now().Unix()
+	var checked, removed int
+	for _, pk := range indexes {
+		entries, err := s.table.query(ctx, query{pk: pk, withExpired: true})
+		if err != nil {
+			return removed, fmt.Errorf("Error reading index %s: %w", pk, err)
+		}
+		var expired []write
+		for _, entry := range entries {
+			if entry.expire != 0 && entry.expire <= now {
+				expired = append(expired, write{item: item{key: entry.key}, kind: deleteWrite})
+			}
+		}
+		for start := 0; start < len(expired); start += maxTransactItems {
+			chunk := expired[start:min(start+maxTransactItems, len(expired))]
+			if err := s.table.transact(ctx, chunk); err != nil {
+				return removed, fmt.Errorf("Error pruning index %s: %w", pk, err)
+			}
+			removed += len(chunk)
+		}
+		checked += len(entries)
+		progress(checked)
+	}
+	return removed, nil
+}
@@ -0,0 +1,140 @@
+package dynamo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+const (
+	tombstoneKeyPrefix = "tombstone:"
+	tombstonesIndexKey = "receipts:tombstones"
+)
+
+func (s *Store) tombstoneKey(id string) key {
+	return key{s.key(tombstoneKeyPrefix + id), single}
+}
+
+// before is the query bound for index entries scored before t
+func before(t time.Time) string {
+	return sortable(t.UnixMicro()-1) + "$"
+}
+
+// SoftDeleteReceipt replaces the receipt and its index entries with a tombstone that
+// doesn't expire, in one transaction conditional on the receipt still being there.
+// Balances stay. db.ErrNotFound for unknown, expired and already deleted ids.
+func (s *Store) SoftDeleteReceipt(ctx context.Context, id string, at time.Time) (db.ReceiptRecord, error) {
+	rec, err := s.receipt(ctx, id)
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error deleting receipt %s: %w", id, err)
+	}
+	deletedAt := at.UTC()
+	rec.DeletedAt = &deletedAt
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error encoding receipt record: %v", err)
+	}
+	writes, err := s.deleteWrites(rec)
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error deleting receipt %s: %w", id, err)
+	}
+	// the record's delete comes first
+	writes[0].cond = cond{live: true}
+	writes = append(writes,
+		write{item: item{key: s.tombstoneKey(id), value: string(value)}, kind: putWrite},
+		write{item: item{key: key{s.key(tombstonesIndexKey), indexKey(deletedAt.UnixMicro(), id)}, value: id}, kind: putWrite})
+	err = s.table.transact(ctx, writes)
+	if i, failed := failedWrite(err); failed && i == 0 {
+		return db.ReceiptRecord{}, fmt.Errorf("Error deleting receipt %s: %w", id, db.ErrNotFound)
+	} else if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error deleting receipt %s: %w", id, err)
+	}
+	return rec, nil
+}
+
+// GetTombstone fails with db.ErrNotFound for receipts that weren't soft deleted or have
+// been purged
+func (s *Store) GetTombstone(ctx context.Context, id string) (db.ReceiptRecord, error) {
+	it, ok, err := s.table.get(ctx, s.tombstoneKey(id))
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error getting key from database: %w", err)
+	}
+	if !ok {
+		return db.ReceiptRecord{}, fmt.Errorf("Key does not exist in database: %w", db.ErrNotFound)
+	}
+	var rec db.ReceiptRecord
+	if err := json.Unmarshal([]byte(it.value), &rec); err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error decoding receipt record: %v", err)
+	}
+	return rec, nil
+}
+
+// PurgeReceipts deletes tombstones deleted before deletedBefore, then receipts created
+// before createdBefore, oldest first and up to limit in all, like RedisStore. Every
+// receipt goes in its own transaction.
+func (s *Store) PurgeReceipts(ctx context.Context, createdBefore, deletedBefore time.Time, limit int) (db.RetentionSweep, error) {
+	var sweep db.RetentionSweep
+	if !deletedBefore.IsZero() {
+		entries, err := s.table.query(ctx, query{pk: s.key(tombstonesIndexKey), to: before(deletedBefore), limit: limit})
+		if err != nil {
+			return sweep, fmt.Errorf("Error reading tombstones: %w", err)
+		}
+		sweep.More = len(entries) == limit
+		for _, entry := range entries {
+			tombstone, ok, err := s.table.get(ctx, s.tombstoneKey(entry.value))
+			if err != nil {
+				return sweep, fmt.Errorf("Error reading tombstones: %w", err)
+			}
+			err = s.table.transact(ctx, []write{
+				{item: item{key: s.tombstoneKey(entry.value)}, kind: deleteWrite},
+				{item: item{key: entry.key}, kind: deleteWrite},
+			})
+			if err != nil {
+				return sweep, fmt.Errorf("Error purging tombstones: %w", err)
+			}
+			var rec db.ReceiptRecord
+			if ok && json.Unmarshal([]byte(tombstone.value), &rec) == nil {
+				sweep.Purged = append(sweep.Purged, rec)
+			}
+		}
+	}
+	if createdBefore.IsZero() || len(sweep.Purged) >= limit {
+		return sweep, nil
+	}
+	left := limit - len(sweep.Purged)
+	entries, err := s.table.query(ctx, query{pk: s.key(createdIndexKey), to: before(createdBefore), limit: left})
+	if err != nil {
+		return sweep, fmt.Errorf("Error reading receipt index: %w", err)
+	}
+	sweep.More = sweep.More || len(entries) == left
+	records, err := s.indexed(ctx, entries)
+	if err != nil {
+		return sweep, fmt.Errorf("Error fetching receipts from database: %w", err)
+	}
+	found := make(map[string]bool, len(records))
+	for _, rec := range records {
+		found[rec.ID] = true
+		writes, err := s.deleteWrites(rec)
+		if err != nil {
+			return sweep, fmt.Errorf("Error purging receipts: %w", err)
+		}
+		if err := s.table.transact(ctx, writes); err != nil {
+			return sweep, fmt.Errorf("Error purging receipts: %w", err)
+		}
+		sweep.Purged = append(sweep.Purged, rec)
+	}
+	// entries whose record is gone before DynamoDB's TTL got to them would come up
+	// every sweep
+	for _, entry := range entries {
+		if found[entry.value] {
+			continue
+		}
+		if err := s.table.transact(ctx, []write{{item: item{key: entry.key}, kind: deleteWrite}}); err != nil {
+			return sweep, fmt.Errorf("Error purging receipts: %w", err)
+		}
+	}
+	return sweep, nil
+}
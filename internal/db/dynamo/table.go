@@ -0,0 +1,572 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/clock"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// the table's attributes: pk and sk are the key, v holds a string value (JSON for
+// records), expire_at is the unix second DynamoDB's TTL deletes the item after. every
+// other number attribute is a counter in item.nums
+const (
+	pkAttr     = "pk"
+	skAttr     = "sk"
+	valueAttr  = "v"
+	expireAttr = "expire_at"
+)
+
+type key struct {
+	pk, sk string
+}
+
+type item struct {
+	key
+	value string
+	nums  map[string]int64
+	// unix seconds, 0 never expires
+	expire int64
+}
+
+// cond is what a write expects of the item it touches, every set field has to hold
+type cond struct {
+	// the item doesn't exist or has expired
+	absent bool
+	// the item exists and hasn't expired
+	live bool
+	// the item hasn't expired, a missing one counts
+	unexpired bool
+	// the item's value is this
+	value *string
+	// the item's counters have these values, a missing counter counts as 0
+	nums map[string]int64
+}
+
+type writeKind int
+
+const (
+	// an update sets the value when it isn't "", adds nums to the counters and sets
+	// expire when the item has no expiry yet
+	updateWrite writeKind = iota
+	putWrite
+	deleteWrite
+	// checkWrite only holds a transaction to its condition, it writes nothing
+	checkWrite
+)
+
+type write struct {
+	item
+	kind writeKind
+	cond cond
+}
+
+// query reads a partition in sort key order. from and to bound the sort keys
+// (inclusive, "" for unbounded), after is the sort key to continue past
+type query struct {
+	pk       string
+	from, to string
+	after    string
+	desc     bool
+	// 0 reads the whole partition
+	limit int
+	// expired items are left out unless this is set
+	withExpired bool
+}
+
+// table is the little of DynamoDB the store uses. reads leave out expired items,
+// DynamoDB's TTL can take a while to delete them.
+type table interface {
+	ping(ctx context.Context) error
+	get(ctx context.Context, k key) (item, bool, error)
+	// getMany returns the items found, by key
+	getMany(ctx context.Context, keys []key) (map[key]item, error)
+	query(ctx context.Context, q query) ([]item, error)
+	count(ctx context.Context, pk string) (int64, error)
+	// scan returns the keys of every item whose pk starts with prefix
+	scan(ctx context.Context, prefix string) ([]key, error)
+	// update applies one write and returns the item as it is afterwards
+	update(ctx context.Context, w write) (item, error)
+	// transact applies up to maxTransactItems writes, all or none. no two may touch
+	// the same item
+	transact(ctx context.Context, writes []write) error
+}
+
+// DynamoDB's limit on the items in one transaction
+const maxTransactItems = 100
+
+// conditionFailed is the error when a write's condition didn't hold, index is the
+// write's position in the transaction
+type conditionFailed struct {
+	index int
+}
+
+func (e *conditionFailed) Error() string {
+	return fmt.Sprintf("condition of write %d failed", e.index)
+}
+
+// failedWrite is the index of the write whose condition failed, false when err is
+// something else
+func failedWrite(err error) (int, bool) {
+	var failed *conditionFailed
+	if errors.As(err, &failed) {
+		return failed.index, true
+	}
+	return 0, false
+}
+
+// dynamoTable is the table on the DynamoDB API
+type dynamoTable struct {
+	client *dynamodb.Client
+	name   string
+	clock  clock.Clock
+}
+
+func (t *dynamoTable) now() int64 {
+	return t.clock.Now().Unix()
+}
+
+func (t *dynamoTable) live(it item) bool {
+	return it.expire == 0 || it.expire > t.now()
+}
+
+func (t *dynamoTable) ping(ctx context.Context) error {
+	_, err := t.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(t.name)})
+	return awsError(err)
+}
+
+func (t *dynamoTable) get(ctx context.Context, k key) (item, bool, error) {
+	out, err := t.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(t.name),
+		Key:            encodeKey(k),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || out.Item == nil {
+		return item{}, false, awsError(err)
+	}
+	it, err := decodeItem(out.Item)
+	if err != nil || !t.live(it) {
+		return item{}, false, err
+	}
+	return it, true, nil
+}
+
+// DynamoDB's limit on the keys in one BatchGetItem
+const maxBatchGetKeys = 100
+
+func (t *dynamoTable) getMany(ctx context.Context, keys []key) (map[key]item, error) {
+	items := make(map[key]item, len(keys))
+	// BatchGetItem refuses a request that asks for a key twice
+	seen := make(map[key]bool, len(keys))
+	unique := keys[:0:0]
+	for _, k := range keys {
+		if !seen[k] {
+			seen[k] = true
+			unique = append(unique, k)
+		}
+	}
+	keys = unique
+	for start := 0; start < len(keys); start += maxBatchGetKeys {
+		chunk := keys[start:min(start+maxBatchGetKeys, len(keys))]
+		request := make([]map[string]types.AttributeValue, len(chunk))
+		for i, k := range chunk {
+			request[i] = encodeKey(k)
+		}
+		// whatever DynamoDB didn't get to comes back unprocessed and is asked for again
+		for len(request) > 0 {
+			out, err := t.client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: map[string]types.KeysAndAttributes{
+					t.name: {Keys: request, ConsistentRead: aws.Bool(true)},
+				},
+			})
+			if err != nil {
+				return nil, awsError(err)
+			}
+			for _, raw := range out.Responses[t.name] {
+				it, err := decodeItem(raw)
+				if err != nil {
+					return nil, err
+				}
+				if t.live(it) {
+					items[it.key] = it
+				}
+			}
+			request = out.UnprocessedKeys[t.name].Keys
+		}
+	}
+	return items, nil
+}
+
+func (t *dynamoTable) query(ctx context.Context, q query) ([]item, error) {
+	b := newExpr()
+	keyCond := b.name(pkAttr) + " = " + b.value(str(q.pk))
+	switch {
+	case q.from != "" && q.to != "":
+		keyCond += " AND " + b.name(skAttr) + " BETWEEN " + b.value(str(q.from)) + " AND " + b.value(str(q.to))
+	case q.from != "":
+		keyCond += " AND " + b.name(skAttr) + " >= " + b.value(str(q.from))
+	case q.to != "":
+		keyCond += " AND " + b.name(skAttr) + " <= " + b.value(str(q.to))
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(t.name),
+		KeyConditionExpression:    aws.String(keyCond),
+		ExpressionAttributeNames:  b.names,
+		ExpressionAttributeValues: b.values,
+		ScanIndexForward:          aws.Bool(!q.desc),
+		ConsistentRead:            aws.Bool(true),
+	}
+	if q.after != "" {
+		input.ExclusiveStartKey = encodeKey(key{q.pk, q.after})
+	}
+	var items []item
+	// expired items are dropped here rather than by a filter expression so a page
+	// keeps going until it has limit live ones
+	for {
+		if q.limit > 0 {
+			input.Limit = aws.Int32(int32(q.limit - len(items)))
+		}
+		out, err := t.client.Query(ctx, input)
+		if err != nil {
+			return nil, awsError(err)
+		}
+		for _, raw := range out.Items {
+			it, err := decodeItem(raw)
+			if err != nil {
+				return nil, err
+			}
+			if q.withExpired || t.live(it) {
+				items = append(items, it)
+			}
+		}
+		if out.LastEvaluatedKey == nil || (q.limit > 0 && len(items) >= q.limit) {
+			return items, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (t *dynamoTable) count(ctx context.Context, pk string) (int64, error) {
+	b := newExpr()
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(t.name),
+		KeyConditionExpression: aws.String(b.name(pkAttr) + " = " + b.value(str(pk))),
+		FilterExpression:       aws.String(b.unexpired(t.now())),
+		Select:                 types.SelectCount,
+	}
+	input.ExpressionAttributeNames, input.ExpressionAttributeValues = b.names, b.values
+	var n int64
+	for {
+		out, err := t.client.Query(ctx, input)
+		if err != nil {
+			return 0, awsError(err)
+		}
+		n += int64(out.Count)
+		if out.LastEvaluatedKey == nil {
+			return n, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (t *dynamoTable) scan(ctx context.Context, prefix string) ([]key, error) {
+	b := newExpr()
+	filter := b.unexpired(t.now())
+	if prefix != "" {
+		filter = "begins_with(" + b.name(pkAttr) + ", " + b.value(str(prefix)) + ") AND " + filter
+	}
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(t.name),
+		FilterExpression:          aws.String(filter),
+		ProjectionExpression:      aws.String(b.name(pkAttr) + ", " + b.name(skAttr)),
+		ExpressionAttributeNames:  b.names,
+		ExpressionAttributeValues: b.values,
+	}
+	var keys []key
+	for {
+		out, err := t.client.Scan(ctx, input)
+		if err != nil {
+			return nil, awsError(err)
+		}
+		for _, raw := range out.Items {
+			it, err := decodeItem(raw)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, it.key)
+		}
+		if out.LastEvaluatedKey == nil {
+			return keys, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (t *dynamoTable) update(ctx context.Context, w write) (item, error) {
+	b := newExpr()
+	input := &dynamodb.UpdateItemInput{
+		TableName:        aws.String(t.name),
+		Key:              encodeKey(w.key),
+		UpdateExpression: aws.String(b.update(w.item)),
+		ReturnValues:     types.ReturnValueAllNew,
+	}
+	if c := b.condition(w.cond, t.now()); c != "" {
+		input.ConditionExpression = aws.String(c)
+	}
+	input.ExpressionAttributeNames, input.ExpressionAttributeValues = b.names, b.values
+	out, err := t.client.UpdateItem(ctx, input)
+	if err != nil {
+		return item{}, conditionError(err)
+	}
+	return decodeItem(out.Attributes)
+}
+
+func (t *dynamoTable) transact(ctx context.Context, writes []write) error {
+	if len(writes) > maxTransactItems {
+		return fmt.Errorf("%d writes don't fit in one transaction", len(writes))
+	}
+	// a transaction costs twice the capacity, one write doesn't need it
+	if len(writes) == 1 && writes[0].kind != checkWrite {
+		return t.write(ctx, writes[0])
+	}
+	now := t.now()
+	items := make([]types.TransactWriteItem, len(writes))
+	for i, w := range writes {
+		b := newExpr()
+		var condition *string
+		if c := b.condition(w.cond, now); c != "" {
+			condition = aws.String(c)
+		}
+		// empty maps aren't allowed, nil ones are left out
+		names, values := b.names, b.values
+		if len(names) == 0 {
+			names = nil
+		}
+		if len(values) == 0 {
+			values = nil
+		}
+		switch w.kind {
+		case putWrite:
+			items[i].Put = &types.Put{TableName: aws.String(t.name), Item: encodeItem(w.item), ConditionExpression: condition,
+				ExpressionAttributeNames: names, ExpressionAttributeValues: values}
+		case deleteWrite:
+			items[i].Delete = &types.Delete{TableName: aws.String(t.name), Key: encodeKey(w.key), ConditionExpression: condition,
+				ExpressionAttributeNames: names, ExpressionAttributeValues: values}
+		case checkWrite:
+			items[i].ConditionCheck = &types.ConditionCheck{TableName: aws.String(t.name), Key: encodeKey(w.key), ConditionExpression: condition,
+				ExpressionAttributeNames: names, ExpressionAttributeValues: values}
+		default:
+			update := b.update(w.item)
+			items[i].Update = &types.Update{TableName: aws.String(t.name), Key: encodeKey(w.key), UpdateExpression: aws.String(update),
+				ConditionExpression: condition, ExpressionAttributeNames: b.names, ExpressionAttributeValues: b.values}
+		}
+	}
+	_, err := t.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	return conditionError(err)
+}
+
+func (t *dynamoTable) write(ctx context.Context, w write) error {
+	if w.kind == updateWrite {
+		_, err := t.update(ctx, w)
+		return err
+	}
+	b := newExpr()
+	var condition *string
+	if c := b.condition(w.cond, t.now()); c != "" {
+		condition = aws.String(c)
+	}
+	names, values := b.names, b.values
+	if len(names) == 0 {
+		names, values = nil, nil
+	}
+	var err error
+	if w.kind == putWrite {
+		_, err = t.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(t.name), Item: encodeItem(w.item),
+			ConditionExpression: condition, ExpressionAttributeNames: names, ExpressionAttributeValues: values})
+	} else {
+		_, err = t.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{TableName: aws.String(t.name), Key: encodeKey(w.key),
+			ConditionExpression: condition, ExpressionAttributeNames: names, ExpressionAttributeValues: values})
+	}
+	return conditionError(err)
+}
+
+// conditionError turns DynamoDB's failed conditions into *conditionFailed
+func conditionError(err error) error {
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for i, reason := range canceled.CancellationReasons {
+			if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+				return &conditionFailed{index: i}
+			}
+		}
+		return awsError(err)
+	}
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return &conditionFailed{}
+	}
+	return awsError(err)
+}
+
+// expr collects the placeholders of an expression
+type expr struct {
+	names  map[string]string
+	values map[string]types.AttributeValue
+}
+
+func newExpr() *expr {
+	return &expr{names: map[string]string{}, values: map[string]types.AttributeValue{}}
+}
+
+func (b *expr) name(attr string) string {
+	for placeholder, name := range b.names {
+		if name == attr {
+			return placeholder
+		}
+	}
+	placeholder := "#n" + strconv.Itoa(len(b.names))
+	b.names[placeholder] = attr
+	return placeholder
+}
+
+func (b *expr) value(v types.AttributeValue) string {
+	placeholder := ":v" + strconv.Itoa(len(b.values))
+	b.values[placeholder] = v
+	return placeholder
+}
+
+func (b *expr) unexpired(now int64) string {
+	exp := b.name(expireAttr)
+	return "(attribute_not_exists(" + exp + ") OR " + exp + " > " + b.value(num(now)) + ")"
+}
+
+func (b *expr) condition(c cond, now int64) string {
+	var parts []string
+	exp := func() string { return b.name(expireAttr) }
+	if c.absent {
+		parts = append(parts, "(attribute_not_exists("+b.name(pkAttr)+") OR "+exp()+" <= "+b.value(num(now))+")")
+	}
+	if c.live {
+		parts = append(parts, "attribute_exists("+b.name(pkAttr)+")", b.unexpired(now))
+	}
+	if c.unexpired {
+		parts = append(parts, b.unexpired(now))
+	}
+	if c.value != nil {
+		parts = append(parts, b.name(valueAttr)+" = "+b.value(str(*c.value)))
+	}
+	for attr, n := range c.nums {
+		if n == 0 {
+			parts = append(parts, "(attribute_not_exists("+b.name(attr)+") OR "+b.name(attr)+" = "+b.value(num(0))+")")
+		} else {
+			parts = append(parts, b.name(attr)+" = "+b.value(num(n)))
+		}
+	}
+	return strings.Join(parts, " AND ")
+}
+
+func (b *expr) update(it item) string {
+	var set, add []string
+	if it.value != "" {
+		set = append(set, b.name(valueAttr)+" = "+b.value(str(it.value)))
+	}
+	if it.expire != 0 {
+		exp := b.name(expireAttr)
+		set = append(set, exp+" = if_not_exists("+exp+", "+b.value(num(it.expire))+")")
+	}
+	for attr, n := range it.nums {
+		add = append(add, b.name(attr)+" "+b.value(num(n)))
+	}
+	var clauses []string
+	if len(set) > 0 {
+		clauses = append(clauses, "SET "+strings.Join(set, ", "))
+	}
+	if len(add) > 0 {
+		clauses = append(clauses, "ADD "+strings.Join(add, ", "))
+	}
+	return strings.Join(clauses, " ")
+}
+
+func str(s string) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: s}
+}
+
+func num(n int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+func encodeKey(k key) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{pkAttr: str(k.pk), skAttr: str(k.sk)}
+}
+
+func encodeItem(it item) map[string]types.AttributeValue {
+	attrs := encodeKey(it.key)
+	if it.value != "" {
+		attrs[valueAttr] = str(it.value)
+	}
+	if it.expire != 0 {
+		attrs[expireAttr] = num(it.expire)
+	}
+	for attr, n := range it.nums {
+		attrs[attr] = num(n)
+	}
+	return attrs
+}
+
+func decodeItem(attrs map[string]types.AttributeValue) (item, error) {
+	var it item
+	for attr, v := range attrs {
+		switch v := v.(type) {
+		case *types.AttributeValueMemberS:
+			switch attr {
+			case pkAttr:
+				it.pk = v.Value
+			case skAttr:
+				it.sk = v.Value
+			case valueAttr:
+				it.value = v.Value
+			}
+		case *types.AttributeValueMemberN:
+			n, err := strconv.ParseInt(v.Value, 10, 64)
+			if err != nil {
+				return item{}, fmt.Errorf("Error decoding attribute %s: %v", attr, err)
+			}
+			if attr == expireAttr {
+				it.expire = n
+				continue
+			}
+			if it.nums == nil {
+				it.nums = make(map[string]int64)
+			}
+			it.nums[attr] = n
+		}
+	}
+	return it, nil
+}
+
+// awsError marks DynamoDB being unreachable, failing or throttling as
+// db.ErrUnavailable. Errors DynamoDB blames on the request itself are left alone, so
+// is the caller giving up.
+func awsError(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorFault() == smithy.FaultClient {
+		switch apiErr.ErrorCode() {
+		case "ProvisionedThroughputExceededException", "ThrottlingException", "RequestLimitExceeded":
+		default:
+			return err
+		}
+	}
+	return db.Unavailable(err)
+}
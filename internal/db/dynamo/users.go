@@ -0,0 +1,423 @@
+package dynamo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+const (
+	userKeyPrefix   = "user:"
+	pointsExpiryKey = "points:expiry"
+)
+
+// userBalanceKey holds the user's balance and expired points counters
+func (s *Store) userBalanceKey(userID string) key {
+	return key{s.key(userKeyPrefix + userID + ":balance"), single}
+}
+
+func (s *Store) userReceiptsKey(userID string) string {
+	return s.key(userKeyPrefix + userID + ":receipts")
+}
+
+// lotKey holds the points a receipt credited that expire, and when they're due
+func (s *Store) lotKey(userID, receiptID string) key {
+	return key{s.key(userKeyPrefix + userID + ":lots"), receiptID}
+}
+
+// expiryKey is a lot's entry in the index ExpirePoints finds due lots in
+func (s *Store) expiryKey(userID, receiptID string, due int64) key {
+	return key{s.key(pointsExpiryKey), indexKey(due, userID+":"+receiptID)}
+}
+
+func (s *Store) redemptionKey(userID, id string) key {
+	return key{s.key(userKeyPrefix + userID + ":redemption:" + id), single}
+}
+
+func (s *Store) userRedemptionsKey(userID string) string {
+	return s.key(userKeyPrefix + userID + ":redemptions")
+}
+
+func (s *Store) adjustmentKey(userID, id string) key {
+	return key{s.key(userKeyPrefix + userID + ":adjustment:" + id), single}
+}
+
+// userAdjustmentsKey is the user's adjustment ledger, receiptAdjustmentsKey the
+// adjustments of one of their receipts. both hold the entries themselves, like the
+// redemption ledger
+func (s *Store) userAdjustmentsKey(userID string) string {
+	return s.key(userKeyPrefix + userID + ":adjustments")
+}
+
+func (s *Store) receiptAdjustmentsKey(userID, receiptID string) string {
+	return s.key(userKeyPrefix + userID + ":adjustments:" + receiptID)
+}
+
+// adjustmentWrites put an adjustment's entry into the ledgers it belongs in
+func (s *Store) adjustmentWrites(adj db.Adjustment, value string) []write {
+	sk := indexKey(adj.CreatedAt.UnixMicro(), adj.ID)
+	writes := []write{{item: item{key: key{s.userAdjustmentsKey(adj.UserID), sk}, value: value}, kind: putWrite}}
+	if adj.ReceiptID != "" {
+		writes = append(writes, write{item: item{key: key{s.receiptAdjustmentsKey(adj.UserID, adj.ReceiptID), sk}, value: value}, kind: putWrite})
+	}
+	return writes
+}
+
+// creditWrites are RedisStore's queueCredit: points that already expired go straight
+// to the expired total, expiring ones become a lot
+func (s *Store) creditWrites(rec db.ReceiptRecord, now time.Time) []write {
+	balance := s.userBalanceKey(rec.UserID)
+	points := int64(rec.Points)
+	switch {
+	case rec.PointsExpireAt == nil:
+		return []write{{item: item{key: balance, nums: map[string]int64{"balance": points}}}}
+	case !rec.PointsExpireAt.After(now):
+		return []write{{item: item{key: balance, nums: map[string]int64{"expired": points}}}}
+	}
+	due := rec.PointsExpireAt.Unix()
+	return []write{
+		{item: item{key: balance, nums: map[string]int64{"balance": points}}},
+		{item: item{key: s.lotKey(rec.UserID, rec.ID), nums: map[string]int64{"points": points, "due": due}}, kind: putWrite},
+		{item: item{key: s.expiryKey(rec.UserID, rec.ID, due), value: rec.UserID}, kind: putWrite},
+	}
+}
+
+// GetUserPoints reads the balance and up to historyLimit of the user's latest receipts
+// that haven't expired
+func (s *Store) GetUserPoints(ctx context.Context, userID string, historyLimit int) (db.UserPoints, error) {
+	balance, _, err := s.table.get(ctx, s.userBalanceKey(userID))
+	if err != nil {
+		return db.UserPoints{}, fmt.Errorf("Error reading user points: %w", err)
+	}
+	entries, err := s.table.query(ctx, query{pk: s.userReceiptsKey(userID), desc: true, limit: historyLimit})
+	if err != nil {
+		return db.UserPoints{}, fmt.Errorf("Error reading user history: %w", err)
+	}
+	records, err := s.indexed(ctx, entries)
+	if err != nil {
+		return db.UserPoints{}, fmt.Errorf("Error reading user history: %w", err)
+	}
+	return db.UserPoints{
+		UserID:   userID,
+		Balance:  int(balance.nums["balance"]),
+		Expired:  int(balance.nums["expired"]),
+		Receipts: records,
+	}, nil
+}
+
+// Redeem follows RedisStore.Redeem: replays of a redemption id return the original,
+// db.ErrRedemptionConflict when they differ, db.ErrInsufficientPoints when the balance
+// is short. The redemption is written only if it doesn't exist yet and the balance
+// only if it's still the one that was checked, a race with another write starts over.
+func (s *Store) Redeem(ctx context.Context, red db.Redemption) (db.Redemption, bool, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		existing, ok, err := s.table.get(ctx, s.redemptionKey(red.UserID, red.ID))
+		if err != nil {
+			return db.Redemption{}, false, fmt.Errorf("Error redeeming points: %w", err)
+		}
+		if ok {
+			var original db.Redemption
+			if err := json.Unmarshal([]byte(existing.value), &original); err != nil {
+				return db.Redemption{}, false, fmt.Errorf("Error decoding redemption: %v", err)
+			}
+			if original.Points != red.Points || original.Reward != red.Reward {
+				return db.Redemption{}, false, fmt.Errorf("Error redeeming %s: %w", red.ID, db.ErrRedemptionConflict)
+			}
+			return original, false, nil
+		}
+
+		current, _, err := s.table.get(ctx, s.userBalanceKey(red.UserID))
+		if err != nil {
+			return db.Redemption{}, false, fmt.Errorf("Error redeeming points: %w", err)
+		}
+		balance := current.nums["balance"]
+		if balance < int64(red.Points) {
+			return db.Redemption{}, false, fmt.Errorf("Error redeeming %d points with a balance of %d: %w",
+				red.Points, balance, db.ErrInsufficientPoints)
+		}
+		attemptRed := red
+		attemptRed.BalanceAfter = int(balance) - red.Points
+		value, err := json.Marshal(attemptRed)
+		if err != nil {
+			return db.Redemption{}, false, fmt.Errorf("Error encoding redemption: %v", err)
+		}
+		// handed back the way it's stored, decoded from JSON
+		if err := json.Unmarshal(value, &attemptRed); err != nil {
+			return db.Redemption{}, false, fmt.Errorf("Error decoding redemption: %v", err)
+		}
+		err = s.table.transact(ctx, []write{
+			{item: item{key: s.redemptionKey(red.UserID, red.ID), value: string(value)}, kind: putWrite, cond: cond{absent: true}},
+			{
+				item: item{key: s.userBalanceKey(red.UserID), nums: map[string]int64{"balance": -int64(red.Points)}},
+				cond: cond{nums: map[string]int64{"balance": balance}},
+			},
+			{
+				item: item{key: key{s.userRedemptionsKey(red.UserID), indexKey(red.CreatedAt.UnixMicro(), red.ID)}, value: string(value)},
+				kind: putWrite,
+			},
+		})
+		if _, failed := failedWrite(err); failed {
+			continue
+		} else if err != nil {
+			return db.Redemption{}, false, fmt.Errorf("Error redeeming points: %w", err)
+		}
+		return attemptRed, true, nil
+	}
+	return db.Redemption{}, false, errContention("redeeming points")
+}
+
+// ListRedemptions returns up to limit of the user's latest redemptions, newest first
+func (s *Store) ListRedemptions(ctx context.Context, userID string, limit int) ([]db.Redemption, error) {
+	entries, err := s.table.query(ctx, query{pk: s.userRedemptionsKey(userID), desc: true, limit: limit})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing redemptions: %w", err)
+	}
+	redemptions := make([]db.Redemption, len(entries))
+	for i, entry := range entries {
+		if err := json.Unmarshal([]byte(entry.value), &redemptions[i]); err != nil {
+			return nil, fmt.Errorf("Error decoding redemption: %v", err)
+		}
+	}
+	return redemptions, nil
+}
+
+// Adjust follows RedisStore.Adjust: replays of an adjustment id return the original,
+// db.ErrAdjustmentConflict when they differ, db.ErrInsufficientPoints when a clawback
+// is more than the balance, db.ErrTooManyAdjustments and db.ErrReceiptOverdrawn when
+// the receipt as stored can't take it, db.ErrNotFound without the receipt. Like Redeem,
+// the balance is only written if it's still the one that was checked, and for a
+// receipt only if the receipt is unchanged and no other adjustment of it was made
+// since they were read.
+func (s *Store) Adjust(ctx context.Context, adj db.Adjustment) (db.Adjustment, bool, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		existing, ok, err := s.table.get(ctx, s.adjustmentKey(adj.UserID, adj.ID))
+		if err != nil {
+			return db.Adjustment{}, false, fmt.Errorf("Error adjusting points: %w", err)
+		}
+		if ok {
+			var original db.Adjustment
+			if err := json.Unmarshal([]byte(existing.value), &original); err != nil {
+				return db.Adjustment{}, false, fmt.Errorf("Error decoding adjustment: %v", err)
+			}
+			if original.Points != adj.Points || original.ReceiptID != adj.ReceiptID || original.Reason != adj.Reason {
+				return db.Adjustment{}, false, fmt.Errorf("Error adjusting %s: %w", adj.ID, db.ErrAdjustmentConflict)
+			}
+			return original, false, nil
+		}
+
+		current, _, err := s.table.get(ctx, s.userBalanceKey(adj.UserID))
+		if err != nil {
+			return db.Adjustment{}, false, fmt.Errorf("Error adjusting points: %w", err)
+		}
+		balanceWrite := write{
+			item: item{key: s.userBalanceKey(adj.UserID), nums: map[string]int64{"balance": int64(adj.Points)}},
+			cond: cond{nums: map[string]int64{"balance": current.nums["balance"]}},
+		}
+		var receiptCheck []write
+		if adj.ReceiptID != "" {
+			check, err := s.checkReceiptAdjustment(ctx, adj)
+			if err != nil {
+				return db.Adjustment{}, false, err
+			}
+			receiptCheck = append(receiptCheck, check)
+			counter := receiptAdjustmentsAttr(adj.ReceiptID)
+			balanceWrite.item.nums[counter] = 1
+			balanceWrite.cond.nums[counter] = current.nums[counter]
+		}
+		balance := current.nums["balance"]
+		if balance+int64(adj.Points) < 0 {
+			return db.Adjustment{}, false, fmt.Errorf("Error adjusting by %d points with a balance of %d: %w",
+				adj.Points, balance, db.ErrInsufficientPoints)
+		}
+		attemptAdj := adj
+		attemptAdj.BalanceAfter = int(balance) + adj.Points
+		value, err := json.Marshal(attemptAdj)
+		if err != nil {
+			return db.Adjustment{}, false, fmt.Errorf("Error encoding adjustment: %v", err)
+		}
+		// handed back the way it's stored, decoded from JSON
+		if err := json.Unmarshal(value, &attemptAdj); err != nil {
+			return db.Adjustment{}, false, fmt.Errorf("Error decoding adjustment: %v", err)
+		}
+		writes := []write{
+			{item: item{key: s.adjustmentKey(adj.UserID, adj.ID), value: string(value)}, kind: putWrite, cond: cond{absent: true}},
+			balanceWrite,
+		}
+		writes = append(writes, receiptCheck...)
+		err = s.table.transact(ctx, append(writes, s.adjustmentWrites(adj, string(value))...))
+		if _, failed := failedWrite(err); failed {
+			continue
+		} else if err != nil {
+			return db.Adjustment{}, false, fmt.Errorf("Error adjusting points: %w", err)
+		}
+		return attemptAdj, true, nil
+	}
+	return db.Adjustment{}, false, errContention("adjusting points")
+}
+
+// receiptAdjustmentsAttr counts the adjustments of a receipt on the user's balance
+// item, so an adjustment of it conditions on none being made in between
+func receiptAdjustmentsAttr(receiptID string) string {
+	return "adjustments:" + receiptID
+}
+
+// checkReceiptAdjustment holds adj to db.MaxReceiptAdjustments for its receipt, and
+// the receipt's points plus adjustments to zero or more. It returns the check that the
+// receipt is still the one read, for the adjustment's transaction.
+func (s *Store) checkReceiptAdjustment(ctx context.Context, adj db.Adjustment) (write, error) {
+	it, ok, err := s.table.get(ctx, s.receiptKey(adj.ReceiptID))
+	if err != nil {
+		return write{}, fmt.Errorf("Error adjusting points: %w", err)
+	}
+	if !ok {
+		return write{}, fmt.Errorf("Error adjusting receipt %s: %w", adj.ReceiptID, db.ErrNotFound)
+	}
+	var rec db.ReceiptRecord
+	if err := json.Unmarshal([]byte(it.value), &rec); err != nil {
+		return write{}, fmt.Errorf("Error decoding receipt record: %v", err)
+	}
+	entries, err := s.table.query(ctx, query{pk: s.receiptAdjustmentsKey(adj.UserID, adj.ReceiptID)})
+	if err != nil {
+		return write{}, fmt.Errorf("Error adjusting points: %w", err)
+	}
+	if len(entries) >= db.MaxReceiptAdjustments {
+		return write{}, fmt.Errorf("Error adjusting receipt %s with %d adjustments: %w", adj.ReceiptID, len(entries), db.ErrTooManyAdjustments)
+	}
+	total := rec.Points
+	for _, entry := range entries {
+		var other db.Adjustment
+		if err := json.Unmarshal([]byte(entry.value), &other); err != nil {
+			return write{}, fmt.Errorf("Error decoding adjustment: %v", err)
+		}
+		total += other.Points
+	}
+	if total+adj.Points < 0 {
+		return write{}, fmt.Errorf("Error adjusting receipt %s by %d points with %d left: %w", adj.ReceiptID, adj.Points, total, db.ErrReceiptOverdrawn)
+	}
+	return write{item: item{key: s.receiptKey(adj.ReceiptID)}, kind: checkWrite, cond: cond{value: &it.value}}, nil
+}
+
+// ListAdjustments returns up to limit of the user's latest adjustments, newest first,
+// only the ones of receiptID unless that's empty
+func (s *Store) ListAdjustments(ctx context.Context, userID, receiptID string, limit int) ([]db.Adjustment, error) {
+	pk := s.userAdjustmentsKey(userID)
+	if receiptID != "" {
+		pk = s.receiptAdjustmentsKey(userID, receiptID)
+	}
+	entries, err := s.table.query(ctx, query{pk: pk, desc: true, limit: limit})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing adjustments: %w", err)
+	}
+	adjustments := make([]db.Adjustment, len(entries))
+	for i, entry := range entries {
+		if err := json.Unmarshal([]byte(entry.value), &adjustments[i]); err != nil {
+			return nil, fmt.Errorf("Error decoding adjustment: %v", err)
+		}
+	}
+	return adjustments, nil
+}
+
+// ExpirePoints expires the points of up to limit lots due by now, user by user like
+// RedisStore's expire script
+func (s *Store) ExpirePoints(ctx context.Context, now time.Time, limit int) (db.ExpirySweep, error) {
+	entries, err := s.table.query(ctx, query{pk: s.key(pointsExpiryKey), to: sortable(now.Unix()) + "$", limit: limit})
+	if err != nil {
+		return db.ExpirySweep{}, fmt.Errorf("Error expiring points: %w", err)
+	}
+	sweep := db.ExpirySweep{More: limit > 0 && len(entries) == limit}
+	var users []string
+	dueEntries := make(map[string][]key)
+	for _, entry := range entries {
+		if _, seen := dueEntries[entry.value]; !seen {
+			users = append(users, entry.value)
+		}
+		dueEntries[entry.value] = append(dueEntries[entry.value], entry.key)
+	}
+	for _, userID := range users {
+		expired, err := s.expireUser(ctx, userID, now, dueEntries[userID])
+		if err != nil {
+			return sweep, fmt.Errorf("Error expiring points: %w", err)
+		}
+		sweep.Users++
+		sweep.Points += expired
+	}
+	return sweep, nil
+}
+
+// a user's due lots are expired in one transaction, each takes two of its writes
+const maxExpiringLots = (maxTransactItems - 1) / 2
+
+// expireUser expires the user's lots that are due and returns how many points that
+// took. Due lots go oldest first and only lose what the balance holds beyond the
+// younger lots, like in RedisStore. entries are the user's index entries the sweep
+// found, they're removed even if their lot is already gone.
+func (s *Store) expireUser(ctx context.Context, userID string, now time.Time, entries []key) (int, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		balanceItem, _, err := s.table.get(ctx, s.userBalanceKey(userID))
+		if err != nil {
+			return 0, err
+		}
+		lots, err := s.table.query(ctx, query{pk: s.lotKey(userID, "").pk})
+		if err != nil {
+			return 0, err
+		}
+		var active int64
+		var due []item
+		for _, lot := range lots {
+			active += lot.nums["points"]
+			if lot.nums["due"] <= now.Unix() {
+				due = append(due, lot)
+			}
+		}
+		sort.SliceStable(due, func(i, j int) bool { return due[i].nums["due"] < due[j].nums["due"] })
+		if len(due) > maxExpiringLots {
+			due = due[:maxExpiringLots]
+		}
+
+		balance := balanceItem.nums["balance"]
+		left := balance
+		var expired int64
+		removed := make(map[key]bool)
+		var writes []write
+		for _, lot := range due {
+			points := lot.nums["points"]
+			active -= points
+			if take := min(points, left-active); take > 0 {
+				left -= take
+				expired += take
+			}
+			entry := s.expiryKey(userID, lot.sk, lot.nums["due"])
+			removed[entry] = true
+			writes = append(writes,
+				write{item: item{key: lot.key}, kind: deleteWrite},
+				write{item: item{key: entry}, kind: deleteWrite})
+		}
+		for _, entry := range entries {
+			if !removed[entry] && len(writes) < maxTransactItems-1 {
+				removed[entry] = true
+				writes = append(writes, write{item: item{key: entry}, kind: deleteWrite})
+			}
+		}
+		if expired > 0 {
+			writes = append(writes, write{
+				item: item{key: s.userBalanceKey(userID), nums: map[string]int64{"balance": -expired, "expired": expired}},
+				cond: cond{nums: map[string]int64{"balance": balance}},
+			})
+		}
+		if len(writes) == 0 {
+			return 0, nil
+		}
+		err = s.table.transact(ctx, writes)
+		if _, failed := failedWrite(err); failed {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		return int(expired), nil
+	}
+	return 0, errContention("expiring points")
+}
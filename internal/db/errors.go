@@ -0,0 +1,37 @@
+package db
+
+import "errors"
+
+var (
+	// ErrNotFound is returned when reading, updating or deleting something that doesn't
+	// exist
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidCursor is returned for list cursors the store didn't hand out
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrUnavailable marks errors from the store not answering: connection failures,
+	// timeouts, an open circuit breaker. Trying again later may work, unlike with any
+	// other store error.
+	ErrUnavailable = errors.New("store unavailable")
+)
+
+// unavailableError is an error from the store not answering. errors.Is finds both
+// ErrUnavailable and whatever it wraps, e.g. breaker.ErrOpen.
+type unavailableError struct {
+	err error
+}
+
+func (e unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e unavailableError) Unwrap() []error {
+	return []error{ErrUnavailable, e.err}
+}
+
+// Unavailable marks err as the store not answering, nil stays nil
+func Unavailable(err error) error {
+	if err == nil || errors.Is(err, ErrUnavailable) {
+		return err
+	}
+	return unavailableError{err: err}
+}
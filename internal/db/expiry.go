@@ -0,0 +1,165 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// pointsExpiryKey indexes every user's expiring points by when they expire, as
+// "<userID>:<receiptID>" (user ids can't contain ':'), so the sweeper can find what's
+// due without walking every user
+const pointsExpiryKey = "points:expiry"
+
+// design decision: expiring points are kept per user in "lots", one per receipt: a zset
+// of receipt ids by expiry and a hash with each receipt's points. the record itself may
+// be gone (Redis TTL) long before its points expire, so the lots can't rely on it
+func (rs *RedisStore) userLotsKey(userID string) string {
+	return rs.key(userKeyPrefix + userID + ":lots")
+}
+
+func (rs *RedisStore) userLotPointsKey(userID string) string {
+	return rs.key(userKeyPrefix + userID + ":lotpoints")
+}
+
+func (rs *RedisStore) userExpiredKey(userID string) string {
+	return rs.key(userKeyPrefix + userID + ":expired")
+}
+
+func expiryMember(userID, receiptID string) string {
+	return userID + ":" + receiptID
+}
+
+// credits a receipt's points can take, see creditKind
+const (
+	creditBalance = "balance"
+	creditExpired = "expired"
+	creditLot     = "lot"
+)
+
+// creditKind is how a receipt's points are credited: to the balance for points that
+// never expire, to the expired total for points that already did (an old purchase
+// date), and to the balance and a lot for points that will
+func creditKind(rec ReceiptRecord, now time.Time) string {
+	switch {
+	case rec.PointsExpireAt == nil:
+		return creditBalance
+	case !rec.PointsExpireAt.After(now):
+		return creditExpired
+	default:
+		return creditLot
+	}
+}
+
+// queueCredit adds a receipt's points to its user, as creditKind has it
+func (rs *RedisStore) queueCredit(ctx context.Context, pipe redis.Pipeliner, rec ReceiptRecord, now time.Time) {
+	switch creditKind(rec, now) {
+	case creditBalance:
+		pipe.IncrBy(ctx, rs.userBalanceKey(rec.UserID), int64(rec.Points))
+	case creditExpired:
+		pipe.IncrBy(ctx, rs.userExpiredKey(rec.UserID), int64(rec.Points))
+	case creditLot:
+		score := float64(rec.PointsExpireAt.Unix())
+		pipe.IncrBy(ctx, rs.userBalanceKey(rec.UserID), int64(rec.Points))
+		pipe.ZAdd(ctx, rs.userLotsKey(rec.UserID), redis.Z{Score: score, Member: rec.ID})
+		pipe.HSet(ctx, rs.userLotPointsKey(rec.UserID), rec.ID, rec.Points)
+		pipe.ZAdd(ctx, rs.key(pointsExpiryKey), redis.Z{Score: score, Member: expiryMember(rec.UserID, rec.ID)})
+	}
+}
+
+// creditDelta is what a change in a receipt's points moves its user's balance by.
+// Expired points stay expired. a sweep landing between the caller's read and the write
+// can still see the old points, the difference is at most one rescore
+func creditDelta(rec ReceiptRecord, delta int, now time.Time) int {
+	if rec.UserID == "" || rec.Status != "" || (rec.PointsExpireAt != nil && !rec.PointsExpireAt.After(now)) {
+		return 0
+	}
+	return delta
+}
+
+// expireScript expires a user's lots that are due, oldest first. Redemptions are
+// taken from the oldest points, so a lot only loses what the balance holds beyond the
+// younger lots. points that never expire count as spent first.
+// KEYS: balance, expired total, lots, lot points, expiry index
+// ARGV: now (unix seconds), user id
+var expireScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1])
+if #due == 0 then
+	return 0
+end
+local active = 0
+for _, id in ipairs(redis.call('ZRANGE', KEYS[3], 0, -1)) do
+	active = active + tonumber(redis.call('HGET', KEYS[4], id) or '0')
+end
+local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+local expired = 0
+for _, id in ipairs(due) do
+	local points = tonumber(redis.call('HGET', KEYS[4], id) or '0')
+	active = active - points
+	local left = math.min(points, balance - active)
+	if left > 0 then
+		balance = balance - left
+		expired = expired + left
+	end
+	redis.call('ZREM', KEYS[3], id)
+	redis.call('HDEL', KEYS[4], id)
+	redis.call('ZREM', KEYS[5], ARGV[2] .. ':' .. id)
+end
+if expired > 0 then
+	redis.call('DECRBY', KEYS[1], expired)
+	redis.call('INCRBY', KEYS[2], expired)
+end
+return expired
+`)
+
+// ExpirySweep is what one ExpirePoints call did
+type ExpirySweep struct {
+	Users  int
+	Points int
+	// true when more lots were due than the call looked at
+	More bool
+}
+
+// ExpirePoints expires the points of up to limit lots that are due by now. It's safe to
+// run from several instances at once, every user is expired in one script.
+func (rs *RedisStore) ExpirePoints(ctx context.Context, now time.Time, limit int) (ExpirySweep, error) {
+	var members []string
+	err := rs.withRetry(ctx, "finding expiring points", func(ctx context.Context) error {
+		var err error
+		members, err = rs.client.ZRangeByScore(ctx, rs.key(pointsExpiryKey), &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   fmt.Sprint(now.Unix()),
+			Count: int64(limit),
+		}).Result()
+		return err
+	})
+	if err != nil {
+		return ExpirySweep{}, fmt.Errorf("Error finding expiring points: %w", err)
+	}
+
+	sweep := ExpirySweep{More: len(members) == limit}
+	seen := make(map[string]bool)
+	for _, member := range members {
+		userID, _, ok := strings.Cut(member, ":")
+		if !ok || seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		keys := []string{rs.userBalanceKey(userID), rs.userExpiredKey(userID), rs.userLotsKey(userID), rs.userLotPointsKey(userID), rs.key(pointsExpiryKey)}
+		var expired int
+		err := rs.withWriteSlot(ctx, "expiring points", func(ctx context.Context) error {
+			var err error
+			expired, err = expireScript.Run(ctx, rs.client, keys, now.Unix(), userID).Int()
+			return err
+		})
+		if err != nil {
+			return sweep, fmt.Errorf("Error expiring points of user %s: %w", userID, err)
+		}
+		sweep.Users++
+		sweep.Points += expired
+	}
+	return sweep, nil
+}
@@ -0,0 +1,140 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+func (s *Store) AddWebhook(ctx context.Context, url string) error {
+	d, err := s.call(ctx, "AddWebhook")
+	if err != nil {
+		return fmt.Errorf("Error registering webhook: %w", err)
+	}
+	defer s.mu.Unlock()
+	d.webhooks[url] = true
+	return nil
+}
+
+func (s *Store) RemoveWebhook(ctx context.Context, url string) error {
+	d, err := s.call(ctx, "RemoveWebhook")
+	if err != nil {
+		return fmt.Errorf("Error removing webhook: %w", err)
+	}
+	defer s.mu.Unlock()
+	delete(d.webhooks, url)
+	return nil
+}
+
+func (s *Store) ListWebhooks(ctx context.Context) ([]string, error) {
+	d, err := s.call(ctx, "ListWebhooks")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing webhooks: %w", err)
+	}
+	defer s.mu.Unlock()
+	var urls []string
+	for url := range d.webhooks {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
+
+func (s *Store) SaveCampaign(ctx context.Context, c db.Campaign) error {
+	d, err := s.call(ctx, "SaveCampaign")
+	if err != nil {
+		return fmt.Errorf("Error saving campaign: %w", err)
+	}
+	defer s.mu.Unlock()
+	d.campaigns[c.ID] = copyCampaign(c)
+	return nil
+}
+
+// copyCampaign keeps callers from sharing a category with the store
+func copyCampaign(c db.Campaign) db.Campaign {
+	if c.Category != nil {
+		category := *c.Category
+		category.Keywords = append([]string(nil), category.Keywords...)
+		c.Category = &category
+	}
+	return c
+}
+
+func (s *Store) DeleteCampaign(ctx context.Context, id string) error {
+	d, err := s.call(ctx, "DeleteCampaign")
+	if err != nil {
+		return fmt.Errorf("Error deleting campaign: %w", err)
+	}
+	defer s.mu.Unlock()
+	if _, ok := d.campaigns[id]; !ok {
+		return fmt.Errorf("Error deleting campaign %s: %w", id, db.ErrNotFound)
+	}
+	delete(d.campaigns, id)
+	return nil
+}
+
+// ListCampaigns returns every campaign ordered by start date, then id
+func (s *Store) ListCampaigns(ctx context.Context) ([]db.Campaign, error) {
+	d, err := s.call(ctx, "ListCampaigns")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing campaigns: %w", err)
+	}
+	defer s.mu.Unlock()
+	campaigns := make([]db.Campaign, 0, len(d.campaigns))
+	for _, c := range d.campaigns {
+		campaigns = append(campaigns, copyCampaign(c))
+	}
+	sort.Slice(campaigns, func(i, j int) bool {
+		if campaigns[i].StartDate != campaigns[j].StartDate {
+			return campaigns[i].StartDate < campaigns[j].StartDate
+		}
+		return campaigns[i].ID < campaigns[j].ID
+	})
+	return campaigns, nil
+}
+
+func (s *Store) SaveRetailer(ctx context.Context, r db.Retailer) error {
+	d, err := s.call(ctx, "SaveRetailer")
+	if err != nil {
+		return fmt.Errorf("Error saving retailer: %w", err)
+	}
+	defer s.mu.Unlock()
+	d.registry[r.ID] = copyRetailer(r)
+	return nil
+}
+
+func copyRetailer(r db.Retailer) db.Retailer {
+	r.Aliases = append([]string(nil), r.Aliases...)
+	r.Patterns = append([]string(nil), r.Patterns...)
+	return r
+}
+
+func (s *Store) DeleteRetailer(ctx context.Context, id string) error {
+	d, err := s.call(ctx, "DeleteRetailer")
+	if err != nil {
+		return fmt.Errorf("Error deleting retailer: %w", err)
+	}
+	defer s.mu.Unlock()
+	if _, ok := d.registry[id]; !ok {
+		return fmt.Errorf("Error deleting retailer %s: %w", id, db.ErrNotFound)
+	}
+	delete(d.registry, id)
+	return nil
+}
+
+// ListRetailers returns the whole registry ordered by id
+func (s *Store) ListRetailers(ctx context.Context) ([]db.Retailer, error) {
+	d, err := s.call(ctx, "ListRetailers")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing retailers: %w", err)
+	}
+	defer s.mu.Unlock()
+	retailers := make([]db.Retailer, 0, len(d.registry))
+	for _, r := range d.registry {
+		retailers = append(retailers, copyRetailer(r))
+	}
+	sort.Slice(retailers, func(i, j int) bool { return retailers[i].ID < retailers[j].ID })
+	return retailers, nil
+}
@@ -0,0 +1,226 @@
+// Package fake is an in-memory db.Store for tests. It behaves like RedisStore as far
+// as callers can tell (tenant scoping, TTLs, balances, expiring points, the review
+// queue, analytics) without a Redis, and can be made slow or failing on purpose:
+//
+//	store := fake.New(fake.WithTTL(10*time.Minute), fake.WithClock(frozen))
+//	store.SetLatency(50 * time.Millisecond)
+//	store.Fail(breaker.ErrOpen, "GetReceipt")
+//
+// It's safe for concurrent use.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/clock"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// Store is the fake. Views returned by ForTenant share their parent's data, latency and
+// faults.
+type Store struct {
+	*shared
+	// "" for the default tenant
+	tenant string
+}
+
+var _ db.Store = (*Store)(nil)
+
+// shared is everything the tenant views have in common, guarded by mu
+type shared struct {
+	mu        sync.Mutex
+	clock     clock.Clock
+	ttl       time.Duration
+	retention map[string]time.Duration
+	latency   time.Duration
+	fault     Fault
+	calls     map[string]int
+	tenants   map[string]*tenantData
+}
+
+// Fault decides whether a call fails: it gets the name of the Store method being
+// called and returns the error that call should fail with, nil to let it through
+type Fault func(method string) error
+
+// Option configures a Store
+type Option func(*shared)
+
+// WithClock sets the clock TTLs and fingerprint windows go by, the real one by default.
+// A clock.Frozen makes expiry something a test can step through.
+func WithClock(c clock.Clock) Option {
+	return func(s *shared) { s.clock = c }
+}
+
+// WithTTL expires receipts ttl after they're saved, like REDIS_TTL_IN_S. 0 (the
+// default) keeps them forever.
+func WithTTL(ttl time.Duration) Option {
+	return func(s *shared) { s.ttl = ttl }
+}
+
+// WithRetention gives receipts saved with a retention class that class's TTL instead,
+// like RECEIPT_RETENTION_IN_S
+func WithRetention(ttls map[string]time.Duration) Option {
+	return func(s *shared) { s.retention = ttls }
+}
+
+// WithLatency delays every call by d, see SetLatency
+func WithLatency(d time.Duration) Option {
+	return func(s *shared) { s.latency = d }
+}
+
+func New(opts ...Option) *Store {
+	s := &shared{
+		clock:   clock.Real,
+		calls:   make(map[string]int),
+		tenants: make(map[string]*tenantData),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return &Store{shared: s}
+}
+
+// SetLatency delays every call by d. A call whose context ends first fails with the
+// context's error, the way a Redis command would time out.
+func (s *Store) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// SetFault replaces the fault deciding which calls fail, nil makes every call succeed
+// again
+func (s *Store) SetFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fault = f
+}
+
+// Fail makes every call to the named methods fail with err, every method when none are
+// named. Fail(nil) clears it.
+func (s *Store) Fail(err error, methods ...string) {
+	if err == nil {
+		s.SetFault(nil)
+		return
+	}
+	names := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		names[m] = true
+	}
+	s.SetFault(func(method string) error {
+		if len(names) == 0 || names[method] {
+			return err
+		}
+		return nil
+	})
+}
+
+// FailNext makes the next n calls to the named methods (any method when none are
+// named) fail with err, and lets the ones after through
+func (s *Store) FailNext(n int, err error, methods ...string) {
+	names := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		names[m] = true
+	}
+	// called with mu held, n needs no lock of its own
+	s.SetFault(func(method string) error {
+		if n == 0 || (len(names) > 0 && !names[method]) {
+			return nil
+		}
+		n--
+		return err
+	})
+}
+
+// Calls is how many times the method was called, failed calls included, across every
+// tenant
+func (s *Store) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
+
+// call is the start of every method: it counts the call, waits out the latency and
+// applies the fault. On success it returns with mu held and the tenant's data.
+func (s *Store) call(ctx context.Context, method string) (*tenantData, error) {
+	s.mu.Lock()
+	s.calls[method]++
+	latency, fault := s.latency, s.fault
+	var err error
+	if fault != nil {
+		err = fault(method)
+	}
+	s.mu.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("Error in %s: %w", method, ctx.Err())
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error in %s: %w", method, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("Error in %s: %w", method, err)
+	}
+	s.mu.Lock()
+	return s.data(), nil
+}
+
+// data is the tenant's data, created on first use. mu must be held.
+func (s *Store) data() *tenantData {
+	d, ok := s.tenants[s.tenant]
+	if !ok {
+		d = newTenantData()
+		s.tenants[s.tenant] = d
+	}
+	return d
+}
+
+func (s *Store) now() time.Time {
+	return s.clock.Now()
+}
+
+// expiry is when something saved now with ttl expires, zero for never
+func (s *Store) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return s.now().Add(ttl)
+}
+
+func expired(expireAt, now time.Time) bool {
+	return !expireAt.IsZero() && !now.Before(expireAt)
+}
+
+// ForTenant returns a view of the store holding only the tenant's data, like
+// RedisStore.ForTenant
+func (s *Store) ForTenant(tenantID string) db.Store {
+	if tenantID == "" {
+		return &Store{shared: s.shared}
+	}
+	return &Store{shared: s.shared, tenant: tenantID}
+}
+
+// prefix is what the tenant's keys start with in Redis, for ScanKeys
+func (s *Store) prefix() string {
+	if s.tenant == "" {
+		return ""
+	}
+	return "tenant:" + s.tenant + ":"
+}
+
+func (s *Store) CheckConnection(ctx context.Context) error {
+	if _, err := s.call(ctx, "CheckConnection"); err != nil {
+		return err
+	}
+	s.mu.Unlock()
+	return nil
+}
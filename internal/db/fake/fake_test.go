@@ -0,0 +1,23 @@
+package fake_test
+
+import (
+	"testing"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/fake"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/storetest"
+	"github.com/jayreddy040-510/receipt_processor/internal/testutil"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// TestMatchesRedisStore runs the same calls against the fake and a RedisStore on
+// miniredis and expects the same answers from both
+func TestMatchesRedisStore(t *testing.T) {
+	cfg := testutil.Config(t, miniredis.RunT(t).Addr(), map[string]string{"REDIS_TTL_IN_S": "0"})
+	redisStore := db.NewRedisStore(cfg)
+	t.Cleanup(func() { redisStore.Close() })
+
+	want := storetest.Script(t, redisStore)
+	storetest.Compare(t, storetest.Script(t, fake.New()), want)
+}
@@ -0,0 +1,120 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// ListUsers pages through the users by id, the cursor is the last id of the previous
+// page
+func (s *Store) ListUsers(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	d, err := s.call(ctx, "ListUsers")
+	if err != nil {
+		return nil, "", fmt.Errorf("Error listing users: %w", err)
+	}
+	defer s.mu.Unlock()
+	var ids []string
+	for id := range d.users {
+		if id > cursor {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if limit <= 0 || len(ids) <= limit {
+		return ids, "", nil
+	}
+	ids = ids[:limit]
+	return ids, ids[len(ids)-1], nil
+}
+
+// GetUserAccount copies out the user's points. Unknown users have an empty account.
+func (s *Store) GetUserAccount(ctx context.Context, userID string) (db.UserAccount, error) {
+	d, err := s.call(ctx, "GetUserAccount")
+	if err != nil {
+		return db.UserAccount{}, fmt.Errorf("Error reading user account: %w", err)
+	}
+	defer s.mu.Unlock()
+	acct := db.UserAccount{UserID: userID}
+	u, ok := d.users[userID]
+	if !ok {
+		return acct, nil
+	}
+	acct.Balance, acct.Expired = u.balance, u.expired
+	for id, l := range u.lots {
+		// Redis keeps when lots expire to the second
+		acct.Lots = append(acct.Lots, db.PointsLot{ReceiptID: id, Points: l.points, ExpireAt: l.expireAt.Truncate(time.Second).UTC()})
+	}
+	for _, red := range u.redemptions {
+		acct.Redemptions = append(acct.Redemptions, red)
+	}
+	for _, adj := range u.adjustments {
+		acct.Adjustments = append(acct.Adjustments, adj)
+	}
+	db.SortAccount(&acct)
+	return acct, nil
+}
+
+// PutUserAccount replaces the user's balances and lots with acct's and adds its
+// redemptions and adjustments to the ledgers, like RedisStore
+func (s *Store) PutUserAccount(ctx context.Context, acct db.UserAccount) error {
+	d, err := s.call(ctx, "PutUserAccount")
+	if err != nil {
+		return fmt.Errorf("Error writing user account: %w", err)
+	}
+	defer s.mu.Unlock()
+	u := d.user(acct.UserID)
+	u.balance, u.expired = acct.Balance, acct.Expired
+	u.lots = make(map[string]lot, len(acct.Lots))
+	for _, l := range acct.Lots {
+		u.lots[l.ReceiptID] = lot{points: l.Points, expireAt: l.ExpireAt}
+	}
+	for _, red := range acct.Redemptions {
+		u.redemptions[red.ID] = red
+	}
+	for _, adj := range acct.Adjustments {
+		u.adjustments[adj.ID] = adj
+	}
+	return nil
+}
+
+// RestoreReceipts writes copied records without crediting their users or counting them
+// in the analytics, keeping the TTL they have left at now, like RedisStore
+func (s *Store) RestoreReceipts(ctx context.Context, recs []db.ReceiptRecord, now time.Time) error {
+	for _, rec := range recs {
+		if _, err := time.Parse("2006-01-02", rec.PurchaseDate); err != nil {
+			return fmt.Errorf("Error parsing date for index: %v", err)
+		}
+	}
+	d, err := s.call(ctx, "RestoreReceipts")
+	if err != nil {
+		return fmt.Errorf("Error restoring receipts in database: %w", err)
+	}
+	defer s.mu.Unlock()
+	for _, rec := range recs {
+		ttl, ok := s.retention[rec.Retention]
+		if !ok || rec.Retention == "" {
+			ttl = s.ttl
+		}
+		ttl = db.RemainingTTL(ttl, rec.CreatedAt, now)
+		if ttl < 0 {
+			continue
+		}
+		var expireAt time.Time
+		if ttl > 0 {
+			expireAt = now.Add(ttl)
+		}
+		d.receipts[rec.ID] = storedReceipt{rec: copyRecord(rec), expireAt: expireAt}
+		d.indexed[rec.ID] = true
+		if rec.Status == db.ReceiptFlagged {
+			d.review[rec.ID] = rec.CreatedAt
+		}
+		if rec.UserID != "" {
+			d.user(rec.UserID).receipts[rec.ID] = rec.CreatedAt
+		}
+	}
+	return nil
+}
@@ -0,0 +1,445 @@
+package fake
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// tenantData is one tenant's share of the store
+type tenantData struct {
+	receipts map[string]storedReceipt
+	// ids in the listing indexes. like in Redis entries outlive their receipt's TTL
+	// until a listing or PruneIndexes notices
+	indexed map[string]bool
+	// flagged receipt ids by when they were submitted
+	review map[string]time.Time
+
+	users        map[string]*user
+	fingerprints map[string]expiring
+	locks        map[string]expiring
+	submissions  map[string]map[string]time.Time
+	usage        map[string]counter
+
+	receiptCount  int
+	scoredPoints  int
+	awardedPoints int
+	days          map[string]db.DayAnalytics
+	retailers     map[string]int
+
+	webhooks  map[string]bool
+	campaigns map[string]db.Campaign
+	// the retailer registry, retailers above are the analytics counts
+	registry map[string]db.Retailer
+
+	// soft deleted receipts, DeletedAt is always set
+	tombstones map[string]db.ReceiptRecord
+}
+
+func newTenantData() *tenantData {
+	return &tenantData{
+		receipts:     make(map[string]storedReceipt),
+		indexed:      make(map[string]bool),
+		review:       make(map[string]time.Time),
+		users:        make(map[string]*user),
+		fingerprints: make(map[string]expiring),
+		locks:        make(map[string]expiring),
+		submissions:  make(map[string]map[string]time.Time),
+		usage:        make(map[string]counter),
+		days:         make(map[string]db.DayAnalytics),
+		retailers:    make(map[string]int),
+		webhooks:     make(map[string]bool),
+		campaigns:    make(map[string]db.Campaign),
+		registry:     make(map[string]db.Retailer),
+		tombstones:   make(map[string]db.ReceiptRecord),
+	}
+}
+
+type storedReceipt struct {
+	rec      db.ReceiptRecord
+	expireAt time.Time
+}
+
+// receipt is the live record with the id, ok is false for unknown and expired ones
+func (d *tenantData) receipt(id string, now time.Time) (db.ReceiptRecord, bool) {
+	stored, ok := d.receipts[id]
+	if !ok {
+		return db.ReceiptRecord{}, false
+	}
+	if expired(stored.expireAt, now) {
+		delete(d.receipts, id)
+		return db.ReceiptRecord{}, false
+	}
+	return copyRecord(stored.rec), true
+}
+
+func (s *Store) SaveReceipt(ctx context.Context, rec db.ReceiptRecord) error {
+	return s.saveReceipts(ctx, "SaveReceipt", []db.ReceiptRecord{rec})
+}
+
+// SaveReceipts saves the batch all or nothing, a record with an invalid purchase date
+// fails the whole batch like it does in Redis
+func (s *Store) SaveReceipts(ctx context.Context, recs []db.ReceiptRecord) error {
+	return s.saveReceipts(ctx, "SaveReceipts", recs)
+}
+
+func (s *Store) saveReceipts(ctx context.Context, method string, recs []db.ReceiptRecord) error {
+	for _, rec := range recs {
+		if _, err := time.Parse("2006-01-02", rec.PurchaseDate); err != nil {
+			return fmt.Errorf("Error parsing date for index: %v", err)
+		}
+	}
+	d, err := s.call(ctx, method)
+	if err != nil {
+		return fmt.Errorf("Error saving receipts in database: %w", err)
+	}
+	defer s.mu.Unlock()
+	for _, rec := range recs {
+		ttl, ok := s.retention[rec.Retention]
+		if !ok || rec.Retention == "" {
+			ttl = s.ttl
+		}
+		d.receipts[rec.ID] = storedReceipt{rec: copyRecord(rec), expireAt: s.expiry(ttl)}
+		d.indexed[rec.ID] = true
+		if rec.Status == db.ReceiptFlagged {
+			d.review[rec.ID] = rec.CreatedAt
+		}
+		d.count(rec)
+		if rec.UserID != "" {
+			u := d.user(rec.UserID)
+			if rec.Status == "" {
+				u.credit(rec, rec.CreatedAt)
+			}
+			u.receipts[rec.ID] = rec.CreatedAt
+		}
+	}
+	return nil
+}
+
+// UpdateReceipts overwrites the records that still exist, keeping their TTL, and moves
+// balances and analytics by the change in points
+func (s *Store) UpdateReceipts(ctx context.Context, updates []db.ReceiptUpdate) error {
+	d, err := s.call(ctx, "UpdateReceipts")
+	if err != nil {
+		return fmt.Errorf("Error updating receipts in database: %w", err)
+	}
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, u := range updates {
+		if _, ok := d.receipt(u.Record.ID, now); ok {
+			stored := d.receipts[u.Record.ID]
+			stored.rec = copyRecord(u.Record)
+			d.receipts[u.Record.ID] = stored
+			// listings sort the records themselves, only the retailer counts need moving
+			if from, to, moved := u.AnalyticsRetailerMove(); moved {
+				if d.retailers[from]--; d.retailers[from] <= 0 {
+					delete(d.retailers, from)
+				}
+				d.retailers[to]++
+			}
+		}
+		delta := u.Record.Points - u.OldPoints
+		d.scoredPoints += delta
+		if u.Record.Status == "" {
+			d.awardedPoints += delta
+		}
+		if u.Record.UserID != "" && u.Record.Status == "" && delta != 0 {
+			d.user(u.Record.UserID).creditChange(u.Record, delta, now)
+		}
+	}
+	return nil
+}
+
+// GetReceipt fails with db.ErrNotFound for unknown and expired ids
+func (s *Store) GetReceipt(ctx context.Context, id string) (db.ReceiptRecord, error) {
+	d, err := s.call(ctx, "GetReceipt")
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error getting key from database: %w", err)
+	}
+	defer s.mu.Unlock()
+	rec, ok := d.receipt(id, s.now())
+	if !ok {
+		return db.ReceiptRecord{}, fmt.Errorf("Key does not exist in database: %w", db.ErrNotFound)
+	}
+	return rec, nil
+}
+
+// GetReceipts returns the live records in the order of ids, leaving out the rest
+func (s *Store) GetReceipts(ctx context.Context, ids []string) ([]db.ReceiptRecord, error) {
+	d, err := s.call(ctx, "GetReceipts")
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching receipts from database: %w", err)
+	}
+	defer s.mu.Unlock()
+	return d.liveReceipts(ids, s.now()), nil
+}
+
+func (d *tenantData) liveReceipts(ids []string, now time.Time) []db.ReceiptRecord {
+	records := make([]db.ReceiptRecord, 0, len(ids))
+	for _, id := range ids {
+		if rec, ok := d.receipt(id, now); ok {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// DeleteReceipt removes the receipt and every index entry it has, balances stay
+func (s *Store) DeleteReceipt(ctx context.Context, id string) error {
+	d, err := s.call(ctx, "DeleteReceipt")
+	if err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	rec, ok := d.receipt(id, s.now())
+	if !ok {
+		return fmt.Errorf("Error deleting receipt %s: %w", id, db.ErrNotFound)
+	}
+	d.remove(rec)
+	return nil
+}
+
+// remove drops the record and every index entry it has
+func (d *tenantData) remove(rec db.ReceiptRecord) {
+	delete(d.receipts, rec.ID)
+	delete(d.indexed, rec.ID)
+	delete(d.review, rec.ID)
+	if u, ok := d.users[rec.UserID]; ok {
+		delete(u.receipts, rec.ID)
+	}
+}
+
+// listEntry is an index entry being listed, its score in the index that's walked
+type listEntry struct {
+	rec   db.ReceiptRecord
+	score float64
+}
+
+func listScore(rec db.ReceiptRecord, byPurchaseDate bool) float64 {
+	if !byPurchaseDate {
+		return float64(rec.CreatedAt.UnixMicro())
+	}
+	t, _ := time.Parse("2006-01-02", rec.PurchaseDate)
+	return float64(t.Year()*10000 + int(t.Month())*100 + t.Day())
+}
+
+// ListReceipts pages newest first by creation time, or by purchase date when the filter
+// has dates or a canonical retailer and no retailer, the order RedisStore's indexes give. Cursors only work
+// with the fake that handed them out.
+func (s *Store) ListReceipts(ctx context.Context, filter db.ListFilter) ([]db.ReceiptRecord, string, error) {
+	var after *listEntry
+	if filter.Cursor != "" {
+		var err error
+		if after, err = decodeCursor(filter.Cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	for _, date := range []string{filter.FromDate, filter.ToDate} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			return nil, "", fmt.Errorf("Error parsing date for index: %v", err)
+		}
+	}
+	d, err := s.call(ctx, "ListReceipts")
+	if err != nil {
+		return nil, "", fmt.Errorf("Error reading receipt index: %w", err)
+	}
+	defer s.mu.Unlock()
+
+	byPurchaseDate := filter.Retailer == "" && (filter.CanonicalRetailer != "" || filter.FromDate != "" || filter.ToDate != "")
+	now := s.now()
+	var entries []listEntry
+	for id := range d.indexed {
+		rec, ok := d.receipt(id, now)
+		if !ok {
+			delete(d.indexed, id)
+			continue
+		}
+		entries = append(entries, listEntry{rec: rec, score: listScore(rec, byPurchaseDate)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].score != entries[j].score {
+			return entries[i].score > entries[j].score
+		}
+		return entries[i].rec.ID > entries[j].rec.ID
+	})
+
+	var results []db.ReceiptRecord
+	for _, entry := range entries {
+		if len(results) == filter.Limit {
+			break
+		}
+		if after != nil && (entry.score > after.score || entry.score == after.score && entry.rec.ID >= after.rec.ID) {
+			continue
+		}
+		if !matches(filter, entry.rec) {
+			continue
+		}
+		results = append(results, entry.rec)
+		if len(results) == filter.Limit {
+			return results, encodeCursor(entry), nil
+		}
+	}
+	return results, "", nil
+}
+
+func matches(f db.ListFilter, rec db.ReceiptRecord) bool {
+	if f.Retailer != "" && db.NormalizeRetailer(rec.Retailer) != db.NormalizeRetailer(f.Retailer) {
+		return false
+	}
+	if f.CanonicalRetailer != "" && rec.AnalyticsRetailer() != f.CanonicalRetailer {
+		return false
+	}
+	if f.FromDate != "" && rec.PurchaseDate < f.FromDate {
+		return false
+	}
+	if f.ToDate != "" && rec.PurchaseDate > f.ToDate {
+		return false
+	}
+	if f.MinPoints != nil && rec.Points < *f.MinPoints {
+		return false
+	}
+	if f.MaxPoints != nil && rec.Points > *f.MaxPoints {
+		return false
+	}
+	return true
+}
+
+func encodeCursor(entry listEntry) string {
+	raw := strconv.FormatFloat(entry.score, 'f', -1, 64) + " " + entry.rec.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (*listEntry, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", db.ErrInvalidCursor, err)
+	}
+	scoreText, id, ok := strings.Cut(string(raw), " ")
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", db.ErrInvalidCursor, raw)
+	}
+	score, err := strconv.ParseFloat(scoreText, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", db.ErrInvalidCursor, err)
+	}
+	return &listEntry{rec: db.ReceiptRecord{ID: id}, score: score}, nil
+}
+
+// ScanKeys pages through the names the tenant's data would have in Redis (receipts,
+// user balances, campaigns, retailers and webhooks), sorted, with the cursor as an offset
+func (s *Store) ScanKeys(ctx context.Context, prefix string, cursor uint64, count int64) ([]string, uint64, error) {
+	d, err := s.call(ctx, "ScanKeys")
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error scanning keys: %w", err)
+	}
+	defer s.mu.Unlock()
+	var keys []string
+	for _, key := range d.keys(s.now()) {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, s.prefix()+key)
+		}
+	}
+	sort.Strings(keys)
+	if count <= 0 {
+		count = 10
+	}
+	start := min(int(cursor), len(keys))
+	end := min(start+int(count), len(keys))
+	next := uint64(end)
+	if end == len(keys) {
+		next = 0
+	}
+	return keys[start:end], next, nil
+}
+
+func (d *tenantData) keys(now time.Time) []string {
+	var keys []string
+	for id := range d.receipts {
+		if _, ok := d.receipt(id, now); ok {
+			keys = append(keys, "receipt:"+id)
+		}
+	}
+	for id := range d.tombstones {
+		keys = append(keys, "tombstone:"+id)
+	}
+	for id := range d.users {
+		keys = append(keys, "user:"+id+":balance")
+	}
+	if len(d.campaigns) > 0 {
+		keys = append(keys, "campaigns")
+	}
+	if len(d.registry) > 0 {
+		keys = append(keys, "retailers")
+	}
+	if len(d.webhooks) > 0 {
+		keys = append(keys, "webhooks")
+	}
+	return keys
+}
+
+// Stats counts what ScanKeys would list, memory use is always 0
+func (s *Store) Stats(ctx context.Context) (db.StoreStats, error) {
+	d, err := s.call(ctx, "Stats")
+	if err != nil {
+		return db.StoreStats{}, fmt.Errorf("Error reading store stats: %w", err)
+	}
+	defer s.mu.Unlock()
+	stats := db.StoreStats{
+		Keys:            int64(len(d.keys(s.now()))),
+		IndexedReceipts: int64(len(d.indexed)),
+		FlaggedReceipts: int64(len(d.review)),
+	}
+	for _, u := range d.users {
+		stats.ExpiringLots += int64(len(u.lots))
+	}
+	return stats, nil
+}
+
+// PruneIndexes drops index and review queue entries whose receipt expired
+func (s *Store) PruneIndexes(ctx context.Context, progress func(checked int)) (int, error) {
+	d, err := s.call(ctx, "PruneIndexes")
+	if err != nil {
+		return 0, fmt.Errorf("Error reading index: %w", err)
+	}
+	defer s.mu.Unlock()
+	now := s.now()
+	var checked, removed int
+	for id := range d.indexed {
+		checked++
+		if _, ok := d.receipt(id, now); !ok {
+			delete(d.indexed, id)
+			removed++
+		}
+	}
+	progress(checked)
+	for id := range d.review {
+		checked++
+		if _, ok := d.receipt(id, now); !ok {
+			delete(d.review, id)
+			removed++
+		}
+	}
+	progress(checked)
+	return removed, nil
+}
+
+// copyRecord round trips a record through JSON the way Redis does, so neither side of
+// a save or a read shares the other's slices (and times lose their monotonic reading)
+func copyRecord(rec db.ReceiptRecord) db.ReceiptRecord {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return rec
+	}
+	var copied db.ReceiptRecord
+	if err := json.Unmarshal(b, &copied); err != nil {
+		return rec
+	}
+	return copied
+}
@@ -0,0 +1,99 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// SoftDeleteReceipt moves the receipt to a tombstone, out of every lookup and listing,
+// balances stay. db.ErrNotFound for unknown, expired and already deleted ids.
+func (s *Store) SoftDeleteReceipt(ctx context.Context, id string, at time.Time) (db.ReceiptRecord, error) {
+	d, err := s.call(ctx, "SoftDeleteReceipt")
+	if err != nil {
+		return db.ReceiptRecord{}, err
+	}
+	defer s.mu.Unlock()
+	rec, ok := d.receipt(id, s.now())
+	if !ok {
+		return db.ReceiptRecord{}, fmt.Errorf("Error deleting receipt %s: %w", id, db.ErrNotFound)
+	}
+	d.remove(rec)
+	deletedAt := at.UTC()
+	rec.DeletedAt = &deletedAt
+	d.tombstones[id] = copyRecord(rec)
+	return rec, nil
+}
+
+// GetTombstone fails with db.ErrNotFound for receipts that weren't soft deleted or have
+// been purged
+func (s *Store) GetTombstone(ctx context.Context, id string) (db.ReceiptRecord, error) {
+	d, err := s.call(ctx, "GetTombstone")
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error getting key from database: %w", err)
+	}
+	defer s.mu.Unlock()
+	rec, ok := d.tombstones[id]
+	if !ok {
+		return db.ReceiptRecord{}, fmt.Errorf("Key does not exist in database: %w", db.ErrNotFound)
+	}
+	return copyRecord(rec), nil
+}
+
+// PurgeReceipts hard deletes tombstones deleted before deletedBefore, then receipts
+// created before createdBefore, oldest first and up to limit in all, like RedisStore
+func (s *Store) PurgeReceipts(ctx context.Context, createdBefore, deletedBefore time.Time, limit int) (db.RetentionSweep, error) {
+	d, err := s.call(ctx, "PurgeReceipts")
+	if err != nil {
+		return db.RetentionSweep{}, fmt.Errorf("Error purging receipts: %w", err)
+	}
+	defer s.mu.Unlock()
+	var sweep db.RetentionSweep
+	if !deletedBefore.IsZero() {
+		var due []db.ReceiptRecord
+		for _, rec := range d.tombstones {
+			if rec.DeletedAt.Before(deletedBefore) {
+				due = append(due, rec)
+			}
+		}
+		due = oldestFirst(due, func(rec db.ReceiptRecord) time.Time { return *rec.DeletedAt }, limit)
+		sweep.More = len(due) == limit
+		for _, rec := range due {
+			delete(d.tombstones, rec.ID)
+			sweep.Purged = append(sweep.Purged, rec)
+		}
+	}
+	if createdBefore.IsZero() || len(sweep.Purged) >= limit {
+		return sweep, nil
+	}
+	left := limit - len(sweep.Purged)
+	now := s.now()
+	var due []db.ReceiptRecord
+	for id := range d.receipts {
+		if rec, ok := d.receipt(id, now); ok && rec.CreatedAt.Before(createdBefore) {
+			due = append(due, rec)
+		}
+	}
+	due = oldestFirst(due, func(rec db.ReceiptRecord) time.Time { return rec.CreatedAt }, left)
+	sweep.More = sweep.More || len(due) == left
+	for _, rec := range due {
+		d.remove(rec)
+		sweep.Purged = append(sweep.Purged, rec)
+	}
+	return sweep, nil
+}
+
+// oldestFirst sorts recs by when, ties by id like a Redis sorted set, and keeps the
+// first limit
+func oldestFirst(recs []db.ReceiptRecord, when func(db.ReceiptRecord) time.Time, limit int) []db.ReceiptRecord {
+	sort.Slice(recs, func(i, j int) bool {
+		if ti, tj := when(recs[i]), when(recs[j]); !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return recs[i].ID < recs[j].ID
+	})
+	return recs[:min(limit, len(recs))]
+}
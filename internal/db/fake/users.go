@@ -0,0 +1,536 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// user is a user's balance, history, expiring points, redemption and adjustment ledgers
+type user struct {
+	balance int
+	expired int
+	// receipt ids by when they were created
+	receipts map[string]time.Time
+	// expiring points by receipt id
+	lots        map[string]lot
+	redemptions map[string]db.Redemption
+	adjustments map[string]db.Adjustment
+}
+
+type lot struct {
+	points   int
+	expireAt time.Time
+}
+
+func (d *tenantData) user(userID string) *user {
+	u, ok := d.users[userID]
+	if !ok {
+		u = &user{
+			receipts:    make(map[string]time.Time),
+			lots:        make(map[string]lot),
+			redemptions: make(map[string]db.Redemption),
+			adjustments: make(map[string]db.Adjustment),
+		}
+		d.users[userID] = u
+	}
+	return u
+}
+
+// credit is RedisStore's queueCredit: points that already expired go straight to the
+// expired total, expiring ones become a lot
+func (u *user) credit(rec db.ReceiptRecord, now time.Time) {
+	switch {
+	case rec.PointsExpireAt == nil:
+		u.balance += rec.Points
+	case !rec.PointsExpireAt.After(now):
+		u.expired += rec.Points
+	default:
+		u.balance += rec.Points
+		u.lots[rec.ID] = lot{points: rec.Points, expireAt: *rec.PointsExpireAt}
+	}
+}
+
+// creditChange is RedisStore's creditDelta
+func (u *user) creditChange(rec db.ReceiptRecord, delta int, now time.Time) {
+	if rec.PointsExpireAt != nil && !rec.PointsExpireAt.After(now) {
+		return
+	}
+	u.balance += delta
+	if l, ok := u.lots[rec.ID]; ok {
+		l.points += delta
+		u.lots[rec.ID] = l
+	}
+}
+
+// newest sorts ids by their time, newest first, ties by id like ZREVRANGE, and keeps
+// up to limit of them (all of them for 0)
+func newest(times map[string]time.Time, limit int) []string {
+	ids := make([]string, 0, len(times))
+	for id := range times {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if !times[ids[i]].Equal(times[ids[j]]) {
+			return times[ids[i]].After(times[ids[j]])
+		}
+		return ids[i] > ids[j]
+	})
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids
+}
+
+// GetUserPoints returns the balance and up to historyLimit of the user's receipts that
+// haven't expired, newest first
+func (s *Store) GetUserPoints(ctx context.Context, userID string, historyLimit int) (db.UserPoints, error) {
+	d, err := s.call(ctx, "GetUserPoints")
+	if err != nil {
+		return db.UserPoints{}, fmt.Errorf("Error reading user points: %w", err)
+	}
+	defer s.mu.Unlock()
+	points := db.UserPoints{UserID: userID, Receipts: []db.ReceiptRecord{}}
+	u, ok := d.users[userID]
+	if !ok {
+		return points, nil
+	}
+	points.Balance, points.Expired = u.balance, u.expired
+	now := s.now()
+	for _, id := range newest(u.receipts, historyLimit) {
+		rec, ok := d.receipt(id, now)
+		if !ok {
+			delete(u.receipts, id)
+			continue
+		}
+		points.Receipts = append(points.Receipts, rec)
+	}
+	return points, nil
+}
+
+// Redeem follows RedisStore.Redeem: replays of a redemption id return the original,
+// db.ErrRedemptionConflict when they differ, db.ErrInsufficientPoints when the balance
+// is short
+func (s *Store) Redeem(ctx context.Context, red db.Redemption) (db.Redemption, bool, error) {
+	d, err := s.call(ctx, "Redeem")
+	if err != nil {
+		return db.Redemption{}, false, fmt.Errorf("Error redeeming points: %w", err)
+	}
+	defer s.mu.Unlock()
+	u := d.user(red.UserID)
+	if existing, ok := u.redemptions[red.ID]; ok {
+		if existing.Points != red.Points || existing.Reward != red.Reward {
+			return db.Redemption{}, false, fmt.Errorf("Error redeeming %s: %w", red.ID, db.ErrRedemptionConflict)
+		}
+		return existing, false, nil
+	}
+	if u.balance < red.Points {
+		return db.Redemption{}, false, fmt.Errorf("Error redeeming %d points with a balance of %d: %w", red.Points, u.balance, db.ErrInsufficientPoints)
+	}
+	u.balance -= red.Points
+	red.BalanceAfter = u.balance
+	// stored the way Redis would hand it back, decoded from JSON
+	red.CreatedAt = copyRecord(db.ReceiptRecord{CreatedAt: red.CreatedAt}).CreatedAt
+	u.redemptions[red.ID] = red
+	return red, true, nil
+}
+
+// ListRedemptions returns up to limit of the user's latest redemptions, newest first
+func (s *Store) ListRedemptions(ctx context.Context, userID string, limit int) ([]db.Redemption, error) {
+	d, err := s.call(ctx, "ListRedemptions")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing redemptions: %w", err)
+	}
+	defer s.mu.Unlock()
+	redemptions := []db.Redemption{}
+	u, ok := d.users[userID]
+	if !ok {
+		return redemptions, nil
+	}
+	times := make(map[string]time.Time, len(u.redemptions))
+	for id, red := range u.redemptions {
+		times[id] = red.CreatedAt
+	}
+	for _, id := range newest(times, limit) {
+		redemptions = append(redemptions, u.redemptions[id])
+	}
+	return redemptions, nil
+}
+
+// Adjust follows RedisStore.Adjust: replays of an adjustment id return the original,
+// db.ErrAdjustmentConflict when they differ, db.ErrInsufficientPoints when a clawback
+// is more than the balance, db.ErrTooManyAdjustments and db.ErrReceiptOverdrawn when
+// the receipt as stored can't take it, db.ErrNotFound without the receipt
+func (s *Store) Adjust(ctx context.Context, adj db.Adjustment) (db.Adjustment, bool, error) {
+	d, err := s.call(ctx, "Adjust")
+	if err != nil {
+		return db.Adjustment{}, false, fmt.Errorf("Error adjusting points: %w", err)
+	}
+	defer s.mu.Unlock()
+	u := d.user(adj.UserID)
+	if existing, ok := u.adjustments[adj.ID]; ok {
+		if existing.Points != adj.Points || existing.ReceiptID != adj.ReceiptID || existing.Reason != adj.Reason {
+			return db.Adjustment{}, false, fmt.Errorf("Error adjusting %s: %w", adj.ID, db.ErrAdjustmentConflict)
+		}
+		return existing, false, nil
+	}
+	if adj.ReceiptID != "" {
+		rec, ok := d.receipt(adj.ReceiptID, s.now())
+		if !ok {
+			return db.Adjustment{}, false, fmt.Errorf("Error adjusting receipt %s: %w", adj.ReceiptID, db.ErrNotFound)
+		}
+		count, total := 0, rec.Points
+		for _, other := range u.adjustments {
+			if other.ReceiptID == adj.ReceiptID {
+				count++
+				total += other.Points
+			}
+		}
+		if count >= db.MaxReceiptAdjustments {
+			return db.Adjustment{}, false, fmt.Errorf("Error adjusting receipt %s with %d adjustments: %w", adj.ReceiptID, count, db.ErrTooManyAdjustments)
+		}
+		if total+adj.Points < 0 {
+			return db.Adjustment{}, false, fmt.Errorf("Error adjusting receipt %s by %d points with %d left: %w", adj.ReceiptID, adj.Points, total, db.ErrReceiptOverdrawn)
+		}
+	}
+	if u.balance+adj.Points < 0 {
+		return db.Adjustment{}, false, fmt.Errorf("Error adjusting by %d points with a balance of %d: %w", adj.Points, u.balance, db.ErrInsufficientPoints)
+	}
+	u.balance += adj.Points
+	adj.BalanceAfter = u.balance
+	// stored the way Redis would hand it back, decoded from JSON
+	adj.CreatedAt = copyRecord(db.ReceiptRecord{CreatedAt: adj.CreatedAt}).CreatedAt
+	u.adjustments[adj.ID] = adj
+	return adj, true, nil
+}
+
+// ListAdjustments returns up to limit of the user's latest adjustments, newest first,
+// only the ones of receiptID unless that's empty
+func (s *Store) ListAdjustments(ctx context.Context, userID, receiptID string, limit int) ([]db.Adjustment, error) {
+	d, err := s.call(ctx, "ListAdjustments")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing adjustments: %w", err)
+	}
+	defer s.mu.Unlock()
+	adjustments := []db.Adjustment{}
+	u, ok := d.users[userID]
+	if !ok {
+		return adjustments, nil
+	}
+	times := make(map[string]time.Time, len(u.adjustments))
+	for id, adj := range u.adjustments {
+		if receiptID == "" || adj.ReceiptID == receiptID {
+			times[id] = adj.CreatedAt
+		}
+	}
+	for _, id := range newest(times, limit) {
+		adjustments = append(adjustments, u.adjustments[id])
+	}
+	return adjustments, nil
+}
+
+// ExpirePoints expires the points of up to limit lots due by now, like RedisStore's
+// expire script: a user's due lots go oldest first and only lose what the balance holds
+// beyond their younger lots
+func (s *Store) ExpirePoints(ctx context.Context, now time.Time, limit int) (db.ExpirySweep, error) {
+	d, err := s.call(ctx, "ExpirePoints")
+	if err != nil {
+		return db.ExpirySweep{}, fmt.Errorf("Error finding expiring points: %w", err)
+	}
+	defer s.mu.Unlock()
+
+	type dueLot struct {
+		userID   string
+		expireAt time.Time
+	}
+	var due []dueLot
+	for userID, u := range d.users {
+		for _, l := range u.lots {
+			if !l.expireAt.After(now) {
+				due = append(due, dueLot{userID: userID, expireAt: l.expireAt})
+			}
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].expireAt.Before(due[j].expireAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	sweep := db.ExpirySweep{More: len(due) == limit}
+	seen := make(map[string]bool)
+	for _, lot := range due {
+		if seen[lot.userID] {
+			continue
+		}
+		seen[lot.userID] = true
+		sweep.Users++
+		sweep.Points += d.users[lot.userID].expire(now)
+	}
+	return sweep, nil
+}
+
+// expire expires the user's lots that are due and returns how many points that took
+func (u *user) expire(now time.Time) int {
+	var active int
+	var due []string
+	for id, l := range u.lots {
+		active += l.points
+		if !l.expireAt.After(now) {
+			due = append(due, id)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !u.lots[due[i]].expireAt.Equal(u.lots[due[j]].expireAt) {
+			return u.lots[due[i]].expireAt.Before(u.lots[due[j]].expireAt)
+		}
+		return due[i] < due[j]
+	})
+	var expired int
+	for _, id := range due {
+		points := u.lots[id].points
+		active -= points
+		if left := min(points, u.balance-active); left > 0 {
+			u.balance -= left
+			expired += left
+		}
+		delete(u.lots, id)
+	}
+	u.expired += expired
+	return expired
+}
+
+// expiring is a value with a TTL
+type expiring struct {
+	value    string
+	expireAt time.Time
+}
+
+// ClaimFingerprint returns the id holding the fingerprint, "" when id got it (or
+// already had it)
+func (s *Store) ClaimFingerprint(ctx context.Context, fingerprint, id string, window time.Duration) (string, error) {
+	d, err := s.call(ctx, "ClaimFingerprint")
+	if err != nil {
+		return "", fmt.Errorf("Error claiming receipt fingerprint: %w", err)
+	}
+	defer s.mu.Unlock()
+	if held, ok := d.fingerprints[fingerprint]; ok && !expired(held.expireAt, s.now()) {
+		if held.value == id {
+			return "", nil
+		}
+		return held.value, nil
+	}
+	d.fingerprints[fingerprint] = expiring{value: id, expireAt: s.expiry(window)}
+	return "", nil
+}
+
+func (s *Store) ReleaseFingerprint(ctx context.Context, fingerprint, id string) error {
+	d, err := s.call(ctx, "ReleaseFingerprint")
+	if err != nil {
+		return fmt.Errorf("Error releasing receipt fingerprint: %w", err)
+	}
+	defer s.mu.Unlock()
+	if held, ok := d.fingerprints[fingerprint]; ok && held.value == id {
+		delete(d.fingerprints, fingerprint)
+	}
+	return nil
+}
+
+// LockSubmission returns the id holding the lock, "" when id got it (or already had
+// it)
+func (s *Store) LockSubmission(ctx context.Context, hash, id string, ttl time.Duration) (string, error) {
+	d, err := s.call(ctx, "LockSubmission")
+	if err != nil {
+		return "", fmt.Errorf("Error locking submission: %w", err)
+	}
+	defer s.mu.Unlock()
+	if held, ok := d.locks[hash]; ok && !expired(held.expireAt, s.now()) {
+		if held.value == id {
+			return "", nil
+		}
+		return held.value, nil
+	}
+	d.locks[hash] = expiring{value: id, expireAt: s.expiry(ttl)}
+	return "", nil
+}
+
+func (s *Store) UnlockSubmission(ctx context.Context, hash, id string) error {
+	d, err := s.call(ctx, "UnlockSubmission")
+	if err != nil {
+		return fmt.Errorf("Error unlocking submission: %w", err)
+	}
+	defer s.mu.Unlock()
+	if held, ok := d.locks[hash]; ok && held.value == id {
+		delete(d.locks, hash)
+	}
+	return nil
+}
+
+// CountSubmission records the submission and counts the user's submissions in the
+// window up to now, this one included
+func (s *Store) CountSubmission(ctx context.Context, userID, id string, now time.Time, window time.Duration) (int, error) {
+	d, err := s.call(ctx, "CountSubmission")
+	if err != nil {
+		return 0, fmt.Errorf("Error counting user submissions: %w", err)
+	}
+	defer s.mu.Unlock()
+	submissions, ok := d.submissions[userID]
+	if !ok {
+		submissions = make(map[string]time.Time)
+		d.submissions[userID] = submissions
+	}
+	for submitted, at := range submissions {
+		if !at.After(now.Add(-window)) {
+			delete(submissions, submitted)
+		}
+	}
+	submissions[id] = now
+	return len(submissions), nil
+}
+
+// ListFlagged returns up to limit receipts waiting for review, oldest first
+func (s *Store) ListFlagged(ctx context.Context, limit int) ([]db.ReceiptRecord, error) {
+	d, err := s.call(ctx, "ListFlagged")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing flagged receipts: %w", err)
+	}
+	defer s.mu.Unlock()
+	ids := newest(d.review, 0)
+	// oldest first
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	records := []db.ReceiptRecord{}
+	now := s.now()
+	for _, id := range ids {
+		rec, ok := d.receipt(id, now)
+		if !ok {
+			delete(d.review, id)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// ResolveFlagged approves or rejects a flagged receipt, db.ErrNotFound when it isn't
+// waiting for review
+func (s *Store) ResolveFlagged(ctx context.Context, id string, approve bool) (db.ReceiptRecord, error) {
+	d, err := s.call(ctx, "ResolveFlagged")
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error resolving flagged receipt %s: %w", id, err)
+	}
+	defer s.mu.Unlock()
+	if _, ok := d.review[id]; !ok {
+		return db.ReceiptRecord{}, fmt.Errorf("Error resolving flagged receipt %s: %w", id, db.ErrNotFound)
+	}
+	delete(d.review, id)
+	now := s.now()
+	rec, ok := d.receipt(id, now)
+	if !ok {
+		return db.ReceiptRecord{}, fmt.Errorf("Error resolving flagged receipt %s: %w", id, db.ErrNotFound)
+	}
+	rec.Status = db.ReceiptRejected
+	if approve {
+		rec.Status = ""
+		d.awardedPoints += rec.Points
+		if rec.UserID != "" {
+			d.user(rec.UserID).credit(rec, now)
+		}
+	}
+	stored := d.receipts[id]
+	stored.rec = copyRecord(rec)
+	d.receipts[id] = stored
+	return rec, nil
+}
+
+// counter is a usage counter with a TTL from when it was created
+type counter struct {
+	value    int
+	expireAt time.Time
+}
+
+func (s *Store) AddUsage(ctx context.Context, name string, n int, ttl time.Duration) (int, error) {
+	d, err := s.call(ctx, "AddUsage")
+	if err != nil {
+		return 0, fmt.Errorf("Error counting usage: %w", err)
+	}
+	defer s.mu.Unlock()
+	c, ok := d.usage[name]
+	if !ok || expired(c.expireAt, s.now()) {
+		c = counter{expireAt: s.expiry(ttl)}
+	}
+	c.value += n
+	d.usage[name] = c
+	return c.value, nil
+}
+
+func (s *Store) GetUsage(ctx context.Context, names []string) (map[string]int, error) {
+	d, err := s.call(ctx, "GetUsage")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading usage: %w", err)
+	}
+	defer s.mu.Unlock()
+	usage := make(map[string]int, len(names))
+	for _, name := range names {
+		if c, ok := d.usage[name]; ok && !expired(c.expireAt, s.now()) {
+			usage[name] = c.value
+		}
+	}
+	return usage, nil
+}
+
+// count adds a newly saved receipt to the analytics
+func (d *tenantData) count(rec db.ReceiptRecord) {
+	d.receiptCount++
+	d.scoredPoints += rec.Points
+	if rec.Status == "" {
+		d.awardedPoints += rec.Points
+	}
+	date := rec.CreatedAt.UTC().Format("2006-01-02")
+	day := d.days[date]
+	day.Date = date
+	day.Receipts++
+	day.Points += rec.Points
+	d.days[date] = day
+	d.retailers[rec.AnalyticsRetailer()]++
+}
+
+func (s *Store) GetAnalytics(ctx context.Context, days []string, topRetailers int) (db.Analytics, error) {
+	d, err := s.call(ctx, "GetAnalytics")
+	if err != nil {
+		return db.Analytics{}, fmt.Errorf("Error reading analytics: %w", err)
+	}
+	defer s.mu.Unlock()
+	analytics := db.Analytics{
+		Receipts:      d.receiptCount,
+		ScoredPoints:  d.scoredPoints,
+		PointsAwarded: d.awardedPoints,
+		Days:          make([]db.DayAnalytics, len(days)),
+		TopRetailers:  []db.RetailerAnalytics{},
+	}
+	for i, date := range days {
+		analytics.Days[i] = d.days[date]
+		analytics.Days[i].Date = date
+	}
+	for retailer, receipts := range d.retailers {
+		analytics.TopRetailers = append(analytics.TopRetailers, db.RetailerAnalytics{Retailer: retailer, Receipts: receipts})
+	}
+	// most receipts first, ties in reverse name order like ZREVRANGE
+	sort.Slice(analytics.TopRetailers, func(i, j int) bool {
+		a, b := analytics.TopRetailers[i], analytics.TopRetailers[j]
+		if a.Receipts != b.Receipts {
+			return a.Receipts > b.Receipts
+		}
+		return a.Retailer > b.Retailer
+	})
+	if len(analytics.TopRetailers) > topRetailers {
+		analytics.TopRetailers = analytics.TopRetailers[:topRetailers]
+	}
+	return analytics, nil
+}
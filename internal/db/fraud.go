@@ -0,0 +1,287 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// receipt statuses, see ReceiptRecord.Status
+const (
+	ReceiptFlagged  = "flagged"
+	ReceiptRejected = "rejected"
+)
+
+const (
+	// flagged receipts waiting for a decision, by when they were submitted
+	reviewQueueKey       = "receipts:review"
+	fingerprintKeyPrefix = "fraud:fingerprint:"
+	// shared Bloom filters of claimed fingerprints, see FingerprintFilterStore
+	fingerprintFilterKeyPrefix = "fraud:bloom:"
+	velocityKeyPrefix          = "fraud:velocity:"
+)
+
+// releaseHeldScript deletes a fingerprint (or a lock) only if it's still held by the
+// receipt releasing it
+var releaseHeldScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// ClaimFingerprint marks id as the receipt with the given fingerprint for window. It
+// returns the id of the receipt that already holds the fingerprint, or "" when id is
+// the first.
+func (rs *RedisStore) ClaimFingerprint(ctx context.Context, fingerprint, id string, window time.Duration) (string, error) {
+	key := rs.key(fingerprintKeyPrefix + fingerprint)
+	var holder string
+	err := rs.withWriteSlot(ctx, "claiming receipt fingerprint", func(ctx context.Context) error {
+		claimed, err := rs.client.SetNX(ctx, key, id, window).Result()
+		if err != nil || claimed {
+			holder = ""
+			return err
+		}
+		holder, err = rs.client.Get(ctx, key).Result()
+		// expired between the two calls, nobody holds it anymore
+		if err == redis.Nil {
+			holder = ""
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error claiming receipt fingerprint: %w", err)
+	}
+	// a retried claim can find its own earlier attempt
+	if holder == id {
+		return "", nil
+	}
+	return holder, nil
+}
+
+// ReleaseFingerprint gives up id's claim on a fingerprint, e.g. when the receipt
+// couldn't be saved after all
+func (rs *RedisStore) ReleaseFingerprint(ctx context.Context, fingerprint, id string) error {
+	err := rs.withWriteSlot(ctx, "releasing receipt fingerprint", func(ctx context.Context) error {
+		return releaseHeldScript.Run(ctx, rs.client, []string{rs.key(fingerprintKeyPrefix + fingerprint)}, id).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("Error releasing receipt fingerprint: %w", err)
+	}
+	return nil
+}
+
+// FingerprintClaim is a fingerprint claim an instance made on its own, on the word of
+// its Bloom filter that nobody holds the fingerprint, for ClaimFingerprints to record
+type FingerprintClaim struct {
+	Fingerprint string
+	ID          string
+	// the shared filter the fingerprint went into and the bits it set there
+	Filter string
+	Bits   []uint64
+}
+
+// FingerprintFilterStore is implemented by stores that can share Bloom filters of
+// claimed fingerprints between instances, so most claims can be made without a round
+// trip and recorded in batches. Only RedisStore does.
+type FingerprintFilterStore interface {
+	// ClaimFingerprints records each claim the way ClaimFingerprint would and sets its
+	// bits in its filter, which then lives for filterTTL. It returns the claims that lost
+	// to a receipt already holding the fingerprint: receipt id -> the holder's.
+	ClaimFingerprints(ctx context.Context, claims []FingerprintClaim, window, filterTTL time.Duration) (map[string]string, error)
+	// FingerprintFilter is the bits of a shared filter, nil before anyone set one
+	FingerprintFilter(ctx context.Context, filter string) ([]byte, error)
+}
+
+// ClaimFingerprints is one pipeline however many claims there are, plus one more to
+// look up the holders when some lost
+func (rs *RedisStore) ClaimFingerprints(ctx context.Context, claims []FingerprintClaim, window, filterTTL time.Duration) (map[string]string, error) {
+	lost := make(map[string]string)
+	err := rs.withWriteSlot(ctx, "claiming receipt fingerprints", func(ctx context.Context) error {
+		claimed := make([]*redis.BoolCmd, len(claims))
+		_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			filters := make(map[string]bool)
+			for i, claim := range claims {
+				claimed[i] = pipe.SetNX(ctx, rs.key(fingerprintKeyPrefix+claim.Fingerprint), claim.ID, window)
+				filter := rs.key(fingerprintFilterKeyPrefix + claim.Filter)
+				for _, bit := range claim.Bits {
+					// Pipeliner has no SetBit in this go-redis version
+					pipe.Do(ctx, "SETBIT", filter, bit, 1)
+				}
+				filters[filter] = true
+			}
+			for filter := range filters {
+				pipe.PExpire(ctx, filter, filterTTL)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		var losers []FingerprintClaim
+		for i, claim := range claims {
+			if !claimed[i].Val() {
+				losers = append(losers, claim)
+			}
+		}
+		if len(losers) == 0 {
+			return nil
+		}
+		holders := make([]*redis.StringCmd, len(losers))
+		rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, claim := range losers {
+				holders[i] = pipe.Get(ctx, rs.key(fingerprintKeyPrefix+claim.Fingerprint))
+			}
+			return nil
+		})
+		for i, claim := range losers {
+			holder, err := holders[i].Result()
+			// expired since, nobody holds it anymore
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			// a retried batch can find its own earlier attempt
+			if holder != claim.ID {
+				lost[claim.ID] = holder
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error claiming receipt fingerprints: %w", err)
+	}
+	return lost, nil
+}
+
+func (rs *RedisStore) FingerprintFilter(ctx context.Context, filter string) ([]byte, error) {
+	var bits []byte
+	err := rs.withRetry(ctx, "reading fingerprint filter", func(ctx context.Context) error {
+		var err error
+		bits, err = rs.client.Get(ctx, rs.key(fingerprintFilterKeyPrefix+filter)).Bytes()
+		if err == redis.Nil {
+			bits, err = nil, nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error reading fingerprint filter: %w", err)
+	}
+	return bits, nil
+}
+
+// CountSubmission records that the user submitted receipt id at now and returns how
+// many receipts they submitted within the window up to now, this one included
+func (rs *RedisStore) CountSubmission(ctx context.Context, userID, id string, now time.Time, window time.Duration) (int, error) {
+	key := rs.key(velocityKeyPrefix + userID)
+	var count int64
+	err := rs.withWriteSlot(ctx, "counting user submissions", func(ctx context.Context) error {
+		var countCmd *redis.IntCmd
+		_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprint(now.Add(-window).UnixMicro()))
+			pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.UnixMicro()), Member: id})
+			countCmd = pipe.ZCard(ctx, key)
+			pipe.PExpire(ctx, key, window)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		count = countCmd.Val()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error counting user submissions: %w", err)
+	}
+	return int(count), nil
+}
+
+// ListFlagged returns up to limit receipts waiting for review, oldest first
+func (rs *RedisStore) ListFlagged(ctx context.Context, limit int) ([]ReceiptRecord, error) {
+	var ids []string
+	err := rs.withRetry(ctx, "listing flagged receipts", func(ctx context.Context) error {
+		var err error
+		ids, err = rs.client.ZRange(ctx, rs.key(reviewQueueKey), 0, int64(limit)-1).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing flagged receipts: %w", err)
+	}
+	records, missing, err := rs.getReceipts(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	// nothing left to decide on for receipts that expired while waiting
+	if len(missing) > 0 {
+		if err := rs.client.ZRem(ctx, rs.key(reviewQueueKey), missing...).Err(); err != nil {
+			logging.Printf(ctx, "Error removing expired receipts from the review queue: %v", err)
+		}
+	}
+	if records == nil {
+		records = []ReceiptRecord{}
+	}
+	return records, nil
+}
+
+// ResolveFlagged settles a flagged receipt. Approving awards its points to its user,
+// rejecting keeps them withheld for good. Either way it leaves the review queue.
+// ErrNotFound when the receipt isn't waiting for review (anymore).
+func (rs *RedisStore) ResolveFlagged(ctx context.Context, id string, approve bool) (ReceiptRecord, error) {
+	var resolved ReceiptRecord
+	// design decision: WATCH the queue entry so two reviewers deciding at once can't
+	// both award the points. the loser's retry finds the entry gone
+	err := rs.withWriteSlot(ctx, "resolving flagged receipt", func(ctx context.Context) error {
+		return rs.client.Watch(ctx, func(tx *redis.Tx) error {
+			if err := tx.ZScore(ctx, rs.key(reviewQueueKey), id).Err(); err != nil {
+				if err == redis.Nil {
+					return ErrNotFound
+				}
+				return err
+			}
+			value, err := tx.Get(ctx, rs.receiptKey(id)).Bytes()
+			if err == redis.Nil {
+				tx.ZRem(ctx, rs.key(reviewQueueKey), id)
+				return ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+			var rec ReceiptRecord
+			if err := json.Unmarshal(value, &rec); err != nil {
+				return fmt.Errorf("Error decoding receipt record: %v", err)
+			}
+			rec.Status = ReceiptRejected
+			if approve {
+				rec.Status = ""
+			}
+			if value, err = json.Marshal(rec); err != nil {
+				return fmt.Errorf("Error encoding receipt record: %v", err)
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SetArgs(ctx, rs.receiptKey(id), value, redis.SetArgs{KeepTTL: true})
+				pipe.ZRem(ctx, rs.key(reviewQueueKey), id)
+				if approve {
+					rs.queueAnalyticsChange(ctx, pipe, 0, rec.Points)
+				}
+				if approve && rec.UserID != "" {
+					rs.queueCredit(ctx, pipe, rec, time.Now())
+				}
+				return nil
+			})
+			resolved = rec
+			return err
+		}, rs.key(reviewQueueKey), rs.receiptKey(id))
+	})
+	if err != nil {
+		return ReceiptRecord{}, fmt.Errorf("Error resolving flagged receipt %s: %w", id, err)
+	}
+	return resolved, nil
+}
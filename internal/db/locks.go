@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const submissionLockKeyPrefix = "lock:submission:"
+
+// lockScript is SET NX PX that answers with the holder when the key is taken, so the
+// answer can't be about a lock that expired in between
+// KEYS: lock
+// ARGV: id, ttl (ms)
+var lockScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return ''
+end
+return redis.call('GET', KEYS[1])
+`)
+
+// LockSubmission locks a submission's content hash for receipt id for ttl. It returns
+// the id of the receipt already holding the lock, "" when id got it (or already had
+// it).
+func (rs *RedisStore) LockSubmission(ctx context.Context, hash, id string, ttl time.Duration) (string, error) {
+	var holder string
+	err := rs.withWriteSlot(ctx, "locking submission", func(ctx context.Context) error {
+		var err error
+		holder, err = lockScript.Run(ctx, rs.client, []string{rs.key(submissionLockKeyPrefix + hash)}, id, ttl.Milliseconds()).Text()
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error locking submission: %w", err)
+	}
+	// a retried lock can find its own earlier attempt
+	if holder == id {
+		return "", nil
+	}
+	return holder, nil
+}
+
+// UnlockSubmission gives up id's lock, a lock someone else holds stays
+func (rs *RedisStore) UnlockSubmission(ctx context.Context, hash, id string) error {
+	err := rs.withWriteSlot(ctx, "unlocking submission", func(ctx context.Context) error {
+		return releaseHeldScript.Run(ctx, rs.client, []string{rs.key(submissionLockKeyPrefix + hash)}, id).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("Error unlocking submission: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// UserAccount is everything a store keeps about a user's points, in a form every
+// backend reads and writes the same way. Migrations copy users with it.
+type UserAccount struct {
+	UserID  string `json:"userId"`
+	Balance int    `json:"balance"`
+	Expired int    `json:"expired"`
+	// points that are still to expire, soonest first
+	Lots []PointsLot `json:"lots,omitempty"`
+	// the whole ledgers, oldest first
+	Redemptions []Redemption `json:"redemptions,omitempty"`
+	Adjustments []Adjustment `json:"adjustments,omitempty"`
+}
+
+// PointsLot is the points a receipt credited that expire at ExpireAt (to the second)
+type PointsLot struct {
+	ReceiptID string    `json:"receiptId"`
+	Points    int       `json:"points"`
+	ExpireAt  time.Time `json:"expireAt"`
+}
+
+// SortAccount puts lots and ledgers in the order UserAccount promises, for
+// backends that don't read them in that order
+func SortAccount(acct *UserAccount) {
+	sort.Slice(acct.Lots, func(i, j int) bool {
+		a, b := acct.Lots[i], acct.Lots[j]
+		if !a.ExpireAt.Equal(b.ExpireAt) {
+			return a.ExpireAt.Before(b.ExpireAt)
+		}
+		return a.ReceiptID < b.ReceiptID
+	})
+	sort.Slice(acct.Redemptions, func(i, j int) bool {
+		a, b := acct.Redemptions[i], acct.Redemptions[j]
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	})
+	sort.Slice(acct.Adjustments, func(i, j int) bool {
+		a, b := acct.Adjustments[i], acct.Adjustments[j]
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	})
+}
+
+// RemainingTTL is what's left of ttl at now for a receipt created at createdAt. 0 for
+// receipts that don't expire, negative for ones that have expired or are about to,
+// within the second.
+func RemainingTTL(ttl time.Duration, createdAt, now time.Time) time.Duration {
+	if ttl <= 0 {
+		return 0
+	}
+	left := createdAt.Add(ttl).Sub(now)
+	if left < time.Second {
+		return -1
+	}
+	return left
+}
+
+// ListUsers pages through the ids of users that have any points data, in no
+// particular order. limit is a hint, a page can have more or fewer ids and ids can
+// come up on more than one page. "" for the next cursor means that was the last page.
+func (rs *RedisStore) ListUsers(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	var from uint64
+	if cursor != "" {
+		var err error
+		if from, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("Error listing users: %w", ErrInvalidCursor)
+		}
+	}
+	keys, next, err := rs.ScanKeys(ctx, userKeyPrefix, from, int64(limit))
+	if err != nil {
+		return nil, "", fmt.Errorf("Error listing users: %w", err)
+	}
+	seen := make(map[string]bool)
+	var ids []string
+	for _, key := range keys {
+		// user ids can't contain ':', everything after the first one is the key's kind
+		userID, _, _ := strings.Cut(strings.TrimPrefix(key, rs.key(userKeyPrefix)), ":")
+		if userID != "" && !seen[userID] {
+			seen[userID] = true
+			ids = append(ids, userID)
+		}
+	}
+	if next == 0 {
+		return ids, "", nil
+	}
+	return ids, strconv.FormatUint(next, 10), nil
+}
+
+// GetUserAccount reads everything about a user's points. Unknown users have an empty
+// account.
+func (rs *RedisStore) GetUserAccount(ctx context.Context, userID string) (UserAccount, error) {
+	acct := UserAccount{UserID: userID}
+	var (
+		lots       []redis.Z
+		lotPoints  map[string]string
+		redemption []string
+		adjustment []string
+	)
+	err := rs.withRetry(ctx, "reading user account", func(ctx context.Context) error {
+		var balanceCmd, expiredCmd *redis.StringCmd
+		var lotsCmd *redis.ZSliceCmd
+		var lotPointsCmd *redis.MapStringStringCmd
+		var redemptionsCmd, adjustmentsCmd *redis.StringSliceCmd
+		_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			balanceCmd = pipe.Get(ctx, rs.userBalanceKey(userID))
+			expiredCmd = pipe.Get(ctx, rs.userExpiredKey(userID))
+			lotsCmd = pipe.ZRangeWithScores(ctx, rs.userLotsKey(userID), 0, -1)
+			lotPointsCmd = pipe.HGetAll(ctx, rs.userLotPointsKey(userID))
+			redemptionsCmd = pipe.ZRange(ctx, rs.userRedemptionsKey(userID), 0, -1)
+			adjustmentsCmd = pipe.ZRange(ctx, rs.userAdjustmentsKey(userID), 0, -1)
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if acct.Balance, err = balanceCmd.Int(); err != nil && err != redis.Nil {
+			return err
+		}
+		if acct.Expired, err = expiredCmd.Int(); err != nil && err != redis.Nil {
+			return err
+		}
+		if lots, err = lotsCmd.Result(); err != nil {
+			return err
+		}
+		if lotPoints, err = lotPointsCmd.Result(); err != nil {
+			return err
+		}
+		if redemption, err = redemptionsCmd.Result(); err != nil {
+			return err
+		}
+		adjustment, err = adjustmentsCmd.Result()
+		return err
+	})
+	if err != nil {
+		return UserAccount{}, fmt.Errorf("Error reading user account: %w", err)
+	}
+	for _, z := range lots {
+		receiptID, _ := z.Member.(string)
+		points, _ := strconv.Atoi(lotPoints[receiptID])
+		acct.Lots = append(acct.Lots, PointsLot{ReceiptID: receiptID, Points: points, ExpireAt: time.Unix(int64(z.Score), 0).UTC()})
+	}
+	if len(redemption) > 0 {
+		keys := make([]string, len(redemption))
+		for i, id := range redemption {
+			keys[i] = rs.redemptionKey(userID, id)
+		}
+		values, err := rs.GetMany(ctx, keys)
+		if err != nil {
+			return UserAccount{}, fmt.Errorf("Error reading user account: %w", err)
+		}
+		for i, value := range values {
+			s, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var red Redemption
+			if err := json.Unmarshal([]byte(s), &red); err != nil {
+				return UserAccount{}, fmt.Errorf("Error decoding redemption %s of user %s: %v", redemption[i], userID, err)
+			}
+			acct.Redemptions = append(acct.Redemptions, red)
+		}
+	}
+	if len(adjustment) > 0 {
+		adjustments, err := rs.getAdjustments(ctx, userID, adjustment)
+		if err != nil {
+			return UserAccount{}, fmt.Errorf("Error reading user account: %w", err)
+		}
+		acct.Adjustments = adjustments
+	}
+	SortAccount(&acct)
+	return acct, nil
+}
+
+// PutUserAccount makes the user's points what acct says, in one MULTI: balance, expired
+// total and lots are replaced, redemptions and adjustments are written on top of the
+// ledgers there are.
+// The user's receipt history isn't touched, it comes with the receipts.
+func (rs *RedisStore) PutUserAccount(ctx context.Context, acct UserAccount) error {
+	userID := acct.UserID
+	var old []string
+	err := rs.withRetry(ctx, "reading user lots", func(ctx context.Context) error {
+		var err error
+		old, err = rs.client.ZRange(ctx, rs.userLotsKey(userID), 0, -1).Result()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing user account: %w", err)
+	}
+	redemptions := make([][]byte, len(acct.Redemptions))
+	for i, red := range acct.Redemptions {
+		if redemptions[i], err = json.Marshal(red); err != nil {
+			return fmt.Errorf("Error encoding redemption: %v", err)
+		}
+	}
+	adjustments := make([][]byte, len(acct.Adjustments))
+	for i, adj := range acct.Adjustments {
+		if adjustments[i], err = json.Marshal(adj); err != nil {
+			return fmt.Errorf("Error encoding adjustment: %v", err)
+		}
+	}
+	err = rs.withWriteSlot(ctx, "writing user account", func(ctx context.Context) error {
+		_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, rs.userBalanceKey(userID), acct.Balance, 0)
+			pipe.Set(ctx, rs.userExpiredKey(userID), acct.Expired, 0)
+			pipe.Del(ctx, rs.userLotsKey(userID), rs.userLotPointsKey(userID))
+			for _, receiptID := range old {
+				pipe.ZRem(ctx, rs.key(pointsExpiryKey), expiryMember(userID, receiptID))
+			}
+			for _, lot := range acct.Lots {
+				score := float64(lot.ExpireAt.Unix())
+				pipe.ZAdd(ctx, rs.userLotsKey(userID), redis.Z{Score: score, Member: lot.ReceiptID})
+				pipe.HSet(ctx, rs.userLotPointsKey(userID), lot.ReceiptID, lot.Points)
+				pipe.ZAdd(ctx, rs.key(pointsExpiryKey), redis.Z{Score: score, Member: expiryMember(userID, lot.ReceiptID)})
+			}
+			for i, red := range acct.Redemptions {
+				pipe.Set(ctx, rs.redemptionKey(userID, red.ID), redemptions[i], 0)
+				pipe.ZAdd(ctx, rs.userRedemptionsKey(userID), redis.Z{Score: float64(red.CreatedAt.UnixMicro()), Member: red.ID})
+			}
+			for i, adj := range acct.Adjustments {
+				score := float64(adj.CreatedAt.UnixMicro())
+				pipe.Set(ctx, rs.adjustmentKey(userID, adj.ID), adjustments[i], 0)
+				pipe.ZAdd(ctx, rs.userAdjustmentsKey(userID), redis.Z{Score: score, Member: adj.ID})
+				if adj.ReceiptID != "" {
+					pipe.ZAdd(ctx, rs.receiptAdjustmentsKey(userID, adj.ReceiptID), redis.Z{Score: score, Member: adj.ID})
+				}
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing user account: %w", err)
+	}
+	return nil
+}
+
+// RestoreReceipts writes records copied from another store as they are: indexes and
+// user histories like SaveReceipts, but without crediting users or counting them in
+// the analytics, the user accounts are copied on their own. Records keep the TTL they
+// have left at now, ones that would have expired by then are skipped.
+func (rs *RedisStore) RestoreReceipts(ctx context.Context, recs []ReceiptRecord, now time.Time) error {
+	var writes []receiptWrite
+	var ttls []time.Duration
+	for _, rec := range recs {
+		ttl := RemainingTTL(rs.receiptTTL(rec), rec.CreatedAt, now)
+		if ttl < 0 {
+			continue
+		}
+		w, err := newReceiptWrite(rec)
+		if err != nil {
+			return err
+		}
+		writes = append(writes, w)
+		ttls = append(ttls, ttl)
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	err := rs.withWriteSlot(ctx, "restoring receipts", func(ctx context.Context) error {
+		_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, w := range writes {
+				rs.queueReceiptRecord(ctx, pipe, w, ttls[i])
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error restoring receipts in database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,661 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	receiptKeyPrefix       = "receipt:"
+	createdIndexKey        = "receipts:idx:created"
+	purchaseDateIndexKey   = "receipts:idx:purchase_date"
+	retailerIndexKeyPrefix = "receipts:idx:retailer:"
+	// the receipts counted under each retailer (see AnalyticsRetailer) by purchase date,
+	// what searches by retailer and date walk
+	canonicalRetailerIndexKeyPrefix = "receipts:idx:canonical_retailer_date:"
+	// plain sets the canonical retailer indexes used to be, PruneIndexes drops them
+	legacyCanonicalRetailerSetKeyPrefix = "receipts:idx:canonical_retailer:"
+)
+
+// ReceiptRecord is what gets persisted for every processed receipt. It carries just
+// enough of the receipt to answer points lookups and listings.
+type ReceiptRecord struct {
+	ID           string    `json:"id"`
+	Retailer     string    `json:"retailer"`
+	PurchaseDate string    `json:"purchaseDate"`
+	Points       int       `json:"points"`
+	CreatedAt    time.Time `json:"createdAt"`
+	// the canonical id the retailer registry had for the retailer when the receipt was
+	// submitted or last corrected, empty when it had none
+	RetailerID string `json:"retailerId,omitempty"`
+	// who the points go to, empty for anonymous receipts
+	UserID string `json:"userId,omitempty"`
+	// when the points stop counting towards the user's balance, nil when they never do.
+	// unrelated to the Redis TTL, expired points are still on the record
+	PointsExpireAt *time.Time `json:"pointsExpireAt,omitempty"`
+	// empty for receipts whose points were awarded, ReceiptFlagged or ReceiptRejected
+	// for ones fraud screening held back, along with why
+	Status       string   `json:"status,omitempty"`
+	FraudReasons []string `json:"fraudReasons,omitempty"`
+	// the rules the points were calculated with and what each rule contributed, empty
+	// for receipts stored before either was recorded
+	RulesVersion string            `json:"rulesVersion,omitempty"`
+	Breakdown    []PointsComponent `json:"breakdown,omitempty"`
+	// the receipt as submitted, so it can be rescored when the rules change. empty for
+	// receipts stored before it was kept
+	Receipt json.RawMessage `json:"receipt,omitempty"`
+	// the retention class the receipt was submitted with, it picks the TTL the receipt
+	// is stored with. empty for the default REDIS_TTL_IN_S
+	Retention string `json:"retention,omitempty"`
+	// what the receipt was before each correction, oldest first. empty for receipts
+	// that were never corrected
+	Revisions []ReceiptRevision `json:"revisions,omitempty"`
+	// when the receipt was soft deleted, only ever set on tombstones
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// ReceiptRevision is a version of a receipt that a correction replaced
+type ReceiptRevision struct {
+	Retailer     string          `json:"retailer"`
+	PurchaseDate string          `json:"purchaseDate"`
+	Points       int             `json:"points"`
+	RulesVersion string          `json:"rulesVersion,omitempty"`
+	Receipt      json.RawMessage `json:"receipt,omitempty"`
+	ReplacedAt   time.Time       `json:"replacedAt"`
+}
+
+// PointsComponent is one line of a receipt's points breakdown: the points a rule added
+// (or, for multipliers, the points the multiplier added)
+type PointsComponent struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail,omitempty"`
+	Points int    `json:"points"`
+}
+
+// ListFilter narrows down a receipt listing. Zero values mean "no filter".
+type ListFilter struct {
+	// Retailer matches the retailer as spelled on the receipt, give or take case and
+	// whitespace. CanonicalRetailer matches what the receipt is counted under, its
+	// retailer id or, without one, its normalized retailer (see AnalyticsRetailer)
+	Retailer          string
+	CanonicalRetailer string
+	FromDate          string // inclusive, YYYY-MM-DD
+	ToDate            string // inclusive, YYYY-MM-DD
+	MinPoints         *int
+	MaxPoints         *int
+	Cursor            string
+	Limit             int
+}
+
+func (rs *RedisStore) receiptKey(id string) string {
+	return rs.key(receiptKeyPrefix + id)
+}
+
+func (rs *RedisStore) retailerIndexKey(retailer string) string {
+	return rs.key(retailerIndexKeyPrefix + NormalizeRetailer(retailer))
+}
+
+func (rs *RedisStore) canonicalRetailerIndexKey(canonical string) string {
+	return rs.key(canonicalRetailerIndexKeyPrefix + canonical)
+}
+
+// NormalizeRetailer is the form retailer names take inside index keys, so that
+// "Target", " target " and "TARGET  " land in the same index: NFC, lowercase, with
+// whitespace collapsed like receipts' retailers are before they're stored.
+func NormalizeRetailer(retailer string) string {
+	return strings.ToLower(strings.Join(strings.Fields(norm.NFC.String(retailer)), " "))
+}
+
+// AnalyticsRetailer is what the receipt is counted under in the retailer analytics: its
+// retailer id, so every alias of a retailer counts towards the same one, or its
+// normalized name for retailers the registry doesn't know
+func (rec ReceiptRecord) AnalyticsRetailer() string {
+	return analyticsRetailer(rec.Retailer, rec.RetailerID)
+}
+
+func analyticsRetailer(retailer, retailerID string) string {
+	if retailerID != "" {
+		return retailerID
+	}
+	return NormalizeRetailer(retailer)
+}
+
+// dateScore turns YYYY-MM-DD into YYYYMMDD so purchase dates sort numerically
+func dateScore(date string) (float64, error) {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing date for index: %v", err)
+	}
+	return float64(t.Year()*10000 + int(t.Month())*100 + t.Day()), nil
+}
+
+// receiptWrite is a record ready to be written: its encoded value and index scores
+type receiptWrite struct {
+	rec               ReceiptRecord
+	value             []byte
+	createdScore      float64
+	purchaseDateScore float64
+}
+
+func newReceiptWrite(rec ReceiptRecord) (receiptWrite, error) {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return receiptWrite{}, fmt.Errorf("Error encoding receipt record: %v", err)
+	}
+	purchaseDateScore, err := dateScore(rec.PurchaseDate)
+	if err != nil {
+		return receiptWrite{}, err
+	}
+	return receiptWrite{
+		rec:   rec,
+		value: value,
+		// micro precision keeps the score inside float64's exact integer range
+		createdScore:      float64(rec.CreatedAt.UnixMicro()),
+		purchaseDateScore: purchaseDateScore,
+	}, nil
+}
+
+// receiptTTL is how long a receipt is kept: its retention class's TTL when it has one,
+// REDIS_TTL_IN_S otherwise. 0 keeps it forever
+func (rs *RedisStore) receiptTTL(rec ReceiptRecord) time.Duration {
+	if ttl, ok := rs.config.ReceiptRetention[rec.Retention]; ok && rec.Retention != "" {
+		return ttl
+	}
+	return rs.config.RedisTTLInSec
+}
+
+// saveReceiptScript writes a receipt that isn't stored yet along with its index
+// entries, analytics counts and credit, and leaves one that is alone. A save retried
+// after Redis applied it but the reply got lost finds the receipt there and doesn't
+// count or credit it twice. The analytics fields are the totals* constants.
+// KEYS: receipt, created index, retailer index, purchase date index, canonical retailer
+// index, review queue, user's receipts, analytics totals, analytics days, analytics
+// retailers, balance, expired total, lots, lot points, expiry index
+// ARGV: record, TTL in ms (0 for none), id, created score, purchase date score,
+// analytics retailer, flagged, has a user, points, awarded, day receipts field, day
+// points field, credit (see creditKind, empty for none), expiry score, expiry member
+// replies 1 when the receipt was written and 0 when it was already stored
+var saveReceiptScript = redis.NewScript(`
+local saved
+if tonumber(ARGV[2]) > 0 then
+	saved = redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2], 'NX')
+else
+	saved = redis.call('SET', KEYS[1], ARGV[1], 'NX')
+end
+if not saved then
+	return 0
+end
+local id, created, points = ARGV[3], ARGV[4], tonumber(ARGV[9])
+redis.call('ZADD', KEYS[2], created, id)
+redis.call('ZADD', KEYS[3], created, id)
+redis.call('ZADD', KEYS[4], ARGV[5], id)
+redis.call('ZADD', KEYS[5], ARGV[5], id)
+if ARGV[7] == '1' then
+	redis.call('ZADD', KEYS[6], created, id)
+end
+if ARGV[8] == '1' then
+	redis.call('ZADD', KEYS[7], created, id)
+end
+redis.call('HINCRBY', KEYS[8], 'receipts', 1)
+redis.call('HINCRBY', KEYS[8], 'scoredPoints', points)
+if ARGV[10] == '1' then
+	redis.call('HINCRBY', KEYS[8], 'awardedPoints', points)
+end
+redis.call('HINCRBY', KEYS[9], ARGV[11], 1)
+redis.call('HINCRBY', KEYS[9], ARGV[12], points)
+redis.call('ZINCRBY', KEYS[10], 1, ARGV[6])
+local credit = ARGV[13]
+if credit == 'expired' then
+	redis.call('INCRBY', KEYS[12], points)
+elseif credit ~= '' then
+	redis.call('INCRBY', KEYS[11], points)
+end
+if credit == 'lot' then
+	redis.call('ZADD', KEYS[13], ARGV[14], id)
+	redis.call('HSET', KEYS[14], id, points)
+	redis.call('ZADD', KEYS[15], ARGV[14], ARGV[15])
+end
+return 1
+`)
+
+func (rs *RedisStore) queueReceiptWrite(ctx context.Context, pipe redis.Pipeliner, w receiptWrite) {
+	rec := w.rec
+	credit, expiryScore := "", 0.0
+	if rec.UserID != "" && rec.Status == "" {
+		// the receipt was credited when it was created, by the app's clock
+		credit = creditKind(rec, rec.CreatedAt)
+	}
+	if rec.PointsExpireAt != nil {
+		expiryScore = float64(rec.PointsExpireAt.Unix())
+	}
+	keys := []string{
+		rs.receiptKey(rec.ID), rs.key(createdIndexKey), rs.retailerIndexKey(rec.Retailer), rs.key(purchaseDateIndexKey),
+		rs.canonicalRetailerIndexKey(rec.AnalyticsRetailer()), rs.key(reviewQueueKey), rs.userReceiptsKey(rec.UserID),
+		rs.key(analyticsTotalsKey), rs.key(analyticsDaysKey), rs.key(analyticsRetailersKey),
+		rs.userBalanceKey(rec.UserID), rs.userExpiredKey(rec.UserID), rs.userLotsKey(rec.UserID), rs.userLotPointsKey(rec.UserID), rs.key(pointsExpiryKey),
+	}
+	day := rec.CreatedAt.UTC().Format("2006-01-02")
+	saveReceiptScript.Eval(ctx, pipe, keys, w.value, rs.receiptTTL(rec).Milliseconds(), rec.ID, w.createdScore, w.purchaseDateScore,
+		rec.AnalyticsRetailer(), rec.Status == ReceiptFlagged, rec.UserID != "", rec.Points, rec.Status == "",
+		dayReceiptsField(day), dayPointsField(day), credit, expiryScore, expiryMember(rec.UserID, rec.ID))
+}
+
+// queueReceiptRecord writes the record with the ttl and its index entries, its user's
+// history included
+func (rs *RedisStore) queueReceiptRecord(ctx context.Context, pipe redis.Pipeliner, w receiptWrite, ttl time.Duration) {
+	pipe.Set(ctx, rs.receiptKey(w.rec.ID), w.value, ttl)
+	pipe.ZAdd(ctx, rs.key(createdIndexKey), redis.Z{Score: w.createdScore, Member: w.rec.ID})
+	pipe.ZAdd(ctx, rs.retailerIndexKey(w.rec.Retailer), redis.Z{Score: w.createdScore, Member: w.rec.ID})
+	pipe.ZAdd(ctx, rs.key(purchaseDateIndexKey), redis.Z{Score: w.purchaseDateScore, Member: w.rec.ID})
+	pipe.ZAdd(ctx, rs.canonicalRetailerIndexKey(w.rec.AnalyticsRetailer()), redis.Z{Score: w.purchaseDateScore, Member: w.rec.ID})
+	if w.rec.Status == ReceiptFlagged {
+		pipe.ZAdd(ctx, rs.key(reviewQueueKey), redis.Z{Score: w.createdScore, Member: w.rec.ID})
+	}
+	if w.rec.UserID != "" {
+		pipe.ZAdd(ctx, rs.userReceiptsKey(w.rec.UserID), redis.Z{Score: w.createdScore, Member: w.rec.ID})
+	}
+}
+
+func (rs *RedisStore) SaveReceipt(ctx context.Context, rec ReceiptRecord) error {
+	return rs.SaveReceipts(ctx, []ReceiptRecord{rec})
+}
+
+// SaveReceipts writes a batch of records and their index entries in a single round
+// trip. The batch is all or nothing, if it fails none of the records were saved.
+// Records that are already stored are skipped, like DynamoDB does.
+func (rs *RedisStore) SaveReceipts(ctx context.Context, recs []ReceiptRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	writes := make([]receiptWrite, len(recs))
+	for i, rec := range recs {
+		w, err := newReceiptWrite(rec)
+		if err != nil {
+			return err
+		}
+		writes[i] = w
+	}
+
+	// design decision: record and indexes go in one MULTI so a listing never sees an
+	// index entry whose record was never written. index entries outlive the record's
+	// TTL, listings clean those up lazily. rerunning the whole MULTI on retry is safe,
+	// saveReceiptScript skips the receipts the first attempt already wrote
+	err := rs.withWriteSlot(ctx, "saving receipts", func(ctx context.Context) error {
+		_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, w := range writes {
+				rs.queueReceiptWrite(ctx, pipe, w)
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error saving receipts in database: %w", err)
+	}
+	return nil
+}
+
+// ReceiptUpdate is a stored record with new contents, along with the points it had so
+// its user's balance can be adjusted by the difference
+type ReceiptUpdate struct {
+	Record    ReceiptRecord
+	OldPoints int
+	// what the receipt was listed under before a correction, so its index entries and
+	// retailer count can move. empty when they can't have changed, e.g. for rescoring
+	OldRetailer     string
+	OldRetailerID   string
+	OldPurchaseDate string
+}
+
+// RetailerChanged reports whether the update moves the receipt to another retailer
+func (u ReceiptUpdate) RetailerChanged() bool {
+	return u.OldRetailer != "" && NormalizeRetailer(u.OldRetailer) != NormalizeRetailer(u.Record.Retailer)
+}
+
+// AnalyticsRetailerMove is what the receipt is counted under in the retailer analytics
+// before and after the update, moved reporting whether those differ
+func (u ReceiptUpdate) AnalyticsRetailerMove() (from, to string, moved bool) {
+	if u.OldRetailer == "" {
+		return "", "", false
+	}
+	from, to = analyticsRetailer(u.OldRetailer, u.OldRetailerID), u.Record.AnalyticsRetailer()
+	return from, to, from != to
+}
+
+// PurchaseDateChanged reports whether the update moves the receipt to another date
+func (u ReceiptUpdate) PurchaseDateChanged() bool {
+	return u.OldPurchaseDate != "" && u.OldPurchaseDate != u.Record.PurchaseDate
+}
+
+// updateReceiptScript is saveReceiptScript for updates: it overwrites a stored record,
+// moves its index entries and moves the counters and balance by the change in points,
+// unless the record already is what it's being updated to. A retried update finds it
+// that way and doesn't move anything twice. A record that's gone stays gone, the
+// counters and balance still move.
+// KEYS: receipt, analytics totals, balance, lot points, old retailer index, retailer
+// index, analytics retailers, old canonical retailer index, canonical retailer index,
+// purchase date index
+// ARGV: record, id, scored delta, awarded delta, credit delta, has a lot, created
+// score, retailer changed, analytics retailer moved, old analytics retailer, analytics
+// retailer, new purchase date score (empty when it didn't change), purchase date score
+// replies 1 when the update was applied and 0 when it already was
+var updateReceiptScript = redis.NewScript(`
+local stored = redis.call('GET', KEYS[1])
+if stored == ARGV[1] then
+	return 0
+end
+local id = ARGV[2]
+local scored, awarded, credit = tonumber(ARGV[3]), tonumber(ARGV[4]), tonumber(ARGV[5])
+if scored ~= 0 then
+	redis.call('HINCRBY', KEYS[2], 'scoredPoints', scored)
+end
+if awarded ~= 0 then
+	redis.call('HINCRBY', KEYS[2], 'awardedPoints', awarded)
+end
+if credit ~= 0 then
+	redis.call('INCRBY', KEYS[3], credit)
+	if ARGV[6] == '1' then
+		redis.call('HINCRBY', KEYS[4], id, credit)
+	end
+end
+if not stored then
+	return 1
+end
+redis.call('SET', KEYS[1], ARGV[1], 'KEEPTTL')
+if ARGV[8] == '1' then
+	redis.call('ZREM', KEYS[5], id)
+	redis.call('ZADD', KEYS[6], ARGV[7], id)
+end
+if ARGV[9] == '1' then
+	redis.call('ZINCRBY', KEYS[7], -1, ARGV[10])
+	redis.call('ZINCRBY', KEYS[7], 1, ARGV[11])
+	redis.call('ZREMRANGEBYSCORE', KEYS[7], '-inf', 0)
+	redis.call('ZREM', KEYS[8], id)
+end
+if ARGV[9] == '1' or ARGV[12] ~= '' then
+	redis.call('ZADD', KEYS[9], ARGV[13], id)
+end
+if ARGV[12] ~= '' then
+	redis.call('ZADD', KEYS[10], ARGV[12], id)
+end
+return 1
+`)
+
+// UpdateReceipts overwrites already stored records in one MULTI, e.g. after they were
+// rescored, and moves user balances by the change in points, unless those points have
+// expired already. Index entries only move when a correction changed the retailer or
+// purchase date, ids and creation times never change. Every record keeps its
+// remaining TTL and records that expired in the meantime stay gone. Updates the
+// stored records already have are skipped, see updateReceiptScript.
+func (rs *RedisStore) UpdateReceipts(ctx context.Context, updates []ReceiptUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	values := make([][]byte, len(updates))
+	dateScores := make([]string, len(updates))
+	newDateScores := make([]string, len(updates))
+	for i, u := range updates {
+		value, err := json.Marshal(u.Record)
+		if err != nil {
+			return fmt.Errorf("Error encoding receipt record: %v", err)
+		}
+		values[i] = value
+		score, err := dateScore(u.Record.PurchaseDate)
+		if err != nil {
+			return err
+		}
+		dateScores[i] = strconv.FormatFloat(score, 'f', -1, 64)
+		if u.PurchaseDateChanged() {
+			newDateScores[i] = dateScores[i]
+		}
+	}
+	now := time.Now()
+	err := rs.withWriteSlot(ctx, "updating receipts", func(ctx context.Context) error {
+		_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, u := range updates {
+				rec := u.Record
+				delta := rec.Points - u.OldPoints
+				awarded := 0
+				if rec.Status == "" {
+					awarded = delta
+				}
+				from, to, moved := u.AnalyticsRetailerMove()
+				oldRetailer := u.OldRetailer
+				if oldRetailer == "" {
+					oldRetailer = rec.Retailer
+				}
+				keys := []string{
+					rs.receiptKey(rec.ID), rs.key(analyticsTotalsKey), rs.userBalanceKey(rec.UserID), rs.userLotPointsKey(rec.UserID),
+					rs.retailerIndexKey(oldRetailer), rs.retailerIndexKey(rec.Retailer), rs.key(analyticsRetailersKey),
+					rs.canonicalRetailerIndexKey(from), rs.canonicalRetailerIndexKey(rec.AnalyticsRetailer()), rs.key(purchaseDateIndexKey),
+				}
+				updateReceiptScript.Eval(ctx, pipe, keys, values[i], rec.ID, delta, awarded, creditDelta(rec, delta, now),
+					rec.PointsExpireAt != nil, float64(rec.CreatedAt.UnixMicro()), u.RetailerChanged(), moved, from, to, newDateScores[i], dateScores[i])
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error updating receipts in database: %w", err)
+	}
+	return nil
+}
+
+func (rs *RedisStore) GetReceipt(ctx context.Context, id string) (ReceiptRecord, error) {
+	value, err := rs.GetKey(ctx, rs.receiptKey(id))
+	if err != nil {
+		return ReceiptRecord{}, err
+	}
+	var rec ReceiptRecord
+	if err := json.Unmarshal([]byte(value), &rec); err != nil {
+		return ReceiptRecord{}, fmt.Errorf("Error decoding receipt record: %v", err)
+	}
+	return rec, nil
+}
+
+// listCursor marks the last index entry handed out. the member is needed on top of the
+// score because many receipts can share a score (e.g. same purchase date)
+type listCursor struct {
+	Score  float64 `json:"s"`
+	Member string  `json:"m"`
+}
+
+func encodeCursor(c listCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	var c listCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return &c, nil
+}
+
+func (f ListFilter) matches(rec ReceiptRecord) bool {
+	if f.Retailer != "" && NormalizeRetailer(rec.Retailer) != NormalizeRetailer(f.Retailer) {
+		return false
+	}
+	if f.CanonicalRetailer != "" && rec.AnalyticsRetailer() != f.CanonicalRetailer {
+		return false
+	}
+	if f.FromDate != "" && rec.PurchaseDate < f.FromDate {
+		return false
+	}
+	if f.ToDate != "" && rec.PurchaseDate > f.ToDate {
+		return false
+	}
+	if f.MinPoints != nil && rec.Points < *f.MinPoints {
+		return false
+	}
+	if f.MaxPoints != nil && rec.Points > *f.MaxPoints {
+		return false
+	}
+	return true
+}
+
+// ListReceipts pages through stored receipts newest first. The index that gets walked
+// depends on the filter: the per-retailer index when filtering by retailer, the
+// canonical retailer's purchase date index when filtering by that, the purchase date
+// index when filtering by date, the creation index otherwise. Whatever the
+// index can't narrow down is filtered after the records are fetched.
+func (rs *RedisStore) ListReceipts(ctx context.Context, filter ListFilter) ([]ReceiptRecord, string, error) {
+	cursor, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	indexKey := rs.key(createdIndexKey)
+	min, max := "-inf", "+inf"
+	if filter.Retailer != "" {
+		indexKey = rs.retailerIndexKey(filter.Retailer)
+	} else if filter.CanonicalRetailer != "" || filter.FromDate != "" || filter.ToDate != "" {
+		indexKey = rs.key(purchaseDateIndexKey)
+		if filter.CanonicalRetailer != "" {
+			indexKey = rs.canonicalRetailerIndexKey(filter.CanonicalRetailer)
+		}
+		if filter.FromDate != "" {
+			score, err := dateScore(filter.FromDate)
+			if err != nil {
+				return nil, "", err
+			}
+			min = strconv.FormatFloat(score, 'f', -1, 64)
+		}
+		if filter.ToDate != "" {
+			score, err := dateScore(filter.ToDate)
+			if err != nil {
+				return nil, "", err
+			}
+			max = strconv.FormatFloat(score, 'f', -1, 64)
+		}
+	}
+	if cursor != nil {
+		// inclusive on purpose, entries sharing the cursor's score are skipped below
+		max = strconv.FormatFloat(cursor.Score, 'f', -1, 64)
+	}
+
+	// over-fetch so a page can still be filled when the filter rejects some entries
+	batchSize := int64(filter.Limit * 2)
+	var (
+		results []ReceiptRecord
+		expired []interface{}
+		offset  int64
+		last    *listCursor
+	)
+	// removing entries mid-scan would shift the offsets, so expired ones are dropped
+	// from the index once the page is done
+	defer func() {
+		if len(expired) == 0 {
+			return
+		}
+		if err := rs.client.ZRem(ctx, indexKey, expired...).Err(); err != nil {
+			logging.Printf(ctx, "Error removing expired receipts from index %s: %v", indexKey, err)
+		}
+	}()
+	for len(results) < filter.Limit {
+		var entries []redis.Z
+		err := rs.withRetry(ctx, "reading receipt index", func(ctx context.Context) error {
+			var err error
+			rangeBy := &redis.ZRangeBy{Min: min, Max: max, Offset: offset, Count: batchSize}
+			entries, err = rs.client.ZRevRangeByScoreWithScores(ctx, indexKey, rangeBy).Result()
+			return err
+		})
+		if err != nil {
+			return nil, "", fmt.Errorf("Error reading receipt index: %w", err)
+		}
+		if len(entries) == 0 {
+			return results, "", nil
+		}
+		offset += int64(len(entries))
+
+		ids := make([]string, 0, len(entries))
+		scores := make(map[string]float64, len(entries))
+		for _, entry := range entries {
+			member := entry.Member.(string)
+			// members with the same score come back in reverse lexicographical order, so
+			// anything at the cursor's score that isn't below its member was already served
+			if cursor != nil && entry.Score == cursor.Score && member >= cursor.Member {
+				continue
+			}
+			ids = append(ids, member)
+			scores[member] = entry.Score
+		}
+		records, missing, err := rs.getReceipts(ctx, ids)
+		if err != nil {
+			return nil, "", err
+		}
+		expired = append(expired, missing...)
+		for _, rec := range records {
+			last = &listCursor{Score: scores[rec.ID], Member: rec.ID}
+			if !filter.matches(rec) {
+				continue
+			}
+			results = append(results, rec)
+			if len(results) == filter.Limit {
+				return results, encodeCursor(*last), nil
+			}
+		}
+		if int64(len(entries)) < batchSize {
+			return results, "", nil
+		}
+	}
+	return results, "", nil
+}
+
+// GetReceipts fetches a batch of records with a single MGET, in the order of ids.
+// Unknown or expired ids are left out.
+func (rs *RedisStore) GetReceipts(ctx context.Context, ids []string) ([]ReceiptRecord, error) {
+	records, _, err := rs.getReceipts(ctx, ids)
+	return records, err
+}
+
+// getReceipts is GetReceipts that also hands back the ids whose record has expired
+func (rs *RedisStore) getReceipts(ctx context.Context, ids []string) ([]ReceiptRecord, []interface{}, error) {
+	if len(ids) == 0 {
+		return nil, nil, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = rs.receiptKey(id)
+	}
+	values, err := rs.GetMany(ctx, keys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error fetching receipts from database: %w", err)
+	}
+
+	records := make([]ReceiptRecord, 0, len(values))
+	var missing []interface{}
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			missing = append(missing, ids[i])
+			continue
+		}
+		var rec ReceiptRecord
+		if err := json.Unmarshal([]byte(s), &rec); err != nil {
+			logging.Printf(ctx, "Error decoding receipt record %s: %v", ids[i], err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, missing, nil
+}
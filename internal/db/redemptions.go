@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrInsufficientPoints is returned when a redemption asks for more than the balance
+	ErrInsufficientPoints = errors.New("insufficient points")
+	// ErrRedemptionConflict is returned when a redemption id is reused for a different
+	// redemption
+	ErrRedemptionConflict = errors.New("redemption id already used for a different redemption")
+)
+
+// Redemption is one entry of a user's redemption ledger
+type Redemption struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"userId"`
+	Points       int       `json:"points"`
+	Reward       string    `json:"reward,omitempty"`
+	BalanceAfter int       `json:"balanceAfter"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func (rs *RedisStore) redemptionKey(userID, id string) string {
+	return rs.key(userKeyPrefix + userID + ":redemption:" + id)
+}
+
+func (rs *RedisStore) userRedemptionsKey(userID string) string {
+	return rs.key(userKeyPrefix + userID + ":redemptions")
+}
+
+// redeemScript checks the balance, deducts the points and writes the ledger entry in
+// one step, so concurrent redemptions can't overdraw a balance. A redemption id that
+// was already used returns the original entry, which also makes retries safe.
+// replies {0, entry} when redeemed, {1, entry} when the id was already used and
+// {2, balance} when the balance is too low
+var redeemScript = redis.NewScript(`
+local existing = redis.call('GET', KEYS[2])
+if existing then
+	return {1, existing}
+end
+local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+local points = tonumber(ARGV[1])
+if balance < points then
+	return {2, tostring(balance)}
+end
+local entry = cjson.decode(ARGV[2])
+entry['balanceAfter'] = redis.call('DECRBY', KEYS[1], points)
+local encoded = cjson.encode(entry)
+redis.call('SET', KEYS[2], encoded)
+redis.call('ZADD', KEYS[3], ARGV[3], ARGV[4])
+return {0, encoded}
+`)
+
+// Redeem deducts a redemption from the user's balance and records it in their ledger.
+// It reports whether the redemption is new; replaying a redemption id returns the
+// original entry without deducting again, as long as it's for the same points and
+// reward (ErrRedemptionConflict otherwise). ErrInsufficientPoints when the balance
+// doesn't cover it.
+func (rs *RedisStore) Redeem(ctx context.Context, red Redemption) (Redemption, bool, error) {
+	entry, err := json.Marshal(red)
+	if err != nil {
+		return Redemption{}, false, fmt.Errorf("Error encoding redemption: %v", err)
+	}
+	keys := []string{rs.userBalanceKey(red.UserID), rs.redemptionKey(red.UserID, red.ID), rs.userRedemptionsKey(red.UserID)}
+	args := []interface{}{red.Points, entry, float64(red.CreatedAt.UnixMicro()), red.ID}
+
+	var reply []interface{}
+	err = rs.withWriteSlot(ctx, "redeeming points", func(ctx context.Context) error {
+		var err error
+		reply, err = redeemScript.Run(ctx, rs.client, keys, args...).Slice()
+		return err
+	})
+	if err != nil {
+		return Redemption{}, false, fmt.Errorf("Error redeeming points: %w", err)
+	}
+	if len(reply) != 2 {
+		return Redemption{}, false, fmt.Errorf("Error redeeming points: unexpected reply %v", reply)
+	}
+	status, _ := reply[0].(int64)
+	payload, _ := reply[1].(string)
+	if status == 2 {
+		return Redemption{}, false, fmt.Errorf("Error redeeming %d points with a balance of %s: %w", red.Points, payload, ErrInsufficientPoints)
+	}
+
+	var stored Redemption
+	if err := json.Unmarshal([]byte(payload), &stored); err != nil {
+		return Redemption{}, false, fmt.Errorf("Error decoding redemption: %v", err)
+	}
+	if status == 1 && (stored.Points != red.Points || stored.Reward != red.Reward) {
+		return Redemption{}, false, fmt.Errorf("Error redeeming %s: %w", red.ID, ErrRedemptionConflict)
+	}
+	return stored, status == 0, nil
+}
+
+// ListRedemptions returns up to limit of the user's latest redemptions, newest first
+func (rs *RedisStore) ListRedemptions(ctx context.Context, userID string, limit int) ([]Redemption, error) {
+	var ids []string
+	err := rs.withRetry(ctx, "listing redemptions", func(ctx context.Context) error {
+		var err error
+		ids, err = rs.client.ZRevRange(ctx, rs.userRedemptionsKey(userID), 0, int64(limit)-1).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing redemptions: %w", err)
+	}
+	if len(ids) == 0 {
+		return []Redemption{}, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = rs.redemptionKey(userID, id)
+	}
+	values, err := rs.GetMany(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching redemptions: %w", err)
+	}
+	redemptions := make([]Redemption, 0, len(values))
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var red Redemption
+		if err := json.Unmarshal([]byte(s), &red); err != nil {
+			logging.Printf(ctx, "Error decoding redemption %s of user %s: %v", ids[i], userID, err)
+			continue
+		}
+		redemptions = append(redemptions, red)
+	}
+	return redemptions, nil
+}
@@ -3,26 +3,109 @@ package db
 import (
 	"context"
 	"fmt"
-	"log"
+	"strings"
 	"time"
 
+	"github.com/jayreddy040-510/receipt_processor/internal/breaker"
+	"github.com/jayreddy040-510/receipt_processor/internal/concurrency"
 	"github.com/jayreddy040-510/receipt_processor/internal/config"
 
 	"github.com/redis/go-redis/v9"
 )
 
 type RedisStore struct {
-	client *redis.Client
-	config config.Config
+	client  *redis.Client
+	config  config.Config
+	breaker *breaker.Breaker
+	// caps concurrent writes so a burst queues here instead of exhausting the pool
+	writes *concurrency.Limiter
+	// every key this store touches starts with it, see ForTenant
+	prefix string
 }
 
 func NewRedisStore(config config.Config) *RedisStore {
-	return &RedisStore{
+	rs := &RedisStore{
 		client: redis.NewClient(&redis.Options{
-			Addr: config.RedisAddr,
+			Addr:         config.RedisAddr,
+			PoolSize:     config.RedisPoolSize,
+			MinIdleConns: config.RedisMinIdleConns,
+			DialTimeout:  config.RedisDialTimeoutInMs,
+			ReadTimeout:  config.RedisReadTimeoutInMs,
+			WriteTimeout: config.RedisWriteTimeoutInMs,
+			// retries are handled by withRetry, stacking go-redis' own on top would
+			// multiply attempts and blow through the retry time budget. -1 is none to
+			// go-redis, 0 its default of 3
+			MaxRetries: redisMaxRetries(config.RedisMaxRetries),
+			// without it go-redis only honors its own 3s socket timeouts and a hung
+			// connection outlasts DB_TIMEOUT_IN_MS
+			ContextTimeoutEnabled: true,
 		}),
-		config: config,
+		config:  config,
+		breaker: breaker.New(config.BreakerFailureThreshold, config.BreakerOpenInMs),
+		writes:  concurrency.New(config.MaxConcurrentStoreWrites, config.StoreWriteQueueSize, config.ConcurrencyQueueWaitInMs),
+		prefix:  keyPrefix(config, ""),
 	}
+	rs.client.AddHook(breakerHook{breaker: rs.breaker})
+	return rs
+}
+
+func redisMaxRetries(n int) int {
+	if n == 0 {
+		return -1
+	}
+	return n
+}
+
+// Breaker exposes the circuit breaker guarding every Redis command, for readiness
+// checks and metrics
+func (rs *RedisStore) Breaker() *breaker.Breaker {
+	return rs.breaker
+}
+
+// WriteLimiter exposes the limit on concurrent writes, for metrics
+func (rs *RedisStore) WriteLimiter() *concurrency.Limiter {
+	return rs.writes
+}
+
+// ForTenant returns a view of the store that keeps all of its keys under the tenant's
+// own prefix, sharing the connection pool and breaker. The default tenant ("") keeps
+// the keys from before there were tenants, with only the namespace in front.
+func (rs *RedisStore) ForTenant(tenantID string) Store {
+	if tenantID == "" {
+		return rs
+	}
+	scoped := *rs
+	scoped.prefix = keyPrefix(rs.config, tenantID)
+	return &scoped
+}
+
+// keyPrefix is what the keys of a tenant start with: the KEY_PREFIX namespace, then
+// tenant:<id> for tenants other than the default one. With REDIS_HASH_TAGS that's a
+// hash tag, "{default}" when there's nothing else, so all of a tenant's keys hash to one
+// Redis Cluster slot and the transactions and scripts spanning them (a receipt with its
+// user, indexes and counters) stay legal there.
+func keyPrefix(cfg config.Config, tenantID string) string {
+	var scope []string
+	if cfg.KeyPrefix != "" {
+		scope = append(scope, cfg.KeyPrefix)
+	}
+	if tenantID != "" {
+		scope = append(scope, "tenant:"+tenantID)
+	}
+	if cfg.RedisHashTags {
+		if len(scope) == 0 {
+			scope = []string{"default"}
+		}
+		return "{" + strings.Join(scope, ":") + "}:"
+	}
+	if len(scope) == 0 {
+		return ""
+	}
+	return strings.Join(scope, ":") + ":"
+}
+
+func (rs *RedisStore) key(key string) string {
+	return rs.prefix + key
 }
 
 func (rs *RedisStore) CheckConnection(ctx context.Context) error {
@@ -30,33 +113,70 @@ func (rs *RedisStore) CheckConnection(ctx context.Context) error {
 }
 
 func (rs *RedisStore) GetKey(ctx context.Context, key string) (string, error) {
-	for i := 0; i < rs.config.MaxDBConnRetries; i++ {
-		storedValue, err := rs.client.Get(ctx, key).Result()
-		if err == context.DeadlineExceeded {
-			log.Printf("Connection to DB timed out, attempting retry, retries attempted: %v", i)
-			continue
-		} else if err == redis.Nil {
-			return "", fmt.Errorf("Key does not exist in database: %v", err)
-		} else if err != nil {
-			return "", fmt.Errorf("Error getting key from database: %v", err)
-		} else {
-			return storedValue, nil
-		}
+	var storedValue string
+	err := rs.withRetry(ctx, "getting key", func(ctx context.Context) error {
+		var err error
+		storedValue, err = rs.client.Get(ctx, key).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return "", fmt.Errorf("Key does not exist in database: %w", ErrNotFound)
+	} else if err != nil {
+		return "", fmt.Errorf("Error getting key from database: %w", err)
 	}
-	return "", fmt.Errorf("Error connecting to DB: %v. Max retries attempted.", context.DeadlineExceeded)
+	return storedValue, nil
 }
 
-func (rs *RedisStore) SetKey(ctx context.Context, key, value string) error {
-	for i := 0; i < rs.config.MaxDBConnRetries; i++ {
-		err := rs.client.Set(ctx, key, value, time.Second*time.Duration(rs.config.RedisTTLInSec)).Err()
-		if err == context.DeadlineExceeded {
-			log.Printf("Connection to DB timed out, attempting retry, retries attempted: %v", i)
-			continue
-		} else if err != nil {
-			return fmt.Errorf("Error setting key in database: %v", err)
-		} else {
+// SetKey stores value under key for ttl, 0 keeping it until it's deleted
+func (rs *RedisStore) SetKey(ctx context.Context, key, value string, ttl time.Duration) error {
+	err := rs.withWriteSlot(ctx, "setting key", func(ctx context.Context) error {
+		return rs.client.Set(ctx, key, value, ttl).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("Error setting key in database: %w", err)
+	}
+	return nil
+}
+
+// GetMany is GetKey for a batch of keys, done with one MGET. Values come back in the
+// order of keys, nil where the key doesn't exist.
+func (rs *RedisStore) GetMany(ctx context.Context, keys []string) ([]interface{}, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	var values []interface{}
+	err := rs.withRetry(ctx, "getting keys", func(ctx context.Context) error {
+		var err error
+		values, err = rs.client.MGet(ctx, keys...).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting keys from database: %w", err)
+	}
+	return values, nil
+}
+
+// SetMany is SetKey for a batch of key-value pairs, pipelined into one round trip
+func (rs *RedisStore) SetMany(ctx context.Context, values map[string]string, ttl time.Duration) error {
+	if len(values) == 0 {
+		return nil
+	}
+	err := rs.withWriteSlot(ctx, "setting keys", func(ctx context.Context) error {
+		_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for key, value := range values {
+				pipe.Set(ctx, key, value, ttl)
+			}
 			return nil
-		}
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error setting keys in database: %w", err)
 	}
-	return fmt.Errorf("Error connecting to DB: %v. Max retries attempted.", context.DeadlineExceeded)
+	return nil
+}
+
+// Close closes the connection pool, the store can't be used afterwards
+func (rs *RedisStore) Close() error {
+	return rs.client.Close()
 }
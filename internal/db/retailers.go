@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+const retailersKey = "retailers"
+
+// Retailer is an entry of the retailer registry: a canonical retailer id along with the
+// raw retailer names receipts print for it, e.g. "M&M Corner Market #123" and "MM
+// CORNER MKT" for "mm-corner-market". Receipts whose retailer matches one of its
+// aliases (compared like NormalizeRetailer compares names) or patterns get its id.
+type Retailer struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// names matched exactly, case and whitespace aside. Name counts as one too
+	Aliases []string `json:"aliases,omitempty"`
+	// regular expressions matched case-insensitively, after the aliases of every
+	// retailer
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// SaveRetailer creates the retailer or replaces the one with the same ID
+func (rs *RedisStore) SaveRetailer(ctx context.Context, r Retailer) error {
+	value, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("Error encoding retailer: %v", err)
+	}
+	err = rs.withWriteSlot(ctx, "saving retailer", func(ctx context.Context) error {
+		return rs.client.HSet(ctx, rs.key(retailersKey), r.ID, value).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("Error saving retailer: %w", err)
+	}
+	return nil
+}
+
+// DeleteRetailer removes the retailer, ErrNotFound when there is no such retailer.
+// Receipts keep the id they were stored with.
+func (rs *RedisStore) DeleteRetailer(ctx context.Context, id string) error {
+	var deleted int64
+	err := rs.withWriteSlot(ctx, "deleting retailer", func(ctx context.Context) error {
+		var err error
+		deleted, err = rs.client.HDel(ctx, rs.key(retailersKey), id).Result()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error deleting retailer: %w", err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("Error deleting retailer %s: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// ListRetailers returns the whole registry ordered by id
+func (rs *RedisStore) ListRetailers(ctx context.Context) ([]Retailer, error) {
+	var values map[string]string
+	err := rs.withRetry(ctx, "listing retailers", func(ctx context.Context) error {
+		var err error
+		values, err = rs.client.HGetAll(ctx, rs.key(retailersKey)).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing retailers: %w", err)
+	}
+	retailers := make([]Retailer, 0, len(values))
+	for id, value := range values {
+		var r Retailer
+		if err := json.Unmarshal([]byte(value), &r); err != nil {
+			logging.Printf(ctx, "Error decoding retailer %s: %v", id, err)
+			continue
+		}
+		retailers = append(retailers, r)
+	}
+	sort.Slice(retailers, func(i, j int) bool { return retailers[i].ID < retailers[j].ID })
+	return retailers, nil
+}
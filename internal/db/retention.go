@@ -0,0 +1,188 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	tombstoneKeyPrefix = "tombstone:"
+	// tombstone ids by when they were deleted, the retention sweeper purges from it
+	tombstonesIndexKey = "receipts:tombstones"
+)
+
+// RetentionSweep is what one PurgeReceipts call did
+type RetentionSweep struct {
+	// the receipts that are gone for good, tombstones have DeletedAt set
+	Purged []ReceiptRecord `json:"purged"`
+	// true when more were due than the call looked at
+	More bool `json:"more"`
+}
+
+func (rs *RedisStore) tombstoneKey(id string) string {
+	return rs.key(tombstoneKeyPrefix + id)
+}
+
+// SoftDeleteReceipt turns a receipt into a tombstone deleted at at: it's gone for every
+// lookup and listing but kept, without a TTL, until PurgeReceipts removes it. Balances
+// are left as they are. ErrNotFound when there is no such receipt, deleted ones
+// included.
+func (rs *RedisStore) SoftDeleteReceipt(ctx context.Context, id string, at time.Time) (ReceiptRecord, error) {
+	rec, err := rs.GetReceipt(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return ReceiptRecord{}, fmt.Errorf("Error deleting receipt %s: %w", id, ErrNotFound)
+		}
+		return ReceiptRecord{}, err
+	}
+	deletedAt := at.UTC()
+	rec.DeletedAt = &deletedAt
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return ReceiptRecord{}, fmt.Errorf("Error encoding receipt record: %v", err)
+	}
+	// design decision: the record moves out of its key into a tombstone instead of
+	// being marked deleted in place. every lookup, listing and history already treats
+	// a missing record as gone, a flag would have to be checked by all of them
+	err = rs.withWriteSlot(ctx, "deleting receipt", func(ctx context.Context) error {
+		_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			rs.queueReceiptDelete(ctx, pipe, rec)
+			pipe.Set(ctx, rs.tombstoneKey(id), value, 0)
+			pipe.ZAdd(ctx, rs.key(tombstonesIndexKey), redis.Z{Score: float64(deletedAt.UnixMicro()), Member: id})
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return ReceiptRecord{}, fmt.Errorf("Error deleting receipt %s: %w", id, err)
+	}
+	return rec, nil
+}
+
+// GetTombstone is the soft deleted receipt with the id, ErrNotFound when there is none
+// or it has been purged
+func (rs *RedisStore) GetTombstone(ctx context.Context, id string) (ReceiptRecord, error) {
+	value, err := rs.GetKey(ctx, rs.tombstoneKey(id))
+	if err != nil {
+		return ReceiptRecord{}, err
+	}
+	var rec ReceiptRecord
+	if err := json.Unmarshal([]byte(value), &rec); err != nil {
+		return ReceiptRecord{}, fmt.Errorf("Error decoding receipt record: %v", err)
+	}
+	return rec, nil
+}
+
+// PurgeReceipts hard deletes up to limit receipts: tombstones deleted before
+// deletedBefore first, then receipts created before createdBefore. A zero time skips
+// that kind. Like DeleteReceipt it leaves balances alone. It's safe to run from several
+// instances at once, a receipt two of them purge is reported by both.
+func (rs *RedisStore) PurgeReceipts(ctx context.Context, createdBefore, deletedBefore time.Time, limit int) (RetentionSweep, error) {
+	var sweep RetentionSweep
+	if !deletedBefore.IsZero() {
+		ids, err := rs.due(ctx, rs.key(tombstonesIndexKey), deletedBefore, limit)
+		if err != nil {
+			return sweep, err
+		}
+		sweep.More = len(ids) == limit
+		if err := rs.purgeTombstones(ctx, ids, &sweep); err != nil {
+			return sweep, err
+		}
+	}
+	if createdBefore.IsZero() || len(sweep.Purged) >= limit {
+		return sweep, nil
+	}
+	left := limit - len(sweep.Purged)
+	ids, err := rs.due(ctx, rs.key(createdIndexKey), createdBefore, left)
+	if err != nil {
+		return sweep, err
+	}
+	sweep.More = sweep.More || len(ids) == left
+	records, missing, err := rs.getReceipts(ctx, ids)
+	if err != nil {
+		return sweep, err
+	}
+	if len(records) == 0 && len(missing) == 0 {
+		return sweep, nil
+	}
+	// entries of receipts that expired go too, or they'd come up every sweep
+	err = rs.withWriteSlot(ctx, "purging receipts", func(ctx context.Context) error {
+		_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, rec := range records {
+				rs.queueReceiptDelete(ctx, pipe, rec)
+			}
+			if len(missing) > 0 {
+				pipe.ZRem(ctx, rs.key(createdIndexKey), missing...)
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return sweep, fmt.Errorf("Error purging receipts: %w", err)
+	}
+	sweep.Purged = append(sweep.Purged, records...)
+	return sweep, nil
+}
+
+// due is up to limit members of the index scored before t, oldest first
+func (rs *RedisStore) due(ctx context.Context, indexKey string, t time.Time, limit int) ([]string, error) {
+	var ids []string
+	err := rs.withRetry(ctx, "reading index", func(ctx context.Context) error {
+		var err error
+		ids, err = rs.client.ZRangeByScore(ctx, indexKey, &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   "(" + strconv.FormatInt(t.UnixMicro(), 10),
+			Count: int64(limit),
+		}).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error reading index %s: %w", indexKey, err)
+	}
+	return ids, nil
+}
+
+func (rs *RedisStore) purgeTombstones(ctx context.Context, ids []string, sweep *RetentionSweep) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	keys := make([]string, len(ids))
+	members := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = rs.tombstoneKey(id)
+		members[i] = id
+	}
+	values, err := rs.GetMany(ctx, keys)
+	if err != nil {
+		return fmt.Errorf("Error reading tombstones: %w", err)
+	}
+	err = rs.withWriteSlot(ctx, "purging tombstones", func(ctx context.Context) error {
+		_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, keys...)
+			pipe.ZRem(ctx, rs.key(tombstonesIndexKey), members...)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error purging tombstones: %w", err)
+	}
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var rec ReceiptRecord
+		if err := json.Unmarshal([]byte(s), &rec); err == nil {
+			sweep.Purged = append(sweep.Purged, rec)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/breaker"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// withRetry runs fn until it succeeds, fails with a non-transient error, runs out of
+// attempts (MaxDBConnRetries) or would overrun the max elapsed time. Every attempt gets
+// its own timeout derived from ctx, so an attempt timing out doesn't leave the next one
+// with an already expired context. Attempts are spaced with exponential backoff and
+// full jitter so a fleet of instances doesn't retry in lockstep against a struggling
+// Redis. Failures that come from Redis not answering are marked ErrUnavailable.
+func (rs *RedisStore) withRetry(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	err := rs.retry(ctx, op, fn)
+	if isStoreFailure(err) {
+		return Unavailable(err)
+	}
+	return err
+}
+
+func (rs *RedisStore) retry(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	maxAttempts := max(1, rs.config.MaxDBConnRetries)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, rs.config.DbAttemptTimeoutInMs)
+		err = fn(attemptCtx)
+		cancel()
+		if err == nil || !isTransient(err) {
+			return err
+		}
+		// the caller's own deadline or cancellation is final
+		if ctx.Err() != nil {
+			return fmt.Errorf("Error %s: %w", op, ctx.Err())
+		}
+		if attempt >= maxAttempts {
+			break
+		}
+
+		delay := backoffDelay(attempt, rs.config.DbRetryBaseDelayInMs, rs.config.DbRetryMaxDelayInMs)
+		if time.Since(start)+delay > rs.config.DbRetryMaxElapsedInMs {
+			break
+		}
+		logging.Warnf(ctx, "Transient DB error while %s, retrying in %v (attempt %d of %d): %v", op, delay, attempt, maxAttempts, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("Error %s: %w", op, ctx.Err())
+		case <-timer.C:
+		}
+	}
+	return fmt.Errorf("Error %s, retries exhausted after %v: %w", op, time.Since(start).Round(time.Millisecond), err)
+}
+
+// withWriteSlot is withRetry for writes: it first waits for one of the
+// MAX_CONCURRENT_STORE_WRITES slots, failing with concurrency.ErrSaturated when the
+// wait is too long. The slot is held across retries.
+func (rs *RedisStore) withWriteSlot(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	release, err := rs.writes.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("Error %s: %w", op, err)
+	}
+	defer release()
+	return rs.withRetry(ctx, op, fn)
+}
+
+// backoffDelay picks a random delay in [0, min(maxDelay, base*2^(attempt-1))]
+func backoffDelay(attempt int, base, maxDelay time.Duration) time.Duration {
+	ceiling := base << (attempt - 1)
+	if ceiling <= 0 || ceiling > maxDelay {
+		ceiling = maxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// isTransient reports whether an error is worth retrying: timeouts, connection level
+// failures and the error replies Redis gives while failing over or loading. A missing
+// key, an open breaker, a cancelled caller or a regular error reply won't get better
+// by trying again.
+func isTransient(err error) bool {
+	switch {
+	case err == nil, err == redis.Nil:
+		return false
+	case errors.Is(err, breaker.ErrOpen), errors.Is(err, context.Canceled):
+		return false
+	// a WATCHed key changed under a transaction, the next attempt reads it again
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, redis.TxFailedErr):
+		return true
+	}
+
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		msg := redisErr.Error()
+		for _, prefix := range []string{"LOADING", "READONLY", "MASTERDOWN", "TRYAGAIN", "CLUSTERDOWN"} {
+			if strings.HasPrefix(msg, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// go-redis doesn't export its pool timeout error, match on the message like for the rest
+	msg := err.Error()
+	return errors.Is(err, net.ErrClosed) || strings.Contains(msg, "EOF") || strings.Contains(msg, "connection reset") ||
+		strings.Contains(msg, "connection refused") || strings.Contains(msg, "connection pool timeout")
+}
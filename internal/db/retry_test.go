@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/breaker"
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// replyError is an error reply from Redis
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+
+func (replyError) RedisError() {}
+
+func retryingStore(retries int, base, maxElapsed time.Duration) *RedisStore {
+	return &RedisStore{config: config.Config{
+		MaxDBConnRetries:      retries,
+		DbAttemptTimeoutInMs:  time.Second,
+		DbRetryBaseDelayInMs:  base,
+		DbRetryMaxDelayInMs:   4 * base,
+		DbRetryMaxElapsedInMs: maxElapsed,
+	}}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		failed   bool
+	}{
+		{"success", nil, 1, false},
+		{"transient then success", []error{context.DeadlineExceeded}, 2, false},
+		{"transient every time", []error{context.DeadlineExceeded, redis.TxFailedErr, context.DeadlineExceeded, context.DeadlineExceeded}, 3, true},
+		{"missing key", []error{redis.Nil}, 1, true},
+		{"open breaker", []error{breaker.ErrOpen}, 1, true},
+		{"failing over", []error{replyError("LOADING Redis is loading the dataset in memory")}, 2, false},
+		{"connection reset", []error{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}}, 2, false},
+		{"error reply", []error{replyError("WRONGTYPE Operation against a key holding the wrong kind of value")}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := retryingStore(3, time.Millisecond, time.Second)
+			var attempts int
+			err := rs.withRetry(context.Background(), "testing", func(ctx context.Context) error {
+				// every attempt gets a deadline of its own, not what the last one left
+				if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) < 900*time.Millisecond {
+					t.Errorf("attempt %d: got deadline %v, want a fresh one", attempts+1, deadline)
+				}
+				attempts++
+				if attempts > len(tt.errs) {
+					return nil
+				}
+				return tt.errs[attempts-1]
+			})
+			if attempts != tt.attempts {
+				t.Errorf("got %d attempts, want %d", attempts, tt.attempts)
+			}
+			if (err != nil) != tt.failed {
+				t.Errorf("got error %v, want failed %v", err, tt.failed)
+			}
+		})
+	}
+}
+
+func TestRetriesExhaustedIsUnavailable(t *testing.T) {
+	rs := retryingStore(2, time.Millisecond, time.Second)
+	err := rs.withRetry(context.Background(), "testing", func(ctx context.Context) error {
+		return context.DeadlineExceeded
+	})
+	if !errors.Is(err, ErrUnavailable) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want ErrUnavailable wrapping the last attempt's error", err)
+	}
+}
+
+func TestRetryStopsAtMaxElapsed(t *testing.T) {
+	// the first backoff could already run past the budget
+	rs := retryingStore(5, time.Hour, time.Millisecond)
+	rs.config.DbRetryMaxDelayInMs = time.Hour
+	var attempts int
+	start := time.Now()
+	rs.withRetry(context.Background(), "testing", func(ctx context.Context) error {
+		attempts++
+		return context.DeadlineExceeded
+	})
+	if attempts != 1 || time.Since(start) > time.Second {
+		t.Errorf("got %d attempts in %v, want 1 without waiting", attempts, time.Since(start))
+	}
+}
+
+func TestRetryStopsWhenTheCallerGivesUp(t *testing.T) {
+	rs := retryingStore(5, time.Hour, 2*time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var attempts int
+	err := rs.withRetry(ctx, "testing", func(ctx context.Context) error {
+		attempts++
+		return context.DeadlineExceeded
+	})
+	if attempts != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %d attempts and %v, want 1 and the caller's deadline", attempts, err)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	base, maxDelay := 10*time.Millisecond, 50*time.Millisecond
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{4, 50 * time.Millisecond},
+		// the shift overflows, the ceiling still holds
+		{70, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		var longest time.Duration
+		for i := 0; i < 200; i++ {
+			delay := backoffDelay(tt.attempt, base, maxDelay)
+			if delay < 0 || delay > tt.ceiling {
+				t.Fatalf("attempt %d: got %v, want within [0, %v]", tt.attempt, delay, tt.ceiling)
+			}
+			longest = max(longest, delay)
+		}
+		// full jitter spreads over the whole range
+		if longest < tt.ceiling/2 {
+			t.Errorf("attempt %d: longest of 200 delays is %v, want close to %v", tt.attempt, longest, tt.ceiling)
+		}
+	}
+	if delay := backoffDelay(3, 0, 0); delay != 0 {
+		t.Errorf("without delays configured: got %v, want 0", delay)
+	}
+}
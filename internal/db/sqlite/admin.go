@@ -0,0 +1,148 @@
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+func (s *Store) AddWebhook(ctx context.Context, url string) error {
+	if _, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO webhooks (tenant, url) VALUES (?, ?)`, s.tenant, url); err != nil {
+		return fmt.Errorf("Error registering webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) RemoveWebhook(ctx context.Context, url string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM webhooks WHERE tenant = ? AND url = ?`, s.tenant, url); err != nil {
+		return fmt.Errorf("Error removing webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) ListWebhooks(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT url FROM webhooks WHERE tenant = ? ORDER BY url`, s.tenant)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing webhooks: %w", err)
+	}
+	defer rows.Close()
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, fmt.Errorf("Error listing webhooks: %w", err)
+		}
+		urls = append(urls, url)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error listing webhooks: %w", err)
+	}
+	return urls, nil
+}
+
+// SaveCampaign creates the campaign or replaces the one with the same ID
+func (s *Store) SaveCampaign(ctx context.Context, c db.Campaign) error {
+	value, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("Error encoding campaign: %v", err)
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT OR REPLACE INTO campaigns (tenant, id, record, start_date) VALUES (?, ?, ?, ?)`,
+		s.tenant, c.ID, value, c.StartDate)
+	if err != nil {
+		return fmt.Errorf("Error saving campaign: %w", err)
+	}
+	return nil
+}
+
+// DeleteCampaign removes the campaign, db.ErrNotFound when there is no such campaign
+func (s *Store) DeleteCampaign(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM campaigns WHERE tenant = ? AND id = ?`, s.tenant, id)
+	if err != nil {
+		return fmt.Errorf("Error deleting campaign: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("Error deleting campaign: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("Error deleting campaign %s: %w", id, db.ErrNotFound)
+	}
+	return nil
+}
+
+// ListCampaigns returns every campaign ordered by start date, then id
+func (s *Store) ListCampaigns(ctx context.Context) ([]db.Campaign, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT record FROM campaigns WHERE tenant = ? ORDER BY start_date, id`, s.tenant)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing campaigns: %w", err)
+	}
+	defer rows.Close()
+	campaigns := []db.Campaign{}
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("Error listing campaigns: %w", err)
+		}
+		var c db.Campaign
+		if err := json.Unmarshal(value, &c); err != nil {
+			return nil, fmt.Errorf("Error decoding campaign: %v", err)
+		}
+		campaigns = append(campaigns, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error listing campaigns: %w", err)
+	}
+	return campaigns, nil
+}
+
+// SaveRetailer creates the retailer or replaces the one with the same ID
+func (s *Store) SaveRetailer(ctx context.Context, r db.Retailer) error {
+	value, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("Error encoding retailer: %v", err)
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT OR REPLACE INTO retailers (tenant, id, record) VALUES (?, ?, ?)`, s.tenant, r.ID, value)
+	if err != nil {
+		return fmt.Errorf("Error saving retailer: %w", err)
+	}
+	return nil
+}
+
+// DeleteRetailer removes the retailer, db.ErrNotFound when there is no such retailer
+func (s *Store) DeleteRetailer(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM retailers WHERE tenant = ? AND id = ?`, s.tenant, id)
+	if err != nil {
+		return fmt.Errorf("Error deleting retailer: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("Error deleting retailer: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("Error deleting retailer %s: %w", id, db.ErrNotFound)
+	}
+	return nil
+}
+
+// ListRetailers returns the whole registry ordered by id
+func (s *Store) ListRetailers(ctx context.Context) ([]db.Retailer, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT record FROM retailers WHERE tenant = ? ORDER BY id`, s.tenant)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing retailers: %w", err)
+	}
+	defer rows.Close()
+	retailers := []db.Retailer{}
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("Error listing retailers: %w", err)
+		}
+		var r db.Retailer
+		if err := json.Unmarshal(value, &r); err != nil {
+			return nil, fmt.Errorf("Error decoding retailer: %v", err)
+		}
+		retailers = append(retailers, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error listing retailers: %w", err)
+	}
+	return retailers, nil
+}
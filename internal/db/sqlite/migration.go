@@ -0,0 +1,216 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// ListUsers pages through the tenant's users by id, the cursor is the last id of the
+// previous page
+func (s *Store) ListUsers(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM users WHERE tenant = ? AND id > ? ORDER BY id LIMIT ?`,
+		s.tenant, cursor, sqlLimit(limit))
+	if err != nil {
+		return nil, "", fmt.Errorf("Error listing users: %w", err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, "", fmt.Errorf("Error listing users: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("Error listing users: %w", err)
+	}
+	if limit <= 0 || len(ids) < limit {
+		return ids, "", nil
+	}
+	return ids, ids[len(ids)-1], nil
+}
+
+// GetUserAccount reads the user's row, lots, redemptions and adjustments. Unknown users
+// have an empty account.
+func (s *Store) GetUserAccount(ctx context.Context, userID string) (db.UserAccount, error) {
+	acct := db.UserAccount{UserID: userID}
+	err := s.db.QueryRowContext(ctx, `SELECT balance, expired FROM users WHERE tenant = ? AND id = ?`, s.tenant, userID).
+		Scan(&acct.Balance, &acct.Expired)
+	if errors.Is(err, sql.ErrNoRows) {
+		return acct, nil
+	} else if err != nil {
+		return db.UserAccount{}, fmt.Errorf("Error reading user account: %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT receipt_id, points, expire_at FROM lots WHERE tenant = ? AND user_id = ?
+		ORDER BY expire_at, receipt_id`, s.tenant, userID)
+	if err != nil {
+		return db.UserAccount{}, fmt.Errorf("Error reading user lots: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var lot db.PointsLot
+		var expireAt int64
+		if err := rows.Scan(&lot.ReceiptID, &lot.Points, &expireAt); err != nil {
+			return db.UserAccount{}, fmt.Errorf("Error reading user lots: %w", err)
+		}
+		lot.ExpireAt = time.UnixMicro(expireAt).UTC()
+		acct.Lots = append(acct.Lots, lot)
+	}
+	if err := rows.Err(); err != nil {
+		return db.UserAccount{}, fmt.Errorf("Error reading user lots: %w", err)
+	}
+
+	rows, err = s.db.QueryContext(ctx, `SELECT record FROM redemptions WHERE tenant = ? AND user_id = ?
+		ORDER BY created_at, id`, s.tenant, userID)
+	if err != nil {
+		return db.UserAccount{}, fmt.Errorf("Error reading user redemptions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return db.UserAccount{}, fmt.Errorf("Error reading user redemptions: %w", err)
+		}
+		var red db.Redemption
+		if err := json.Unmarshal(value, &red); err != nil {
+			return db.UserAccount{}, fmt.Errorf("Error decoding redemption: %v", err)
+		}
+		acct.Redemptions = append(acct.Redemptions, red)
+	}
+	if err := rows.Err(); err != nil {
+		return db.UserAccount{}, fmt.Errorf("Error reading user redemptions: %w", err)
+	}
+
+	rows, err = s.db.QueryContext(ctx, `SELECT record FROM adjustments WHERE tenant = ? AND user_id = ?
+		ORDER BY created_at, id`, s.tenant, userID)
+	if err != nil {
+		return db.UserAccount{}, fmt.Errorf("Error reading user adjustments: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return db.UserAccount{}, fmt.Errorf("Error reading user adjustments: %w", err)
+		}
+		var adj db.Adjustment
+		if err := json.Unmarshal(value, &adj); err != nil {
+			return db.UserAccount{}, fmt.Errorf("Error decoding adjustment: %v", err)
+		}
+		acct.Adjustments = append(acct.Adjustments, adj)
+	}
+	if err := rows.Err(); err != nil {
+		return db.UserAccount{}, fmt.Errorf("Error reading user adjustments: %w", err)
+	}
+	return acct, nil
+}
+
+// PutUserAccount replaces the user's balances and lots with acct's in one transaction
+// and adds its redemptions and adjustments to the ledgers, like RedisStore
+func (s *Store) PutUserAccount(ctx context.Context, acct db.UserAccount) error {
+	redemptions := make([][]byte, len(acct.Redemptions))
+	for i, red := range acct.Redemptions {
+		var err error
+		if redemptions[i], err = json.Marshal(red); err != nil {
+			return fmt.Errorf("Error encoding redemption: %v", err)
+		}
+	}
+	adjustments := make([][]byte, len(acct.Adjustments))
+	for i, adj := range acct.Adjustments {
+		var err error
+		if adjustments[i], err = json.Marshal(adj); err != nil {
+			return fmt.Errorf("Error encoding adjustment: %v", err)
+		}
+	}
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO users (tenant, id, balance, expired) VALUES (?, ?, ?, ?)`,
+			s.tenant, acct.UserID, acct.Balance, acct.Expired)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM lots WHERE tenant = ? AND user_id = ?`, s.tenant, acct.UserID); err != nil {
+			return err
+		}
+		for _, lot := range acct.Lots {
+			_, err := tx.ExecContext(ctx, `INSERT INTO lots (tenant, user_id, receipt_id, points, expire_at) VALUES (?, ?, ?, ?, ?)`,
+				s.tenant, acct.UserID, lot.ReceiptID, lot.Points, lot.ExpireAt.UnixMicro())
+			if err != nil {
+				return err
+			}
+		}
+		for i, red := range acct.Redemptions {
+			_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO redemptions (tenant, user_id, id, record, created_at) VALUES (?, ?, ?, ?, ?)`,
+				s.tenant, acct.UserID, red.ID, redemptions[i], red.CreatedAt.UnixMicro())
+			if err != nil {
+				return err
+			}
+		}
+		for i, adj := range acct.Adjustments {
+			_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO adjustments (tenant, user_id, id, receipt_id, record, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+				s.tenant, acct.UserID, adj.ID, adj.ReceiptID, adjustments[i], adj.CreatedAt.UnixMicro())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing user account: %w", err)
+	}
+	return nil
+}
+
+// RestoreReceipts writes copied records without crediting their users or counting them
+// in the analytics, keeping the TTL they have left at now, like RedisStore
+func (s *Store) RestoreReceipts(ctx context.Context, recs []db.ReceiptRecord, now time.Time) error {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, rec := range recs {
+			ttl := db.RemainingTTL(s.receiptTTL(rec), rec.CreatedAt, now)
+			if ttl < 0 {
+				continue
+			}
+			score, err := purchaseScore(rec.PurchaseDate)
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(rec)
+			if err != nil {
+				return fmt.Errorf("Error encoding receipt record: %v", err)
+			}
+			var flaggedAt *int64
+			if rec.Status == db.ReceiptFlagged {
+				created := rec.CreatedAt.UnixMicro()
+				flaggedAt = &created
+			}
+			var expireAt int64
+			if ttl > 0 {
+				expireAt = now.Add(ttl).UnixMicro()
+			}
+			_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO receipts
+				(tenant, id, record, retailer, purchase_date, purchase_score, points, user_id, created_at, flagged_at, expire_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				s.tenant, rec.ID, value, db.NormalizeRetailer(rec.Retailer), rec.PurchaseDate, score, rec.Points,
+				rec.UserID, rec.CreatedAt.UnixMicro(), flaggedAt, expireAt)
+			if err != nil {
+				return err
+			}
+			if rec.UserID != "" {
+				if err := s.ensureUser(ctx, tx, rec.UserID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error restoring receipts in database: %w", err)
+	}
+	return nil
+}
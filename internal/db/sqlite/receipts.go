@@ -0,0 +1,406 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// purchaseScore turns YYYY-MM-DD into YYYYMMDD, the order the purchase date index
+// lists by
+func purchaseScore(date string) (int64, error) {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing date for index: %v", err)
+	}
+	return int64(t.Year()*10000 + int(t.Month())*100 + t.Day()), nil
+}
+
+func (s *Store) SaveReceipt(ctx context.Context, rec db.ReceiptRecord) error {
+	return s.SaveReceipts(ctx, []db.ReceiptRecord{rec})
+}
+
+// SaveReceipts saves the batch in one transaction, a record with an invalid purchase
+// date fails the whole batch like it does in Redis
+func (s *Store) SaveReceipts(ctx context.Context, recs []db.ReceiptRecord) error {
+	scores := make([]int64, len(recs))
+	values := make([][]byte, len(recs))
+	for i, rec := range recs {
+		var err error
+		if scores[i], err = purchaseScore(rec.PurchaseDate); err != nil {
+			return err
+		}
+		if values[i], err = json.Marshal(rec); err != nil {
+			return fmt.Errorf("Error encoding receipt record: %v", err)
+		}
+	}
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		for i, rec := range recs {
+			var flaggedAt *int64
+			if rec.Status == db.ReceiptFlagged {
+				created := rec.CreatedAt.UnixMicro()
+				flaggedAt = &created
+			}
+			_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO receipts
+				(tenant, id, record, retailer, purchase_date, purchase_score, points, user_id, created_at, flagged_at, expire_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				s.tenant, rec.ID, values[i], db.NormalizeRetailer(rec.Retailer), rec.PurchaseDate, scores[i], rec.Points,
+				rec.UserID, rec.CreatedAt.UnixMicro(), flaggedAt, s.expiry(s.receiptTTL(rec)))
+			if err != nil {
+				return err
+			}
+			if err := s.count(ctx, tx, rec); err != nil {
+				return err
+			}
+			if rec.UserID == "" {
+				continue
+			}
+			if err := s.ensureUser(ctx, tx, rec.UserID); err != nil {
+				return err
+			}
+			if rec.Status == "" {
+				// the receipt was credited when it was created, by the app's clock
+				if err := s.credit(ctx, tx, rec, rec.CreatedAt); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error saving receipts in database: %w", err)
+	}
+	return nil
+}
+
+// UpdateReceipts overwrites the records that still exist, keeping their TTL, and moves
+// balances and analytics by the change in points
+func (s *Store) UpdateReceipts(ctx context.Context, updates []db.ReceiptUpdate) error {
+	now := s.now()
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, u := range updates {
+			value, err := json.Marshal(u.Record)
+			if err != nil {
+				return fmt.Errorf("Error encoding receipt record: %v", err)
+			}
+			score, err := purchaseScore(u.Record.PurchaseDate)
+			if err != nil {
+				return err
+			}
+			res, err := tx.ExecContext(ctx, `UPDATE receipts SET record = ?, points = ?, retailer = ?, purchase_date = ?, purchase_score = ?
+				WHERE tenant = ? AND id = ? AND `+live,
+				value, u.Record.Points, db.NormalizeRetailer(u.Record.Retailer), u.Record.PurchaseDate, score,
+				s.tenant, u.Record.ID, now.UnixMicro())
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if from, to, moved := u.AnalyticsRetailerMove(); n > 0 && moved {
+				if err := s.moveRetailer(ctx, tx, from, to); err != nil {
+					return err
+				}
+			}
+			delta := u.Record.Points - u.OldPoints
+			awarded := 0
+			if u.Record.Status == "" {
+				awarded = delta
+			}
+			if err := s.addTotals(ctx, tx, 0, delta, awarded); err != nil {
+				return err
+			}
+			if u.Record.UserID != "" && u.Record.Status == "" && delta != 0 {
+				if err := s.creditChange(ctx, tx, u.Record, delta, now); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error updating receipts in database: %w", err)
+	}
+	return nil
+}
+
+// queryer is what reads need, a *sql.DB or a *sql.Tx
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// receipt is the live record with the id, db.ErrNotFound for unknown and expired ones
+func (s *Store) receipt(ctx context.Context, q queryer, id string) (db.ReceiptRecord, error) {
+	var value []byte
+	err := q.QueryRowContext(ctx, `SELECT record FROM receipts WHERE tenant = ? AND id = ? AND `+live,
+		s.tenant, id, s.now().UnixMicro()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return db.ReceiptRecord{}, db.ErrNotFound
+	} else if err != nil {
+		return db.ReceiptRecord{}, err
+	}
+	var rec db.ReceiptRecord
+	if err := json.Unmarshal(value, &rec); err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error decoding receipt record: %v", err)
+	}
+	return rec, nil
+}
+
+// GetReceipt fails with db.ErrNotFound for unknown and expired ids
+func (s *Store) GetReceipt(ctx context.Context, id string) (db.ReceiptRecord, error) {
+	rec, err := s.receipt(ctx, s.db, id)
+	if errors.Is(err, db.ErrNotFound) {
+		return db.ReceiptRecord{}, fmt.Errorf("Key does not exist in database: %w", err)
+	} else if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error getting key from database: %w", err)
+	}
+	return rec, nil
+}
+
+// GetReceipts returns the live records in the order of ids, leaving out the rest
+func (s *Store) GetReceipts(ctx context.Context, ids []string) ([]db.ReceiptRecord, error) {
+	records := make([]db.ReceiptRecord, 0, len(ids))
+	for _, id := range ids {
+		rec, err := s.receipt(ctx, s.db, id)
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Error fetching receipts from database: %w", err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// decodeRecords reads the record column of every row
+func decodeRecords(rows *sql.Rows) ([]db.ReceiptRecord, error) {
+	defer rows.Close()
+	records := []db.ReceiptRecord{}
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		var rec db.ReceiptRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return nil, fmt.Errorf("Error decoding receipt record: %v", err)
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// DeleteReceipt removes the receipt, and with it its place in the listings, the user's
+// history and the review queue. Balances stay.
+func (s *Store) DeleteReceipt(ctx context.Context, id string) error {
+	if _, err := s.receipt(ctx, s.db, id); err != nil {
+		return fmt.Errorf("Error deleting receipt %s: %w", id, err)
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM receipts WHERE tenant = ? AND id = ?`, s.tenant, id); err != nil {
+		return fmt.Errorf("Error deleting receipt %s: %w", id, err)
+	}
+	return nil
+}
+
+// ListReceipts pages newest first by creation time, or by purchase date when the filter
+// has dates or a canonical retailer and no retailer, the order RedisStore's indexes
+// give. Cursors only work with the store that handed them out.
+func (s *Store) ListReceipts(ctx context.Context, filter db.ListFilter) ([]db.ReceiptRecord, string, error) {
+	scoreColumn := "created_at"
+	if filter.Retailer == "" && (filter.CanonicalRetailer != "" || filter.FromDate != "" || filter.ToDate != "") {
+		scoreColumn = "purchase_score"
+	}
+	where := []string{"tenant = ?", live}
+	args := []interface{}{s.tenant, s.now().UnixMicro()}
+	if filter.Cursor != "" {
+		score, id, err := decodeCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, "("+scoreColumn+" < ? OR ("+scoreColumn+" = ? AND id < ?))")
+		args = append(args, score, score, id)
+	}
+	if filter.Retailer != "" {
+		where = append(where, "retailer = ?")
+		args = append(args, db.NormalizeRetailer(filter.Retailer))
+	}
+	if filter.CanonicalRetailer != "" {
+		// what AnalyticsRetailer gives, retailer already is the normalized name
+		where = append(where, "COALESCE(NULLIF(json_extract(record, '$.retailerId'), ''), retailer) = ?")
+		args = append(args, filter.CanonicalRetailer)
+	}
+	for _, date := range []struct {
+		value, op string
+	}{{filter.FromDate, ">="}, {filter.ToDate, "<="}} {
+		if date.value == "" {
+			continue
+		}
+		if _, err := purchaseScore(date.value); err != nil {
+			return nil, "", err
+		}
+		where = append(where, "purchase_date "+date.op+" ?")
+		args = append(args, date.value)
+	}
+	if filter.MinPoints != nil {
+		where = append(where, "points >= ?")
+		args = append(args, *filter.MinPoints)
+	}
+	if filter.MaxPoints != nil {
+		where = append(where, "points <= ?")
+		args = append(args, *filter.MaxPoints)
+	}
+	args = append(args, filter.Limit)
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+scoreColumn+`, id, record FROM receipts WHERE `+
+		strings.Join(where, " AND ")+` ORDER BY `+scoreColumn+` DESC, id DESC LIMIT ?`, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error reading receipt index: %w", err)
+	}
+	defer rows.Close()
+	var (
+		results []db.ReceiptRecord
+		score   int64
+		id      string
+	)
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&score, &id, &value); err != nil {
+			return nil, "", fmt.Errorf("Error reading receipt index: %w", err)
+		}
+		var rec db.ReceiptRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return nil, "", fmt.Errorf("Error decoding receipt record: %v", err)
+		}
+		results = append(results, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("Error reading receipt index: %w", err)
+	}
+	if filter.Limit > 0 && len(results) == filter.Limit {
+		return results, encodeCursor(score, id), nil
+	}
+	return results, "", nil
+}
+
+func encodeCursor(score int64, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(score, 10) + " " + id))
+}
+
+func decodeCursor(s string) (int64, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: %v", db.ErrInvalidCursor, err)
+	}
+	scoreText, id, ok := strings.Cut(string(raw), " ")
+	if !ok {
+		return 0, "", fmt.Errorf("%w: %q", db.ErrInvalidCursor, raw)
+	}
+	score, err := strconv.ParseInt(scoreText, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: %v", db.ErrInvalidCursor, err)
+	}
+	return score, id, nil
+}
+
+// keys are the names the tenant's data would have in Redis: receipts, tombstones, user
+// balances, campaigns, retailers and webhooks, sorted
+func (s *Store) keys(ctx context.Context) ([]string, error) {
+	var keys []string
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT 'receipt:' || id FROM receipts WHERE tenant = ? AND `+live+`
+		UNION ALL SELECT 'tombstone:' || id FROM tombstones WHERE tenant = ?
+		UNION ALL SELECT 'user:' || id || ':balance' FROM users WHERE tenant = ?
+		UNION ALL SELECT DISTINCT 'campaigns' FROM campaigns WHERE tenant = ?
+		UNION ALL SELECT DISTINCT 'retailers' FROM retailers WHERE tenant = ?
+		UNION ALL SELECT DISTINCT 'webhooks' FROM webhooks WHERE tenant = ?
+		ORDER BY 1`, s.tenant, s.now().UnixMicro(), s.tenant, s.tenant, s.tenant, s.tenant, s.tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// ScanKeys pages through the names the tenant's data would have in Redis, sorted, with
+// the cursor as an offset
+func (s *Store) ScanKeys(ctx context.Context, prefix string, cursor uint64, count int64) ([]string, uint64, error) {
+	all, err := s.keys(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error scanning keys: %w", err)
+	}
+	var keys []string
+	for _, key := range all {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, s.prefix()+key)
+		}
+	}
+	if count <= 0 {
+		count = 10
+	}
+	start := min(int(cursor), len(keys))
+	end := min(start+int(count), len(keys))
+	next := uint64(end)
+	if end == len(keys) {
+		next = 0
+	}
+	return keys[start:end], next, nil
+}
+
+// Stats counts what ScanKeys would list. Memory use is always 0, the database lives on
+// disk.
+func (s *Store) Stats(ctx context.Context) (db.StoreStats, error) {
+	keys, err := s.keys(ctx)
+	if err != nil {
+		return db.StoreStats{}, fmt.Errorf("Error reading store stats: %w", err)
+	}
+	stats := db.StoreStats{Keys: int64(len(keys))}
+	err = s.db.QueryRowContext(ctx, `SELECT
+		(SELECT COUNT(*) FROM receipts WHERE tenant = ?),
+		(SELECT COUNT(*) FROM receipts WHERE tenant = ? AND flagged_at IS NOT NULL),
+		(SELECT COUNT(*) FROM lots WHERE tenant = ?)`, s.tenant, s.tenant, s.tenant).
+		Scan(&stats.IndexedReceipts, &stats.FlaggedReceipts, &stats.ExpiringLots)
+	if err != nil {
+		return db.StoreStats{}, fmt.Errorf("Error reading store stats: %w", err)
+	}
+	return stats, nil
+}
+
+// PruneIndexes deletes the rows of receipts whose TTL ran out. They're left in place
+// until then, like Redis index entries, so it counts a flagged one twice: once for the
+// listings and once for the review queue.
+func (s *Store) PruneIndexes(ctx context.Context, progress func(checked int)) (int, error) {
+	now := s.now().UnixMicro()
+	var checked, removed int
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `SELECT
+			(SELECT COUNT(*) FROM receipts WHERE tenant = ?) + (SELECT COUNT(*) FROM receipts WHERE tenant = ? AND flagged_at IS NOT NULL),
+			(SELECT COUNT(*) FROM receipts WHERE tenant = ? AND NOT `+live+`) +
+			(SELECT COUNT(*) FROM receipts WHERE tenant = ? AND flagged_at IS NOT NULL AND NOT `+live+`)`,
+			s.tenant, s.tenant, s.tenant, now, s.tenant, now).Scan(&checked, &removed)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM receipts WHERE tenant = ? AND NOT `+live, s.tenant, now)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error reading index: %w", err)
+	}
+	progress(checked)
+	return removed, nil
+}
@@ -0,0 +1,110 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// SoftDeleteReceipt moves the receipt's row to the tombstones, out of every lookup and
+// listing. Balances stay. db.ErrNotFound for unknown, expired and already deleted ids.
+func (s *Store) SoftDeleteReceipt(ctx context.Context, id string, at time.Time) (db.ReceiptRecord, error) {
+	var rec db.ReceiptRecord
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if rec, err = s.receipt(ctx, tx, id); err != nil {
+			return err
+		}
+		deletedAt := at.UTC()
+		rec.DeletedAt = &deletedAt
+		value, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("Error encoding receipt record: %v", err)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO tombstones (tenant, id, record, deleted_at) VALUES (?, ?, ?, ?)`,
+			s.tenant, id, value, deletedAt.UnixMicro())
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM receipts WHERE tenant = ? AND id = ?`, s.tenant, id)
+		return err
+	})
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error deleting receipt %s: %w", id, err)
+	}
+	return rec, nil
+}
+
+// GetTombstone fails with db.ErrNotFound for receipts that weren't soft deleted or have
+// been purged
+func (s *Store) GetTombstone(ctx context.Context, id string) (db.ReceiptRecord, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx, `SELECT record FROM tombstones WHERE tenant = ? AND id = ?`, s.tenant, id).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return db.ReceiptRecord{}, fmt.Errorf("Key does not exist in database: %w", db.ErrNotFound)
+	} else if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error getting key from database: %w", err)
+	}
+	var rec db.ReceiptRecord
+	if err := json.Unmarshal(value, &rec); err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error decoding receipt record: %v", err)
+	}
+	return rec, nil
+}
+
+// PurgeReceipts deletes the rows of tombstones deleted before deletedBefore, then of
+// receipts created before createdBefore, oldest first and up to limit in all, like
+// RedisStore
+func (s *Store) PurgeReceipts(ctx context.Context, createdBefore, deletedBefore time.Time, limit int) (db.RetentionSweep, error) {
+	var sweep db.RetentionSweep
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if !deletedBefore.IsZero() {
+			rows, err := tx.QueryContext(ctx, `SELECT record FROM tombstones WHERE tenant = ? AND deleted_at < ?
+				ORDER BY deleted_at, id LIMIT ?`, s.tenant, deletedBefore.UnixMicro(), limit)
+			if err != nil {
+				return err
+			}
+			due, err := decodeRecords(rows)
+			if err != nil {
+				return err
+			}
+			sweep.More = len(due) == limit
+			for _, rec := range due {
+				if _, err := tx.ExecContext(ctx, `DELETE FROM tombstones WHERE tenant = ? AND id = ?`, s.tenant, rec.ID); err != nil {
+					return err
+				}
+			}
+			sweep.Purged = append(sweep.Purged, due...)
+		}
+		if createdBefore.IsZero() || len(sweep.Purged) >= limit {
+			return nil
+		}
+		left := limit - len(sweep.Purged)
+		rows, err := tx.QueryContext(ctx, `SELECT record FROM receipts WHERE tenant = ? AND created_at < ? AND `+live+`
+			ORDER BY created_at, id LIMIT ?`, s.tenant, createdBefore.UnixMicro(), s.now().UnixMicro(), left)
+		if err != nil {
+			return err
+		}
+		due, err := decodeRecords(rows)
+		if err != nil {
+			return err
+		}
+		sweep.More = sweep.More || len(due) == left
+		for _, rec := range due {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM receipts WHERE tenant = ? AND id = ?`, s.tenant, rec.ID); err != nil {
+				return err
+			}
+		}
+		sweep.Purged = append(sweep.Purged, due...)
+		return nil
+	})
+	if err != nil {
+		return db.RetentionSweep{}, fmt.Errorf("Error purging receipts: %w", err)
+	}
+	return sweep, nil
+}
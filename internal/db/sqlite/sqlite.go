@@ -0,0 +1,258 @@
+// Package sqlite is a db.Store on an embedded SQLite file, so the whole service can run
+// as one binary without a Redis: demos, edge deployments and CI. It behaves like
+// RedisStore as far as callers can tell (tenant scoping, TTLs, balances, expiring
+// points, the review queue, analytics).
+//
+// The driver is cgo, binaries built with CGO_ENABLED=0 fail to open a store.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/clock"
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Store is a SQLite backed db.Store. Views returned by ForTenant share their parent's
+// database.
+type Store struct {
+	*shared
+	// "" for the default tenant
+	tenant string
+}
+
+type shared struct {
+	db        *sql.DB
+	clock     clock.Clock
+	ttl       time.Duration
+	retention map[string]time.Duration
+}
+
+var _ db.Store = (*Store)(nil)
+
+// every table is keyed by tenant first, "" being the default tenant. times are unix
+// microseconds, an expire_at of 0 never expires
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS receipts (
+		tenant TEXT NOT NULL,
+		id TEXT NOT NULL,
+		record TEXT NOT NULL,
+		retailer TEXT NOT NULL,
+		purchase_date TEXT NOT NULL,
+		purchase_score INTEGER NOT NULL,
+		points INTEGER NOT NULL,
+		user_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		flagged_at INTEGER,
+		expire_at INTEGER NOT NULL,
+		PRIMARY KEY (tenant, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS receipts_created ON receipts (tenant, created_at, id)`,
+	`CREATE INDEX IF NOT EXISTS receipts_purchased ON receipts (tenant, purchase_score, id)`,
+	`CREATE INDEX IF NOT EXISTS receipts_user ON receipts (tenant, user_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS tombstones (
+		tenant TEXT NOT NULL,
+		id TEXT NOT NULL,
+		record TEXT NOT NULL,
+		deleted_at INTEGER NOT NULL,
+		PRIMARY KEY (tenant, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS tombstones_deleted ON tombstones (tenant, deleted_at, id)`,
+	`CREATE TABLE IF NOT EXISTS users (
+		tenant TEXT NOT NULL,
+		id TEXT NOT NULL,
+		balance INTEGER NOT NULL DEFAULT 0,
+		expired INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (tenant, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS lots (
+		tenant TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		receipt_id TEXT NOT NULL,
+		points INTEGER NOT NULL,
+		expire_at INTEGER NOT NULL,
+		PRIMARY KEY (tenant, user_id, receipt_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS lots_due ON lots (tenant, expire_at)`,
+	`CREATE TABLE IF NOT EXISTS redemptions (
+		tenant TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		id TEXT NOT NULL,
+		record TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (tenant, user_id, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS adjustments (
+		tenant TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		id TEXT NOT NULL,
+		receipt_id TEXT NOT NULL,
+		record TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (tenant, user_id, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS adjustments_receipt ON adjustments (tenant, user_id, receipt_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS fingerprints (
+		tenant TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		receipt_id TEXT NOT NULL,
+		expire_at INTEGER NOT NULL,
+		PRIMARY KEY (tenant, fingerprint)
+	)`,
+	`CREATE TABLE IF NOT EXISTS submission_locks (
+		tenant TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		receipt_id TEXT NOT NULL,
+		expire_at INTEGER NOT NULL,
+		PRIMARY KEY (tenant, hash)
+	)`,
+	`CREATE TABLE IF NOT EXISTS submissions (
+		tenant TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		receipt_id TEXT NOT NULL,
+		submitted_at INTEGER NOT NULL,
+		PRIMARY KEY (tenant, user_id, receipt_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS usage (
+		tenant TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value INTEGER NOT NULL,
+		expire_at INTEGER NOT NULL,
+		PRIMARY KEY (tenant, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS analytics_totals (
+		tenant TEXT NOT NULL PRIMARY KEY,
+		receipts INTEGER NOT NULL DEFAULT 0,
+		scored_points INTEGER NOT NULL DEFAULT 0,
+		awarded_points INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS analytics_days (
+		tenant TEXT NOT NULL,
+		day TEXT NOT NULL,
+		receipts INTEGER NOT NULL,
+		points INTEGER NOT NULL,
+		PRIMARY KEY (tenant, day)
+	)`,
+	`CREATE TABLE IF NOT EXISTS analytics_retailers (
+		tenant TEXT NOT NULL,
+		retailer TEXT NOT NULL,
+		receipts INTEGER NOT NULL,
+		PRIMARY KEY (tenant, retailer)
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		tenant TEXT NOT NULL,
+		url TEXT NOT NULL,
+		PRIMARY KEY (tenant, url)
+	)`,
+	`CREATE TABLE IF NOT EXISTS campaigns (
+		tenant TEXT NOT NULL,
+		id TEXT NOT NULL,
+		record TEXT NOT NULL,
+		start_date TEXT NOT NULL,
+		PRIMARY KEY (tenant, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS retailers (
+		tenant TEXT NOT NULL,
+		id TEXT NOT NULL,
+		record TEXT NOT NULL,
+		PRIMARY KEY (tenant, id)
+	)`,
+}
+
+// Option configures a Store
+type Option func(*shared)
+
+// WithClock sets the clock TTLs and fingerprint windows go by, the real one by default
+func WithClock(c clock.Clock) Option {
+	return func(s *shared) { s.clock = c }
+}
+
+// Open opens (creating it if needed) the database at SQLITE_PATH. ":memory:" is a
+// database that lives as long as the Store. Receipts expire after REDIS_TTL_IN_S or
+// their retention class's TTL, like they do in Redis.
+func Open(cfg config.Config, opts ...Option) (*Store, error) {
+	conn, err := sql.Open("sqlite3", "file:"+cfg.SQLitePath+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("Error opening SQLite database: %v", err)
+	}
+	// one connection: writes are serialized anyway, and an in-memory database only
+	// exists on the connection that created it
+	conn.SetMaxOpenConns(1)
+	s := &shared{db: conn, clock: clock.Real, ttl: cfg.RedisTTLInSec, retention: cfg.ReceiptRetention}
+	for _, opt := range opts {
+		opt(s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, stmt := range schema {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Error creating SQLite schema: %v", err)
+		}
+	}
+	return &Store{shared: s}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) ForTenant(tenantID string) db.Store {
+	return &Store{shared: s.shared, tenant: tenantID}
+}
+
+// prefix is what the tenant's keys start with in Redis, for ScanKeys
+func (s *Store) prefix() string {
+	if s.tenant == "" {
+		return ""
+	}
+	return "tenant:" + s.tenant + ":"
+}
+
+func (s *Store) CheckConnection(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// inTx runs fn in a transaction, committed when fn returns nil
+func (s *Store) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) now() time.Time {
+	return s.clock.Now()
+}
+
+// expiry is when something saved now with ttl expires, 0 for never
+func (s *Store) expiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return s.now().Add(ttl).UnixMicro()
+}
+
+// receiptTTL is RedisStore's: the receipt's retention class's TTL when it has one,
+// REDIS_TTL_IN_S otherwise
+func (s *Store) receiptTTL(rec db.ReceiptRecord) time.Duration {
+	if ttl, ok := s.retention[rec.Retention]; ok && rec.Retention != "" {
+		return ttl
+	}
+	return s.ttl
+}
+
+// live is the condition for rows whose TTL hasn't run out, its argument is now in unix
+// microseconds
+const live = `(expire_at = 0 OR expire_at > ?)`
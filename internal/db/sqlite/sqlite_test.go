@@ -0,0 +1,88 @@
+package sqlite_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/clock"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/sqlite"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/storetest"
+	"github.com/jayreddy040-510/receipt_processor/internal/testutil"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// TestMatchesRedisStore runs the same calls against SQLite and a RedisStore on
+// miniredis and expects the same answers from both
+func TestMatchesRedisStore(t *testing.T) {
+	cfg := testutil.Config(t, miniredis.RunT(t).Addr(), map[string]string{"REDIS_TTL_IN_S": "0"})
+	redisStore := db.NewRedisStore(cfg)
+	t.Cleanup(func() { redisStore.Close() })
+
+	cfg.SQLitePath = t.TempDir() + "/receipts.db"
+	store, err := sqlite.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	want := storetest.Script(t, redisStore)
+	storetest.Compare(t, storetest.Script(t, store), want)
+}
+
+func TestReceiptsExpire(t *testing.T) {
+	cfg := testutil.Config(t, "127.0.0.1:0", map[string]string{
+		"REDIS_TTL_IN_S":         "600",
+		"RECEIPT_RETENTION_IN_S": "keep=0",
+		"SQLITE_PATH":            ":memory:",
+	})
+	now := clock.NewFrozen(testutil.Now)
+	store, err := sqlite.Open(cfg, sqlite.WithClock(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	ctx := context.Background()
+	expiring := db.ReceiptRecord{ID: "expiring", PurchaseDate: "2024-01-01", CreatedAt: testutil.Now}
+	kept := db.ReceiptRecord{ID: "kept", PurchaseDate: "2024-01-01", CreatedAt: testutil.Now, Retention: "keep"}
+	if err := store.SaveReceipts(ctx, []db.ReceiptRecord{expiring, kept}); err != nil {
+		t.Fatal(err)
+	}
+	now.Advance(600 * time.Second)
+	if _, err := store.GetReceipt(ctx, "expiring"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("after the TTL: got %v, want db.ErrNotFound", err)
+	}
+	if _, err := store.GetReceipt(ctx, "kept"); err != nil {
+		t.Errorf("a receipt kept forever: %v", err)
+	}
+	if removed, err := store.PruneIndexes(ctx, func(int) {}); err != nil || removed != 1 {
+		t.Errorf("prune: got %d, %v, want 1 removed", removed, err)
+	}
+}
+
+func TestReopenKeepsReceipts(t *testing.T) {
+	cfg := testutil.Config(t, "127.0.0.1:0", map[string]string{"SQLITE_PATH": t.TempDir() + "/receipts.db"})
+	ctx := context.Background()
+	store, err := sqlite.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := db.ReceiptRecord{ID: "r1", Retailer: "Target", PurchaseDate: "2024-01-01", Points: 28, CreatedAt: testutil.Now, UserID: "u1"}
+	if err := store.SaveReceipt(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	if store, err = sqlite.Open(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	points, err := store.GetUserPoints(ctx, "u1", 10)
+	if err != nil || points.Balance != 28 || len(points.Receipts) != 1 {
+		t.Fatalf("after reopening: got %+v, %v, want a balance of 28 and r1", points, err)
+	}
+}
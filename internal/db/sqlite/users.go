@@ -0,0 +1,658 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+func (s *Store) ensureUser(ctx context.Context, tx *sql.Tx, userID string) error {
+	_, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO users (tenant, id) VALUES (?, ?)`, s.tenant, userID)
+	return err
+}
+
+// credit is RedisStore's queueCredit: points that already expired go straight to the
+// expired total, expiring ones become a lot
+func (s *Store) credit(ctx context.Context, tx *sql.Tx, rec db.ReceiptRecord, now time.Time) error {
+	if err := s.ensureUser(ctx, tx, rec.UserID); err != nil {
+		return err
+	}
+	if rec.PointsExpireAt != nil && !rec.PointsExpireAt.After(now) {
+		_, err := tx.ExecContext(ctx, `UPDATE users SET expired = expired + ? WHERE tenant = ? AND id = ?`, rec.Points, s.tenant, rec.UserID)
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET balance = balance + ? WHERE tenant = ? AND id = ?`, rec.Points, s.tenant, rec.UserID); err != nil {
+		return err
+	}
+	if rec.PointsExpireAt == nil {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO lots (tenant, user_id, receipt_id, points, expire_at) VALUES (?, ?, ?, ?, ?)`,
+		s.tenant, rec.UserID, rec.ID, rec.Points, rec.PointsExpireAt.UnixMicro())
+	return err
+}
+
+// creditChange is RedisStore's creditDelta
+func (s *Store) creditChange(ctx context.Context, tx *sql.Tx, rec db.ReceiptRecord, delta int, now time.Time) error {
+	if rec.PointsExpireAt != nil && !rec.PointsExpireAt.After(now) {
+		return nil
+	}
+	if err := s.ensureUser(ctx, tx, rec.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET balance = balance + ? WHERE tenant = ? AND id = ?`, delta, s.tenant, rec.UserID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `UPDATE lots SET points = points + ? WHERE tenant = ? AND user_id = ? AND receipt_id = ?`,
+		delta, s.tenant, rec.UserID, rec.ID)
+	return err
+}
+
+// GetUserPoints returns the balance and up to historyLimit of the user's receipts that
+// haven't expired, newest first
+func (s *Store) GetUserPoints(ctx context.Context, userID string, historyLimit int) (db.UserPoints, error) {
+	points := db.UserPoints{UserID: userID, Receipts: []db.ReceiptRecord{}}
+	err := s.db.QueryRowContext(ctx, `SELECT balance, expired FROM users WHERE tenant = ? AND id = ?`, s.tenant, userID).
+		Scan(&points.Balance, &points.Expired)
+	if errors.Is(err, sql.ErrNoRows) {
+		return points, nil
+	} else if err != nil {
+		return db.UserPoints{}, fmt.Errorf("Error reading user points: %w", err)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT record FROM receipts WHERE tenant = ? AND user_id = ? AND `+live+`
+		ORDER BY created_at DESC, id DESC LIMIT ?`, s.tenant, userID, s.now().UnixMicro(), sqlLimit(historyLimit))
+	if err == nil {
+		points.Receipts, err = decodeRecords(rows)
+	}
+	if err != nil {
+		return db.UserPoints{}, fmt.Errorf("Error reading user history: %w", err)
+	}
+	return points, nil
+}
+
+// sqlLimit is a LIMIT for limit, where 0 means all of them
+func sqlLimit(limit int) int {
+	if limit <= 0 {
+		return -1
+	}
+	return limit
+}
+
+// Redeem follows RedisStore.Redeem: replays of a redemption id return the original,
+// db.ErrRedemptionConflict when they differ, db.ErrInsufficientPoints when the balance
+// is short
+func (s *Store) Redeem(ctx context.Context, red db.Redemption) (db.Redemption, bool, error) {
+	var isNew bool
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.ensureUser(ctx, tx, red.UserID); err != nil {
+			return err
+		}
+		var value []byte
+		err := tx.QueryRowContext(ctx, `SELECT record FROM redemptions WHERE tenant = ? AND user_id = ? AND id = ?`,
+			s.tenant, red.UserID, red.ID).Scan(&value)
+		if err == nil {
+			var existing db.Redemption
+			if err := json.Unmarshal(value, &existing); err != nil {
+				return fmt.Errorf("Error decoding redemption: %v", err)
+			}
+			if existing.Points != red.Points || existing.Reward != red.Reward {
+				return fmt.Errorf("Error redeeming %s: %w", red.ID, db.ErrRedemptionConflict)
+			}
+			red = existing
+			return nil
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		var balance int
+		if err := tx.QueryRowContext(ctx, `SELECT balance FROM users WHERE tenant = ? AND id = ?`, s.tenant, red.UserID).Scan(&balance); err != nil {
+			return err
+		}
+		if balance < red.Points {
+			return fmt.Errorf("Error redeeming %d points with a balance of %d: %w", red.Points, balance, db.ErrInsufficientPoints)
+		}
+		red.BalanceAfter = balance - red.Points
+		if value, err = json.Marshal(red); err != nil {
+			return fmt.Errorf("Error encoding redemption: %v", err)
+		}
+		// handed back the way it's stored, decoded from JSON
+		if err := json.Unmarshal(value, &red); err != nil {
+			return fmt.Errorf("Error decoding redemption: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET balance = ? WHERE tenant = ? AND id = ?`, red.BalanceAfter, s.tenant, red.UserID); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO redemptions (tenant, user_id, id, record, created_at) VALUES (?, ?, ?, ?, ?)`,
+			s.tenant, red.UserID, red.ID, value, red.CreatedAt.UnixMicro())
+		isNew = err == nil
+		return err
+	})
+	if err != nil {
+		return db.Redemption{}, false, fmt.Errorf("Error redeeming points: %w", err)
+	}
+	return red, isNew, nil
+}
+
+// ListRedemptions returns up to limit of the user's latest redemptions, newest first
+func (s *Store) ListRedemptions(ctx context.Context, userID string, limit int) ([]db.Redemption, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT record FROM redemptions WHERE tenant = ? AND user_id = ?
+		ORDER BY created_at DESC, id DESC LIMIT ?`, s.tenant, userID, sqlLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing redemptions: %w", err)
+	}
+	defer rows.Close()
+	redemptions := []db.Redemption{}
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("Error listing redemptions: %w", err)
+		}
+		var red db.Redemption
+		if err := json.Unmarshal(value, &red); err != nil {
+			return nil, fmt.Errorf("Error decoding redemption: %v", err)
+		}
+		redemptions = append(redemptions, red)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error listing redemptions: %w", err)
+	}
+	return redemptions, nil
+}
+
+// Adjust follows RedisStore.Adjust: replays of an adjustment id return the original,
+// db.ErrAdjustmentConflict when they differ, db.ErrInsufficientPoints when a clawback
+// is more than the balance, db.ErrTooManyAdjustments and db.ErrReceiptOverdrawn when
+// the receipt as stored can't take it, db.ErrNotFound without the receipt
+func (s *Store) Adjust(ctx context.Context, adj db.Adjustment) (db.Adjustment, bool, error) {
+	var isNew bool
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.ensureUser(ctx, tx, adj.UserID); err != nil {
+			return err
+		}
+		var value []byte
+		err := tx.QueryRowContext(ctx, `SELECT record FROM adjustments WHERE tenant = ? AND user_id = ? AND id = ?`,
+			s.tenant, adj.UserID, adj.ID).Scan(&value)
+		if err == nil {
+			var existing db.Adjustment
+			if err := json.Unmarshal(value, &existing); err != nil {
+				return fmt.Errorf("Error decoding adjustment: %v", err)
+			}
+			if existing.Points != adj.Points || existing.ReceiptID != adj.ReceiptID || existing.Reason != adj.Reason {
+				return fmt.Errorf("Error adjusting %s: %w", adj.ID, db.ErrAdjustmentConflict)
+			}
+			adj = existing
+			return nil
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if adj.ReceiptID != "" {
+			if err := s.checkReceiptAdjustment(ctx, tx, adj); err != nil {
+				return err
+			}
+		}
+
+		var balance int
+		if err := tx.QueryRowContext(ctx, `SELECT balance FROM users WHERE tenant = ? AND id = ?`, s.tenant, adj.UserID).Scan(&balance); err != nil {
+			return err
+		}
+		if balance+adj.Points < 0 {
+			return fmt.Errorf("Error adjusting by %d points with a balance of %d: %w", adj.Points, balance, db.ErrInsufficientPoints)
+		}
+		adj.BalanceAfter = balance + adj.Points
+		if value, err = json.Marshal(adj); err != nil {
+			return fmt.Errorf("Error encoding adjustment: %v", err)
+		}
+		// handed back the way it's stored, decoded from JSON
+		if err := json.Unmarshal(value, &adj); err != nil {
+			return fmt.Errorf("Error decoding adjustment: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET balance = ? WHERE tenant = ? AND id = ?`, adj.BalanceAfter, s.tenant, adj.UserID); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO adjustments (tenant, user_id, id, receipt_id, record, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			s.tenant, adj.UserID, adj.ID, adj.ReceiptID, value, adj.CreatedAt.UnixMicro())
+		isNew = err == nil
+		return err
+	})
+	if err != nil {
+		return db.Adjustment{}, false, fmt.Errorf("Error adjusting points: %w", err)
+	}
+	return adj, isNew, nil
+}
+
+// checkReceiptAdjustment holds adj to db.MaxReceiptAdjustments for its receipt, and
+// the receipt's points plus adjustments to zero or more
+func (s *Store) checkReceiptAdjustment(ctx context.Context, tx *sql.Tx, adj db.Adjustment) error {
+	rec, err := s.receipt(ctx, tx, adj.ReceiptID)
+	if err != nil {
+		return fmt.Errorf("Error adjusting receipt %s: %w", adj.ReceiptID, err)
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT record FROM adjustments WHERE tenant = ? AND user_id = ? AND receipt_id = ?`,
+		s.tenant, adj.UserID, adj.ReceiptID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	count, total := 0, rec.Points
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return err
+		}
+		var other db.Adjustment
+		if err := json.Unmarshal(value, &other); err != nil {
+			return fmt.Errorf("Error decoding adjustment: %v", err)
+		}
+		count++
+		total += other.Points
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if count >= db.MaxReceiptAdjustments {
+		return fmt.Errorf("Error adjusting receipt %s with %d adjustments: %w", adj.ReceiptID, count, db.ErrTooManyAdjustments)
+	}
+	if total+adj.Points < 0 {
+		return fmt.Errorf("Error adjusting receipt %s by %d points with %d left: %w", adj.ReceiptID, adj.Points, total, db.ErrReceiptOverdrawn)
+	}
+	return nil
+}
+
+// ListAdjustments returns up to limit of the user's latest adjustments, newest first,
+// only the ones of receiptID unless that's empty
+func (s *Store) ListAdjustments(ctx context.Context, userID, receiptID string, limit int) ([]db.Adjustment, error) {
+	query := `SELECT record FROM adjustments WHERE tenant = ? AND user_id = ?`
+	args := []interface{}{s.tenant, userID}
+	if receiptID != "" {
+		query += ` AND receipt_id = ?`
+		args = append(args, receiptID)
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY created_at DESC, id DESC LIMIT ?`, append(args, sqlLimit(limit))...)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing adjustments: %w", err)
+	}
+	defer rows.Close()
+	adjustments := []db.Adjustment{}
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("Error listing adjustments: %w", err)
+		}
+		var adj db.Adjustment
+		if err := json.Unmarshal(value, &adj); err != nil {
+			return nil, fmt.Errorf("Error decoding adjustment: %v", err)
+		}
+		adjustments = append(adjustments, adj)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error listing adjustments: %w", err)
+	}
+	return adjustments, nil
+}
+
+// ExpirePoints expires the points of up to limit lots due by now, like RedisStore's
+// expire script: a user's due lots go oldest first and only lose what the balance holds
+// beyond their younger lots
+func (s *Store) ExpirePoints(ctx context.Context, now time.Time, limit int) (db.ExpirySweep, error) {
+	var sweep db.ExpirySweep
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT user_id FROM lots WHERE tenant = ? AND expire_at <= ?
+			ORDER BY expire_at LIMIT ?`, s.tenant, now.UnixMicro(), limit)
+		if err != nil {
+			return err
+		}
+		var users []string
+		seen := make(map[string]bool)
+		var due int
+		for rows.Next() {
+			var userID string
+			if err := rows.Scan(&userID); err != nil {
+				rows.Close()
+				return err
+			}
+			due++
+			if !seen[userID] {
+				seen[userID] = true
+				users = append(users, userID)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		sweep.More = due == limit
+		for _, userID := range users {
+			expired, err := s.expireUser(ctx, tx, userID, now)
+			if err != nil {
+				return err
+			}
+			sweep.Users++
+			sweep.Points += expired
+		}
+		return nil
+	})
+	if err != nil {
+		return db.ExpirySweep{}, fmt.Errorf("Error expiring points: %w", err)
+	}
+	return sweep, nil
+}
+
+// expireUser expires the user's lots that are due and returns how many points that
+// took
+func (s *Store) expireUser(ctx context.Context, tx *sql.Tx, userID string, now time.Time) (int, error) {
+	var balance, active int
+	err := tx.QueryRowContext(ctx, `SELECT balance, (SELECT COALESCE(SUM(points), 0) FROM lots WHERE tenant = ? AND user_id = ?)
+		FROM users WHERE tenant = ? AND id = ?`, s.tenant, userID, s.tenant, userID).Scan(&balance, &active)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT points FROM lots WHERE tenant = ? AND user_id = ? AND expire_at <= ?
+		ORDER BY expire_at, receipt_id`, s.tenant, userID, now.UnixMicro())
+	if err != nil {
+		return 0, err
+	}
+	var expired int
+	for rows.Next() {
+		var points int
+		if err := rows.Scan(&points); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		active -= points
+		if left := min(points, balance-active); left > 0 {
+			balance -= left
+			expired += left
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM lots WHERE tenant = ? AND user_id = ? AND expire_at <= ?`, s.tenant, userID, now.UnixMicro()); err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE users SET balance = ?, expired = expired + ? WHERE tenant = ? AND id = ?`,
+		balance, expired, s.tenant, userID)
+	return expired, err
+}
+
+// ClaimFingerprint returns the id holding the fingerprint, "" when id got it (or
+// already had it)
+func (s *Store) ClaimFingerprint(ctx context.Context, fingerprint, id string, window time.Duration) (string, error) {
+	var holder string
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `SELECT receipt_id FROM fingerprints WHERE tenant = ? AND fingerprint = ? AND `+live,
+			s.tenant, fingerprint, s.now().UnixMicro()).Scan(&holder)
+		if err == nil {
+			if holder == id {
+				holder = ""
+			}
+			return nil
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO fingerprints (tenant, fingerprint, receipt_id, expire_at) VALUES (?, ?, ?, ?)`,
+			s.tenant, fingerprint, id, s.expiry(window))
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error claiming receipt fingerprint: %w", err)
+	}
+	return holder, nil
+}
+
+func (s *Store) ReleaseFingerprint(ctx context.Context, fingerprint, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM fingerprints WHERE tenant = ? AND fingerprint = ? AND receipt_id = ?`,
+		s.tenant, fingerprint, id)
+	if err != nil {
+		return fmt.Errorf("Error releasing receipt fingerprint: %w", err)
+	}
+	return nil
+}
+
+// LockSubmission returns the id holding the lock, "" when id got it (or already had
+// it)
+func (s *Store) LockSubmission(ctx context.Context, hash, id string, ttl time.Duration) (string, error) {
+	var holder string
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `SELECT receipt_id FROM submission_locks WHERE tenant = ? AND hash = ? AND `+live,
+			s.tenant, hash, s.now().UnixMicro()).Scan(&holder)
+		if err == nil {
+			if holder == id {
+				holder = ""
+			}
+			return nil
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO submission_locks (tenant, hash, receipt_id, expire_at) VALUES (?, ?, ?, ?)`,
+			s.tenant, hash, id, s.expiry(ttl))
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error locking submission: %w", err)
+	}
+	return holder, nil
+}
+
+func (s *Store) UnlockSubmission(ctx context.Context, hash, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM submission_locks WHERE tenant = ? AND hash = ? AND receipt_id = ?`,
+		s.tenant, hash, id)
+	if err != nil {
+		return fmt.Errorf("Error unlocking submission: %w", err)
+	}
+	return nil
+}
+
+// CountSubmission records the submission and counts the user's submissions in the
+// window up to now, this one included
+func (s *Store) CountSubmission(ctx context.Context, userID, id string, now time.Time, window time.Duration) (int, error) {
+	var count int
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM submissions WHERE tenant = ? AND user_id = ? AND submitted_at <= ?`,
+			s.tenant, userID, now.Add(-window).UnixMicro())
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO submissions (tenant, user_id, receipt_id, submitted_at) VALUES (?, ?, ?, ?)`,
+			s.tenant, userID, id, now.UnixMicro())
+		if err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM submissions WHERE tenant = ? AND user_id = ?`, s.tenant, userID).Scan(&count)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error counting user submissions: %w", err)
+	}
+	return count, nil
+}
+
+// ListFlagged returns up to limit receipts waiting for review, oldest first
+func (s *Store) ListFlagged(ctx context.Context, limit int) ([]db.ReceiptRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT record FROM receipts WHERE tenant = ? AND flagged_at IS NOT NULL AND `+live+`
+		ORDER BY flagged_at, id LIMIT ?`, s.tenant, s.now().UnixMicro(), sqlLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing flagged receipts: %w", err)
+	}
+	records, err := decodeRecords(rows)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing flagged receipts: %w", err)
+	}
+	return records, nil
+}
+
+// ResolveFlagged approves or rejects a flagged receipt, db.ErrNotFound when it isn't
+// waiting for review
+func (s *Store) ResolveFlagged(ctx context.Context, id string, approve bool) (db.ReceiptRecord, error) {
+	var rec db.ReceiptRecord
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE receipts SET flagged_at = NULL WHERE tenant = ? AND id = ? AND flagged_at IS NOT NULL`, s.tenant, id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return db.ErrNotFound
+		}
+		if rec, err = s.receipt(ctx, tx, id); err != nil {
+			return err
+		}
+		rec.Status = db.ReceiptRejected
+		if approve {
+			rec.Status = ""
+			if err := s.addTotals(ctx, tx, 0, 0, rec.Points); err != nil {
+				return err
+			}
+			if rec.UserID != "" {
+				if err := s.credit(ctx, tx, rec, s.now()); err != nil {
+					return err
+				}
+			}
+		}
+		value, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("Error encoding receipt record: %v", err)
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE receipts SET record = ? WHERE tenant = ? AND id = ?`, value, s.tenant, id)
+		return err
+	})
+	if err != nil {
+		return db.ReceiptRecord{}, fmt.Errorf("Error resolving flagged receipt %s: %w", id, err)
+	}
+	return rec, nil
+}
+
+// AddUsage adds n to the named counter and returns its new value. The counter expires
+// ttl after it was created.
+func (s *Store) AddUsage(ctx context.Context, name string, n int, ttl time.Duration) (int, error) {
+	var value int
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		expireAt := s.expiry(ttl)
+		err := tx.QueryRowContext(ctx, `SELECT value, expire_at FROM usage WHERE tenant = ? AND name = ? AND `+live,
+			s.tenant, name, s.now().UnixMicro()).Scan(&value, &expireAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		value += n
+		_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO usage (tenant, name, value, expire_at) VALUES (?, ?, ?, ?)`,
+			s.tenant, name, value, expireAt)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error counting usage: %w", err)
+	}
+	return value, nil
+}
+
+// GetUsage reads the named counters that haven't expired
+func (s *Store) GetUsage(ctx context.Context, names []string) (map[string]int, error) {
+	usage := make(map[string]int, len(names))
+	for _, name := range names {
+		var value int
+		err := s.db.QueryRowContext(ctx, `SELECT value FROM usage WHERE tenant = ? AND name = ? AND `+live,
+			s.tenant, name, s.now().UnixMicro()).Scan(&value)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading usage: %w", err)
+		}
+		usage[name] = value
+	}
+	return usage, nil
+}
+
+// addTotals moves the analytics totals
+func (s *Store) addTotals(ctx context.Context, tx *sql.Tx, receipts, scored, awarded int) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO analytics_totals (tenant, receipts, scored_points, awarded_points) VALUES (?, ?, ?, ?)
+		ON CONFLICT (tenant) DO UPDATE SET receipts = receipts + excluded.receipts,
+			scored_points = scored_points + excluded.scored_points, awarded_points = awarded_points + excluded.awarded_points`,
+		s.tenant, receipts, scored, awarded)
+	return err
+}
+
+// count adds a newly saved receipt to the analytics. Retailers are counted by their
+// normalized name, the one the listings filter on.
+func (s *Store) count(ctx context.Context, tx *sql.Tx, rec db.ReceiptRecord) error {
+	awarded := 0
+	if rec.Status == "" {
+		awarded = rec.Points
+	}
+	if err := s.addTotals(ctx, tx, 1, rec.Points, awarded); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO analytics_days (tenant, day, receipts, points) VALUES (?, ?, 1, ?)
+		ON CONFLICT (tenant, day) DO UPDATE SET receipts = receipts + 1, points = points + excluded.points`,
+		s.tenant, rec.CreatedAt.UTC().Format("2006-01-02"), rec.Points)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO analytics_retailers (tenant, retailer, receipts) VALUES (?, ?, 1)
+		ON CONFLICT (tenant, retailer) DO UPDATE SET receipts = receipts + 1`,
+		s.tenant, rec.AnalyticsRetailer())
+	return err
+}
+
+// moveRetailer counts a corrected receipt under its new retailer instead of the old
+// one, both as AnalyticsRetailer has them. Retailers left without receipts drop out of
+// the ranking.
+func (s *Store) moveRetailer(ctx context.Context, tx *sql.Tx, from, to string) error {
+	_, err := tx.ExecContext(ctx, `UPDATE analytics_retailers SET receipts = receipts - 1 WHERE tenant = ? AND retailer = ?`,
+		s.tenant, from)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM analytics_retailers WHERE tenant = ? AND retailer = ? AND receipts <= 0`,
+		s.tenant, from)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO analytics_retailers (tenant, retailer, receipts) VALUES (?, ?, 1)
+		ON CONFLICT (tenant, retailer) DO UPDATE SET receipts = receipts + 1`,
+		s.tenant, to)
+	return err
+}
+
+func (s *Store) GetAnalytics(ctx context.Context, days []string, topRetailers int) (db.Analytics, error) {
+	analytics := db.Analytics{
+		Days:         make([]db.DayAnalytics, len(days)),
+		TopRetailers: []db.RetailerAnalytics{},
+	}
+	err := s.db.QueryRowContext(ctx, `SELECT receipts, scored_points, awarded_points FROM analytics_totals WHERE tenant = ?`, s.tenant).
+		Scan(&analytics.Receipts, &analytics.ScoredPoints, &analytics.PointsAwarded)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return db.Analytics{}, fmt.Errorf("Error reading analytics: %w", err)
+	}
+	for i, date := range days {
+		analytics.Days[i].Date = date
+		err := s.db.QueryRowContext(ctx, `SELECT receipts, points FROM analytics_days WHERE tenant = ? AND day = ?`, s.tenant, date).
+			Scan(&analytics.Days[i].Receipts, &analytics.Days[i].Points)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return db.Analytics{}, fmt.Errorf("Error reading analytics: %w", err)
+		}
+	}
+	// most receipts first, ties in reverse name order like ZREVRANGE
+	rows, err := s.db.QueryContext(ctx, `SELECT retailer, receipts FROM analytics_retailers WHERE tenant = ?
+		ORDER BY receipts DESC, retailer DESC LIMIT ?`, s.tenant, topRetailers)
+	if err != nil {
+		return db.Analytics{}, fmt.Errorf("Error reading analytics: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var retailer db.RetailerAnalytics
+		if err := rows.Scan(&retailer.Retailer, &retailer.Receipts); err != nil {
+			return db.Analytics{}, fmt.Errorf("Error reading analytics: %w", err)
+		}
+		analytics.TopRetailers = append(analytics.TopRetailers, retailer)
+	}
+	if err := rows.Err(); err != nil {
+		return db.Analytics{}, fmt.Errorf("Error reading analytics: %w", err)
+	}
+	return analytics, nil
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Store is what the app needs from persistence. RedisStore is the implementation used
+// in production, sqlite.Store the one for running without a Redis and dynamo.Store the
+// one for DynamoDB.
+type Store interface {
+	CheckConnection(ctx context.Context) error
+	// ForTenant scopes every other method to one tenant's data
+	ForTenant(tenantID string) Store
+
+	SaveReceipt(ctx context.Context, rec ReceiptRecord) error
+	GetReceipt(ctx context.Context, id string) (ReceiptRecord, error)
+	// batch versions of the above for the bulk paths, one round trip per call
+	SaveReceipts(ctx context.Context, recs []ReceiptRecord) error
+	GetReceipts(ctx context.Context, ids []string) ([]ReceiptRecord, error)
+	UpdateReceipts(ctx context.Context, updates []ReceiptUpdate) error
+
+	GetUserPoints(ctx context.Context, userID string, historyLimit int) (UserPoints, error)
+	Redeem(ctx context.Context, red Redemption) (Redemption, bool, error)
+	ListRedemptions(ctx context.Context, userID string, limit int) ([]Redemption, error)
+	Adjust(ctx context.Context, adj Adjustment) (Adjustment, bool, error)
+	ListAdjustments(ctx context.Context, userID, receiptID string, limit int) ([]Adjustment, error)
+	ExpirePoints(ctx context.Context, now time.Time, limit int) (ExpirySweep, error)
+
+	ClaimFingerprint(ctx context.Context, fingerprint, id string, window time.Duration) (string, error)
+	ReleaseFingerprint(ctx context.Context, fingerprint, id string) error
+	// short-lived locks on a submission's content, so identical submissions racing each
+	// other are processed once
+	LockSubmission(ctx context.Context, hash, id string, ttl time.Duration) (string, error)
+	UnlockSubmission(ctx context.Context, hash, id string) error
+	CountSubmission(ctx context.Context, userID, id string, now time.Time, window time.Duration) (int, error)
+	ListFlagged(ctx context.Context, limit int) ([]ReceiptRecord, error)
+	ResolveFlagged(ctx context.Context, id string, approve bool) (ReceiptRecord, error)
+
+	AddUsage(ctx context.Context, name string, n int, ttl time.Duration) (int, error)
+	// GetUsage reads usage counters by name, ones that don't exist (anymore) are left out
+	GetUsage(ctx context.Context, names []string) (map[string]int, error)
+	GetAnalytics(ctx context.Context, days []string, topRetailers int) (Analytics, error)
+
+	// operator tooling for the admin API
+	DeleteReceipt(ctx context.Context, id string) error
+	// soft deletes and the retention sweeper
+	SoftDeleteReceipt(ctx context.Context, id string, at time.Time) (ReceiptRecord, error)
+	GetTombstone(ctx context.Context, id string) (ReceiptRecord, error)
+	PurgeReceipts(ctx context.Context, createdBefore, deletedBefore time.Time, limit int) (RetentionSweep, error)
+	ScanKeys(ctx context.Context, prefix string, cursor uint64, count int64) ([]string, uint64, error)
+	Stats(ctx context.Context) (StoreStats, error)
+	PruneIndexes(ctx context.Context, progress func(checked int)) (int, error)
+	ListReceipts(ctx context.Context, filter ListFilter) ([]ReceiptRecord, string, error)
+
+	AddWebhook(ctx context.Context, url string) error
+	RemoveWebhook(ctx context.Context, url string) error
+	ListWebhooks(ctx context.Context) ([]string, error)
+
+	SaveCampaign(ctx context.Context, c Campaign) error
+	DeleteCampaign(ctx context.Context, id string) error
+	ListCampaigns(ctx context.Context) ([]Campaign, error)
+
+	SaveRetailer(ctx context.Context, r Retailer) error
+	DeleteRetailer(ctx context.Context, id string) error
+	ListRetailers(ctx context.Context) ([]Retailer, error)
+
+	// copying data between stores, see cmd/migrate
+	ListUsers(ctx context.Context, cursor string, limit int) ([]string, string, error)
+	GetUserAccount(ctx context.Context, userID string) (UserAccount, error)
+	PutUserAccount(ctx context.Context, acct UserAccount) error
+	RestoreReceipts(ctx context.Context, recs []ReceiptRecord, now time.Time) error
+}
@@ -0,0 +1,330 @@
+// Package storetest checks a db.Store implementation against RedisStore: run Script
+// on both and Compare what they answered.
+package storetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// Compare fails t for every step where got differs from want, the RedisStore answers
+func Compare(t testing.TB, got, want []string) {
+	t.Helper()
+	for i := range want {
+		if i >= len(got) || got[i] != want[i] {
+			t.Errorf("step %d:\n got:   %s\n redis: %s", i, at(got, i), want[i])
+		}
+	}
+}
+
+func at(steps []string, i int) string {
+	if i < len(steps) {
+		return steps[i]
+	}
+	return "(missing)"
+}
+
+// Script exercises every part of a Store and returns what each step answered,
+// encoded. Errors are reduced to which sentinel they match, the messages differ.
+func Script(t testing.TB, store db.Store) []string {
+	ctx := context.Background()
+	var steps []string
+	record := func(name string, v interface{}, err error) {
+		t.Helper()
+		if err != nil {
+			v = errorKind(err)
+		}
+		b, jsonErr := json.Marshal(v)
+		if jsonErr != nil {
+			t.Fatal(jsonErr)
+		}
+		steps = append(steps, name+" "+string(b))
+	}
+	t0 := time.Date(2024, time.January, 10, 10, 0, 0, 0, time.UTC)
+	expireAt := t0.AddDate(0, 0, 30)
+	r1 := db.ReceiptRecord{ID: "r1", Retailer: "Target", PurchaseDate: "2024-01-01", Points: 100, CreatedAt: t0, UserID: "u1", PointsExpireAt: &expireAt,
+		Breakdown: []db.PointsComponent{{Rule: "retailerName", Points: 6}}}
+	r2 := db.ReceiptRecord{ID: "r2", Retailer: "Walmart", RetailerID: "wmt", PurchaseDate: "2024-01-05", Points: 50, CreatedAt: t0.Add(time.Hour), UserID: "u1"}
+	r3 := db.ReceiptRecord{ID: "r3", Retailer: " target ", PurchaseDate: "2023-12-31", Points: 30, CreatedAt: t0.Add(2 * time.Hour), UserID: "u2",
+		Status: db.ReceiptFlagged, FraudReasons: []string{"velocity"}}
+	r4 := db.ReceiptRecord{ID: "r4", Retailer: "Costco", PurchaseDate: "2024-01-05", Points: 10, CreatedAt: t0.Add(3 * time.Hour)}
+
+	record("save batch", nil, store.SaveReceipts(ctx, []db.ReceiptRecord{r1, r2}))
+	record("save flagged", nil, store.SaveReceipt(ctx, r3))
+	record("save anonymous", nil, store.SaveReceipt(ctx, r4))
+	record("save bad date", nil, store.SaveReceipt(ctx, db.ReceiptRecord{ID: "bad", PurchaseDate: "soon"}))
+
+	rec, err := store.GetReceipt(ctx, "r1")
+	record("get", rec, err)
+	_, err = store.GetReceipt(ctx, "missing")
+	record("get missing", nil, err)
+	recs, err := store.GetReceipts(ctx, []string{"r4", "missing", "r1"})
+	record("get many", recs, err)
+
+	list := func(store db.Store, name string, filter db.ListFilter) {
+		recs, cursor, err := store.ListReceipts(ctx, filter)
+		record(name, recs, err)
+		for page := 2; cursor != "" && err == nil; page++ {
+			filter.Cursor = cursor
+			recs, cursor, err = store.ListReceipts(ctx, filter)
+			record(name+" page "+string(rune('0'+page)), recs, err)
+		}
+	}
+	forty := 40
+	list(store, "list", db.ListFilter{Limit: 10})
+	list(store, "list paged", db.ListFilter{Limit: 1})
+	list(store, "list retailer", db.ListFilter{Retailer: "TARGET", Limit: 10})
+	list(store, "list dates", db.ListFilter{FromDate: "2024-01-01", ToDate: "2024-01-05", Limit: 10})
+	list(store, "list dates paged", db.ListFilter{FromDate: "2024-01-01", Limit: 2})
+	list(store, "list min points", db.ListFilter{MinPoints: &forty, Limit: 10})
+
+	points, err := store.GetUserPoints(ctx, "u1", 10)
+	record("user points", points, err)
+	points, err = store.GetUserPoints(ctx, "u1", 1)
+	record("user points limited", points, err)
+	points, err = store.GetUserPoints(ctx, "nobody", 10)
+	record("unknown user points", points.Balance, err)
+
+	redemption := db.Redemption{ID: "red1", UserID: "u1", Points: 120, Reward: "mug", CreatedAt: t0.Add(4 * time.Hour)}
+	redeemed, isNew, err := store.Redeem(ctx, redemption)
+	record("redeem", []interface{}{redeemed, isNew}, err)
+	redeemed, isNew, err = store.Redeem(ctx, redemption)
+	record("redeem replay", []interface{}{redeemed, isNew}, err)
+	_, _, err = store.Redeem(ctx, db.Redemption{ID: "red1", UserID: "u1", Points: 1})
+	record("redeem conflict", nil, err)
+	_, _, err = store.Redeem(ctx, db.Redemption{ID: "red2", UserID: "u1", Points: 1000})
+	record("redeem too much", nil, err)
+	redemptions, err := store.ListRedemptions(ctx, "u1", 10)
+	record("redemptions", redemptions, err)
+	redemptions, err = store.ListRedemptions(ctx, "nobody", 10)
+	record("no redemptions", redemptions, err)
+
+	goodwill := db.Adjustment{ID: "adj1", UserID: "u1", ReceiptID: "r1", Points: 15, Reason: "goodwill", By: "support", CreatedAt: t0.Add(5 * time.Hour)}
+	adjusted, isNew, err := store.Adjust(ctx, goodwill)
+	record("adjust receipt", []interface{}{adjusted, isNew}, err)
+	adjusted, isNew, err = store.Adjust(ctx, goodwill)
+	record("adjust replay", []interface{}{adjusted, isNew}, err)
+	_, _, err = store.Adjust(ctx, db.Adjustment{ID: "adj1", UserID: "u1", Points: 15, Reason: "goodwill"})
+	record("adjust conflict", nil, err)
+	_, _, err = store.Adjust(ctx, db.Adjustment{ID: "adj2", UserID: "u1", Points: -1000, Reason: "fraud"})
+	record("claw back too much", nil, err)
+	_, _, err = store.Adjust(ctx, db.Adjustment{ID: "adj2", UserID: "u1", ReceiptID: "r2", Points: -51, Reason: "fraud"})
+	record("claw back more than the receipt", nil, err)
+	_, _, err = store.Adjust(ctx, db.Adjustment{ID: "adj2", UserID: "u1", ReceiptID: "missing", Points: 1, Reason: "goodwill"})
+	record("adjust missing receipt", nil, err)
+	adjusted, isNew, err = store.Adjust(ctx, db.Adjustment{ID: "adj3", UserID: "u1", Points: -5, Reason: "fraud", CreatedAt: t0.Add(6 * time.Hour)})
+	record("adjust user", []interface{}{adjusted, isNew}, err)
+	adjustments, err := store.ListAdjustments(ctx, "u1", "", 10)
+	record("adjustments", adjustments, err)
+	adjustments, err = store.ListAdjustments(ctx, "u1", "", 1)
+	record("adjustments limited", adjustments, err)
+	adjustments, err = store.ListAdjustments(ctx, "u1", "r1", 10)
+	record("receipt adjustments", adjustments, err)
+	adjustments, err = store.ListAdjustments(ctx, "u1", "r2", 10)
+	record("no receipt adjustments", adjustments, err)
+	adjustments, err = store.ListAdjustments(ctx, "nobody", "", 10)
+	record("no adjustments", adjustments, err)
+
+	flagged, err := store.ListFlagged(ctx, 10)
+	record("flagged", flagged, err)
+	resolved, err := store.ResolveFlagged(ctx, "r3", true)
+	record("approve", resolved, err)
+	_, err = store.ResolveFlagged(ctx, "r3", true)
+	record("approve again", nil, err)
+	points, err = store.GetUserPoints(ctx, "u2", 10)
+	record("approved user points", points, err)
+
+	r2.Points = 70
+	record("update", nil, store.UpdateReceipts(ctx, []db.ReceiptUpdate{{Record: r2, OldPoints: 50}}))
+	points, err = store.GetUserPoints(ctx, "u1", 10)
+	record("updated user points", points.Balance, err)
+	sweep, err := store.ExpirePoints(ctx, t0.AddDate(0, 0, 31), 100)
+	record("expire", sweep, err)
+	points, err = store.GetUserPoints(ctx, "u1", 10)
+	record("expired user points", []int{points.Balance, points.Expired}, err)
+
+	corrected := r4
+	corrected.Retailer, corrected.PurchaseDate, corrected.Points = "target", "2024-01-03", 15
+	corrected.Revisions = []db.ReceiptRevision{{Retailer: r4.Retailer, PurchaseDate: r4.PurchaseDate, Points: r4.Points, ReplacedAt: t0.Add(5 * time.Hour)}}
+	record("correct", nil, store.UpdateReceipts(ctx, []db.ReceiptUpdate{{
+		Record: corrected, OldPoints: r4.Points, OldRetailer: r4.Retailer, OldPurchaseDate: r4.PurchaseDate,
+	}}))
+	// the registry learned r1's retailer since, only the analytics move
+	aliased := r1
+	aliased.RetailerID = "target-corp"
+	record("correct retailer id", nil, store.UpdateReceipts(ctx, []db.ReceiptUpdate{{
+		Record: aliased, OldPoints: r1.Points, OldRetailer: r1.Retailer, OldPurchaseDate: r1.PurchaseDate,
+	}}))
+	list(store, "list corrected retailer", db.ListFilter{Retailer: "Target", Limit: 10})
+	list(store, "list old retailer", db.ListFilter{Retailer: "Costco", Limit: 10})
+	list(store, "list corrected date", db.ListFilter{FromDate: "2024-01-03", ToDate: "2024-01-03", Limit: 10})
+	list(store, "list old date", db.ListFilter{FromDate: "2024-01-05", ToDate: "2024-01-05", Limit: 10})
+	list(store, "list canonical retailer", db.ListFilter{CanonicalRetailer: "target-corp", Limit: 10})
+	list(store, "list canonical retailer paged", db.ListFilter{CanonicalRetailer: "wmt", FromDate: "2024-01-01", Limit: 1})
+	list(store, "list canonical name", db.ListFilter{CanonicalRetailer: "target", ToDate: "2023-12-31", Limit: 10})
+
+	analytics, err := store.GetAnalytics(ctx, []string{"2024-01-10", "2024-01-11"}, 3)
+	record("analytics", analytics, err)
+
+	for i := 0; i < 2; i++ {
+		used, err := store.AddUsage(ctx, "quota", 3, time.Hour)
+		record("usage", used, err)
+	}
+	usage, err := store.GetUsage(ctx, []string{"quota", "unused"})
+	record("read usage", usage, err)
+
+	for _, claim := range []struct{ fingerprint, id string }{{"fp", "r1"}, {"fp", "r2"}, {"fp", "r1"}} {
+		holder, err := store.ClaimFingerprint(ctx, claim.fingerprint, claim.id, time.Hour)
+		record("claim", holder, err)
+	}
+	record("release other", nil, store.ReleaseFingerprint(ctx, "fp", "r2"))
+	holder, err := store.ClaimFingerprint(ctx, "fp", "r2", time.Hour)
+	record("claim held", holder, err)
+	record("release", nil, store.ReleaseFingerprint(ctx, "fp", "r1"))
+	holder, err = store.ClaimFingerprint(ctx, "fp", "r2", time.Hour)
+	record("claim released", holder, err)
+
+	for _, id := range []string{"r1", "r2", "r1"} {
+		holder, err := store.LockSubmission(ctx, "hash", id, time.Hour)
+		record("lock", holder, err)
+	}
+	record("unlock other", nil, store.UnlockSubmission(ctx, "hash", "r2"))
+	holder, err = store.LockSubmission(ctx, "hash", "r2", time.Hour)
+	record("lock held", holder, err)
+	record("unlock", nil, store.UnlockSubmission(ctx, "hash", "r1"))
+	holder, err = store.LockSubmission(ctx, "hash", "r2", time.Hour)
+	record("lock released", holder, err)
+
+	for i, id := range []string{"a", "b", "c", "b"} {
+		count, err := store.CountSubmission(ctx, "u1", id, t0.Add(time.Duration(i)*20*time.Minute), 30*time.Minute)
+		record("submissions", count, err)
+	}
+
+	record("add webhook", nil, store.AddWebhook(ctx, "https://b.example"))
+	record("add webhook", nil, store.AddWebhook(ctx, "https://a.example"))
+	record("remove webhook", nil, store.RemoveWebhook(ctx, "https://b.example"))
+	webhooks, err := store.ListWebhooks(ctx)
+	record("webhooks", webhooks, err)
+
+	record("save campaign", nil, store.SaveCampaign(ctx, db.Campaign{ID: "c2", StartDate: "2024-02-01", EndDate: "2024-02-28"}))
+	record("save campaign", nil, store.SaveCampaign(ctx, db.Campaign{ID: "c1", StartDate: "2024-01-01", EndDate: "2024-01-31",
+		Category: &db.CategoryBonus{Keywords: []string{"soda"}, PointsPerItem: 5}}))
+	record("save campaign", nil, store.SaveCampaign(ctx, db.Campaign{ID: "c3", StartDate: "2024-03-01", EndDate: "2024-03-31"}))
+	record("delete campaign", nil, store.DeleteCampaign(ctx, "c3"))
+	record("delete missing campaign", nil, store.DeleteCampaign(ctx, "c3"))
+	campaigns, err := store.ListCampaigns(ctx)
+	record("campaigns", campaigns, err)
+
+	record("save retailer", nil, store.SaveRetailer(ctx, db.Retailer{ID: "mm", Name: "M&M Corner Market", Aliases: []string{"MM CORNER MKT"}}))
+	record("save retailer", nil, store.SaveRetailer(ctx, db.Retailer{ID: "costco", Name: "Costco", Patterns: []string{"^costco"}}))
+	record("save retailer", nil, store.SaveRetailer(ctx, db.Retailer{ID: "gone", Name: "Gone"}))
+	record("delete retailer", nil, store.DeleteRetailer(ctx, "gone"))
+	record("delete missing retailer", nil, store.DeleteRetailer(ctx, "gone"))
+	retailers, err := store.ListRetailers(ctx)
+	record("retailers", retailers, err)
+
+	record("delete", nil, store.DeleteReceipt(ctx, "r4"))
+	record("delete again", nil, store.DeleteReceipt(ctx, "r4"))
+	list(store, "list after delete", db.ListFilter{Limit: 10})
+	stats, err := store.Stats(ctx)
+	record("stats", []int64{stats.IndexedReceipts, stats.FlaggedReceipts, stats.ExpiringLots}, err)
+	removed, err := store.PruneIndexes(ctx, func(int) {})
+	record("prune", removed, err)
+
+	deletedAt := t0.Add(6 * time.Hour)
+	deleted, err := store.SoftDeleteReceipt(ctx, "r2", deletedAt)
+	record("soft delete", deleted, err)
+	_, err = store.SoftDeleteReceipt(ctx, "r2", deletedAt)
+	record("soft delete again", nil, err)
+	_, err = store.GetReceipt(ctx, "r2")
+	record("get soft deleted", nil, err)
+	tombstone, err := store.GetTombstone(ctx, "r2")
+	record("tombstone", tombstone, err)
+	_, err = store.GetTombstone(ctx, "r1")
+	record("tombstone of live", nil, err)
+	points, err = store.GetUserPoints(ctx, "u1", 10)
+	record("user points after soft delete", points, err)
+	purged, err := store.PurgeReceipts(ctx, t0.Add(90*time.Minute), deletedAt, 10)
+	record("purge by age", purged, err)
+	purged, err = store.PurgeReceipts(ctx, time.Time{}, deletedAt.Add(time.Second), 10)
+	record("purge tombstones", purged, err)
+	purged, err = store.PurgeReceipts(ctx, t0.Add(24*time.Hour), deletedAt.Add(time.Second), 1)
+	record("purge limited", purged, err)
+	_, err = store.GetTombstone(ctx, "r2")
+	record("tombstone purged", nil, err)
+	list(store, "list after purge", db.ListFilter{Limit: 10})
+
+	copied := store.ForTenant("copy")
+	record("restore", nil, copied.RestoreReceipts(ctx, []db.ReceiptRecord{r1, r3}, t0.Add(time.Hour)))
+	recs, err = copied.GetReceipts(ctx, []string{"r1", "r3"})
+	record("get restored", recs, err)
+	points, err = copied.GetUserPoints(ctx, "u1", 10)
+	record("restored user points", points, err)
+	list(copied, "list restored", db.ListFilter{Limit: 10})
+	account := db.UserAccount{UserID: "u1", Balance: 100, Expired: 5,
+		Lots:        []db.PointsLot{{ReceiptID: "r1", Points: 100, ExpireAt: expireAt}},
+		Redemptions: []db.Redemption{{ID: "red1", UserID: "u1", Points: 20, Reward: "mug", BalanceAfter: 80, CreatedAt: t0.Add(4 * time.Hour)}},
+		Adjustments: []db.Adjustment{{ID: "adj1", UserID: "u1", ReceiptID: "r1", Points: 20, Reason: "goodwill", BalanceAfter: 100, CreatedAt: t0.Add(5 * time.Hour)}}}
+	record("put account", nil, copied.PutUserAccount(ctx, account))
+	acct, err := copied.GetUserAccount(ctx, "u1")
+	record("get account", acct, err)
+	acct, err = copied.GetUserAccount(ctx, "nobody")
+	record("get unknown account", acct, err)
+	sweep, err = copied.ExpirePoints(ctx, expireAt.Add(time.Hour), 100)
+	record("expire put lots", sweep, err)
+	record("put account again", nil, copied.PutUserAccount(ctx, account))
+	account.Lots, account.Redemptions, account.Adjustments = nil, nil, nil
+	record("put account without lots", nil, copied.PutUserAccount(ctx, account))
+	sweep, err = copied.ExpirePoints(ctx, expireAt.Add(time.Hour), 100)
+	record("expire replaced lots", sweep, err)
+	acct, err = copied.GetUserAccount(ctx, "u1")
+	record("get replaced account", acct, err)
+	adjustments, err = copied.ListAdjustments(ctx, "u1", "r1", 10)
+	record("put receipt adjustments", adjustments, err)
+	// Redis can list a user on more than one page
+	seen := make(map[string]bool)
+	var users []string
+	for cursor, page := "", 0; page == 0 || cursor != ""; page++ {
+		var ids []string
+		ids, cursor, err = copied.ListUsers(ctx, cursor, 1)
+		if err != nil {
+			break
+		}
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				users = append(users, id)
+			}
+		}
+	}
+	sort.Strings(users)
+	record("list users", users, err)
+
+	tenant := store.ForTenant("acme")
+	_, err = tenant.GetReceipt(ctx, "r1")
+	record("tenant get other's", nil, err)
+	record("tenant save", nil, tenant.SaveReceipt(ctx, db.ReceiptRecord{ID: "t1", Retailer: "Target", PurchaseDate: "2024-01-02", CreatedAt: t0}))
+	list(tenant, "tenant list", db.ListFilter{Limit: 10})
+	keys, _, err := tenant.ScanKeys(ctx, "receipt:", 0, 100)
+	record("tenant keys", keys, err)
+	return steps
+}
+
+func errorKind(err error) string {
+	for _, sentinel := range []error{db.ErrNotFound, db.ErrInsufficientPoints, db.ErrRedemptionConflict, db.ErrAdjustmentConflict, db.ErrReceiptOverdrawn, db.ErrTooManyAdjustments} {
+		if errors.Is(err, sentinel) {
+			return sentinel.Error()
+		}
+	}
+	if strings.Contains(err.Error(), "date") {
+		return "invalid date"
+	}
+	return "error"
+}
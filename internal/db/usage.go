@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	usageKeyPrefix = "usage:"
+	// what an AddUsage call added, by call, for its retries
+	usageAddKeyPrefix = "usageadd:"
+)
+
+// addUsageScript adds to a counter once per call: an attempt retried after its reply
+// got lost finds the value the first one left instead of adding again
+// KEYS: counter, call
+// ARGV: n, counter TTL (ms), call TTL (ms)
+var addUsageScript = redis.NewScript(`
+local added = redis.call('GET', KEYS[2])
+if added then
+	return tonumber(added)
+end
+local used = redis.call('INCRBY', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) == -1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+redis.call('SET', KEYS[2], used, 'PX', ARGV[3])
+return used
+`)
+
+// AddUsage adds n (which may be negative) to a usage counter and returns its new value.
+// The counter expires ttl after it was created.
+func (rs *RedisStore) AddUsage(ctx context.Context, name string, n int, ttl time.Duration) (int, error) {
+	keys := []string{rs.key(usageKeyPrefix + name), rs.key(usageAddKeyPrefix + uuid.NewString())}
+	// long enough to outlive every retry of this call
+	callTTL := rs.config.DbRetryMaxElapsedInMs + rs.config.DbAttemptTimeoutInMs
+	var used int64
+	err := rs.withWriteSlot(ctx, "counting usage", func(ctx context.Context) error {
+		var err error
+		used, err = addUsageScript.Run(ctx, rs.client, keys, n, ttl.Milliseconds(), callTTL.Milliseconds()).Int64()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error counting usage: %w", err)
+	}
+	return int(used), nil
+}
+
+// GetUsage reads usage counters by name, in one MGET
+func (rs *RedisStore) GetUsage(ctx context.Context, names []string) (map[string]int, error) {
+	usage := make(map[string]int, len(names))
+	if len(names) == 0 {
+		return usage, nil
+	}
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = rs.key(usageKeyPrefix + name)
+	}
+	var values []interface{}
+	err := rs.withRetry(ctx, "reading usage", func(ctx context.Context) error {
+		var err error
+		values, err = rs.client.MGet(ctx, keys...).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error reading usage: %w", err)
+	}
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			n, _ := strconv.Atoi(s)
+			usage[names[i]] = n
+		}
+	}
+	return usage, nil
+}
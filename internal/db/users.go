@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const userKeyPrefix = "user:"
+
+// design decision: balances and histories don't get the receipt TTL, they're the point
+// of the loyalty program. the history only holds ids, receipts that expired drop out
+// of it when it's read
+func (rs *RedisStore) userBalanceKey(userID string) string {
+	return rs.key(userKeyPrefix + userID + ":balance")
+}
+
+func (rs *RedisStore) userReceiptsKey(userID string) string {
+	return rs.key(userKeyPrefix + userID + ":receipts")
+}
+
+// UserPoints is a user's running balance and their most recent receipts, newest first.
+// Balance only holds active points, the ones that expired are totalled in Expired.
+type UserPoints struct {
+	UserID   string
+	Balance  int
+	Expired  int
+	Receipts []ReceiptRecord
+}
+
+// GetUserPoints reads a user's balance and up to historyLimit of their latest
+// receipts. Unknown users have a zero balance and no history.
+func (rs *RedisStore) GetUserPoints(ctx context.Context, userID string, historyLimit int) (UserPoints, error) {
+	var (
+		balance int
+		expired int
+		ids     []string
+	)
+	err := rs.withRetry(ctx, "reading user points", func(ctx context.Context) error {
+		var balanceCmd, expiredCmd *redis.StringCmd
+		var historyCmd *redis.StringSliceCmd
+		_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			balanceCmd = pipe.Get(ctx, rs.userBalanceKey(userID))
+			expiredCmd = pipe.Get(ctx, rs.userExpiredKey(userID))
+			historyCmd = pipe.ZRevRange(ctx, rs.userReceiptsKey(userID), 0, int64(historyLimit)-1)
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if balance, err = balanceCmd.Int(); err != nil && err != redis.Nil {
+			return err
+		}
+		if expired, err = expiredCmd.Int(); err != nil && err != redis.Nil {
+			return err
+		}
+		ids, err = historyCmd.Result()
+		return err
+	})
+	if err != nil {
+		return UserPoints{}, fmt.Errorf("Error reading user points: %w", err)
+	}
+
+	records, missing, err := rs.getReceipts(ctx, ids)
+	if err != nil {
+		return UserPoints{}, err
+	}
+	if len(missing) > 0 {
+		if err := rs.client.ZRem(ctx, rs.userReceiptsKey(userID), missing...).Err(); err != nil {
+			logging.Printf(ctx, "Error removing expired receipts from history of user %s: %v", userID, err)
+		}
+	}
+	return UserPoints{UserID: userID, Balance: balance, Expired: expired, Receipts: records}, nil
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+const webhooksKey = "webhooks"
+
+func (rs *RedisStore) AddWebhook(ctx context.Context, url string) error {
+	err := rs.withWriteSlot(ctx, "registering webhook", func(ctx context.Context) error {
+		return rs.client.SAdd(ctx, rs.key(webhooksKey), url).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("Error registering webhook: %w", err)
+	}
+	return nil
+}
+
+func (rs *RedisStore) RemoveWebhook(ctx context.Context, url string) error {
+	err := rs.withWriteSlot(ctx, "removing webhook", func(ctx context.Context) error {
+		return rs.client.SRem(ctx, rs.key(webhooksKey), url).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("Error removing webhook: %w", err)
+	}
+	return nil
+}
+
+func (rs *RedisStore) ListWebhooks(ctx context.Context) ([]string, error) {
+	var urls []string
+	err := rs.withRetry(ctx, "listing webhooks", func(ctx context.Context) error {
+		var err error
+		urls, err = rs.client.SMembers(ctx, rs.key(webhooksKey)).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing webhooks: %w", err)
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
@@ -0,0 +1,31 @@
+package events
+
+import "time"
+
+const (
+	ReceiptProcessed = "receipt.processed"
+	// a receipt was corrected and rescored, Points is what it's worth now
+	ReceiptCorrected = "receipt.corrected"
+	// a receipt was deleted through the API, it's kept as a tombstone until it's purged
+	ReceiptDeleted = "receipt.deleted"
+	// the retention sweeper deleted a receipt or tombstone for good
+	ReceiptPurged = "receipt.purged"
+)
+
+// Event is published whenever something noteworthy happens to a receipt
+type Event struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Retailer string `json:"retailer"`
+	Points   int    `json:"points"`
+	UserID   string `json:"userId,omitempty"`
+	// the tenant the receipt belongs to, empty for the default tenant
+	Tenant    string    `json:"tenant,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Publisher hands events off to some downstream system. Publish must not block the
+// request path, implementations are expected to buffer.
+type Publisher interface {
+	Publish(ev Event)
+}
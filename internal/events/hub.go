@@ -0,0 +1,124 @@
+package events
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Hub fans events out to in-process subscribers, the server-sent event streams. Like
+// every Publisher it never blocks: a subscriber whose buffer is full misses the event.
+type Hub struct {
+	bufferSize     int
+	maxSubscribers int
+
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+
+	published atomic.Int64
+	dropped   atomic.Int64
+}
+
+var (
+	// ErrTooManySubscribers is returned by Subscribe when the hub is at its limit
+	ErrTooManySubscribers = errors.New("too many subscribers")
+	// ErrHubClosed is returned by Subscribe once the hub is closed
+	ErrHubClosed = errors.New("hub closed")
+)
+
+// Subscription receives the events its filter accepts on C until it's closed
+type Subscription struct {
+	C <-chan Event
+
+	hub    *Hub
+	ch     chan Event
+	filter func(Event) bool
+	once   sync.Once
+}
+
+// HubStats is what the hub has done since boot, for the metrics endpoint
+type HubStats struct {
+	Subscribers int   `json:"subscribers"`
+	Published   int64 `json:"published"`
+	Dropped     int64 `json:"dropped"`
+}
+
+// NewHub makes a hub whose subscriptions buffer up to bufferSize events each. 0
+// maxSubscribers is no limit.
+func NewHub(bufferSize, maxSubscribers int) *Hub {
+	return &Hub{bufferSize: bufferSize, maxSubscribers: maxSubscribers, subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe starts delivering the events filter accepts, every event for a nil filter.
+// The subscription has to be closed when the subscriber is done with it.
+func (h *Hub) Subscribe(filter func(Event) bool) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrHubClosed
+	}
+	if h.maxSubscribers > 0 && len(h.subs) >= h.maxSubscribers {
+		return nil, ErrTooManySubscribers
+	}
+	ch := make(chan Event, h.bufferSize)
+	sub := &Subscription{C: ch, hub: h, ch: ch, filter: filter}
+	h.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+// Publish hands the event to every subscriber that wants it. design decision: a slow
+// subscriber misses events instead of holding up the others or the request that
+// published it, a dashboard catches up with the next one
+func (h *Hub) Publish(ev Event) {
+	h.published.Add(1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if sub.filter != nil && !sub.filter(ev) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			h.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribers is how many subscriptions are open
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+func (h *Hub) Stats() HubStats {
+	return HubStats{
+		Subscribers: h.Subscribers(),
+		Published:   h.published.Load(),
+		Dropped:     h.dropped.Load(),
+	}
+}
+
+// Close ends every subscription, closing their C, and turns away new ones. The server
+// calls it on shutdown, streams would otherwise run until their clients go away.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		sub.once.Do(func() { close(sub.ch) })
+	}
+}
+
+// Close stops delivery and closes C. Safe to call more than once.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.hub.mu.Lock()
+		delete(s.hub.subs, s)
+		s.hub.mu.Unlock()
+		close(s.ch)
+	})
+}
@@ -0,0 +1,148 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaPublisher buffers events in memory and ships them to Kafka in batches from a
+// single background goroutine
+type KafkaPublisher struct {
+	writer        *kafka.Writer
+	buffer        chan Event
+	batchSize     int
+	flushInterval time.Duration
+	// closing is closed by Close, which sets closed under mu. Publish checks closed and
+	// queues under mu too, so once run sees closing nothing more gets into buffer and
+	// draining it loses nothing. buffer itself is never closed
+	mu      sync.RWMutex
+	closed  bool
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func NewKafkaPublisher(cfg config.Config) *KafkaPublisher {
+	return &KafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.KafkaBrokers...),
+			Topic:        cfg.KafkaTopic,
+			Balancer:     &kafka.Hash{}, // keyed by receipt id
+			RequiredAcks: kafka.RequireAll,
+			MaxAttempts:  cfg.KafkaMaxAttempts,
+		},
+		buffer:        make(chan Event, cfg.KafkaBufferSize),
+		batchSize:     cfg.KafkaBatchSize,
+		flushInterval: cfg.KafkaFlushIntervalInMs,
+		closing:       make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// Publish queues an event. design decision: when the buffer is full the event is
+// dropped and logged, Kafka being slow shouldn't make receipt processing slow
+func (kp *KafkaPublisher) Publish(ev Event) {
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	if kp.closed {
+		logging.Warnf(context.Background(), "Kafka publisher closed, dropping %s event for receipt %s", ev.Type, ev.ID)
+		return
+	}
+	select {
+	case kp.buffer <- ev:
+	default:
+		logging.Warnf(context.Background(), "Kafka buffer full, dropping %s event for receipt %s", ev.Type, ev.ID)
+	}
+}
+
+// Start runs the flush loop until Close is called
+func (kp *KafkaPublisher) Start() {
+	go kp.run()
+}
+
+// Close stops accepting events, flushes whatever is buffered and closes the writer.
+// Calling it more than once is fine, Publish can still be called meanwhile.
+func (kp *KafkaPublisher) Close() error {
+	kp.mu.Lock()
+	if !kp.closed {
+		kp.closed = true
+		close(kp.closing)
+	}
+	kp.mu.Unlock()
+	<-kp.done
+	return kp.writer.Close()
+}
+
+func (kp *KafkaPublisher) run() {
+	defer close(kp.done)
+	ticker := time.NewTicker(kp.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]kafka.Message, 0, kp.batchSize)
+	add := func(ev Event) {
+		value, err := json.Marshal(ev)
+		if err != nil {
+			logging.Printf(context.Background(), "Error encoding %s event for receipt %s: %v", ev.Type, ev.ID, err)
+			return
+		}
+		batch = append(batch, kafka.Message{
+			Key:   []byte(ev.ID),
+			Value: value,
+			Time:  ev.Timestamp,
+		})
+		if len(batch) >= kp.batchSize {
+			kp.flush(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case ev := <-kp.buffer:
+			add(ev)
+		case <-kp.closing:
+			// whatever made it into the buffer before Close goes out with the last batch
+			for {
+				select {
+				case ev := <-kp.buffer:
+					add(ev)
+				default:
+					kp.flush(batch)
+					return
+				}
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				kp.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+func (kp *KafkaPublisher) flush(batch []kafka.Message) {
+	if len(batch) == 0 {
+		return
+	}
+	// the writer retries internally up to MaxAttempts, anything failing after that is lost
+	ctx, cancel := context.WithTimeout(context.Background(), kp.flushInterval*10)
+	defer cancel()
+	err := kp.writer.WriteMessages(ctx, batch...)
+	if err == nil {
+		return
+	}
+	if writeErrs, ok := err.(kafka.WriteErrors); ok {
+		for i, writeErr := range writeErrs {
+			if writeErr != nil {
+				logging.Printf(ctx, "Error delivering event for receipt %s to Kafka: %v", batch[i].Key, writeErr)
+			}
+		}
+		return
+	}
+	logging.Printf(ctx, "Error delivering %d events to Kafka: %v", len(batch), err)
+}
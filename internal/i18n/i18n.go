@@ -0,0 +1,91 @@
+// Package i18n translates the messages clients see. Messages are looked up by id in
+// one catalog per language (catalogs/<lang>.json), the language is negotiated from the
+// request's Accept-Language. English is the fallback for languages and ids that have
+// no translation.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Default is the language of clients that don't ask for one we have
+const Default = "en"
+
+//go:embed catalogs/*.json
+var catalogFiles embed.FS
+
+// catalogs maps a language to its messages by id
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]map[string]string {
+	files, err := catalogFiles.ReadDir("catalogs")
+	if err != nil {
+		panic(err)
+	}
+	loaded := make(map[string]map[string]string, len(files))
+	for _, f := range files {
+		b, err := catalogFiles.ReadFile(path.Join("catalogs", f.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(b, &messages); err != nil {
+			panic(fmt.Sprintf("Error decoding message catalog %s: %v", f.Name(), err))
+		}
+		loaded[strings.TrimSuffix(f.Name(), ".json")] = messages
+	}
+	return loaded
+}
+
+// Languages lists the languages there are catalogs for
+func Languages() []string {
+	langs := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Negotiate picks the language to answer in from an Accept-Language header: the one
+// with the highest q we have a catalog for, regions ignored (es-MX is es). Ties go to
+// whichever was listed first.
+func Negotiate(acceptLanguage string) string {
+	best, bestQ := Default, 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if _, ok := catalogs[lang]; ok && q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
+
+// Translate is the message with the id in lang, formatted with args like fmt.Sprintf
+func Translate(lang, id string, args ...interface{}) string {
+	msg, ok := catalogs[lang][id]
+	if !ok {
+		if msg, ok = catalogs[Default][id]; !ok {
+			msg = id
+		}
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
@@ -0,0 +1,63 @@
+package i18n
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+)
+
+var verb = regexp.MustCompile(`%[a-z]`)
+
+// every catalog translates every English message, with the same format verbs in the
+// same order so the arguments line up
+func TestCatalogsMatchEnglish(t *testing.T) {
+	for _, lang := range Languages() {
+		for id, english := range catalogs[Default] {
+			msg, ok := catalogs[lang][id]
+			if !ok {
+				t.Errorf("%s: no translation of %s", lang, id)
+				continue
+			}
+			if got, want := verb.FindAllString(msg, -1), verb.FindAllString(english, -1); !slices.Equal(got, want) {
+				t.Errorf("%s: %s has verbs %v, English has %v", lang, id, got, want)
+			}
+		}
+		for id := range catalogs[lang] {
+			if _, ok := catalogs[Default][id]; !ok {
+				t.Errorf("%s: %s isn't an English message", lang, id)
+			}
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "en"},
+		{"es", "es"},
+		{"fr-CA", "fr"},
+		{"ES-mx,es;q=0.9", "es"},
+		{"de,fr;q=0.8,es;q=0.9", "es"},
+		{"de", "en"},
+		{"*", "en"},
+		{"fr;q=0", "en"},
+		{"fr;q=nope,es;q=0.1", "es"},
+		{"en-US,en;q=0.9,fr;q=0.8", "en"},
+	}
+	for _, tt := range tests {
+		if got := Negotiate(tt.header); got != tt.want {
+			t.Errorf("Negotiate(%q): got %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	if got, want := Translate("es", "receipt_too_many_items", 5), "El recibo tiene más de 5 artículos"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := Translate("de", "receipt_invalid"), "The receipt is invalid"; got != want {
+		t.Errorf("unknown language: got %q, want %q", got, want)
+	}
+}
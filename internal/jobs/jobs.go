@@ -0,0 +1,197 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+
+	"github.com/google/uuid"
+)
+
+// State of a job, in the order a job goes through them
+type State string
+
+const (
+	Queued    State = "queued"
+	Running   State = "running"
+	Succeeded State = "succeeded"
+	Failed    State = "failed"
+
+	// finished jobs are kept around for their reports, the oldest get dropped past this
+	maxFinished = 100
+)
+
+// Func is the work of a job. It reports progress through the job as it goes and
+// returns the job's result (its report), which must be safe to encode as JSON.
+type Func func(ctx context.Context, job *Job) (interface{}, error)
+
+// Status is a point in time snapshot of a job
+type Status struct {
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"`
+	State      State       `json:"state"`
+	Progress   interface{} `json:"progress,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	StartedAt  *time.Time  `json:"startedAt,omitempty"`
+	FinishedAt *time.Time  `json:"finishedAt,omitempty"`
+}
+
+type Job struct {
+	mu     sync.Mutex
+	status Status
+	fn     Func
+}
+
+// SetProgress replaces the job's progress report, whatever the job wants to show while
+// it runs
+func (j *Job) SetProgress(progress interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Progress = progress
+}
+
+func (j *Job) Status() Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+func (j *Job) update(f func(s *Status)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f(&j.status)
+}
+
+// Runner runs background jobs with a fixed number of workers. Jobs live in memory,
+// they're gone when the process restarts.
+type Runner struct {
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	queue chan *Job
+}
+
+func NewRunner(queueSize int) *Runner {
+	return &Runner{
+		jobs:  make(map[string]*Job),
+		queue: make(chan *Job, queueSize),
+	}
+}
+
+// Start runs the workers until ctx is done. Jobs get ctx, so they're cancelled with it.
+func (r *Runner) Start(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go r.work(ctx)
+	}
+}
+
+// Submit queues a job, failing when the queue is full
+func (r *Runner) Submit(kind string, fn Func) (Status, error) {
+	job := &Job{
+		fn: fn,
+		status: Status{
+			ID:        uuid.New().String(),
+			Kind:      kind,
+			State:     Queued,
+			CreatedAt: time.Now().UTC(),
+		},
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case r.queue <- job:
+	default:
+		return Status{}, fmt.Errorf("Error submitting %s job: queue is full", kind)
+	}
+	r.jobs[job.status.ID] = job
+	r.evictLocked()
+	return job.Status(), nil
+}
+
+func (r *Runner) Get(id string) (Status, bool) {
+	r.mu.Lock()
+	job, ok := r.jobs[id]
+	r.mu.Unlock()
+	if !ok {
+		return Status{}, false
+	}
+	return job.Status(), true
+}
+
+// List returns every known job, newest first
+func (r *Runner) List() []Status {
+	r.mu.Lock()
+	statuses := make([]Status, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		statuses = append(statuses, job.Status())
+	}
+	r.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].CreatedAt.After(statuses[j].CreatedAt)
+	})
+	return statuses
+}
+
+// evictLocked drops the oldest finished jobs past maxFinished
+func (r *Runner) evictLocked() {
+	var finished []Status
+	for _, job := range r.jobs {
+		if s := job.Status(); s.State == Succeeded || s.State == Failed {
+			finished = append(finished, s)
+		}
+	}
+	if len(finished) <= maxFinished {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].CreatedAt.Before(finished[j].CreatedAt)
+	})
+	for _, s := range finished[:len(finished)-maxFinished] {
+		delete(r.jobs, s.ID)
+	}
+}
+
+func (r *Runner) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-r.queue:
+			r.run(ctx, job)
+		}
+	}
+}
+
+func (r *Runner) run(ctx context.Context, job *Job) {
+	started := time.Now().UTC()
+	job.update(func(s *Status) {
+		s.State = Running
+		s.StartedAt = &started
+	})
+	status := job.Status()
+	logging.Printf(ctx, "Started %s job %s", status.Kind, status.ID)
+
+	result, err := job.fn(ctx, job)
+
+	finished := time.Now().UTC()
+	job.update(func(s *Status) {
+		s.FinishedAt = &finished
+		s.Result = result
+		if err != nil {
+			s.State = Failed
+			s.Error = err.Error()
+		} else {
+			s.State = Succeeded
+		}
+	})
+	if err != nil {
+		logging.Errorf(ctx, "%s job %s failed after %v: %v", status.Kind, status.ID, finished.Sub(started), err)
+		return
+	}
+	logging.Printf(ctx, "%s job %s finished in %v", status.Kind, status.ID, finished.Sub(started))
+}
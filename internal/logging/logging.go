@@ -0,0 +1,85 @@
+// Package logging ties log lines to the request they were written for. Requests get an
+// id (X-Request-ID), every line logged with the request's context carries it as
+// request_id, so a user's complaint can be matched to the server's side of the story.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+type requestIDKey struct{}
+
+// NewContext returns ctx carrying a request id
+func NewContext(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the id of the request ctx belongs to, "" outside of requests
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Printf is log.Printf for code that has a context, the line gets its request id.
+// Lines starting with "Error" are logged at error level, the rest at info.
+func Printf(ctx context.Context, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	level := slog.LevelInfo
+	if strings.HasPrefix(msg, "Error") {
+		level = slog.LevelError
+	}
+	slog.Log(ctx, level, msg)
+}
+
+// Warnf is Printf at warn level, for trouble that's worked around: retries, dropped
+// notifications, a store outage the outbox covers
+func Warnf(ctx context.Context, format string, args ...interface{}) {
+	slog.WarnContext(ctx, fmt.Sprintf(format, args...))
+}
+
+// Errorf is Printf at error level, for failures whose line doesn't start with "Error"
+func Errorf(ctx context.Context, format string, args ...interface{}) {
+	slog.ErrorContext(ctx, fmt.Sprintf(format, args...))
+}
+
+// Writer is where the std log package writes once logging goes through slog: every
+// line is logged like Printf logs it
+func Writer() io.Writer {
+	return writer{}
+}
+
+type writer struct{}
+
+func (writer) Write(p []byte) (int, error) {
+	Printf(context.Background(), "%s", bytes.TrimSuffix(p, []byte("\n")))
+	return len(p), nil
+}
+
+type handler struct {
+	slog.Handler
+}
+
+// Handler wraps h so records logged with a request's context get a request_id attr
+func Handler(h slog.Handler) slog.Handler {
+	return handler{h}
+}
+
+func (h handler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return handler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h handler) WithGroup(name string) slog.Handler {
+	return handler{h.Handler.WithGroup(name)}
+}
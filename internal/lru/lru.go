@@ -0,0 +1,134 @@
+// Package lru is a size-bounded in-process cache that evicts the least recently used
+// entry, with entries that also expire after a while.
+package lru
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Stats is a snapshot for metrics
+type Stats struct {
+	Size     int   `json:"size"`
+	Capacity int   `json:"capacity"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	// hits over lookups, 0 before the first lookup
+	HitRate   float64 `json:"hitRate"`
+	Evictions int64   `json:"evictions"`
+	// entries dropped by Remove because what they cached changed
+	Invalidations int64 `json:"invalidations"`
+}
+
+// Cache maps string keys to values of type V. Lookups take the time from the caller, so
+// the cache goes by whatever clock the caller goes by.
+//
+// A nil Cache (size 0) caches nothing: every Get misses and Add does nothing.
+type Cache[V any] struct {
+	size int
+	ttl  time.Duration
+
+	mu sync.Mutex
+	// most recently used at the front
+	order   *list.List
+	entries map[string]*list.Element
+
+	hits, misses, evictions, invalidations int64
+}
+
+type entry[V any] struct {
+	key      string
+	value    V
+	expireAt time.Time
+}
+
+// New returns a Cache of up to size entries that each live for ttl, nil when size is 0
+func New[V any](size int, ttl time.Duration) *Cache[V] {
+	if size <= 0 {
+		return nil
+	}
+	return &Cache[V]{size: size, ttl: ttl, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Get is the value cached for key, if there is one that hasn't expired at now
+func (c *Cache[V]) Get(key string, now time.Time) (V, bool) {
+	var zero V
+	if c == nil {
+		return zero, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return zero, false
+	}
+	e := el.Value.(*entry[V])
+	if !now.Before(e.expireAt) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		c.misses++
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	c.hits++
+	return e.value, true
+}
+
+// Add caches value for key from now on, evicting the least recently used entry when
+// the cache is full
+func (c *Cache[V]) Add(key string, value V, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &entry[V]{key: key, value: value, expireAt: now.Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(e)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry[V]).key)
+		c.evictions++
+	}
+}
+
+// Remove drops what's cached for key, for when it changed
+func (c *Cache[V]) Remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		c.invalidations++
+	}
+}
+
+func (c *Cache[V]) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := Stats{
+		Size:          c.order.Len(),
+		Capacity:      c.size,
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Evictions:     c.evictions,
+		Invalidations: c.invalidations,
+	}
+	if lookups := c.hits + c.misses; lookups > 0 {
+		stats.HitRate = float64(c.hits) / float64(lookups)
+	}
+	return stats
+}
@@ -0,0 +1,59 @@
+package lru
+
+import (
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New[int](2, time.Minute)
+	c.Add("a", 1, now)
+	c.Add("b", 2, now)
+	if _, ok := c.Get("a", now); !ok {
+		t.Fatal("a isn't cached")
+	}
+	c.Add("c", 3, now)
+	if _, ok := c.Get("b", now); ok {
+		t.Error("b was used least recently and is still cached")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if got, ok := c.Get(key, now); !ok || got != want {
+			t.Errorf("%s: got %d, %v, want %d", key, got, ok, want)
+		}
+	}
+	stats := c.Stats()
+	if stats.Size != 2 || stats.Hits != 3 || stats.Misses != 1 || stats.Evictions != 1 || stats.HitRate != 0.75 {
+		t.Errorf("stats: got %+v", stats)
+	}
+}
+
+func TestExpiresAndInvalidates(t *testing.T) {
+	c := New[int](10, time.Minute)
+	c.Add("a", 1, now)
+	c.Add("b", 2, now)
+	if _, ok := c.Get("a", now.Add(time.Minute)); ok {
+		t.Error("a is cached past its TTL")
+	}
+	c.Remove("b")
+	c.Remove("missing")
+	if _, ok := c.Get("b", now); ok {
+		t.Error("b is cached after it was removed")
+	}
+	if stats := c.Stats(); stats.Size != 0 || stats.Invalidations != 1 {
+		t.Errorf("stats: got %+v", stats)
+	}
+}
+
+func TestNilCachesNothing(t *testing.T) {
+	c := New[int](0, time.Minute)
+	c.Add("a", 1, now)
+	if _, ok := c.Get("a", now); ok {
+		t.Error("a disabled cache returned a value")
+	}
+	c.Remove("a")
+	if stats := c.Stats(); stats != (Stats{}) {
+		t.Errorf("stats: got %+v", stats)
+	}
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Metrics are plain expvar variables, served as one JSON document (alongside the Go
+// runtime's memstats) by Handler. Names are snake_case with the subsystem first, e.g.
+// store_breaker.
+
+// Handler serves every published metric like expvar.Handler, but for the process's
+// command line, which can hold secrets passed as flags
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n")
+		first := true
+		expvar.Do(func(kv expvar.KeyValue) {
+			if kv.Key == "cmdline" {
+				return
+			}
+			if !first {
+				fmt.Fprintf(w, ",\n")
+			}
+			first = false
+			fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+		})
+		fmt.Fprintf(w, "\n}\n")
+	})
+}
+
+// PublishFunc exposes a value computed on every scrape, handy for state owned by
+// another component
+func PublishFunc(name string, f func() interface{}) {
+	expvar.Publish(name, expvar.Func(f))
+}
+
+// NewInt publishes a counter owned by the caller
+func NewInt(name string) *expvar.Int {
+	return expvar.NewInt(name)
+}
+
+// NewMap publishes a map of metrics owned by the caller, keyed by whatever it counts
+// separately (a rule name, a tenant)
+func NewMap(name string) *expvar.Map {
+	return expvar.NewMap(name)
+}
+
+// Histogram counts observed values into buckets by upper bound, Prometheus style: a
+// bucket counts every value up to its bound, so each includes the ones before it. It
+// isn't published on its own, it goes in a Map. Safe for concurrent use.
+type Histogram struct {
+	bounds []float64
+
+	mu sync.Mutex
+	// counts[i] is the values up to bounds[i] that aren't in an earlier bucket, the last
+	// one is the values over every bound
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// NewHistogram is an empty histogram with buckets for the given bounds, ascending
+func NewHistogram(bounds ...float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+// Observe adds one value
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+type histogramBucket struct {
+	// "+Inf" for the one counting everything
+	LE    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+// String is the histogram as JSON, for expvar
+func (h *Histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make([]histogramBucket, len(h.counts))
+	var cumulative int64
+	for i, n := range h.counts {
+		cumulative += n
+		buckets[i] = histogramBucket{LE: "+Inf", Count: cumulative}
+		if i < len(h.bounds) {
+			buckets[i].LE = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+	}
+	out, _ := json.Marshal(struct {
+		Count   int64             `json:"count"`
+		Sum     float64           `json:"sum"`
+		Buckets []histogramBucket `json:"buckets"`
+	}{h.count, h.sum, buckets})
+	return string(out)
+}
@@ -0,0 +1,250 @@
+// Package migrate copies a tenant's data from one store to another and checks the
+// copy, for cmd/migrate. Copies are idempotent, running one again brings the target
+// up to date with the source.
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// Report is what a copy or verification of one tenant went through
+type Report struct {
+	Receipts  int `json:"receipts"`
+	Users     int `json:"users"`
+	Campaigns int `json:"campaigns"`
+	Retailers int `json:"retailers"`
+	Webhooks  int `json:"webhooks"`
+	// verification only: how many things differ and the first maxMismatches of them
+	Mismatched int      `json:"mismatched,omitempty"`
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+const maxMismatches = 100
+
+func (r *Report) mismatch(format string, args ...interface{}) {
+	r.Mismatched++
+	if len(r.Mismatches) < maxMismatches {
+		r.Mismatches = append(r.Mismatches, fmt.Sprintf(format, args...))
+	}
+}
+
+// Copy copies receipts, user accounts, campaigns, retailers and webhooks from one tenant-scoped
+// store to another, batch receipts and users at a time. Receipts keep the TTL they have
+// left at now. Fingerprint claims, submission counts, usage, analytics counters and
+// tombstones are left behind: they're either short-lived or rebuilt as receipts come in.
+func Copy(ctx context.Context, from, to db.Store, batch int, now time.Time) (Report, error) {
+	var report Report
+	err := eachReceiptPage(ctx, from, batch, func(recs []db.ReceiptRecord) error {
+		if err := to.RestoreReceipts(ctx, recs, now); err != nil {
+			return err
+		}
+		report.Receipts += len(recs)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	err = eachUser(ctx, from, batch, func(acct db.UserAccount) error {
+		if err := to.PutUserAccount(ctx, acct); err != nil {
+			return err
+		}
+		report.Users++
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	campaigns, err := from.ListCampaigns(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, c := range campaigns {
+		if err := to.SaveCampaign(ctx, c); err != nil {
+			return report, err
+		}
+		report.Campaigns++
+	}
+	retailers, err := from.ListRetailers(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, rt := range retailers {
+		if err := to.SaveRetailer(ctx, rt); err != nil {
+			return report, err
+		}
+		report.Retailers++
+	}
+	webhooks, err := from.ListWebhooks(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, url := range webhooks {
+		if err := to.AddWebhook(ctx, url); err != nil {
+			return report, err
+		}
+		report.Webhooks++
+	}
+	return report, nil
+}
+
+// Verify checks that everything Copy copies from one store is in the other as it is in
+// the first, and reports what isn't. What's only in the target isn't looked for.
+func Verify(ctx context.Context, from, to db.Store, batch int) (Report, error) {
+	var report Report
+	err := eachReceiptPage(ctx, from, batch, func(recs []db.ReceiptRecord) error {
+		ids := make([]string, len(recs))
+		for i, rec := range recs {
+			ids[i] = rec.ID
+		}
+		copied, err := to.GetReceipts(ctx, ids)
+		if err != nil {
+			return err
+		}
+		byID := make(map[string]db.ReceiptRecord, len(copied))
+		for _, rec := range copied {
+			byID[rec.ID] = rec
+		}
+		for _, rec := range recs {
+			report.Receipts++
+			if c, ok := byID[rec.ID]; !ok {
+				report.mismatch("receipt %s is missing", rec.ID)
+			} else if !sameJSON(rec, c) {
+				report.mismatch("receipt %s differs", rec.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	err = eachUser(ctx, from, batch, func(acct db.UserAccount) error {
+		report.Users++
+		copied, err := to.GetUserAccount(ctx, acct.UserID)
+		if err != nil {
+			return err
+		}
+		if !sameJSON(normalize(acct), normalize(copied)) {
+			report.mismatch("user %s differs: balance %d, expired %d, %d lots, %d redemptions, %d adjustments in the source; "+
+				"balance %d, expired %d, %d lots, %d redemptions, %d adjustments in the target",
+				acct.UserID, acct.Balance, acct.Expired, len(acct.Lots), len(acct.Redemptions), len(acct.Adjustments),
+				copied.Balance, copied.Expired, len(copied.Lots), len(copied.Redemptions), len(copied.Adjustments))
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	campaigns, err := from.ListCampaigns(ctx)
+	if err != nil {
+		return report, err
+	}
+	copiedCampaigns, err := to.ListCampaigns(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Campaigns = len(campaigns)
+	if len(campaigns)+len(copiedCampaigns) > 0 && !sameJSON(campaigns, copiedCampaigns) {
+		report.mismatch("campaigns differ: %d in the source, %d in the target", len(campaigns), len(copiedCampaigns))
+	}
+	retailers, err := from.ListRetailers(ctx)
+	if err != nil {
+		return report, err
+	}
+	copiedRetailers, err := to.ListRetailers(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Retailers = len(retailers)
+	if len(retailers)+len(copiedRetailers) > 0 && !sameJSON(retailers, copiedRetailers) {
+		report.mismatch("retailers differ: %d in the source, %d in the target", len(retailers), len(copiedRetailers))
+	}
+	webhooks, err := from.ListWebhooks(ctx)
+	if err != nil {
+		return report, err
+	}
+	copiedWebhooks, err := to.ListWebhooks(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Webhooks = len(webhooks)
+	if len(webhooks)+len(copiedWebhooks) > 0 && !sameJSON(webhooks, copiedWebhooks) {
+		report.mismatch("webhooks differ: %d in the source, %d in the target", len(webhooks), len(copiedWebhooks))
+	}
+	return report, nil
+}
+
+func eachReceiptPage(ctx context.Context, store db.Store, batch int, f func([]db.ReceiptRecord) error) error {
+	filter := db.ListFilter{Limit: batch}
+	for {
+		recs, cursor, err := store.ListReceipts(ctx, filter)
+		if err != nil {
+			return fmt.Errorf("Error listing receipts: %w", err)
+		}
+		if len(recs) > 0 {
+			if err := f(recs); err != nil {
+				return err
+			}
+		}
+		if cursor == "" {
+			return nil
+		}
+		filter.Cursor = cursor
+	}
+}
+
+// eachUser hands f every user's account once, Redis can list a user on more than one
+// page
+func eachUser(ctx context.Context, store db.Store, batch int, f func(db.UserAccount) error) error {
+	seen := make(map[string]bool)
+	cursor := ""
+	for {
+		ids, next, err := store.ListUsers(ctx, cursor, batch)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			acct, err := store.GetUserAccount(ctx, id)
+			if err != nil {
+				return err
+			}
+			if err := f(acct); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// normalize drops what the stores are allowed to disagree on: Redis keeps when lots
+// expire to the second
+func normalize(acct db.UserAccount) db.UserAccount {
+	lots := make([]db.PointsLot, len(acct.Lots))
+	for i, lot := range acct.Lots {
+		lot.ExpireAt = lot.ExpireAt.Truncate(time.Second).UTC()
+		lots[i] = lot
+	}
+	acct.Lots = lots
+	db.SortAccount(&acct)
+	return acct
+}
+
+// sameJSON compares by encoding, so that times in different zones or with and without
+// a monotonic reading compare equal when they're the same instant as stored. Callers
+// deal with nil and empty lists, which encode differently.
+func sameJSON(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
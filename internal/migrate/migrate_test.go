@@ -0,0 +1,109 @@
+package migrate_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/dualwrite"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/sqlite"
+	"github.com/jayreddy040-510/receipt_processor/internal/migrate"
+	"github.com/jayreddy040-510/receipt_processor/internal/testutil"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// TestCopyRedisToSQLite moves a deployment the way the README describes: dual writes
+// on, copy, verify
+func TestCopyRedisToSQLite(t *testing.T) {
+	cfg := testutil.Config(t, miniredis.RunT(t).Addr(), map[string]string{"REDIS_TTL_IN_S": "0"})
+	source := db.NewRedisStore(cfg)
+	t.Cleanup(func() { source.Close() })
+	cfg.SQLitePath = t.TempDir() + "/receipts.db"
+	target, err := sqlite.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+
+	ctx := context.Background()
+	now := time.Now()
+	expireAt := now.AddDate(0, 1, 0).Truncate(time.Second)
+	receipt := func(id, userID string, points int) db.ReceiptRecord {
+		return db.ReceiptRecord{ID: id, Retailer: "Target", PurchaseDate: "2024-01-01", Points: points,
+			CreatedAt: now.Add(-time.Hour).UTC(), UserID: userID}
+	}
+	r1 := receipt("r1", "u1", 100)
+	r1.PointsExpireAt = &expireAt
+	if err := source.SaveReceipts(ctx, []db.ReceiptRecord{r1, receipt("r2", "u1", 50), receipt("r3", "", 10)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := source.Redeem(ctx, db.Redemption{ID: "red1", UserID: "u1", Points: 30, CreatedAt: now.UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := source.Adjust(ctx, db.Adjustment{ID: "adj1", UserID: "u1", ReceiptID: "r2", Points: -20, Reason: "fraud", CreatedAt: now.UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.SaveCampaign(ctx, db.Campaign{ID: "c1", StartDate: "2024-01-01", EndDate: "2024-01-31"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.SaveRetailer(ctx, db.Retailer{ID: "mm", Name: "M&M Corner Market", Aliases: []string{"MM CORNER MKT"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.AddWebhook(ctx, "https://hooks.example"); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.ForTenant("acme").SaveReceipt(ctx, receipt("t1", "u9", 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second copy mustn't credit anyone again
+	for i := 0; i < 2; i++ {
+		for _, tenantID := range []string{"", "acme"} {
+			report, err := migrate.Copy(ctx, source.ForTenant(tenantID), target.ForTenant(tenantID), 2, now)
+			if err != nil {
+				t.Fatalf("copying tenant %q: %v", tenantID, err)
+			}
+			if tenantID == "" && (report.Receipts != 3 || report.Users != 1 || report.Campaigns != 1 || report.Retailers != 1 || report.Webhooks != 1) {
+				t.Errorf("copy report: got %+v", report)
+			}
+		}
+	}
+	for _, tenantID := range []string{"", "acme"} {
+		if report, err := migrate.Verify(ctx, source.ForTenant(tenantID), target.ForTenant(tenantID), 2); err != nil || report.Mismatched != 0 {
+			t.Fatalf("verifying tenant %q: got %+v, %v", tenantID, report, err)
+		}
+	}
+	points, err := target.GetUserPoints(ctx, "u1", 10)
+	if err != nil || points.Balance != 100 || len(points.Receipts) != 2 {
+		t.Fatalf("copied user: got %+v, %v, want a balance of 100 and 2 receipts", points, err)
+	}
+	if adjustments, err := target.ListAdjustments(ctx, "u1", "r2", 10); err != nil || len(adjustments) != 1 {
+		t.Fatalf("copied adjustments: got %+v, %v, want the clawback", adjustments, err)
+	}
+
+	mirrored := dualwrite.New(source, target)
+	if err := mirrored.SaveReceipt(ctx, receipt("r4", "u1", 7)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := mirrored.MirrorStats(); stats.Mirrored != 1 || stats.Failed != 0 {
+		t.Errorf("dual write stats: got %+v", stats)
+	}
+	if report, err := migrate.Verify(ctx, source, target, 2); err != nil || report.Mismatched != 0 {
+		t.Fatalf("verifying after a dual write: got %+v, %v", report, err)
+	}
+
+	if err := source.SaveReceipt(ctx, receipt("r5", "u1", 3)); err != nil {
+		t.Fatal(err)
+	}
+	report, err := migrate.Verify(ctx, source, target, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(report.Mismatches, "; "); report.Mismatched != 2 ||
+		!strings.Contains(got, "receipt r5 is missing") || !strings.Contains(got, "user u1 differs") {
+		t.Errorf("verifying after a write the target missed: got %d mismatches: %s", report.Mismatched, got)
+	}
+}
@@ -0,0 +1,51 @@
+package ocr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// HTTP posts the raw image to an OCR service and expects {"text": "..."} back. Cloud
+// OCR APIs all differ, so the idea is to point this at a thin adapter (a sidecar or a
+// cloud function) that speaks this contract.
+type HTTP struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func NewHTTP(url, token string) *HTTP {
+	// no client timeout, the caller's context bounds every call
+	return &HTTP{url: url, token: token, client: &http.Client{}}
+}
+
+func (h *HTTP) ExtractText(ctx context.Context, image []byte, contentType string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(image))
+	if err != nil {
+		return "", fmt.Errorf("Error building OCR request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error calling OCR service: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("OCR service responded %d: %s", resp.StatusCode, msg)
+	}
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("Error decoding OCR response: %v", err)
+	}
+	return body.Text, nil
+}
@@ -0,0 +1,47 @@
+package ocr
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+)
+
+const (
+	ContentTypeJPEG = "image/jpeg"
+	ContentTypePNG  = "image/png"
+	ContentTypePDF  = "application/pdf"
+)
+
+// Extractor turns a receipt image (or PDF) into plain text, one printed line per line
+type Extractor interface {
+	ExtractText(ctx context.Context, image []byte, contentType string) (string, error)
+}
+
+func IsSupportedContentType(contentType string) bool {
+	switch contentType {
+	case ContentTypeJPEG, ContentTypePNG, ContentTypePDF:
+		return true
+	}
+	return false
+}
+
+// New builds the extractor selected by OCR_BACKEND, nil when OCR is disabled
+func New(cfg config.Config) (Extractor, error) {
+	switch cfg.OCRBackend {
+	case "":
+		return nil, nil
+	case "tesseract":
+		return &Tesseract{
+			TesseractPath: cfg.OCRTesseractPath,
+			PdftoppmPath:  cfg.OCRPdftoppmPath,
+		}, nil
+	case "http":
+		if cfg.OCRHTTPURL == "" {
+			return nil, fmt.Errorf("OCR_BACKEND=http needs OCR_HTTP_URL")
+		}
+		return NewHTTP(cfg.OCRHTTPURL, cfg.OCRHTTPToken), nil
+	default:
+		return nil, fmt.Errorf("Unknown OCR_BACKEND %q, expected tesseract or http", cfg.OCRBackend)
+	}
+}
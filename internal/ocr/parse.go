@@ -0,0 +1,156 @@
+package ocr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Item and Fields mirror the receipt JSON, with everything still as strings so the
+// regular receipt validation runs on OCR'd receipts too
+type Item struct {
+	ShortDescription string `json:"shortDescription"`
+	Price            string `json:"price"`
+}
+
+type Fields struct {
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+	Items        []Item `json:"items"`
+	Total        string `json:"total"`
+}
+
+var (
+	// "GATORADE 2.25", "Emils Cheese Pizza $12.25 TF". trailing 1-2 letters are POS tax flags
+	priceLineRe = regexp.MustCompile(`^(.*?\S)\s+\$?(\d{1,6}[.,]\d{2})(?:\s+[A-Z]{1,2})?$`)
+	isoDateRe   = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`)
+	usDateRe    = regexp.MustCompile(`\b(\d{1,2})/(\d{1,2})/(\d{2}|\d{4})\b`)
+	timeRe      = regexp.MustCompile(`\b(\d{1,2}):(\d{2})(?::\d{2})?\s*([AaPp][Mm])?\b`)
+
+	// lines with these are payment/summary lines, never items
+	nonItemKeywords = []string{
+		"TOTAL", "TAX", "CHANGE", "CASH", "BALANCE", "VISA", "MASTERCARD", "AMEX", "DEBIT",
+		"CREDIT", "TENDER", "AMOUNT", "DUE", "SAVINGS", "DISCOUNT", "COUPON",
+	}
+	totalKeywords = []string{"TOTAL", "BALANCE DUE", "AMOUNT DUE"}
+)
+
+// ParseReceipt pulls receipt fields out of OCR text with some line based heuristics.
+// Anything it can't find is left empty and will fail validation downstream.
+func ParseReceipt(text string) Fields {
+	var (
+		fields    Fields
+		lines     []string
+		totalLine = -1
+	)
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	for i, line := range lines {
+		upper := strings.ToUpper(line)
+		if fields.PurchaseDate == "" {
+			fields.PurchaseDate = findDate(line)
+		}
+		if fields.PurchaseTime == "" {
+			fields.PurchaseTime = findTime(line)
+		}
+		if fields.Retailer == "" && looksLikeRetailer(line) {
+			fields.Retailer = line
+			continue
+		}
+
+		m := priceLineRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		price := strings.Replace(m[2], ",", ".", 1)
+		if fields.Total == "" && isTotalLine(upper) {
+			fields.Total = price
+			totalLine = i
+			continue
+		}
+		// nothing after the total is an item (tender, change, loyalty blurbs...)
+		if totalLine == -1 && !containsAny(upper, nonItemKeywords) {
+			fields.Items = append(fields.Items, Item{ShortDescription: m[1], Price: price})
+		}
+	}
+	return fields
+}
+
+func looksLikeRetailer(line string) bool {
+	var letters int
+	for _, c := range line {
+		if unicode.IsLetter(c) {
+			letters++
+		}
+	}
+	return letters >= 2 && !priceLineRe.MatchString(line) && findDate(line) == "" && findTime(line) == ""
+}
+
+func isTotalLine(upper string) bool {
+	if strings.Contains(upper, "SUBTOTAL") || strings.Contains(upper, "SUB TOTAL") || strings.Contains(upper, "TAX") {
+		return false
+	}
+	return containsAny(upper, totalKeywords)
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// findDate returns the first date on the line as YYYY-MM-DD. Slashed dates are read
+// US style (MM/DD/YY) since that's what our partners' POS systems print.
+func findDate(line string) string {
+	if m := isoDateRe.FindStringSubmatch(line); m != nil {
+		return m[0]
+	}
+	m := usDateRe.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	month, _ := strconv.Atoi(m[1])
+	day, _ := strconv.Atoi(m[2])
+	year, _ := strconv.Atoi(m[3])
+	if year < 100 {
+		year += 2000
+	}
+	if month < 1 || month > 12 || day < 1 || day > 31 {
+		return ""
+	}
+	return fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+}
+
+// findTime returns the first time on the line as 24h HH:MM
+func findTime(line string) string {
+	m := timeRe.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	hour, _ := strconv.Atoi(m[1])
+	minute, _ := strconv.Atoi(m[2])
+	switch strings.ToUpper(m[3]) {
+	case "PM":
+		if hour < 12 {
+			hour += 12
+		}
+	case "AM":
+		if hour == 12 {
+			hour = 0
+		}
+	}
+	if hour > 23 || minute > 59 {
+		return ""
+	}
+	return fmt.Sprintf("%02d:%02d", hour, minute)
+}
@@ -0,0 +1,78 @@
+package ocr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Tesseract shells out to the tesseract binary. PDFs are rasterized with pdftoppm
+// (poppler-utils) first since tesseract can't read them.
+type Tesseract struct {
+	TesseractPath string
+	PdftoppmPath  string
+}
+
+func (t *Tesseract) ExtractText(ctx context.Context, image []byte, contentType string) (string, error) {
+	dir, err := os.MkdirTemp("", "receipt-ocr-")
+	if err != nil {
+		return "", fmt.Errorf("Error creating OCR work dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input")
+	if err := os.WriteFile(input, image, 0o600); err != nil {
+		return "", fmt.Errorf("Error writing OCR input: %v", err)
+	}
+
+	pages := []string{input}
+	if contentType == ContentTypePDF {
+		if pages, err = t.rasterize(ctx, input, dir); err != nil {
+			return "", err
+		}
+	}
+
+	var text strings.Builder
+	for _, page := range pages {
+		out, err := run(ctx, t.TesseractPath, page, "stdout", "--psm", "4")
+		if err != nil {
+			return "", err
+		}
+		text.Write(out)
+		text.WriteString("\n")
+	}
+	return text.String(), nil
+}
+
+func (t *Tesseract) rasterize(ctx context.Context, pdf, dir string) ([]string, error) {
+	prefix := filepath.Join(dir, "page")
+	if _, err := run(ctx, t.PdftoppmPath, "-r", "300", "-png", pdf, prefix); err != nil {
+		return nil, err
+	}
+	pages, err := filepath.Glob(prefix + "*.png")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing rasterized pages: %v", err)
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("PDF has no pages")
+	}
+	// pdftoppm zero pads page numbers so lexical order is page order
+	sort.Strings(pages)
+	return pages, nil
+}
+
+func run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Error running %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,435 @@
+// Package oidc signs admins in with an OpenID Connect provider: it verifies the ID
+// tokens (and JWT access tokens) the provider issues against its published keys, and
+// runs the authorization code flow for browsers. Only what the admin routes need is
+// here, RS256/384/512 and ES256/384/512 signed tokens and a confidential client.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken is a token that doesn't verify: malformed, badly signed, expired or
+// not meant for this client
+var ErrInvalidToken = errors.New("invalid token")
+
+const (
+	// clocks drift, tokens are taken a minute either side of their validity
+	leeway = time.Minute
+	// unknown key ids refetch the provider's keys (it may have rotated them), but no
+	// more often than this, so tokens made up with random ids can't keep it fetching
+	minKeyRefresh = time.Minute
+	maxBodyBytes  = 1 << 20
+)
+
+// Provider is an OpenID Connect provider as configured for one client
+type Provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	authURL      string
+	tokenURL     string
+	jwksURL      string
+	client       *http.Client
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey
+	// when an unknown key id last made it refetch the keys
+	refetchedAt time.Time
+}
+
+// Claims are a verified token's claims
+type Claims map[string]interface{}
+
+type discovery struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURL  string `json:"jwks_uri"`
+}
+
+// Discover reads the provider's configuration from the issuer's
+// /.well-known/openid-configuration and loads its keys. redirectURL is where the
+// provider sends browsers back to, empty when only bearer tokens are used.
+func Discover(ctx context.Context, client *http.Client, issuer, clientID, clientSecret, redirectURL string) (*Provider, error) {
+	var doc discovery
+	if err := getJSON(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, fmt.Errorf("Error discovering OIDC provider %s: %w", issuer, err)
+	}
+	// a provider must name itself the way it's configured, or its tokens won't match
+	if doc.Issuer != issuer {
+		return nil, fmt.Errorf("Error discovering OIDC provider %s: it calls itself %q", issuer, doc.Issuer)
+	}
+	if doc.JWKSURL == "" || doc.AuthURL == "" || doc.TokenURL == "" {
+		return nil, fmt.Errorf("Error discovering OIDC provider %s: endpoints missing from its configuration", issuer)
+	}
+	p := &Provider{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		authURL:      doc.AuthURL,
+		tokenURL:     doc.TokenURL,
+		jwksURL:      doc.JWKSURL,
+		client:       client,
+	}
+	if err := p.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Login reports whether browsers can sign in, i.e. there's a redirect URL
+func (p *Provider) Login() bool {
+	return p.redirectURL != ""
+}
+
+// RedirectURL is where the provider sends browsers back to
+func (p *Provider) RedirectURL() string {
+	return p.redirectURL
+}
+
+// AuthCodeURL is where to send a browser to sign in. state comes back on the redirect,
+// nonce in the ID token.
+func (p *Provider) AuthCodeURL(state, nonce string) string {
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.clientID},
+		"redirect_uri":  {p.redirectURL},
+		"scope":         {"openid profile email"},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(p.authURL, "?") {
+		sep = "&"
+	}
+	return p.authURL + sep + q.Encode()
+}
+
+// Exchange trades the code a browser came back with for its ID token, verified
+func (p *Provider) Exchange(ctx context.Context, code string) (string, Claims, error) {
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {p.redirectURL}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", nil, fmt.Errorf("Error exchanging OIDC code: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error exchanging OIDC code: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+	if err != nil {
+		return "", nil, fmt.Errorf("Error exchanging OIDC code: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("Error exchanging OIDC code: the provider answered %d %s", resp.StatusCode, body)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil || tokens.IDToken == "" {
+		return "", nil, fmt.Errorf("Error exchanging OIDC code: no ID token in the answer")
+	}
+	claims, err := p.Verify(ctx, tokens.IDToken)
+	if err != nil {
+		return "", nil, err
+	}
+	return tokens.IDToken, claims, nil
+}
+
+// Verify checks a token's signature against the provider's keys and that it was
+// issued by the provider, for this client, and hasn't expired. It returns the claims.
+func (p *Provider) Verify(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	hash, ok := algHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(key, header.Alg, hash, h.Sum(nil), sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+	if iss, _ := claims["iss"].(string); iss != p.issuer {
+		return nil, fmt.Errorf("%w: issued by %q", ErrInvalidToken, iss)
+	}
+	if !claims.audience(p.clientID) {
+		return nil, fmt.Errorf("%w: not for client %q", ErrInvalidToken, p.clientID)
+	}
+	now := time.Now()
+	exp, ok := claims.time("exp")
+	if !ok || now.After(exp.Add(leeway)) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+var algHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+func verifySignature(key crypto.PublicKey, alg string, hash crypto.Hash, digest, sig []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		// JWS signatures are r and s back to back, each the curve's size
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// key is the provider's key with the id. An id it doesn't know refetches the keys,
+// the provider may have rotated them.
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.lookup(kid)
+	refetch := !ok && time.Since(p.refetchedAt) > minKeyRefresh
+	if refetch {
+		p.refetchedAt = time.Now()
+	}
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if refetch {
+		if err := p.refreshKeys(ctx); err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		key, ok = p.lookup(kid)
+		p.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+}
+
+// lookup finds a key by id, a token without one goes with the only key there is.
+// Callers hold mu.
+func (p *Provider) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// refreshKeys loads the provider's signing keys. Keys of a type it can't use are
+// skipped.
+func (p *Provider) refreshKeys(ctx context.Context) error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(ctx, p.client, p.jwksURL, &set); err != nil {
+		return fmt.Errorf("Error loading OIDC keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC key isn't on its curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// Strings is the claim at path (dots go into nested objects, like
+// realm_access.roles) as a list of strings. A single string is a list of one.
+func (c Claims) Strings(path string) []string {
+	var v interface{} = map[string]interface{}(c)
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = obj[name]
+	}
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// Subject is who the token is for, by email when it has one
+func (c Claims) Subject() string {
+	if email, _ := c["email"].(string); email != "" {
+		return email
+	}
+	sub, _ := c["sub"].(string)
+	return sub
+}
+
+// Expiry is when the token expires
+func (c Claims) Expiry() time.Time {
+	exp, _ := c.time("exp")
+	return exp
+}
+
+func (c Claims) audience(clientID string) bool {
+	for _, aud := range c.Strings("aud") {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(raw) == 0 {
+		return nil, errors.New("bad key parameter")
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxBodyBytes)).Decode(v)
+}
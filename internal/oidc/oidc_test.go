@@ -0,0 +1,85 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/oidc"
+	"github.com/jayreddy040-510/receipt_processor/internal/oidc/oidctest"
+)
+
+func discover(t *testing.T, idp *oidctest.Provider) *oidc.Provider {
+	t.Helper()
+	p, err := oidc.Discover(context.Background(), http.DefaultClient, idp.Issuer, idp.ClientID, idp.ClientSecret, "")
+	if err != nil {
+		t.Fatalf("Error discovering the provider: %v", err)
+	}
+	return p
+}
+
+func TestVerify(t *testing.T) {
+	idp := oidctest.New(t, "receipts", "secret")
+	p := discover(t, idp)
+	ctx := context.Background()
+	hour := time.Hour.Seconds()
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		claims, err := p.Verify(ctx, idp.Sign(t, alg, map[string]interface{}{"sub": "ana", "roles": []string{"viewer", "ops"}}))
+		if err != nil {
+			t.Fatalf("%s token didn't verify: %v", alg, err)
+		}
+		if got := claims.Strings("roles"); strings.Join(got, ",") != "viewer,ops" {
+			t.Errorf("%s token has roles %v", alg, got)
+		}
+	}
+
+	nested := idp.Token(t, map[string]interface{}{"realm_access": map[string]interface{}{"roles": "ops"}, "aud": []string{"other", "receipts"}})
+	if claims, err := p.Verify(ctx, nested); err != nil || strings.Join(claims.Strings("realm_access.roles"), ",") != "ops" {
+		t.Errorf("nested roles claim: got %v, %v", claims.Strings("realm_access.roles"), err)
+	}
+
+	tampered := idp.Token(t, map[string]interface{}{"sub": "ana"})
+	parts := strings.Split(tampered, ".")
+	parts[1] = strings.Split(idp.Token(t, map[string]interface{}{"sub": "root"}), ".")[1]
+	unsigned := parts[0] + "." + parts[1] + "."
+	rejected := map[string]string{
+		"expired":      idp.Token(t, map[string]interface{}{"exp": float64(time.Now().Unix()) - 2*hour}),
+		"not yet":      idp.Token(t, map[string]interface{}{"nbf": float64(time.Now().Unix()) + hour}),
+		"other client": idp.Token(t, map[string]interface{}{"aud": "someone-else"}),
+		"other issuer": idp.Token(t, map[string]interface{}{"iss": "https://evil.example.com"}),
+		"tampered":     strings.Join(parts, "."),
+		"unsigned":     unsigned,
+		"alg none":     `eyJhbGciOiJub25lIn0.` + parts[1] + ".",
+		"garbage":      "not-a-token",
+	}
+	for name, token := range rejected {
+		if _, err := p.Verify(ctx, token); !errors.Is(err, oidc.ErrInvalidToken) {
+			t.Errorf("%s token: got %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
+
+func TestVerifyAfterKeyRotation(t *testing.T) {
+	idp := oidctest.New(t, "receipts", "secret")
+	p := discover(t, idp)
+	old := idp.Token(t, nil)
+	idp.Rotate(t)
+	// the new key id isn't known yet, it makes the keys get fetched again
+	if _, err := p.Verify(context.Background(), idp.Token(t, nil)); err != nil {
+		t.Fatalf("token signed with the rotated key didn't verify: %v", err)
+	}
+	if _, err := p.Verify(context.Background(), old); !errors.Is(err, oidc.ErrInvalidToken) {
+		t.Errorf("token signed with the retired key: got %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestDiscoverRejectsIssuerMismatch(t *testing.T) {
+	idp := oidctest.New(t, "receipts", "secret")
+	if _, err := oidc.Discover(context.Background(), http.DefaultClient, idp.Issuer+"/", "receipts", "secret", ""); err == nil {
+		t.Error("discovered a provider that calls itself something else")
+	}
+}
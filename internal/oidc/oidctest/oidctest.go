@@ -0,0 +1,249 @@
+// Package oidctest is an OpenID Connect provider for tests: it publishes its discovery
+// document and keys, signs whatever tokens a test asks for and signs browsers in as
+// whoever the test says, without asking anything.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Provider is a running fake provider. Issuer is its URL, clients sign in as
+// ClientID/ClientSecret.
+type Provider struct {
+	Server       *httptest.Server
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	mu     sync.Mutex
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+	// bumped by Rotate, part of the key ids
+	generation int
+	// who the next browser signs in as
+	signIn map[string]interface{}
+	// issued codes -> the ID token they trade for
+	codes map[string]string
+}
+
+// New starts a provider, stopped when the test ends
+func New(t testing.TB, clientID, clientSecret string) *Provider {
+	t.Helper()
+	p := &Provider{ClientID: clientID, ClientSecret: clientSecret, codes: make(map[string]string)}
+	p.newKeys(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/keys", p.keys)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	p.Issuer = p.Server.URL
+	t.Cleanup(p.Server.Close)
+	return p
+}
+
+func (p *Provider) newKeys(t testing.TB) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating an RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating an EC key: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rsaKey, p.ecKey = rsaKey, ecKey
+	p.generation++
+}
+
+// Rotate replaces the provider's keys, tokens signed before don't verify anymore
+func (p *Provider) Rotate(t testing.TB) {
+	t.Helper()
+	p.newKeys(t)
+}
+
+// Token is an RS256 ID token with claims, see Sign
+func (p *Provider) Token(t testing.TB, claims map[string]interface{}) string {
+	t.Helper()
+	return p.Sign(t, "RS256", claims)
+}
+
+// Sign signs claims with alg, RS256 or ES256. iss, aud, iat and exp (an hour from now)
+// are filled in unless claims has them.
+func (p *Provider) Sign(t testing.TB, alg string, claims map[string]interface{}) string {
+	t.Helper()
+	token, err := p.sign(alg, claims)
+	if err != nil {
+		t.Fatalf("Error signing a token: %v", err)
+	}
+	return token
+}
+
+func (p *Provider) sign(alg string, claims map[string]interface{}) (string, error) {
+	full := map[string]interface{}{
+		"iss": p.Issuer,
+		"aud": p.ClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		full[k] = v
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	header, err := segment(map[string]string{"alg": alg, "typ": "JWT", "kid": p.kid(alg)})
+	if err != nil {
+		return "", err
+	}
+	payload, err := segment(full)
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + payload
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, p.rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, p.ecKey, digest[:])
+		if err == nil {
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	default:
+		err = fmt.Errorf("can't sign with %s", alg)
+	}
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// SignIn makes the next browser sent to the provider sign in with claims. A sign in
+// without it comes back with error=access_denied.
+func (p *Provider) SignIn(claims map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.signIn = claims
+}
+
+// kid is the id of the alg's key. Callers hold mu.
+func (p *Provider) kid(alg string) string {
+	return alg[:2] + "-" + strconv.Itoa(p.generation)
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{
+		"issuer":                 p.Issuer,
+		"authorization_endpoint": p.Issuer + "/authorize",
+		"token_endpoint":         p.Issuer + "/token",
+		"jwks_uri":               p.Issuer + "/keys",
+	})
+}
+
+func (p *Provider) keys(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b64 := base64.RawURLEncoding.EncodeToString
+	writeJSON(w, map[string]interface{}{"keys": []map[string]string{
+		{
+			"kty": "RSA", "use": "sig", "alg": "RS256", "kid": p.kid("RS256"),
+			"n": b64(p.rsaKey.N.Bytes()),
+			"e": b64(big.NewInt(int64(p.rsaKey.E)).Bytes()),
+		},
+		{
+			"kty": "EC", "use": "sig", "alg": "ES256", "kid": p.kid("ES256"), "crv": "P-256",
+			"x": b64(p.ecKey.X.FillBytes(make([]byte, 32))),
+			"y": b64(p.ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+	}})
+}
+
+// authorize signs the browser straight in and sends it back with a code
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	back, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("client_id") != p.ClientID {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	claims := p.signIn
+	p.mu.Unlock()
+	answer := url.Values{"state": {q.Get("state")}}
+	if claims == nil {
+		answer.Set("error", "access_denied")
+	} else {
+		withNonce := map[string]interface{}{"nonce": q.Get("nonce")}
+		for k, v := range claims {
+			withNonce[k] = v
+		}
+		code := strconv.FormatInt(time.Now().UnixNano(), 36)
+		token, err := p.sign("RS256", withNonce)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.mu.Lock()
+		p.codes[code] = token
+		p.mu.Unlock()
+		answer.Set("code", code)
+	}
+	back.RawQuery = answer.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+// token trades a code for its ID token, once
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != p.ClientID || secret != p.ClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJSON(w, map[string]string{"error": "invalid_client"})
+		return
+	}
+	code := r.PostFormValue("code")
+	p.mu.Lock()
+	token, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	writeJSON(w, map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": token})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func segment(v interface{}) (string, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,298 @@
+// Package outbox holds receipts that couldn't be saved because the store was down, in
+// a file on local disk or only in memory, until they can be written. Processing answers
+// as if the receipt had been saved, the receipt shows up in the store once the outbox
+// is flushed.
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// ErrFull is returned by Add when the outbox holds as many receipts as it may
+var ErrFull = errors.New("outbox full")
+
+// Entry is a receipt waiting to be saved
+type Entry struct {
+	// empty for the default tenant
+	Tenant   string           `json:"tenant,omitempty"`
+	Record   db.ReceiptRecord `json:"record"`
+	QueuedAt time.Time        `json:"queuedAt"`
+	// taken while the store was down before the checks that need it had run: fraud
+	// screening against other receipts and the tenant's quota. They run when it's
+	// flushed, and it's only announced then
+	Provisional bool `json:"provisional,omitempty"`
+	// the receipt's fraud fingerprint, set on provisional entries when screening is on
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// Stats is what the outbox holds and has done since boot
+type Stats struct {
+	Pending int   `json:"pending"`
+	Queued  int64 `json:"queued"`
+	Flushed int64 `json:"flushed"`
+	// entries whose receipt turned out to be in the store already
+	Skipped int64 `json:"skipped"`
+}
+
+// Outbox is an append-only file of entries plus the same entries in memory. It's meant
+// for one process, instances don't share an outbox.
+type Outbox struct {
+	// empty for an outbox kept in memory only, file is nil then
+	path       string
+	maxEntries int
+
+	mu      sync.Mutex
+	file    *os.File
+	entries []Entry
+	// tenant + "/" + receipt id -> index in entries
+	index map[string]int
+
+	queued  atomic.Int64
+	flushed atomic.Int64
+	skipped atomic.Int64
+}
+
+// Open loads the outbox at path, creating the file if it isn't there. Entries a
+// previous run didn't get to flush are pending again. 0 maxEntries is no limit.
+func Open(path string, maxEntries int) (*Outbox, error) {
+	ob := &Outbox{path: path, maxEntries: maxEntries}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening outbox %s: %w", path, err)
+	}
+	var entries []Entry
+	partial := false
+	lines := bufio.NewScanner(f)
+	lines.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lines.Scan() {
+		var e Entry
+		// a crash halfway through an append leaves a partial last line, that entry
+		// was never acknowledged to anyone
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			partial = true
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := lines.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error reading outbox %s: %w", path, err)
+	}
+	ob.file = f
+	// the next append would go on the end of the partial line
+	if partial {
+		if err := ob.rewrite(entries); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	ob.setEntries(entries)
+	return ob, nil
+}
+
+// New is an empty outbox kept in memory only, what's in it is lost with the process.
+// 0 maxEntries is no limit.
+func New(maxEntries int) *Outbox {
+	ob := &Outbox{maxEntries: maxEntries}
+	ob.setEntries(nil)
+	return ob
+}
+
+func entryKey(tenantID, id string) string {
+	return tenantID + "/" + id
+}
+
+func (ob *Outbox) setEntries(entries []Entry) {
+	ob.entries = entries
+	ob.index = make(map[string]int, len(entries))
+	for i, e := range entries {
+		ob.index[entryKey(e.Tenant, e.Record.ID)] = i
+	}
+}
+
+// Add appends the receipts to the file and syncs it, they're only acknowledged once
+// they're on disk. All or nothing: ErrFull when they don't all fit.
+func (ob *Outbox) Add(tenantID string, recs []db.ReceiptRecord, now time.Time) error {
+	added := make([]Entry, len(recs))
+	for i, rec := range recs {
+		added[i] = Entry{Tenant: tenantID, Record: rec, QueuedAt: now.UTC()}
+	}
+	return ob.add(added)
+}
+
+// AddProvisional adds receipts taken before the store had a say in them, like Add.
+// fingerprints line up with recs, empty when the receipt isn't screened.
+func (ob *Outbox) AddProvisional(tenantID string, recs []db.ReceiptRecord, fingerprints []string, now time.Time) error {
+	added := make([]Entry, len(recs))
+	for i, rec := range recs {
+		added[i] = Entry{Tenant: tenantID, Record: rec, QueuedAt: now.UTC(), Provisional: true, Fingerprint: fingerprints[i]}
+	}
+	return ob.add(added)
+}
+
+func (ob *Outbox) add(added []Entry) error {
+	var buf []byte
+	if ob.path != "" {
+		for _, e := range added {
+			line, err := json.Marshal(e)
+			if err != nil {
+				return fmt.Errorf("Error encoding outbox entry: %v", err)
+			}
+			buf = append(append(buf, line...), '\n')
+		}
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if ob.maxEntries > 0 && len(ob.entries)+len(added) > ob.maxEntries {
+		return ErrFull
+	}
+	if ob.file != nil {
+		if _, err := ob.file.Write(buf); err != nil {
+			return fmt.Errorf("Error writing outbox: %w", err)
+		}
+		if err := ob.file.Sync(); err != nil {
+			return fmt.Errorf("Error syncing outbox: %w", err)
+		}
+	}
+	for _, e := range added {
+		ob.index[entryKey(e.Tenant, e.Record.ID)] = len(ob.entries)
+		ob.entries = append(ob.entries, e)
+	}
+	ob.queued.Add(int64(len(added)))
+	return nil
+}
+
+// Get is the pending receipt with the id, for reads that come in before it's flushed
+func (ob *Outbox) Get(tenantID, id string) (db.ReceiptRecord, bool) {
+	e, ok := ob.Pending(tenantID, id)
+	return e.Record, ok
+}
+
+// Pending is the entry of the pending receipt with the id
+func (ob *Outbox) Pending(tenantID, id string) (Entry, bool) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	i, ok := ob.index[entryKey(tenantID, id)]
+	if !ok {
+		return Entry{}, false
+	}
+	return ob.entries[i], true
+}
+
+// Len is how many receipts are waiting
+func (ob *Outbox) Len() int {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	return len(ob.entries)
+}
+
+func (ob *Outbox) Stats() Stats {
+	return Stats{
+		Pending: ob.Len(),
+		Queued:  ob.queued.Load(),
+		Flushed: ob.flushed.Load(),
+		Skipped: ob.skipped.Load(),
+	}
+}
+
+// Flush hands entries to save oldest first and drops the ones it succeeds for. save
+// reports whether it wrote the receipt or found it in the store already. Flushing
+// stops at the first error, the entries from there on stay for the next flush. Adds
+// can go on while a flush runs, flushes can't run concurrently.
+func (ob *Outbox) Flush(ctx context.Context, save func(ctx context.Context, e Entry) (bool, error)) (int, error) {
+	ob.mu.Lock()
+	pending := ob.entries
+	ob.mu.Unlock()
+
+	done := 0
+	var saveErr error
+	for _, e := range pending {
+		if saveErr = ctx.Err(); saveErr != nil {
+			break
+		}
+		written, err := save(ctx, e)
+		if err != nil {
+			saveErr = err
+			break
+		}
+		done++
+		if written {
+			ob.flushed.Add(1)
+		} else {
+			ob.skipped.Add(1)
+		}
+	}
+	if done == 0 {
+		return 0, saveErr
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	// what was added during the flush is behind the pending entries
+	left := append([]Entry(nil), ob.entries[done:]...)
+	if err := ob.rewrite(left); err != nil {
+		// the entries are saved but still in the file, the next flush finds them in
+		// the store and skips them
+		return done, err
+	}
+	ob.setEntries(left)
+	return done, saveErr
+}
+
+// rewrite replaces the file with one holding only entries, atomically so a crash
+// leaves either the old file or the new one. Appends go on in the new file.
+func (ob *Outbox) rewrite(entries []Entry) error {
+	if ob.path == "" {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(ob.path), filepath.Base(ob.path)+".*")
+	if err != nil {
+		return fmt.Errorf("Error rewriting outbox: %w", err)
+	}
+	out := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(out)
+	for _, e := range entries {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), ob.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Error rewriting outbox: %w", err)
+	}
+	ob.file.Close()
+	ob.file = tmp
+	return nil
+}
+
+// Close closes the file, pending entries stay in it for the next Open
+func (ob *Outbox) Close() error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if ob.file == nil {
+		return nil
+	}
+	return ob.file.Close()
+}
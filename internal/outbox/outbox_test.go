@@ -0,0 +1,162 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+var now = time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+
+func records(ids ...string) []db.ReceiptRecord {
+	recs := make([]db.ReceiptRecord, len(ids))
+	for i, id := range ids {
+		recs[i] = db.ReceiptRecord{ID: id, Retailer: "Target", Points: 28, CreatedAt: now}
+	}
+	return recs
+}
+
+func TestAddSurvivesReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	ob, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.Add("", records("a", "b"), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.Add("acme", records("c"), now); err != nil {
+		t.Fatal(err)
+	}
+	ob.Close()
+
+	// a crash in the middle of an append
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	f.WriteString(`{"tenant":"acme","rec`)
+	f.Close()
+
+	ob, err = Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ob.Len() != 3 {
+		t.Fatalf("reopened with %d entries, want 3", ob.Len())
+	}
+	if _, ok := ob.Get("acme", "c"); !ok {
+		t.Error("c isn't pending for acme")
+	}
+	if _, ok := ob.Get("", "c"); ok {
+		t.Error("c is pending for the default tenant")
+	}
+	if err := ob.Add("", records("d"), now); err != nil {
+		t.Fatal(err)
+	}
+	ob.Close()
+	if ob, err = Open(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer ob.Close()
+	if ob.Len() != 4 {
+		t.Fatalf("appending after a partial line: reopened with %d entries, want 4", ob.Len())
+	}
+}
+
+func TestAddWhenFull(t *testing.T) {
+	ob, err := Open(filepath.Join(t.TempDir(), "outbox.jsonl"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ob.Close()
+	if err := ob.Add("", records("a"), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.Add("", records("b", "c"), now); !errors.Is(err, ErrFull) {
+		t.Fatalf("got %v, want ErrFull", err)
+	}
+	if ob.Len() != 1 {
+		t.Errorf("a batch that didn't fit left %d entries, want 1", ob.Len())
+	}
+}
+
+func TestFlushStopsAtTheFirstFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	ob, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.Add("", records("a", "b", "c"), now); err != nil {
+		t.Fatal(err)
+	}
+	down := errors.New("connection refused")
+	var saved []string
+	flushed, err := ob.Flush(context.Background(), func(ctx context.Context, e Entry) (bool, error) {
+		if e.Record.ID == "b" {
+			return false, down
+		}
+		saved = append(saved, e.Record.ID)
+		return true, nil
+	})
+	if flushed != 1 || !errors.Is(err, down) {
+		t.Fatalf("got %d, %v, want 1 flushed and the save error", flushed, err)
+	}
+	if _, ok := ob.Get("", "a"); ok || ob.Len() != 2 {
+		t.Errorf("after flushing a: %d pending, a still there: %v", ob.Len(), ok)
+	}
+
+	if err := ob.Add("", records("d"), now); err != nil {
+		t.Fatal(err)
+	}
+	flushed, err = ob.Flush(context.Background(), func(ctx context.Context, e Entry) (bool, error) {
+		saved = append(saved, e.Record.ID)
+		return e.Record.ID != "c", nil
+	})
+	if flushed != 3 || err != nil {
+		t.Fatalf("got %d, %v, want 3 flushed", flushed, err)
+	}
+	if got := strings.Join(saved, ","); got != "a,b,c,d" {
+		t.Errorf("saved %s, want a,b,c,d", got)
+	}
+	if stats := ob.Stats(); stats.Pending != 0 || stats.Queued != 4 || stats.Flushed != 3 || stats.Skipped != 1 {
+		t.Errorf("stats: got %+v", stats)
+	}
+	ob.Close()
+	if ob, err = Open(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer ob.Close()
+	if ob.Len() != 0 {
+		t.Fatalf("reopened a flushed outbox with %d entries", ob.Len())
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	ob := New(2)
+	defer ob.Close()
+	if err := ob.Add("", records("a"), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.AddProvisional("acme", records("b"), []string{"fp"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.Add("", records("c"), now); !errors.Is(err, ErrFull) {
+		t.Fatalf("got %v, want ErrFull", err)
+	}
+	if e, ok := ob.Pending("acme", "b"); !ok || !e.Provisional || e.Fingerprint != "fp" {
+		t.Fatalf("provisional entry: got %+v, %v", e, ok)
+	}
+	if e, _ := ob.Pending("", "a"); e.Provisional {
+		t.Error("an entry added with Add is provisional")
+	}
+	flushed, err := ob.Flush(context.Background(), func(ctx context.Context, e Entry) (bool, error) {
+		return true, nil
+	})
+	if flushed != 2 || err != nil || ob.Len() != 0 {
+		t.Fatalf("got %d, %v with %d left, want 2 flushed and none left", flushed, err, ob.Len())
+	}
+}
@@ -0,0 +1,310 @@
+// Package plugin runs scoring rule plugins: WebAssembly modules partners ship that are
+// handed a parsed receipt and answer with points to add to it. Modules run inside the
+// service on an embedded runtime (wazero) with WASI but no filesystem, network or
+// environment, a memory limit and a timeout. Every run is a fresh instance, so a
+// plugin can't hold on to anything between receipts.
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// ErrFailed marks a plugin that didn't answer: it's missing, crashed, ran out of time
+// or memory, or wrote something other than a list of deltas. It's never the receipt's
+// fault.
+var ErrFailed = errors.New("rule plugin failed")
+
+// what a plugin may answer with
+const (
+	maxOutputBytes  = 64 << 10
+	maxDeltas       = 100
+	maxDetailLength = 128
+	// points either way, for one delta and for all of a run's
+	maxDeltaPoints = 10000
+	maxRunPoints   = 100000
+)
+
+// compileTimeout bounds compiling a plugin, which a run waits on when its plugin is new
+// or was replaced
+const compileTimeout = time.Minute
+
+// plugins are named by file name, never by path, so a rules file can't run anything
+// outside the plugin directory
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// pageSize is the size of a WebAssembly memory page, what memory limits count in
+const pageSize = 64 << 10
+
+// Delta is points a plugin gives a receipt, negative to take some off. Detail is what
+// the receipt's breakdown shows for them.
+type Delta struct {
+	Detail string `json:"detail"`
+	Points int    `json:"points"`
+}
+
+// Runner runs the plugins in one directory
+type Runner struct {
+	dir     string
+	timeout time.Duration
+	runtime wazero.Runtime
+
+	mu sync.Mutex
+	// compiled modules by plugin name
+	modules map[string]*module
+}
+
+// module is a compiled plugin, along with what its file looked like when it was
+// compiled so a plugin that's replaced gets compiled again
+type module struct {
+	modTime time.Time
+	size    int64
+	// closed once compiled or err is set
+	ready    chan struct{}
+	compiled wazero.CompiledModule
+	err      error
+	// the runs using the module, plus one while it's the plugin's current module. The
+	// last one to let go closes it. Guarded by Runner.mu
+	refs int
+}
+
+// New is the runner RULE_PLUGIN_DIR configures, nil when plugins are off
+func New(cfg config.Config) *Runner {
+	if cfg.RulePluginDir == "" {
+		return nil
+	}
+	// design decision: one runtime compiles every plugin once and instantiates it per
+	// receipt. closing on context done is what stops a plugin that spins past its
+	// timeout, wazero has no instruction metering
+	runtimeConfig := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(cfg.RulePluginMemoryLimitInMB * (1 << 20) / pageSize)).
+		WithCloseOnContextDone(true)
+	rt := wazero.NewRuntimeWithConfig(context.Background(), runtimeConfig)
+	wasi_snapshot_preview1.MustInstantiate(context.Background(), rt)
+	return &Runner{
+		dir:     cfg.RulePluginDir,
+		timeout: cfg.RulePluginTimeoutInMs,
+		runtime: rt,
+		modules: make(map[string]*module),
+	}
+}
+
+// Close releases the compiled plugins
+func (r *Runner) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.runtime.Close(context.Background())
+}
+
+// ValidName reports whether name can name a plugin, a <name>.wasm file right in the
+// plugin directory
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// Check makes sure the plugin called name is there to run, compiling it if it wasn't
+// already
+func (r *Runner) Check(name string) error {
+	if r == nil {
+		return fmt.Errorf("rule plugin %q can't run, RULE_PLUGIN_DIR isn't set", name)
+	}
+	m, err := r.module(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	r.release(m)
+	return nil
+}
+
+// module is the compiled plugin called name, compiled now if it wasn't yet or its file
+// changed since. It's compiled outside the lock, by the first caller that needs it,
+// the others wait for it or for ctx. Callers release it once they're done with it.
+func (r *Runner) module(ctx context.Context, name string) (*module, error) {
+	if !ValidName(name) {
+		return nil, fmt.Errorf("invalid rule plugin name %q", name)
+	}
+	path := filepath.Join(r.dir, name+".wasm")
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error finding rule plugin %q: %v", name, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("rule plugin %q is not a file", name)
+	}
+	r.mu.Lock()
+	m, ok := r.modules[name]
+	stale := !ok || !m.modTime.Equal(info.ModTime()) || m.size != info.Size()
+	if stale {
+		// runs still using the module a replaced plugin had finish with it
+		if ok {
+			r.releaseLocked(m)
+		}
+		m = &module{modTime: info.ModTime(), size: info.Size(), ready: make(chan struct{}), refs: 1}
+		r.modules[name] = m
+	}
+	m.refs++
+	r.mu.Unlock()
+
+	if stale {
+		r.compile(m, name, path)
+	}
+	select {
+	case <-m.ready:
+	case <-ctx.Done():
+		r.release(m)
+		return nil, fmt.Errorf("Error waiting for rule plugin %q to compile: %v", name, ctx.Err())
+	}
+	if m.err != nil {
+		r.release(m)
+		return nil, m.err
+	}
+	return m, nil
+}
+
+// compile compiles m from the file at path. A module that doesn't compile is dropped,
+// the next run tries again.
+func (r *Runner) compile(m *module, name, path string) {
+	var compiled wazero.CompiledModule
+	code, err := os.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("Error reading rule plugin %q: %v", name, err)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), compileTimeout)
+		compiled, err = r.runtime.CompileModule(ctx, code)
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("rule plugin %q is not a valid WebAssembly module: %v", name, err)
+		}
+	}
+	r.mu.Lock()
+	m.compiled, m.err = compiled, err
+	if err != nil && r.modules[name] == m {
+		delete(r.modules, name)
+		r.releaseLocked(m)
+	}
+	r.mu.Unlock()
+	close(m.ready)
+}
+
+// release lets go of a module module returned
+func (r *Runner) release(m *module) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.releaseLocked(m)
+}
+
+func (r *Runner) releaseLocked(m *module) {
+	m.refs--
+	if m.refs == 0 && m.compiled != nil {
+		m.compiled.Close(context.Background())
+	}
+}
+
+// Run runs the plugin called name with input on its stdin and returns the deltas it
+// wrote to its stdout, as a JSON array. Errors wrap ErrFailed.
+func (r *Runner) Run(ctx context.Context, name string, input []byte) ([]Delta, error) {
+	if r == nil {
+		return nil, fmt.Errorf("%w: %v", ErrFailed, r.Check(name))
+	}
+	m, err := r.module(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFailed, err)
+	}
+	defer r.release(m)
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	// a plugin that won't stop talking is stopped right away
+	stdout := &cappedBuffer{max: maxOutputBytes, overflow: cancel}
+	stderr := &cappedBuffer{max: 512}
+	// no filesystem, environment, arguments or real clock: the name is left empty so
+	// instances of one plugin can run side by side
+	moduleConfig := wazero.NewModuleConfig().
+		WithName("").
+		WithStdin(bytes.NewReader(input)).
+		WithStdout(stdout).
+		WithStderr(stderr)
+	instance, err := r.runtime.InstantiateModule(ctx, m.compiled, moduleConfig)
+	if instance != nil {
+		instance.Close(context.Background())
+	}
+	if stdout.truncated {
+		return nil, fmt.Errorf("%w: %s wrote more than %d bytes", ErrFailed, name, maxOutputBytes)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%w: %s took longer than %v", ErrFailed, name, r.timeout)
+	}
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v: %s", ErrFailed, name, err, strings.TrimSpace(stderr.String()))
+	}
+	var deltas []Delta
+	dec := json.NewDecoder(&stdout.buf)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&deltas); err != nil {
+		return nil, fmt.Errorf("%w: %s wrote something other than a list of deltas: %v", ErrFailed, name, err)
+	}
+	if len(deltas) > maxDeltas {
+		return nil, fmt.Errorf("%w: %s answered with more than %d deltas", ErrFailed, name, maxDeltas)
+	}
+	total := 0
+	for _, d := range deltas {
+		if len(d.Detail) > maxDetailLength {
+			return nil, fmt.Errorf("%w: %s answered with a detail longer than %d bytes", ErrFailed, name, maxDetailLength)
+		}
+		if d.Points > maxDeltaPoints || d.Points < -maxDeltaPoints {
+			return nil, fmt.Errorf("%w: %s answered with a delta of more than %d points", ErrFailed, name, maxDeltaPoints)
+		}
+		total += d.Points
+	}
+	if total > maxRunPoints || total < -maxRunPoints {
+		return nil, fmt.Errorf("%w: %s answered with more than %d points altogether", ErrFailed, name, maxRunPoints)
+	}
+	return deltas, nil
+}
+
+var errOutputTooLong = errors.New("output too long")
+
+// cappedBuffer keeps the first max bytes written to it. Writing more fails and calls
+// overflow, if set. It's not a bytes.Buffer itself, io.Copy would go around Write
+// through its ReadFrom
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	overflow  func()
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); len(p) > room {
+		b.truncated = true
+		if b.overflow != nil {
+			b.overflow()
+		}
+		n, _ := b.buf.Write(p[:max(room, 0)])
+		return n, errOutputTooLong
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) String() string {
+	return b.buf.String()
+}
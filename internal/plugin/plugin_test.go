@@ -0,0 +1,139 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/plugin/plugintest"
+)
+
+// newRunner is a runner for a directory of Go plugins, name -> source of its main
+// package. They're compiled up front, like when rules naming them load.
+func newRunner(t *testing.T, timeout time.Duration, sources map[string]string) *Runner {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range sources {
+		plugintest.Build(t, dir, name, src)
+	}
+	r := New(config.Config{
+		RulePluginDir:             dir,
+		RulePluginTimeoutInMs:     timeout,
+		RulePluginMemoryLimitInMB: 32,
+	})
+	t.Cleanup(func() { r.Close() })
+	// side by side, compiling doesn't hold up other plugins
+	var wg sync.WaitGroup
+	for name := range sources {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := r.Check(name); err != nil {
+				t.Error(err)
+			}
+		}(name)
+	}
+	wg.Wait()
+	return r
+}
+
+// plugin is a main package doing body, with io, os and fmt imported
+func plugin(body string) string {
+	return "package main\n\nimport (\n\t\"fmt\"\n\t\"io\"\n\t\"os\"\n)\n\nvar _, _, _ = fmt.Sprint, io.EOF, os.Exit\n\nfunc main() {\n" + body + "\n}\n"
+}
+
+func TestRun(t *testing.T) {
+	r := newRunner(t, 5*time.Second, map[string]string{
+		// echoes back how many bytes of input it got, and what it could see of the host
+		"count": plugin(`
+	in, _ := io.ReadAll(os.Stdin)
+	_, err := os.ReadFile("/etc/hostname")
+	fmt.Printf("[{\"detail\": \"%d bytes, HOME=%s, fs: %t\", \"points\": 7}, {\"detail\": \"\", \"points\": -2}]", len(in), os.Getenv("HOME"), err == nil)`),
+	})
+	deltas, err := r.Run(context.Background(), "count", []byte(`{"retailer":"Target"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Delta{{Detail: "21 bytes, HOME=, fs: false", Points: 7}, {Points: -2}}
+	if len(deltas) != len(want) || deltas[0] != want[0] || deltas[1] != want[1] {
+		t.Errorf("got %+v, want %+v", deltas, want)
+	}
+}
+
+func TestRunFailures(t *testing.T) {
+	r := newRunner(t, 300*time.Millisecond, map[string]string{
+		"crash":   plugin(`fmt.Fprintln(os.Stderr, "oops"); os.Exit(3)`),
+		"garbage": plugin(`fmt.Println("{\"points\": 5}")`),
+		"chatty":  plugin(`for { fmt.Println("[]") }`),
+		"spinner": plugin(`for {}`),
+		// a 64MB buffer is over the 32MB limit
+		"hungry":   plugin(`b := make([]byte, 64<<20); b[len(b)-1] = 1; fmt.Println("[]", b[0])`),
+		"generous": plugin(`fmt.Println("[{\"points\": -10001}]")`),
+		"greedy":   plugin(`fmt.Print("["); for i := 0; i < 20; i++ { fmt.Print("{\"points\": 9000},") }; fmt.Println("{\"points\": 0}]")`),
+	})
+	if err := os.WriteFile(filepath.Join(r.dir, "script.wasm"), []byte("#!/bin/sh\necho '[]'\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"crash":    "oops",
+		"garbage":  "list of deltas",
+		"chatty":   "more than",
+		"spinner":  "took longer",
+		"hungry":   "out of memory",
+		"generous": "a delta of more than 10000 points",
+		"greedy":   "more than 100000 points altogether",
+		"script":   "not a valid WebAssembly module",
+		"missing":  "no such file",
+		"../etc":   "invalid rule plugin name",
+	} {
+		start := time.Now()
+		_, err := r.Run(context.Background(), name, nil)
+		if !errors.Is(err, ErrFailed) || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want an ErrFailed saying %q", name, err, want)
+		}
+		if took := time.Since(start); took > 2*time.Second {
+			t.Errorf("%s: took %v, the timeout is 300ms", name, took)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	r := newRunner(t, time.Second, map[string]string{"bonus": plugin(`fmt.Println("[]")`)})
+	if err := r.Check("bonus"); err != nil {
+		t.Error(err)
+	}
+	if err := os.WriteFile(filepath.Join(r.dir, "readme.wasm"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Check("readme"); err == nil {
+		t.Error("a file that isn't a WebAssembly module passed the check")
+	}
+	var off *Runner
+	if err := off.Check("bonus"); err == nil || !strings.Contains(err.Error(), "RULE_PLUGIN_DIR") {
+		t.Errorf("got %v without a plugin dir", err)
+	}
+}
+
+func TestReplacedPluginIsRecompiled(t *testing.T) {
+	r := newRunner(t, 5*time.Second, map[string]string{"bonus": plugin(`fmt.Println("[{\"points\": 1}]")`)})
+	if deltas, err := r.Run(context.Background(), "bonus", nil); err != nil || len(deltas) != 1 || deltas[0].Points != 1 {
+		t.Fatalf("got %+v, %v", deltas, err)
+	}
+	old := r.modules["bonus"]
+	plugintest.Build(t, r.dir, "bonus", plugin(`fmt.Println("[{\"points\": 2}, {\"points\": 3}]")`))
+	if deltas, err := r.Run(context.Background(), "bonus", nil); err != nil || len(deltas) != 2 {
+		t.Errorf("after replacing it: got %+v, %v, want the new plugin's 2 deltas", deltas, err)
+	}
+	// nothing runs the old module anymore, it's closed
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old.refs != 0 || r.modules["bonus"] == old {
+		t.Errorf("the replaced module is still held %d times", old.refs)
+	}
+}
@@ -0,0 +1,26 @@
+// Package plugintest builds rule plugins for tests: Go programs compiled to WASI
+// modules with the go command running the tests.
+package plugintest
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Build compiles the Go program src (package main, standard library only) into dir
+// as the plugin called name
+func Build(t testing.TB, dir, name, src string) {
+	t.Helper()
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "main.go"), []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "build", "-o", filepath.Join(dir, name+".wasm"), "main.go")
+	cmd.Dir = srcDir
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm", "CGO_ENABLED=0", "GO111MODULE=off")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building plugin %s: %v\n%s", name, err, out)
+	}
+}
@@ -0,0 +1,326 @@
+// Package replay scores archived receipts again with candidate rules, offline, and
+// reports how their points would change, receipt by receipt and in aggregate, for
+// cmd/replay. It's for sizing up a rules change before it's rolled out.
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+)
+
+// Receipt is an archived receipt to replay
+type Receipt struct {
+	ID string
+	// the receipt as submitted, or as stored for rescoring when it comes from an
+	// export, in ContentType
+	Body        []byte
+	ContentType string
+	RetailerID  string
+	// what the receipt was scored as when it was stored, nil when the source doesn't
+	// have it. It's scored with the baseline rules then
+	Stored *db.ReceiptRecord
+}
+
+// Scorer scores a receipt body, app.Scorer
+type Scorer interface {
+	Score(body []byte, contentType, retailerID string) (db.ReceiptRecord, error)
+}
+
+// Change is a receipt whose points changed
+type Change struct {
+	ID              string `json:"id"`
+	Retailer        string `json:"retailer"`
+	OldPoints       int    `json:"oldPoints"`
+	NewPoints       int    `json:"newPoints"`
+	OldRulesVersion string `json:"oldRulesVersion,omitempty"`
+}
+
+// Failure is a receipt that couldn't be scored
+type Failure struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// RulePoints are the points one rule (a breakdown line's rule) gave the replayed
+// receipts before and after
+type RulePoints struct {
+	Before int `json:"before"`
+	After  int `json:"after"`
+}
+
+// Report is what a replay found
+type Report struct {
+	RulesVersion string `json:"rulesVersion"`
+	Replayed     int    `json:"replayed"`
+	Changed      int    `json:"changed"`
+	Increased    int    `json:"increased"`
+	Decreased    int    `json:"decreased"`
+	Unchanged    int    `json:"unchanged"`
+	// exported without their raw contents, they can't be scored again
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+	// over the receipts that scored both before and after
+	PointsBefore int `json:"pointsBefore"`
+	PointsAfter  int `json:"pointsAfter"`
+	// receipts stored before breakdowns were kept count in the totals above but not here
+	Rules map[string]*RulePoints `json:"rules"`
+	// the first maxListed of each
+	Changes          []Change  `json:"changes"`
+	ChangesTruncated bool      `json:"changesTruncated,omitempty"`
+	Failures         []Failure `json:"failures,omitempty"`
+}
+
+// Replayer scores receipts with the candidate rules and compares them with what they
+// were stored with, or what the baseline rules give them
+type Replayer struct {
+	candidate, baseline Scorer
+	maxListed           int
+	report              Report
+}
+
+// New is a replayer listing up to maxListed changes and failures
+func New(candidate, baseline Scorer, rulesVersion string, maxListed int) *Replayer {
+	return &Replayer{
+		candidate: candidate,
+		baseline:  baseline,
+		maxListed: maxListed,
+		report:    Report{RulesVersion: rulesVersion, Rules: make(map[string]*RulePoints), Changes: []Change{}},
+	}
+}
+
+// Add replays a receipt
+func (r *Replayer) Add(rec Receipt) {
+	report := &r.report
+	if len(rec.Body) == 0 {
+		report.Skipped++
+		return
+	}
+	report.Replayed++
+	before := rec.Stored
+	if before == nil {
+		scored, err := r.baseline.Score(rec.Body, rec.ContentType, rec.RetailerID)
+		if err != nil {
+			r.fail(rec.ID, fmt.Errorf("with the baseline rules: %v", err))
+			return
+		}
+		before = &scored
+	}
+	after, err := r.candidate.Score(rec.Body, rec.ContentType, rec.RetailerID)
+	if err != nil {
+		r.fail(rec.ID, err)
+		return
+	}
+
+	report.PointsBefore += before.Points
+	report.PointsAfter += after.Points
+	for _, line := range before.Breakdown {
+		r.rule(line.Rule).Before += line.Points
+	}
+	for _, line := range after.Breakdown {
+		r.rule(line.Rule).After += line.Points
+	}
+	switch {
+	case after.Points == before.Points:
+		report.Unchanged++
+		return
+	case after.Points > before.Points:
+		report.Increased++
+	default:
+		report.Decreased++
+	}
+	report.Changed++
+	if len(report.Changes) == r.maxListed {
+		report.ChangesTruncated = true
+		return
+	}
+	report.Changes = append(report.Changes, Change{
+		ID:              rec.ID,
+		Retailer:        after.Retailer,
+		OldPoints:       before.Points,
+		NewPoints:       after.Points,
+		OldRulesVersion: before.RulesVersion,
+	})
+}
+
+func (r *Replayer) rule(name string) *RulePoints {
+	points, ok := r.report.Rules[name]
+	if !ok {
+		points = &RulePoints{}
+		r.report.Rules[name] = points
+	}
+	return points
+}
+
+func (r *Replayer) fail(id string, err error) {
+	r.report.Failed++
+	if len(r.report.Failures) < r.maxListed {
+		r.report.Failures = append(r.report.Failures, Failure{ID: id, Error: err.Error()})
+	}
+}
+
+// Report is what the receipts added so far came to
+func (r *Replayer) Report() Report {
+	return r.report
+}
+
+// exportLine is the part of a GET /admin/export?raw=true line a replay needs
+type exportLine struct {
+	ID           string               `json:"id"`
+	Retailer     string               `json:"retailer"`
+	Points       int                  `json:"points"`
+	RulesVersion string               `json:"rulesVersion"`
+	Breakdown    []db.PointsComponent `json:"breakdown"`
+	RetailerID   string               `json:"retailerId"`
+	Receipt      json.RawMessage      `json:"receipt"`
+}
+
+// ReadExport hands each receipt of an export (JSON lines, from GET
+// /admin/export?raw=true) to each, with what it was stored with. Receipts exported
+// without raw contents come with an empty body.
+func ReadExport(r io.Reader, each func(Receipt) error) error {
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var line exportLine
+		if err := dec.Decode(&line); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Error decoding export line %d: %v", n, err)
+		}
+		stored := db.ReceiptRecord{
+			ID:           line.ID,
+			Retailer:     line.Retailer,
+			Points:       line.Points,
+			RulesVersion: line.RulesVersion,
+			Breakdown:    line.Breakdown,
+		}
+		err := each(Receipt{ID: line.ID, Body: line.Receipt, ContentType: "application/json", RetailerID: line.RetailerID, Stored: &stored})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Bucket is where the archive keeps receipts, archive.Archiver or a copy on disk (Dir)
+type Bucket interface {
+	// List is a page of keys, "<receipt id>/<name>", in lexical order and where the
+	// next page starts, "" after the last one
+	List(ctx context.Context, continuation string) ([]string, string, error)
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+// ReadArchive hands each receipt in bucket to each, its latest revision when it was
+// corrected. Images are left out, what was read from them is archived next to them.
+func ReadArchive(ctx context.Context, bucket Bucket, each func(Receipt) error) error {
+	var (
+		id     string
+		latest string
+		rev    int
+	)
+	flush := func() error {
+		if latest == "" {
+			return nil
+		}
+		body, err := bucket.Get(ctx, latest)
+		if err != nil {
+			return err
+		}
+		return each(Receipt{ID: id, Body: body, ContentType: contentType(latest)})
+	}
+	for continuation := ""; ; {
+		keys, next, err := bucket.List(ctx, continuation)
+		if err != nil {
+			return err
+		}
+		// a receipt's keys are next to each other, though not necessarily on one page
+		for _, key := range keys {
+			keyID, name, ok := strings.Cut(key, "/")
+			if !ok {
+				continue
+			}
+			if keyID != id {
+				if err := flush(); err != nil {
+					return err
+				}
+				id, latest, rev = keyID, "", 0
+			}
+			if n := revision(name); n > rev && contentType(name) != "" {
+				latest, rev = key, n
+			}
+		}
+		if next == "" {
+			return flush()
+		}
+		continuation = next
+	}
+}
+
+// revision is the revision an archived name holds, the original submission
+// ("receipt.json") being 1. 0 for anything else, like images
+func revision(name string) int {
+	base := strings.TrimSuffix(name, path.Ext(name))
+	if base == "receipt" {
+		return 1
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(base, "revision-"))
+	if err != nil || !strings.HasPrefix(base, "revision-") || n < 2 {
+		return 0
+	}
+	return n
+}
+
+// contentType is what the archive stored a body as, from its extension
+func contentType(name string) string {
+	switch path.Ext(name) {
+	case ".json":
+		return "application/json"
+	case ".xml":
+		return "application/xml"
+	case ".pb":
+		return "application/x-protobuf"
+	}
+	return ""
+}
+
+// Dir is a copy of the archive on disk (aws s3 sync s3://<bucket>/<prefix> dir), listed
+// in one page. WalkDir's order keeps a receipt's keys together like S3's does.
+func Dir(dir string) Bucket {
+	return dirBucket{fsys: os.DirFS(dir)}
+}
+
+type dirBucket struct {
+	fsys fs.FS
+}
+
+func (d dirBucket) List(ctx context.Context, continuation string) ([]string, string, error) {
+	var keys []string
+	err := fs.WalkDir(d.fsys, ".", func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			keys = append(keys, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("Error listing the archive copy: %v", err)
+	}
+	return keys, "", nil
+}
+
+func (d dirBucket) Get(ctx context.Context, key string) ([]byte, error) {
+	body, err := fs.ReadFile(d.fsys, key)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s from the archive copy: %v", key, err)
+	}
+	return body, nil
+}
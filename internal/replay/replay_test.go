@@ -0,0 +1,107 @@
+package replay_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/app"
+	"github.com/jayreddy040-510/receipt_processor/internal/replay"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+	"github.com/jayreddy040-510/receipt_processor/internal/testutil"
+)
+
+// scorers are the default rules and a candidate doubling the round total bonus: the
+// corner market receipt (9.00) gains 50 points, the Target one (35.35) doesn't change
+func scorers(t *testing.T) (candidate, baseline app.Scorer) {
+	t.Helper()
+	doubled, err := rules.Parse([]byte(`{"version": "doubled", "roundTotalPoints": 100}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	return app.Scorer{Rules: doubled, MaxItems: 1000, Now: now}, app.Scorer{Rules: rules.Default(), MaxItems: 1000, Now: now}
+}
+
+func replayed(t *testing.T, read func(each func(replay.Receipt) error) error) replay.Report {
+	t.Helper()
+	candidate, baseline := scorers(t)
+	replayer := replay.New(candidate, baseline, candidate.Rules.Version, 10)
+	if err := read(func(rec replay.Receipt) error {
+		replayer.Add(rec)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return replayer.Report()
+}
+
+func checkChanges(t *testing.T, report replay.Report, want replay.Change) {
+	t.Helper()
+	if report.Changed != 1 || report.Increased != 1 || report.Unchanged != 1 || len(report.Changes) != 1 || report.Changes[0] != want {
+		t.Errorf("changes: got %+v, want only %+v", report, want)
+	}
+	if report.PointsBefore != 137 || report.PointsAfter != 187 {
+		t.Errorf("points: got %d before and %d after, want 137 and 187", report.PointsBefore, report.PointsAfter)
+	}
+	if round := report.Rules["roundTotal"]; round == nil || round.Before != 50 || round.After != 100 {
+		t.Errorf("roundTotal rule: got %+v", round)
+	}
+}
+
+func TestReplayExport(t *testing.T) {
+	_, baseline := scorers(t)
+	var export bytes.Buffer
+	enc := json.NewEncoder(&export)
+	for i, body := range []string{testutil.TargetReceipt, testutil.CornerMarketReceipt} {
+		stored, err := baseline.Score([]byte(body), "application/json", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc.Encode(map[string]interface{}{
+			"id": []string{"target", "corner"}[i], "retailer": stored.Retailer, "points": stored.Points,
+			"rulesVersion": stored.RulesVersion, "breakdown": stored.Breakdown, "receipt": stored.Receipt,
+		})
+	}
+	// stored without its raw contents, and something the candidate can't score
+	enc.Encode(map[string]interface{}{"id": "huge", "points": 10})
+	enc.Encode(map[string]interface{}{"id": "broken", "points": 10, "receipt": map[string]string{"retailer": "Target"}})
+
+	report := replayed(t, func(each func(replay.Receipt) error) error { return replay.ReadExport(&export, each) })
+	checkChanges(t, report, replay.Change{ID: "corner", Retailer: "M&M Corner Market", OldPoints: 109, NewPoints: 159, OldRulesVersion: rules.DefaultVersion})
+	if report.Replayed != 3 || report.Skipped != 1 || report.Failed != 1 || report.Failures[0].ID != "broken" {
+		t.Errorf("counts: got %+v", report)
+	}
+}
+
+func TestReplayArchiveCopy(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"target/receipt.json": testutil.TargetReceipt,
+		// corrected into the corner market receipt, the latest revision is replayed
+		"corner/receipt.json":     `{"retailer": "Target"}`,
+		"corner/revision-2.json":  `{"retailer": "Target"}`,
+		"corner/revision-10.json": testutil.CornerMarketReceipt,
+		"corner/image.png":        "png",
+	}
+	for name, body := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := replayed(t, func(each func(replay.Receipt) error) error {
+		return replay.ReadArchive(context.Background(), replay.Dir(dir), each)
+	})
+	checkChanges(t, report, replay.Change{ID: "corner", Retailer: "M&M Corner Market", OldPoints: 109, NewPoints: 159, OldRulesVersion: rules.DefaultVersion})
+	if report.Replayed != 2 || report.Failed != 0 || report.RulesVersion != "doubled" {
+		t.Errorf("counts: got %+v", report)
+	}
+}
@@ -0,0 +1,289 @@
+// Package report sends the scheduled summaries of what the service did, receipts
+// processed, points awarded, top retailers and fraud flags per tenant, to wherever ops
+// wants to read them: a webhook, email and the archive bucket.
+package report
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/archive"
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+	"github.com/jayreddy040-510/receipt_processor/internal/webhook"
+)
+
+// the periods a summary covers, both end with the UTC day before it's sent
+const (
+	Daily  = "daily"
+	Weekly = "weekly"
+)
+
+const maxBackoff = time.Minute
+
+type Retailer struct {
+	Retailer string `json:"retailer"`
+	Receipts int    `json:"receipts"`
+}
+
+// Tenant is one tenant's part of a summary
+type Tenant struct {
+	ID            string `json:"tenantId"`
+	Name          string `json:"name"`
+	Receipts      int    `json:"receipts"`
+	PointsAwarded int    `json:"pointsAwarded"`
+	// receipts flagged for review in the period. PendingReview is the review queue when
+	// the summary was made, whenever its receipts were flagged
+	FraudFlags    int `json:"fraudFlags"`
+	PendingReview int `json:"pendingReview"`
+	// ranked by the receipts purchased in the period, TopRetailersPartial when there
+	// were too many of them to read them all
+	TopRetailers        []Retailer `json:"topRetailers"`
+	TopRetailersPartial bool       `json:"topRetailersPartial,omitempty"`
+}
+
+// Summary is a report on the days From to To (YYYY-MM-DD, UTC, inclusive), with every
+// tenant's totals and their sums
+type Summary struct {
+	Period        string    `json:"period"`
+	From          string    `json:"from"`
+	To            string    `json:"to"`
+	GeneratedAt   time.Time `json:"generatedAt"`
+	Receipts      int       `json:"receipts"`
+	PointsAwarded int       `json:"pointsAwarded"`
+	FraudFlags    int       `json:"fraudFlags"`
+	Tenants       []Tenant  `json:"tenants"`
+}
+
+// Name tells summaries apart, like "daily-2024-01-14", it's what they're archived as
+func (s Summary) Name() string {
+	return s.Period + "-" + s.From
+}
+
+func (s Summary) Subject() string {
+	title := strings.ToUpper(s.Period[:1]) + s.Period[1:]
+	if s.From == s.To {
+		return fmt.Sprintf("%s receipt report for %s", title, s.From)
+	}
+	return fmt.Sprintf("%s receipt report for %s to %s", title, s.From, s.To)
+}
+
+// Text is the summary for people to read, the body of the email
+func (s Summary) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (UTC), generated %s\n\n", s.Subject(), s.GeneratedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Receipts processed: %d\nPoints awarded: %d\nFraud flags: %d\n", s.Receipts, s.PointsAwarded, s.FraudFlags)
+	for _, t := range s.Tenants {
+		name := t.ID
+		if name == "" {
+			name = "default"
+		}
+		if t.Name != "" && t.Name != name {
+			name += " (" + t.Name + ")"
+		}
+		fmt.Fprintf(&b, "\nTenant %s\n", name)
+		fmt.Fprintf(&b, "  Receipts processed: %d\n  Points awarded: %d\n", t.Receipts, t.PointsAwarded)
+		fmt.Fprintf(&b, "  Fraud flags: %d, %d receipts waiting on a review\n", t.FraudFlags, t.PendingReview)
+		if len(t.TopRetailers) == 0 {
+			continue
+		}
+		partial := ""
+		if t.TopRetailersPartial {
+			partial = ", from part of them"
+		}
+		fmt.Fprintf(&b, "  Top retailers by receipts purchased%s:\n", partial)
+		for i, r := range t.TopRetailers {
+			fmt.Fprintf(&b, "    %d. %s (%d)\n", i+1, r.Retailer, r.Receipts)
+		}
+	}
+	return b.String()
+}
+
+// Sender delivers summaries to the configured destinations
+type Sender struct {
+	client     *http.Client
+	webhookURL string
+	secret     []byte
+
+	smtpAddr     string
+	smtpUsername string
+	smtpPassword string
+	from         string
+	to           []string
+
+	// nil unless summaries are archived
+	archive *archive.Archiver
+
+	timeout    time.Duration
+	backoff    time.Duration
+	maxRetries int
+}
+
+// New returns a Sender for the destinations in cfg. Webhook deliveries are signed with
+// WEBHOOK_SECRET and retried like receipt webhooks. archiver is where REPORT_TO_ARCHIVE
+// keeps summaries.
+func New(cfg config.Config, archiver *archive.Archiver) *Sender {
+	s := &Sender{
+		client:       &http.Client{},
+		webhookURL:   cfg.ReportWebhookURL,
+		secret:       []byte(cfg.WebhookSecret),
+		smtpAddr:     cfg.ReportSMTPAddr,
+		smtpUsername: cfg.ReportSMTPUsername,
+		smtpPassword: cfg.ReportSMTPPassword,
+		from:         cfg.ReportEmailFrom,
+		to:           cfg.ReportEmailTo,
+		timeout:      cfg.ReportTimeoutInMs,
+		backoff:      cfg.WebhookBackoffInMs,
+		maxRetries:   cfg.WebhookMaxRetries,
+	}
+	if cfg.ReportToArchive {
+		s.archive = archiver
+	}
+	return s
+}
+
+// Send delivers sum to every destination, trying all of them whichever fail. Archiving
+// is queued, the archiver retries and logs on its own.
+func (s *Sender) Send(ctx context.Context, sum Summary) error {
+	body, err := json.Marshal(sum)
+	if err != nil {
+		return fmt.Errorf("Error encoding report: %v", err)
+	}
+	var errs []error
+	if s.webhookURL != "" {
+		if err := s.retry(ctx, "report webhook", func(ctx context.Context) error { return s.post(ctx, body) }); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.smtpAddr != "" {
+		if err := s.retry(ctx, "report email", func(ctx context.Context) error { return s.email(ctx, sum) }); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.archive != nil {
+		s.archive.Report(sum.Name(), "application/json", body)
+	}
+	return errors.Join(errs...)
+}
+
+// retry runs send until it succeeds, backing off exponentially between attempts, and
+// gives up after maxRetries retries
+func (s *Sender) retry(ctx context.Context, what string, send func(ctx context.Context) error) error {
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		err := send(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt >= s.maxRetries {
+			return fmt.Errorf("Error sending %s after %d attempts: %w", what, attempt+1, err)
+		}
+		logging.Warnf(ctx, "Sending %s failed, retrying in %v: %v", what, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("Error sending %s: %w", what, ctx.Err())
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// post sends the summary as JSON, signed the way receipt webhooks are
+func (s *Sender) post(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Error building report webhook request: %v", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhook.TimestampHeader, timestamp)
+	if len(s.secret) > 0 {
+		req.Header.Set(webhook.SignatureHeader, "sha256="+webhook.Sign(s.secret, timestamp, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error sending report webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Report webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// email sends the summary as plain text. The connection is upgraded with STARTTLS when
+// the server offers it, and net/smtp only sends credentials over TLS (or to localhost).
+func (s *Sender) email(ctx context.Context, sum Summary) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.smtpAddr)
+	if err != nil {
+		return fmt.Errorf("Error connecting to SMTP server: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(s.smtpAddr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("Error talking to SMTP server: %v", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("Error starting TLS with SMTP server: %v", err)
+		}
+	}
+	if s.smtpUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.smtpUsername, s.smtpPassword, host)); err != nil {
+			return fmt.Errorf("Error authenticating with SMTP server: %v", err)
+		}
+	}
+	if err := c.Mail(s.from); err != nil {
+		return fmt.Errorf("Error sending report email: %v", err)
+	}
+	for _, to := range s.to {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("Error sending report email to %s: %v", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("Error sending report email: %v", err)
+	}
+	if _, err := w.Write(s.message(sum)); err != nil {
+		return fmt.Errorf("Error sending report email: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("Error sending report email: %v", err)
+	}
+	return c.Quit()
+}
+
+// message is the email with its headers, lines end in CRLF like SMTP wants them
+func (s *Sender) message(sum Summary) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", sum.Subject())
+	fmt.Fprintf(&b, "Date: %s\r\n", sum.GeneratedAt.UTC().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(sum.Text(), "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,149 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/webhook"
+)
+
+var testSummary = Summary{
+	Period:        Daily,
+	From:          "2024-01-14",
+	To:            "2024-01-14",
+	GeneratedAt:   time.Date(2024, time.January, 15, 6, 0, 0, 0, time.UTC),
+	Receipts:      3,
+	PointsAwarded: 137,
+	FraudFlags:    1,
+	Tenants: []Tenant{{
+		Receipts:      3,
+		PointsAwarded: 137,
+		FraudFlags:    1,
+		PendingReview: 2,
+		TopRetailers:  []Retailer{{Retailer: "target", Receipts: 2}, {Retailer: "m&m corner market", Receipts: 1}},
+	}},
+}
+
+func testConfig() config.Config {
+	return config.Config{
+		WebhookSecret:      "secret",
+		WebhookMaxRetries:  2,
+		WebhookBackoffInMs: time.Millisecond,
+		ReportTimeoutInMs:  time.Second,
+	}
+}
+
+func TestWebhookIsSignedAndRetried(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failures = 1
+		got      []byte
+		verified bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		got, _ = io.ReadAll(r.Body)
+		want := "sha256=" + webhook.Sign([]byte("secret"), r.Header.Get(webhook.TimestampHeader), got)
+		verified = r.Header.Get(webhook.SignatureHeader) == want
+	}))
+	defer server.Close()
+	cfg := testConfig()
+	cfg.ReportWebhookURL = server.URL
+
+	if err := New(cfg, nil).Send(context.Background(), testSummary); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var sent Summary
+	if err := json.Unmarshal(got, &sent); err != nil || sent.Name() != "daily-2024-01-14" || sent.Tenants[0].PendingReview != 2 {
+		t.Errorf("got %s (%v), want the summary", got, err)
+	}
+	if !verified {
+		t.Errorf("signature doesn't verify with the webhook secret")
+	}
+
+	cfg.WebhookMaxRetries = 0
+	server.Close()
+	if err := New(cfg, nil).Send(context.Background(), testSummary); err == nil || !strings.Contains(err.Error(), "report webhook after 1 attempts") {
+		t.Errorf("Send to a dead webhook: got %v, want it to give up", err)
+	}
+}
+
+// fakeSMTP accepts one message and hands over its data
+func fakeSMTP(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost ready")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch verb, _, _ := strings.Cut(line, " "); strings.ToUpper(verb) {
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				data, _ := tp.ReadDotLines()
+				messages <- strings.Join(data, "\n")
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func TestEmail(t *testing.T) {
+	addr, messages := fakeSMTP(t)
+	cfg := testConfig()
+	cfg.ReportSMTPAddr = addr
+	cfg.ReportEmailFrom = "reports@example.com"
+	cfg.ReportEmailTo = []string{"ops@example.com", "finance@example.com"}
+
+	if err := New(cfg, nil).Send(context.Background(), testSummary); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	message := <-messages
+	for _, want := range []string{
+		"To: ops@example.com, finance@example.com",
+		"Subject: Daily receipt report for 2024-01-14",
+		"Receipts processed: 3",
+		"Fraud flags: 1, 2 receipts waiting on a review",
+		"    1. target (2)",
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("email is missing %q:\n%s", want, message)
+		}
+	}
+}
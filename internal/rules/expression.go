@@ -0,0 +1,167 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+)
+
+// ErrExpressionFailed marks an expression rule that couldn't be evaluated, e.g. it
+// divided by zero or went over its cost limit. The rule's fault, not the receipt's.
+var ErrExpressionFailed = errors.New("expression rule failed")
+
+const (
+	maxExpressionLength = 4096
+	// roughly how many operations a rule may take on one receipt, a comprehension over
+	// the items of the biggest receipts stays well under it
+	maxExpressionCost = 1_000_000
+)
+
+var validExpressionName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,63}$`)
+
+// ExpressionRule scores receipts with a CEL expression (https://cel.dev) that evaluates
+// to the points it adds, e.g. "total.cents % 25 == 0 ? 25 : 0". The variables it can use
+// are the fields of ExpressionInput, by their cel name.
+type ExpressionRule struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+
+	program cel.Program
+}
+
+// Money is an amount in cents, for exact arithmetic, and in dollars
+type Money struct {
+	Cents   int64   `cel:"cents"`
+	Dollars float64 `cel:"dollars"`
+}
+
+// ExpressionItem is an item line as expression rules see it. Quantity is 1 for lines
+// without one, UnitPrice the price for those
+type ExpressionItem struct {
+	Description string `cel:"description"`
+	Price       Money  `cel:"price"`
+	Quantity    int64  `cel:"quantity"`
+	UnitPrice   Money  `cel:"unitPrice"`
+}
+
+type ExpressionDiscount struct {
+	Description string `cel:"description"`
+	Amount      Money  `cel:"amount"`
+}
+
+// Purchase is when a receipt's purchase was, in its timezone. Weekday is 0 for Sunday
+type Purchase struct {
+	Year    int64 `cel:"year"`
+	Month   int64 `cel:"month"`
+	Day     int64 `cel:"day"`
+	Weekday int64 `cel:"weekday"`
+	Hour    int64 `cel:"hour"`
+	Minute  int64 `cel:"minute"`
+}
+
+// ExpressionInput is a receipt the way expression rules see it. Receipts too big to keep
+// their items only have the first ones in Items, ItemCount counts them all. Points is
+// what the receipt earned before the rule, from the built-in rules, bonuses and the
+// expression rules before it.
+type ExpressionInput struct {
+	Retailer      string
+	RetailerID    string
+	Total         Money
+	Purchase      Purchase
+	Items         []ExpressionItem
+	ItemCount     int64
+	Tax           Money
+	Discounts     []ExpressionDiscount
+	PaymentMethod string
+	StoreID       string
+	UserID        string
+	Points        int64
+}
+
+func (in ExpressionInput) activation() map[string]any {
+	return map[string]any{
+		"retailer":      in.Retailer,
+		"retailerId":    in.RetailerID,
+		"total":         in.Total,
+		"purchase":      in.Purchase,
+		"items":         in.Items,
+		"itemCount":     in.ItemCount,
+		"tax":           in.Tax,
+		"discounts":     in.Discounts,
+		"paymentMethod": in.PaymentMethod,
+		"storeId":       in.StoreID,
+		"userId":        in.UserID,
+		"points":        in.Points,
+	}
+}
+
+// expressionEnv declares the variables of ExpressionInput, typed, so rules using one
+// that doesn't exist or comparing a string to a number don't load
+var expressionEnv = sync.OnceValues(func() (*cel.Env, error) {
+	money := cel.ObjectType("rules.Money")
+	return cel.NewEnv(
+		ext.NativeTypes(
+			reflect.TypeOf(Money{}),
+			reflect.TypeOf(ExpressionItem{}),
+			reflect.TypeOf(ExpressionDiscount{}),
+			reflect.TypeOf(Purchase{}),
+			ext.ParseStructTags(true),
+		),
+		ext.Strings(),
+		cel.Variable("retailer", cel.StringType),
+		cel.Variable("retailerId", cel.StringType),
+		cel.Variable("total", money),
+		cel.Variable("purchase", cel.ObjectType("rules.Purchase")),
+		cel.Variable("items", cel.ListType(cel.ObjectType("rules.ExpressionItem"))),
+		cel.Variable("itemCount", cel.IntType),
+		cel.Variable("tax", money),
+		cel.Variable("discounts", cel.ListType(cel.ObjectType("rules.ExpressionDiscount"))),
+		cel.Variable("paymentMethod", cel.StringType),
+		cel.Variable("storeId", cel.StringType),
+		cel.Variable("userId", cel.StringType),
+		cel.Variable("points", cel.IntType),
+	)
+})
+
+// compile checks the rule and readies it for Eval
+func (r *ExpressionRule) compile() error {
+	if !validExpressionName.MatchString(r.Name) {
+		return fmt.Errorf("name must be a letter followed by letters, digits or '_', got %q", r.Name)
+	}
+	if len(r.Expression) > maxExpressionLength {
+		return fmt.Errorf("expression is longer than %d bytes", maxExpressionLength)
+	}
+	env, err := expressionEnv()
+	if err != nil {
+		return fmt.Errorf("Error setting up expressions: %v", err)
+	}
+	ast, issues := env.Compile(r.Expression)
+	if issues.Err() != nil {
+		return issues.Err()
+	}
+	if !ast.OutputType().IsExactType(cel.IntType) {
+		return fmt.Errorf("expression must evaluate to an int, it's a %v", ast.OutputType())
+	}
+	if r.program, err = env.Program(ast, cel.CostLimit(maxExpressionCost)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Eval is the points the rule gives in. Errors wrap ErrExpressionFailed
+func (r *ExpressionRule) Eval(in ExpressionInput) (int, error) {
+	out, _, err := r.program.Eval(in.activation())
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %v", ErrExpressionFailed, r.Name, err)
+	}
+	points, ok := out.Value().(int64)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s evaluated to %v", ErrExpressionFailed, r.Name, out)
+	}
+	return int(points), nil
+}
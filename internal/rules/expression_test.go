@@ -0,0 +1,40 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpressionRulesAreCheckedOnLoad(t *testing.T) {
+	for expression, want := range map[string]string{
+		`total.cent % 25 == 0 ? 25 : 0`: "undefined field 'cent'",
+		`retailer == 5 ? 1 : 0`:         "no matching overload",
+		`total.dollars * 2.0`:           "must evaluate to an int",
+		`itemCount >`:                   "Syntax error",
+		`unknownVariable`:               "undeclared reference",
+	} {
+		_, err := Parse([]byte(`{"expressionRules": [{"name": "bonus", "expression": "` + strings.ReplaceAll(expression, `"`, `\"`) + `"}]}`))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want an error saying %q", expression, err, want)
+		}
+	}
+	_, err := Parse([]byte(`{"expressionRules": [{"name": "a", "expression": "1"}, {"name": "a", "expression": "2"}]}`))
+	if err == nil {
+		t.Error("two rules named a loaded")
+	}
+}
+
+func TestExpressionCostLimit(t *testing.T) {
+	rs, err := Parse([]byte(`{"expressionRules": [{"name": "spin", "expression": "size(items.map(a, items.map(b, items.map(c, 1))))"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := ExpressionInput{Items: make([]ExpressionItem, 1000)}
+	if _, err := rs.ExpressionRules[0].Eval(in); err == nil || !strings.Contains(err.Error(), "cost limit") {
+		t.Errorf("got %v, want the cost limit to stop it", err)
+	}
+	in.Items = in.Items[:2]
+	if points, err := rs.ExpressionRules[0].Eval(in); err != nil || points != 2 {
+		t.Errorf("got %d, %v for two items", points, err)
+	}
+}
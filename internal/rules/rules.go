@@ -0,0 +1,358 @@
+package rules
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/plugin"
+)
+
+// the ways ItemQuantityMode can count items
+const (
+	ItemQuantityLine = "line"
+	ItemQuantityUnit = "unit"
+)
+
+// DefaultVersion is the version of the built-in rule set, used when no rules file is
+// configured
+const DefaultVersion = "default"
+
+// RuleSet holds every knob of the points rules. A rules file only needs the fields it
+// changes, anything left out keeps its default value.
+type RuleSet struct {
+	// Version identifies the rule set. When the file doesn't set one it's derived from
+	// the file's contents, so two different files never share a version.
+	Version string `json:"version"`
+
+	// one point per alphanumeric character in the retailer name
+	RetailerCharPoints int `json:"retailerCharPoints"`
+	// total is a round dollar amount with no cents
+	RoundTotalPoints int `json:"roundTotalPoints"`
+	// total is a multiple of 0.25
+	QuarterMultiplePoints int `json:"quarterMultiplePoints"`
+	// for every two items on the receipt
+	ItemPairPoints int `json:"itemPairPoints"`
+	// items whose trimmed description length is a multiple of ItemDescriptionMultiple
+	// earn ceil(price * ItemPriceMultiplier)
+	ItemDescriptionMultiple int     `json:"itemDescriptionMultiple"`
+	ItemPriceMultiplier     float64 `json:"itemPriceMultiplier"`
+	// how items with a quantity count: ItemQuantityLine (the default) scores every line
+	// as one item at its line price, ItemQuantityUnit scores every unit as an item of
+	// its own at the unit price, for item pairs, descriptions and campaign categories
+	ItemQuantityMode string `json:"itemQuantityMode"`
+	// the day in the purchase date is odd
+	OddDayPoints int `json:"oddDayPoints"`
+	// purchase time between AfternoonStart and AfternoonEnd (HH:MM), both ends excluded
+	// unless AfternoonInclusive names them like a TimeWindow's Inclusive does
+	AfternoonPoints    int    `json:"afternoonPoints"`
+	AfternoonStart     string `json:"afternoonStart"`
+	AfternoonEnd       string `json:"afternoonEnd"`
+	AfternoonInclusive string `json:"afternoonInclusive,omitempty"`
+
+	// TimeWindows give points to purchases in a time of day window, on top of the
+	// afternoon bonus. Every window a purchase is in applies
+	TimeWindows []TimeWindow `json:"timeWindows,omitempty"`
+
+	// RetailerOverrides adjust the points of specific retailers, e.g. partners. The
+	// first override matching a receipt's retailer applies.
+	RetailerOverrides []RetailerOverride `json:"retailerOverrides,omitempty"`
+
+	// flat bonuses for receipts paid a certain way, keyed by paymentMethod, or bought
+	// at a certain store, keyed by store id. Keys match case-insensitively
+	PaymentMethodPoints map[string]int `json:"paymentMethodPoints,omitempty"`
+	StorePoints         map[string]int `json:"storePoints,omitempty"`
+
+	// ExpressionRules add the points their expression evaluates to, after the bonuses,
+	// in order. See ExpressionRule
+	ExpressionRules []ExpressionRule `json:"expressionRules,omitempty"`
+
+	// Plugins are run for every receipt after the expression rules, in order, each adding the
+	// points it answers with. They're named by file name in RULE_PLUGIN_DIR. Plugins
+	// aren't part of the derived Version, bump the version when one changes.
+	Plugins []string `json:"plugins,omitempty"`
+
+	plugins *plugin.Runner
+}
+
+// RetailerOverride matches retailers by name (case and surrounding whitespace don't
+// matter), by a regular expression or by the id the retailer registry has for them,
+// exactly one of the three
+type RetailerOverride struct {
+	Retailer   string `json:"retailer,omitempty"`
+	Pattern    string `json:"pattern,omitempty"`
+	RetailerID string `json:"retailerId,omitempty"`
+
+	// multiplies the points earned from item descriptions, 0 means 1
+	ItemPointsMultiplier float64 `json:"itemPointsMultiplier,omitempty"`
+	// multiplies the receipt's points before the bonus is added, 0 means 1
+	PointsMultiplier float64 `json:"pointsMultiplier,omitempty"`
+	// flat bonus added to every receipt of the retailer
+	BonusPoints int `json:"bonusPoints,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Describe is how the override shows up in points breakdowns
+func (o *RetailerOverride) Describe() string {
+	if o.Pattern != "" {
+		return "pattern " + o.Pattern
+	}
+	if o.RetailerID != "" {
+		return "retailer " + o.RetailerID
+	}
+	return o.Retailer
+}
+
+// Regexp is the compiled Pattern, nil for overrides matching by name. Only set on
+// validated rule sets.
+func (o *RetailerOverride) Regexp() *regexp.Regexp {
+	return o.pattern
+}
+
+// Default is the original rule set, what receipts were always scored with
+func Default() *RuleSet {
+	return &RuleSet{
+		Version:                 DefaultVersion,
+		RetailerCharPoints:      1,
+		RoundTotalPoints:        50,
+		QuarterMultiplePoints:   25,
+		ItemPairPoints:          5,
+		ItemDescriptionMultiple: 3,
+		ItemPriceMultiplier:     0.2,
+		ItemQuantityMode:        ItemQuantityLine,
+		OddDayPoints:            6,
+		AfternoonPoints:         10,
+		AfternoonStart:          "14:00",
+		AfternoonEnd:            "16:00",
+	}
+}
+
+// Parse decodes a rules file on top of the defaults and validates the result
+func Parse(data []byte) (*RuleSet, error) {
+	rs := Default()
+	rs.Version = ""
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(rs); err != nil {
+		return nil, fmt.Errorf("Error decoding rules: %v", err)
+	}
+	if rs.Version == "" {
+		sum := sha256.Sum256(data)
+		rs.Version = "sha256:" + hex.EncodeToString(sum[:6])
+	}
+	if err := rs.Validate(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (rs *RuleSet) Validate() error {
+	if rs.ItemDescriptionMultiple < 1 {
+		return fmt.Errorf("Invalid rules: itemDescriptionMultiple must be at least 1")
+	}
+	if rs.ItemPriceMultiplier < 0 {
+		return fmt.Errorf("Invalid rules: itemPriceMultiplier must not be negative")
+	}
+	if rs.ItemQuantityMode != ItemQuantityLine && rs.ItemQuantityMode != ItemQuantityUnit {
+		return fmt.Errorf("Invalid rules: itemQuantityMode must be %q or %q", ItemQuantityLine, ItemQuantityUnit)
+	}
+	start, err := ParseClock(rs.AfternoonStart)
+	if err != nil {
+		return fmt.Errorf("Invalid rules: afternoonStart: %v", err)
+	}
+	end, err := ParseClock(rs.AfternoonEnd)
+	if err != nil {
+		return fmt.Errorf("Invalid rules: afternoonEnd: %v", err)
+	}
+	if end <= start {
+		return fmt.Errorf("Invalid rules: afternoonEnd must be after afternoonStart")
+	}
+	if err := rs.Afternoon().validate(); err != nil {
+		return fmt.Errorf("Invalid rules: afternoonInclusive: %v", err)
+	}
+	windows := make(map[string]bool, len(rs.TimeWindows))
+	for i, w := range rs.TimeWindows {
+		if !validWindowName.MatchString(w.Name) {
+			return fmt.Errorf("Invalid rules: timeWindows[%d] name must be a letter followed by letters, digits or '_', got %q", i, w.Name)
+		}
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("Invalid rules: timeWindows[%d]: %v", i, err)
+		}
+		if windows[w.Name] {
+			return fmt.Errorf("Invalid rules: time window %q is defined more than once", w.Name)
+		}
+		windows[w.Name] = true
+	}
+	for i := range rs.RetailerOverrides {
+		o := &rs.RetailerOverrides[i]
+		set := 0
+		for _, matcher := range []string{o.Retailer, o.Pattern, o.RetailerID} {
+			if matcher != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("Invalid rules: retailerOverrides[%d] needs exactly one of retailer, pattern or retailerId", i)
+		}
+		if o.ItemPointsMultiplier < 0 || o.PointsMultiplier < 0 {
+			return fmt.Errorf("Invalid rules: retailerOverrides[%d] multipliers must not be negative", i)
+		}
+		if o.Pattern != "" {
+			// patterns are case-insensitive like name matches
+			re, err := regexp.Compile("(?i)" + o.Pattern)
+			if err != nil {
+				return fmt.Errorf("Invalid rules: retailerOverrides[%d] pattern: %v", i, err)
+			}
+			o.pattern = re
+		}
+	}
+	for name, m := range map[string]map[string]int{"paymentMethodPoints": rs.PaymentMethodPoints, "storePoints": rs.StorePoints} {
+		seen := make(map[string]bool, len(m))
+		for k := range m {
+			if strings.TrimSpace(k) == "" {
+				return fmt.Errorf("Invalid rules: %s keys must not be empty", name)
+			}
+			// two keys differing only in case would match the same receipts
+			folded := strings.ToLower(k)
+			if seen[folded] {
+				return fmt.Errorf("Invalid rules: %s has %q more than once", name, k)
+			}
+			seen[folded] = true
+		}
+	}
+	names := make(map[string]bool, len(rs.ExpressionRules))
+	for i := range rs.ExpressionRules {
+		r := &rs.ExpressionRules[i]
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("Invalid rules: expressionRules[%d]: %v", i, err)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("Invalid rules: expression rule %q is defined more than once", r.Name)
+		}
+		names[r.Name] = true
+	}
+	seen := make(map[string]bool, len(rs.Plugins))
+	for _, name := range rs.Plugins {
+		if !plugin.ValidName(name) {
+			return fmt.Errorf("Invalid rules: plugin %q must be a file name of letters, digits, '.', '_' or '-'", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("Invalid rules: plugin %q is listed more than once", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// UsePlugins makes sure runner can run every plugin of the rule set and has the rule
+// set run them with it
+func (rs *RuleSet) UsePlugins(runner *plugin.Runner) error {
+	for _, name := range rs.Plugins {
+		if err := runner.Check(name); err != nil {
+			return fmt.Errorf("Invalid rules: %v", err)
+		}
+	}
+	rs.plugins = runner
+	return nil
+}
+
+// PluginRunner runs the rule set's plugins, nil until UsePlugins
+func (rs *RuleSet) PluginRunner() *plugin.Runner {
+	return rs.plugins
+}
+
+// PaymentMethodBonus is the bonus for receipts paid with method, 0 for none
+func (rs *RuleSet) PaymentMethodBonus(method string) int {
+	return lookupFold(rs.PaymentMethodPoints, method)
+}
+
+// StoreBonus is the bonus for receipts from the store with id storeID, 0 for none
+func (rs *RuleSet) StoreBonus(storeID string) int {
+	return lookupFold(rs.StorePoints, storeID)
+}
+
+// lookupFold finds key in m ignoring case, the maps are a handful of entries
+func lookupFold(m map[string]int, key string) int {
+	if key == "" {
+		return 0
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return 0
+}
+
+// ParseClock turns HH:MM into HHMM, an int that compares like the time of day
+func ParseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", s)
+	}
+	return t.Hour()*100 + t.Minute(), nil
+}
+
+// Registry hands out the active rule set. Reloads swap the whole set atomically, a
+// request that already grabbed Current keeps scoring with the set it started with.
+type Registry struct {
+	path    string
+	plugins *plugin.Runner
+	current atomic.Pointer[RuleSet]
+}
+
+// NewRegistry loads the rules file at path, or uses the default rules when path is
+// empty. The rules' plugins are run by plugins.
+func NewRegistry(path string, plugins *plugin.Runner) (*Registry, error) {
+	reg := &Registry{path: path, plugins: plugins}
+	if _, err := reg.Reload(); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+// Parse parses a rules document the way Reload parses the rules file, plugins included,
+// without swapping it in
+func (reg *Registry) Parse(data []byte) (*RuleSet, error) {
+	rs, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	var plugins *plugin.Runner
+	if reg != nil {
+		plugins = reg.plugins
+	}
+	if err := rs.UsePlugins(plugins); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (reg *Registry) Current() *RuleSet {
+	return reg.current.Load()
+}
+
+// Reload re-reads the rules file and swaps it in. On error the active rules stay as
+// they were.
+func (reg *Registry) Reload() (*RuleSet, error) {
+	rs := Default()
+	if reg.path != "" {
+		data, err := os.ReadFile(reg.path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading rules file: %v", err)
+		}
+		if rs, err = reg.Parse(data); err != nil {
+			return nil, err
+		}
+	}
+	reg.current.Store(rs)
+	return rs, nil
+}
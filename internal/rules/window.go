@@ -0,0 +1,82 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// which ends of a time window a purchase at exactly that time is in
+const (
+	InclusiveStart = "start"
+	InclusiveEnd   = "end"
+	InclusiveBoth  = "both"
+	InclusiveNone  = "none"
+)
+
+var validWindowName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,63}$`)
+
+// TimeWindow gives Points to receipts purchased between Start and End (HH:MM, in the
+// receipt's timezone). Inclusive says which ends are part of the window, InclusiveStart
+// when it's empty: a 14:00-16:00 window takes 14:00 but not 16:00, so back to back
+// windows never both fire. A window that ends before it starts runs past midnight.
+type TimeWindow struct {
+	Name      string `json:"name"`
+	Start     string `json:"start"`
+	End       string `json:"end"`
+	Inclusive string `json:"inclusive,omitempty"`
+	Points    int    `json:"points"`
+}
+
+// validate checks the window's times and boundaries parse
+func (w TimeWindow) validate() error {
+	start, err := ParseClock(w.Start)
+	if err != nil {
+		return fmt.Errorf("start: %v", err)
+	}
+	end, err := ParseClock(w.End)
+	if err != nil {
+		return fmt.Errorf("end: %v", err)
+	}
+	if start == end {
+		return fmt.Errorf("start and end are both %s", w.Start)
+	}
+	switch w.Inclusive {
+	case "", InclusiveStart, InclusiveEnd, InclusiveBoth, InclusiveNone:
+	default:
+		return fmt.Errorf("inclusive must be %q, %q, %q or %q", InclusiveStart, InclusiveEnd, InclusiveBoth, InclusiveNone)
+	}
+	return nil
+}
+
+// Contains reports whether a purchase at hhmm (hour*100 + minute) is in the window.
+// Windows are validated on load, their times always parse.
+func (w TimeWindow) Contains(hhmm int) bool {
+	start, _ := ParseClock(w.Start)
+	end, _ := ParseClock(w.End)
+	inclusive := w.Inclusive
+	if inclusive == "" {
+		inclusive = InclusiveStart
+	}
+	afterStart := hhmm > start || (hhmm == start && (inclusive == InclusiveStart || inclusive == InclusiveBoth))
+	beforeEnd := hhmm < end || (hhmm == end && (inclusive == InclusiveEnd || inclusive == InclusiveBoth))
+	if end < start {
+		return afterStart || beforeEnd
+	}
+	return afterStart && beforeEnd
+}
+
+// Afternoon is the afternoon bonus as a window. Unlike TimeWindows it's exclusive at
+// both ends unless AfternoonInclusive says otherwise, that's how it always scored.
+func (rs *RuleSet) Afternoon() TimeWindow {
+	inclusive := rs.AfternoonInclusive
+	if inclusive == "" {
+		inclusive = InclusiveNone
+	}
+	return TimeWindow{
+		Name:      "afternoonPurchase",
+		Start:     rs.AfternoonStart,
+		End:       rs.AfternoonEnd,
+		Inclusive: inclusive,
+		Points:    rs.AfternoonPoints,
+	}
+}
@@ -0,0 +1,55 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTimeWindowBoundaries(t *testing.T) {
+	for _, tc := range []struct {
+		window TimeWindow
+		in     []int
+		out    []int
+	}{
+		{TimeWindow{Start: "14:00", End: "16:00"}, []int{1400, 1559}, []int{1359, 1600}},
+		{TimeWindow{Start: "14:00", End: "16:00", Inclusive: InclusiveEnd}, []int{1401, 1600}, []int{1400, 1601}},
+		{TimeWindow{Start: "14:00", End: "16:00", Inclusive: InclusiveBoth}, []int{1400, 1600}, []int{1359, 1601}},
+		{TimeWindow{Start: "14:00", End: "16:00", Inclusive: InclusiveNone}, []int{1401, 1559}, []int{1400, 1600}},
+		// past midnight
+		{TimeWindow{Start: "22:00", End: "02:00"}, []int{2200, 2359, 0, 159}, []int{200, 1200, 2159}},
+	} {
+		for _, hhmm := range tc.in {
+			if !tc.window.Contains(hhmm) {
+				t.Errorf("%+v doesn't contain %04d", tc.window, hhmm)
+			}
+		}
+		for _, hhmm := range tc.out {
+			if tc.window.Contains(hhmm) {
+				t.Errorf("%+v contains %04d", tc.window, hhmm)
+			}
+		}
+	}
+
+	// the afternoon bonus keeps excluding both ends unless told otherwise
+	if afternoon := Default().Afternoon(); afternoon.Contains(1400) || !afternoon.Contains(1401) || afternoon.Contains(1600) {
+		t.Errorf("default afternoon window: %+v", afternoon)
+	}
+}
+
+func TestTimeWindowsAreCheckedOnLoad(t *testing.T) {
+	for windows, want := range map[string]string{
+		`{"name": "m", "start": "8:00am", "end": "11:00"}`:                                                 "start",
+		`{"name": "m", "start": "08:00", "end": "08:00"}`:                                                  "start and end are both",
+		`{"name": "m", "start": "08:00", "end": "11:00", "inclusive": "left"}`:                             "inclusive must be",
+		`{"name": "", "start": "08:00", "end": "11:00"}`:                                                   "name must be",
+		`{"name": "m", "start": "08:00", "end": "11:00"}, {"name": "m", "start": "12:00", "end": "13:00"}`: "more than once",
+	} {
+		_, err := Parse([]byte(`{"timeWindows": [` + windows + `]}`))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want an error saying %q", windows, err, want)
+		}
+	}
+	if _, err := Parse([]byte(`{"afternoonInclusive": "sometimes"}`)); err == nil {
+		t.Error("afternoonInclusive sometimes loaded")
+	}
+}
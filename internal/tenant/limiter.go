@@ -0,0 +1,49 @@
+package tenant
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter enforces every tenant's RateLimit with one token bucket per tenant. The
+// buckets are per instance, a tenant's effective limit grows with the instance count.
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token from the tenant's bucket. When it's empty it says how long until
+// the next token, for Retry-After. Tenants without a RateLimit are always allowed.
+func (l *Limiter) Allow(t *Tenant, now time.Time) (bool, time.Duration) {
+	limit := t.RateLimit
+	if limit == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[t.ID]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[t.ID] = b
+	}
+	// limits are read on every call so a reload applies right away
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.RequestsPerSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / limit.RequestsPerSecond * float64(time.Second))
+	return false, wait
+}
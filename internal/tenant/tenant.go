@@ -0,0 +1,215 @@
+package tenant
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync/atomic"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/plugin"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+)
+
+var (
+	validID      = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+	validKeyHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// Default is who requests belong to when no tenants are configured. Its data lives
+// under the unprefixed keys and it scores with the deployment's rules.
+var Default = &Tenant{Name: "default"}
+
+// RateLimit caps a tenant's requests per instance, as a token bucket
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	Burst             int     `json:"burst"`
+}
+
+// Tenant is one partner app sharing the deployment
+type Tenant struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// hex SHA-256 of the tenant's API keys, the keys themselves never get written down.
+	// more than one so keys can be rotated without downtime
+	APIKeyHashes []string `json:"apiKeySha256"`
+	// the tenant's own points rules, the deployment's when empty
+	RulesPath string     `json:"rulesPath,omitempty"`
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	// receipts per UTC day and per UTC calendar month, 0 means no quota
+	DailyReceiptQuota   int `json:"dailyReceiptQuota,omitempty"`
+	MonthlyReceiptQuota int `json:"monthlyReceiptQuota,omitempty"`
+
+	ruleSet *rules.RuleSet
+}
+
+// RuleSet is the tenant's own rule set, nil when it uses the deployment's
+func (t *Tenant) RuleSet() *rules.RuleSet {
+	return t.ruleSet
+}
+
+// HashAPIKey is how API keys are written down in the tenants file
+func HashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+type tenantsFile struct {
+	Tenants []*Tenant `json:"tenants"`
+}
+
+// Parse decodes and validates a tenants file, loading every tenant's rules file. The
+// rules' plugins are run by plugins.
+func Parse(data []byte, plugins *plugin.Runner) ([]*Tenant, error) {
+	var file tenantsFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("Error decoding tenants file: %v", err)
+	}
+	seenIDs := make(map[string]bool)
+	seenKeys := make(map[string]bool)
+	for _, t := range file.Tenants {
+		if !validID.MatchString(t.ID) {
+			return nil, fmt.Errorf("Invalid tenant id %q, expected lowercase letters, digits and dashes", t.ID)
+		}
+		if seenIDs[t.ID] {
+			return nil, fmt.Errorf("Duplicate tenant id %q", t.ID)
+		}
+		seenIDs[t.ID] = true
+		if len(t.APIKeyHashes) == 0 {
+			return nil, fmt.Errorf("Tenant %s has no apiKeySha256", t.ID)
+		}
+		for _, hash := range t.APIKeyHashes {
+			if !validKeyHash.MatchString(hash) {
+				return nil, fmt.Errorf("Tenant %s has an invalid apiKeySha256, expected 64 lowercase hex characters", t.ID)
+			}
+			if seenKeys[hash] {
+				return nil, fmt.Errorf("Tenant %s shares an API key with another tenant", t.ID)
+			}
+			seenKeys[hash] = true
+		}
+		if t.RateLimit != nil && (t.RateLimit.RequestsPerSecond <= 0 || t.RateLimit.Burst < 1) {
+			return nil, fmt.Errorf("Tenant %s needs a positive requestsPerSecond and burst", t.ID)
+		}
+		if t.DailyReceiptQuota < 0 {
+			return nil, fmt.Errorf("Tenant %s has a negative dailyReceiptQuota", t.ID)
+		}
+		if t.MonthlyReceiptQuota < 0 {
+			return nil, fmt.Errorf("Tenant %s has a negative monthlyReceiptQuota", t.ID)
+		}
+		if t.RulesPath != "" {
+			rulesData, err := os.ReadFile(t.RulesPath)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading rules file of tenant %s: %v", t.ID, err)
+			}
+			if t.ruleSet, err = rules.Parse(rulesData); err != nil {
+				return nil, fmt.Errorf("Error in rules file of tenant %s: %v", t.ID, err)
+			}
+			if err := t.ruleSet.UsePlugins(plugins); err != nil {
+				return nil, fmt.Errorf("Error in rules file of tenant %s: %v", t.ID, err)
+			}
+		}
+	}
+	return file.Tenants, nil
+}
+
+type tenantSet struct {
+	byID      map[string]*Tenant
+	byKeyHash map[string]*Tenant
+}
+
+// Registry hands out the configured tenants. Like the rules, reloads swap the whole
+// set at once.
+type Registry struct {
+	path    string
+	plugins *plugin.Runner
+	current atomic.Pointer[tenantSet]
+}
+
+// NewRegistry loads the tenants file at path. Without a path there are no tenants and
+// every request belongs to Default. Tenants' rule plugins are run by plugins.
+func NewRegistry(path string, plugins *plugin.Runner) (*Registry, error) {
+	reg := &Registry{path: path, plugins: plugins}
+	if err := reg.Reload(); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+// Enabled reports whether tenants are configured, i.e. whether requests need an API key
+func (reg *Registry) Enabled() bool {
+	return reg.path != ""
+}
+
+// Reload re-reads the tenants file (and the tenants' rules files) and swaps it in. On
+// error the active tenants stay as they were.
+func (reg *Registry) Reload() error {
+	set := &tenantSet{byID: map[string]*Tenant{}, byKeyHash: map[string]*Tenant{}}
+	if reg.path != "" {
+		data, err := os.ReadFile(reg.path)
+		if err != nil {
+			return fmt.Errorf("Error reading tenants file: %v", err)
+		}
+		tenants, err := Parse(data, reg.plugins)
+		if err != nil {
+			return err
+		}
+		for _, t := range tenants {
+			set.byID[t.ID] = t
+			for _, hash := range t.APIKeyHashes {
+				set.byKeyHash[hash] = t
+			}
+		}
+	}
+	reg.current.Store(set)
+	return nil
+}
+
+// Authenticate finds the tenant an API key belongs to
+func (reg *Registry) Authenticate(apiKey string) (*Tenant, bool) {
+	t, ok := reg.current.Load().byKeyHash[HashAPIKey(apiKey)]
+	return t, ok
+}
+
+// Get finds a tenant by id, "" being Default
+func (reg *Registry) Get(id string) (*Tenant, bool) {
+	if id == "" {
+		return Default, true
+	}
+	t, ok := reg.current.Load().byID[id]
+	return t, ok
+}
+
+// All returns Default followed by the configured tenants sorted by id, for work that
+// has to cover every tenant's data (sweeps, refreshes)
+func (reg *Registry) All() []*Tenant {
+	set := reg.current.Load()
+	all := make([]*Tenant, 0, len(set.byID)+1)
+	all = append(all, Default)
+	for _, t := range set.byID {
+		all = append(all, t)
+	}
+	sort.Slice(all[1:], func(i, j int) bool { return all[i+1].ID < all[j+1].ID })
+	return all
+}
+
+type contextKey struct{}
+
+// NewContext returns ctx carrying the tenant a request or job acts for
+func NewContext(ctx context.Context, t *Tenant) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the tenant ctx acts for, Default when none was set
+func FromContext(ctx context.Context) *Tenant {
+	if t, ok := ctx.Value(contextKey{}).(*Tenant); ok {
+		return t
+	}
+	return Default
+}
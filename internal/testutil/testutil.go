@@ -0,0 +1,249 @@
+// Package testutil boots the whole HTTP stack (router, middlewares, handlers and the
+// Redis store) against an in-memory Redis, for tests that exercise the service end to
+// end without any outside dependencies.
+package testutil
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/app"
+	"github.com/jayreddy040-510/receipt_processor/internal/breaker"
+	"github.com/jayreddy040-510/receipt_processor/internal/chaos"
+	"github.com/jayreddy040-510/receipt_processor/internal/clock"
+	"github.com/jayreddy040-510/receipt_processor/internal/concurrency"
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/db"
+	"github.com/jayreddy040-510/receipt_processor/internal/db/fake"
+	"github.com/jayreddy040-510/receipt_processor/internal/events"
+	"github.com/jayreddy040-510/receipt_processor/internal/jobs"
+	"github.com/jayreddy040-510/receipt_processor/internal/lru"
+	"github.com/jayreddy040-510/receipt_processor/internal/oidc"
+	"github.com/jayreddy040-510/receipt_processor/internal/outbox"
+	"github.com/jayreddy040-510/receipt_processor/internal/plugin"
+	"github.com/jayreddy040-510/receipt_processor/internal/report"
+	"github.com/jayreddy040-510/receipt_processor/internal/rules"
+	"github.com/jayreddy040-510/receipt_processor/internal/tenant"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// AdminToken is the ADMIN_TOKEN every harness is booted with
+const AdminToken = "test-admin-token"
+
+// Now is where a harness' clock starts. Fixed so anything date dependent (future date
+// checks, stats days) comes out the same on every run.
+var Now = time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+
+// baseEnv is the configuration every harness starts from, the required variables plus
+// timeouts short enough for timeout tests to be quick
+var baseEnv = map[string]string{
+	"SERVER_PORT":           "8080",
+	"DB_TIMEOUT_IN_MS":      "200",
+	"REQUEST_TIMEOUT_IN_MS": "500",
+	"REDIS_TTL_IN_S":        "600",
+	"MAX_DB_CONN_RETRIES":   "3",
+	"ADMIN_TOKEN":           AdminToken,
+}
+
+// Harness is a running instance of the service. Redis and Store are set when it runs
+// against miniredis (New), Fake when it runs against the in-memory fake (NewFake).
+type Harness struct {
+	Redis  *miniredis.Miniredis
+	Store  *db.RedisStore
+	Fake   *fake.Store
+	App    *app.App
+	Server *httptest.Server
+	Clock  *clock.Frozen
+}
+
+// New boots the service against a fresh miniredis. env overrides the configuration
+// (same names as the real env vars), REDIS_ADDR defaults to the miniredis. Everything
+// is torn down when the test ends.
+func New(t testing.TB, env map[string]string) *Harness {
+	t.Helper()
+	h := &Harness{Redis: miniredis.RunT(t), Clock: clock.NewFrozen(Now)}
+	cfg := Config(t, h.Redis.Addr(), env)
+
+	h.Store = db.NewRedisStore(cfg)
+	t.Cleanup(func() { h.Store.Close() })
+	h.boot(t, cfg, h.Store, h.Store.Breaker())
+	return h
+}
+
+// NewFake boots the service against an in-memory fake.Store instead of Redis, for
+// tests that want to make the store slow or failing. The fake shares the harness'
+// clock and expires receipts after REDIS_TTL_IN_S (or their retention class's TTL)
+// like Redis would.
+func NewFake(t testing.TB, env map[string]string) *Harness {
+	t.Helper()
+	h := &Harness{Clock: clock.NewFrozen(Now)}
+	cfg := Config(t, "127.0.0.1:0", env)
+	h.Fake = fake.New(fake.WithClock(h.Clock), fake.WithTTL(cfg.RedisTTLInSec), fake.WithRetention(cfg.ReceiptRetention))
+	h.boot(t, cfg, h.Fake, nil)
+	return h
+}
+
+func (h *Harness) boot(t testing.TB, cfg config.Config, store db.Store, storeBreaker *breaker.Breaker) {
+	t.Helper()
+	rulePlugins := plugin.New(cfg)
+	t.Cleanup(func() { rulePlugins.Close() })
+	ruleRegistry, err := rules.NewRegistry(cfg.RulesPath, rulePlugins)
+	if err != nil {
+		t.Fatalf("Error loading rules: %v", err)
+	}
+	tenants, err := tenant.NewRegistry(cfg.TenantsPath, rulePlugins)
+	if err != nil {
+		t.Fatalf("Error loading tenants: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	jobRunner := jobs.NewRunner(16)
+	jobRunner.Start(ctx, 1)
+
+	h.App = &app.App{
+		Db:           store,
+		Breaker:      storeBreaker,
+		Config:       cfg,
+		Rules:        ruleRegistry,
+		Jobs:         jobRunner,
+		Tenants:      tenants,
+		RateLimiter:  tenant.NewLimiter(),
+		Processing:   concurrency.New(cfg.MaxConcurrentReceipts, cfg.ReceiptQueueSize, cfg.ConcurrencyQueueWaitInMs),
+		Requests:     concurrency.NewPriority(cfg.MaxInFlightRequests, cfg.LookupReservedRequests, cfg.InFlightQueueSize, cfg.ConcurrencyQueueWaitInMs),
+		Stream:       events.NewHub(cfg.EventStreamBufferSize, cfg.MaxEventStreams),
+		ReceiptCache: lru.New[db.ReceiptRecord](cfg.ReceiptCacheSize, cfg.ReceiptCacheTTLInMs),
+		Clock:        h.Clock,
+	}
+	if redisStore, ok := store.(*db.RedisStore); ok && cfg.ChaosMode {
+		h.App.Chaos = chaos.New()
+		redisStore.InjectFaults(h.App.Chaos)
+	}
+	h.App.StartFingerprintSync(ctx, cfg.FraudBloomSyncInMs)
+	if cfg.OutboxPath != "" || cfg.DegradedMode {
+		receiptOutbox := outbox.New(cfg.OutboxMaxEntries)
+		if cfg.OutboxPath != "" {
+			if receiptOutbox, err = outbox.Open(cfg.OutboxPath, cfg.OutboxMaxEntries); err != nil {
+				t.Fatalf("Error opening the outbox: %v", err)
+			}
+		}
+		// the flusher stops before the file is closed
+		t.Cleanup(func() {
+			cancel()
+			receiptOutbox.Close()
+		})
+		h.App.Outbox = receiptOutbox
+		h.App.StartOutboxFlusher(ctx, cfg.OutboxFlushInMs)
+	}
+	if cfg.HasReportDestination() {
+		h.App.Reports = report.New(cfg, nil)
+	}
+	if cfg.OIDCIssuerURL != "" {
+		provider, err := oidc.Discover(ctx, http.DefaultClient, cfg.OIDCIssuerURL, cfg.OIDCClientID, cfg.OIDCClientSecret, cfg.OIDCRedirectURL)
+		if err != nil {
+			t.Fatalf("Error configuring OIDC: %v", err)
+		}
+		h.App.OIDC = provider
+	}
+	// served the way main serves it, timeouts and h2c included
+	h.Server = httptest.NewUnstartedServer(nil)
+	h.Server.Config = h.App.Server("")
+	h.Server.Start()
+	t.Cleanup(h.Server.Close)
+}
+
+// Config resolves a configuration the way the service does at boot, from baseEnv with
+// env on top and redisAddr as REDIS_ADDR unless env sets it
+func Config(t testing.TB, redisAddr string, env map[string]string) config.Config {
+	t.Helper()
+	vars := map[string]string{"REDIS_ADDR": redisAddr}
+	for k, v := range baseEnv {
+		vars[k] = v
+	}
+	for k, v := range env {
+		vars[k] = v
+	}
+	for k, v := range vars {
+		t.Setenv(k, v)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+	return cfg
+}
+
+// Response is a finished response with its body read
+type Response struct {
+	*http.Response
+	Body string
+}
+
+// Do sends a request to the harness. headers are name/value pairs.
+func (h *Harness) Do(t testing.TB, method, path, body string, headers ...string) Response {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, h.Server.URL+path, reader)
+	if err != nil {
+		t.Fatalf("Error building request: %v", err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := h.Server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Error sending %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading response to %s %s: %v", method, path, err)
+	}
+	return Response{Response: resp, Body: string(b)}
+}
+
+// Admin is Do with the admin token
+func (h *Harness) Admin(t testing.TB, method, path, body string) Response {
+	t.Helper()
+	return h.Do(t, method, path, body, "Authorization", "Bearer "+AdminToken)
+}
+
+// StalledRedis is the address of something that accepts connections like Redis would
+// and then never answers, for driving requests into their timeouts
+func StalledRedis(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// held open, never read from or written to
+			conns = append(conns, conn)
+		}
+	}()
+	return ln.Addr().String()
+}
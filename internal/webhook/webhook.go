@@ -0,0 +1,229 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jayreddy040-510/receipt_processor/internal/config"
+	"github.com/jayreddy040-510/receipt_processor/internal/logging"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	TimestampHeader = "X-Webhook-Timestamp"
+
+	queueSize  = 1024
+	maxBackoff = time.Minute
+)
+
+// Payload is the body POSTed to every webhook once a receipt is processed
+type Payload struct {
+	ID     string `json:"id"`
+	Points int    `json:"points"`
+	// the tenant the receipt belongs to, empty for the default tenant
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Registry hands out the webhook URLs registered at runtime (through the admin API),
+// on top of the ones coming from config
+type Registry interface {
+	ListWebhooks(ctx context.Context) ([]string, error)
+}
+
+// TenantRegistry returns the Registry with a tenant's webhooks. Configured URLs get
+// every tenant's notifications, registered ones only their own tenant's.
+type TenantRegistry func(tenantID string) Registry
+
+type delivery struct {
+	url  string
+	body []byte
+}
+
+// settings are the parts of the dispatcher's config that can be swapped at runtime
+type settings struct {
+	staticURLs []string
+	maxRetries int
+	timeout    time.Duration
+	backoff    time.Duration
+	dbTimeout  time.Duration
+}
+
+type Dispatcher struct {
+	registry TenantRegistry
+	secret   []byte
+	client   *http.Client
+	settings atomic.Pointer[settings]
+
+	events     chan Payload
+	deliveries chan delivery
+}
+
+func NewDispatcher(cfg config.Config, registry TenantRegistry) *Dispatcher {
+	d := &Dispatcher{
+		registry:   registry,
+		secret:     []byte(cfg.WebhookSecret),
+		client:     &http.Client{},
+		events:     make(chan Payload, queueSize),
+		deliveries: make(chan delivery, queueSize),
+	}
+	d.Reconfigure(cfg)
+	return d
+}
+
+// Reconfigure swaps in new targets, retry and timeout settings. Deliveries already
+// retrying keep the settings they started with.
+func (d *Dispatcher) Reconfigure(cfg config.Config) {
+	d.settings.Store(&settings{
+		staticURLs: cfg.WebhookURLs,
+		maxRetries: cfg.WebhookMaxRetries,
+		timeout:    cfg.WebhookTimeoutInMs,
+		backoff:    cfg.WebhookBackoffInMs,
+		dbTimeout:  cfg.DbTimeoutInMs,
+	})
+}
+
+// Start runs the fan-out loop and the delivery workers until ctx is done
+func (d *Dispatcher) Start(ctx context.Context, workers int) {
+	go d.fanOut(ctx)
+	for i := 0; i < workers; i++ {
+		go d.work(ctx)
+	}
+}
+
+// Notify queues a payload for delivery without blocking the caller. design decision:
+// drop (and log) when the queue is full rather than slow down receipt processing
+func (d *Dispatcher) Notify(p Payload) {
+	select {
+	case d.events <- p:
+	default:
+		logging.Warnf(context.Background(), "Webhook queue full, dropping notification for receipt %s", p.ID)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>". Receivers recompute it with
+// the shared secret to verify a request came from us and wasn't replayed later.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dispatcher) targets(ctx context.Context, tenantID string) []string {
+	cfg := d.settings.Load()
+	urls := append([]string{}, cfg.staticURLs...)
+	if d.registry == nil {
+		return urls
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.dbTimeout)
+	defer cancel()
+	registered, err := d.registry(tenantID).ListWebhooks(ctx)
+	if err != nil {
+		logging.Printf(ctx, "Error loading registered webhooks, only notifying configured ones: %v", err)
+		return urls
+	}
+	seen := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		seen[u] = true
+	}
+	for _, u := range registered {
+		if !seen[u] {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+func (d *Dispatcher) fanOut(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-d.events:
+			body, err := json.Marshal(p)
+			if err != nil {
+				logging.Printf(ctx, "Error encoding webhook payload: %v", err)
+				continue
+			}
+			for _, u := range d.targets(ctx, p.Tenant) {
+				select {
+				case d.deliveries <- delivery{url: u, body: body}:
+				default:
+					logging.Warnf(ctx, "Webhook delivery queue full, dropping %s for receipt %s", u, p.ID)
+				}
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case del := <-d.deliveries:
+			d.deliver(ctx, del)
+		}
+	}
+}
+
+// deliver POSTs until the receiver answers 2xx, backing off exponentially between
+// attempts, and gives up after maxRetries retries
+func (d *Dispatcher) deliver(ctx context.Context, del delivery) {
+	cfg := d.settings.Load()
+	backoff := cfg.backoff
+	for attempt := 0; ; attempt++ {
+		err := d.post(ctx, del, cfg.timeout)
+		if err == nil {
+			return
+		}
+		if attempt >= cfg.maxRetries {
+			logging.Errorf(ctx, "Giving up on webhook %s after %d attempts: %v", del.url, attempt+1, err)
+			return
+		}
+		logging.Warnf(ctx, "Webhook %s failed, retrying in %v: %v", del.url, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (d *Dispatcher) post(ctx context.Context, del delivery, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.url, bytes.NewReader(del.body))
+	if err != nil {
+		return fmt.Errorf("Error building webhook request: %v", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	if len(d.secret) > 0 {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(d.secret, timestamp, del.body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error sending webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
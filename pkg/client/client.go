@@ -0,0 +1,275 @@
+// Package client is a Go client for the receipt processor API.
+//
+//	c := client.New("http://localhost:8080")
+//	id, err := c.ProcessReceipt(ctx, receipt)
+//	points, err := c.GetPoints(ctx, id)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ID identifies a processed receipt
+type ID string
+
+type Item struct {
+	ShortDescription string `json:"shortDescription"`
+	// the line's total, Quantity times UnitPrice. Either one of Price and UnitPrice will do
+	Price string `json:"price,omitempty"`
+	// optional, 0 means 1
+	Quantity  int    `json:"quantity,omitempty"`
+	UnitPrice string `json:"unitPrice,omitempty"`
+}
+
+type Receipt struct {
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+	Items        []Item `json:"items"`
+	Total        string `json:"total"`
+	// optional, the user the points are credited to
+	UserID string `json:"userId,omitempty"`
+	// optional, the IANA zone PurchaseDate and PurchaseTime are in, the server's
+	// BUSINESS_TIMEZONE when empty
+	Timezone string `json:"timezone,omitempty"`
+	// optional details from the point of sale, Total is what was paid after tax and
+	// discounts
+	Tax           string     `json:"tax,omitempty"`
+	Discounts     []Discount `json:"discounts,omitempty"`
+	PaymentMethod string     `json:"paymentMethod,omitempty"`
+	Store         *Store     `json:"store,omitempty"`
+}
+
+type Discount struct {
+	Description string `json:"description"`
+	Amount      string `json:"amount"`
+}
+
+// Store is where a receipt is from, every field is optional
+type Store struct {
+	ID         string `json:"id,omitempty"`
+	Address    string `json:"address,omitempty"`
+	City       string `json:"city,omitempty"`
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postalCode,omitempty"`
+	Country    string `json:"country,omitempty"`
+}
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	// bounds each attempt, 0 for none
+	timeout    time.Duration
+	maxRetries int
+	backoff    time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient swaps the underlying http.Client, e.g. to add transport middleware. It
+// isn't modified, WithTimeout applies on top of its own Timeout.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithTimeout bounds every single attempt, retries get a fresh timeout each. Defaults
+// to 5s, 0 leaves attempts to the context and the http.Client.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+// WithRetries sets how many times a failed call is retried and the initial backoff,
+// which doubles after each attempt. Defaults to 2 retries starting at 200ms.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{},
+		timeout:    5 * time.Second,
+		maxRetries: 2,
+		backoff:    200 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ProcessReceipt submits a receipt for scoring and returns its id. Processing isn't
+// idempotent, so it is only retried when the server can't have seen the request
+// (connection refused) or turned it away before processing it (429). A 503 can come
+// after the store took part of the write, it isn't retried.
+func (c *Client) ProcessReceipt(ctx context.Context, receipt Receipt) (ID, error) {
+	body, err := json.Marshal(receipt)
+	if err != nil {
+		return "", fmt.Errorf("Error encoding receipt: %w", err)
+	}
+	var resp struct {
+		ID ID `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/receipts/process", body, false, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// Score is what a receipt would earn if it were processed now
+type Score struct {
+	Points       int    `json:"points"`
+	RulesVersion string `json:"rulesVersion,omitempty"`
+	// when the points would expire, nil if they don't
+	PointsExpireAt *time.Time        `json:"pointsExpireAt,omitempty"`
+	Breakdown      []PointsComponent `json:"breakdown"`
+}
+
+// PointsComponent is what one rule contributed to a receipt's points
+type PointsComponent struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail,omitempty"`
+	Points int    `json:"points"`
+}
+
+// ScoreReceipt previews the points a receipt would earn, e.g. before checkout is
+// finalized. Nothing is stored, so it's retried like a lookup.
+func (c *Client) ScoreReceipt(ctx context.Context, receipt Receipt) (Score, error) {
+	body, err := json.Marshal(receipt)
+	if err != nil {
+		return Score{}, fmt.Errorf("Error encoding receipt: %w", err)
+	}
+	var score Score
+	if err := c.do(ctx, http.MethodPost, "/v1/receipts/score", body, true, &score); err != nil {
+		return Score{}, err
+	}
+	return score, nil
+}
+
+// GetPoints returns the points awarded to a processed receipt. A receipt that doesn't
+// exist (or has expired) yields an error matching ErrNotFound.
+func (c *Client) GetPoints(ctx context.Context, id ID) (int, error) {
+	var resp struct {
+		Points int `json:"points"`
+	}
+	path := "/v1/receipts/" + url.PathEscape(string(id)) + "/points"
+	if err := c.do(ctx, http.MethodGet, path, nil, true, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Points, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte, idempotent bool, out interface{}) error {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, method, path, body, out)
+		if err == nil {
+			return nil
+		}
+		if attempt >= c.maxRetries || !shouldRetry(err, idempotent) {
+			return err
+		}
+
+		wait := backoff
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			wait = apiErr.RetryAfter
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("Error building request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newAPIError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("Error decoding response: %w", err)
+	}
+	return nil
+}
+
+func newAPIError(resp *http.Response) *APIError {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(msg)),
+		RequestID:  resp.Header.Get("X-Request-ID"),
+	}
+	var body struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") && json.Unmarshal(msg, &body) == nil {
+		apiErr.Code, apiErr.Message = body.Code, body.Message
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return apiErr
+}
+
+func shouldRetry(err error, idempotent bool) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests:
+			return true
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return idempotent
+		}
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return idempotent
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return idempotent
+}
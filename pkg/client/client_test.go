@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var target = Receipt{
+	Retailer:     "Target",
+	PurchaseDate: "2022-01-01",
+	PurchaseTime: "13:01",
+	Items:        []Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+	Total:        "6.49",
+}
+
+// answering serves status to every call and counts them
+func answering(t *testing.T, status int) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"code":"STORE_UNAVAILABLE","message":"down"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestProcessingIsNotRetriedAfterA503(t *testing.T) {
+	srv, calls := answering(t, http.StatusServiceUnavailable)
+	c := New(srv.URL, WithRetries(2, time.Millisecond))
+
+	// the store may have taken part of the write, a retry could mint a second id
+	if _, err := c.ProcessReceipt(context.Background(), target); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("got %v, want ErrUnavailable", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("process was sent %d times, want once", n)
+	}
+	// a lookup changes nothing, it's retried
+	calls.Store(0)
+	if _, err := c.GetPoints(context.Background(), "some-id"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("got %v, want ErrUnavailable", err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("lookup was sent %d times, want 3", n)
+	}
+}
+
+func TestProcessingIsRetriedAfterA429(t *testing.T) {
+	srv, calls := answering(t, http.StatusTooManyRequests)
+	c := New(srv.URL, WithRetries(2, time.Millisecond))
+
+	if _, err := c.ProcessReceipt(context.Background(), target); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("got %v, want ErrUnavailable", err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("process was sent %d times, want 3", n)
+	}
+}
+
+func TestProcessingSendsTheTimezone(t *testing.T) {
+	var sent map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = nil
+		if err := json.NewDecoder(r.Body).Decode(&sent); err != nil {
+			t.Errorf("decoding the request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"some-id","points":28}`))
+	}))
+	t.Cleanup(srv.Close)
+	c := New(srv.URL)
+
+	// the server checks the purchase date against the day it is in that zone
+	receipt := target
+	receipt.Timezone = "America/Los_Angeles"
+	if _, err := c.ProcessReceipt(context.Background(), receipt); err != nil {
+		t.Fatal(err)
+	}
+	if sent["timezone"] != "America/Los_Angeles" {
+		t.Errorf("sent timezone %v, want America/Los_Angeles", sent["timezone"])
+	}
+	// left out when empty, the server falls back to BUSINESS_TIMEZONE
+	if _, err := c.ProcessReceipt(context.Background(), target); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sent["timezone"]; ok {
+		t.Errorf("sent timezone %v for a receipt without one", sent["timezone"])
+	}
+}
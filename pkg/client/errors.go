@@ -0,0 +1,46 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrNotFound matches lookups for receipts that don't exist or have expired
+	ErrNotFound = errors.New("receipt not found")
+	// ErrInvalidReceipt matches receipts the server refused to process
+	ErrInvalidReceipt = errors.New("receipt is invalid")
+	// ErrUnavailable matches the server shedding load or its store being down
+	ErrUnavailable = errors.New("service unavailable")
+)
+
+// APIError is returned for any non-2xx response. Use errors.Is with the sentinel
+// errors above rather than switching on StatusCode.
+type APIError struct {
+	StatusCode int
+	// the server's machine-readable error code, e.g. "RECEIPT_NOT_FOUND". empty for
+	// errors the server answers in plain text
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+	// the server's id for the failed call, quote it when reporting a problem
+	RequestID string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("receipt processor responded %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrInvalidReceipt:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnavailable:
+		return e.StatusCode == http.StatusServiceUnavailable || e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
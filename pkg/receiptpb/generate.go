@@ -0,0 +1,6 @@
+// Package receiptpb has the protobuf receipt the process endpoints take as
+// application/x-protobuf, generated from receipt.proto. Clients in other languages can
+// generate theirs from the same file.
+package receiptpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative receipt.proto